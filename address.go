@@ -0,0 +1,226 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin"
+)
+
+const (
+	// defaultAPIPort is the port of the API when api.listen_addr has
+	// none.
+	defaultAPIPort = "8336"
+
+	// resolveTimeout bounds the lookup of a known peer's host name when
+	// Network.ResolveKnownPeers is set.
+	resolveTimeout = 10 * time.Second
+)
+
+// normalizeAddress checks that addr is a host and port and returns it in the
+// form net.Dial and net.Listen expect. Surrounding whitespace is trimmed, a
+// missing port is set to defaultPort and brackets are added to bare IPv6
+// addresses. An empty host, meaning every interface, is only allowed for
+// listen addresses, which may also use port 0 for any free port.
+func normalizeAddress(addr, defaultPort string, listen bool) (string,
+	error) {
+
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", errors.New("empty address")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Without a port the whole address is the host, which may be
+		// a bare or bracketed IPv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		if _, ipErr := netip.ParseAddr(host); ipErr != nil &&
+			strings.ContainsAny(host, ":[]") {
+
+			return "", fmt.Errorf("invalid address: %v", err)
+		}
+		port = defaultPort
+	}
+
+	_, ipErr := netip.ParseAddr(host)
+	switch {
+	case host == "" && !listen:
+		return "", errors.New("missing host")
+	case host != "" && ipErr != nil && !validHostName(host):
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (number == 0 && !listen) {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(number, 10)), nil
+}
+
+// validHostName reports whether name is a DNS host name: labels of letters,
+// digits, hyphens and underscores, as in the names of Docker containers, not
+// starting or ending with a hyphen.
+func validHostName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' ||
+			label[len(label)-1] == '-' {
+
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-' || c == '_') {
+
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeNodeURL checks that rawURL is the URL of a Bitcoin node, with or
+// without an http:// or https:// scheme, and sets a missing port to
+// defaultPort. An empty URL is localhost.
+func normalizeNodeURL(rawURL, defaultPort string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "http://" + net.JoinHostPort("localhost", defaultPort), nil
+	}
+
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	switch {
+	case !ok:
+		scheme, rest = "", rawURL
+	case scheme != "http" && scheme != "https":
+		return "", fmt.Errorf("unsupported scheme %q", scheme)
+	default:
+		scheme += "://"
+	}
+
+	host, path, _ := strings.Cut(rest, "/")
+	addr, err := normalizeAddress(host, defaultPort, false)
+	if err != nil {
+		return "", err
+	}
+	if path != "" {
+		addr += "/" + path
+	}
+	return scheme + addr, nil
+}
+
+// normalizeAddresses validates and normalizes the listen addresses and known
+// peers of cfg, see normalizeAddress, and the URLs of its Bitcoin nodes, see
+// normalizeNodeURL. The API's listen address is only checked if the API is
+// enabled. Known peers listed twice are rejected. With
+// Network.ResolveKnownPeers the host names of known peers are resolved and
+// replaced with their first address. Every invalid entry is reported, naming
+// its config key.
+func normalizeAddresses(ctx context.Context, cfg *config,
+	defaultPort string) error {
+
+	var errs []error
+	invalid := func(key, value string, err error) {
+		errs = append(errs, fmt.Errorf("%s %q: %v", key, value, err))
+	}
+
+	addr, err := normalizeAddress(cfg.Network.ListenAddr, defaultPort, true)
+	if err != nil {
+		invalid("network.listen_addr", cfg.Network.ListenAddr, err)
+	} else {
+		cfg.Network.ListenAddr = addr
+	}
+
+	if cfg.API.Enabled {
+		addr, err := normalizeAddress(cfg.API.ListenAddr, defaultAPIPort,
+			true)
+		if err != nil {
+			invalid("api.listen_addr", cfg.API.ListenAddr, err)
+		} else {
+			cfg.API.ListenAddr = addr
+		}
+	}
+
+	seen := make(map[string]string, len(cfg.Network.KnownPeers))
+	peers := make([]string, 0, len(cfg.Network.KnownPeers))
+	for i, peer := range cfg.Network.KnownPeers {
+		key := fmt.Sprintf("network.known_peers[%d]", i)
+		addr, err := normalizeAddress(peer, defaultPort, false)
+		if err == nil && cfg.Network.ResolveKnownPeers {
+			addr, err = resolveAddress(ctx, addr)
+		}
+		if err != nil {
+			invalid(key, peer, err)
+			continue
+		}
+		if first, ok := seen[addr]; ok {
+			invalid(key, peer, fmt.Errorf("duplicate of %s", first))
+			continue
+		}
+		seen[addr] = key
+		peers = append(peers, addr)
+	}
+	cfg.Network.KnownPeers = peers
+
+	// Nodes default to the RPC port of the chain, which serves REST too
+	rpcPort := bitcoin.Chain(cfg.Bitcoin.Chain).DefaultRPCPort()
+	nodeURL := func(key string, url *string, required bool) {
+		if required && strings.TrimSpace(*url) == "" {
+			invalid(key, *url, errors.New("missing URL"))
+			return
+		}
+		normalized, err := normalizeNodeURL(*url, rpcPort)
+		if err != nil {
+			invalid(key, *url, err)
+			return
+		}
+		*url = normalized
+	}
+	nodeURL("bitcoin.rpc_url", &cfg.Bitcoin.RPCURL, false)
+	nodeURL("bitcoin.rest_url", &cfg.Bitcoin.RESTURL, false)
+	for i := range cfg.Bitcoin.Endpoints {
+		endpoint := &cfg.Bitcoin.Endpoints[i]
+		key := fmt.Sprintf("bitcoin.endpoints[%d]", i)
+		if cfg.Bitcoin.Backend == bitcoin.BackendREST {
+			nodeURL(key+".rest_url", &endpoint.RESTURL, true)
+		} else {
+			nodeURL(key+".rpc_url", &endpoint.RPCURL, true)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// resolveAddress replaces the host name of addr, a normalized address, with
+// its first address.
+func resolveAddress(ctx context.Context, addr string) (string, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve host: %v", err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("host %s has no address", host)
+	}
+	return net.JoinHostPort(ips[0], port), nil
+}
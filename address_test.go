@@ -0,0 +1,169 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin"
+)
+
+// TestNormalizeAddress checks the addresses accepted for peers and listeners
+// and the form they are normalized to.
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		listen bool
+		want   string
+	}{
+		{addr: "10.0.0.1:9000", want: "10.0.0.1:9000"},
+		{addr: " 10.0.0.1:9000\t", want: "10.0.0.1:9000"},
+		{addr: "10.0.0.1", want: "10.0.0.1:8335"},
+		{addr: "example.com", want: "example.com:8335"},
+		{addr: "example.com.:9000", want: "example.com.:9000"},
+		{addr: "utxochat_node-1", want: "utxochat_node-1:8335"},
+		{addr: "example.com:09000", want: "example.com:9000"},
+		{addr: "::1", want: "[::1]:8335"},
+		{addr: "[::1]", want: "[::1]:8335"},
+		{addr: "[::1]:9000", want: "[::1]:9000"},
+		{addr: "2001:db8::1", want: "[2001:db8::1]:8335"},
+		{addr: "fe80::1%eth0", want: "[fe80::1%eth0]:8335"},
+		{addr: ":9000", listen: true, want: ":9000"},
+		{addr: "0.0.0.0", listen: true, want: "0.0.0.0:8335"},
+		{addr: "127.0.0.1:0", listen: true, want: "127.0.0.1:0"},
+
+		{addr: ""},
+		{addr: "   "},
+		{addr: ":9000"},
+		{addr: "10.0.0.1:0"},
+		{addr: "10.0.0.1:65536"},
+		{addr: "10.0.0.1:-1"},
+		{addr: "10.0.0.1:port"},
+		{addr: "10.0.0.1:9000:1"},
+		{addr: "[::1]:9000]"},
+		{addr: "bad host:9000"},
+		{addr: "-example.com"},
+		{addr: "example-.com"},
+		{addr: "example..com"},
+		{addr: "http://example.com"},
+		{addr: strings.Repeat("a", 64) + ".com"},
+	}
+	for _, test := range tests {
+		got, err := normalizeAddress(test.addr, "8335", test.listen)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("normalizeAddress(%q, %v) = %q, want an error",
+					test.addr, test.listen, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeAddress(%q, %v) = %q, %v, want %q",
+				test.addr, test.listen, got, err, test.want)
+		}
+	}
+}
+
+// TestNormalizeNodeURL checks the URLs accepted for Bitcoin nodes.
+func TestNormalizeNodeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"", "http://localhost:8332"},
+		{" ", "http://localhost:8332"},
+		{"127.0.0.1", "127.0.0.1:8332"},
+		{"node:18443", "node:18443"},
+		{"http://node", "http://node:8332"},
+		{"https://[::1]", "https://[::1]:8332"},
+		{"http://node:18443/wallet/chat", "http://node:18443/wallet/chat"},
+
+		{"ftp://node", ""},
+		{"http://:8332", ""},
+		{"http://node:99999", ""},
+		{"http://bad host", ""},
+	}
+	for _, test := range tests {
+		got, err := normalizeNodeURL(test.url, "8332")
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("normalizeNodeURL(%q) = %q, want an error",
+					test.url, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeNodeURL(%q) = %q, %v, want %q", test.url,
+				got, err, test.want)
+		}
+	}
+}
+
+// TestNormalizeAddresses checks that the addresses of a config are
+// normalized in place, and that every invalid one is reported with its key.
+func TestNormalizeAddresses(t *testing.T) {
+	var cfg config
+	cfg.Network.ListenAddr = " 0.0.0.0 "
+	cfg.Network.KnownPeers = []string{"10.0.0.1", "::1", "10.0.0.2:8335"}
+	cfg.API.Enabled = true
+	cfg.API.ListenAddr = "127.0.0.1"
+	cfg.Bitcoin.Chain = string(bitcoin.ChainRegtest)
+	cfg.Bitcoin.RPCURL = "bitcoind"
+	cfg.Bitcoin.Endpoints = []bitcoinEndpoint{{RPCURL: "http://backup"}}
+
+	err := normalizeAddresses(context.Background(), &cfg, "18446")
+	if err != nil {
+		t.Fatalf("normalizeAddresses: %v", err)
+	}
+	if cfg.Network.ListenAddr != "0.0.0.0:18446" ||
+		cfg.API.ListenAddr != "127.0.0.1:8336" ||
+		cfg.Bitcoin.RPCURL != "bitcoind:18443" ||
+		cfg.Bitcoin.Endpoints[0].RPCURL != "http://backup:18443" {
+
+		t.Fatalf("normalized to %q, %q, %q and %q", cfg.Network.ListenAddr,
+			cfg.API.ListenAddr, cfg.Bitcoin.RPCURL,
+			cfg.Bitcoin.Endpoints[0].RPCURL)
+	}
+	want := []string{"10.0.0.1:18446", "[::1]:18446", "10.0.0.2:8335"}
+	if !reflect.DeepEqual(cfg.Network.KnownPeers, want) {
+		t.Fatalf("known peers normalized to %q, want %q",
+			cfg.Network.KnownPeers, want)
+	}
+
+	var bad config
+	bad.Network.ListenAddr = "0.0.0.0:port"
+	bad.Network.KnownPeers = []string{"10.0.0.1", "10.0.0.1:18446",
+		":18446", "10.0.0.2"}
+	bad.API.ListenAddr = "not checked:port"
+	bad.Bitcoin.Chain = string(bitcoin.ChainRegtest)
+	bad.Bitcoin.Endpoints = []bitcoinEndpoint{{}}
+
+	err = normalizeAddresses(context.Background(), &bad, "18446")
+	if err == nil {
+		t.Fatal("invalid addresses accepted")
+	}
+	for _, key := range []string{
+		`network.listen_addr "0.0.0.0:port"`,
+		`network.known_peers[1] "10.0.0.1:18446": duplicate of ` +
+			`network.known_peers[0]`,
+		`network.known_peers[2] ":18446": missing host`,
+		`bitcoin.endpoints[0].rpc_url "": missing URL`,
+	} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error doesn't report %s:\n%v", key, err)
+		}
+	}
+	if strings.Contains(err.Error(), "api.listen_addr") {
+		t.Errorf("listen address of the disabled API checked:\n%v", err)
+	}
+	want = []string{"10.0.0.1:18446", "10.0.0.2:18446"}
+	if !reflect.DeepEqual(bad.Network.KnownPeers, want) {
+		t.Fatalf("valid known peers are %q, want %q",
+			bad.Network.KnownPeers, want)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// TokenFileName is the name of the file in the data directory holding the
+// token generated for the API when none is configured.
+const TokenFileName = "api.token"
+
+// tokenSize is the number of random bytes of a generated token.
+const tokenSize = 32
+
+// statsPaths are the endpoints exempted from authentication with
+// Config.PublicStats.
+var statsPaths = []string{"/debug/stats"}
+
+// LoadToken returns the token stored in the token file of dataDir, creating
+// the file with a new random token on first use. Like the cookie file of
+// bitcoind, only the user running the node can read it.
+func LoadToken(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, TokenFileName)
+	token, err := ReadToken(dataDir)
+	if err != nil || token != "" {
+		return token, err
+	}
+
+	var buf [tokenSize]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("failed to generate API token: %v", err)
+	}
+	token = hex.EncodeToString(buf[:])
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write API token: %v", err)
+	}
+	log.Infof("Generated API token in %s", path)
+	return token, nil
+}
+
+// ReadToken returns the token stored in the token file of dataDir, empty if
+// there is none.
+func ReadToken(dataDir string) (string, error) {
+	path := filepath.Join(dataDir, TokenFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read API token: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// authenticate wraps next with the CORS headers for the allowed origins and
+// a check of the bearer token on every request. Requests without the token
+// get a bare 401. Preflight requests are answered without the token, which
+// browsers don't send with them.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && s.allowsOrigin(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != "" {
+
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods",
+				"GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers",
+				"Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if s.config.PublicStats && slices.Contains(statsPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r carries the API token. Every request is
+// authorized when no token is configured. Browsers can't set headers on
+// websocket requests, which may pass the token in the access_token query
+// parameter instead.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.config.Token == "" {
+		return true
+	}
+
+	var token string
+	scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case ok && strings.EqualFold(scheme, "Bearer"):
+		token = value
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		token = r.URL.Query().Get("access_token")
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token),
+		[]byte(s.config.Token)) == 1
+}
+
+// allowsOrigin reports whether browser frontends served from origin may call
+// the API.
+func (s *Server) allowsOrigin(origin string) bool {
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// testToken is the API token of the servers under test.
+const testToken = "secret"
+
+// newTestServer returns a server on a manager that isn't started, backed by
+// a mock Bitcoin node and an in-memory database.
+func newTestServer(t *testing.T, config Config) (*Server, *mock.Client) {
+	t.Helper()
+
+	client := mock.NewClient()
+	db := database.NewMemoryDB()
+	manager, err := network.NewManager(network.NewDefaultConfig(),
+		database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	return NewServerWithConfig(manager, nil, db, config), client
+}
+
+// TestAuthenticate checks that requests are only served with the token, and
+// that PublicStats exempts the statistics alone.
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		publicStats   bool
+		path          string
+		authorization string
+		want          int
+	}{
+		{"missing token", false, "/v1/limits", "", http.StatusUnauthorized},
+		{"wrong token", false, "/v1/limits", "Bearer wrong",
+			http.StatusUnauthorized},
+		{"other scheme", false, "/v1/limits", "Basic " + testToken,
+			http.StatusUnauthorized},
+		{"correct token", false, "/v1/limits", "Bearer " + testToken,
+			http.StatusOK},
+		{"scheme case", false, "/v1/limits", "bearer " + testToken,
+			http.StatusOK},
+
+		{"stats missing token", false, "/debug/stats", "",
+			http.StatusUnauthorized},
+		{"stats wrong token", false, "/debug/stats", "Bearer wrong",
+			http.StatusUnauthorized},
+		{"stats correct token", false, "/debug/stats",
+			"Bearer " + testToken, http.StatusOK},
+
+		{"public stats missing token", true, "/debug/stats", "",
+			http.StatusOK},
+		{"public stats wrong token", true, "/debug/stats", "Bearer wrong",
+			http.StatusOK},
+		{"public stats correct token", true, "/debug/stats",
+			"Bearer " + testToken, http.StatusOK},
+		{"public stats other path", true, "/v1/limits", "",
+			http.StatusUnauthorized},
+		{"public stats unknown path", true, "/metrics", "",
+			http.StatusUnauthorized},
+		{"public stats other path with token", true, "/v1/limits",
+			"Bearer " + testToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestServer(t, Config{
+				Token:       testToken,
+				PublicStats: test.publicStats,
+			})
+
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d", w.Code, test.want)
+			}
+			if w.Code == http.StatusUnauthorized &&
+				w.Header().Get("WWW-Authenticate") != "Bearer" {
+
+				t.Fatal("401 without a Bearer challenge")
+			}
+		})
+	}
+}
+
+// TestAuthenticateNoToken checks that every request is served when no token
+// is configured.
+func TestAuthenticateNoToken(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	r := httptest.NewRequest(http.MethodGet, "/v1/limits", nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// maxBlockRequestSize is the largest blocklist request body accepted.
+const maxBlockRequestSize = 1024
+
+// blockRequest is the JSON body of a blocklist change. Exactly one of the
+// fields is set.
+type blockRequest struct {
+	PubKey   string `json:"pubkey"`
+	Outpoint string `json:"outpoint"`
+}
+
+// parseBlockRequest decodes a blocklist change, returning either the x-only
+// taproot output key or the outpoint it is about.
+func parseBlockRequest(w http.ResponseWriter, r *http.Request) (
+	[]byte, *message.Outpoint, error) {
+
+	var req blockRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBlockRequestSize))
+	if err := dec.Decode(&req); err != nil {
+		return nil, nil, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	switch {
+	case req.PubKey != "" && req.Outpoint != "":
+		return nil, nil, errors.New("expected either pubkey or outpoint")
+
+	case req.PubKey != "":
+		pubKey, err := hex.DecodeString(req.PubKey)
+		if err != nil || len(pubKey) != 32 {
+			return nil, nil, fmt.Errorf(
+				"invalid pubkey %q: expected 32 hex encoded bytes",
+				req.PubKey)
+		}
+		return pubKey, nil, nil
+
+	case req.Outpoint != "":
+		outpoint, err := message.ParseOutpoint(req.Outpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &outpoint, nil
+
+	default:
+		return nil, nil, errors.New("expected pubkey or outpoint")
+	}
+}
+
+// handleListBlocked returns the blocked senders and outpoints.
+func (s *Server) handleListBlocked(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.manager.ListBlocked())
+}
+
+// handleBlock blocks the sender or outpoint in the request body. The stored
+// messages it covers are purged and new ones are no longer stored or relayed.
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	pubKey, outpoint, err := parseBlockRequest(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if pubKey != nil {
+		err = s.manager.BlockPubKey(r.Context(), pubKey)
+	} else {
+		err = s.manager.BlockOutpoint(r.Context(), *outpoint)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.manager.ListBlocked())
+}
+
+// handleUnblock unblocks the sender or outpoint in the request body.
+func (s *Server) handleUnblock(w http.ResponseWriter, r *http.Request) {
+	pubKey, outpoint, err := parseBlockRequest(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if pubKey != nil {
+		err = s.manager.UnblockPubKey(pubKey)
+	} else {
+		err = s.manager.UnblockOutpoint(*outpoint)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, network.ErrNotBlocked) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.manager.ListBlocked())
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// TestBlocklist checks that blocking a sender through the API purges its
+// message and refuses new ones, that the blocklist is listed and that
+// unblocking lets its messages in again.
+func TestBlocklist(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	first := message.NewOutpoint(chainhash.Hash{1}, 0)
+	pubKey := postSigned(t, s, client, 5, first, "hello")
+	body := []byte(`{"pubkey":"` + hex.EncodeToString(pubKey) + `"}`)
+
+	var list network.Blocklist
+	serveJSON(t, s, http.MethodPost, "/v1/blocklist", body, http.StatusOK,
+		&list)
+	if len(list.PubKeys) != 1 || list.PubKeys[0] != hex.EncodeToString(pubKey) {
+		t.Fatalf("blocklist is %+v after blocking", list)
+	}
+	var errResp errorResponse
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+outpointPath(first), nil,
+		http.StatusNotFound, &errResp)
+
+	second := message.NewOutpoint(chainhash.Hash{2}, 0)
+	msg := signTestMessage(t, client, second, "blocked")
+	serveJSON(t, s, http.MethodPost, "/v1/messages",
+		[]byte(hex.EncodeToString(msg.Serialize())), http.StatusForbidden,
+		&errResp)
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+outpointPath(second), nil,
+		http.StatusNotFound, &errResp)
+
+	serveJSON(t, s, http.MethodGet, "/v1/blocklist", nil, http.StatusOK, &list)
+	if len(list.PubKeys) != 1 {
+		t.Fatalf("listed %+v", list)
+	}
+	serveJSON(t, s, http.MethodDelete, "/v1/blocklist", body, http.StatusOK,
+		&list)
+	if len(list.PubKeys) != 0 {
+		t.Fatalf("blocklist is %+v after unblocking", list)
+	}
+	serveJSON(t, s, http.MethodDelete, "/v1/blocklist", body,
+		http.StatusNotFound, &errResp)
+
+	third := message.NewOutpoint(chainhash.Hash{3}, 0)
+	postSigned(t, s, client, 5, third, "unblocked")
+
+	for _, body := range []string{`{}`, `{"pubkey":"abcd"}`,
+		`{"outpoint":"nope"}`, `{"pubkey":"` + hex.EncodeToString(pubKey) +
+			`","outpoint":"` + first.ToString() + `"}`} {
+
+		serveJSON(t, s, http.MethodPost, "/v1/blocklist", []byte(body),
+			http.StatusBadRequest, &errResp)
+	}
+}
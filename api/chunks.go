@@ -0,0 +1,120 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// chunkResponse is the JSON representation of the chunk a structured
+// payload carries. Its data is part of the message payload.
+type chunkResponse struct {
+	Group string `json:"group"`
+	Index uint16 `json:"index"`
+	Total uint16 `json:"total"`
+}
+
+// chunksResponse is the JSON representation of the stored chunks of a
+// group, along with the joined payload once every chunk is stored.
+type chunksResponse struct {
+	Group     string   `json:"group"`
+	Total     uint16   `json:"total"`
+	Complete  bool     `json:"complete"`
+	Missing   []uint16 `json:"missing,omitempty"`
+	Outpoints []string `json:"outpoints"`
+
+	ContentType string `json:"content_type,omitempty"`
+	Length      int    `json:"length"`
+	Payload     string `json:"payload,omitempty"`
+	PayloadHex  string `json:"payload_hex,omitempty"`
+}
+
+// limitsResponse is the JSON representation of message.Limits, the sizes
+// clients check messages against before signing them.
+type limitsResponse struct {
+	MaxPayloadSize int `json:"max_payload_size"`
+	MaxMessageSize int `json:"max_message_size"`
+}
+
+// handleGetChunks returns the stored chunks of the group in the path, hex
+// encoded, and their joined payload once every chunk is stored. Chunks may
+// have been stored in any order.
+func (s *Server) handleGetChunks(w http.ResponseWriter, r *http.Request) {
+	group, err := message.ParseChunkGroup(r.PathValue("group"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := s.db.GetChunkGroup(r.Context(), group)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("no chunks of group %s", group))
+		return
+	}
+
+	resp := &chunksResponse{
+		Group:     group.String(),
+		Outpoints: make([]string, 0, len(entries)),
+	}
+	chunks := make([]*message.Chunk, 0, len(entries))
+	for _, entry := range entries {
+		msg, err := message.Deserialize(entry.Data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		payload, err := message.ParsePayload(msg.Payload)
+		if err != nil || payload.Chunk == nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf(
+				"message %s carries no chunk", entry.Outpoint.ToString()))
+			return
+		}
+		chunks = append(chunks, payload.Chunk)
+		resp.Outpoints = append(resp.Outpoints, entry.Outpoint.ToString())
+	}
+	resp.Total = chunks[0].Total
+
+	contentType, joined, err := message.JoinChunks(chunks)
+	switch {
+	case errors.Is(err, message.ErrIncompleteChunks):
+		resp.Missing = message.MissingChunks(chunks)
+		writeJSON(w, http.StatusOK, resp)
+		return
+
+	case err != nil:
+		// Anyone can post a chunk claiming any group
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	resp.Complete = true
+	resp.ContentType = contentType.String()
+	resp.Length = len(joined)
+	resp.PayloadHex = hex.EncodeToString(joined)
+	switch contentType {
+	case message.ContentTypeText, message.ContentTypeJSON:
+		resp.Payload = string(joined)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetLimits returns the size limits of the messages the node accepts.
+func (s *Server) handleGetLimits(w http.ResponseWriter, r *http.Request) {
+	limits := s.manager.Limits()
+	writeJSON(w, http.StatusOK, &limitsResponse{
+		MaxPayloadSize: limits.PayloadCap(),
+		MaxMessageSize: limits.MessageCap(),
+	})
+}
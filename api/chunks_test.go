@@ -0,0 +1,80 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// TestGetChunks checks that the chunks of a payload posted out of order are
+// listed with the missing ones until the last arrives, and then returned
+// joined.
+func TestGetChunks(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+	limits := message.Limits{MaxPayloadSize: 200}
+
+	key, pkScript := senderKey(t, 5)
+	var outpoints []message.Outpoint
+	for i := 0; i < 3; i++ {
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+		outpoints = append(outpoints, outpoint)
+	}
+	payload := bytes.Repeat([]byte("x"),
+		2*message.ChunkCapacity(limits.PayloadCap())+1)
+	msgs, err := signer.SignChunks(key, signer.AddressTaproot, outpoints,
+		message.ContentTypeText, payload, limits)
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("SignChunks: %d chunks, %v", len(msgs), err)
+	}
+	parsed, err := message.ParsePayload(msgs[0].Payload)
+	if err != nil {
+		t.Fatalf("ParsePayload: %v", err)
+	}
+	path := "/v1/chunks/" + parsed.Chunk.Group.String()
+
+	var errResp errorResponse
+	serveJSON(t, s, http.MethodGet, path, nil, http.StatusNotFound,
+		&errResp)
+
+	post := func(msg *message.Message) {
+		t.Helper()
+		var resp messageResponse
+		serveJSON(t, s, http.MethodPost, "/v1/messages",
+			[]byte(hex.EncodeToString(msg.Serialize())),
+			http.StatusCreated, &resp)
+	}
+	post(msgs[2])
+	post(msgs[0])
+	var partial chunksResponse
+	serveJSON(t, s, http.MethodGet, path, nil, http.StatusOK, &partial)
+	if partial.Complete || partial.Total != 3 ||
+		!slices.Equal(partial.Missing, []uint16{1}) ||
+		len(partial.Outpoints) != 2 || partial.Payload != "" {
+
+		t.Fatalf("2 of 3 chunks gave %+v", partial)
+	}
+
+	post(msgs[1])
+	var joined chunksResponse
+	serveJSON(t, s, http.MethodGet, path, nil, http.StatusOK, &joined)
+	if !joined.Complete || len(joined.Missing) != 0 ||
+		joined.ContentType != message.ContentTypeText.String() ||
+		joined.Length != len(payload) || joined.Payload != string(payload) {
+
+		t.Fatalf("all chunks gave %+v", joined)
+	}
+
+	serveJSON(t, s, http.MethodGet, "/v1/chunks/abcd", nil,
+		http.StatusBadRequest, &errResp)
+}
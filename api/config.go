@@ -0,0 +1,30 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+// Config holds configuration options for the HTTP API server.
+type Config struct {
+	// ListenAddr is the address the API server listens on.
+	ListenAddr string
+
+	// Token is the bearer token every request must carry in its
+	// Authorization header. Empty disables authentication.
+	Token string
+
+	// PublicStats exempts the statistics endpoints from authentication,
+	// for metrics scrapers.
+	PublicStats bool
+
+	// AllowedOrigins are the origins of browser frontends allowed to call
+	// the API, "*" for any. Empty allows none.
+	AllowedOrigins []string
+}
+
+// DefaultConfig returns the default configuration for the API server.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr: "127.0.0.1:8336",
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/shaibearary/utxo_chat/database"
+)
+
+// keyspaceResponse is the JSON representation of database.KeyspaceStats.
+type keyspaceResponse struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// dbStatsResponse is the JSON representation of database.Stats.
+type dbStatsResponse struct {
+	Outpoints  keyspaceResponse `json:"outpoints"`
+	Messages   keyspaceResponse `json:"messages"`
+	Indexes    keyspaceResponse `json:"indexes"`
+	Archive    keyspaceResponse `json:"archive"`
+	Expired    keyspaceResponse `json:"expired"`
+	Undo       keyspaceResponse `json:"undo"`
+	Tombstones keyspaceResponse `json:"tombstones"`
+}
+
+// newDBStatsResponse converts database statistics to their JSON
+// representation.
+func newDBStatsResponse(stats *database.Stats) *dbStatsResponse {
+	return &dbStatsResponse{
+		Outpoints:  keyspaceResponse(stats.Outpoints),
+		Messages:   keyspaceResponse(stats.Messages),
+		Indexes:    keyspaceResponse(stats.Indexes),
+		Archive:    keyspaceResponse(stats.Archive),
+		Expired:    keyspaceResponse(stats.Expired),
+		Undo:       keyspaceResponse(stats.Undo),
+		Tombstones: keyspaceResponse(stats.Tombstones),
+	}
+}
+
+// handleDBStats returns the number of entries and the approximate size of
+// each keyspace of the database.
+func (s *Server) handleDBStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.db.Stats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newDBStatsResponse(stats))
+}
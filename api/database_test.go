@@ -0,0 +1,48 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestDBStats checks that the database stats count the stored messages and
+// the known outpoints.
+func TestDBStats(t *testing.T) {
+	s, _ := newTestServer(t, Config{Token: testToken})
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		if err := s.db.AddOutpoint(ctx, outpoint); err != nil {
+			t.Fatalf("AddOutpoint: %v", err)
+		}
+	}
+	msg := message.Message{
+		Outpoint:    message.NewOutpoint(chainhash.Hash{1}, 0),
+		ContentType: message.ContentTypeText,
+		Length:      5,
+		Payload:     []byte("hello"),
+	}
+	err := s.db.AddMessage(ctx, msg.Outpoint, msg.Serialize(),
+		database.MessageMeta{})
+	if err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+
+	var resp dbStatsResponse
+	serveJSON(t, s, http.MethodGet, "/v1/db/stats", nil, http.StatusOK,
+		&resp)
+	if resp.Outpoints.Entries != 3 || resp.Messages.Entries != 1 ||
+		resp.Messages.Bytes == 0 {
+
+		t.Fatalf("got %+v", resp)
+	}
+}
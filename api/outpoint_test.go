@@ -0,0 +1,107 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// serveJSON sends a request with the test token to s and decodes the JSON
+// response into resp, failing the test unless it has the wanted status.
+func serveJSON(t *testing.T, s *Server, method, path string, body []byte,
+	want int, resp any) {
+
+	t.Helper()
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != want {
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, path, w.Code,
+			want, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+}
+
+// TestOutpointRoundTrip checks that an outpoint with a vout above 255 keeps
+// its txid and vout from its text form through signing, the UTXO lookup,
+// storage and the API routes.
+func TestOutpointRoundTrip(t *testing.T) {
+	const txid = "4a5e1e4baab89f3a32518a88c31bc87f" +
+		"618f76673e2cc77ab2127b7afdeda33b"
+
+	outpoint, err := message.ParseOutpoint(txid + ":300")
+	if err != nil {
+		t.Fatalf("ParseOutpoint: %v", err)
+	}
+	wireOutpoint := outpoint.WireOutPoint()
+	if wireOutpoint.Hash.String() != txid || wireOutpoint.Index != 300 {
+		t.Fatalf("wire outpoint is %v", wireOutpoint)
+	}
+
+	s, client := newTestServer(t, Config{Token: testToken})
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{3}, 32))
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AddUTXO(wireOutpoint, 50000, pkScript)
+
+	msg, err := signer.SignMessage(key, outpoint, message.ContentTypeText,
+		[]byte("hello"))
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	body := []byte(hex.EncodeToString(msg.Serialize()))
+
+	var posted, fetched messageResponse
+	serveJSON(t, s, http.MethodPost, "/v1/messages", body,
+		http.StatusCreated, &posted)
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+txid+"/300", nil,
+		http.StatusOK, &fetched)
+	for _, resp := range []messageResponse{posted, fetched} {
+		if resp.Outpoint != txid+":300" || resp.Txid != txid ||
+			resp.Vout != 300 || resp.Payload != "hello" {
+
+			t.Fatalf("got outpoint %s, txid %s, vout %d, payload %q",
+				resp.Outpoint, resp.Txid, resp.Vout, resp.Payload)
+		}
+	}
+
+	// Only the exact outpoint is known, not one with the vout truncated
+	// to a byte or the txid in the other byte order
+	reversed, _ := hex.DecodeString(txid)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for path, want := range map[string]bool{
+		txid + "/300":                         true,
+		txid + "/44":                          false,
+		hex.EncodeToString(reversed) + "/300": false,
+	} {
+		var resp outpointResponse
+		serveJSON(t, s, http.MethodGet, "/v1/outpoints/"+path, nil,
+			http.StatusOK, &resp)
+		if resp.Known != want ||
+			resp.Outpoint != strings.Replace(path, "/", ":", 1) {
+
+			t.Fatalf("outpoint %s reported as %s known %v", path,
+				resp.Outpoint, resp.Known)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// rejectResponse is the JSON representation of network.RejectEntry, with the
+// recorded payload bytes hex encoded.
+type rejectResponse struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Outpoint    string    `json:"outpoint,omitempty"`
+	Reason      string    `json:"reason"`
+	Error       string    `json:"error"`
+	PayloadHex  string    `json:"payload_hex,omitempty"`
+	PayloadSize int       `json:"payload_size"`
+}
+
+// rejectsResponse is the JSON representation of the reject journal.
+type rejectsResponse struct {
+	Rejects []*rejectResponse `json:"rejects"`
+
+	// Dropped is the number of rejections left out of the journal
+	// because they came faster than it could be written.
+	Dropped uint64 `json:"dropped"`
+}
+
+// handleListRejects returns the recently rejected messages, newest first.
+// The optional reason query parameter, the name of a reject code such as
+// invalid-signature, and peer, the address of a peer, select the messages
+// rejected for that reason or sent by that peer, and limit caps their number.
+func (s *Server) handleListRejects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var limit int
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q", value))
+			return
+		}
+	}
+
+	entries, dropped := s.manager.RecentRejects(query.Get("reason"),
+		query.Get("peer"), limit)
+	resp := &rejectsResponse{
+		Rejects: make([]*rejectResponse, 0, len(entries)),
+		Dropped: dropped,
+	}
+	for _, entry := range entries {
+		resp.Rejects = append(resp.Rejects, newRejectResponse(&entry))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// newRejectResponse converts a reject journal entry to its JSON
+// representation.
+func newRejectResponse(entry *network.RejectEntry) *rejectResponse {
+	return &rejectResponse{
+		Time:        entry.Time.UTC(),
+		Source:      entry.Source,
+		Outpoint:    entry.Outpoint,
+		Reason:      entry.Reason,
+		Error:       entry.Error,
+		PayloadHex:  hex.EncodeToString(entry.Payload),
+		PayloadSize: entry.PayloadSize,
+	}
+}
@@ -0,0 +1,779 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+const (
+	// maxBodySize is the largest request body accepted. It leaves room for
+	// a hex encoded message of the maximum size.
+	maxBodySize = 2*message.MaxMessageSize + 2
+
+	// shutdownTimeout is the maximum time to wait for in-flight requests
+	// when the server is stopped.
+	shutdownTimeout = 5 * time.Second
+)
+
+// Server is an HTTP server exposing a REST API for submitting and reading
+// messages. It shares the network manager and database of the node so
+// submitted messages go through the same validation and relay path as
+// messages delivered by peers.
+type Server struct {
+	config  Config
+	manager *network.Manager
+	chain   *blockchain.Handler
+	db      database.Database
+
+	server   *http.Server
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	// quit is closed when the server shuts down, ending the websocket
+	// connections, which Shutdown doesn't track.
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewServer creates a new API server. chain may be nil, in which case no
+// blockchain statistics are reported.
+func NewServer(manager *network.Manager, chain *blockchain.Handler,
+	db database.Database) *Server {
+
+	return NewServerWithConfig(manager, chain, db, DefaultConfig())
+}
+
+// NewServerWithConfig creates a new API server with the specified
+// configuration.
+func NewServerWithConfig(manager *network.Manager, chain *blockchain.Handler,
+	db database.Database, config Config) *Server {
+
+	s := &Server{
+		config:  config,
+		manager: manager,
+		chain:   chain,
+		db:      db,
+		quit:    make(chan struct{}),
+	}
+	s.server = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.server.RegisterOnShutdown(func() {
+		s.quitOnce.Do(func() { close(s.quit) })
+	})
+	return s
+}
+
+// Handler returns the HTTP handler serving the API routes to authenticated
+// requests.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/messages", s.handlePostMessage)
+	mux.HandleFunc("POST /v1/messages/validate", s.handleValidateMessage)
+	mux.HandleFunc("GET /v1/messages", s.handleListMessages)
+	mux.HandleFunc("GET /v1/messages/{txid}/{vout}", s.handleGetMessage)
+	mux.HandleFunc("GET /v1/messages/{txid}/{vout}/thread", s.handleGetThread)
+	mux.HandleFunc("GET /v1/chunks/{group}", s.handleGetChunks)
+	mux.HandleFunc("GET /v1/outpoints/{txid}/{vout}", s.handleGetOutpoint)
+	mux.HandleFunc("GET /v1/senders/{pubkey}/messages", s.handleListSenderMessages)
+	mux.HandleFunc("GET /v1/peers", s.handleListPeers)
+	mux.HandleFunc("GET /v1/peers/known", s.handleListKnownPeers)
+	mux.HandleFunc("GET /v1/rejects", s.handleListRejects)
+	mux.HandleFunc("GET /v1/blocklist", s.handleListBlocked)
+	mux.HandleFunc("POST /v1/blocklist", s.handleBlock)
+	mux.HandleFunc("DELETE /v1/blocklist", s.handleUnblock)
+	mux.HandleFunc("GET /v1/trusted", s.handleListTrusted)
+	mux.HandleFunc("POST /v1/trusted", s.handleTrust)
+	mux.HandleFunc("DELETE /v1/trusted", s.handleDistrust)
+	mux.HandleFunc("GET /v1/whitelist", s.handleGetWhitelist)
+	mux.HandleFunc("PUT /v1/whitelist", s.handleSetWhitelist)
+	mux.HandleFunc("GET /v1/subscribe", s.handleSubscribe)
+	mux.HandleFunc("GET /v1/events", s.handleListEvents)
+	mux.HandleFunc("GET /v1/export", s.handleExport)
+	mux.HandleFunc("POST /v1/import", s.handleImport)
+	mux.HandleFunc("POST /v1/revalidate", s.handleRevalidate)
+	mux.HandleFunc("GET /v1/db/stats", s.handleDBStats)
+	mux.HandleFunc("GET /v1/limits", s.handleGetLimits)
+	mux.Handle("GET /debug/stats", NewStatsHandler(s.manager, s.chain))
+	return s.authenticate(mux)
+}
+
+// Start starts listening for API requests. The server shuts down when ctx is
+// canceled or Stop is called.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.config.ListenAddr, err)
+	}
+	s.listener = listener
+
+	log.Infof("API server listening on %s", listener.Addr())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(listener); err != nil &&
+			!errors.Is(err, http.ErrServerClosed) {
+
+			log.Errorf("API server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.shutdown()
+	}()
+
+	return nil
+}
+
+// Stop shuts down the API server and waits for it to exit.
+func (s *Server) Stop() error {
+	err := s.shutdown()
+	s.wg.Wait()
+	return err
+}
+
+// shutdown gracefully stops the HTTP server.
+func (s *Server) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
+
+// messageResponse is the JSON representation of a stored message.
+type messageResponse struct {
+	Outpoint    string   `json:"outpoint"`
+	Txid        string   `json:"txid"`
+	Vout        uint32   `json:"vout"`
+	Signature   string   `json:"signature"`
+	Witness     []string `json:"witness,omitempty"`
+	ContentType string   `json:"content_type"`
+	Length      uint16   `json:"length"`
+	Sequence    uint32   `json:"sequence"`
+	Payload     string   `json:"payload,omitempty"`
+	PayloadHex  string   `json:"payload_hex"`
+	Validated   bool     `json:"validated"`
+
+	// Channel, ReplyTo, Body, Expiry and Chunk are the fields of a
+	// structured payload.
+	Channel string         `json:"channel,omitempty"`
+	ReplyTo string         `json:"reply_to,omitempty"`
+	Body    string         `json:"body,omitempty"`
+	Expiry  *time.Time     `json:"expiry,omitempty"`
+	Chunk   *chunkResponse `json:"chunk,omitempty"`
+
+	ReceivedAt   *time.Time `json:"received_at,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	ValidationMs float64    `json:"validation_ms,omitempty"`
+	PubKey       string     `json:"pubkey,omitempty"`
+
+	// ValidatedHeight is the chain height the signature was verified at.
+	ValidatedHeight int32 `json:"validated_height,omitempty"`
+
+	// Dangling is set for a reply whose parent no peer had.
+	Dangling bool `json:"dangling,omitempty"`
+}
+
+// newMessageResponse builds the JSON representation of msg and its metadata,
+// which may be nil. Messages are reported as validated unless they were
+// stored without verifying their signature, as imported after their UTXO was
+// spent.
+func newMessageResponse(msg *message.Message,
+	meta *database.MessageMeta) *messageResponse {
+
+	txid, vout := msg.Outpoint.ToTxidIdx()
+	resp := &messageResponse{
+		Outpoint:    msg.Outpoint.ToString(),
+		Txid:        txid.String(),
+		Vout:        vout,
+		Signature:   hex.EncodeToString(msg.Signature[:]),
+		ContentType: msg.ContentType.String(),
+		Length:      msg.Length,
+		Sequence:    msg.Sequence,
+		PayloadHex:  hex.EncodeToString(msg.Payload),
+		Validated:   true,
+	}
+	for _, item := range msg.Witness {
+		resp.Witness = append(resp.Witness, hex.EncodeToString(item))
+	}
+	switch msg.ContentType {
+	case message.ContentTypeText, message.ContentTypeJSON:
+		resp.Payload = string(msg.Payload)
+	}
+	if payload, err := message.ParsePayload(msg.Payload); err == nil {
+		resp.Channel = payload.Channel
+		resp.Body = payload.Body
+		if payload.ReplyTo != nil {
+			resp.ReplyTo = payload.ReplyTo.ToString()
+		}
+		if !payload.Expiry.IsZero() {
+			expiry := payload.Expiry.UTC()
+			resp.Expiry = &expiry
+		}
+		if chunk := payload.Chunk; chunk != nil {
+			resp.Chunk = &chunkResponse{
+				Group: chunk.Group.String(),
+				Index: chunk.Index,
+				Total: chunk.Total,
+			}
+		}
+	}
+	if meta != nil {
+		receivedAt := meta.ReceivedAt.UTC()
+		resp.ReceivedAt = &receivedAt
+		resp.Source = meta.Source
+		resp.ValidationMs = float64(meta.ValidationTime) /
+			float64(time.Millisecond)
+		if meta.PubKey != nil {
+			resp.PubKey = hex.EncodeToString(meta.PubKey)
+		}
+		resp.Validated = meta.SignatureValid
+		resp.ValidatedHeight = meta.ValidatedHeight
+	}
+	return resp
+}
+
+// describeMessage is newMessageResponse with replies whose parent couldn't be
+// fetched from any peer marked as dangling.
+func (s *Server) describeMessage(msg *message.Message,
+	meta *database.MessageMeta) *messageResponse {
+
+	resp := newMessageResponse(msg, meta)
+	if meta != nil && meta.ReplyTo != nil {
+		resp.Dangling = s.manager.ParentMissing(*meta.ReplyTo)
+	}
+	return resp
+}
+
+// listResponse is the JSON representation of a page of messages.
+type listResponse struct {
+	Messages []*messageResponse `json:"messages"`
+	Cursor   string             `json:"cursor"`
+}
+
+// threadResponse is the JSON representation of a thread of replies.
+type threadResponse struct {
+	Root     string             `json:"root"`
+	Messages []*messageResponse `json:"messages"`
+}
+
+// senderResponse is the JSON representation of the messages sent by a
+// taproot key.
+type senderResponse struct {
+	PubKey   string             `json:"pubkey"`
+	Messages []*messageResponse `json:"messages"`
+}
+
+// importResponse is the JSON representation of database.ImportResult.
+type importResponse struct {
+	Accepted   int      `json:"accepted"`
+	Rejected   int      `json:"rejected"`
+	Duplicates int      `json:"duplicates"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// revalidateResponse is the JSON representation of network.RevalidateResult.
+type revalidateResponse struct {
+	Checked      int                 `json:"checked"`
+	Unverifiable int                 `json:"unverifiable"`
+	Invalid      []revalidateFailure `json:"invalid"`
+}
+
+// revalidateFailure is a stored message that failed to verify.
+type revalidateFailure struct {
+	Outpoint string `json:"outpoint"`
+	Error    string `json:"error"`
+}
+
+// outpointResponse is the JSON representation of an outpoint lookup.
+type outpointResponse struct {
+	Outpoint string `json:"outpoint"`
+	Known    bool   `json:"known"`
+}
+
+// validateResponse is the JSON representation of database.DryRunResult.
+type validateResponse struct {
+	OK            bool   `json:"ok"`
+	Reason        string `json:"reason,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Outpoint      string `json:"outpoint,omitempty"`
+	ScriptType    string `json:"script_type,omitempty"`
+	PubKey        string `json:"pubkey,omitempty"`
+	Value         int64  `json:"value"`
+	Confirmations int64  `json:"confirmations"`
+}
+
+// errorResponse is the JSON body returned with every error status.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handlePostMessage accepts a serialized message, either raw with an
+// application/octet-stream content type or hex encoded, and submits it to the
+// network.
+func (s *Server) handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	msgData, ok := readMessageBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Reject anything that isn't exactly one well-formed message before
+	// touching the validator
+	if _, err := message.Deserialize(msgData); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msg, err := s.manager.SubmitMessage(r.Context(), msgData)
+	if err != nil {
+		writeError(w, submitErrorStatus(err), err)
+		return
+	}
+
+	meta, err := s.db.GetMessageMeta(r.Context(), msg.Outpoint)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, s.describeMessage(msg, meta))
+}
+
+// handleValidateMessage runs every check a message submitted like in
+// handlePostMessage goes through without storing or announcing it. A message
+// that fails a check is reported with the reason code of the check and a 200
+// status, error statuses are kept for requests that couldn't be processed.
+func (s *Server) handleValidateMessage(w http.ResponseWriter, r *http.Request) {
+	msgData, ok := readMessageBody(w, r)
+	if !ok {
+		return
+	}
+
+	msg, err := message.Deserialize(msgData)
+	if err != nil {
+		reason := database.ReasonMalformed
+		if errors.Is(err, message.ErrPayloadTooLarge) {
+			reason = database.ReasonTooLarge
+		}
+		writeJSON(w, http.StatusOK, &validateResponse{
+			Reason: reason,
+			Error:  err.Error(),
+		})
+		return
+	}
+
+	result := s.manager.DryRunMessage(r.Context(), msg)
+	resp := &validateResponse{
+		OK:            result.OK,
+		Reason:        result.Reason,
+		Outpoint:      msg.Outpoint.ToString(),
+		Value:         result.Value,
+		Confirmations: result.Confirmations,
+	}
+	if result.Err != nil {
+		resp.Error = result.Err.Error()
+	}
+	if result.ScriptType != database.ScriptUnsupported {
+		resp.ScriptType = result.ScriptType.String()
+	}
+	if result.PubKey != nil {
+		resp.PubKey = hex.EncodeToString(result.PubKey)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readMessageBody reads the serialized message in the body of a request,
+// either raw with an application/octet-stream content type or hex encoded. On
+// failure it writes the error response and returns false.
+func readMessageBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return nil, false
+	}
+
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		return body, true
+	}
+	msgData, err := hex.DecodeString(string(bytes.TrimSpace(body)))
+	if err != nil {
+		writeError(w, http.StatusBadRequest,
+			fmt.Errorf("invalid hex body: %v", err))
+		return nil, false
+	}
+	return msgData, true
+}
+
+// handleListMessages returns a page of stored messages in the order they were
+// accepted. The cursor and limit query parameters control pagination, and the
+// optional channel parameter limits the page to messages with a structured
+// payload posted to that channel.
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var limit int
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q", l))
+			return
+		}
+	}
+
+	var (
+		entries []database.MessageEntry
+		cursor  string
+		err     error
+	)
+	if channel := query.Get("channel"); channel != "" {
+		entries, cursor, err = s.manager.ListChannelMessages(r.Context(),
+			channel, query.Get("cursor"), limit)
+	} else {
+		entries, cursor, err = s.manager.ListMessages(r.Context(),
+			query.Get("cursor"), limit)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, database.ErrInvalidCursor) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	resp := &listResponse{
+		Messages: make([]*messageResponse, 0, len(entries)),
+		Cursor:   cursor,
+	}
+	for _, entry := range entries {
+		msg, err := message.Deserialize(entry.Data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Messages = append(resp.Messages,
+			s.describeMessage(msg, &entry.Meta))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleGetMessage returns the stored message for an outpoint.
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	outpoint, err := parseOutpoint(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msgData, err := s.db.GetMessage(r.Context(), outpoint)
+	if errors.Is(err, database.ErrEvicted) {
+		writeError(w, http.StatusGone,
+			fmt.Errorf("message for outpoint %s was evicted", outpoint.ToString()))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if msgData == nil {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("no message for outpoint %s", outpoint.ToString()))
+		return
+	}
+
+	msg, err := message.Deserialize(msgData)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	meta, err := s.db.GetMessageMeta(r.Context(), outpoint)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.describeMessage(msg, meta))
+}
+
+// handleGetThread returns the stored message for an outpoint along with every
+// stored message replying to it, directly or through other replies, in the
+// order they were accepted.
+func (s *Server) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	root, err := parseOutpoint(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := s.db.GetThread(r.Context(), root)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := &threadResponse{
+		Root:     root.ToString(),
+		Messages: make([]*messageResponse, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		msg, err := message.Deserialize(entry.Data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Messages = append(resp.Messages,
+			s.describeMessage(msg, &entry.Meta))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleListSenderMessages returns the stored messages whose UTXO is
+// controlled by the x-only taproot output key in the path, hex encoded.
+func (s *Server) handleListSenderMessages(w http.ResponseWriter,
+	r *http.Request) {
+
+	pubKey, err := hex.DecodeString(r.PathValue("pubkey"))
+	if err != nil || len(pubKey) != 32 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf(
+			"invalid pubkey %q: expected 32 hex encoded bytes",
+			r.PathValue("pubkey")))
+		return
+	}
+
+	entries, err := s.db.GetMessagesByPubKey(r.Context(), pubKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := &senderResponse{
+		PubKey:   hex.EncodeToString(pubKey),
+		Messages: make([]*messageResponse, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		msg, err := message.Deserialize(entry.Data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Messages = append(resp.Messages,
+			s.describeMessage(msg, &entry.Meta))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleExport streams every stored message as an archive.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	count, err := database.Export(r.Context(), s.db, w)
+	if err != nil {
+		// The status is already sent, the client sees a truncated archive
+		log.Warnf("Export failed after %d messages: %v", count, err)
+		return
+	}
+	log.Infof("Exported %d messages", count)
+}
+
+// handleImport validates and stores the messages of an archive in the request
+// body. With the trust query parameter set, messages whose UTXO was spent are
+// stored without validation.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	trust, err := parseBool(r.URL.Query().Get("trust"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := database.Import(r.Context(), r.Body,
+		func(ctx context.Context, msgData []byte) error {
+			return s.manager.ImportMessage(ctx, msgData, trust)
+		})
+	if result == nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	resp := &importResponse{
+		Accepted:   result.Accepted,
+		Rejected:   result.Rejected,
+		Duplicates: result.Duplicates,
+		Errors:     result.Errors,
+	}
+	if err != nil {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	log.Infof("Imported %d messages, %d rejected, %d duplicates",
+		result.Accepted, result.Rejected, result.Duplicates)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleRevalidate verifies every stored message again and removes the ones
+// that fail.
+func (s *Server) handleRevalidate(w http.ResponseWriter, r *http.Request) {
+	result, err := s.manager.Revalidate(r.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, message.ErrRPCUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	resp := &revalidateResponse{
+		Checked:      result.Checked,
+		Unverifiable: result.Unverifiable,
+		Invalid:      []revalidateFailure{},
+	}
+	for _, failure := range result.Invalid {
+		resp.Invalid = append(resp.Invalid, revalidateFailure{
+			Outpoint: failure.Outpoint.ToString(),
+			Error:    failure.Err.Error(),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseBool parses an optional boolean query parameter.
+func parseBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+	return b, nil
+}
+
+// handleGetOutpoint reports whether an outpoint is known to the node.
+func (s *Server) handleGetOutpoint(w http.ResponseWriter, r *http.Request) {
+	outpoint, err := parseOutpoint(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	known, err := s.db.HasOutpoint(r.Context(), outpoint)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &outpointResponse{
+		Outpoint: outpoint.ToString(),
+		Known:    known,
+	})
+}
+
+// handleListPeers returns the connected peers sorted by address.
+func (s *Server) handleListPeers(w http.ResponseWriter, r *http.Request) {
+	stats := s.manager.Stats()
+	resp := &peersResponse{
+		Peers: make([]*peerStatsResponse, 0, len(stats.Peers)),
+	}
+	for _, peer := range stats.Peers {
+		resp.Peers = append(resp.Peers, newPeerStatsResponse(peer))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleListKnownPeers returns the peer addresses the node knows of, including
+// those it was connected to in earlier runs, sorted by address.
+func (s *Server) handleListKnownPeers(w http.ResponseWriter, r *http.Request) {
+	known := s.manager.KnownPeers()
+	resp := &knownPeersResponse{
+		Peers: make([]*knownPeerResponse, 0, len(known)),
+	}
+	for _, peer := range known {
+		resp.Peers = append(resp.Peers, newKnownPeerResponse(peer))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseOutpoint parses the txid and vout path values of a request.
+func parseOutpoint(r *http.Request) (message.Outpoint, error) {
+	return message.ParseOutpoint(
+		r.PathValue("txid") + ":" + r.PathValue("vout"))
+}
+
+// submitErrorStatus maps an error from Manager.SubmitMessage to an HTTP
+// status code.
+func submitErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, message.ErrDuplicateOutpoint):
+		return http.StatusConflict
+
+	case errors.Is(err, database.ErrUnconfirmedOutpoint):
+		return http.StatusTooEarly
+
+	case errors.Is(err, message.ErrRPCUnavailable):
+		return http.StatusServiceUnavailable
+
+	case errors.Is(err, network.ErrBlocked),
+		errors.Is(err, network.ErrNotWhitelisted):
+		return http.StatusForbidden
+
+	case errors.Is(err, database.ErrOutpointBudgetExceeded),
+		errors.Is(err, message.ErrExceedsPolicy):
+		return http.StatusRequestEntityTooLarge
+
+	case errors.Is(err, message.ErrBadSignature),
+		errors.Is(err, database.ErrScriptMismatch),
+		errors.Is(err, database.ErrInvalidContent),
+		errors.Is(err, message.ErrUTXONotFound),
+		errors.Is(err, message.ErrUTXOSpent),
+		errors.Is(err, message.ErrExpired),
+		errors.Is(err, database.ErrUTXOBelowMinimum),
+		errors.Is(err, message.ErrNotTaproot),
+		errors.Is(err, message.ErrUnsupportedScript):
+
+		return http.StatusUnprocessableEntity
+
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("Failed to write API response: %v", err)
+	}
+}
+
+// writeError writes err as a JSON error response with the given status code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorResponse{Error: err.Error()})
+}
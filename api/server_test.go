@@ -0,0 +1,358 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// signTestMessage adds a taproot UTXO for outpoint to client and returns a
+// message for it signed by its key.
+func signTestMessage(t *testing.T, client *mock.Client,
+	outpoint message.Outpoint, text string) *message.Message {
+
+	t.Helper()
+
+	return signTestPayload(t, client, outpoint, message.ContentTypeText,
+		[]byte(text))
+}
+
+// signTestPayload is signTestMessage for a payload of any content type.
+func signTestPayload(t *testing.T, client *mock.Client,
+	outpoint message.Outpoint, contentType message.ContentType,
+	payload []byte) *message.Message {
+
+	t.Helper()
+
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{5}, 32))
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+
+	msg, err := signer.SignMessage(key, outpoint, contentType, payload)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	return msg
+}
+
+// outpointPath returns the txid/vout path of outpoint in the API routes.
+func outpointPath(outpoint message.Outpoint) string {
+	txid, vout := outpoint.ToTxidIdx()
+	return fmt.Sprintf("%s/%d", txid, vout)
+}
+
+// TestPostMessage checks that a message posted hex encoded or raw is
+// validated, stored and then served with its metadata, and that the same
+// message posted again conflicts.
+func TestPostMessage(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	for i, raw := range []bool{false, true} {
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 2)
+		msgData := signTestMessage(t, client, outpoint, "hello").
+			Serialize()
+
+		body := []byte(hex.EncodeToString(msgData))
+		if raw {
+			body = msgData
+		}
+		r := httptest.NewRequest(http.MethodPost, "/v1/messages",
+			bytes.NewReader(body))
+		if raw {
+			r.Header.Set("Content-Type", "application/octet-stream")
+		}
+		r.Header.Set("Authorization", "Bearer "+testToken)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("raw %v: got status %d: %s", raw, w.Code, w.Body)
+		}
+
+		var resp messageResponse
+		serveJSON(t, s, http.MethodGet, "/v1/messages/"+
+			outpointPath(outpoint), nil, http.StatusOK, &resp)
+		if resp.Outpoint != outpoint.ToString() || resp.Payload != "hello" ||
+			resp.ContentType != message.ContentTypeText.String() ||
+			!resp.Validated || resp.Source != database.SourceLocal ||
+			resp.ReceivedAt == nil || resp.PubKey == "" {
+
+			t.Fatalf("raw %v: got %+v", raw, resp)
+		}
+
+		var known outpointResponse
+		serveJSON(t, s, http.MethodGet, "/v1/outpoints/"+
+			outpointPath(outpoint), nil, http.StatusOK, &known)
+		if !known.Known {
+			t.Fatalf("raw %v: stored outpoint not known", raw)
+		}
+
+		var conflict errorResponse
+		serveJSON(t, s, http.MethodPost, "/v1/messages",
+			[]byte(hex.EncodeToString(msgData)), http.StatusConflict,
+			&conflict)
+	}
+}
+
+// TestPostMessageInvalidSignature checks that a message whose signature
+// doesn't verify is refused without being stored.
+func TestPostMessageInvalidSignature(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+	msg := signTestMessage(t, client, outpoint, "hello")
+	msg.Signature[10] ^= 0xff
+
+	var resp errorResponse
+	serveJSON(t, s, http.MethodPost, "/v1/messages",
+		[]byte(hex.EncodeToString(msg.Serialize())),
+		http.StatusUnprocessableEntity, &resp)
+	if resp.Error == "" {
+		t.Fatal("no error reported")
+	}
+
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+outpointPath(outpoint),
+		nil, http.StatusNotFound, &resp)
+	known, err := s.db.HasOutpoint(context.Background(), outpoint)
+	if err != nil || known {
+		t.Fatalf("outpoint of a bad signature recorded: %v, %v", known, err)
+	}
+}
+
+// TestValidateMessage checks that a valid message, one with a bad signature
+// and one for a spent UTXO are reported with their reason code by the
+// validate route, and that none of them is stored.
+func TestValidateMessage(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	valid := message.NewOutpoint(chainhash.Hash{1}, 0)
+	forged := message.NewOutpoint(chainhash.Hash{2}, 0)
+	spent := message.NewOutpoint(chainhash.Hash{3}, 0)
+	badSig := signTestMessage(t, client, forged, "hello")
+	badSig.Signature[10] ^= 0xff
+	spentMsg := signTestMessage(t, client, spent, "hello")
+	client.SpendUTXO(spent.WireOutPoint())
+
+	tests := []struct {
+		name   string
+		msg    *message.Message
+		ok     bool
+		reason string
+	}{
+		{"valid", signTestMessage(t, client, valid, "hello"), true, ""},
+		{"bad signature", badSig, false, database.ReasonInvalidSignature},
+		{"spent", spentMsg, false, database.ReasonUTXONotFound},
+	}
+	for _, test := range tests {
+		var resp validateResponse
+		serveJSON(t, s, http.MethodPost, "/v1/messages/validate",
+			[]byte(hex.EncodeToString(test.msg.Serialize())),
+			http.StatusOK, &resp)
+		if resp.OK != test.ok || resp.Reason != test.reason ||
+			resp.Outpoint != test.msg.Outpoint.ToString() ||
+			test.ok != (resp.Error == "") {
+
+			t.Fatalf("%s: got %+v", test.name, resp)
+		}
+
+		var errResp errorResponse
+		serveJSON(t, s, http.MethodGet, "/v1/messages/"+
+			outpointPath(test.msg.Outpoint), nil, http.StatusNotFound,
+			&errResp)
+		known, err := s.db.HasOutpoint(context.Background(),
+			test.msg.Outpoint)
+		if err != nil || known {
+			t.Fatalf("%s: outpoint recorded by validation: %v", test.name,
+				err)
+		}
+	}
+}
+
+// TestUnknownOutpoint checks that an outpoint the node never saw has no
+// message and is reported unknown, that a message for a UTXO the Bitcoin node
+// doesn't have is refused, and that a malformed outpoint is a bad request.
+func TestUnknownOutpoint(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 7)
+	path := outpointPath(outpoint)
+
+	var errResp errorResponse
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+path, nil,
+		http.StatusNotFound, &errResp)
+
+	var known outpointResponse
+	serveJSON(t, s, http.MethodGet, "/v1/outpoints/"+path, nil,
+		http.StatusOK, &known)
+	if known.Known || known.Outpoint != outpoint.ToString() {
+		t.Fatalf("got %+v", known)
+	}
+
+	// Signed by the key of another UTXO that doesn't exist either
+	msg := signTestMessage(t, mock.NewClient(), outpoint, "hello")
+	serveJSON(t, s, http.MethodPost, "/v1/messages",
+		[]byte(hex.EncodeToString(msg.Serialize())),
+		http.StatusUnprocessableEntity, &errResp)
+	if n := client.Calls(mock.MethodGetTxOut); n == 0 {
+		t.Fatal("UTXO not looked up")
+	}
+
+	for _, path := range []string{"nothex/0", path[:10] + "/0",
+		path[:64] + "/x"} {
+
+		serveJSON(t, s, http.MethodGet, "/v1/outpoints/"+path, nil,
+			http.StatusBadRequest, &errResp)
+	}
+}
+
+// TestSenderMessages checks that the messages of two UTXOs controlled by the
+// same key are both listed for it, and only the other one once a block
+// spent the first UTXO.
+func TestSenderMessages(t *testing.T) {
+	ctx := context.Background()
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	var outpoints []message.Outpoint
+	for i := byte(1); i <= 2; i++ {
+		outpoint := message.NewOutpoint(chainhash.Hash{i}, 0)
+		msg := signTestMessage(t, client, outpoint, "hello")
+		var resp messageResponse
+		serveJSON(t, s, http.MethodPost, "/v1/messages",
+			[]byte(hex.EncodeToString(msg.Serialize())),
+			http.StatusCreated, &resp)
+		outpoints = append(outpoints, outpoint)
+	}
+
+	var stored messageResponse
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+
+		outpointPath(outpoints[0]), nil, http.StatusOK, &stored)
+	path := "/v1/senders/" + stored.PubKey + "/messages"
+
+	// listed returns the outpoints listed for the key
+	listed := func() []string {
+		t.Helper()
+
+		var resp senderResponse
+		serveJSON(t, s, http.MethodGet, path, nil, http.StatusOK, &resp)
+		if resp.PubKey != stored.PubKey {
+			t.Fatalf("listed messages of %s for %s", resp.PubKey,
+				stored.PubKey)
+		}
+		var got []string
+		for _, msg := range resp.Messages {
+			got = append(got, msg.Outpoint)
+		}
+		return got
+	}
+
+	got := listed()
+	if len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("listed %v, want both messages", got)
+	}
+	for _, outpoint := range outpoints {
+		if got[0] != outpoint.ToString() && got[1] != outpoint.ToString() {
+			t.Fatalf("%s not listed in %v", outpoint.ToString(), got)
+		}
+	}
+
+	// A block spends the first UTXO
+	_, err := s.db.RemoveBlockOutpoints(ctx, chainhash.Hash{9},
+		outpoints[:1])
+	if err != nil {
+		t.Fatalf("RemoveBlockOutpoints: %v", err)
+	}
+	if got := listed(); len(got) != 1 || got[0] != outpoints[1].ToString() {
+		t.Fatalf("listed %v after the spend, want %s", got,
+			outpoints[1].ToString())
+	}
+
+	var errResp errorResponse
+	serveJSON(t, s, http.MethodGet, "/v1/senders/abcd/messages", nil,
+		http.StatusBadRequest, &errResp)
+}
+
+// TestChannelThread checks that structured messages posted to the node are
+// listed by channel among unstructured ones, and that a thread holds the
+// replies chaining to its root.
+func TestChannelThread(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	// post stores a message for the outpoint numbered i with payload p, or
+	// an unstructured one if p is nil
+	post := func(i byte, p *message.Payload) message.Outpoint {
+		t.Helper()
+
+		contentType, payload := message.ContentTypeText, []byte("plain")
+		if p != nil {
+			var err error
+			contentType = message.ContentTypeBinary
+			payload, err = message.BuildPayload(p)
+			if err != nil {
+				t.Fatalf("BuildPayload: %v", err)
+			}
+		}
+		outpoint := message.NewOutpoint(chainhash.Hash{i}, 0)
+		msg := signTestPayload(t, client, outpoint, contentType, payload)
+		var resp messageResponse
+		serveJSON(t, s, http.MethodPost, "/v1/messages",
+			[]byte(hex.EncodeToString(msg.Serialize())),
+			http.StatusCreated, &resp)
+		return outpoint
+	}
+
+	root := post(1, &message.Payload{Channel: "general", Body: "root"})
+	post(2, nil)
+	reply := post(3, &message.Payload{Channel: "general", ReplyTo: &root,
+		Body: "reply"})
+	deep := post(4, &message.Payload{ReplyTo: &reply, Body: "deeper"})
+
+	var list listResponse
+	serveJSON(t, s, http.MethodGet, "/v1/messages?channel=general", nil,
+		http.StatusOK, &list)
+	if len(list.Messages) != 2 ||
+		list.Messages[0].Outpoint != root.ToString() ||
+		list.Messages[1].Outpoint != reply.ToString() ||
+		list.Messages[1].Channel != "general" ||
+		list.Messages[1].Body != "reply" {
+
+		t.Fatalf("listed %+v in the channel", list.Messages)
+	}
+	serveJSON(t, s, http.MethodGet, "/v1/messages", nil, http.StatusOK,
+		&list)
+	if len(list.Messages) != 4 {
+		t.Fatalf("listed %d messages in all, want 4", len(list.Messages))
+	}
+
+	var thread threadResponse
+	serveJSON(t, s, http.MethodGet, "/v1/messages/"+outpointPath(root)+
+		"/thread", nil, http.StatusOK, &thread)
+	want := []message.Outpoint{root, reply, deep}
+	if thread.Root != root.ToString() || len(thread.Messages) != len(want) {
+		t.Fatalf("got thread %+v", thread)
+	}
+	for i, outpoint := range want {
+		if thread.Messages[i].Outpoint != outpoint.ToString() {
+			t.Fatalf("message %d of the thread is %s, want %s", i,
+				thread.Messages[i].Outpoint, outpoint.ToString())
+		}
+	}
+	if thread.Messages[2].ReplyTo != reply.ToString() {
+		t.Fatalf("deepest reply is to %q", thread.Messages[2].ReplyTo)
+	}
+}
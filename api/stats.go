@@ -0,0 +1,341 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+const (
+	// topPayloads is the number of payloads seen most often reported, and
+	// payloadOutpoints the number of outpoints listed for each.
+	topPayloads      = 10
+	payloadOutpoints = 10
+)
+
+// statsResponse is the JSON representation of the node statistics.
+type statsResponse struct {
+	// RPCDegraded is set while the network manager or the block handler
+	// fails to reach the Bitcoin node.
+	RPCDegraded bool                 `json:"rpc_degraded"`
+	Network     networkStatsResponse `json:"network"`
+	Blockchain  *chainStatsResponse  `json:"blockchain,omitempty"`
+}
+
+// networkStatsResponse is the JSON representation of network.Stats.
+type networkStatsResponse struct {
+	IdentityKey         string               `json:"identity_key,omitempty"`
+	ConnectedPeers      int                  `json:"connected_peers"`
+	InboundPeers        int                  `json:"inbound_peers"`
+	OutboundPeers       int                  `json:"outbound_peers"`
+	MaxInboundPeers     int                  `json:"max_inbound_peers"`
+	MaxOutboundPeers    int                  `json:"max_outbound_peers"`
+	InboundRejected     uint64               `json:"inbound_rejected"`
+	InboundEvicted      uint64               `json:"inbound_evicted"`
+	Peers               []*peerStatsResponse `json:"peers"`
+	MessagesStored      uint64               `json:"messages_stored"`
+	MessagesRejected    uint64               `json:"messages_rejected"`
+	MessagesBlocked     uint64               `json:"messages_blocked"`
+	MessagesSuppressed  uint64               `json:"messages_suppressed"`
+	RejectsJournaled    int                  `json:"rejects_journaled"`
+	RejectsDropped      uint64               `json:"rejects_dropped"`
+	ThrottledMessages   uint64               `json:"throttled_messages"`
+	ThrottleDisconnects uint64               `json:"throttle_disconnects"`
+	UnknownFrames       uint64               `json:"unknown_frames"`
+	Bandwidth           bandwidthResponse    `json:"bandwidth"`
+	MessageCache        messageCacheResponse `json:"message_cache"`
+	RPCDegraded         bool                 `json:"rpc_degraded"`
+	HeldMessages        int                  `json:"held_messages"`
+	HeldDropped         uint64               `json:"held_dropped"`
+	ValidationQueue     int                  `json:"validation_queue"`
+	Subscribers         int                  `json:"subscribers"`
+	PendingAnnounce     int                  `json:"pending_announce"`
+	UptimeSeconds       float64              `json:"uptime_seconds"`
+
+	// DuplicatePayloads are the payloads seen most often, to spot
+	// campaigns sending the same payload from many outpoints.
+	DuplicatePayloads []*payloadCountResponse `json:"duplicate_payloads"`
+}
+
+// payloadCountResponse is the JSON representation of
+// database.PayloadCount, listing the first stored outpoints.
+type payloadCountResponse struct {
+	Hash      string   `json:"hash"`
+	Count     int      `json:"count"`
+	Stored    int      `json:"stored"`
+	Outpoints []string `json:"outpoints"`
+}
+
+// bandwidthResponse is the JSON representation of network.BandwidthStats.
+type bandwidthResponse struct {
+	BytesSent            uint64 `json:"bytes_sent"`
+	BytesReceived        uint64 `json:"bytes_received"`
+	BytesSentHour        uint64 `json:"bytes_sent_hour"`
+	BytesReceivedHour    uint64 `json:"bytes_received_hour"`
+	MaxUploadPerHour     uint64 `json:"max_upload_per_hour"`
+	MaxPeerUploadPerHour uint64 `json:"max_peer_upload_per_hour"`
+	BusyRejects          uint64 `json:"busy_rejects"`
+}
+
+// messageCacheResponse is the JSON representation of
+// network.MessageCacheStats.
+type messageCacheResponse struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// peerStatsResponse is the JSON representation of network.PeerStats.
+type peerStatsResponse struct {
+	Addr          string     `json:"addr"`
+	Direction     string     `json:"direction"`
+	Version       uint32     `json:"version,omitempty"`
+	UserAgent     string     `json:"user_agent,omitempty"`
+	PeerKey       string     `json:"peer_key,omitempty"`
+	Trusted       bool       `json:"trusted"`
+	ConnectedAt   time.Time  `json:"connected_at"`
+	BytesReceived uint64     `json:"bytes_received"`
+	BytesSent     uint64     `json:"bytes_sent"`
+	BytesRecvHour uint64     `json:"bytes_received_hour"`
+	BytesSentHour uint64     `json:"bytes_sent_hour"`
+	LastRecv      *time.Time `json:"last_recv,omitempty"`
+	LastSend      *time.Time `json:"last_send,omitempty"`
+	TipHeight     *int32     `json:"tip_height,omitempty"`
+	TipHash       string     `json:"tip_hash,omitempty"`
+	Lagging       bool       `json:"lagging"`
+
+	// Announcements to the peer and how many it fetched.
+	Announced     uint64  `json:"announced"`
+	Fetched       uint64  `json:"fetched"`
+	Ignored       uint64  `json:"ignored"`
+	Conversion    float64 `json:"conversion"`
+	MedianFetchMs float64 `json:"median_fetch_ms,omitempty"`
+
+	DuplicatesSkipped uint64 `json:"duplicates_skipped"`
+}
+
+// peersResponse is the JSON representation of the connected peers.
+type peersResponse struct {
+	Peers []*peerStatsResponse `json:"peers"`
+}
+
+// knownPeerResponse is the JSON representation of network.KnownPeer.
+type knownPeerResponse struct {
+	Addr        string     `json:"addr"`
+	UserAgent   string     `json:"user_agent,omitempty"`
+	PeerKey     string     `json:"peer_key,omitempty"`
+	Connected   bool       `json:"connected"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	BadUntil    *time.Time `json:"bad_until,omitempty"`
+}
+
+// knownPeersResponse is the JSON representation of the known peers.
+type knownPeersResponse struct {
+	Peers []*knownPeerResponse `json:"peers"`
+}
+
+// chainStatsResponse is the JSON representation of blockchain.Stats.
+type chainStatsResponse struct {
+	LastBlockHeight    int32  `json:"last_block_height"`
+	LastBlockHash      string `json:"last_block_hash,omitempty"`
+	BlocksProcessed    uint64 `json:"blocks_processed"`
+	BlocksDisconnected uint64 `json:"blocks_disconnected"`
+	OutpointsRemoved   uint64 `json:"outpoints_removed"`
+	RPCDegraded        bool   `json:"rpc_degraded"`
+	Paused             bool   `json:"paused"`
+	InputsSkipped      uint64 `json:"inputs_skipped"`
+	InputErrors        uint64 `json:"input_errors"`
+	BitcoinEndpoint    string `json:"bitcoin_endpoint,omitempty"`
+	EndpointSwitches   uint64 `json:"endpoint_switches"`
+}
+
+// NewStatsHandler returns an HTTP handler reporting the statistics of the
+// network manager and, if chain is not nil, the block handler as JSON.
+func NewStatsHandler(manager *network.Manager,
+	chain *blockchain.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK,
+			newStatsResponse(r.Context(), manager, chain))
+	})
+}
+
+// newStatsResponse collects the current statistics.
+func newStatsResponse(ctx context.Context, manager *network.Manager,
+	chain *blockchain.Handler) *statsResponse {
+
+	netStats := manager.Stats()
+	resp := &statsResponse{
+		RPCDegraded: netStats.RPCDegraded,
+		Network: networkStatsResponse{
+			IdentityKey:         netStats.IdentityKey,
+			ConnectedPeers:      len(netStats.Peers),
+			InboundPeers:        netStats.InboundPeers,
+			OutboundPeers:       netStats.OutboundPeers,
+			MaxInboundPeers:     netStats.MaxInboundPeers,
+			MaxOutboundPeers:    netStats.MaxOutboundPeers,
+			InboundRejected:     netStats.InboundRejected,
+			InboundEvicted:      netStats.InboundEvicted,
+			Peers:               make([]*peerStatsResponse, 0, len(netStats.Peers)),
+			MessagesStored:      netStats.MessagesStored,
+			MessagesRejected:    netStats.MessagesRejected,
+			MessagesBlocked:     netStats.MessagesBlocked,
+			MessagesSuppressed:  netStats.MessagesSuppressed,
+			RejectsJournaled:    netStats.RejectsJournaled,
+			RejectsDropped:      netStats.RejectsDropped,
+			ThrottledMessages:   netStats.RateLimit.ThrottledMessages,
+			ThrottleDisconnects: netStats.RateLimit.Disconnects,
+			UnknownFrames:       netStats.UnknownFrames,
+			Bandwidth: bandwidthResponse{
+				BytesSent:            netStats.Bandwidth.BytesSent,
+				BytesReceived:        netStats.Bandwidth.BytesReceived,
+				BytesSentHour:        netStats.Bandwidth.SentWindow,
+				BytesReceivedHour:    netStats.Bandwidth.ReceivedWindow,
+				MaxUploadPerHour:     netStats.Bandwidth.MaxUploadPerHour,
+				MaxPeerUploadPerHour: netStats.Bandwidth.MaxPeerUploadPerHour,
+				BusyRejects:          netStats.Bandwidth.BusyRejects,
+			},
+			MessageCache: messageCacheResponse{
+				Hits:     netStats.MessageCache.Hits,
+				Misses:   netStats.MessageCache.Misses,
+				Entries:  netStats.MessageCache.Entries,
+				Bytes:    netStats.MessageCache.Bytes,
+				MaxBytes: netStats.MessageCache.MaxBytes,
+			},
+			RPCDegraded:     netStats.RPCDegraded,
+			HeldMessages:    netStats.HeldMessages,
+			HeldDropped:     netStats.HeldDropped,
+			ValidationQueue: netStats.ValidationQueue,
+			Subscribers:     netStats.Subscribers,
+			PendingAnnounce: netStats.PendingAnnounce,
+			UptimeSeconds:   netStats.Uptime.Seconds(),
+		},
+	}
+	for _, peer := range netStats.Peers {
+		resp.Network.Peers = append(resp.Network.Peers,
+			newPeerStatsResponse(peer))
+	}
+
+	payloads, err := manager.TopPayloads(ctx, topPayloads)
+	if err != nil {
+		log.Warnf("Failed to list duplicate payloads: %v", err)
+	}
+	resp.Network.DuplicatePayloads = make([]*payloadCountResponse, 0,
+		len(payloads))
+	for _, payload := range payloads {
+		resp.Network.DuplicatePayloads = append(
+			resp.Network.DuplicatePayloads, newPayloadCountResponse(payload))
+	}
+
+	if chain != nil {
+		chainStats := chain.Stats()
+		resp.Blockchain = &chainStatsResponse{
+			LastBlockHeight:    chainStats.LastBlockHeight,
+			BlocksProcessed:    chainStats.BlocksProcessed,
+			BlocksDisconnected: chainStats.BlocksDisconnected,
+			OutpointsRemoved:   chainStats.OutpointsRemoved,
+			RPCDegraded:        chainStats.RPCDegraded,
+			Paused:             chainStats.Paused,
+			InputsSkipped:      chainStats.InputsSkipped,
+			InputErrors:        chainStats.InputErrors,
+			BitcoinEndpoint:    chainStats.BitcoinEndpoint,
+			EndpointSwitches:   chainStats.EndpointSwitches,
+		}
+		resp.RPCDegraded = resp.RPCDegraded || chainStats.RPCDegraded
+		if chainStats.LastBlockHash != nil {
+			resp.Blockchain.LastBlockHash = chainStats.LastBlockHash.String()
+		}
+	}
+
+	return resp
+}
+
+// newPayloadCountResponse builds the JSON representation of a payload seen
+// more than once.
+func newPayloadCountResponse(
+	payload database.PayloadCount) *payloadCountResponse {
+
+	outpoints := payload.Outpoints[:min(len(payload.Outpoints),
+		payloadOutpoints)]
+	resp := &payloadCountResponse{
+		Hash:      hex.EncodeToString(payload.Hash[:]),
+		Count:     payload.Count,
+		Stored:    payload.Stored,
+		Outpoints: make([]string, 0, len(outpoints)),
+	}
+	for _, outpoint := range outpoints {
+		resp.Outpoints = append(resp.Outpoints, outpoint.ToString())
+	}
+	return resp
+}
+
+// newPeerStatsResponse builds the JSON representation of a peer.
+func newPeerStatsResponse(peer network.PeerStats) *peerStatsResponse {
+	resp := &peerStatsResponse{
+		Addr:          peer.Addr,
+		Direction:     "inbound",
+		Version:       peer.Version,
+		UserAgent:     peer.UserAgent,
+		PeerKey:       peer.PeerKey,
+		Trusted:       peer.Trusted,
+		ConnectedAt:   peer.ConnectedAt.UTC(),
+		BytesReceived: peer.BytesReceived,
+		BytesSent:     peer.BytesSent,
+		BytesRecvHour: peer.ReceivedWindow,
+		BytesSentHour: peer.SentWindow,
+		LastRecv:      optionalTime(peer.LastRecv),
+		LastSend:      optionalTime(peer.LastSend),
+		Lagging:       peer.Lagging,
+		Announced:     peer.Announce.Announced,
+		Fetched:       peer.Announce.Fetched,
+		Ignored:       peer.Announce.Ignored,
+		Conversion:    peer.Announce.Conversion(),
+		MedianFetchMs: float64(peer.Announce.MedianFetchLatency) /
+			float64(time.Millisecond),
+		DuplicatesSkipped: peer.DuplicatesSkipped,
+	}
+	if peer.Tip != nil {
+		resp.TipHeight = &peer.Tip.Height
+		resp.TipHash = peer.Tip.Hash.String()
+	}
+	if peer.Outbound {
+		resp.Direction = "outbound"
+	}
+	return resp
+}
+
+// newKnownPeerResponse builds the JSON representation of peer.
+func newKnownPeerResponse(peer network.KnownPeer) *knownPeerResponse {
+	return &knownPeerResponse{
+		Addr:        peer.Addr,
+		UserAgent:   peer.UserAgent,
+		PeerKey:     peer.PeerKey,
+		Connected:   peer.Connected,
+		LastSeen:    optionalTime(peer.LastSeen),
+		LastSuccess: optionalTime(peer.LastSuccess),
+		LastAttempt: optionalTime(peer.LastAttempt),
+		BadUntil:    optionalTime(peer.BadUntil),
+	}
+}
+
+// optionalTime returns t in UTC, or nil if t is the zero time.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/websocket"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+const (
+	// wsWriteTimeout is the maximum time to write an event to a
+	// subscriber before its connection is closed.
+	wsWriteTimeout = 10 * time.Second
+
+	// wsPingInterval is how often idle subscribers are pinged to keep
+	// their connection alive through proxies.
+	wsPingInterval = 30 * time.Second
+)
+
+// upgrader accepts websocket connections from any origin, events only carry
+// messages that are public on the network anyway.
+var upgrader = websocket.Upgrader{
+	HandshakeTimeout: 10 * time.Second,
+	CheckOrigin:      func(r *http.Request) bool { return true },
+}
+
+// eventResponse is the JSON representation of a network.Event.
+type eventResponse struct {
+	ID       uint64           `json:"id"`
+	Time     time.Time        `json:"time"`
+	Type     string           `json:"type"`
+	Outpoint string           `json:"outpoint"`
+	Reason   string           `json:"reason,omitempty"`
+	Message  *messageResponse `json:"message,omitempty"`
+}
+
+// eventsResponse is the JSON representation of the recent events.
+type eventsResponse struct {
+	Events []*eventResponse `json:"events"`
+}
+
+// newEventResponse builds the JSON representation of ev.
+func newEventResponse(ev *network.Event) *eventResponse {
+	resp := &eventResponse{
+		ID:       ev.ID,
+		Time:     ev.Time.UTC(),
+		Type:     ev.Type.String(),
+		Outpoint: ev.Outpoint.ToString(),
+		Reason:   ev.Reason.String(),
+	}
+	if ev.Message != nil {
+		resp.Message = newMessageResponse(ev.Message, &ev.Meta)
+	}
+	return resp
+}
+
+// parsePubKeyFilter parses the optional pubkey query parameter filtering
+// events, an x-only taproot output key. It returns nil if it is absent.
+func parsePubKeyFilter(r *http.Request) ([]byte, error) {
+	value := r.URL.Query().Get("pubkey")
+	if value == "" {
+		return nil, nil
+	}
+	pubKey, err := hex.DecodeString(value)
+	if err != nil || len(pubKey) != 32 {
+		return nil, fmt.Errorf("invalid pubkey %q: expected 32 hex "+
+			"encoded bytes", value)
+	}
+	return pubKey, nil
+}
+
+// handleListEvents returns the recent events, oldest first, so a client that
+// reconnects to /v1/subscribe can catch up. The optional after query
+// parameter returns only the events following the one with that id, limit
+// the last ones of them, and pubkey filters them like /v1/subscribe.
+func (s *Server) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pubKey, err := parsePubKeyFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var after uint64
+	if value := query.Get("after"); value != "" {
+		after, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid after %q", value))
+			return
+		}
+	}
+
+	var limit int
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid limit %q", value))
+			return
+		}
+	}
+
+	events := s.manager.RecentEvents(after, limit, pubKey)
+	resp := &eventsResponse{
+		Events: make([]*eventResponse, 0, len(events)),
+	}
+	for i := range events {
+		resp.Events = append(resp.Events, newEventResponse(&events[i]))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleSubscribe upgrades the request to a websocket and streams an event for
+// every message added, replaced and removed from then on. The optional pubkey
+// query parameter, an x-only taproot output key, limits the events of stored
+// messages to those sent by that key. The client isn't expected to send
+// anything, the connection ends when it closes it or the server stops.
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	pubKey, err := parsePubKeyFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		log.Debugf("Failed to upgrade subscriber %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	sub := s.manager.Subscribe(pubKey)
+	defer sub.Close()
+
+	log.Debugf("Subscriber %s connected", r.RemoteAddr)
+
+	// Read until the client goes away, which also answers its pings and
+	// close frames
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				closeSubscriber(conn, websocket.CloseGoingAway)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(newEventResponse(&ev)); err != nil {
+				log.Debugf("Failed to send event to subscriber %s: %v",
+					r.RemoteAddr, err)
+				return
+			}
+
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				return
+			}
+
+		case <-s.quit:
+			closeSubscriber(conn, websocket.CloseGoingAway)
+			return
+
+		case <-closed:
+			log.Debugf("Subscriber %s disconnected, %d events dropped",
+				r.RemoteAddr, sub.Dropped())
+			return
+		}
+	}
+}
+
+// closeSubscriber sends a close frame with the given code, ignoring errors
+// since the connection is closed next anyway.
+func closeSubscriber(conn *websocket.Conn, code int) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, ""),
+		time.Now().Add(wsWriteTimeout))
+}
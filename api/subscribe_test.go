@@ -0,0 +1,244 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/websocket"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// subscribe opens a websocket subscription to srv with the given query and
+// waits until the manager of s counts it. It is closed when the test ends.
+func subscribe(t *testing.T, s *Server, srv *httptest.Server,
+	query string) *websocket.Conn {
+
+	t.Helper()
+
+	want := s.manager.Stats().Subscribers + 1
+	header := http.Header{"Authorization": {"Bearer " + testToken}}
+	url := "ws://" + srv.Listener.Addr().String() + "/v1/subscribe" + query
+	conn, _, err := (&websocket.Dialer{}).Dial(url, header)
+	if err != nil {
+		t.Fatalf("Dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.manager.Stats().Subscribers != want {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return conn
+}
+
+// nextEvent reads the next event from conn.
+func nextEvent(t *testing.T, conn *websocket.Conn) *eventResponse {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var ev eventResponse
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return &ev
+}
+
+// senderKey returns the taproot key made of seed bytes and the script of its
+// UTXOs.
+func senderKey(t *testing.T, seed byte) (*btcec.PrivateKey, []byte) {
+	t.Helper()
+
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{seed}, 32))
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pkScript
+}
+
+// postSigned posts a message for outpoint signed by the taproot key made of
+// seed bytes, after adding its UTXO to client. It returns the x-only output
+// key of the UTXO.
+func postSigned(t *testing.T, s *Server, client *mock.Client, seed byte,
+	outpoint message.Outpoint, text string) []byte {
+
+	t.Helper()
+
+	key, pkScript := senderKey(t, seed)
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	msg, err := signer.SignMessage(key, outpoint, message.ContentTypeText,
+		[]byte(text))
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+
+	var resp messageResponse
+	serveJSON(t, s, http.MethodPost, "/v1/messages",
+		[]byte(hex.EncodeToString(msg.Serialize())), http.StatusCreated,
+		&resp)
+	return pkScript[2:]
+}
+
+// TestSubscribe checks that a subscriber gets an event with the message once
+// it passed validation, and an event for its outpoint once the block handler
+// saw a block spend its UTXO.
+func TestSubscribe(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	conn := subscribe(t, s, srv, "")
+
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+	pubKey := postSigned(t, s, client, 5, outpoint, "hello")
+
+	ev := nextEvent(t, conn)
+	if ev.Type != "message_added" || ev.Outpoint != outpoint.ToString() ||
+		ev.Message == nil {
+
+		t.Fatalf("got event %+v, want the added message", ev)
+	}
+	if ev.Message.Payload != "hello" ||
+		ev.Message.PubKey != hex.EncodeToString(pubKey) ||
+		ev.Message.ReceivedAt == nil {
+
+		t.Fatalf("got message %+v", ev.Message)
+	}
+
+	// The block handler processes a block spending the UTXO
+	cfg := blockchain.DefaultConfig()
+	cfg.NotificationsEnabled = false
+	h := blockchain.NewHandlerWithConfig(client, s.db, cfg)
+	h.SetExpireHandler(s.manager.AnnounceExpired)
+	if err := h.Start(t.Context()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { h.Stop() })
+	if err := h.SetPollInterval(10 * time.Millisecond); err != nil {
+		t.Fatalf("SetPollInterval: %v", err)
+	}
+	client.AddBlock(outpoint.WireOutPoint())
+
+	ev = nextEvent(t, conn)
+	if ev.Type != "message_removed" || ev.Reason != "spent" ||
+		ev.Outpoint != outpoint.ToString() || ev.Message != nil {
+
+		t.Fatalf("got event %+v, want the spent outpoint", ev)
+	}
+}
+
+// TestSubscribeFilter checks that a subscription filtered by sender only gets
+// the messages of that sender, while an unfiltered one gets them all.
+func TestSubscribeFilter(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	_, pkScript := senderKey(t, 6)
+	all := subscribe(t, s, srv, "")
+	filtered := subscribe(t, s, srv, "?pubkey="+
+		hex.EncodeToString(pkScript[2:]))
+
+	other := message.NewOutpoint(chainhash.Hash{1}, 0)
+	postSigned(t, s, client, 5, other, "not for the filter")
+	sender := message.NewOutpoint(chainhash.Hash{2}, 0)
+	postSigned(t, s, client, 6, sender, "for the filter")
+
+	for _, outpoint := range []message.Outpoint{other, sender} {
+		if ev := nextEvent(t, all); ev.Outpoint != outpoint.ToString() {
+			t.Fatalf("unfiltered subscription got %s, want %s",
+				ev.Outpoint, outpoint.ToString())
+		}
+	}
+	ev := nextEvent(t, filtered)
+	if ev.Outpoint != sender.ToString() || ev.Message == nil ||
+		ev.Message.Payload != "for the filter" {
+
+		t.Fatalf("filtered subscription got %+v, want %s", ev,
+			sender.ToString())
+	}
+
+	// A malformed filter is refused before the upgrade
+	var resp errorResponse
+	serveJSON(t, s, http.MethodGet, "/v1/subscribe?pubkey=abcd", nil,
+		http.StatusBadRequest, &resp)
+}
+
+// TestListEvents checks that the recent events are listed oldest first with
+// the reason a message went away, and that after and limit select the events
+// following an id and the last ones of them.
+func TestListEvents(t *testing.T) {
+	s, client := newTestServer(t, Config{Token: testToken})
+
+	first := message.NewOutpoint(chainhash.Hash{1}, 0)
+	postSigned(t, s, client, 5, first, "first")
+	second := message.NewOutpoint(chainhash.Hash{2}, 0)
+	postSigned(t, s, client, 6, second, "second")
+	body := []byte(`{"outpoint":"` + first.ToString() + `"}`)
+	var list network.Blocklist
+	serveJSON(t, s, http.MethodPost, "/v1/blocklist", body, http.StatusOK,
+		&list)
+
+	var resp eventsResponse
+	serveJSON(t, s, http.MethodGet, "/v1/events", nil, http.StatusOK, &resp)
+	want := []struct {
+		typ      string
+		outpoint message.Outpoint
+		reason   string
+	}{
+		{"message_added", first, ""},
+		{"message_added", second, ""},
+		{"message_removed", first, "blocked"},
+	}
+	if len(resp.Events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(resp.Events), len(want))
+	}
+	for i, ev := range resp.Events {
+		if ev.Type != want[i].typ || ev.Reason != want[i].reason ||
+			ev.Outpoint != want[i].outpoint.ToString() {
+
+			t.Fatalf("event %d is %+v, want %s of %s", i, ev,
+				want[i].typ, want[i].outpoint.ToString())
+		}
+		if i > 0 && ev.ID <= resp.Events[i-1].ID {
+			t.Fatalf("event %d id %d not after %d", i, ev.ID,
+				resp.Events[i-1].ID)
+		}
+	}
+
+	var after eventsResponse
+	serveJSON(t, s, http.MethodGet, fmt.Sprintf("/v1/events?after=%d",
+		resp.Events[0].ID), nil, http.StatusOK, &after)
+	if len(after.Events) != 2 || after.Events[0].ID != resp.Events[1].ID {
+		t.Fatalf("events after %d: %+v", resp.Events[0].ID, after.Events)
+	}
+	var last eventsResponse
+	serveJSON(t, s, http.MethodGet, "/v1/events?limit=1", nil,
+		http.StatusOK, &last)
+	if len(last.Events) != 1 || last.Events[0].ID != resp.Events[2].ID {
+		t.Fatalf("last event: %+v", last.Events)
+	}
+
+	var errResp errorResponse
+	serveJSON(t, s, http.MethodGet, "/v1/events?limit=-1", nil,
+		http.StatusBadRequest, &errResp)
+	serveJSON(t, s, http.MethodGet, "/v1/events?after=x", nil,
+		http.StatusBadRequest, &errResp)
+}
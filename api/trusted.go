@@ -0,0 +1,109 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// maxTrustRequestSize is the largest trusted peers request body accepted.
+const maxTrustRequestSize = 1024
+
+// trustRequest is the JSON body of a change of the trusted peers. Exactly one
+// of the fields is set.
+type trustRequest struct {
+	Addr string `json:"addr"`
+	Key  string `json:"key"`
+}
+
+// parseTrustRequest decodes a change of the trusted peers, returning either
+// the peer address or the identity key it is about.
+func parseTrustRequest(w http.ResponseWriter, r *http.Request) (string,
+	[]byte, error) {
+
+	var req trustRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTrustRequestSize))
+	if err := dec.Decode(&req); err != nil {
+		return "", nil, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	switch {
+	case req.Addr != "" && req.Key != "":
+		return "", nil, errors.New("expected either addr or key")
+
+	case req.Addr != "":
+		return req.Addr, nil, nil
+
+	case req.Key != "":
+		key, err := hex.DecodeString(req.Key)
+		if err != nil || len(key) != 32 {
+			return "", nil, fmt.Errorf(
+				"invalid key %q: expected 32 hex encoded bytes", req.Key)
+		}
+		return "", key, nil
+
+	default:
+		return "", nil, errors.New("expected addr or key")
+	}
+}
+
+// handleListTrusted returns the trusted peer addresses and identity keys.
+func (s *Server) handleListTrusted(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.manager.TrustedPeers())
+}
+
+// handleTrust trusts the peer address or identity key in the request body,
+// including the peers connected already.
+func (s *Server) handleTrust(w http.ResponseWriter, r *http.Request) {
+	addr, key, err := parseTrustRequest(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if key != nil {
+		err = s.manager.TrustKey(key)
+	} else {
+		err = s.manager.TrustAddr(addr)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.manager.TrustedPeers())
+}
+
+// handleDistrust stops trusting the peer address or identity key in the
+// request body.
+func (s *Server) handleDistrust(w http.ResponseWriter, r *http.Request) {
+	addr, key, err := parseTrustRequest(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if key != nil {
+		err = s.manager.DistrustKey(key)
+	} else {
+		err = s.manager.DistrustAddr(addr)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, network.ErrNotTrusted) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.manager.TrustedPeers())
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// maxWhitelistRequestSize is the largest whitelist request body accepted.
+const maxWhitelistRequestSize = 1 << 20
+
+// whitelistResponse is the JSON representation of the whitelist.
+type whitelistResponse struct {
+	Enabled bool `json:"enabled"`
+	*network.Whitelist
+}
+
+// handleGetWhitelist returns whether whitelist mode is enabled and the
+// whitelisted senders and outpoints.
+func (s *Server) handleGetWhitelist(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &whitelistResponse{
+		Enabled:   s.manager.WhitelistEnabled(),
+		Whitelist: s.manager.Whitelist(),
+	})
+}
+
+// handleSetWhitelist replaces the whitelist with the senders and outpoints in
+// the request body, given as {"pubkeys": [...], "outpoints": [...]}.
+func (s *Server) handleSetWhitelist(w http.ResponseWriter, r *http.Request) {
+	var list network.Whitelist
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		maxWhitelistRequestSize))
+	if err := dec.Decode(&list); err != nil {
+		writeError(w, http.StatusBadRequest,
+			fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+
+	if err := s.manager.SetWhitelist(&list); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, network.ErrWhitelistDisabled) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	s.handleGetWhitelist(w, r)
+}
@@ -0,0 +1,246 @@
+package bitcoin
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// DefaultCacheSize is the default number of UTXO lookups cached.
+	DefaultCacheSize = 10000
+
+	// DefaultCacheTTL is the default time a UTXO lookup is cached.
+	DefaultCacheTTL = 60 * time.Second
+
+	// DefaultNegativeCacheTTL is the default time a lookup of a missing or
+	// unconfirmed output is cached.
+	DefaultNegativeCacheTTL = 10 * time.Second
+)
+
+// CacheConfig defines the UTXO lookup cache of a CachedClient.
+type CacheConfig struct {
+	// Size is the number of lookups cached, the least recently used are
+	// dropped beyond it.
+	Size int
+
+	// TTL is how long the lookup of an unspent confirmed output is cached.
+	TTL time.Duration
+
+	// NegativeTTL is how long the lookup of a missing or unconfirmed
+	// output is cached. Such outputs may show up or confirm any time, so
+	// it is usually shorter than TTL.
+	NegativeTTL time.Duration
+}
+
+// DefaultCacheConfig returns the default configuration of the UTXO lookup
+// cache.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		Size:        DefaultCacheSize,
+		TTL:         DefaultCacheTTL,
+		NegativeTTL: DefaultNegativeCacheTTL,
+	}
+}
+
+// CacheStats holds counters describing the UTXO lookup cache.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// txOutKey identifies a cached GetTxOut call.
+type txOutKey struct {
+	outpoint wire.OutPoint
+	mempool  bool
+}
+
+// txOutEntry is a cached GetTxOut result, nil for a missing output.
+type txOutEntry struct {
+	key     txOutKey
+	result  *btcjson.GetTxOutResult
+	expires time.Time
+}
+
+// CachedClient wraps a ChainClient and caches the results of GetTxOut, so
+// that looking up the UTXO of a message more than once only reaches the node
+// once. Errors are never cached. Other calls are passed through.
+//
+// The cache must follow the chain: BlockConnected and Purge keep it in step
+// with the blocks processed by the block handler. It is safe for concurrent
+// use.
+type CachedClient struct {
+	ChainClient
+
+	config CacheConfig
+
+	entries map[txOutKey]*list.Element
+	order   *list.List
+	mu      sync.Mutex
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Ensure CachedClient implements the ChainClient interface.
+var _ ChainClient = (*CachedClient)(nil)
+
+// NewCachedClient wraps client with a UTXO lookup cache.
+func NewCachedClient(client ChainClient) *CachedClient {
+	return NewCachedClientWithConfig(client, DefaultCacheConfig())
+}
+
+// NewCachedClientWithConfig wraps client with a UTXO lookup cache with the
+// specified configuration.
+func NewCachedClientWithConfig(client ChainClient,
+	config CacheConfig) *CachedClient {
+
+	return &CachedClient{
+		ChainClient: client,
+		config:      config,
+		entries:     make(map[txOutKey]*list.Element),
+		order:       list.New(),
+	}
+}
+
+// GetTxOut returns the cached result of the call if there is one, and
+// otherwise asks the node and caches the answer. The result is shared with
+// other callers and must not be modified.
+func (c *CachedClient) GetTxOut(ctx context.Context, txHash *chainhash.Hash,
+	index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+
+	key := txOutKey{*wire.NewOutPoint(txHash, index), mempool}
+	if result, ok := c.lookup(key, time.Now()); ok {
+		c.hits.Add(1)
+		return result, nil
+	}
+	c.misses.Add(1)
+
+	result, err := c.ChainClient.GetTxOut(ctx, txHash, index, mempool)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, result, time.Now())
+	return result, nil
+}
+
+// lookup returns the unexpired cached result for key.
+func (c *CachedClient) lookup(key txOutKey,
+	now time.Time) (*btcjson.GetTxOutResult, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*txOutEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.result, true
+}
+
+// store caches result for key, dropping the least recently used entry if the
+// cache is full.
+func (c *CachedClient) store(key txOutKey, result *btcjson.GetTxOutResult,
+	now time.Time) {
+
+	ttl := c.config.TTL
+	if result == nil || result.Confirmations == 0 {
+		ttl = c.config.NegativeTTL
+	}
+	if ttl <= 0 || c.config.Size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &txOutEntry{key: key, result: result, expires: now.Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	for c.order.Len() >= c.config.Size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*txOutEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+}
+
+// BlockConnected updates the cache for a new block that spent the given
+// outpoints. Their cached lookups are dropped along with those of missing
+// and unconfirmed outputs, which the block may have confirmed. The other
+// cached outputs gain a confirmation.
+func (c *CachedClient) BlockConnected(spent []wire.OutPoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, outpoint := range spent {
+		for _, mempool := range []bool{false, true} {
+			key := txOutKey{outpoint, mempool}
+			if elem, ok := c.entries[key]; ok {
+				c.order.Remove(elem)
+				delete(c.entries, key)
+			}
+		}
+	}
+
+	for key, elem := range c.entries {
+		entry := elem.Value.(*txOutEntry)
+		if entry.result == nil || entry.result.Confirmations == 0 {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+			continue
+		}
+
+		// Results are shared with callers, so replace rather than
+		// modify them
+		result := *entry.result
+		result.Confirmations++
+		entry.result = &result
+	}
+}
+
+// Purge drops every cached lookup, such as when blocks are disconnected and
+// spent outputs may be unspent again.
+func (c *CachedClient) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[txOutKey]*list.Element)
+	c.order.Init()
+}
+
+// Stats returns the cache counters.
+func (c *CachedClient) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// Unwrap returns the client whose lookups are cached, so optional interfaces
+// such as RawBlockClient can be detected through the cache.
+func (c *CachedClient) Unwrap() ChainClient {
+	return c.ChainClient
+}
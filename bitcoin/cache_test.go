@@ -0,0 +1,165 @@
+package bitcoin_test
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/bitcoin"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// testScript is a taproot script the mock node reports for test UTXOs.
+var testScript = append([]byte{0x51, 0x20}, make([]byte, 32)...)
+
+// TestCachedValidation checks that looking up the UTXO of the same message
+// twice, as the peer handler and the validator do, reaches the node once.
+func TestCachedValidation(t *testing.T) {
+	ctx := context.Background()
+	client := mock.NewClient()
+	cache := bitcoin.NewCachedClient(client)
+	validator := database.NewValidator(cache, database.NewMemoryDB())
+
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, testScript)
+	for i := 0; i < 2; i++ {
+		if _, err := validator.LookupUTXO(ctx, outpoint); err != nil {
+			t.Fatalf("LookupUTXO: %v", err)
+		}
+	}
+	if n := client.Calls(mock.MethodGetTxOut); n != 1 {
+		t.Fatalf("node asked %d times, want once", n)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 ||
+		stats.Entries != 1 {
+
+		t.Fatalf("got cache stats %+v", stats)
+	}
+}
+
+// TestCachedClientTTL checks that missing outputs are cached for the
+// negative TTL and unspent ones for the TTL, and that errors are not cached.
+func TestCachedClientTTL(t *testing.T) {
+	ctx := context.Background()
+	client := mock.NewClient()
+	cache := bitcoin.NewCachedClientWithConfig(client, bitcoin.CacheConfig{
+		Size:        10,
+		TTL:         time.Hour,
+		NegativeTTL: 50 * time.Millisecond,
+	})
+
+	unspent, missing := chainhash.Hash{1}, chainhash.Hash{2}
+	client.AddUTXO(*wire.NewOutPoint(&unspent, 0), 50000, testScript)
+	lookup := func(hash chainhash.Hash) {
+		t.Helper()
+		if _, err := cache.GetTxOut(ctx, &hash, 0, false); err != nil {
+			t.Fatalf("GetTxOut: %v", err)
+		}
+	}
+
+	lookup(unspent)
+	lookup(missing)
+	lookup(unspent)
+	lookup(missing)
+	if n := client.Calls(mock.MethodGetTxOut); n != 2 {
+		t.Fatalf("node asked %d times, want 2", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	lookup(unspent)
+	lookup(missing)
+	if n := client.Calls(mock.MethodGetTxOut); n != 3 {
+		t.Fatalf("node asked %d times, want the missing output again", n)
+	}
+
+	// A failed lookup is made again
+	other := chainhash.Hash{3}
+	client.FailCalls(mock.MethodGetTxOut, 1, syscall.ECONNREFUSED)
+	if _, err := cache.GetTxOut(ctx, &other, 0, false); !errors.Is(err,
+		syscall.ECONNREFUSED) {
+
+		t.Fatalf("failing node gave %v", err)
+	}
+	lookup(other)
+	if n := client.Calls(mock.MethodGetTxOut); n != 5 {
+		t.Fatalf("node asked %d times, want the failed lookup again", n)
+	}
+}
+
+// TestCachedClientBlockConnected checks that a block drops the lookups of
+// the outputs it spent and of missing ones, adds a confirmation to the
+// others, and that Purge drops them all.
+func TestCachedClientBlockConnected(t *testing.T) {
+	ctx := context.Background()
+	client := mock.NewClient()
+	cache := bitcoin.NewCachedClient(client)
+
+	spent, kept, missing := chainhash.Hash{1}, chainhash.Hash{2},
+		chainhash.Hash{3}
+	for _, hash := range []chainhash.Hash{spent, kept} {
+		client.AddUTXO(*wire.NewOutPoint(&hash, 0), 50000, testScript)
+	}
+	for _, hash := range []chainhash.Hash{spent, kept, missing} {
+		if _, err := cache.GetTxOut(ctx, &hash, 0, false); err != nil {
+			t.Fatalf("GetTxOut: %v", err)
+		}
+	}
+	before, _ := cache.GetTxOut(ctx, &kept, 0, false)
+
+	client.AddBlock(*wire.NewOutPoint(&spent, 0))
+	cache.BlockConnected([]wire.OutPoint{*wire.NewOutPoint(&spent, 0)})
+	if n := cache.Stats().Entries; n != 1 {
+		t.Fatalf("%d lookups cached after the block, want 1", n)
+	}
+	after, err := cache.GetTxOut(ctx, &kept, 0, false)
+	if err != nil || after.Confirmations != before.Confirmations+1 {
+		t.Fatalf("kept output has %d confirmations, %v, want %d",
+			after.Confirmations, err, before.Confirmations+1)
+	}
+	if result, err := cache.GetTxOut(ctx, &spent, 0, false); err != nil ||
+		result != nil {
+
+		t.Fatalf("spent output looked up as %+v, %v", result, err)
+	}
+
+	cache.Purge()
+	if n := cache.Stats().Entries; n != 0 {
+		t.Fatalf("%d lookups cached after Purge", n)
+	}
+}
+
+// TestCachedClientSize checks that the least recently used lookup is
+// dropped once the cache is full.
+func TestCachedClientSize(t *testing.T) {
+	ctx := context.Background()
+	client := mock.NewClient()
+	config := bitcoin.DefaultCacheConfig()
+	config.Size = 2
+	cache := bitcoin.NewCachedClientWithConfig(client, config)
+
+	lookup := func(n byte) {
+		t.Helper()
+		hash := chainhash.Hash{n}
+		if _, err := cache.GetTxOut(ctx, &hash, 0, false); err != nil {
+			t.Fatalf("GetTxOut: %v", err)
+		}
+	}
+	for _, n := range []byte{1, 2, 1, 3} {
+		lookup(n)
+	}
+	calls := client.Calls(mock.MethodGetTxOut)
+	lookup(1)
+	if client.Calls(mock.MethodGetTxOut) != calls {
+		t.Fatal("recently used lookup dropped")
+	}
+	lookup(2)
+	if client.Calls(mock.MethodGetTxOut) != calls+1 {
+		t.Fatal("least recently used lookup kept beyond the size")
+	}
+}
@@ -0,0 +1,62 @@
+package bitcoin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Chain identifies a Bitcoin network. Messages are anchored to UTXOs of a
+// single chain, so nodes and their peers must agree on it.
+type Chain string
+
+const (
+	// ChainMainnet is the main Bitcoin network.
+	ChainMainnet Chain = "mainnet"
+	// ChainTestnet is testnet3.
+	ChainTestnet Chain = "testnet"
+	// ChainTestnet4 is testnet4.
+	ChainTestnet4 Chain = "testnet4"
+	// ChainSignet is the default signet.
+	ChainSignet Chain = "signet"
+	// ChainRegtest is a local regression test network.
+	ChainRegtest Chain = "regtest"
+)
+
+// chainParams holds the per-chain settings.
+var chainParams = map[Chain]struct {
+	rpcName string
+	port    string
+	rpcPort string
+}{
+	ChainMainnet:  {"main", "8335", "8332"},
+	ChainTestnet:  {"test", "18335", "18332"},
+	ChainTestnet4: {"testnet4", "48335", "48332"},
+	ChainSignet:   {"signet", "38335", "38332"},
+	ChainRegtest:  {"regtest", "18446", "18443"},
+}
+
+// ParseChain parses a chain name, case insensitively.
+func ParseChain(name string) (Chain, error) {
+	chain := Chain(strings.ToLower(name))
+	if _, ok := chainParams[chain]; !ok {
+		return "", fmt.Errorf("unknown chain %q, expected one of mainnet, "+
+			"testnet, testnet4, signet or regtest", name)
+	}
+	return chain, nil
+}
+
+// RPCName returns the chain name reported by getblockchaininfo.
+func (c Chain) RPCName() string {
+	return chainParams[c].rpcName
+}
+
+// DefaultPort returns the default UTXOchat peer port of the chain.
+func (c Chain) DefaultPort() string {
+	return chainParams[c].port
+}
+
+// DefaultRPCPort returns the port bitcoind serves RPC and REST on by default
+// for the chain.
+func (c Chain) DefaultRPCPort() string {
+	return chainParams[c].rpcPort
+}
@@ -2,26 +2,102 @@ package bitcoin
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 )
 
+// DefaultRPCTimeout is the default time in seconds a call to the Bitcoin node
+// may take when the caller's context has no deadline.
+const DefaultRPCTimeout = 30
+
 // Config defines the Bitcoin node configuration.
 type Config struct {
+	// Backend selects the interface the node is reached over, BackendRPC
+	// if empty or BackendREST. RESTURL is the base URL of the REST
+	// interface, which takes no credentials.
+	Backend string
+	RESTURL string
+
+	// RPCURL is the address of the node, with or without an http:// or
+	// https:// scheme. Whether TLS is used is set by DisableTLS.
 	RPCURL  string
 	RPCUser string
 	RPCPass string
+
+	// RPCCookiePath is the path of the .cookie file bitcoind writes when
+	// it has no static credentials. It is used when RPCPass is empty, and
+	// read again when the node refuses the credentials since bitcoind
+	// writes a new cookie every time it starts.
+	RPCCookiePath string
+
+	// DisableTLS connects over plain HTTP. Otherwise the node certificate
+	// is checked against RPCCAFile, a PEM encoded CA certificate, or the
+	// system roots if empty.
+	DisableTLS bool
+	RPCCAFile  string
+
+	// RPCTimeout is the time in seconds a call may take when the caller's
+	// context has no deadline. Zero selects DefaultRPCTimeout.
+	RPCTimeout int
+}
+
+// ChainClient is the subset of the Bitcoin node RPC interface used by
+// UTXOchat. Client implements it against a live node; the mock package
+// provides a programmable fake for tests. Every call returns the context's
+// error once ctx is done.
+type ChainClient interface {
+	// GetBlockchainInfo returns the current chain and height.
+	GetBlockchainInfo(ctx context.Context) (*BlockchainInfo, error)
+
+	// GetBlockHash returns the hash of the best chain block at height.
+	GetBlockHash(ctx context.Context, height int32) (*chainhash.Hash, error)
+
+	// GetBlock returns a block with the ids of its transactions.
+	GetBlock(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error)
+
+	// GetBlockVerboseTx returns a block with full transaction details.
+	GetBlockVerboseTx(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error)
+
+	// GetRawTransaction returns a transaction, which requires txindex for
+	// transactions outside the mempool.
+	GetRawTransaction(ctx context.Context, txHash *chainhash.Hash) (*btcjson.TxRawResult, error)
+
+	// GetTxOut returns an unspent transaction output, or nil if it does
+	// not exist or has been spent.
+	GetTxOut(ctx context.Context, txHash *chainhash.Hash, index uint32, mempool bool) (*btcjson.GetTxOutResult, error)
 }
 
 // Client represents a Bitcoin RPC client.
 type Client struct {
-	*rpcclient.Client
+	// rpc is the underlying client. It is replaced by one with the new
+	// credentials when the cookie changed.
+	rpc atomic.Pointer[rpcclient.Client]
+
+	// connCfg is the configuration rpc was created with, and cookiePath
+	// the cookie its credentials came from, if any.
+	connCfg    rpcclient.ConnConfig
+	cookiePath string
+	closed     bool
+	mu         sync.Mutex
+
+	// timeout bounds calls whose context has no deadline.
+	timeout time.Duration
 }
 
+// Ensure Client implements the ChainClient interface.
+var _ ChainClient = (*Client)(nil)
+
 // BlockchainInfo represents the response from getblockchaininfo RPC call.
 type BlockchainInfo struct {
 	Chain  string `json:"chain"`
@@ -30,28 +106,157 @@ type BlockchainInfo struct {
 
 // NewClient creates a new Bitcoin RPC client.
 func NewClient(cfg Config) (*Client, error) {
-	// Parse host from RPCURL
+	// rpcclient adds the scheme itself according to DisableTLS
 	host := cfg.RPCURL
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.TrimPrefix(host, "https://")
 	if host == "" {
 		host = "localhost:8332"
 	}
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         host,
-		User:         cfg.RPCUser,
-		Pass:         cfg.RPCPass,
-		HTTPPostMode: true,
-		DisableTLS:   true,
+	c := &Client{
+		connCfg: rpcclient.ConnConfig{
+			Host:         host,
+			User:         cfg.RPCUser,
+			Pass:         cfg.RPCPass,
+			HTTPPostMode: true,
+			DisableTLS:   cfg.DisableTLS,
+		},
+	}
+
+	// Explicit credentials win over the cookie
+	if cfg.RPCPass == "" && cfg.RPCCookiePath != "" {
+		user, pass, err := readCookie(cfg.RPCCookiePath)
+		if err != nil {
+			return nil, err
+		}
+		c.connCfg.User = user
+		c.connCfg.Pass = pass
+		c.cookiePath = cfg.RPCCookiePath
+	}
+
+	if !cfg.DisableTLS && cfg.RPCCAFile != "" {
+		pem, err := os.ReadFile(cfg.RPCCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificate found in %s",
+				cfg.RPCCAFile)
+		}
+		c.connCfg.Certificates = pem
+	}
+
+	client, err := c.newRPCClient()
+	if err != nil {
+		return nil, err
+	}
+	c.rpc.Store(client)
+
+	timeout := cfg.RPCTimeout
+	if timeout == 0 {
+		timeout = DefaultRPCTimeout
 	}
-	fmt.Println("connCfg", connCfg)
-	client, err := rpcclient.New(connCfg, nil)
+	c.timeout = time.Duration(timeout) * time.Second
+
+	return c, nil
+}
+
+// newRPCClient creates an rpcclient for the current configuration.
+func (c *Client) newRPCClient() (*rpcclient.Client, error) {
+	// rpcclient keeps the config it is given, so it gets its own copy
+	connCfg := c.connCfg
+	client, err := rpcclient.New(&connCfg, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Bitcoin client: %v", err)
 	}
+	return client, nil
+}
+
+// reloadCookie reads the cookie again after used, the client a call was made
+// with, had its credentials refused. It reports whether the call should be
+// retried, which is when the cookie changed or another call already picked
+// up the new one.
+func (c *Client) reloadCookie(used *rpcclient.Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	if c.rpc.Load() != used {
+		return true
+	}
 
-	return &Client{
-		Client: client,
-	}, nil
+	user, pass, err := readCookie(c.cookiePath)
+	if err != nil || (user == c.connCfg.User && pass == c.connCfg.Pass) {
+		return false
+	}
+
+	c.connCfg.User = user
+	c.connCfg.Pass = pass
+	client, err := c.newRPCClient()
+	if err != nil {
+		return false
+	}
+	c.rpc.Store(client)
+
+	// Calls still queued on the old client fail with ErrClientShutdown
+	// and are retried on the new one
+	used.Shutdown()
+	return true
+}
+
+// call makes a call started by start with one of the rpcclient Async methods
+// and waits for its result. With cookie authentication, a call refused by
+// the node is made again once if the cookie changed meanwhile.
+func call[T any](c *Client, ctx context.Context,
+	start func(*rpcclient.Client) func() (T, error)) (T, error) {
+
+	used := c.rpc.Load()
+	value, err := await(c, ctx, start(used))
+	if err == nil || c.cookiePath == "" {
+		return value, err
+	}
+	if !isAuthError(err) && !errors.Is(err, rpcclient.ErrClientShutdown) {
+		return value, err
+	}
+	if !c.reloadCookie(used) {
+		return value, err
+	}
+	return await(c, ctx, start(c.rpc.Load()))
+}
+
+// await waits for receive to return the result of a call started with one of
+// the rpcclient Async methods. It gives up with the context's error once ctx
+// is done, or once the client timeout elapses if ctx has no deadline. The
+// request itself can't be canceled, its result is discarded when it arrives.
+func await[T any](c *Client, ctx context.Context,
+	receive func() (T, error)) (T, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := receive()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
 }
 
 type GetBlockchainInfoResult struct {
@@ -79,9 +284,13 @@ type RegtestGetBlockchainInfoResult struct {
 func (c *Client) GetBlockchainInfo(ctx context.Context) (*BlockchainInfo, error) {
 	// Get blockchain info using the RPC client
 	// use rawrequest because rpcclient cannot handle response in regtest where warning is a slice instead of a string(mainnet)
-	result, err := c.RawRequest("getblockchaininfo", []json.RawMessage{})
+	result, err := call(c, ctx,
+		func(rpc *rpcclient.Client) func() (json.RawMessage, error) {
+			return rpc.RawRequestAsync("getblockchaininfo",
+				[]json.RawMessage{}).Receive
+		})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get blockchain info: %v", err)
+		return nil, fmt.Errorf("failed to get blockchain info: %w", err)
 	}
 
 	// Unmarshal into map to see all fields
@@ -102,26 +311,53 @@ func (c *Client) GetBlockchainInfo(ctx context.Context) (*BlockchainInfo, error)
 
 // Close shuts down the client.
 func (c *Client) Close() {
-	c.Shutdown()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.rpc.Load().Shutdown()
 }
 
 // GetBlockHash gets the block hash for a given height
 func (c *Client) GetBlockHash(ctx context.Context, height int32) (*chainhash.Hash, error) {
-	return c.Client.GetBlockHash(int64(height))
+	return call(c, ctx,
+		func(rpc *rpcclient.Client) func() (*chainhash.Hash, error) {
+			return rpc.GetBlockHashAsync(int64(height)).Receive
+		})
 }
 
 // GetBlock gets a block by hash and returns the raw block data
 func (c *Client) GetBlock(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
 	// Get verbose block info which includes transaction details
-	return c.Client.GetBlockVerbose(blockHash)
+	return call(c, ctx,
+		func(rpc *rpcclient.Client) func() (*btcjson.GetBlockVerboseResult, error) {
+			return rpc.GetBlockVerboseAsync(blockHash).Receive
+		})
 }
 
 // GetBlockVerboseTx gets a block with full transaction details (verbosity level 2)
-func (c *Client) GetBlockVerboseTx(blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
-	return c.Client.GetBlockVerboseTx(blockHash)
+func (c *Client) GetBlockVerboseTx(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+	return call(c, ctx,
+		func(rpc *rpcclient.Client) func() (*btcjson.GetBlockVerboseTxResult, error) {
+			return rpc.GetBlockVerboseTxAsync(blockHash).Receive
+		})
 }
 
 // GetRawTransaction gets the raw transaction data for a given transaction hash
 func (c *Client) GetRawTransaction(ctx context.Context, txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
-	return c.Client.GetRawTransactionVerbose(txHash)
+	return call(c, ctx,
+		func(rpc *rpcclient.Client) func() (*btcjson.TxRawResult, error) {
+			return rpc.GetRawTransactionVerboseAsync(txHash).Receive
+		})
+}
+
+// GetTxOut gets an unspent transaction output, or nil if it does not exist or
+// has been spent.
+func (c *Client) GetTxOut(ctx context.Context, txHash *chainhash.Hash,
+	index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+
+	return call(c, ctx,
+		func(rpc *rpcclient.Client) func() (*btcjson.GetTxOutResult, error) {
+			return rpc.GetTxOutAsync(txHash, index, mempool).Receive
+		})
 }
@@ -0,0 +1,81 @@
+package bitcoin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// newStalledClient returns a client of an RPC server that never answers,
+// until the test ends.
+func newStalledClient(t *testing.T, timeout int) *Client {
+	t.Helper()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	c, err := NewClient(Config{
+		RPCURL:     server.Listener.Addr().String(),
+		RPCUser:    "user",
+		RPCPass:    "pass",
+		DisableTLS: true,
+		RPCTimeout: timeout,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// TestCallTimeout checks that a call to a stalled node gives up after the
+// client timeout when the context has no deadline, and after the context's
+// own deadline otherwise, and that either counts as a transport error.
+func TestCallTimeout(t *testing.T) {
+	c := newStalledClient(t, 1)
+	var txid chainhash.Hash
+
+	start := time.Now()
+	_, err := c.GetTxOut(context.Background(), &txid, 0, true)
+	if !errors.Is(err, context.DeadlineExceeded) || !IsTransportError(err) {
+		t.Fatalf("stalled node gave %v, want DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited < time.Second ||
+		waited > 3*time.Second {
+
+		t.Fatalf("gave up after %v with a 1s timeout", waited)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = c.GetBlockHash(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stalled node gave %v, want DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited > 900*time.Millisecond {
+		t.Fatalf("gave up after %v with a 100ms deadline", waited)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetBlockchainInfo(ctx); !errors.Is(err,
+		context.Canceled) {
+
+		t.Fatalf("canceled call gave %v", err)
+	}
+}
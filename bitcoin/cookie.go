@@ -0,0 +1,47 @@
+package bitcoin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidCookie is returned when a cookie file isn't of the user:password
+// form written by bitcoind.
+var ErrInvalidCookie = errors.New("invalid cookie")
+
+// ParseCookie parses the content of the .cookie file bitcoind writes to its
+// data directory when no static RPC credentials are configured. The file
+// holds a single user:password line.
+func ParseCookie(data []byte) (user, pass string, err error) {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	user, pass, ok := strings.Cut(strings.TrimRight(string(line), "\r"), ":")
+	if !ok || user == "" || pass == "" {
+		return "", "", fmt.Errorf("%w: expected user:password", ErrInvalidCookie)
+	}
+	return user, pass, nil
+}
+
+// readCookie reads and parses the cookie file at path.
+func readCookie(path string) (user, pass string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read cookie: %v", err)
+	}
+
+	user, pass, err = ParseCookie(data)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	return user, pass, nil
+}
+
+// isAuthError reports whether err is the node refusing the credentials.
+// bitcoind answers HTTP 401 with an empty body, which rpcclient reports with
+// the status code in the error text.
+func isAuthError(err error) bool {
+	return err != nil && (strings.HasPrefix(err.Error(), "status code: 401") ||
+		strings.HasPrefix(err.Error(), "status code: 403"))
+}
@@ -0,0 +1,259 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// testBlockHash is the hash every test RPC server answers getblockhash with.
+var testBlockHash = chainhash.Hash{1, 2, 3}
+
+// rpcHandler answers every JSON-RPC request with testBlockHash, once its
+// basic auth credentials pass auth. It counts the requests it refused.
+func rpcHandler(auth func(user, pass string) bool,
+	refused *atomic.Int32) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if !auth(user, pass) {
+			refused.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"result": testBlockHash.String(),
+			"error":  nil,
+			"id":     req.ID,
+		})
+	}
+}
+
+// writeCookie writes a cookie file with user:pass to path.
+func writeCookie(t *testing.T, path, user, pass string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(user+":"+pass), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestParseCookie checks that the user:password line bitcoind writes is
+// parsed, and that anything else is an invalid cookie.
+func TestParseCookie(t *testing.T) {
+	tests := []struct {
+		data       string
+		user, pass string
+	}{
+		{"__cookie__:abc123", "__cookie__", "abc123"},
+		{"__cookie__:abc123\n", "__cookie__", "abc123"},
+		{"__cookie__:abc123\r\n", "__cookie__", "abc123"},
+		{"__cookie__:a:b", "__cookie__", "a:b"},
+		{"__cookie__:abc123\nignored", "__cookie__", "abc123"},
+	}
+	for _, test := range tests {
+		user, pass, err := ParseCookie([]byte(test.data))
+		if err != nil || user != test.user || pass != test.pass {
+			t.Fatalf("%q parsed as %q, %q, %v", test.data, user, pass, err)
+		}
+	}
+
+	for _, data := range []string{"", "\n", "nocolon", ":pass", "user:",
+		"\nuser:pass"} {
+
+		if _, _, err := ParseCookie([]byte(data)); !errors.Is(err,
+			ErrInvalidCookie) {
+
+			t.Fatalf("%q gave %v, want ErrInvalidCookie", data, err)
+		}
+	}
+}
+
+// TestCookiePrecedence checks that explicit credentials are used over the
+// cookie, that the cookie is used without them and that a missing cookie
+// fails the client.
+func TestCookiePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".cookie")
+	writeCookie(t, path, "__cookie__", "secret")
+
+	tests := []struct {
+		name       string
+		user, pass string
+		wantUser   string
+		wantPass   string
+	}{
+		{"cookie", "", "", "__cookie__", "secret"},
+		{"explicit", "user", "pass", "user", "pass"},
+		{"user only", "user", "", "__cookie__", "secret"},
+	}
+	for _, test := range tests {
+		c, err := NewClient(Config{
+			RPCURL:        "127.0.0.1:1",
+			RPCUser:       test.user,
+			RPCPass:       test.pass,
+			RPCCookiePath: path,
+			DisableTLS:    true,
+		})
+		if err != nil {
+			t.Fatalf("%s: NewClient: %v", test.name, err)
+		}
+		c.Close()
+		if c.connCfg.User != test.wantUser ||
+			c.connCfg.Pass != test.wantPass {
+
+			t.Fatalf("%s: authenticating as %s:%s, want %s:%s",
+				test.name, c.connCfg.User, c.connCfg.Pass,
+				test.wantUser, test.wantPass)
+		}
+	}
+
+	_, err := NewClient(Config{
+		RPCCookiePath: filepath.Join(t.TempDir(), ".cookie"),
+		DisableTLS:    true,
+	})
+	if err == nil {
+		t.Fatal("client created with a missing cookie")
+	}
+}
+
+// TestCookieReload checks that a call refused after bitcoind wrote a new
+// cookie is made again with it.
+func TestCookieReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".cookie")
+	writeCookie(t, path, "__cookie__", "first")
+
+	var (
+		current atomic.Value
+		refused atomic.Int32
+	)
+	current.Store("first")
+	server := httptest.NewServer(rpcHandler(func(user, pass string) bool {
+		return user == "__cookie__" && pass == current.Load()
+	}, &refused))
+	t.Cleanup(server.Close)
+
+	c, err := NewClient(Config{
+		RPCURL:        server.Listener.Addr().String(),
+		RPCCookiePath: path,
+		DisableTLS:    true,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	ctx := context.Background()
+	if hash, err := c.GetBlockHash(ctx, 1); err != nil ||
+		*hash != testBlockHash {
+
+		t.Fatalf("GetBlockHash gave %v, %v", hash, err)
+	}
+
+	// bitcoind restarts with a new cookie
+	current.Store("second")
+	writeCookie(t, path, "__cookie__", "second")
+	if hash, err := c.GetBlockHash(ctx, 1); err != nil ||
+		*hash != testBlockHash {
+
+		t.Fatalf("GetBlockHash after the restart gave %v, %v", hash, err)
+	}
+	if n := refused.Load(); n != 1 {
+		t.Fatalf("%d calls refused, want 1", n)
+	}
+
+	// A refusal without a new cookie isn't retried
+	current.Store("third")
+	if _, err := c.GetBlockHash(ctx, 1); !isAuthError(err) {
+		t.Fatalf("GetBlockHash with a stale cookie gave %v", err)
+	}
+	if n := refused.Load(); n != 2 {
+		t.Fatalf("%d calls refused, want 2", n)
+	}
+}
+
+// TestClientTLS checks that the client reaches a TLS node whose certificate
+// is signed by RPCCAFile, and not one it can't verify or with TLS disabled.
+func TestClientTLS(t *testing.T) {
+	var refused atomic.Int32
+	server := httptest.NewUnstartedServer(rpcHandler(
+		func(user, pass string) bool {
+			return user == "user" && pass == "pass"
+		}, &refused))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	if err := os.WriteFile(caFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// call reports the result of a call with the CA file and TLS setting
+	call := func(caFile string, disableTLS bool) error {
+		t.Helper()
+
+		c, err := NewClient(Config{
+			RPCURL:     "https://" + server.Listener.Addr().String(),
+			RPCUser:    "user",
+			RPCPass:    "pass",
+			RPCCAFile:  caFile,
+			DisableTLS: disableTLS,
+			RPCTimeout: 2,
+		})
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		defer c.Close()
+
+		hash, err := c.GetBlockHash(context.Background(), 1)
+		if err == nil && *hash != testBlockHash {
+			t.Fatalf("got hash %v", hash)
+		}
+		return err
+	}
+
+	if err := call(caFile, false); err != nil {
+		t.Fatalf("call with the CA certificate failed: %v", err)
+	}
+	if err := call("", false); err == nil {
+		t.Fatal("certificate verified against the system roots")
+	}
+	if err := call(caFile, true); err == nil {
+		t.Fatal("plain HTTP call to a TLS node succeeded")
+	}
+
+	// A CA file without a certificate is refused up front
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("not a certificate"),
+		0600); err != nil {
+
+		t.Fatal(err)
+	}
+	_, err := NewClient(Config{RPCCAFile: badFile})
+	if err == nil {
+		t.Fatal("client created with a CA file without a certificate")
+	}
+}
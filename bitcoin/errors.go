@@ -0,0 +1,73 @@
+package bitcoin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// IsTransportError reports whether err means the Bitcoin node could not be
+// reached or was not ready to answer, as opposed to an answer to the call.
+// Such failures are expected to clear once the node is back, so the call may
+// be retried.
+func IsTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// bitcoind answers with RPC_IN_WARMUP while it loads the chain after
+	// a restart
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code == btcjson.ErrRPCInWarmup
+	}
+
+	// and its REST interface with 503 Service Unavailable
+	var restErr *RESTStatusError
+	if errors.As(err, &restErr) {
+		return restErr.StatusCode == http.StatusServiceUnavailable
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, rpcclient.ErrClientNotConnected),
+		errors.Is(err, rpcclient.ErrClientDisconnect):
+		return true
+	}
+	return false
+}
+
+// IsPrunedError reports whether err is the answer of a pruned node asked for a
+// block it no longer stores. bitcoind reports it with RPC_MISC_ERROR over RPC
+// and 404 Not Found over REST, both mentioning the pruned data.
+func IsPrunedError(err error) bool {
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code == btcjson.ErrRPCMisc &&
+			strings.Contains(rpcErr.Message, "pruned")
+	}
+
+	var restErr *RESTStatusError
+	if errors.As(err, &restErr) {
+		return restErr.StatusCode == http.StatusNotFound &&
+			strings.Contains(restErr.Message, "pruned")
+	}
+	return false
+}
@@ -0,0 +1,327 @@
+package bitcoin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive failed
+	// calls or health checks after which an endpoint is abandoned.
+	DefaultFailureThreshold = 3
+
+	// DefaultHealthCheckInterval is the default time between health
+	// checks of the endpoints.
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
+// ErrRawBlockUnsupported is returned by FailoverClient.GetRawBlock when the
+// endpoint asked can't serve blocks in their binary serialization.
+var ErrRawBlockUnsupported = errors.New("raw blocks not supported")
+
+// Endpoint is a Bitcoin node a FailoverClient may use.
+type Endpoint struct {
+	// Name identifies the endpoint in logs and stats, usually its URL.
+	Name   string
+	Client ChainClient
+}
+
+// FailoverConfig defines how a FailoverClient chooses its endpoint.
+type FailoverConfig struct {
+	// FailureThreshold is the number of consecutive calls or health
+	// checks an endpoint may fail to answer before the next one is used.
+	FailureThreshold int
+
+	// HealthCheckInterval is the time between health checks.
+	HealthCheckInterval time.Duration
+
+	// Chain is the chain name getblockchaininfo must report, as returned
+	// by Chain.RPCName. Endpoints on another chain are never used. Empty
+	// doesn't check the chain.
+	Chain string
+}
+
+// DefaultFailoverConfig returns the default failover configuration.
+func DefaultFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		FailureThreshold:    DefaultFailureThreshold,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+	}
+}
+
+// FailoverStats describes the endpoint a FailoverClient uses.
+type FailoverStats struct {
+	// Active is the name of the endpoint calls go to first.
+	Active string
+
+	// Switches is the number of times the active endpoint changed.
+	Switches uint64
+}
+
+// endpointState is an endpoint along with its health.
+type endpointState struct {
+	Endpoint
+
+	// failures is the number of consecutive calls or health checks the
+	// endpoint failed to answer.
+	failures int
+
+	// wrongChain is set once the endpoint reported another chain.
+	wrongChain bool
+}
+
+// FailoverClient implements ChainClient over several Bitcoin nodes, listed in
+// order of preference. Calls go to the active endpoint, the first one that
+// answers, and are made again on the others when it can't be reached. Once
+// an endpoint failed FailureThreshold calls or health checks in a row the
+// next one becomes active, and a preferred endpoint becomes active again as
+// soon as it answers a health check.
+//
+// The nodes may be at slightly different tips, so users that follow the
+// chain should check their recent blocks again when FailoverStats.Switches
+// changes. It is safe for concurrent use.
+type FailoverClient struct {
+	config    FailoverConfig
+	endpoints []*endpointState
+	active    int
+	switches  uint64
+	mu        sync.Mutex
+}
+
+// Ensure FailoverClient implements the ChainClient and RawBlockClient
+// interfaces.
+var (
+	_ ChainClient    = (*FailoverClient)(nil)
+	_ RawBlockClient = (*FailoverClient)(nil)
+)
+
+// NewFailoverClient creates a client of endpoints, the first of which is
+// preferred. Start runs the health checks.
+func NewFailoverClient(endpoints []Endpoint,
+	config FailoverConfig) (*FailoverClient, error) {
+
+	if len(endpoints) == 0 {
+		return nil, errors.New("no Bitcoin node endpoint")
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	f := &FailoverClient{config: config}
+	for _, endpoint := range endpoints {
+		f.endpoints = append(f.endpoints, &endpointState{Endpoint: endpoint})
+	}
+	return f, nil
+}
+
+// Start checks the health of every endpoint right away and then each
+// HealthCheckInterval until ctx is done.
+func (f *FailoverClient) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(f.config.HealthCheckInterval)
+		defer ticker.Stop()
+
+		f.checkHealth(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				f.checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+// checkHealth asks every endpoint for its chain at once and records which
+// answered on the right chain.
+func (f *FailoverClient) checkHealth(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx,
+		f.config.HealthCheckInterval)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i, endpoint := range f.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			info, err := endpoint.Client.GetBlockchainInfo(checkCtx)
+			if ctx.Err() != nil {
+				// Shutting down
+				return
+			}
+			f.record(i, info, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// Stats returns the active endpoint and the number of switches.
+func (f *FailoverClient) Stats() FailoverStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return FailoverStats{
+		Active:   f.endpoints[f.active].Name,
+		Switches: f.switches,
+	}
+}
+
+// record updates the health of endpoint i after a call or health check that
+// returned err, and info for a health check, then selects the active
+// endpoint. Errors other than transport errors are answers of a
+// reachable node.
+func (f *FailoverClient) record(i int, info *BlockchainInfo, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	endpoint := f.endpoints[i]
+	switch {
+	case IsTransportError(err):
+		endpoint.failures++
+	case info != nil && f.config.Chain != "" && info.Chain != f.config.Chain:
+		endpoint.wrongChain = true
+	default:
+		endpoint.failures = 0
+	}
+
+	// The first usable endpoint is active. With none usable calls keep
+	// going to the active one until another answers.
+	for next, endpoint := range f.endpoints {
+		if endpoint.failures >= f.config.FailureThreshold ||
+			endpoint.wrongChain {
+
+			continue
+		}
+		if next != f.active {
+			f.active = next
+			f.switches++
+		}
+		return
+	}
+}
+
+// order returns the indexes of the endpoints a call tries, the active one
+// first and the others in order of preference. Endpoints on the wrong chain
+// are left out.
+func (f *FailoverClient) order() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order := []int{f.active}
+	for i, endpoint := range f.endpoints {
+		if i != f.active && !endpoint.wrongChain {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// failover makes a call with fn on the active endpoint, and on the next ones
+// for as long as the call fails with a transport error. It returns the first
+// answer, or the last error if no endpoint answered.
+func failover[T any](f *FailoverClient, ctx context.Context,
+	fn func(ChainClient) (T, error)) (T, error) {
+
+	var (
+		value T
+		err   error
+	)
+	for _, i := range f.order() {
+		value, err = fn(f.endpoints[i].Client)
+		if ctx.Err() != nil || errors.Is(err, ErrRawBlockUnsupported) {
+			// The caller gave up or the node wasn't asked, which
+			// says nothing of its health
+			return value, err
+		}
+		f.record(i, nil, err)
+		if !IsTransportError(err) {
+			return value, err
+		}
+	}
+	return value, err
+}
+
+// GetBlockchainInfo returns the current chain and height of the active
+// endpoint.
+func (f *FailoverClient) GetBlockchainInfo(ctx context.Context) (
+	*BlockchainInfo, error) {
+
+	return failover(f, ctx, func(c ChainClient) (*BlockchainInfo, error) {
+		return c.GetBlockchainInfo(ctx)
+	})
+}
+
+// GetBlockHash returns the hash of the best chain block at height.
+func (f *FailoverClient) GetBlockHash(ctx context.Context,
+	height int32) (*chainhash.Hash, error) {
+
+	return failover(f, ctx, func(c ChainClient) (*chainhash.Hash, error) {
+		return c.GetBlockHash(ctx, height)
+	})
+}
+
+// GetBlock returns a block with the ids of its transactions.
+func (f *FailoverClient) GetBlock(ctx context.Context,
+	blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+
+	return failover(f, ctx,
+		func(c ChainClient) (*btcjson.GetBlockVerboseResult, error) {
+			return c.GetBlock(ctx, blockHash)
+		})
+}
+
+// GetBlockVerboseTx returns a block with full transaction details.
+func (f *FailoverClient) GetBlockVerboseTx(ctx context.Context,
+	blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+
+	return failover(f, ctx,
+		func(c ChainClient) (*btcjson.GetBlockVerboseTxResult, error) {
+			return c.GetBlockVerboseTx(ctx, blockHash)
+		})
+}
+
+// GetRawTransaction returns a transaction.
+func (f *FailoverClient) GetRawTransaction(ctx context.Context,
+	txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+
+	return failover(f, ctx, func(c ChainClient) (*btcjson.TxRawResult, error) {
+		return c.GetRawTransaction(ctx, txHash)
+	})
+}
+
+// GetTxOut returns an unspent transaction output, or nil if it does not exist
+// or has been spent.
+func (f *FailoverClient) GetTxOut(ctx context.Context, txHash *chainhash.Hash,
+	index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+
+	return failover(f, ctx, func(c ChainClient) (*btcjson.GetTxOutResult, error) {
+		return c.GetTxOut(ctx, txHash, index, mempool)
+	})
+}
+
+// GetRawBlock returns the block with the given hash in its binary
+// serialization. It fails with ErrRawBlockUnsupported if the endpoint asked
+// is not a RawBlockClient.
+func (f *FailoverClient) GetRawBlock(ctx context.Context,
+	blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+
+	return failover(f, ctx, func(c ChainClient) (*wire.MsgBlock, error) {
+		raw, ok := c.(RawBlockClient)
+		if !ok {
+			return nil, fmt.Errorf("%w by %T", ErrRawBlockUnsupported, c)
+		}
+		return raw.GetRawBlock(ctx, blockHash)
+	})
+}
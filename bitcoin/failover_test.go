@@ -0,0 +1,233 @@
+package bitcoin_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// rpcNode is an RPC server standing in for bitcoind on regtest, which
+// reports every output asked for as unspent and paying to pkScript.
+type rpcNode struct {
+	server   *httptest.Server
+	pkScript []byte
+
+	// warmup makes the node answer every call with RPC_IN_WARMUP, as
+	// bitcoind does while it restarts. lookups counts the gettxout calls
+	// answered.
+	warmup  atomic.Bool
+	lookups atomic.Int64
+}
+
+// newRPCNode starts an RPC node serving outputs paying to pkScript until
+// the test ends.
+func newRPCNode(t *testing.T, pkScript []byte) *rpcNode {
+	t.Helper()
+
+	node := &rpcNode{pkScript: pkScript}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+	t.Cleanup(node.server.Close)
+	return node
+}
+
+// serve answers a JSON-RPC request.
+func (n *rpcNode) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		ID     json.RawMessage `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]any{"id": req.ID, "error": nil}
+	switch {
+	case n.warmup.Load():
+		resp["error"] = btcjson.RPCError{
+			Code:    btcjson.ErrRPCInWarmup,
+			Message: "Loading block index...",
+		}
+	case req.Method == "getblockchaininfo":
+		resp["result"] = map[string]any{"chain": "regtest", "blocks": 100}
+	case req.Method == "gettxout":
+		n.lookups.Add(1)
+		resp["result"] = btcjson.GetTxOutResult{
+			Confirmations: 6,
+			Value:         0.0005,
+			ScriptPubKey: btcjson.ScriptPubKeyResult{
+				Hex:  hex.EncodeToString(n.pkScript),
+				Type: "witness_v1_taproot",
+			},
+		}
+	default:
+		resp["error"] = btcjson.RPCError{
+			Code:    btcjson.ErrRPCMethodNotFound.Code,
+			Message: "Method not found",
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// client returns an RPC client of the node. Calls the node doesn't answer
+// are retried until the 1s timeout.
+func (n *rpcNode) client(t *testing.T) *bitcoin.Client {
+	t.Helper()
+
+	c, err := bitcoin.NewClient(bitcoin.Config{
+		RPCURL:     n.server.Listener.Addr().String(),
+		RPCUser:    "user",
+		RPCPass:    "pass",
+		DisableTLS: true,
+		RPCTimeout: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// newFailoverTest returns a failover client of a primary and a backup RPC
+// node, health checked every 20ms, and a key whose taproot outputs they
+// serve.
+func newFailoverTest(t *testing.T) (*bitcoin.FailoverClient, *rpcNode,
+	*rpcNode, *btcec.PrivateKey) {
+
+	t.Helper()
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := newRPCNode(t, pkScript)
+	backup := newRPCNode(t, pkScript)
+
+	f, err := bitcoin.NewFailoverClient([]bitcoin.Endpoint{
+		{Name: "primary", Client: primary.client(t)},
+		{Name: "backup", Client: backup.client(t)},
+	}, bitcoin.FailoverConfig{
+		FailureThreshold:    2,
+		HealthCheckInterval: 20 * time.Millisecond,
+		Chain:               "regtest",
+	})
+	if err != nil {
+		t.Fatalf("NewFailoverClient: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f.Start(ctx)
+	return f, primary, backup, key
+}
+
+// validate runs the checks of the validator on a message for outpoint
+// signed by key, as the network manager does for a message from a peer.
+func validate(t *testing.T, validator *database.Validator,
+	key *btcec.PrivateKey, outpoint message.Outpoint) error {
+
+	t.Helper()
+
+	msg, err := signer.SignMessage(key, outpoint, message.ContentTypeText,
+		[]byte("failover"))
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	ctx := context.Background()
+	txOut, err := validator.LookupUTXO(ctx, outpoint)
+	if err != nil {
+		return err
+	}
+	pkScript, err := validator.GetPKScript(txOut)
+	if err != nil {
+		return err
+	}
+	return validator.ValidateMessage(ctx, msg, pkScript)
+}
+
+// TestFailover checks that once the primary node is killed mid-run,
+// validations go on against the backup without any of them failing, and
+// that the backup is reported active.
+func TestFailover(t *testing.T) {
+	const messages = 20
+
+	f, primary, backup, key := newFailoverTest(t)
+	validator := database.NewValidator(f, database.NewMemoryDB())
+	for i := 0; i < messages; i++ {
+		if i == messages/2 {
+			primary.server.CloseClientConnections()
+			primary.server.Close()
+		}
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		if err := validate(t, validator, key, outpoint); err != nil {
+			t.Fatalf("message %d dropped: %v", i, err)
+		}
+	}
+
+	if n := backup.lookups.Load(); n < messages/2 {
+		t.Fatalf("backup answered %d lookups, want at least %d", n,
+			messages/2)
+	}
+	if stats := f.Stats(); stats.Active != "backup" ||
+		stats.Switches != 1 {
+
+		t.Fatalf("got failover stats %+v", stats)
+	}
+}
+
+// TestFailoverRecovery checks that calls fail over to the backup while the
+// primary warms up, and go back to the primary once it answers a health
+// check.
+func TestFailoverRecovery(t *testing.T) {
+	f, primary, backup, key := newFailoverTest(t)
+	validator := database.NewValidator(f, database.NewMemoryDB())
+
+	primary.warmup.Store(true)
+	for i := 0; i < 3; i++ {
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		if err := validate(t, validator, key, outpoint); err != nil {
+			t.Fatalf("message %d dropped while warming up: %v", i, err)
+		}
+	}
+	if stats := f.Stats(); stats.Active != "backup" {
+		t.Fatalf("active endpoint %s while the primary warms up",
+			stats.Active)
+	}
+
+	primary.warmup.Store(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Stats().Active != "primary" {
+		if time.Now().After(deadline) {
+			t.Fatal("primary not active again once it recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	before := backup.lookups.Load()
+	outpoint := message.NewOutpoint(chainhash.Hash{0xff}, 0)
+	if err := validate(t, validator, key, outpoint); err != nil {
+		t.Fatalf("message dropped after recovery: %v", err)
+	}
+	if backup.lookups.Load() != before {
+		t.Fatal("backup asked after the primary recovered")
+	}
+	if stats := f.Stats(); stats.Switches != 2 {
+		t.Fatalf("%d switches, want 2", stats.Switches)
+	}
+}
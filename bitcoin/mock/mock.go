@@ -0,0 +1,477 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package mock provides a programmable fake of bitcoin.ChainClient so code
+// depending on a Bitcoin node can be tested without a running bitcoind.
+package mock
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/bitcoin"
+)
+
+// Names of the ChainClient methods, used with SetError and FailCalls.
+const (
+	MethodGetBlockchainInfo = "GetBlockchainInfo"
+	MethodGetBlockHash      = "GetBlockHash"
+	MethodGetBlock          = "GetBlock"
+	MethodGetBlockVerboseTx = "GetBlockVerboseTx"
+	MethodGetRawTransaction = "GetRawTransaction"
+	MethodGetTxOut          = "GetTxOut"
+)
+
+// utxo is an unspent output along with the height of the block that
+// confirmed it, or -1 while it is only in the mempool.
+type utxo struct {
+	txOut  btcjson.GetTxOutResult
+	height int32
+}
+
+// block is a block of the fake chain.
+type block struct {
+	hash   chainhash.Hash
+	height int32
+	txs    []*btcjson.TxRawResult
+
+	// spent holds the outputs spent by the block so they can be restored
+	// when it is disconnected.
+	spent map[wire.OutPoint]*utxo
+
+	// confirmed holds the mempool outputs confirmed by the block.
+	confirmed []wire.OutPoint
+}
+
+// Client is a fake Bitcoin node holding a UTXO set and a chain of blocks.
+// It is safe for concurrent use. The zero value is not usable, create one
+// with NewClient.
+type Client struct {
+	chain   string
+	utxos   map[wire.OutPoint]*utxo
+	blocks  []*block
+	txs     map[chainhash.Hash]*btcjson.TxRawResult
+	funding map[chainhash.Hash]*btcjson.TxRawResult
+	errs    map[string]error
+	fails   map[string]*failure
+	calls   map[string]int
+	latency time.Duration
+	nonce   uint64
+	mu      sync.Mutex
+}
+
+// Ensure Client implements the bitcoin.ChainClient interface.
+var _ bitcoin.ChainClient = (*Client)(nil)
+
+// NewClient creates a fake regtest node whose chain holds only a genesis
+// block.
+func NewClient() *Client {
+	c := &Client{
+		chain:   "regtest",
+		utxos:   make(map[wire.OutPoint]*utxo),
+		txs:     make(map[chainhash.Hash]*btcjson.TxRawResult),
+		funding: make(map[chainhash.Hash]*btcjson.TxRawResult),
+		errs:    make(map[string]error),
+		fails:   make(map[string]*failure),
+		calls:   make(map[string]int),
+	}
+	c.connectBlock(nil)
+	return c
+}
+
+// AddUTXO adds an unspent output worth value satoshis and locked by pkScript
+// to the UTXO set, confirmed by the chain tip.
+func (c *Client) AddUTXO(outpoint wire.OutPoint, value int64, pkScript []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addUTXO(outpoint, value, pkScript, c.tip().height)
+}
+
+// AddMempoolUTXO adds an unconfirmed output worth value satoshis and locked
+// by pkScript. GetTxOut only returns it when asked to include the mempool,
+// until the next block confirms it.
+func (c *Client) AddMempoolUTXO(outpoint wire.OutPoint, value int64,
+	pkScript []byte) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addUTXO(outpoint, value, pkScript, -1)
+}
+
+// SpendUTXO removes an output from the UTXO set without mining a block, as
+// if it was spent by a mempool transaction.
+func (c *Client) SpendUTXO(outpoint wire.OutPoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.utxos, outpoint)
+}
+
+// AddBlock mines a block spending the given outputs and returns its hash.
+// The block holds a coinbase transaction and, if any outputs are spent, one
+// transaction spending all of them.
+func (c *Client) AddBlock(spends ...wire.OutPoint) chainhash.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connectBlock(spends)
+}
+
+// DisconnectBlock removes the tip of the chain, as in a reorg, and restores
+// the outputs it spent. The genesis block can't be disconnected.
+func (c *Client) DisconnectBlock() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.blocks) == 1 {
+		return fmt.Errorf("cannot disconnect the genesis block")
+	}
+
+	tip := c.tip()
+	for outpoint, u := range tip.spent {
+		c.utxos[outpoint] = u
+	}
+	for _, outpoint := range tip.confirmed {
+		if u, ok := c.utxos[outpoint]; ok {
+			u.height = -1
+		}
+	}
+	for _, tx := range tip.txs {
+		hash, _ := chainhash.NewHashFromStr(tx.Txid)
+		delete(c.txs, *hash)
+	}
+	c.blocks = c.blocks[:len(c.blocks)-1]
+	return nil
+}
+
+// Height returns the height of the chain tip.
+func (c *Client) Height() int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tip().height
+}
+
+// SetError makes the named method fail with err until it is cleared by
+// passing a nil err.
+func (c *Client) SetError(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.errs, method)
+		return
+	}
+	c.errs[method] = err
+}
+
+// failure is an error injected for a limited number of calls.
+type failure struct {
+	remaining int
+	err       error
+}
+
+// FailCalls makes the next n calls of the named method fail with err, after
+// which the method recovers. It simulates a node that is briefly
+// unreachable. Errors set with SetError take precedence.
+func (c *Client) FailCalls(method string, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n <= 0 || err == nil {
+		delete(c.fails, method)
+		return
+	}
+	c.fails[method] = &failure{remaining: n, err: err}
+}
+
+// Calls returns the number of times the named method was called, including
+// the calls that failed.
+func (c *Client) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[method]
+}
+
+// SetLatency delays every call by d. Calls taking a context return early
+// with its error if it is canceled.
+func (c *Client) SetLatency(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.latency = d
+}
+
+// GetBlockchainInfo returns the chain name and tip height.
+func (c *Client) GetBlockchainInfo(ctx context.Context) (*bitcoin.BlockchainInfo, error) {
+	if err := c.call(ctx, MethodGetBlockchainInfo); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &bitcoin.BlockchainInfo{
+		Chain:  c.chain,
+		Blocks: c.tip().height,
+	}, nil
+}
+
+// GetBlockHash returns the hash of the block at height.
+func (c *Client) GetBlockHash(ctx context.Context, height int32) (*chainhash.Hash, error) {
+	if err := c.call(ctx, MethodGetBlockHash); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if height < 0 || int(height) >= len(c.blocks) {
+		return nil, fmt.Errorf("block height out of range: %d", height)
+	}
+	hash := c.blocks[height].hash
+	return &hash, nil
+}
+
+// GetBlock returns the block with the ids of its transactions.
+func (c *Client) GetBlock(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	if err := c.call(ctx, MethodGetBlock); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := c.findBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &btcjson.GetBlockVerboseResult{
+		Hash:          b.hash.String(),
+		Height:        int64(b.height),
+		Confirmations: int64(c.tip().height-b.height) + 1,
+	}
+	if b.height > 0 {
+		result.PreviousHash = c.blocks[b.height-1].hash.String()
+	}
+	for _, tx := range b.txs {
+		result.Tx = append(result.Tx, tx.Txid)
+	}
+	return result, nil
+}
+
+// GetBlockVerboseTx returns the block with full transaction details.
+func (c *Client) GetBlockVerboseTx(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+	if err := c.call(ctx, MethodGetBlockVerboseTx); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := c.findBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &btcjson.GetBlockVerboseTxResult{
+		Hash:          b.hash.String(),
+		Height:        int64(b.height),
+		Confirmations: int64(c.tip().height-b.height) + 1,
+	}
+	if b.height > 0 {
+		result.PreviousHash = c.blocks[b.height-1].hash.String()
+	}
+	for _, tx := range b.txs {
+		result.Tx = append(result.Tx, *tx)
+	}
+	return result, nil
+}
+
+// GetRawTransaction returns a transaction of the best chain, or one that
+// created an output added with AddUTXO or AddMempoolUTXO, as a node with
+// txindex would.
+func (c *Client) GetRawTransaction(ctx context.Context, txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	if err := c.call(ctx, MethodGetRawTransaction); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx, ok := c.txs[*txHash]
+	if !ok {
+		tx, ok = c.funding[*txHash]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no such transaction: %s", txHash)
+	}
+	txCopy := *tx
+	return &txCopy, nil
+}
+
+// GetTxOut returns an unspent output, or nil if it is not in the UTXO set.
+// Unconfirmed outputs are only returned if mempool is set.
+func (c *Client) GetTxOut(ctx context.Context, txHash *chainhash.Hash, index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+	if err := c.call(ctx, MethodGetTxOut); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.utxos[wire.OutPoint{Hash: *txHash, Index: index}]
+	if !ok || (u.height < 0 && !mempool) {
+		return nil, nil
+	}
+	txOut := u.txOut
+	txOut.BestBlock = c.tip().hash.String()
+	if u.height >= 0 {
+		txOut.Confirmations = int64(c.tip().height-u.height) + 1
+	}
+	return &txOut, nil
+}
+
+// call applies the configured latency and returns the error injected for
+// method, if any. It returns the context's error if ctx is done.
+func (c *Client) call(ctx context.Context, method string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.calls[method]++
+	latency := c.latency
+	err := c.errs[method]
+	if f := c.fails[method]; err == nil && f != nil {
+		err = f.err
+		if f.remaining--; f.remaining == 0 {
+			delete(c.fails, method)
+		}
+	}
+	c.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// addUTXO adds an output confirmed at height to the UTXO set. The caller
+// must hold c.mu.
+func (c *Client) addUTXO(outpoint wire.OutPoint, value int64, pkScript []byte,
+	height int32) {
+
+	c.utxos[outpoint] = &utxo{
+		txOut: btcjson.GetTxOutResult{
+			Value: btcutil.Amount(value).ToBTC(),
+			ScriptPubKey: btcjson.ScriptPubKeyResult{
+				Hex: hex.EncodeToString(pkScript),
+			},
+		},
+		height: height,
+	}
+
+	// Record the transaction creating the output, so a spent output can be
+	// told apart from one that never existed
+	tx, ok := c.funding[outpoint.Hash]
+	if !ok {
+		tx = &btcjson.TxRawResult{Txid: outpoint.Hash.String()}
+		c.funding[outpoint.Hash] = tx
+	}
+	for uint32(len(tx.Vout)) <= outpoint.Index {
+		tx.Vout = append(tx.Vout, btcjson.Vout{N: uint32(len(tx.Vout))})
+	}
+}
+
+// tip returns the last block of the chain. The caller must hold c.mu.
+func (c *Client) tip() *block {
+	return c.blocks[len(c.blocks)-1]
+}
+
+// findBlock returns the best chain block with the given hash. The caller
+// must hold c.mu.
+func (c *Client) findBlock(hash *chainhash.Hash) (*block, error) {
+	for _, b := range c.blocks {
+		if b.hash == *hash {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("block not found: %s", hash)
+}
+
+// connectBlock appends a block spending the given outputs and confirming the
+// mempool outputs to the chain. The caller must hold c.mu.
+func (c *Client) connectBlock(spends []wire.OutPoint) chainhash.Hash {
+	b := &block{
+		height: int32(len(c.blocks)),
+		spent:  make(map[wire.OutPoint]*utxo),
+	}
+
+	// Every block gets a unique hash, even when it replaces a
+	// disconnected block at the same height
+	var seed [12]byte
+	binary.LittleEndian.PutUint32(seed[:4], uint32(b.height))
+	binary.LittleEndian.PutUint64(seed[4:], c.nonce)
+	c.nonce++
+	b.hash = chainhash.DoubleHashH(seed[:])
+
+	coinbase := &btcjson.TxRawResult{
+		Txid: chainhash.DoubleHashH(append(b.hash[:], 0)).String(),
+		Vin:  []btcjson.Vin{{Coinbase: hex.EncodeToString(seed[:])}},
+	}
+	b.txs = append(b.txs, coinbase)
+
+	if len(spends) > 0 {
+		tx := &btcjson.TxRawResult{
+			Txid: chainhash.DoubleHashH(append(b.hash[:], 1)).String(),
+		}
+		for _, outpoint := range spends {
+			tx.Vin = append(tx.Vin, btcjson.Vin{
+				Txid: outpoint.Hash.String(),
+				Vout: outpoint.Index,
+			})
+			if u, ok := c.utxos[outpoint]; ok {
+				b.spent[outpoint] = u
+				delete(c.utxos, outpoint)
+			}
+		}
+		b.txs = append(b.txs, tx)
+	}
+
+	for outpoint, u := range c.utxos {
+		if u.height < 0 {
+			u.height = b.height
+			b.confirmed = append(b.confirmed, outpoint)
+		}
+	}
+
+	for _, tx := range b.txs {
+		tx.BlockHash = b.hash.String()
+		hash, _ := chainhash.NewHashFromStr(tx.Txid)
+		c.txs[*hash] = tx
+	}
+
+	c.blocks = append(c.blocks, b)
+	return b.hash
+}
@@ -0,0 +1,276 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Backends selecting how the Bitcoin node is reached.
+const (
+	// BackendRPC uses the authenticated JSON-RPC interface.
+	BackendRPC = "rpc"
+
+	// BackendREST uses the unauthenticated REST interface bitcoind
+	// serves with -rest.
+	BackendREST = "rest"
+)
+
+// DefaultRESTURL is the default base URL of the REST interface.
+const DefaultRESTURL = "http://localhost:8332"
+
+// mempoolHeight is the height getutxos reports for outputs of unconfirmed
+// transactions.
+const mempoolHeight = 0x7fffffff
+
+// maxRESTResponseSize bounds the size of a REST response, above the size of
+// the largest block with full transaction details.
+const maxRESTResponseSize = 256 << 20
+
+// RawBlockClient is implemented by clients that can fetch blocks in their
+// binary serialization, which is much cheaper to decode than verbose JSON.
+type RawBlockClient interface {
+	// GetRawBlock returns the block with the given hash.
+	GetRawBlock(ctx context.Context, blockHash *chainhash.Hash) (*wire.MsgBlock, error)
+}
+
+// RESTStatusError is returned by RESTClient for a request the node answered
+// with an error status.
+type RESTStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error implements error.
+func (e *RESTStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("REST request failed: %s",
+			http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("REST request failed: %s: %s",
+		http.StatusText(e.StatusCode), e.Message)
+}
+
+// RESTClient implements ChainClient over the REST interface of Bitcoin Core,
+// for nodes that don't expose RPC to UTXOchat. Transactions outside the
+// mempool are only found with txindex, as with RPC. It is safe for
+// concurrent use.
+type RESTClient struct {
+	baseURL string
+	http    *http.Client
+
+	// timeout bounds calls whose context has no deadline.
+	timeout time.Duration
+}
+
+// Ensure RESTClient implements the ChainClient and RawBlockClient
+// interfaces.
+var (
+	_ ChainClient    = (*RESTClient)(nil)
+	_ RawBlockClient = (*RESTClient)(nil)
+)
+
+// NewRESTClient creates a client of the REST interface at cfg.RESTURL.
+func NewRESTClient(cfg Config) (*RESTClient, error) {
+	baseURL := cfg.RESTURL
+	if baseURL == "" {
+		baseURL = DefaultRESTURL
+	}
+	if !strings.HasPrefix(baseURL, "http://") &&
+		!strings.HasPrefix(baseURL, "https://") {
+
+		baseURL = "http://" + baseURL
+	}
+
+	timeout := cfg.RPCTimeout
+	if timeout == 0 {
+		timeout = DefaultRPCTimeout
+	}
+	return &RESTClient{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/rest/",
+		http:    &http.Client{},
+		timeout: time.Duration(timeout) * time.Second,
+	}, nil
+}
+
+// NewChainClient creates a client of the node for the backend selected by
+// cfg.Backend.
+func NewChainClient(cfg Config) (ChainClient, error) {
+	switch cfg.Backend {
+	case "", BackendRPC:
+		return NewClient(cfg)
+	case BackendREST:
+		return NewRESTClient(cfg)
+	default:
+		return nil, fmt.Errorf("unknown Bitcoin backend %q, expected %s "+
+			"or %s", cfg.Backend, BackendRPC, BackendREST)
+	}
+}
+
+// get fetches path below the REST root and returns the response body.
+func (c *RESTClient) get(ctx context.Context, path string) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRESTResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RESTStatusError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(body)),
+		}
+	}
+	return body, nil
+}
+
+// getJSON fetches path and decodes its JSON body into result.
+func (c *RESTClient) getJSON(ctx context.Context, path string,
+	result interface{}) error {
+
+	body, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return nil
+}
+
+// GetBlockchainInfo returns the current chain and height.
+func (c *RESTClient) GetBlockchainInfo(ctx context.Context) (*BlockchainInfo, error) {
+	var info BlockchainInfo
+	if err := c.getJSON(ctx, "chaininfo.json", &info); err != nil {
+		return nil, fmt.Errorf("failed to get blockchain info: %w", err)
+	}
+	return &info, nil
+}
+
+// GetBlockHash returns the hash of the best chain block at height.
+func (c *RESTClient) GetBlockHash(ctx context.Context, height int32) (*chainhash.Hash, error) {
+	var result struct {
+		BlockHash string `json:"blockhash"`
+	}
+	err := c.getJSON(ctx, fmt.Sprintf("blockhashbyheight/%d.json", height),
+		&result)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(result.BlockHash)
+}
+
+// GetBlock returns a block with the ids of its transactions.
+func (c *RESTClient) GetBlock(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	var block btcjson.GetBlockVerboseResult
+	err := c.getJSON(ctx, "block/notxdetails/"+blockHash.String()+".json",
+		&block)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// GetBlockVerboseTx returns a block with full transaction details.
+func (c *RESTClient) GetBlockVerboseTx(ctx context.Context, blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+	var block btcjson.GetBlockVerboseTxResult
+	err := c.getJSON(ctx, "block/"+blockHash.String()+".json", &block)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// GetRawBlock returns a block decoded from its binary serialization.
+func (c *RESTClient) GetRawBlock(ctx context.Context, blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	body, err := c.get(ctx, "block/"+blockHash.String()+".bin")
+	if err != nil {
+		return nil, err
+	}
+
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(body)); err != nil {
+		return nil, fmt.Errorf("failed to decode block %s: %v", blockHash,
+			err)
+	}
+	return &block, nil
+}
+
+// GetRawTransaction returns a transaction, which requires txindex for
+// transactions outside the mempool.
+func (c *RESTClient) GetRawTransaction(ctx context.Context, txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	var tx btcjson.TxRawResult
+	if err := c.getJSON(ctx, "tx/"+txHash.String()+".json", &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// getUTXOsResult is the response of getutxos.
+type getUTXOsResult struct {
+	ChainHeight  int32  `json:"chainHeight"`
+	ChaintipHash string `json:"chaintipHash"`
+	Bitmap       string `json:"bitmap"`
+	UTXOs        []struct {
+		Height       int32                      `json:"height"`
+		Value        float64                    `json:"value"`
+		ScriptPubKey btcjson.ScriptPubKeyResult `json:"scriptPubKey"`
+	} `json:"utxos"`
+}
+
+// GetTxOut returns an unspent transaction output, or nil if it does not exist
+// or has been spent. With mempool set, outputs of unconfirmed transactions
+// are returned and outputs spent by them are not. Whether the output is
+// from a coinbase transaction is not reported by the REST interface.
+func (c *RESTClient) GetTxOut(ctx context.Context, txHash *chainhash.Hash,
+	index uint32, mempool bool) (*btcjson.GetTxOutResult, error) {
+
+	path := "getutxos/"
+	if mempool {
+		path += "checkmempool/"
+	}
+	path += fmt.Sprintf("%s-%d.json", txHash, index)
+
+	var result getUTXOsResult
+	if err := c.getJSON(ctx, path, &result); err != nil {
+		return nil, err
+	}
+	if len(result.UTXOs) == 0 {
+		return nil, nil
+	}
+
+	utxo := result.UTXOs[0]
+	txOut := &btcjson.GetTxOutResult{
+		BestBlock:    result.ChaintipHash,
+		Value:        utxo.Value,
+		ScriptPubKey: utxo.ScriptPubKey,
+	}
+	if utxo.Height != mempoolHeight {
+		txOut.Confirmations = int64(result.ChainHeight-utxo.Height) + 1
+	}
+	return txOut, nil
+}
@@ -0,0 +1,130 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newRESTTestClient returns a client of a REST server answering the paths
+// of responses below /rest/ with their body, and any other path with a 404.
+func newRESTTestClient(t *testing.T, responses map[string][]byte) *RESTClient {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, ok := responses[r.URL.Path[len("/rest/"):]]
+			if !ok {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		}))
+	t.Cleanup(server.Close)
+
+	c, err := NewRESTClient(Config{RESTURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewRESTClient: %v", err)
+	}
+	return c
+}
+
+// TestRESTClient checks the chain info, block hash, binary block and UTXO
+// lookups of the REST client against canned responses of Bitcoin Core.
+func TestRESTClient(t *testing.T) {
+	ctx := context.Background()
+
+	block := wire.NewMsgBlock(wire.NewBlockHeader(1, &chainhash.Hash{},
+		&chainhash.Hash{}, 0, 0))
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{7}, 3), nil,
+		nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	block.AddTransaction(tx)
+	var raw bytes.Buffer
+	if err := block.Serialize(&raw); err != nil {
+		t.Fatal(err)
+	}
+	blockHash := block.BlockHash()
+
+	confirmed, unconfirmed := chainhash.Hash{1}, chainhash.Hash{2}
+	c := newRESTTestClient(t, map[string][]byte{
+		"chaininfo.json": []byte(`{"chain": "regtest", "blocks": 110}`),
+		"blockhashbyheight/110.json": []byte(`{"blockhash": "` +
+			blockHash.String() + `"}`),
+		"block/" + blockHash.String() + ".bin": raw.Bytes(),
+		"getutxos/checkmempool/" + confirmed.String() + "-0.json": []byte(`{
+			"chainHeight": 110, "chaintipHash": "` + blockHash.String() + `",
+			"bitmap": "1", "utxos": [{"height": 101, "value": 0.0005,
+			"scriptPubKey": {"hex": "51"}}]}`),
+		"getutxos/checkmempool/" + unconfirmed.String() + "-1.json": []byte(`{
+			"chainHeight": 110, "bitmap": "1", "utxos": [{
+			"height": 2147483647, "value": 1, "scriptPubKey": {}}]}`),
+		"getutxos/" + unconfirmed.String() + "-1.json": []byte(`{
+			"chainHeight": 110, "bitmap": "0", "utxos": []}`),
+	})
+
+	info, err := c.GetBlockchainInfo(ctx)
+	if err != nil || info.Chain != "regtest" || info.Blocks != 110 {
+		t.Fatalf("got chain info %+v, %v", info, err)
+	}
+	hash, err := c.GetBlockHash(ctx, 110)
+	if err != nil || *hash != blockHash {
+		t.Fatalf("got block hash %v, %v, want %s", hash, err, blockHash)
+	}
+	got, err := c.GetRawBlock(ctx, &blockHash)
+	if err != nil || got.BlockHash() != blockHash ||
+		got.Transactions[0].TxHash() != tx.TxHash() {
+
+		t.Fatalf("got block %+v, %v", got, err)
+	}
+
+	txOut, err := c.GetTxOut(ctx, &confirmed, 0, true)
+	if err != nil || txOut == nil || txOut.Confirmations != 10 ||
+		txOut.Value != 0.0005 || txOut.ScriptPubKey.Hex != "51" ||
+		txOut.BestBlock != blockHash.String() {
+
+		t.Fatalf("got confirmed UTXO %+v, %v", txOut, err)
+	}
+	txOut, err = c.GetTxOut(ctx, &unconfirmed, 1, true)
+	if err != nil || txOut == nil || txOut.Confirmations != 0 {
+		t.Fatalf("got mempool UTXO %+v, %v", txOut, err)
+	}
+	txOut, err = c.GetTxOut(ctx, &unconfirmed, 1, false)
+	if err != nil || txOut != nil {
+		t.Fatalf("UTXO outside the chain returned: %+v, %v", txOut, err)
+	}
+
+	// Anything else is answered with a 404
+	_, err = c.GetBlockHash(ctx, 111)
+	var statusErr *RESTStatusError
+	if !errors.As(err, &statusErr) ||
+		statusErr.StatusCode != http.StatusNotFound ||
+		statusErr.Message != "Not found" {
+
+		t.Fatalf("unknown height gave %v, want a 404", err)
+	}
+}
+
+// TestNewChainClient checks that the REST backend is selected by name and
+// that unknown backends are refused.
+func TestNewChainClient(t *testing.T) {
+	client, err := NewChainClient(Config{Backend: BackendREST})
+	if err != nil {
+		t.Fatalf("NewChainClient: %v", err)
+	}
+	rest, ok := client.(*RESTClient)
+	if !ok || rest.baseURL != DefaultRESTURL+"/rest/" {
+		t.Fatalf("got client %#v", client)
+	}
+
+	if _, err := NewChainClient(Config{Backend: "zmq"}); err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
@@ -18,8 +18,28 @@ type Config struct {
 	ScanFullBlocks bool
 
 	// PollInterval specifies the interval in seconds between block polling attempts
-	// when notifications are disabled.
+	// when notifications are disabled. With notifications enabled, polling
+	// continues at a much lower frequency to catch missed notifications.
 	PollInterval int
+
+	// ZMQBlockEndpoint is the bitcoind zmqpubhashblock endpoint, for example
+	// tcp://127.0.0.1:28332. Notifications are only used when it is set.
+	ZMQBlockEndpoint string
+
+	// StartHeight is the height of the first block scanned for spent
+	// outpoints, for backfilling from a past block. It must not be above
+	// the tip. Zero starts with the first block after the tip, since no
+	// outpoints are stored before the node runs.
+	StartHeight int32
+
+	// Reconcile selects the startup pass removing the stored outpoints
+	// whose UTXO was spent while the node was not running. It runs in the
+	// background, ReconcileWorkers UTXO lookups at a time, and checks every
+	// outpoint or, when sampled, ReconcileSampleSize random ones. Empty
+	// disables it.
+	Reconcile           ReconcileMode
+	ReconcileSampleSize int
+	ReconcileWorkers    int
 }
 
 // DefaultConfig returns the default configuration for the blockchain handler.
@@ -29,5 +49,8 @@ func DefaultConfig() Config {
 		MaxReorgDepth:        6,
 		ScanFullBlocks:       true,
 		PollInterval:         30,
+		Reconcile:            ReconcileOff,
+		ReconcileSampleSize:  DefaultReconcileSampleSize,
+		ReconcileWorkers:     DefaultReconcileWorkers,
 	}
 }
@@ -6,47 +6,209 @@ package blockchain
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/shaibearary/utxo_chat/bitcoin"
 	"github.com/shaibearary/utxo_chat/database"
 	"github.com/shaibearary/utxo_chat/message"
 )
 
+// fallbackPollFactor is how much less often blocks are polled when ZMQ
+// notifications are active.
+const fallbackPollFactor = 10
+
+// maxPollBackoff caps the delay between polls while the Bitcoin node is
+// unreachable, unless the poll interval itself is longer. Paused processing is
+// retried as often.
+const maxPollBackoff = 5 * time.Minute
+
+// ErrNodePruned is returned when the Bitcoin node pruned a block the handler
+// has yet to scan. Processing pauses at that block until a node serves it.
+var ErrNodePruned = errors.New("Bitcoin node is pruned below our scan height")
+
+// txOutCache is implemented by clients that cache UTXO lookups, such as
+// bitcoin.CachedClient. The handler keeps such a cache in step with the
+// blocks it processes.
+type txOutCache interface {
+	BlockConnected(spent []wire.OutPoint)
+	Purge()
+}
+
+// failoverClient is implemented by clients switching between Bitcoin nodes,
+// such as bitcoin.FailoverClient. The nodes may be at different tips, so the
+// handler checks its recent blocks again after each switch.
+type failoverClient interface {
+	Stats() bitcoin.FailoverStats
+}
+
+// processedBlock is a block whose spent outpoints have been removed from the
+// database.
+type processedBlock struct {
+	height int32
+	hash   chainhash.Hash
+}
+
 // Handler is responsible for monitoring the blockchain and handling new blocks
 type Handler struct {
-	client *bitcoin.Client
+	client bitcoin.ChainClient
 	db     database.Database
 	config Config
 	ctx    context.Context
 	cancel context.CancelFunc
 	done   chan struct{}
+
+	// blockNotify is signaled when bitcoind announces a new block.
+	blockNotify chan struct{}
+	zmq         *zmqSubscriber
+
+	// pollIntervalChan delivers poll interval changes to processBlocks.
+	pollIntervalChan chan time.Duration
+	pollIntervalMu   sync.Mutex
+
+	// recent holds the last MaxReorgDepth processed blocks, oldest first,
+	// so that a reorg can be detected and undone.
+	recent []processedBlock
+
+	// onExpired is called with the outpoints removed by each block.
+	onExpired func(outpoints []message.Outpoint)
+
+	// lastBlock is the most recently processed block, nil until the first
+	// block has been processed.
+	lastBlock atomic.Pointer[processedBlock]
+
+	blocksProcessed    atomic.Uint64
+	blocksDisconnected atomic.Uint64
+	outpointsRemoved   atomic.Uint64
+
+	// rpcDegraded is set while polls fail to reach the Bitcoin node.
+	rpcDegraded atomic.Bool
+
+	// paused is set while processing waits for a block the node pruned.
+	paused atomic.Bool
+
+	// inputsSkipped counts the inputs of verbose blocks without a
+	// previous txid, inputErrors those whose outpoint or transaction
+	// couldn't be read.
+	inputsSkipped atomic.Uint64
+	inputErrors   atomic.Uint64
+
+	// switches is the number of endpoint switches of a failover client
+	// seen by syncToTip, and recheck is set from a switch until the
+	// recent blocks were checked against the new node.
+	switches uint64
+	recheck  bool
+
+	// reconciling tracks the startup reconciliation.
+	reconciling sync.WaitGroup
+}
+
+// SetExpireHandler registers fn to be called with the outpoints whose UTXO
+// was spent by a new block, after they and their messages were removed from
+// the database. It must be called before Start.
+func (h *Handler) SetExpireHandler(fn func(outpoints []message.Outpoint)) {
+	h.onExpired = fn
+}
+
+// Stats holds counters describing the progress of the block handler.
+type Stats struct {
+	// LastBlockHeight and LastBlockHash identify the most recently
+	// processed block. LastBlockHash is nil until a block is processed.
+	LastBlockHeight int32
+	LastBlockHash   *chainhash.Hash
+
+	// BlocksProcessed is the number of blocks scanned for spent outpoints.
+	BlocksProcessed uint64
+
+	// BlocksDisconnected is the number of processed blocks undone because
+	// of a reorg.
+	BlocksDisconnected uint64
+
+	// OutpointsRemoved is the number of spent outpoints removed from the
+	// database.
+	OutpointsRemoved uint64
+
+	// RPCDegraded is set while polls fail to reach the Bitcoin node and
+	// are backing off.
+	RPCDegraded bool
+
+	// Paused is set while processing waits for a block the Bitcoin node
+	// pruned, see ErrNodePruned.
+	Paused bool
+
+	// InputsSkipped is the number of inputs without a previous txid in
+	// the verbose blocks from the node, InputErrors the number of inputs
+	// and transactions that couldn't be read. Neither removed an outpoint.
+	InputsSkipped uint64
+	InputErrors   uint64
+
+	// BitcoinEndpoint is the Bitcoin node in use and EndpointSwitches the
+	// number of times it changed, when several are configured.
+	BitcoinEndpoint  string
+	EndpointSwitches uint64
+}
+
+// Stats returns the block handler counters. It is safe to call concurrently
+// with block processing.
+func (h *Handler) Stats() Stats {
+	stats := Stats{
+		BlocksProcessed:    h.blocksProcessed.Load(),
+		BlocksDisconnected: h.blocksDisconnected.Load(),
+		OutpointsRemoved:   h.outpointsRemoved.Load(),
+		RPCDegraded:        h.rpcDegraded.Load(),
+		Paused:             h.paused.Load(),
+		InputsSkipped:      h.inputsSkipped.Load(),
+		InputErrors:        h.inputErrors.Load(),
+	}
+	if last := h.lastBlock.Load(); last != nil {
+		hash := last.hash
+		stats.LastBlockHeight = last.height
+		stats.LastBlockHash = &hash
+	}
+	if failover, ok := unwrapClient[failoverClient](h.client); ok {
+		failoverStats := failover.Stats()
+		stats.BitcoinEndpoint = failoverStats.Active
+		stats.EndpointSwitches = failoverStats.Switches
+	}
+	return stats
 }
 
 // NewHandler creates a new block handler.
-func NewHandler(client *bitcoin.Client, db database.Database) *Handler {
+func NewHandler(client bitcoin.ChainClient, db database.Database) *Handler {
 	return NewHandlerWithConfig(client, db, DefaultConfig())
 }
 
 // NewHandlerWithConfig creates a new block handler with the specified configuration.
-func NewHandlerWithConfig(client *bitcoin.Client, db database.Database, config Config) *Handler {
+func NewHandlerWithConfig(client bitcoin.ChainClient, db database.Database, config Config) *Handler {
 	return &Handler{
 		client: client,
 		db:     db,
 		config: config,
 		done:   make(chan struct{}),
+
+		blockNotify:      make(chan struct{}, 1),
+		pollIntervalChan: make(chan time.Duration, 1),
 	}
 }
 
 // Start begins the block notification and processing.
 func (h *Handler) Start(ctx context.Context) error {
+	reconcile, err := ParseReconcileMode(string(h.config.Reconcile))
+	if err != nil {
+		return err
+	}
+
 	h.ctx, h.cancel = context.WithCancel(ctx)
 
-	log.Println("Starting blockchain handler")
+	log.Info("Starting blockchain handler")
 
 	// Get initial blockchain info to determine starting point
 	info, err := h.client.GetBlockchainInfo(h.ctx)
@@ -54,29 +216,66 @@ func (h *Handler) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to get initial blockchain info: %v", err)
 	}
 
-	log.Printf("Initial blockchain state: chain=%s, height=%d", info.Chain, info.Blocks)
+	log.Infof("Initial blockchain state: chain=%s, height=%d", info.Chain, info.Blocks)
 
-	// TODO: Subscribe to block notifications from the Bitcoin client if enabled
-	if h.config.NotificationsEnabled {
-		// This would typically involve:
-		// 1. Setting up a notification handler
-		// 2. Registering for block notifications
-		log.Println("Block notifications are enabled but not implemented yet, falling back to polling")
+	lastKnownHeight, err := h.initialHeight(info)
+	if err != nil {
+		return err
+	}
+
+	// Subscribe to block notifications from bitcoind if enabled
+	if h.notificationsActive() {
+		h.zmq = newZMQSubscriber(h.config.ZMQBlockEndpoint, h.blockNotify)
+		h.zmq.start()
+	} else if h.config.NotificationsEnabled {
+		log.Warn("Block notifications are enabled but no ZMQ endpoint is configured, falling back to polling")
 	}
 
-	// Start processing in background
-	go h.processBlocks()
+	// Start processing in background, right away when backfilling
+	if lastKnownHeight < info.Blocks {
+		h.blockNotify <- struct{}{}
+	}
+	go h.processBlocks(lastKnownHeight)
+
+	// Catch up on the spends missed while the node was not running
+	if reconcile != ReconcileOff {
+		h.reconciling.Add(1)
+		go h.reconcile()
+	}
 
 	return nil
 }
 
+// initialHeight returns the height of the block processing starts after. A
+// fresh node has no outpoints that older blocks could have spent, so it
+// starts at the tip unless Config.StartHeight asks for a backfill.
+func (h *Handler) initialHeight(info *bitcoin.BlockchainInfo) (int32, error) {
+	start := h.config.StartHeight
+	switch {
+	case start < 0:
+		return 0, fmt.Errorf("invalid start height %d", start)
+
+	case start == 0:
+		log.Infof("Scanning blocks after the tip at height %d", info.Blocks)
+		return info.Blocks, nil
+
+	case start > info.Blocks:
+		return 0, fmt.Errorf("start height %d is above the tip at height %d",
+			start, info.Blocks)
+	}
+
+	log.Infof("Backfilling %d blocks from height %d", info.Blocks-start+1,
+		start)
+	return start - 1, nil
+}
+
 // Stop shuts down the block handler.
 func (h *Handler) Stop() error {
-	log.Println("Stopping blockchain handler")
+	log.Info("Stopping blockchain handler")
 
-	// TODO: Unsubscribe from block notifications if enabled
-	if h.config.NotificationsEnabled {
-		// Unregister notifications
+	// Unsubscribe from block notifications
+	if h.zmq != nil {
+		h.zmq.stop()
 	}
 
 	if h.cancel != nil {
@@ -86,200 +285,563 @@ func (h *Handler) Stop() error {
 	// Wait for processing to complete with timeout
 	select {
 	case <-h.done:
-		log.Println("Blockchain handler stopped gracefully")
+		log.Info("Blockchain handler stopped gracefully")
 	case <-time.After(5 * time.Second):
-		log.Println("Blockchain handler stop timed out")
+		log.Warn("Blockchain handler stop timed out")
+	}
+
+	// Lookups return once the context is canceled
+	h.reconciling.Wait()
+
+	return nil
+}
+
+// notificationsActive reports whether blocks are announced over ZMQ.
+func (h *Handler) notificationsActive() bool {
+	return h.config.NotificationsEnabled && h.config.ZMQBlockEndpoint != ""
+}
+
+// pollInterval returns the configured block polling interval, falling back to
+// the default when it is not set. When ZMQ notifications are active polling
+// only serves to catch missed notifications and runs much less often.
+func (h *Handler) pollInterval() time.Duration {
+	return h.pollIntervalFor(h.config.PollInterval)
+}
+
+// pollIntervalFor is like pollInterval for a configured interval of seconds.
+func (h *Handler) pollIntervalFor(seconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = DefaultConfig().PollInterval
+	}
+	interval := time.Duration(seconds) * time.Second
+	if h.notificationsActive() {
+		interval *= fallbackPollFactor
+	}
+	return interval
+}
+
+// SetPollInterval changes the block polling interval at runtime. Unlike
+// Config.PollInterval it accepts sub-second intervals.
+func (h *Handler) SetPollInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid poll interval: %v", interval)
 	}
 
+	h.pollIntervalMu.Lock()
+	defer h.pollIntervalMu.Unlock()
+
+	// Replace any change processBlocks has not picked up yet
+	select {
+	case <-h.pollIntervalChan:
+	default:
+	}
+	h.pollIntervalChan <- interval
 	return nil
 }
 
-// processBlocks handles incoming block notifications
-func (h *Handler) processBlocks() {
+// ApplyConfig applies the poll interval of cfg to the running handler. It
+// returns the names of the other settings of cfg that differ from the running
+// ones, which only take effect after a restart.
+func (h *Handler) ApplyConfig(cfg Config) ([]string, error) {
+	if err := h.SetPollInterval(h.pollIntervalFor(cfg.PollInterval)); err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	running, applied := reflect.ValueOf(h.config), reflect.ValueOf(cfg)
+	for i := 0; i < running.NumField(); i++ {
+		name := running.Type().Field(i).Name
+		if name == "PollInterval" {
+			continue
+		}
+		if !reflect.DeepEqual(running.Field(i).Interface(),
+			applied.Field(i).Interface()) {
+
+			changed = append(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// processBlocks handles incoming block notifications, processing blocks
+// after lastKnownHeight.
+func (h *Handler) processBlocks(lastKnownHeight int32) {
 	defer close(h.done)
 
-	log.Printf("Block handler processing started with options: notifications=%v, maxReorgDepth=%d, fullScan=%v",
-		h.config.NotificationsEnabled, h.config.MaxReorgDepth, h.config.ScanFullBlocks)
+	log.Infof("Block handler processing started with options: notifications=%v, maxReorgDepth=%d, fullScan=%v, pollInterval=%v",
+		h.config.NotificationsEnabled, h.config.MaxReorgDepth, h.config.ScanFullBlocks, h.pollInterval())
 
-	// Set up polling interval if notifications are not enabled
-	ticker := time.NewTicker(5 * time.Second)
+	// Poll for new blocks, either as the primary mechanism or as a fallback
+	// for missed notifications
+	interval := h.pollInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	lastKnownHeight := int32(0)
-
+	var (
+		failures int
+		err      error
+	)
 	for {
 		select {
 		case <-h.ctx.Done():
 			return
 
+		case interval = <-h.pollIntervalChan:
+			log.Infof("Block poll interval changed to %v", interval)
+			if failures == 0 && !h.paused.Load() {
+				ticker.Reset(interval)
+			}
+			continue
+
+		case <-h.blockNotify:
 		case <-ticker.C:
-			if !h.config.NotificationsEnabled {
-				// If notifications are disabled, poll for new blocks
-				info, err := h.client.GetBlockchainInfo(h.ctx)
-				if err != nil {
-					log.Printf("Error getting blockchain info: %v", err)
-					continue
-				}
-
-				if info.Blocks > lastKnownHeight {
-					log.Printf("New block(s) detected. Previous height: %d, Current height: %d",
-						lastKnownHeight, info.Blocks)
-
-					// Process blocks from lastKnownHeight+1 to current height
-					for height := lastKnownHeight + 1; height <= info.Blocks; height++ {
-						if err := h.handleNewBlock(height); err != nil {
-							log.Printf("Error processing block at height %d: %v", height, err)
-						}
-					}
-
-					lastKnownHeight = info.Blocks
-				}
+		}
+
+		lastKnownHeight, err = h.syncToTip(lastKnownHeight)
+		switch {
+		case errors.Is(err, ErrNodePruned):
+			// The node answers, but polling it faster won't bring
+			// the block back
+			failures = 0
+			h.rpcDegraded.Store(false)
+			if !h.paused.Swap(true) {
+				log.Errorf("Block processing paused after height %d: "+
+					"%v. Connect a node that has the block, such as "+
+					"one with a higher prune setting", lastKnownHeight,
+					err)
 			}
+			ticker.Reset(max(interval, maxPollBackoff))
 
-			// TODO: Add a case for block notifications if enabled
-			// case block := <-blockNotificationChannel:
-			//     h.handleNewBlock(block)
+		case err == nil && (failures > 0 || h.paused.Load()):
+			if failures > 0 {
+				log.Infof("Block processing recovered after %d "+
+					"failed polls", failures)
+			}
+			if h.paused.Swap(false) {
+				log.Infof("Block processing resumed, processed up to "+
+					"height %d", lastKnownHeight)
+			}
+			failures = 0
+			h.rpcDegraded.Store(false)
+			ticker.Reset(interval)
+
+		case err != nil && !bitcoin.IsTransportError(err):
+			failures++
+			delay := pollBackoff(interval, failures)
+			log.Errorf("Block processing stopped after height %d, "+
+				"retrying in %v: %v", lastKnownHeight,
+				delay.Round(time.Second), err)
+			ticker.Reset(delay)
+
+		case err != nil:
+			failures++
+			h.rpcDegraded.Store(true)
+			delay := pollBackoff(interval, failures)
+			if failures == 1 {
+				log.Warnf("Bitcoin node unreachable, polling again in "+
+					"%v: %v", delay.Round(time.Second), err)
+			} else {
+				log.Debugf("Bitcoin node still unreachable after %d "+
+					"polls, polling again in %v: %v", failures,
+					delay.Round(time.Second), err)
+			}
+			ticker.Reset(delay)
 		}
 	}
 }
 
+// pollBackoff returns the delay before the next poll after the given number of
+// consecutive failures. It doubles the poll interval per failure up to
+// maxPollBackoff, randomized between half and the full delay so that polls
+// don't line up with other clients of a recovering node.
+func pollBackoff(interval time.Duration, failures int) time.Duration {
+	limit := max(maxPollBackoff, interval)
+	delay := interval
+	for i := 0; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// syncToTip undoes any disconnected blocks and processes all blocks from
+// lastKnownHeight up to the node's current tip. It returns the new last
+// processed height, along with an error if the node could not be reached or
+// a block failed to process. Blocks are processed again on the next call
+// from the first one that failed.
+func (h *Handler) syncToTip(lastKnownHeight int32) (int32, error) {
+	info, err := h.client.GetBlockchainInfo(h.ctx)
+	if err != nil {
+		return lastKnownHeight, err
+	}
+
+	// After a switch to another node, wait until it reaches our last block
+	// so that rewindReorg doesn't take the blocks it hasn't seen yet for
+	// disconnected ones
+	if h.switchedNode() && info.Blocks < lastKnownHeight {
+		log.Infof("Bitcoin node at height %d is behind the last processed "+
+			"block at height %d, waiting for it to catch up", info.Blocks,
+			lastKnownHeight)
+		return lastKnownHeight, nil
+	}
+	h.recheck = false
+
+	// Undo any blocks that are no longer in the best chain
+	lastKnownHeight = h.rewindReorg(lastKnownHeight)
+
+	if info.Blocks > lastKnownHeight {
+		log.Debugf("New block(s) detected. Previous height: %d, Current height: %d",
+			lastKnownHeight, info.Blocks)
+
+		// Process blocks from lastKnownHeight+1 to current height
+		for height := lastKnownHeight + 1; height <= info.Blocks; height++ {
+			select {
+			case <-h.ctx.Done():
+				return lastKnownHeight, nil
+			default:
+			}
+
+			// A block that fails is retried rather than skipped,
+			// which would keep the outpoints it spends valid
+			if err := h.handleNewBlock(height); err != nil {
+				return lastKnownHeight, err
+			}
+			lastKnownHeight = height
+		}
+	}
+
+	return lastKnownHeight, nil
+}
+
+// switchedNode reports whether the client switched to another Bitcoin node
+// since the recent blocks were last checked against its chain. Lookups cached
+// from the previous node are dropped.
+func (h *Handler) switchedNode() bool {
+	failover, ok := unwrapClient[failoverClient](h.client)
+	if !ok {
+		return false
+	}
+	stats := failover.Stats()
+	if stats.Switches != h.switches {
+		log.Infof("Switched to Bitcoin node %s, checking the last %d "+
+			"processed blocks against its chain", stats.Active,
+			len(h.recent))
+		h.switches = stats.Switches
+		h.recheck = true
+		if cache, ok := h.client.(txOutCache); ok {
+			cache.Purge()
+		}
+	}
+	return h.recheck
+}
+
 // handleNewBlock processes a new block
 func (h *Handler) handleNewBlock(height int32) error {
 
 	// Get the block hash for this height
 	blockHash, err := h.client.GetBlockHash(h.ctx, height)
 	if err != nil {
-		return fmt.Errorf("failed to get block hash for height %d: %v", height, err)
+		return fmt.Errorf("failed to get block hash for height %d: %w", height, err)
 	}
 
-	// Get the block data
-	block, err := h.client.GetBlock(h.ctx, blockHash)
+	// Extract all spent outpoints from the block
+	scan, err := h.blockSpentOutpoints(blockHash)
 	if err != nil {
-		return fmt.Errorf("failed to get block %s: %v", blockHash.String(), err)
+		return fmt.Errorf("failed to extract spent outpoints from block %s: %w", blockHash.String(), err)
+	}
+	spentOutpoints := scan.outpoints
+	h.inputsSkipped.Add(uint64(scan.skipped))
+	h.inputErrors.Add(uint64(scan.errors))
+	if scan.skipped > 0 || scan.errors > 0 {
+		log.Warnf("Block %s at height %d: %d spent, %d inputs skipped "+
+			"without a txid, %d errors", blockHash, height,
+			len(spentOutpoints), scan.skipped, scan.errors)
+	} else {
+		log.Debugf("Block %s at height %d: %d spent", blockHash, height,
+			len(spentOutpoints))
 	}
 
-	// Extract all spent outpoints from the block
-	spentOutpoints, err := h.extractSpentOutpoints(block)
-	if err != nil {
-		return fmt.Errorf("failed to extract spent outpoints from block %s: %v", blockHash.String(), err)
+	// Lookups cached before the block are stale now
+	if cache, ok := h.client.(txOutCache); ok {
+		spent := make([]wire.OutPoint, len(spentOutpoints))
+		for i, outpoint := range spentOutpoints {
+			spent[i] = outpoint.WireOutPoint()
+		}
+		cache.BlockConnected(spent)
 	}
 
 	if len(spentOutpoints) > 0 {
-		log.Printf("Found %d spent outpoints in block %s", len(spentOutpoints), blockHash.String())
-
-		// Remove spent outpoints from the database
-		if err := h.db.RemoveOutpoints(h.ctx, spentOutpoints); err != nil {
-			return fmt.Errorf("failed to remove spent outpoints from database: %v", err)
+		// Remove spent outpoints from the database, remembering them in
+		// case the block is later disconnected
+		removed, err := h.db.RemoveBlockOutpoints(h.ctx, *blockHash, spentOutpoints)
+		if err != nil {
+			return fmt.Errorf("failed to remove spent outpoints from database: %w", err)
 		}
 
-		log.Printf("Removed %d spent outpoints from UTXOchat database", len(spentOutpoints))
+		if len(removed) > 0 {
+			log.Debugf("Removed %d spent outpoints from UTXOchat database", len(removed))
+			h.outpointsRemoved.Add(uint64(len(removed)))
+			if h.onExpired != nil {
+				h.onExpired(removed)
+			}
+		}
 	}
 
+	h.recordBlock(height, *blockHash)
+	h.blocksProcessed.Add(1)
+
 	return nil
 }
 
-// extractSpentOutpoints extracts all outpoints that are spent in the given block
-func (h *Handler) extractSpentOutpoints(block *btcjson.GetBlockVerboseResult) ([]message.Outpoint, error) {
-	var spentOutpoints []message.Outpoint
-
-	// Get the block with transaction details
-	blockHash, err := chainhash.NewHashFromStr(block.Hash)
-	if err != nil {
-		return nil, fmt.Errorf("invalid block hash: %v", err)
-	}
-
-	// Get verbose block data with transaction details (verbosity level 2)
-	blockVerbose, err := h.client.GetBlockVerboseTx(blockHash)
-	if err != nil {
-		log.Printf("Failed to get block verbose data, falling back to individual tx calls: %v", err)
-		return h.extractSpentOutpointsFromTxIDs(block)
+// recordBlock remembers a processed block for reorg detection and forgets
+// blocks buried deeper than MaxReorgDepth.
+func (h *Handler) recordBlock(height int32, hash chainhash.Hash) {
+	block := processedBlock{height: height, hash: hash}
+	h.recent = append(h.recent, block)
+	h.lastBlock.Store(&block)
+
+	for int32(len(h.recent)) > h.config.MaxReorgDepth {
+		oldest := h.recent[0]
+		if err := h.db.ForgetBlock(h.ctx, oldest.hash); err != nil {
+			log.Warnf("Failed to forget block %s: %v", oldest.hash.String(), err)
+		}
+		h.recent = h.recent[1:]
 	}
+}
 
-	// Process each transaction in the verbose block
-	for _, tx := range blockVerbose.Tx {
-		// Process each input in the transaction
-		for _, input := range tx.Vin {
-			// Skip coinbase transactions (they don't spend existing UTXOs)
-			if input.Coinbase != "" {
-				continue
+// rewindReorg checks the recently processed blocks against the node's best
+// chain and restores the outpoints spent by any block that has been
+// disconnected. It returns the height of the last processed block that is
+// still in the best chain.
+func (h *Handler) rewindReorg(lastKnownHeight int32) int32 {
+	disconnected := 0
+	for len(h.recent) > 0 {
+		tip := h.recent[len(h.recent)-1]
+
+		hash, err := h.client.GetBlockHash(h.ctx, tip.height)
+		if err == nil && hash.IsEqual(&tip.hash) {
+			return lastKnownHeight
+		}
+		if err != nil {
+			// The chain may have become shorter than our tip; treat
+			// the block as disconnected but stop on other failures.
+			info, infoErr := h.client.GetBlockchainInfo(h.ctx)
+			if infoErr != nil || info.Blocks >= tip.height {
+				log.Warnf("Error checking block at height %d for reorg: %v",
+					tip.height, err)
+				return lastKnownHeight
 			}
+		}
 
-			// Convert the spent outpoint to our format
-			spentOutpoint, err := h.convertToOutpoint(input.Txid, input.Vout)
-			if err != nil {
-				log.Printf("Failed to convert outpoint %s:%d: %v", input.Txid, input.Vout, err)
-				continue
-			}
+		log.Infof("Block %s at height %d was disconnected, restoring its spent outpoints",
+			tip.hash.String(), tip.height)
+		if err := h.db.RestoreBlockOutpoints(h.ctx, tip.hash); err != nil {
+			log.Warnf("Failed to restore outpoints for block %s: %v",
+				tip.hash.String(), err)
+		}
 
-			spentOutpoints = append(spentOutpoints, spentOutpoint)
+		if cache, ok := h.client.(txOutCache); ok {
+			cache.Purge()
 		}
+
+		h.recent = h.recent[:len(h.recent)-1]
+		lastKnownHeight = tip.height - 1
+		disconnected++
+		h.blocksDisconnected.Add(1)
+
+		if len(h.recent) > 0 {
+			last := h.recent[len(h.recent)-1]
+			h.lastBlock.Store(&last)
+		} else {
+			h.lastBlock.Store(nil)
+		}
+	}
+
+	// Every block we remember was disconnected, so the fork point may be
+	// deeper than we can undo.
+	if disconnected > 0 {
+		log.Warnf("Reorg of at least %d blocks reached MaxReorgDepth (%d), "+
+			"outpoints spent in older blocks cannot be restored",
+			disconnected, h.config.MaxReorgDepth)
 	}
 
-	return spentOutpoints, nil
+	return lastKnownHeight
 }
 
-// extractSpentOutpointsFromTxIDs is a fallback method using individual transaction calls
-func (h *Handler) extractSpentOutpointsFromTxIDs(block *btcjson.GetBlockVerboseResult) ([]message.Outpoint, error) {
-	var spentOutpoints []message.Outpoint
+// spentScan holds the outpoints spent by a block and what couldn't be read.
+type spentScan struct {
+	outpoints []message.Outpoint
 
-	log.Printf("Using fallback method for block %s (requires txindex=1)", block.Hash)
+	// skipped is the number of inputs without a previous txid and errors
+	// the number of inputs and transactions that couldn't be read.
+	skipped int
+	errors  int
+}
 
-	// Process each transaction in the block
-	for _, txid := range block.Tx {
-		// Parse the transaction ID
-		txHash, err := chainhash.NewHashFromStr(txid)
-		if err != nil {
-			log.Printf("Invalid transaction ID %s: %v", txid, err)
+// addInputs adds the outpoints spent by the inputs of a verbose transaction.
+// Inputs without a txid are skipped rather than taken for the zero outpoint,
+// some nodes return them for blocks they only partially know.
+func (s *spentScan) addInputs(vin []btcjson.Vin) {
+	for _, input := range vin {
+		// Coinbase inputs don't spend existing UTXOs
+		if input.IsCoinBase() {
+			continue
+		}
+		if input.Txid == "" {
+			s.skipped++
 			continue
 		}
 
-		// Get the raw transaction to access its inputs
-		tx, err := h.client.GetRawTransaction(h.ctx, txHash)
+		txHash, err := chainhash.NewHashFromStr(input.Txid)
 		if err != nil {
-			log.Printf("Failed to get raw transaction %s: %v (hint: enable txindex=1 in bitcoin.conf)", txid, err)
+			log.Debugf("Invalid spent outpoint %s:%d: %v", input.Txid,
+				input.Vout, err)
+			s.errors++
 			continue
 		}
+		s.outpoints = append(s.outpoints,
+			message.NewOutpoint(*txHash, input.Vout))
+	}
+}
 
-		// Process each input in the transaction
-		for _, input := range tx.Vin {
-			// Skip coinbase transactions (they don't spend existing UTXOs)
-			if input.Coinbase != "" {
-				continue
-			}
+// blockSpentOutpoints returns the outpoints spent in the block with the
+// given hash. The block is decoded from its binary serialization if the
+// client supports it, and from verbose JSON otherwise. It fails with
+// ErrNodePruned if the node no longer has the block.
+func (h *Handler) blockSpentOutpoints(blockHash *chainhash.Hash) (
+	*spentScan, error) {
+
+	if raw, ok := unwrapClient[bitcoin.RawBlockClient](h.client); ok {
+		block, err := raw.GetRawBlock(h.ctx, blockHash)
+		switch {
+		case err == nil:
+			return &spentScan{outpoints: spentOutpointsFromBlock(block)}, nil
+		case bitcoin.IsTransportError(err):
+			return nil, err
+		case bitcoin.IsPrunedError(err):
+			return nil, fmt.Errorf("%w: %v", ErrNodePruned, err)
+		case !errors.Is(err, bitcoin.ErrRawBlockUnsupported):
+			log.Warnf("Failed to get raw block %s, falling back to "+
+				"verbose data: %v", blockHash, err)
+		}
+	}
 
-			// Convert the spent outpoint to our format
-			spentOutpoint, err := h.convertToOutpoint(input.Txid, input.Vout)
-			if err != nil {
-				log.Printf("Failed to convert outpoint %s:%d: %v", input.Txid, input.Vout, err)
-				continue
-			}
+	block, err := h.client.GetBlock(h.ctx, blockHash)
+	if bitcoin.IsPrunedError(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNodePruned, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get block: %w", err)
+	}
+	return h.extractSpentOutpoints(block)
+}
 
-			spentOutpoints = append(spentOutpoints, spentOutpoint)
+// unwrapClient returns client as a T, such as a bitcoin.RawBlockClient,
+// looking through caches wrapping it.
+func unwrapClient[T any](client bitcoin.ChainClient) (T, bool) {
+	for {
+		if found, ok := client.(T); ok {
+			return found, true
+		}
+		wrapper, ok := client.(interface{ Unwrap() bitcoin.ChainClient })
+		if !ok {
+			var zero T
+			return zero, false
 		}
+		client = wrapper.Unwrap()
 	}
+}
 
-	return spentOutpoints, nil
+// spentOutpointsFromBlock returns the outpoints spent by the transactions of
+// a block.
+func spentOutpointsFromBlock(block *wire.MsgBlock) []message.Outpoint {
+	var spentOutpoints []message.Outpoint
+	for i, tx := range block.Transactions {
+		// The coinbase transaction doesn't spend existing UTXOs
+		if i == 0 {
+			continue
+		}
+		for _, input := range tx.TxIn {
+			prev := input.PreviousOutPoint
+			spentOutpoints = append(spentOutpoints,
+				message.NewOutpointFromTxidIdx(&prev.Hash, prev.Index))
+		}
+	}
+	return spentOutpoints
 }
 
-// convertToOutpoint converts a txid string and vout to our Outpoint format
-func (h *Handler) convertToOutpoint(txidStr string, vout uint32) (message.Outpoint, error) {
-	var outpoint message.Outpoint
+// extractSpentOutpoints extracts all outpoints that are spent in the given
+// block from its verbose transactions, or from each transaction if the node
+// can't return them at once.
+func (h *Handler) extractSpentOutpoints(
+	block *btcjson.GetBlockVerboseResult) (*spentScan, error) {
 
-	// Parse the transaction hash
-	txHash, err := chainhash.NewHashFromStr(txidStr)
+	blockHash, err := chainhash.NewHashFromStr(block.Hash)
 	if err != nil {
-		return outpoint, fmt.Errorf("invalid txid: %v", err)
+		return nil, fmt.Errorf("invalid block hash: %v", err)
+	}
+
+	// Get verbose block data with transaction details (verbosity level 2)
+	blockVerbose, err := h.client.GetBlockVerboseTx(h.ctx, blockHash)
+	switch {
+	case bitcoin.IsTransportError(err):
+		return nil, err
+	case bitcoin.IsPrunedError(err):
+		return nil, fmt.Errorf("%w: %v", ErrNodePruned, err)
+	case err != nil:
+		log.Warnf("Failed to get block verbose data, falling back to individual tx calls: %v", err)
+		return h.extractSpentOutpointsFromTxIDs(block)
+	}
+
+	scan := &spentScan{}
+	for _, tx := range blockVerbose.Tx {
+		scan.addInputs(tx.Vin)
 	}
+	return scan, nil
+}
 
-	// Copy the transaction hash (in little-endian format for our Outpoint)
-	// The chainhash.Hash is already in little-endian format internally
-	copy(outpoint[:32], txHash[:])
+// extractSpentOutpointsFromTxIDs is a fallback method using individual
+// transaction calls, which needs txindex for confirmed transactions. The
+// transactions that can't be fetched are counted and reported once for the
+// block.
+func (h *Handler) extractSpentOutpointsFromTxIDs(
+	block *btcjson.GetBlockVerboseResult) (*spentScan, error) {
 
-	// Set the vout (output index) in little-endian format
-	outpoint[32] = byte(vout)
-	outpoint[33] = byte(vout >> 8)
-	outpoint[34] = byte(vout >> 16)
-	outpoint[35] = byte(vout >> 24)
+	log.Debugf("Using fallback method for block %s (requires txindex=1)", block.Hash)
 
-	return outpoint, nil
+	scan := &spentScan{}
+	var (
+		failed   int
+		firstErr error
+	)
+	for _, txid := range block.Tx {
+		txHash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			log.Debugf("Invalid transaction ID %s: %v", txid, err)
+			scan.errors++
+			continue
+		}
+
+		// Get the raw transaction to access its inputs
+		tx, err := h.client.GetRawTransaction(h.ctx, txHash)
+		if bitcoin.IsTransportError(err) {
+			return nil, err
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("transaction %s: %v", txid, err)
+			}
+			failed++
+			scan.errors++
+			continue
+		}
+		scan.addInputs(tx.Vin)
+	}
+
+	if failed > 0 {
+		log.Warnf("Failed to get %d of %d transactions of block %s, "+
+			"first %v (hint: enable txindex=1 in bitcoin.conf)", failed,
+			len(block.Tx), block.Hash, firstErr)
+	}
+	return scan, nil
 }
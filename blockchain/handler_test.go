@@ -0,0 +1,753 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/bitcoin"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// handlerTest is a block handler following a mock Bitcoin node, with an
+// in-memory database preloaded with messages for some of the node's UTXOs.
+type handlerTest struct {
+	t       *testing.T
+	client  *mock.Client
+	db      *database.MemoryDB
+	handler *Handler
+	height  int32
+	expired []message.Outpoint
+}
+
+// newHandlerTest creates a handler that has processed the node's chain up
+// to its tip, and stores a message for each outpoint, which the node holds
+// as a UTXO.
+func newHandlerTest(t *testing.T, outpoints ...message.Outpoint) *handlerTest {
+	t.Helper()
+
+	ht := &handlerTest{
+		t:      t,
+		client: mock.NewClient(),
+		db:     database.NewMemoryDB(),
+	}
+	ht.handler = NewHandler(ht.client, ht.db)
+	ht.handler.ctx = context.Background()
+	ht.handler.SetExpireHandler(func(outpoints []message.Outpoint) {
+		ht.expired = append(ht.expired, outpoints...)
+	})
+
+	for _, outpoint := range outpoints {
+		ht.client.AddUTXO(outpoint.WireOutPoint(), 50000, []byte{0x51})
+		err := ht.db.AddMessage(context.Background(), outpoint,
+			[]byte("message"), database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+	ht.height = ht.client.Height()
+	return ht
+}
+
+// sync processes the blocks the node has over the last processed height.
+func (ht *handlerTest) sync() error {
+	height, err := ht.handler.syncToTip(ht.height)
+	ht.height = height
+	return err
+}
+
+// mustSync syncs, failing the test on an error or if the handler stopped
+// before the node's tip.
+func (ht *handlerTest) mustSync() {
+	ht.t.Helper()
+
+	if err := ht.sync(); err != nil {
+		ht.t.Fatalf("syncToTip: %v", err)
+	}
+	if tip := ht.client.Height(); ht.height != tip {
+		ht.t.Fatalf("synced to height %d, want the tip at %d", ht.height,
+			tip)
+	}
+}
+
+// stored reports whether the database still holds the outpoint.
+func (ht *handlerTest) stored(outpoint message.Outpoint) bool {
+	ht.t.Helper()
+
+	ok, err := ht.db.HasOutpoint(context.Background(), outpoint)
+	if err != nil {
+		ht.t.Fatalf("HasOutpoint: %v", err)
+	}
+	return ok
+}
+
+// testOutpoint returns the outpoint of output vout of a transaction
+// numbered n.
+func testOutpoint(n byte, vout uint32) message.Outpoint {
+	return message.NewOutpoint(chainhash.Hash{n}, vout)
+}
+
+// TestHandlerSpentOutpoints checks that the outpoints spent by new blocks
+// are removed from the database and reported, leaving the others.
+func TestHandlerSpentOutpoints(t *testing.T) {
+	a, b, c := testOutpoint(1, 0), testOutpoint(2, 300), testOutpoint(3, 1)
+	ht := newHandlerTest(t, a, b, c)
+
+	ht.client.AddBlock()
+	ht.client.AddBlock(a.WireOutPoint(), b.WireOutPoint())
+	ht.mustSync()
+
+	if ht.stored(a) || ht.stored(b) || !ht.stored(c) {
+		t.Fatalf("stored after the spend: a %v, b %v, c %v", ht.stored(a),
+			ht.stored(b), ht.stored(c))
+	}
+	if len(ht.expired) != 2 {
+		t.Fatalf("%d outpoints reported expired, want 2", len(ht.expired))
+	}
+	stats := ht.handler.Stats()
+	if stats.BlocksProcessed != 2 || stats.OutpointsRemoved != 2 {
+		t.Fatalf("stats %+v, want 2 blocks processed, 2 outpoints removed",
+			stats)
+	}
+}
+
+// TestHandlerReorg checks that the outpoints spent by a block the node
+// disconnects are restored, and that those spent again by the replacing
+// chain are removed again.
+func TestHandlerReorg(t *testing.T) {
+	a, b := testOutpoint(1, 0), testOutpoint(2, 0)
+	ht := newHandlerTest(t, a, b)
+
+	ht.client.AddBlock(a.WireOutPoint())
+	ht.client.AddBlock(b.WireOutPoint())
+	ht.mustSync()
+	if ht.stored(a) || ht.stored(b) {
+		t.Fatal("spent outpoints still stored")
+	}
+
+	// Replace the last block with two that don't spend b
+	if err := ht.client.DisconnectBlock(); err != nil {
+		t.Fatalf("DisconnectBlock: %v", err)
+	}
+	ht.client.AddBlock()
+	ht.client.AddBlock()
+	ht.mustSync()
+
+	if ht.stored(a) || !ht.stored(b) {
+		t.Fatalf("stored after the reorg: a %v, b %v, want only b",
+			ht.stored(a), ht.stored(b))
+	}
+	if n := ht.handler.Stats().BlocksDisconnected; n != 1 {
+		t.Fatalf("%d blocks disconnected, want 1", n)
+	}
+
+	// A chain that shrinks below the last processed block and spends b
+	// again
+	for i := 0; i < 2; i++ {
+		if err := ht.client.DisconnectBlock(); err != nil {
+			t.Fatalf("DisconnectBlock: %v", err)
+		}
+	}
+	ht.client.AddBlock(b.WireOutPoint())
+	ht.mustSync()
+
+	if ht.stored(b) {
+		t.Fatal("outpoint spent by the new chain still stored")
+	}
+	if n := ht.handler.Stats().BlocksDisconnected; n != 3 {
+		t.Fatalf("%d blocks disconnected, want 3", n)
+	}
+}
+
+// TestHandlerRPCErrors checks that blocks the node fails to serve are
+// processed again on the next sync instead of being skipped.
+func TestHandlerRPCErrors(t *testing.T) {
+	a := testOutpoint(1, 0)
+	ht := newHandlerTest(t, a)
+	start := ht.height
+
+	ht.client.AddBlock(a.WireOutPoint())
+	ht.client.SetError(mock.MethodGetBlockHash, syscall.ECONNREFUSED)
+	err := ht.sync()
+	if !bitcoin.IsTransportError(err) {
+		t.Fatalf("unreachable node gave %v, want a transport error", err)
+	}
+	if ht.height != start || !ht.stored(a) {
+		t.Fatalf("advanced to height %d from %d while the node was "+
+			"unreachable", ht.height, start)
+	}
+
+	ht.client.SetError(mock.MethodGetBlockHash, nil)
+	ht.client.FailCalls(mock.MethodGetBlockchainInfo, 1, syscall.ECONNRESET)
+	if err := ht.sync(); !bitcoin.IsTransportError(err) {
+		t.Fatalf("unreachable node gave %v, want a transport error", err)
+	}
+
+	ht.mustSync()
+	if ht.stored(a) {
+		t.Fatal("spent outpoint still stored after the node came back")
+	}
+}
+
+// failingDB is an in-memory database whose block removals fail while err is
+// set.
+type failingDB struct {
+	*database.MemoryDB
+	err error
+}
+
+// RemoveBlockOutpoints implements database.Database.
+func (db *failingDB) RemoveBlockOutpoints(ctx context.Context,
+	blockHash chainhash.Hash, outpoints []message.Outpoint) (
+	[]message.Outpoint, error) {
+
+	if db.err != nil {
+		return nil, db.err
+	}
+	return db.MemoryDB.RemoveBlockOutpoints(ctx, blockHash, outpoints)
+}
+
+// TestHandlerDatabaseErrors checks that a block whose spends can't be
+// removed from the database is processed again on the next sync instead of
+// being skipped.
+func TestHandlerDatabaseErrors(t *testing.T) {
+	a, b := testOutpoint(1, 0), testOutpoint(2, 0)
+	ht := newHandlerTest(t, a, b)
+	start := ht.height
+
+	failure := errors.New("disk full")
+	db := &failingDB{MemoryDB: ht.db, err: failure}
+	ht.handler.db = db
+
+	ht.client.AddBlock(a.WireOutPoint())
+	ht.client.AddBlock(b.WireOutPoint())
+	for i := 0; i < 2; i++ {
+		if err := ht.sync(); !errors.Is(err, failure) {
+			t.Fatalf("failing database gave %v, want its error", err)
+		}
+		if ht.height != start || !ht.stored(a) || !ht.stored(b) {
+			t.Fatalf("advanced to height %d from %d past a block whose "+
+				"spends weren't removed", ht.height, start)
+		}
+	}
+
+	db.err = nil
+	ht.mustSync()
+	if ht.stored(a) || ht.stored(b) {
+		t.Fatalf("stored after the database recovered: a %v, b %v",
+			ht.stored(a), ht.stored(b))
+	}
+	if n := ht.handler.Stats().BlocksProcessed; n != 2 {
+		t.Fatalf("%d blocks processed, want 2", n)
+	}
+}
+
+// TestHandlerPruned checks that a block the node pruned stops the sync with
+// ErrNodePruned before it.
+func TestHandlerPruned(t *testing.T) {
+	ht := newHandlerTest(t)
+	start := ht.height
+
+	ht.client.AddBlock()
+	ht.client.SetError(mock.MethodGetBlock, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCMisc,
+		Message: "Block not available (pruned data)",
+	})
+	if err := ht.sync(); !errors.Is(err, ErrNodePruned) {
+		t.Fatalf("pruned block gave %v, want ErrNodePruned", err)
+	}
+	if ht.height != start {
+		t.Fatalf("advanced to height %d past a pruned block", ht.height)
+	}
+}
+
+// verboseNode is a mock Bitcoin node returning every block it is asked for
+// in verbose form with a coinbase and one transaction of the given inputs.
+type verboseNode struct {
+	*mock.Client
+	vin []btcjson.Vin
+}
+
+// GetBlockVerboseTx implements bitcoin.ChainClient.
+func (n *verboseNode) GetBlockVerboseTx(ctx context.Context,
+	blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseTxResult, error) {
+
+	block, err := n.Client.GetBlockVerboseTx(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	block.Tx = []btcjson.TxRawResult{
+		{Vin: []btcjson.Vin{{Coinbase: "51"}}},
+		{Vin: n.vin},
+	}
+	return block, nil
+}
+
+// TestHandlerVerboseInputs checks that the inputs of a verbose block remove
+// the outpoints they spend, while an input without a txid is skipped rather
+// than taken for the zero outpoint and one with a malformed txid is counted
+// as an error.
+func TestHandlerVerboseInputs(t *testing.T) {
+	a, b := testOutpoint(1, 0), testOutpoint(2, 1)
+	zero := message.NewOutpoint(chainhash.Hash{}, 0)
+
+	tests := []struct {
+		name    string
+		vin     []btcjson.Vin
+		spent   []message.Outpoint
+		skipped uint64
+		errors  uint64
+	}{{
+		name: "normal",
+		vin: []btcjson.Vin{
+			{Txid: a.Txid().String(), Vout: a.Vout()},
+			{Txid: b.Txid().String(), Vout: b.Vout()},
+		},
+		spent: []message.Outpoint{a, b},
+	}, {
+		name: "malformed vin",
+		vin: []btcjson.Vin{
+			{Vout: 0},
+			{Txid: "not a txid", Vout: 0},
+			{Txid: a.Txid().String(), Vout: a.Vout()},
+		},
+		spent:   []message.Outpoint{a},
+		skipped: 1,
+		errors:  1,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ht := newHandlerTest(t, a, b, zero)
+			ht.handler.client = &verboseNode{
+				Client: ht.client,
+				vin:    test.vin,
+			}
+
+			ht.client.AddBlock()
+			ht.mustSync()
+			if !slices.Equal(ht.expired, test.spent) {
+				t.Fatalf("expired %v, want %v", ht.expired, test.spent)
+			}
+			for _, outpoint := range []message.Outpoint{a, b, zero} {
+				spent := slices.Contains(test.spent, outpoint)
+				if ht.stored(outpoint) == spent {
+					t.Fatalf("%s stored: %v", outpoint.ToString(),
+						!spent)
+				}
+			}
+			stats := ht.handler.Stats()
+			if stats.InputsSkipped != test.skipped ||
+				stats.InputErrors != test.errors {
+
+				t.Fatalf("%d inputs skipped, %d errors, want %d and %d",
+					stats.InputsSkipped, stats.InputErrors,
+					test.skipped, test.errors)
+			}
+		})
+	}
+}
+
+// TestHandlerPrunedPause checks that processing pauses at a block the node
+// pruned, polling it no faster than maxPollBackoff, and resumes once the node
+// serves the block.
+func TestHandlerPrunedPause(t *testing.T) {
+	a := testOutpoint(1, 0)
+	ht := newHandlerTest(t, a)
+	h, err := startHandler(t, ht.client, ht.db, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := h.SetPollInterval(50 * time.Millisecond); err != nil {
+		t.Fatalf("SetPollInterval: %v", err)
+	}
+
+	start := ht.client.Height()
+	ht.client.SetError(mock.MethodGetBlock, &btcjson.RPCError{
+		Code:    btcjson.ErrRPCMisc,
+		Message: "Block not available (pruned data)",
+	})
+	ht.client.AddBlock(a.WireOutPoint())
+	deadline := time.Now().Add(10 * time.Second)
+	for !h.Stats().Paused {
+		if time.Now().After(deadline) {
+			t.Fatal("processing not paused at a pruned block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := pollsDuring(ht.client, 500*time.Millisecond); n != 0 {
+		t.Fatalf("paused handler polled %d times in 500ms", n)
+	}
+	if stats := h.Stats(); stats.LastBlockHeight == start+1 ||
+		stats.RPCDegraded || !ht.stored(a) {
+
+		t.Fatalf("stats %+v while paused at height %d", stats, start+1)
+	}
+
+	ht.client.SetError(mock.MethodGetBlock, nil)
+	waitProcessed(t, h, start+1)
+	if h.Stats().Paused || ht.stored(a) {
+		t.Fatal("processing not resumed once the node served the block")
+	}
+}
+
+// startHandler starts a handler following client with cfg. It is stopped
+// when the test ends.
+func startHandler(t *testing.T, client bitcoin.ChainClient,
+	db database.Database, cfg Config) (*Handler, error) {
+
+	t.Helper()
+
+	cfg.NotificationsEnabled = false
+	h := NewHandlerWithConfig(client, db, cfg)
+	if err := h.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { h.Stop() })
+	return h, nil
+}
+
+// waitProcessed waits until h processed the block at height.
+func waitProcessed(t *testing.T, h *Handler, height int32) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for h.Stats().LastBlockHeight != height {
+		if time.Now().After(deadline) {
+			t.Fatalf("block %d not processed, last is %d", height,
+				h.Stats().LastBlockHeight)
+		}
+		select {
+		case h.blockNotify <- struct{}{}:
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandlerStartAtTip checks that a handler started on an empty database
+// next to a node at height 500 fetches none of its blocks, and processes the
+// next one first.
+func TestHandlerStartAtTip(t *testing.T) {
+	client := mock.NewClient()
+	for client.Height() < 500 {
+		client.AddBlock()
+	}
+	db := database.NewMemoryDB()
+	h, err := startHandler(t, client, db, DefaultConfig())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// A sync at the tip has nothing to fetch
+	infos := client.Calls(mock.MethodGetBlockchainInfo)
+	h.blockNotify <- struct{}{}
+	deadline := time.Now().Add(10 * time.Second)
+	for client.Calls(mock.MethodGetBlockchainInfo) == infos {
+		if time.Now().After(deadline) {
+			t.Fatal("no sync at the tip")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := client.Calls(mock.MethodGetBlock); n != 0 {
+		t.Fatalf("%d historical blocks fetched, want none", n)
+	}
+
+	client.AddBlock()
+	waitProcessed(t, h, 501)
+	if n := client.Calls(mock.MethodGetBlock); n != 1 {
+		t.Fatalf("%d blocks fetched, want block 501 only", n)
+	}
+	if n := h.Stats().BlocksProcessed; n != 1 {
+		t.Fatalf("%d blocks processed, want 1", n)
+	}
+}
+
+// TestHandlerStartHeight checks that a start height backfills from that
+// block, and that one above the tip is refused.
+func TestHandlerStartHeight(t *testing.T) {
+	client := mock.NewClient()
+	for client.Height() < 500 {
+		client.AddBlock()
+	}
+
+	cfg := DefaultConfig()
+	for _, start := range []int32{501, -1} {
+		cfg.StartHeight = start
+		_, err := startHandler(t, client, database.NewMemoryDB(), cfg)
+		if err == nil {
+			t.Fatalf("start height %d accepted at height 500", start)
+		}
+	}
+
+	cfg.StartHeight = 498
+	h, err := startHandler(t, client, database.NewMemoryDB(), cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	waitProcessed(t, h, 500)
+	if n := h.Stats().BlocksProcessed; n != 3 {
+		t.Fatalf("%d blocks processed, want 498 to 500", n)
+	}
+}
+
+// pollsDuring returns the number of times client is polled for its tip
+// during window.
+func pollsDuring(client *mock.Client, window time.Duration) int {
+	before := client.Calls(mock.MethodGetBlockchainInfo)
+	time.Sleep(window)
+	return client.Calls(mock.MethodGetBlockchainInfo) - before
+}
+
+// TestHandlerPollInterval checks that the tip is polled at the configured
+// interval, at the default one when none is configured, and at the one set
+// at runtime.
+func TestHandlerPollInterval(t *testing.T) {
+	client := mock.NewClient()
+	cfg := DefaultConfig()
+	cfg.PollInterval = 1
+	if _, err := startHandler(t, client, database.NewMemoryDB(),
+		cfg); err != nil {
+
+		t.Fatalf("Start: %v", err)
+	}
+	if n := pollsDuring(client, 2500*time.Millisecond); n < 2 || n > 3 {
+		t.Fatalf("polled %d times in 2.5s at a 1s interval", n)
+	}
+
+	client = mock.NewClient()
+	cfg.PollInterval = 0
+	h, err := startHandler(t, client, database.NewMemoryDB(), cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if interval := h.pollInterval(); interval != 30*time.Second {
+		t.Fatalf("zero interval gave %v, want the 30s default", interval)
+	}
+	if n := pollsDuring(client, 300*time.Millisecond); n != 0 {
+		t.Fatalf("polled %d times in 300ms at the default interval", n)
+	}
+
+	if err := h.SetPollInterval(0); err == nil {
+		t.Fatal("zero interval set at runtime")
+	}
+	if err := h.SetPollInterval(50 * time.Millisecond); err != nil {
+		t.Fatalf("SetPollInterval: %v", err)
+	}
+	if n := pollsDuring(client, time.Second); n < 15 || n > 21 {
+		t.Fatalf("polled %d times in 1s at a 50ms interval", n)
+	}
+}
+
+// TestPollBackoff checks that the delay after failed polls doubles from the
+// poll interval up to maxPollBackoff, randomized between half and all of it.
+func TestPollBackoff(t *testing.T) {
+	const interval = time.Second
+
+	for failures := 0; failures < 20; failures++ {
+		want := min(interval<<failures, maxPollBackoff)
+		for i := 0; i < 100; i++ {
+			delay := pollBackoff(interval, failures)
+			if delay < want/2 || delay > want {
+				t.Fatalf("%d failures gave %v, want %v to %v", failures,
+					delay, want/2, want)
+			}
+		}
+	}
+	if delay := pollBackoff(time.Hour, 3); delay < 30*time.Minute ||
+		delay > time.Hour {
+
+		t.Fatalf("backoff of a 1h interval is %v", delay)
+	}
+}
+
+// TestHandlerPollUnreachable checks that an unreachable node is polled less
+// and less often while the handler reports it degraded, and that blocks are
+// processed again once it is back.
+func TestHandlerPollUnreachable(t *testing.T) {
+	client := mock.NewClient()
+	h, err := startHandler(t, client, database.NewMemoryDB(), DefaultConfig())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := h.SetPollInterval(50 * time.Millisecond); err != nil {
+		t.Fatalf("SetPollInterval: %v", err)
+	}
+
+	client.SetError(mock.MethodGetBlockchainInfo, syscall.ECONNREFUSED)
+	if n := pollsDuring(client, 1500*time.Millisecond); n > 10 {
+		t.Fatalf("unreachable node polled %d times in 1.5s at a 50ms "+
+			"interval", n)
+	}
+	if !h.Stats().RPCDegraded {
+		t.Fatal("unreachable node not reported")
+	}
+
+	client.SetError(mock.MethodGetBlockchainInfo, nil)
+	client.AddBlock()
+	waitProcessed(t, h, client.Height())
+	if h.Stats().RPCDegraded {
+		t.Fatal("node still reported unreachable after it came back")
+	}
+}
+
+// TestHandlerCachedLookups checks that a block processed by the handler drops
+// the cached lookups of the outputs it spent.
+func TestHandlerCachedLookups(t *testing.T) {
+	ctx := context.Background()
+	client := mock.NewClient()
+	cache := bitcoin.NewCachedClient(client)
+	h, err := startHandler(t, cache, database.NewMemoryDB(), DefaultConfig())
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	spent, kept := testOutpoint(1, 0), testOutpoint(2, 0)
+	for _, outpoint := range []message.Outpoint{spent, kept} {
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, nil)
+		txid := outpoint.Txid()
+		if _, err := cache.GetTxOut(ctx, &txid, outpoint.Vout(),
+			false); err != nil {
+
+			t.Fatalf("GetTxOut: %v", err)
+		}
+	}
+
+	client.AddBlock(spent.WireOutPoint())
+	waitProcessed(t, h, client.Height())
+	calls := client.Calls(mock.MethodGetTxOut)
+	for _, outpoint := range []message.Outpoint{spent, kept} {
+		txid := outpoint.Txid()
+		result, err := cache.GetTxOut(ctx, &txid, outpoint.Vout(), false)
+		if err != nil || (result == nil) != (outpoint == spent) {
+			t.Fatalf("%s looked up as %+v, %v after the block",
+				outpoint.ToString(), result, err)
+		}
+	}
+	if n := client.Calls(mock.MethodGetTxOut) - calls; n != 1 {
+		t.Fatalf("node asked %d times after the block, want only for "+
+			"the spent output", n)
+	}
+}
+
+// testBlock returns a block of numTxs transactions, each but the coinbase
+// spending two outputs, in its binary serialization and as the verbose JSON
+// of getblock with verbosity 2.
+func testBlock(t testing.TB, numTxs int) ([]byte, []byte) {
+	t.Helper()
+
+	block := wire.NewMsgBlock(wire.NewBlockHeader(1, &chainhash.Hash{},
+		&chainhash.Hash{}, 0, 0))
+	verbose := btcjson.GetBlockVerboseTxResult{
+		Tx: make([]btcjson.TxRawResult, numTxs),
+	}
+
+	coinbase := wire.NewMsgTx(2)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{},
+		wire.MaxPrevOutIndex), []byte{0x51}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50000, []byte{0x51}))
+	block.AddTransaction(coinbase)
+	verbose.Tx[0].Vin = []btcjson.Vin{{Coinbase: "51"}}
+
+	for i := 1; i < numTxs; i++ {
+		tx := wire.NewMsgTx(2)
+		for vout := uint32(0); vout < 2; vout++ {
+			prevHash := chainhash.DoubleHashH([]byte{byte(i), byte(i >> 8)})
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, vout), nil,
+				nil))
+			verbose.Tx[i].Vin = append(verbose.Tx[i].Vin, btcjson.Vin{
+				Txid: prevHash.String(),
+				Vout: vout,
+			})
+		}
+		tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+		block.AddTransaction(tx)
+	}
+
+	var raw bytes.Buffer
+	if err := block.Serialize(&raw); err != nil {
+		t.Fatal(err)
+	}
+	verboseJSON, err := json.Marshal(&verbose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw.Bytes(), verboseJSON
+}
+
+// rawSpentOutpoints decodes a binary block and returns its spent outpoints.
+func rawSpentOutpoints(raw []byte) ([]message.Outpoint, error) {
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	return spentOutpointsFromBlock(&block), nil
+}
+
+// verboseSpentOutpoints decodes a verbose block and returns its spent
+// outpoints.
+func verboseSpentOutpoints(verboseJSON []byte) ([]message.Outpoint, error) {
+	var block btcjson.GetBlockVerboseTxResult
+	if err := json.Unmarshal(verboseJSON, &block); err != nil {
+		return nil, err
+	}
+	scan := &spentScan{}
+	for _, tx := range block.Tx {
+		scan.addInputs(tx.Vin)
+	}
+	return scan.outpoints, nil
+}
+
+// TestSpentOutpointsFromBlock checks that a binary block yields the same
+// spent outpoints as its verbose JSON, without the coinbase input.
+func TestSpentOutpointsFromBlock(t *testing.T) {
+	raw, verboseJSON := testBlock(t, 10)
+	fromRaw, err := rawSpentOutpoints(raw)
+	if err != nil {
+		t.Fatalf("binary block: %v", err)
+	}
+	fromVerbose, err := verboseSpentOutpoints(verboseJSON)
+	if err != nil {
+		t.Fatalf("verbose block: %v", err)
+	}
+	if len(fromRaw) != 18 || !slices.Equal(fromRaw, fromVerbose) {
+		t.Fatalf("got %d outpoints from the binary block, %d from the "+
+			"verbose one, want the same 18", len(fromRaw),
+			len(fromVerbose))
+	}
+}
+
+// BenchmarkSpentOutpoints compares extracting the spent outpoints of a block
+// of 2000 transactions from its binary serialization and from verbose JSON.
+func BenchmarkSpentOutpoints(b *testing.B) {
+	raw, verboseJSON := testBlock(b, 2000)
+	b.Run("binary", func(b *testing.B) {
+		b.SetBytes(int64(len(raw)))
+		for i := 0; i < b.N; i++ {
+			if _, err := rawSpentOutpoints(raw); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("json", func(b *testing.B) {
+		b.SetBytes(int64(len(verboseJSON)))
+		for i := 0; i < b.N; i++ {
+			if _, err := verboseSpentOutpoints(verboseJSON); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
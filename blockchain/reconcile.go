@@ -0,0 +1,197 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// DefaultReconcileSampleSize is the default number of outpoints checked
+	// by a sampled reconciliation.
+	DefaultReconcileSampleSize = 1000
+
+	// DefaultReconcileWorkers is the default number of UTXO lookups a
+	// reconciliation makes at a time.
+	DefaultReconcileWorkers = 4
+
+	// reconcileBatchSize is the number of outpoints looked up before the
+	// spent ones among them are removed.
+	reconcileBatchSize = 100
+)
+
+// ReconcileMode selects how the stored outpoints are checked against the
+// UTXO set on startup.
+type ReconcileMode string
+
+const (
+	// ReconcileOff skips the startup check.
+	ReconcileOff ReconcileMode = "off"
+
+	// ReconcileFull checks every stored outpoint.
+	ReconcileFull ReconcileMode = "full"
+
+	// ReconcileSampled checks a random sample of the stored outpoints, for
+	// stores too large to check in full on every start.
+	ReconcileSampled ReconcileMode = "sampled"
+)
+
+// ParseReconcileMode parses a reconciliation mode name. An empty name is
+// ReconcileOff.
+func ParseReconcileMode(name string) (ReconcileMode, error) {
+	switch mode := ReconcileMode(name); mode {
+	case "":
+		return ReconcileOff, nil
+	case ReconcileOff, ReconcileFull, ReconcileSampled:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown reconcile mode %q, expected off, "+
+			"full or sampled", name)
+	}
+}
+
+// reconcile removes the stored outpoints whose UTXO was spent while the node
+// was not running, since the blocks spending them are older than the first
+// block scanned. Removed outpoints are reported to the expire handler like
+// those spent by new blocks. The pass stops early if the Bitcoin node becomes
+// unreachable; the remaining outpoints are left for the next start.
+func (h *Handler) reconcile() {
+	defer h.reconciling.Done()
+
+	start := time.Now()
+	outpoints, err := h.db.ListOutpoints(h.ctx)
+	if err != nil {
+		log.Warnf("Startup reconciliation failed to list outpoints: %v", err)
+		return
+	}
+
+	total := len(outpoints)
+	if h.config.Reconcile == ReconcileSampled {
+		size := h.config.ReconcileSampleSize
+		if size <= 0 {
+			size = DefaultReconcileSampleSize
+		}
+		if total > size {
+			rand.Shuffle(total, func(i, j int) {
+				outpoints[i], outpoints[j] = outpoints[j], outpoints[i]
+			})
+			outpoints = outpoints[:size]
+		}
+	}
+
+	log.Infof("Startup reconciliation checking %d of %d outpoints",
+		len(outpoints), total)
+
+	var checked, removed int
+	for len(outpoints) > 0 {
+		batch := outpoints[:min(reconcileBatchSize, len(outpoints))]
+		outpoints = outpoints[len(batch):]
+
+		spent, err := h.findSpent(batch)
+		if err != nil {
+			log.Warnf("Startup reconciliation stopped after %d outpoints, "+
+				"%d removed: %v", checked, removed, err)
+			return
+		}
+		checked += len(batch)
+
+		if len(spent) == 0 {
+			continue
+		}
+		if err := h.db.RemoveOutpoints(h.ctx, spent); err != nil {
+			log.Warnf("Startup reconciliation failed to remove spent "+
+				"outpoints: %v", err)
+			return
+		}
+		removed += len(spent)
+		h.outpointsRemoved.Add(uint64(len(spent)))
+		if h.onExpired != nil {
+			h.onExpired(spent)
+		}
+	}
+
+	log.Infof("Startup reconciliation checked %d outpoints in %v, removed %d "+
+		"spent while offline", checked, time.Since(start).Round(time.Millisecond),
+		removed)
+}
+
+// findSpent looks up the UTXOs of outpoints, ReconcileWorkers at a time, and
+// returns the outpoints whose UTXO no longer exists. Only confirmed spends
+// count, like those of the scanned blocks. It fails if the Bitcoin node
+// can't be reached, outpoints whose lookup fails otherwise are kept.
+func (h *Handler) findSpent(
+	outpoints []message.Outpoint) ([]message.Outpoint, error) {
+
+	workers := h.config.ReconcileWorkers
+	if workers <= 0 {
+		workers = DefaultReconcileWorkers
+	}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	spent := make([]bool, len(outpoints))
+	sem := make(chan struct{}, workers)
+	for i, outpoint := range outpoints {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			txid, vout := outpoint.ToTxidIdx()
+			txOut, err := h.client.GetTxOut(ctx, txid, vout, false)
+			switch {
+			case err == nil:
+				spent[i] = txOut == nil
+
+			case bitcoin.IsTransportError(err) || ctx.Err() != nil:
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+
+			default:
+				log.Debugf("Failed to look up outpoint %s: %v",
+					outpoint.ToString(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := h.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []message.Outpoint
+	for i, outpoint := range outpoints {
+		if spent[i] {
+			result = append(result, outpoint)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// newReconcileTest stores messages for 10 outpoints, 3 of whose UTXOs were
+// spent while the node was not running, and returns them with the spent
+// ones.
+func newReconcileTest(t *testing.T, mode ReconcileMode) (*handlerTest,
+	[]message.Outpoint, map[message.Outpoint]bool) {
+
+	t.Helper()
+
+	outpoints := make([]message.Outpoint, 10)
+	for i := range outpoints {
+		outpoints[i] = testOutpoint(byte(i+1), 0)
+	}
+	ht := newHandlerTest(t, outpoints...)
+	ht.handler.config.Reconcile = mode
+	ht.handler.config.ReconcileWorkers = 2
+
+	spent := make(map[message.Outpoint]bool)
+	for _, i := range []int{1, 4, 8} {
+		ht.client.SpendUTXO(outpoints[i].WireOutPoint())
+		spent[outpoints[i]] = true
+	}
+	return ht, outpoints, spent
+}
+
+// runReconcile runs the startup reconciliation of ht to completion.
+func (ht *handlerTest) runReconcile() {
+	ht.handler.reconciling.Add(1)
+	ht.handler.reconcile()
+}
+
+// TestReconcile checks that a full reconciliation removes exactly the 3 of
+// 10 stored outpoints whose UTXO is gone, along with their messages, and
+// reports them to the expire handler.
+func TestReconcile(t *testing.T) {
+	ht, outpoints, spent := newReconcileTest(t, ReconcileFull)
+	ht.runReconcile()
+
+	for _, outpoint := range outpoints {
+		if ht.stored(outpoint) == spent[outpoint] {
+			t.Fatalf("outpoint %s stored: %v, spent: %v",
+				outpoint.ToString(), !spent[outpoint], spent[outpoint])
+		}
+		data, err := ht.db.GetMessage(context.Background(), outpoint)
+		if err != nil || (data == nil) != spent[outpoint] {
+			t.Fatalf("message of %s: %q, %v", outpoint.ToString(), data,
+				err)
+		}
+	}
+	if len(ht.expired) != len(spent) {
+		t.Fatalf("%d outpoints reported expired, want %d", len(ht.expired),
+			len(spent))
+	}
+	for _, outpoint := range ht.expired {
+		if !spent[outpoint] {
+			t.Fatalf("unspent %s reported expired", outpoint.ToString())
+		}
+	}
+	if n := ht.client.Calls(mock.MethodGetTxOut); n != len(outpoints) {
+		t.Fatalf("%d UTXO lookups, want %d", n, len(outpoints))
+	}
+	if n := ht.handler.Stats().OutpointsRemoved; n != uint64(len(spent)) {
+		t.Fatalf("%d outpoints removed, want %d", n, len(spent))
+	}
+}
+
+// TestReconcileSampled checks that a sampled reconciliation looks up no more
+// outpoints than its sample size, and only removes spent ones.
+func TestReconcileSampled(t *testing.T) {
+	ht, outpoints, spent := newReconcileTest(t, ReconcileSampled)
+	ht.handler.config.ReconcileSampleSize = 4
+	ht.runReconcile()
+
+	if n := ht.client.Calls(mock.MethodGetTxOut); n != 4 {
+		t.Fatalf("%d UTXO lookups, want 4", n)
+	}
+	for _, outpoint := range outpoints {
+		if !spent[outpoint] && !ht.stored(outpoint) {
+			t.Fatalf("unspent %s removed", outpoint.ToString())
+		}
+	}
+}
+
+// TestReconcileUnreachable checks that a reconciliation stops without
+// removing anything when the Bitcoin node can't be reached.
+func TestReconcileUnreachable(t *testing.T) {
+	ht, outpoints, _ := newReconcileTest(t, ReconcileFull)
+	ht.client.SetError(mock.MethodGetTxOut, syscall.ECONNREFUSED)
+	ht.runReconcile()
+
+	for _, outpoint := range outpoints {
+		if !ht.stored(outpoint) {
+			t.Fatalf("%s removed while the node was unreachable",
+				outpoint.ToString())
+		}
+	}
+	if len(ht.expired) != 0 {
+		t.Fatalf("%d outpoints reported expired", len(ht.expired))
+	}
+}
+
+// TestReconcileOnStart checks that Start runs the reconciliation in the
+// background when it is enabled, and that an unknown mode fails it.
+func TestReconcileOnStart(t *testing.T) {
+	ht, _, spent := newReconcileTest(t, ReconcileFull)
+	cfg := DefaultConfig()
+	cfg.Reconcile = ReconcileFull
+	h, err := startHandler(t, ht.client, ht.db, cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	h.reconciling.Wait()
+	for outpoint := range spent {
+		if ht.stored(outpoint) {
+			t.Fatalf("spent %s still stored", outpoint.ToString())
+		}
+	}
+
+	cfg.Reconcile = "sometimes"
+	if _, err := startHandler(t, ht.client, ht.db, cfg); err == nil {
+		t.Fatal("handler started with an unknown reconcile mode")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/gozmq"
+)
+
+const (
+	// zmqBlockTopic is the bitcoind ZMQ topic announcing new block hashes.
+	zmqBlockTopic = "hashblock"
+
+	// zmqReadTimeout is the maximum time to wait for the remainder of a
+	// partially received ZMQ message.
+	zmqReadTimeout = 5 * time.Second
+
+	// zmqRetryDelay is the delay between attempts to (re)subscribe to the
+	// ZMQ endpoint.
+	zmqRetryDelay = 5 * time.Second
+)
+
+// zmqSubscriber listens for hashblock notifications published by bitcoind on
+// a ZMQ endpoint and signals them on notify. It resubscribes if the socket
+// drops.
+type zmqSubscriber struct {
+	endpoint string
+	notify   chan<- struct{}
+
+	conn   *gozmq.Conn
+	connMu sync.Mutex
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newZMQSubscriber creates a subscriber for the given endpoint, for example
+// tcp://127.0.0.1:28332.
+func newZMQSubscriber(endpoint string, notify chan<- struct{}) *zmqSubscriber {
+	return &zmqSubscriber{
+		endpoint: endpoint,
+		notify:   notify,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start begins listening for notifications in the background.
+func (z *zmqSubscriber) start() {
+	go z.run()
+}
+
+// stop closes the ZMQ socket and waits for the subscriber to exit.
+func (z *zmqSubscriber) stop() {
+	close(z.quit)
+
+	z.connMu.Lock()
+	if z.conn != nil {
+		z.conn.Close()
+	}
+	z.connMu.Unlock()
+
+	<-z.done
+}
+
+// run subscribes to the endpoint and forwards notifications until stopped.
+func (z *zmqSubscriber) run() {
+	defer close(z.done)
+
+	for {
+		conn, err := gozmq.Subscribe(z.endpoint, []string{zmqBlockTopic},
+			zmqReadTimeout)
+		if err != nil {
+			log.Warnf("Failed to subscribe to ZMQ endpoint %s: %v", z.endpoint, err)
+			select {
+			case <-z.quit:
+				return
+			case <-time.After(zmqRetryDelay):
+				continue
+			}
+		}
+
+		z.connMu.Lock()
+		select {
+		case <-z.quit:
+			z.connMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		z.conn = conn
+		z.connMu.Unlock()
+
+		log.Infof("Subscribed to block notifications on %s", z.endpoint)
+		err = z.receive(conn)
+		conn.Close()
+
+		select {
+		case <-z.quit:
+			return
+		default:
+		}
+		log.Warnf("ZMQ subscription to %s lost: %v, resubscribing", z.endpoint, err)
+	}
+}
+
+// receive reads notifications from conn until it fails with an error that
+// the connection cannot recover from by itself.
+func (z *zmqSubscriber) receive(conn *gozmq.Conn) error {
+	for {
+		msg, err := conn.Receive(nil)
+		if err != nil {
+			// Timeouts are returned after gozmq transparently
+			// reconnected the socket, so keep reading.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		if len(msg) < 2 || string(msg[0]) != zmqBlockTopic {
+			continue
+		}
+
+		// Coalesce notifications; processBlocks catches up to the tip
+		// whenever it is woken.
+		select {
+		case z.notify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// zmqPublisher is a ZMQ publisher speaking just enough ZMTP 3.0 to announce
+// blocks the way bitcoind does on its zmqpubhashblock endpoint.
+type zmqPublisher struct {
+	t        *testing.T
+	listener net.Listener
+	subs     chan net.Conn
+	seq      uint32
+}
+
+// newZMQPublisher listens on a local port for subscribers. It is closed when
+// the test ends.
+func newZMQPublisher(t *testing.T) *zmqPublisher {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	p := &zmqPublisher{
+		t:        t,
+		listener: listener,
+		subs:     make(chan net.Conn, 4),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go p.accept()
+	return p
+}
+
+// endpoint returns the endpoint subscribers connect to.
+func (p *zmqPublisher) endpoint() string {
+	return "tcp://" + p.listener.Addr().String()
+}
+
+// accept completes the handshake of each subscriber and hands it out once
+// it subscribed to the block topic.
+func (p *zmqPublisher) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.t.Cleanup(func() { conn.Close() })
+		if err := zmqHandshake(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		p.subs <- conn
+	}
+}
+
+// subscriber waits for the next subscriber.
+func (p *zmqPublisher) subscriber() net.Conn {
+	p.t.Helper()
+
+	select {
+	case conn := <-p.subs:
+		return conn
+	case <-time.After(10 * time.Second):
+		p.t.Fatal("no ZMQ subscriber")
+		return nil
+	}
+}
+
+// publish announces the block hash to conn.
+func (p *zmqPublisher) publish(conn net.Conn, hash chainhash.Hash) {
+	p.t.Helper()
+
+	var seq [4]byte
+	binary.LittleEndian.PutUint32(seq[:], p.seq)
+	p.seq++
+
+	// bitcoind sends the hash in display order
+	var display [chainhash.HashSize]byte
+	for i := range hash {
+		display[i] = hash[chainhash.HashSize-1-i]
+	}
+	parts := [][]byte{[]byte(zmqBlockTopic), display[:], seq[:]}
+	for i, part := range parts {
+		var flag byte
+		if i < len(parts)-1 {
+			flag = 1
+		}
+		if err := writeZMQFrame(conn, flag, part); err != nil {
+			p.t.Fatalf("publish: %v", err)
+		}
+	}
+}
+
+// zmqHandshake exchanges the NULL mechanism greeting and READY commands with
+// a subscriber and reads its subscription.
+func zmqHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return err
+	}
+	greeting = make([]byte, 64)
+	greeting[0], greeting[9], greeting[10] = 0xff, 0x7f, 3
+	copy(greeting[12:], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	if flag, _, err := readZMQFrame(conn); err != nil || flag&4 == 0 {
+		return errors.New("no READY command")
+	}
+	ready := []byte("\x05READY\x0bSocket-Type\x00\x00\x00\x03PUB")
+	if err := writeZMQFrame(conn, 4, ready); err != nil {
+		return err
+	}
+
+	_, sub, err := readZMQFrame(conn)
+	if err != nil {
+		return err
+	}
+	if string(sub) != "\x01"+zmqBlockTopic {
+		return errors.New("no subscription to " + zmqBlockTopic)
+	}
+	return nil
+}
+
+// readZMQFrame reads a short frame.
+func readZMQFrame(conn net.Conn) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&2 != 0 {
+		return 0, nil, errors.New("long frame")
+	}
+	body := make([]byte, header[1])
+	_, err := io.ReadFull(conn, body)
+	return header[0], body, err
+}
+
+// writeZMQFrame writes a short frame.
+func writeZMQFrame(conn net.Conn, flag byte, body []byte) error {
+	_, err := conn.Write(append([]byte{flag, byte(len(body))}, body...))
+	return err
+}
+
+// TestHandlerZMQ checks that a block announced over ZMQ is processed within
+// a second while polling is at its fallback interval, that the subscriber
+// resubscribes after the socket drops and that Stop tears it down.
+func TestHandlerZMQ(t *testing.T) {
+	publisher := newZMQPublisher(t)
+	a, b := testOutpoint(1, 0), testOutpoint(2, 0)
+	ht := newHandlerTest(t, a, b)
+
+	cfg := DefaultConfig()
+	cfg.ZMQBlockEndpoint = publisher.endpoint()
+	h := NewHandlerWithConfig(ht.client, ht.db, cfg)
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	stopped := false
+	t.Cleanup(func() {
+		if !stopped {
+			h.Stop()
+		}
+	})
+	if interval := h.pollInterval(); interval <= 30*time.Second {
+		t.Fatalf("fallback poll interval is %v", interval)
+	}
+
+	// removedWithin announces a block spending outpoint and checks that
+	// it is removed within a second
+	removedWithin := func(conn net.Conn, outpoint message.Outpoint) {
+		t.Helper()
+
+		hash := ht.client.AddBlock(outpoint.WireOutPoint())
+		start := time.Now()
+		publisher.publish(conn, hash)
+		for ht.stored(outpoint) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("%s still stored a second after the "+
+					"notification", outpoint.ToString())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	conn := publisher.subscriber()
+	removedWithin(conn, a)
+
+	// The socket drops, and the subscriber comes back
+	conn.Close()
+	conn = publisher.subscriber()
+	removedWithin(conn, b)
+	if n := h.Stats().BlocksProcessed; n != 2 {
+		t.Fatalf("%d blocks processed, want 2", n)
+	}
+
+	// Stop closes the subscription
+	start := time.Now()
+	h.Stop()
+	stopped = true
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("Stop took %v", waited)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("subscription read %v after Stop, want EOF", err)
+	}
+	select {
+	case <-h.zmq.done:
+	default:
+		t.Fatal("subscriber still running after Stop")
+	}
+}
+
+// TestHandlerZMQUnavailable checks that a handler whose ZMQ endpoint can't
+// be reached still starts, processes blocks and stops.
+func TestHandlerZMQUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	endpoint := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	client := mock.NewClient()
+	cfg := DefaultConfig()
+	cfg.ZMQBlockEndpoint = endpoint
+	h := NewHandlerWithConfig(client, database.NewMemoryDB(), cfg)
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	client.AddBlock()
+	waitProcessed(t, h, client.Height())
+
+	start := time.Now()
+	h.Stop()
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("Stop took %v while resubscribing", waited)
+	}
+}
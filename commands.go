@@ -0,0 +1,1014 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/shaibearary/utxo_chat/api"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+const (
+	// clientTimeout bounds every request a client command makes to a node.
+	clientTimeout = 30 * time.Second
+
+	// frameHeaderSize is the size of a legacy wire frame header: a 1-byte
+	// type followed by a 4-byte little-endian payload length.
+	frameHeaderSize = 5
+)
+
+// command is a subcommand of the utxochat binary.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands lists the subcommands in the order they are shown in the usage.
+var commands = []command{
+	{"start", "Run the node (the default without a command)", utxoChatMain},
+	{"send", "Sign a message and submit it to a running node", sendCommand},
+	{"psbt", "Write a message as a PSBT for an external wallet to sign", psbtCommand},
+	{"submit-psbt", "Submit a message signed as a PSBT to a running node", submitPSBTCommand},
+	{"validate", "Check whether a running node would accept a message", validateCommand},
+	{"get", "Print a message stored by a running node", getCommand},
+	{"read", "Show the messages of a running node as text", readCommand},
+	{"peers", "List the peers connected to a running node", peersCommand},
+	{"rejects", "List the messages a running node rejected recently", rejectsCommand},
+	{"export", "Write the messages of a running node to an archive", exportCommand},
+	{"import", "Submit the messages of an archive to a running node", importCommand},
+	{"revalidate", "Verify every message stored by a running node again", revalidateCommand},
+	{"db", "Show statistics of or compact the database of a stopped node", dbCommand},
+}
+
+// contentTypes maps the -contenttype flag values to content types.
+var contentTypes = map[string]message.ContentType{
+	"text":   message.ContentTypeText,
+	"json":   message.ContentTypeJSON,
+	"binary": message.ContentTypeBinary,
+}
+
+// runCommand runs the subcommand named by the first argument with the rest
+// of the arguments. Without a command, or when the first argument is a flag,
+// the node is started.
+func runCommand(args []string) error {
+	name := "start"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(os.Stdout)
+		return nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	usage(os.Stderr)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// usage writes the list of commands to w.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: utxochat <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	width := 0
+	for _, cmd := range commands {
+		width = max(width, len(cmd.name))
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command accepts -config and -datadir. Run "+
+		"'utxochat <command> -h' for the flags of a command.")
+}
+
+// clientFlags are the flags shared by the commands talking to a running node.
+type clientFlags struct {
+	common   *commonFlags
+	apiAddr  string
+	apiToken string
+}
+
+// addClientFlags registers the flags of commands talking to a running node.
+func addClientFlags(fs *flag.FlagSet) *clientFlags {
+	client := &clientFlags{common: addCommonFlags(fs)}
+	fs.StringVar(&client.apiAddr, "api", "",
+		"Address of the node's HTTP API (default API.ListenAddr from the config)")
+	fs.StringVar(&client.apiToken, "apitoken", "",
+		"Token of the node's HTTP API (default API.Token from the config, "+
+			"or the api.token file in the data directory)")
+	return client
+}
+
+// apiURL returns the URL of the API path on the node selected by the flags.
+// The node's config only supplies the API address and token when -api and
+// -apitoken are not given.
+func (c *clientFlags) apiURL(fs *flag.FlagSet, path string) (string, error) {
+	addr := c.apiAddr
+	if addr == "" || c.apiToken == "" {
+		// Keep the config loader quiet, its output is meant for the node
+		setLogLevels("warn")
+		cfg, err := resolveConfig(fs, c.common)
+		if err != nil {
+			return "", err
+		}
+		if addr == "" {
+			addr = cfg.API.ListenAddr
+		}
+		if c.apiToken == "" {
+			c.apiToken = cfg.API.Token
+		}
+		if c.apiToken == "" {
+			c.apiToken, err = api.ReadToken(cfg.DataDir)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path, nil
+}
+
+// messageFlags are the flags describing the message a command signs.
+type messageFlags struct {
+	txid        string
+	vout        uint
+	payload     string
+	contentType string
+	sequence    uint
+}
+
+// addMessageFlags registers the flags describing the message to sign.
+func addMessageFlags(fs *flag.FlagSet) *messageFlags {
+	flags := &messageFlags{}
+	fs.StringVar(&flags.txid, "txid", "", "Transaction ID of the outpoint")
+	fs.UintVar(&flags.vout, "vout", 0, "Output index of the outpoint")
+	fs.StringVar(&flags.payload, "message", "", "Message to send")
+	fs.StringVar(&flags.contentType, "contenttype", "text", "Payload content type (text, json or binary)")
+	fs.UintVar(&flags.sequence, "sequence", 0, "Sequence number, greater than that of the message to replace")
+	return flags
+}
+
+// outpoint returns the outpoint and the content type given by the flags.
+func (f *messageFlags) outpoint() (message.Outpoint, message.ContentType,
+	error) {
+
+	if f.txid == "" {
+		return message.Outpoint{}, 0, fmt.Errorf("-txid is required")
+	}
+	contentType, ok := contentTypes[f.contentType]
+	if !ok {
+		return message.Outpoint{}, 0, fmt.Errorf("unknown content type %q",
+			f.contentType)
+	}
+	outpoint, err := message.ParseOutpoint(fmt.Sprintf("%s:%d", f.txid, f.vout))
+	if err != nil {
+		return message.Outpoint{}, 0, err
+	}
+	return outpoint, contentType, nil
+}
+
+// unsignedMessage returns the message described by the flags, with an empty
+// signature.
+func (f *messageFlags) unsignedMessage() (*message.Message, error) {
+	outpoint, contentType, err := f.outpoint()
+	if err != nil {
+		return nil, err
+	}
+	if f.sequence > math.MaxUint32 {
+		return nil, fmt.Errorf("sequence %d out of range", f.sequence)
+	}
+	err = signer.CheckPayloadSize(len(f.payload), message.DefaultLimits())
+	if err != nil {
+		return nil, err
+	}
+
+	var sig [message.SignatureSize]byte
+	msg, err := message.NewMessage(outpoint, sig, contentType,
+		[]byte(f.payload))
+	if err != nil {
+		return nil, err
+	}
+	msg.Sequence = uint32(f.sequence)
+	if err := msg.ValidateContent(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// sendCommand signs a message with a private key controlling its outpoint
+// and submits it to a node, over the HTTP API by default or over the peer
+// port with -peer. The payload is checked against the node's limits before
+// it is signed. With -chunk a payload over them is split instead across the
+// outpoint and those of -outpoints, see signer.SignChunks.
+func sendCommand(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	msgFlags := addMessageFlags(fs)
+	wif := fs.String("wif", "", "WIF private key of the output, visible to other local users")
+	descriptor := fs.String("descriptor", "", "Taproot descriptor with the private key of the output, visible to other local users")
+	keyFile := fs.String("descriptor-file", "", "File holding the private key of the output as a taproot descriptor or WIF")
+	keyIndex := fs.Uint("index", 0, "Child index derived from a range descriptor ending in /*")
+	addressType := fs.String("address-type", "p2tr", "Type of the output (p2tr or p2wpkh)")
+	peerAddr := fs.String("peer", "", "Send over the peer port at this address instead of the API")
+	chunk := fs.Bool("chunk", false, "Split a payload too large for one message into chunks, one per outpoint")
+	chunkOutpoints := fs.String("outpoints", "", "Comma separated txid:vout of further outputs of the same key for -chunk")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	limits, err := nodeLimits(fs, client, *peerAddr)
+	if err != nil {
+		return err
+	}
+	// A payload within the limits is sent as is even with -chunk
+	chunked := *chunk &&
+		signer.CheckPayloadSize(len(msgFlags.payload), limits) != nil
+	var (
+		unsigned  *message.Message
+		outpoints []message.Outpoint
+	)
+	if chunked {
+		outpoints, err = msgFlags.chunkOutpoints(*chunkOutpoints)
+	} else {
+		unsigned, err = msgFlags.unsignedMessage()
+		if err == nil {
+			err = signer.CheckPayloadSize(len(unsigned.Payload), limits)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	addrType, err := signer.ParseAddressType(*addressType)
+	if err != nil {
+		return err
+	}
+	if *keyIndex > math.MaxUint32 {
+		return fmt.Errorf("index %d out of range", *keyIndex)
+	}
+	privKey, err := readPrivateKey(*wif, *descriptor, *keyFile,
+		uint32(*keyIndex), addrType)
+	if err != nil {
+		return err
+	}
+
+	if chunked {
+		contentType := contentTypes[msgFlags.contentType]
+		msgs, err := signer.SignChunks(privKey, addrType, outpoints,
+			contentType, []byte(msgFlags.payload), limits)
+		if err != nil {
+			return fmt.Errorf("failed to sign chunks: %v", err)
+		}
+		for _, msg := range msgs {
+			if err := submitMessage(fs, client, *peerAddr, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	msg, err := signer.SignReplacementFor(privKey, addrType,
+		unsigned.Outpoint, unsigned.Sequence, unsigned.ContentType,
+		unsigned.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %v", err)
+	}
+	return submitMessage(fs, client, *peerAddr, msg)
+}
+
+// chunkOutpoints returns the outpoints chunks are signed for with -chunk:
+// the outpoint of the flags followed by those listed in outpoints, comma
+// separated.
+func (f *messageFlags) chunkOutpoints(outpoints string) ([]message.Outpoint,
+	error) {
+
+	if f.sequence != 0 {
+		return nil, errors.New("-sequence can't be used with -chunk")
+	}
+	first, _, err := f.outpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []message.Outpoint{first}
+	for _, field := range strings.Split(outpoints, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		outpoint, err := message.ParseOutpoint(field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, outpoint)
+	}
+	return result, nil
+}
+
+// nodeLimits returns the size limits of the messages the node accepts, as
+// reported by its API. Over the peer port, or if the node doesn't report
+// them, the protocol limits are returned and the node rejects messages over
+// its own once they are sent.
+func nodeLimits(fs *flag.FlagSet, client *clientFlags,
+	peerAddr string) (message.Limits, error) {
+
+	if peerAddr != "" {
+		return message.DefaultLimits(), nil
+	}
+	url, err := client.apiURL(fs, "/v1/limits")
+	if err != nil {
+		return message.Limits{}, err
+	}
+	body, err := client.apiRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return message.DefaultLimits(), nil
+	}
+
+	var resp struct {
+		MaxPayloadSize int `json:"max_payload_size"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return message.Limits{}, fmt.Errorf("invalid limits response: %v",
+			err)
+	}
+	limits := message.Limits{MaxPayloadSize: resp.MaxPayloadSize}
+	if err := limits.Validate(); err != nil {
+		return message.Limits{}, fmt.Errorf("invalid node limits: %v", err)
+	}
+	return limits, nil
+}
+
+// submitMessage submits a signed message to a node, over the HTTP API or,
+// if peerAddr is set, over the peer port at peerAddr.
+func submitMessage(fs *flag.FlagSet, client *clientFlags, peerAddr string,
+	msg *message.Message) error {
+
+	msgData := msg.Serialize()
+	if peerAddr != "" {
+		if err := sendToPeer(peerAddr, msgData); err != nil {
+			return err
+		}
+		fmt.Printf("Message for %s accepted\n", msg.Outpoint.ToString())
+		return nil
+	}
+
+	url, err := client.apiURL(fs, "/v1/messages")
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodPost, url, msgData)
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
+
+// psbtCommand writes the BIP322 to_sign transaction of a message as a base64
+// encoded PSBT, for keys held by a hardware wallet or a Bitcoin Core wallet
+// that can't be handed to send. Once the wallet signed it, submit-psbt turns
+// it into the message.
+func psbtCommand(args []string) error {
+	fs := flag.NewFlagSet("psbt", flag.ContinueOnError)
+	addCommonFlags(fs)
+	msgFlags := addMessageFlags(fs)
+	pkScriptHex := fs.String("pkscript", "", "Hex encoded script of the output, the scriptPubKey printed by bitcoin-cli gettxout")
+	out := fs.String("out", "", "File to write the PSBT to (default standard output)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	msg, err := msgFlags.unsignedMessage()
+	if err != nil {
+		return err
+	}
+	if *pkScriptHex == "" {
+		return fmt.Errorf("-pkscript is required")
+	}
+	pkScript, err := hex.DecodeString(*pkScriptHex)
+	if err != nil {
+		return fmt.Errorf("invalid -pkscript: %v", err)
+	}
+
+	packet, err := signer.BuildBIP322PSBT(msg, pkScript)
+	if err != nil {
+		return err
+	}
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode PSBT: %v", err)
+	}
+
+	if *out == "" {
+		fmt.Println(encoded)
+		return nil
+	}
+	return os.WriteFile(*out, []byte(encoded+"\n"), 0644)
+}
+
+// submitPSBTCommand submits a message signed externally as a PSBT written by
+// the psbt command. The message flags must repeat those given to psbt.
+func submitPSBTCommand(args []string) error {
+	fs := flag.NewFlagSet("submit-psbt", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	msgFlags := addMessageFlags(fs)
+	in := fs.String("in", "", "File holding the signed PSBT, base64 encoded or binary (default standard input)")
+	peerAddr := fs.String("peer", "", "Send over the peer port at this address instead of the API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	unsigned, err := msgFlags.unsignedMessage()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if *in == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read PSBT: %v", err)
+	}
+	raw := bytes.HasPrefix(data, []byte("psbt\xff"))
+	if !raw {
+		data = bytes.TrimSpace(data)
+	}
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(data), !raw)
+	if err != nil {
+		return fmt.Errorf("invalid PSBT: %v", err)
+	}
+
+	msg, err := signer.ExtractMessageFromPSBT(packet, unsigned)
+	if err != nil {
+		return err
+	}
+	return submitMessage(fs, client, *peerAddr, msg)
+}
+
+// validateCommand asks a node whether it would accept a hex encoded message,
+// given as the argument or on standard input, without storing or relaying
+// it. The result is printed and a rejected message fails the command.
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var encoded []byte
+	switch fs.NArg() {
+	case 0:
+		var err error
+		encoded, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read message: %v", err)
+		}
+	case 1:
+		encoded = []byte(fs.Arg(0))
+	default:
+		return fmt.Errorf("expected a single hex encoded message")
+	}
+	msgData, err := hex.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return fmt.Errorf("invalid hex message: %v", err)
+	}
+
+	url, err := client.apiURL(fs, "/v1/messages/validate")
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodPost, url, msgData)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(body); err != nil {
+		return err
+	}
+
+	var result struct {
+		OK     bool   `json:"ok"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("message would be rejected: %s", result.Reason)
+	}
+	return nil
+}
+
+// readPrivateKey returns the private key of an output of type addrType, given
+// as WIF or as a taproot descriptor by exactly one of the -wif, -descriptor
+// and -descriptor-file flags or the UTXOCHAT_DESCRIPTOR environment variable.
+// Without any of them it is prompted for on the terminal. index is the child
+// derived from a range descriptor.
+func readPrivateKey(wif, descriptor, keyFile string, index uint32,
+	addrType signer.AddressType) (*btcec.PrivateKey, error) {
+
+	if wif != "" && descriptor != "" {
+		return nil, fmt.Errorf("-wif and -descriptor are mutually exclusive")
+	}
+	source := signer.KeySource{
+		Key:      wif + descriptor,
+		File:     keyFile,
+		Prompter: signer.TerminalPrompter{},
+	}
+	key, err := source.ReadKey()
+	if errors.Is(err, signer.ErrNoKey) {
+		return nil, fmt.Errorf("%v: use -descriptor-file or set %s",
+			err, signer.KeyEnv)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addrType != signer.AddressTaproot && signer.IsDescriptor(key) {
+		return nil, fmt.Errorf("descriptors only hold taproot keys, use " +
+			"WIF for other address types")
+	}
+	return signer.ParsePrivateKey(key, index)
+}
+
+// getCommand prints a message stored by a node.
+func getCommand(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	txid := fs.String("txid", "", "Transaction ID of the outpoint")
+	vout := fs.Uint("vout", 0, "Output index of the outpoint")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	outpoint, err := message.ParseOutpoint(fmt.Sprintf("%s:%d", *txid, *vout))
+	if err != nil {
+		return err
+	}
+	hash, index := outpoint.ToTxidIdx()
+
+	url, err := client.apiURL(fs, fmt.Sprintf("/v1/messages/%s/%d", hash, index))
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
+
+// peersCommand lists the peers connected to a node, or with -known every
+// peer address it knows of.
+func peersCommand(args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	known := fs.Bool("known", false, "List every known peer address, including those from earlier runs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *known {
+		return knownPeersCommand(fs, client)
+	}
+
+	url, err := client.apiURL(fs, "/v1/peers")
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Peers []struct {
+			Addr          string    `json:"addr"`
+			Direction     string    `json:"direction"`
+			Trusted       bool      `json:"trusted"`
+			UserAgent     string    `json:"user_agent"`
+			ConnectedAt   time.Time `json:"connected_at"`
+			BytesReceived uint64    `json:"bytes_received"`
+			BytesSent     uint64    `json:"bytes_sent"`
+			LastRecv      time.Time `json:"last_recv"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	if len(resp.Peers) == 0 {
+		fmt.Println("No connected peers")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tDIRECTION\tUSER AGENT\tCONNECTED\tLAST RECV\tRECEIVED\tSENT")
+	for _, peer := range resp.Peers {
+		if peer.Trusted {
+			peer.Direction += " (trusted)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", peer.Addr,
+			peer.Direction, orDash(peer.UserAgent),
+			time.Since(peer.ConnectedAt).Round(time.Second),
+			sinceOrDash(peer.LastRecv), peer.BytesReceived, peer.BytesSent)
+	}
+	return w.Flush()
+}
+
+// knownPeersCommand lists the peer addresses a node knows of.
+func knownPeersCommand(fs *flag.FlagSet, client *clientFlags) error {
+	url, err := client.apiURL(fs, "/v1/peers/known")
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Peers []struct {
+			Addr        string    `json:"addr"`
+			UserAgent   string    `json:"user_agent"`
+			Connected   bool      `json:"connected"`
+			LastSeen    time.Time `json:"last_seen"`
+			LastSuccess time.Time `json:"last_success"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	if len(resp.Peers) == 0 {
+		fmt.Println("No known peers")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tUSER AGENT\tCONNECTED\tLAST SEEN\tLAST CONNECTED")
+	for _, peer := range resp.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\n", peer.Addr,
+			orDash(peer.UserAgent), peer.Connected,
+			sinceOrDash(peer.LastSeen), sinceOrDash(peer.LastSuccess))
+	}
+	return w.Flush()
+}
+
+// rejectsCommand lists the messages a node rejected recently, newest first,
+// optionally only those rejected for a reason or sent by a peer.
+func rejectsCommand(args []string) error {
+	fs := flag.NewFlagSet("rejects", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	reason := fs.String("reason", "", "Only list messages rejected for this reason, such as invalid-signature")
+	peer := fs.String("peer", "", "Only list messages sent by the peer with this address, or local")
+	limit := fs.Int("limit", 50, "Maximum number of messages to list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *reason != "" {
+		query.Set("reason", *reason)
+	}
+	if *peer != "" {
+		query.Set("peer", *peer)
+	}
+	query.Set("limit", strconv.Itoa(*limit))
+	endpoint, err := client.apiURL(fs, "/v1/rejects?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	body, err := client.apiRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Rejects []struct {
+			Time        time.Time `json:"time"`
+			Source      string    `json:"source"`
+			Outpoint    string    `json:"outpoint"`
+			Reason      string    `json:"reason"`
+			Error       string    `json:"error"`
+			PayloadSize int       `json:"payload_size"`
+		} `json:"rejects"`
+		Dropped uint64 `json:"dropped"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	if len(resp.Rejects) == 0 {
+		fmt.Println("No rejected messages")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tSOURCE\tOUTPOINT\tREASON\tSIZE\tERROR")
+		for _, reject := range resp.Rejects {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+				sinceOrDash(reject.Time), reject.Source,
+				orDash(reject.Outpoint), reject.Reason,
+				reject.PayloadSize, reject.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if resp.Dropped > 0 {
+		fmt.Printf("%d rejections were dropped from the journal\n",
+			resp.Dropped)
+	}
+	return nil
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// sinceOrDash returns how long ago t was, or "-" if it is the zero time.
+func sinceOrDash(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+// exportCommand writes every message stored by a node to an archive file.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	out := fs.String("out", "", "Archive file to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	url, err := client.apiURL(fs, "/v1/export")
+	if err != nil {
+		return err
+	}
+	resp, err := client.apiResponse(http.MethodGet, url, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	fmt.Printf("Wrote %d bytes to %s\n", written, *out)
+	return nil
+}
+
+// importCommand submits the messages of an archive file to a node, which
+// validates each of them.
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	in := fs.String("in", "", "Archive file to read")
+	trust := fs.Bool("trust", false, "Store messages whose UTXO was spent without validating them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	url, err := client.apiURL(fs, "/v1/import")
+	if err != nil {
+		return err
+	}
+	if *trust {
+		url += "?trust=true"
+	}
+	resp, err := client.apiResponse(http.MethodPost, url, file, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	return printJSON(body)
+}
+
+// revalidateCommand makes a node verify its stored messages again, ignoring
+// the validation recorded with them, and remove the ones that fail. It fails
+// if any did, which points at a corrupt database.
+func revalidateCommand(args []string) error {
+	fs := flag.NewFlagSet("revalidate", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	url, err := client.apiURL(fs, "/v1/revalidate")
+	if err != nil {
+		return err
+	}
+	resp, err := client.apiResponse(http.MethodPost, url, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if err := printJSON(body); err != nil {
+		return err
+	}
+
+	var result struct {
+		Invalid []json.RawMessage `json:"invalid"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if len(result.Invalid) > 0 {
+		return fmt.Errorf("%d stored messages failed to verify and were "+
+			"removed", len(result.Invalid))
+	}
+	return nil
+}
+
+// apiRequest sends a request to the node's HTTP API and returns the response
+// body. Error statuses are returned as errors carrying the API's message.
+func (c *clientFlags) apiRequest(method, url string, body []byte) ([]byte,
+	error) {
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	resp, err := c.apiResponse(method, url, reqBody, clientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return respBody, nil
+}
+
+// apiResponse sends a request to the node's HTTP API and returns the response
+// for the caller to read and close. A non-nil body is sent as raw bytes.
+// Error statuses are returned as errors carrying the API's message. A zero
+// timeout lets long transfers such as archives run to completion.
+func (c *clientFlags) apiResponse(method, url string, body io.Reader,
+	timeout time.Duration) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach node: %v", err)
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%s: wrong or missing API token, see "+
+			"-apitoken", resp.Status)
+	}
+
+	respBody, _ := io.ReadAll(resp.Body)
+	var errResp struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(respBody, &errResp) == nil && errResp.Error != "" {
+		return nil, fmt.Errorf("%s: %s", resp.Status, errResp.Error)
+	}
+	return nil, fmt.Errorf("%s", resp.Status)
+}
+
+// printJSON writes a JSON document to standard output, indented.
+func printJSON(data []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+// sendToPeer delivers a serialized message over the peer port at addr and
+// waits for the node's ack or reject. Without a version handshake the node
+// treats the connection as a legacy peer, so plain frames are used.
+func sendToPeer(addr string, msgData []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, clientTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clientTimeout))
+
+	frame := make([]byte, frameHeaderSize+len(msgData))
+	frame[0] = byte(network.MessageTypeData)
+	binary.LittleEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(msgData)))
+	copy(frame[frameHeaderSize:], msgData)
+	if _, err := conn.Write(frame); err != nil {
+		return fmt.Errorf("failed to send message: %v", err)
+	}
+
+	// Skip announcements the node relays before answering
+	for {
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return fmt.Errorf("error reading response: %v", err)
+		}
+		length := binary.LittleEndian.Uint32(header[1:])
+		if length > network.DefaultMaxFrameSize {
+			return fmt.Errorf("response too large: %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return fmt.Errorf("error reading response: %v", err)
+		}
+
+		switch network.MessageType(header[0]) {
+		case network.MessageTypeAck:
+			return nil
+
+		case network.MessageTypeReject:
+			if len(payload) < message.OutpointSize+1 {
+				return fmt.Errorf("invalid reject length: %d", len(payload))
+			}
+			code := network.RejectCode(payload[message.OutpointSize])
+			return fmt.Errorf("message rejected (%s): %s", code,
+				payload[message.OutpointSize+1:])
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/api"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/network"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// captureStdout runs fn and returns what it wrote to standard output.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+	err = fn()
+	w.Close()
+	return string(<-output), err
+}
+
+// startTestAPI serves the API of a node backed by a mock Bitcoin node and
+// returns its address and the mock node. The server is closed when the test
+// ends.
+func startTestAPI(t *testing.T, token string) (string, *mock.Client) {
+	t.Helper()
+
+	client := mock.NewClient()
+	db := database.NewMemoryDB()
+	manager, err := network.NewManager(network.NewDefaultConfig(),
+		database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	s := api.NewServerWithConfig(manager, nil, db, api.Config{Token: token})
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), client
+}
+
+// TestSendGet checks that a message sent with send is stored by the node and
+// printed back by get, which finds the node through the config file and the
+// token file of the data directory.
+func TestSendGet(t *testing.T) {
+	const token = "secret"
+	addr, client := startTestAPI(t, token)
+
+	// Reading the config quiets the log
+	t.Cleanup(func() { setLogLevels("info") })
+
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{9}, 32))
+	wif, err := btcutil.NewWIF(key, &chaincfg.MainNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 3)
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	txid, vout := outpoint.ToTxidIdx()
+
+	_, err = captureStdout(t, func() error {
+		return runCommand([]string{"send", "-api", addr, "-apitoken", token,
+			"-wif", wif.String(), "-txid", txid.String(), "-vout",
+			fmt.Sprint(vout), "-message", "hello from send"})
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	dataDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dataDir, api.TokenFileName),
+		[]byte(token+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := writeTestConfig(t, "config.json",
+		fmt.Sprintf(`{"API": {"ListenAddr": %q}}`, addr))
+	output, err := captureStdout(t, func() error {
+		return runCommand([]string{"get", "-config", configPath,
+			"-datadir", dataDir, "-txid", txid.String(), "-vout",
+			fmt.Sprint(vout)})
+	})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	var resp struct {
+		Outpoint string `json:"outpoint"`
+		Payload  string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(output), &resp); err != nil {
+		t.Fatalf("get printed %q: %v", output, err)
+	}
+	if resp.Outpoint != outpoint.ToString() ||
+		resp.Payload != "hello from send" {
+
+		t.Fatalf("get printed %+v", resp)
+	}
+}
+
+// TestSendAddressType checks that send signs for the P2WPKH output of a key
+// with -address-type p2wpkh, that a message signed for its taproot output
+// is refused for it, and that other address types are refused.
+func TestSendAddressType(t *testing.T) {
+	const token = "secret"
+	addr, client := startTestAPI(t, token)
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF(key, &chaincfg.MainNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := signer.WitnessPubKeyHashScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := message.NewOutpoint(chainhash.Hash{2}, 0)
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	txid, vout := outpoint.ToTxidIdx()
+
+	send := func(addrType string) error {
+		_, err := captureStdout(t, func() error {
+			return runCommand([]string{"send", "-api", addr, "-apitoken",
+				token, "-wif", wif.String(), "-address-type", addrType,
+				"-txid", txid.String(), "-vout", fmt.Sprint(vout),
+				"-message", "hello from p2wpkh"})
+		})
+		return err
+	}
+	if err := send("p2tr"); err == nil {
+		t.Fatal("taproot signature accepted for a P2WPKH output")
+	}
+	if err := send("p2pkh"); !errors.Is(err, signer.ErrUnknownAddressType) {
+		t.Fatalf("p2pkh gave %v, want ErrUnknownAddressType", err)
+	}
+	if err := send("p2wpkh"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	output, err := captureStdout(t, func() error {
+		return runCommand([]string{"get", "-api", addr, "-apitoken", token,
+			"-txid", txid.String(), "-vout", fmt.Sprint(vout)})
+	})
+	if err != nil || !strings.Contains(output, "hello from p2wpkh") {
+		t.Fatalf("get printed %q, %v", output, err)
+	}
+}
+
+// TestMessageFlags checks the outpoint, content type and sequence flags of
+// the commands signing a message.
+func TestMessageFlags(t *testing.T) {
+	txid := chainhash.Hash{1}.String()
+	tests := []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"outpoint", []string{"-txid", txid, "-vout", "7"}, true},
+		{"json", []string{"-txid", txid, "-contenttype", "json",
+			"-message", `{"a": 1}`}, true},
+		{"sequence", []string{"-txid", txid, "-sequence", "4294967295"},
+			true},
+		{"no txid", []string{"-vout", "7"}, false},
+		{"bad txid", []string{"-txid", "nothex"}, false},
+		{"content type", []string{"-txid", txid, "-contenttype", "html"},
+			false},
+		{"bad json", []string{"-txid", txid, "-contenttype", "json",
+			"-message", "hello"}, false},
+		{"sequence range", []string{"-txid", txid, "-sequence",
+			"4294967296"}, false},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := addMessageFlags(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("%s: Parse: %v", test.name, err)
+		}
+		msg, err := flags.unsignedMessage()
+		if test.ok != (err == nil) {
+			t.Fatalf("%s: got %v", test.name, err)
+		}
+		if test.name == "outpoint" && msg.Outpoint.Vout() != 7 {
+			t.Fatalf("outpoint parsed as %s", msg.Outpoint.ToString())
+		}
+	}
+}
+
+// TestRunCommandUnknown checks that an unknown command is refused with the
+// usage, while help and -h succeed.
+func TestRunCommandUnknown(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = devNull
+	t.Cleanup(func() {
+		os.Stderr = stderr
+		devNull.Close()
+	})
+
+	if err = runCommand([]string{"sned"}); err == nil ||
+		!strings.Contains(err.Error(), "unknown command") {
+
+		t.Fatalf("unknown command gave %v", err)
+	}
+
+	output, err := captureStdout(t, func() error {
+		return runCommand([]string{"help"})
+	})
+	if err != nil {
+		t.Fatalf("help: %v", err)
+	}
+	for _, cmd := range commands {
+		if !strings.Contains(output, cmd.name) {
+			t.Fatalf("usage lacks %s:\n%s", cmd.name, output)
+		}
+	}
+	if err := runCommand([]string{"get", "-h"}); err != nil {
+		t.Fatalf("get -h: %v", err)
+	}
+}
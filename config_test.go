@@ -0,0 +1,243 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btclog"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+// resolveTestConfig resolves the configuration of the JSON config file data.
+func resolveTestConfig(t *testing.T, data string) (*config, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	common := addCommonFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-datadir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	return resolveConfig(fs, common)
+}
+
+// TestResolveConfigDatabaseType checks that the memory database is selected
+// by default and that types without a backend are refused.
+func TestResolveConfigDatabaseType(t *testing.T) {
+	cfg, err := resolveTestConfig(t, `{"Database": {}}`)
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+	if cfg.Database.Type != "memory" {
+		t.Fatalf("got database type %q, want memory", cfg.Database.Type)
+	}
+
+	_, err = resolveTestConfig(t, `{"Database": {"Type": "leveldb"}}`)
+	if err == nil || !strings.Contains(err.Error(), `"leveldb"`) {
+		t.Fatalf("leveldb got %v, want an unknown type error", err)
+	}
+}
+
+// writeTestConfig writes a config file named name with data to a temporary
+// directory and returns its path.
+func writeTestConfig(t *testing.T, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfigPrecedence checks that each option is taken from the last of
+// the defaults, the config file, the environment and the command line that
+// sets it.
+func TestConfigPrecedence(t *testing.T) {
+	t.Cleanup(func() { parseAndSetDebugLevels("info") })
+
+	path := writeTestConfig(t, "config.toml", `
+data_dir = "/from/file"
+
+[bitcoin]
+rpc_user = "file-user"
+rpc_pass = "file-pass"
+rpc_url = "file-host:8332"
+
+[debug]
+log_level = "warn"
+profile = "6061"
+`)
+	t.Setenv(envRPCUser, "env-user")
+
+	// Restored when the test ends
+	t.Setenv(envRPCPass, "")
+	os.Unsetenv(envRPCPass)
+
+	cfg, err := loadConfig([]string{"-config", path, "-datadir", "/from/flag",
+		"-debug"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	defaults := defaultConfig("")
+	tests := []struct {
+		option, got, want string
+	}{
+		{"chain", cfg.Bitcoin.Chain, defaults.Bitcoin.Chain},
+		{"rpc_url", cfg.Bitcoin.RPCURL, "file-host:8332"},
+		{"rpc_pass", cfg.Bitcoin.RPCPass, "file-pass"},
+		{"profile", cfg.Debug.Profile, "6061"},
+		{"rpc_user", cfg.Bitcoin.RPCUser, "env-user"},
+		{"data_dir", cfg.DataDir, "/from/flag"},
+		{"log_level", cfg.Debug.LogLevel, "debug"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s is %q, want %q", test.option, test.got,
+				test.want)
+		}
+	}
+
+	// Without their flags, the file's options are kept
+	cfg, err = loadConfig([]string{"-config", path, "-profile", "7070"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.DataDir != "/from/file" || cfg.Debug.LogLevel != "warn" ||
+		cfg.Debug.Profile != "7070" {
+
+		t.Fatalf("got data dir %q, log level %q and profile %q",
+			cfg.DataDir, cfg.Debug.LogLevel, cfg.Debug.Profile)
+	}
+}
+
+// TestConfigFileFormats checks that the example configs parse as JSON and
+// TOML alike, and that a TOML file with an unknown option is refused.
+func TestConfigFileFormats(t *testing.T) {
+	var fromJSON, fromTOML config
+	if err := loadConfigFile("config-example.json", &fromJSON); err != nil {
+		t.Fatalf("config-example.json: %v", err)
+	}
+	if err := loadConfigFile("config-example.toml", &fromTOML); err != nil {
+		t.Fatalf("config-example.toml: %v", err)
+	}
+	if fromJSON.Network.ListenAddr != fromTOML.Network.ListenAddr ||
+		fromJSON.Bitcoin.RPCURL != fromTOML.Bitcoin.RPCURL {
+
+		t.Fatalf("JSON and TOML examples differ: %q %q, %q %q",
+			fromJSON.Network.ListenAddr, fromJSON.Bitcoin.RPCURL,
+			fromTOML.Network.ListenAddr, fromTOML.Bitcoin.RPCURL)
+	}
+
+	path := writeTestConfig(t, "config.toml", "[bitcoin]\nrpcuser = \"x\"\n")
+	var cfg config
+	err := loadConfigFile(path, &cfg)
+	if err == nil || !strings.Contains(err.Error(), "rpcuser") {
+		t.Fatalf("unknown option got %v", err)
+	}
+}
+
+// TestDumpConfig checks that the dumped configuration holds the resolved
+// options with the secrets redacted.
+func TestDumpConfig(t *testing.T) {
+	t.Setenv(envRPCPass, "hunter2")
+	t.Setenv(envAPIToken, "token")
+	path := writeTestConfig(t, "config.json",
+		`{"Bitcoin": {"RPCUser": "alice"}}`)
+	cfg, err := loadConfig([]string{"-config", path, "-dump-config"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.dumpConfig {
+		t.Fatal("-dump-config not set")
+	}
+
+	var out strings.Builder
+	if err := writeConfig(&out, cfg); err != nil {
+		t.Fatalf("writeConfig: %v", err)
+	}
+	dump := out.String()
+	if strings.Contains(dump, "hunter2") || strings.Contains(dump, `"token"`) {
+		t.Fatalf("secrets in the dump:\n%s", dump)
+	}
+	var dumped config
+	if err := json.Unmarshal([]byte(dump), &dumped); err != nil {
+		t.Fatalf("dump isn't JSON: %v", err)
+	}
+	if dumped.Bitcoin.RPCUser != "alice" ||
+		dumped.Bitcoin.RPCPass != "********" ||
+		dumped.API.Token != "********" || cfg.Bitcoin.RPCPass != "hunter2" {
+
+		t.Fatalf("dumped user %q, password %q, token %q",
+			dumped.Bitcoin.RPCUser, dumped.Bitcoin.RPCPass,
+			dumped.API.Token)
+	}
+}
+
+// TestReloadConfig checks that reloading the configuration file of a running
+// node applies a changed log level to every subsystem.
+func TestReloadConfig(t *testing.T) {
+	t.Cleanup(func() { setLogLevels("info") })
+	running := cfg
+	t.Cleanup(func() { cfg = running })
+
+	const base = `
+data_dir = %q
+
+[network]
+listen_addr = "127.0.0.1:0"
+
+[debug]
+log_level = %q
+`
+	dataDir := t.TempDir()
+	path := writeTestConfig(t, "config.toml",
+		fmt.Sprintf(base, dataDir, "info"))
+	args := []string{"-config", path}
+	var err error
+	cfg, err = loadConfig(args)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	client := mock.NewClient()
+	db := database.NewMemoryDB()
+	m, err := network.NewManager(newNetworkConfig(cfg),
+		database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	h := blockchain.NewHandlerWithConfig(client, db,
+		newBlockchainConfig(cfg))
+
+	err = os.WriteFile(path, []byte(fmt.Sprintf(base, dataDir, "debug")),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig(context.Background(), args, m, h)
+	for id, logger := range subsystemLoggers {
+		if logger.Level() != btclog.LevelDebug {
+			t.Fatalf("%s at level %v after reload, want debug", id,
+				logger.Level())
+		}
+	}
+}
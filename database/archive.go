@@ -0,0 +1,193 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// An archive holds serialized messages for moving them between nodes. It
+// starts with archiveMagic and a version byte, followed by one entry per
+// message: a 4-byte little-endian length and the message as produced by
+// message.Serialize. Metadata is not archived.
+const (
+	archiveMagic   = "UTXOCHAT"
+	archiveVersion = 1
+
+	// maxArchiveEntry bounds the length of an archive entry.
+	maxArchiveEntry = message.MaxMessageSize
+)
+
+// SourceImport is the MessageMeta source of messages imported from an
+// archive.
+const SourceImport = "import"
+
+var (
+	// ErrInvalidArchive is returned for data that is not a message archive.
+	ErrInvalidArchive = errors.New("invalid message archive")
+
+	// ErrCorruptEntry is returned by ArchiveReader.Next for an entry that
+	// is not a valid message. Reading can continue with the next entry.
+	ErrCorruptEntry = errors.New("corrupt archive entry")
+)
+
+// Export writes every message stored in db to w as an archive, in insertion
+// order, and returns the number of messages written.
+func Export(ctx context.Context, db Database, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(archiveMagic)
+	bw.WriteByte(archiveVersion)
+
+	var (
+		cursor string
+		count  int
+		length [4]byte
+	)
+	for {
+		entries, next, err := db.ListMessages(ctx, cursor, MaxListLimit)
+		if err != nil {
+			return count, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			binary.LittleEndian.PutUint32(length[:], uint32(len(entry.Data)))
+			bw.Write(length[:])
+			if _, err := bw.Write(entry.Data); err != nil {
+				return count, err
+			}
+			count++
+		}
+		cursor = next
+	}
+
+	return count, bw.Flush()
+}
+
+// ArchiveReader reads the messages of an archive written by Export.
+type ArchiveReader struct {
+	r     *bufio.Reader
+	entry int
+}
+
+// NewArchiveReader checks the archive header and returns a reader for its
+// entries.
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(archiveMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if string(header[:len(archiveMagic)]) != archiveMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidArchive)
+	}
+	if version := header[len(archiveMagic)]; version != archiveVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d",
+			ErrInvalidArchive, version)
+	}
+	return &ArchiveReader{r: br}, nil
+}
+
+// Next returns the next message and its serialized form, or io.EOF once all
+// entries are read. Entries that don't hold a valid message return
+// ErrCorruptEntry, after which reading may continue. Any other error, such as
+// a truncated entry, ends the archive.
+func (a *ArchiveReader) Next() (*message.Message, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(a.r, length[:]); err != nil {
+		if err == io.EOF {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, fmt.Errorf("%w: entry %d: %v", ErrInvalidArchive,
+			a.entry, err)
+	}
+	a.entry++
+
+	size := binary.LittleEndian.Uint32(length[:])
+	if size > maxArchiveEntry {
+		return nil, nil, fmt.Errorf("%w: entry %d is %d bytes",
+			ErrInvalidArchive, a.entry, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(a.r, data); err != nil {
+		return nil, nil, fmt.Errorf("%w: entry %d: %v", ErrInvalidArchive,
+			a.entry, err)
+	}
+
+	msg, err := message.Deserialize(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: entry %d: %v", ErrCorruptEntry,
+			a.entry, err)
+	}
+	return msg, data, nil
+}
+
+// ImportResult counts the outcome of an import.
+type ImportResult struct {
+	Accepted   int
+	Rejected   int
+	Duplicates int
+
+	// Errors describes why entries were rejected, up to maxImportErrors.
+	Errors []string
+}
+
+// maxImportErrors bounds the rejection reasons kept in an ImportResult.
+const maxImportErrors = 100
+
+// Import reads an archive from r and hands every message to add, which
+// validates and stores it. Messages add rejects with
+// message.ErrDuplicateOutpoint are counted as duplicates, other errors and
+// corrupt entries as rejected. An
+// error is returned if the archive itself is unreadable, along with the
+// counts so far.
+func Import(ctx context.Context, r io.Reader,
+	add func(ctx context.Context, msgData []byte) error) (*ImportResult, error) {
+
+	archive, err := NewArchiveReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	reject := func(err error) {
+		result.Rejected++
+		if len(result.Errors) < maxImportErrors {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		msg, data, err := archive.Next()
+		switch {
+		case err == io.EOF:
+			return result, nil
+		case errors.Is(err, ErrCorruptEntry):
+			reject(err)
+			continue
+		case err != nil:
+			return result, err
+		}
+
+		err = add(ctx, data)
+		switch {
+		case err == nil:
+			result.Accepted++
+		case errors.Is(err, message.ErrDuplicateOutpoint):
+			result.Duplicates++
+		default:
+			reject(fmt.Errorf("%s: %v", msg.Outpoint.ToString(), err))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// importInto returns an Import callback storing messages in db without
+// validating them.
+func importInto(db Database) func(context.Context, []byte) error {
+	return func(ctx context.Context, msgData []byte) error {
+		msg, err := message.Deserialize(msgData)
+		if err != nil {
+			return err
+		}
+		seen, err := db.HasOutpoint(ctx, msg.Outpoint)
+		if err != nil {
+			return err
+		}
+		if seen {
+			return message.ErrDuplicateOutpoint
+		}
+		return db.AddMessage(ctx, msg.Outpoint, msgData,
+			MessageMeta{Source: SourceImport})
+	}
+}
+
+// listAll returns every message stored in db, in insertion order.
+func listAll(t *testing.T, db Database) []MessageEntry {
+	t.Helper()
+
+	var (
+		all    []MessageEntry
+		cursor string
+	)
+	for {
+		entries, next, err := db.ListMessages(context.Background(), cursor,
+			MaxListLimit)
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if len(entries) == 0 {
+			return all
+		}
+		all, cursor = append(all, entries...), next
+	}
+}
+
+// TestExportImport checks that a database exported and imported into
+// another ends up with identical contents, and that importing it again
+// only finds duplicates.
+func TestExportImport(t *testing.T) {
+	const count = MaxListLimit + 5
+
+	ctx := context.Background()
+	src := NewMemoryDB()
+	addTestMessages(t, src, 0, count)
+
+	var archive bytes.Buffer
+	n, err := Export(ctx, src, &archive)
+	if err != nil || n != count {
+		t.Fatalf("exported %d messages, %v, want %d", n, err, count)
+	}
+	data := archive.Bytes()
+
+	dst := NewMemoryDB()
+	result, err := Import(ctx, bytes.NewReader(data), importInto(dst))
+	if err != nil || result.Accepted != count || result.Rejected != 0 ||
+		result.Duplicates != 0 {
+
+		t.Fatalf("imported %+v, %v", result, err)
+	}
+	want, got := listAll(t, src), listAll(t, dst)
+	if len(got) != len(want) {
+		t.Fatalf("imported %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Outpoint != want[i].Outpoint ||
+			!bytes.Equal(got[i].Data, want[i].Data) ||
+			got[i].Meta.Source != SourceImport {
+
+			t.Fatalf("message %d is %s from %q, want %s", i,
+				got[i].Outpoint.ToString(), got[i].Meta.Source,
+				want[i].Outpoint.ToString())
+		}
+	}
+
+	result, err = Import(ctx, bytes.NewReader(data), importInto(dst))
+	if err != nil || result.Accepted != 0 || result.Duplicates != count {
+		t.Fatalf("imported again %+v, %v", result, err)
+	}
+}
+
+// TestImportCorrupt checks that corrupt entries are skipped and reported
+// while the others are imported, that a truncated archive stops the import
+// with the counts so far, and that other data is not taken for an archive.
+func TestImportCorrupt(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryDB()
+	addTestMessages(t, src, 0, 2)
+	var archive bytes.Buffer
+	if _, err := Export(ctx, src, &archive); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	// A garbage entry goes between the two messages, and a message with a
+	// stray byte after them
+	entry := func(data []byte) []byte {
+		return binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	}
+	header := len(archiveMagic) + 1
+	first := header + 4 + len(batchMessage(batchOutpoint(0)))
+	data := append([]byte(nil), archive.Bytes()[:first]...)
+	garbage := []byte("not a message")
+	data = append(append(data, entry(garbage)...), garbage...)
+	data = append(data, archive.Bytes()[first:]...)
+	long := append(batchMessage(batchOutpoint(5)), 'x')
+	data = append(append(data, entry(long)...), long...)
+
+	dst := NewMemoryDB()
+	result, err := Import(ctx, bytes.NewReader(data), importInto(dst))
+	if err != nil || result.Accepted != 2 || result.Rejected != 2 ||
+		len(result.Errors) != 2 {
+
+		t.Fatalf("imported %+v, %v", result, err)
+	}
+	for _, reason := range result.Errors {
+		if !strings.Contains(reason, ErrCorruptEntry.Error()) {
+			t.Fatalf("rejected for %q", reason)
+		}
+	}
+	if len(listAll(t, dst)) != 2 {
+		t.Fatal("valid messages not imported around corrupt entries")
+	}
+
+	// The archive ends within its second message
+	truncated := archive.Bytes()[:archive.Len()-3]
+	result, err = Import(ctx, bytes.NewReader(truncated),
+		importInto(NewMemoryDB()))
+	if !errors.Is(err, ErrInvalidArchive) || result == nil ||
+		result.Accepted != 1 {
+
+		t.Fatalf("truncated archive imported %+v, %v", result, err)
+	}
+
+	for _, data := range [][]byte{nil, []byte("UTXOCHAT"),
+		[]byte("NOTCHAT\x00\x01"), []byte("UTXOCHAT\x02")} {
+
+		if _, err := Import(ctx, bytes.NewReader(data),
+			importInto(NewMemoryDB())); !errors.Is(err, ErrInvalidArchive) {
+
+			t.Fatalf("%q imported: %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// DefaultBatchSize is the number of writes a BatchDB holds before
+	// writing them out.
+	DefaultBatchSize = 256
+
+	// DefaultBatchInterval is how often a BatchDB writes out the writes it
+	// holds.
+	DefaultBatchInterval = 100 * time.Millisecond
+)
+
+// batchWrite is an AddOutpoint or AddMessage call held by a BatchDB. data is
+// nil for AddOutpoint.
+type batchWrite struct {
+	outpoint message.Outpoint
+	data     []byte
+	meta     MessageMeta
+}
+
+// BatchDB wraps a Database, holding AddOutpoint and AddMessage calls in a
+// batch that is written to it in order and flushed once it holds a number of
+// writes, periodically, and on Flush and Close. A backend that syncs on Flush
+// then syncs once per batch rather than once per write.
+//
+// Writes held in the batch are visible to HasOutpoint, GetMessage and
+// GetMessageMeta. The other calls write the batch out first, when it may
+// change their result, so the wrapper reads like the database it wraps.
+// Block removals and restores in particular always see every earlier write.
+type BatchDB struct {
+	Database
+
+	size int
+
+	// mu guards the batch and is held while the batch is written, so
+	// reads wait for the writes they might otherwise miss. outpoints
+	// holds the outpoints written in the batch, messages the index in
+	// writes of the last message written for an outpoint and payloads
+	// the number of messages written per payload hash.
+	mu        sync.Mutex
+	writes    []batchWrite
+	outpoints map[message.Outpoint]struct{}
+	messages  map[message.Outpoint]int
+	payloads  map[[32]byte]int
+
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Ensure BatchDB implements the Database interface.
+var _ Database = (*BatchDB)(nil)
+
+// NewBatchDB wraps db, writing to it once size writes are held, or
+// DefaultBatchSize if size is not positive, and every interval. A zero
+// interval leaves the batch held until it fills up or is flushed.
+func NewBatchDB(db Database, size int, interval time.Duration) *BatchDB {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	b := &BatchDB{
+		Database:  db,
+		size:      size,
+		outpoints: make(map[message.Outpoint]struct{}),
+		messages:  make(map[message.Outpoint]int),
+		payloads:  make(map[[32]byte]int),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if interval > 0 {
+		go b.flushPeriodically(interval)
+	} else {
+		close(b.done)
+	}
+	return b
+}
+
+// flushPeriodically writes out the batch every interval until the database
+// is closed.
+func (b *BatchDB) flushPeriodically(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+			if err := b.Flush(context.Background()); err != nil {
+				log.Errorf("Failed to flush batched writes: %v", err)
+			}
+		}
+	}
+}
+
+// add holds a write in the batch, writing the batch out if it is full.
+func (b *BatchDB) add(ctx context.Context, write batchWrite) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.outpoints[write.outpoint] = struct{}{}
+	if write.data != nil {
+		b.messages[write.outpoint] = len(b.writes)
+		if len(write.meta.PayloadHash) == 32 {
+			b.payloads[[32]byte(write.meta.PayloadHash)]++
+		}
+	}
+	b.writes = append(b.writes, write)
+
+	if len(b.writes) < b.size {
+		return nil
+	}
+	return b.flushLocked(ctx)
+}
+
+// flushLocked writes the batch to the wrapped database in order and flushes
+// it. Writes that fail are kept along with those after them, to be tried
+// again by the next flush. The caller must hold b.mu.
+func (b *BatchDB) flushLocked(ctx context.Context) error {
+	for i, write := range b.writes {
+		var err error
+		if write.data == nil {
+			err = b.Database.AddOutpoint(ctx, write.outpoint)
+		} else {
+			err = b.Database.AddMessage(ctx, write.outpoint, write.data,
+				write.meta)
+		}
+		if err != nil {
+			b.reset(b.writes[i:])
+			return fmt.Errorf("failed to write %d batched writes: %w",
+				len(b.writes), err)
+		}
+	}
+	b.reset(nil)
+
+	return b.Database.Flush(ctx)
+}
+
+// reset replaces the batch with writes. The caller must hold b.mu.
+func (b *BatchDB) reset(writes []batchWrite) {
+	b.writes = append(b.writes[:0:0], writes...)
+	clear(b.outpoints)
+	clear(b.messages)
+	clear(b.payloads)
+	for i, write := range b.writes {
+		b.outpoints[write.outpoint] = struct{}{}
+		if write.data != nil {
+			b.messages[write.outpoint] = i
+			if len(write.meta.PayloadHash) == 32 {
+				b.payloads[[32]byte(write.meta.PayloadHash)]++
+			}
+		}
+	}
+}
+
+// flushIf writes out the batch if pending reports that it holds a write
+// concerning the caller.
+func (b *BatchDB) flushIf(ctx context.Context, pending func() bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.writes) == 0 || !pending() {
+		return nil
+	}
+	return b.flushLocked(ctx)
+}
+
+// flushAll writes out the batch, if any.
+func (b *BatchDB) flushAll(ctx context.Context) error {
+	return b.flushIf(ctx, func() bool { return true })
+}
+
+// flushOutpoint writes out the batch if it holds a message for outpoint.
+func (b *BatchDB) flushOutpoint(ctx context.Context,
+	outpoint message.Outpoint) error {
+
+	return b.flushIf(ctx, func() bool {
+		_, ok := b.messages[outpoint]
+		return ok
+	})
+}
+
+// Flush implements Database. It returns once every write held in the batch
+// has been written to the wrapped database and flushed.
+func (b *BatchDB) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flushLocked(ctx)
+}
+
+// Close writes out the batch and closes the wrapped database.
+func (b *BatchDB) Close() error {
+	b.closeOnce.Do(func() { close(b.quit) })
+	<-b.done
+
+	err := b.Flush(context.Background())
+	if closeErr := b.Database.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// AddOutpoint implements Database.
+func (b *BatchDB) AddOutpoint(ctx context.Context,
+	outpoint message.Outpoint) error {
+
+	return b.add(ctx, batchWrite{outpoint: outpoint})
+}
+
+// AddMessage implements Database.
+func (b *BatchDB) AddMessage(ctx context.Context, outpoint message.Outpoint,
+	data []byte, meta MessageMeta) error {
+
+	// Hold a private copy so callers can reuse their buffer
+	stored := make([]byte, len(data))
+	copy(stored, data)
+	return b.add(ctx, batchWrite{outpoint: outpoint, data: stored,
+		meta: meta})
+}
+
+// HasOutpoint implements Database.
+func (b *BatchDB) HasOutpoint(ctx context.Context,
+	outpoint message.Outpoint) (bool, error) {
+
+	b.mu.Lock()
+	_, ok := b.outpoints[outpoint]
+	b.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return b.Database.HasOutpoint(ctx, outpoint)
+}
+
+// GetMessage implements Database.
+func (b *BatchDB) GetMessage(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+
+	b.mu.Lock()
+	i, ok := b.messages[outpoint]
+	var data []byte
+	if ok {
+		data = b.writes[i].data
+	}
+	b.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+	return b.Database.GetMessage(ctx, outpoint)
+}
+
+// GetMessageMeta implements Database.
+func (b *BatchDB) GetMessageMeta(ctx context.Context,
+	outpoint message.Outpoint) (*MessageMeta, error) {
+
+	b.mu.Lock()
+	i, ok := b.messages[outpoint]
+	var meta MessageMeta
+	if ok {
+		meta = b.writes[i].meta
+	}
+	b.mu.Unlock()
+	if ok {
+		return &meta, nil
+	}
+	return b.Database.GetMessageMeta(ctx, outpoint)
+}
+
+// GetStoredSize implements Database.
+func (b *BatchDB) GetStoredSize(ctx context.Context,
+	outpoint message.Outpoint) (int, error) {
+
+	if err := b.flushOutpoint(ctx, outpoint); err != nil {
+		return 0, err
+	}
+	return b.Database.GetStoredSize(ctx, outpoint)
+}
+
+// GetExpiredSequence implements Database.
+func (b *BatchDB) GetExpiredSequence(ctx context.Context,
+	outpoint message.Outpoint) (uint32, bool, error) {
+
+	if err := b.flushOutpoint(ctx, outpoint); err != nil {
+		return 0, false, err
+	}
+	return b.Database.GetExpiredSequence(ctx, outpoint)
+}
+
+// GetArchivedMessage implements Database.
+func (b *BatchDB) GetArchivedMessage(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+
+	if err := b.flushOutpoint(ctx, outpoint); err != nil {
+		return nil, err
+	}
+	return b.Database.GetArchivedMessage(ctx, outpoint)
+}
+
+// CountPayload implements Database.
+func (b *BatchDB) CountPayload(ctx context.Context, hash [32]byte) (int,
+	error) {
+
+	err := b.flushIf(ctx, func() bool { return b.payloads[hash] > 0 })
+	if err != nil {
+		return 0, err
+	}
+	return b.Database.CountPayload(ctx, hash)
+}
+
+// SuppressPayload implements Database.
+func (b *BatchDB) SuppressPayload(ctx context.Context, hash [32]byte) (int,
+	error) {
+
+	err := b.flushIf(ctx, func() bool { return b.payloads[hash] > 0 })
+	if err != nil {
+		return 0, err
+	}
+	return b.Database.SuppressPayload(ctx, hash)
+}
+
+// RemoveOutpoint implements Database.
+func (b *BatchDB) RemoveOutpoint(ctx context.Context,
+	outpoint message.Outpoint) error {
+
+	if err := b.flushAll(ctx); err != nil {
+		return err
+	}
+	return b.Database.RemoveOutpoint(ctx, outpoint)
+}
+
+// RemoveOutpoints implements Database.
+func (b *BatchDB) RemoveOutpoints(ctx context.Context,
+	outpoints []message.Outpoint) error {
+
+	if err := b.flushAll(ctx); err != nil {
+		return err
+	}
+	return b.Database.RemoveOutpoints(ctx, outpoints)
+}
+
+// ListOutpoints implements Database.
+func (b *BatchDB) ListOutpoints(ctx context.Context) ([]message.Outpoint,
+	error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.ListOutpoints(ctx)
+}
+
+// ExpireMessages implements Database.
+func (b *BatchDB) ExpireMessages(ctx context.Context, now time.Time) (
+	[]message.Outpoint, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.ExpireMessages(ctx, now)
+}
+
+// ListMessages implements Database.
+func (b *BatchDB) ListMessages(ctx context.Context, cursor string,
+	limit int) ([]MessageEntry, string, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, "", err
+	}
+	return b.Database.ListMessages(ctx, cursor, limit)
+}
+
+// ListChannelMessages implements Database.
+func (b *BatchDB) ListChannelMessages(ctx context.Context, channel string,
+	cursor string, limit int) ([]MessageEntry, string, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, "", err
+	}
+	return b.Database.ListChannelMessages(ctx, channel, cursor, limit)
+}
+
+// GetThread implements Database.
+func (b *BatchDB) GetThread(ctx context.Context, root message.Outpoint) (
+	[]MessageEntry, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.GetThread(ctx, root)
+}
+
+// GetChunkGroup implements Database.
+func (b *BatchDB) GetChunkGroup(ctx context.Context,
+	group message.ChunkGroup) ([]MessageEntry, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.GetChunkGroup(ctx, group)
+}
+
+// GetOutpointsByPubKey implements Database.
+func (b *BatchDB) GetOutpointsByPubKey(ctx context.Context,
+	pubKey []byte) ([]message.Outpoint, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.GetOutpointsByPubKey(ctx, pubKey)
+}
+
+// GetMessagesByPubKey implements Database.
+func (b *BatchDB) GetMessagesByPubKey(ctx context.Context,
+	pubKey []byte) ([]MessageEntry, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.GetMessagesByPubKey(ctx, pubKey)
+}
+
+// TopPayloads implements Database.
+func (b *BatchDB) TopPayloads(ctx context.Context, limit int) (
+	[]PayloadCount, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.TopPayloads(ctx, limit)
+}
+
+// RemoveBlockOutpoints implements Database.
+func (b *BatchDB) RemoveBlockOutpoints(ctx context.Context,
+	blockHash chainhash.Hash, outpoints []message.Outpoint) (
+	[]message.Outpoint, error) {
+
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.RemoveBlockOutpoints(ctx, blockHash, outpoints)
+}
+
+// RestoreBlockOutpoints implements Database.
+func (b *BatchDB) RestoreBlockOutpoints(ctx context.Context,
+	blockHash chainhash.Hash) error {
+
+	if err := b.flushAll(ctx); err != nil {
+		return err
+	}
+	return b.Database.RestoreBlockOutpoints(ctx, blockHash)
+}
+
+// ForgetBlock implements Database.
+func (b *BatchDB) ForgetBlock(ctx context.Context,
+	blockHash chainhash.Hash) error {
+
+	if err := b.flushAll(ctx); err != nil {
+		return err
+	}
+	return b.Database.ForgetBlock(ctx, blockHash)
+}
+
+// Stats implements Database.
+func (b *BatchDB) Stats(ctx context.Context) (*Stats, error) {
+	if err := b.flushAll(ctx); err != nil {
+		return nil, err
+	}
+	return b.Database.Stats(ctx)
+}
+
+// Compact implements Database.
+func (b *BatchDB) Compact(ctx context.Context) error {
+	if err := b.flushAll(ctx); err != nil {
+		return err
+	}
+	return b.Database.Compact(ctx)
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// syncLatency is the time syncDB takes to flush, standing in for an fsync.
+const syncLatency = 200 * time.Microsecond
+
+// syncDB is an in-memory database whose Flush takes syncLatency, like a
+// disk backend syncing its writes.
+type syncDB struct {
+	*MemoryDB
+	flushes atomic.Int32
+}
+
+// Flush implements Database.
+func (db *syncDB) Flush(ctx context.Context) error {
+	db.flushes.Add(1)
+	time.Sleep(syncLatency)
+	return nil
+}
+
+// batchOutpoint returns a distinct outpoint for i.
+func batchOutpoint(i int) message.Outpoint {
+	var txid chainhash.Hash
+	binary.LittleEndian.PutUint64(txid[:], uint64(i))
+	return message.NewOutpoint(txid, uint32(i))
+}
+
+// batchMessage returns a serialized message for outpoint.
+func batchMessage(outpoint message.Outpoint) []byte {
+	payload := []byte("hello")
+	msg := &message.Message{
+		Outpoint:    outpoint,
+		ContentType: message.ContentTypeText,
+		Length:      uint16(len(payload)),
+		Payload:     payload,
+	}
+	return msg.Serialize()
+}
+
+// checkMessage fails the test unless db returns data for outpoint.
+func checkMessage(t *testing.T, db Database, outpoint message.Outpoint,
+	data []byte) {
+
+	t.Helper()
+
+	ctx := context.Background()
+	if ok, err := db.HasOutpoint(ctx, outpoint); err != nil || !ok {
+		t.Fatalf("outpoint %s not found: %v", outpoint.ToString(), err)
+	}
+	got, err := db.GetMessage(ctx, outpoint)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("message %s is %x, %v, want %x", outpoint.ToString(), got,
+			err, data)
+	}
+	meta, err := db.GetMessageMeta(ctx, outpoint)
+	if err != nil || meta == nil || meta.Source != "test" {
+		t.Fatalf("metadata of %s is %+v, %v", outpoint.ToString(), meta,
+			err)
+	}
+}
+
+// TestBatchReadYourWrites checks that writes are visible before, as and
+// after the batch holding them is written out when it fills up.
+func TestBatchReadYourWrites(t *testing.T) {
+	const size = 4
+
+	ctx := context.Background()
+	backend := &syncDB{MemoryDB: NewMemoryDB()}
+	db := NewBatchDB(backend, size, 0)
+	defer db.Close()
+
+	var outpoints []message.Outpoint
+	var msgs [][]byte
+	for i := 0; i < 2*size+1; i++ {
+		outpoint := batchOutpoint(i)
+		data := batchMessage(outpoint)
+		err := db.AddMessage(ctx, outpoint, data, MessageMeta{Source: "test"})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+
+		// The buffer is the caller's to reuse
+		data[0] ^= 0xff
+		data = batchMessage(outpoint)
+		outpoints, msgs = append(outpoints, outpoint), append(msgs, data)
+
+		for j := range outpoints {
+			checkMessage(t, db, outpoints[j], msgs[j])
+		}
+
+		flushed := (i + 1) / size
+		if n := int(backend.flushes.Load()); n != flushed {
+			t.Fatalf("%d writes flushed %d times, want %d", i+1, n,
+				flushed)
+		}
+		stored, err := backend.HasOutpoint(ctx, outpoint)
+		if err != nil || stored != ((i+1)%size == 0) {
+			t.Fatalf("write %d stored %v in the backend at batch size %d",
+				i+1, stored, size)
+		}
+	}
+
+	// Outpoints without a message are batched too
+	outpoint := batchOutpoint(100)
+	if err := db.AddOutpoint(ctx, outpoint); err != nil {
+		t.Fatalf("AddOutpoint: %v", err)
+	}
+	if ok, err := db.HasOutpoint(ctx, outpoint); err != nil || !ok {
+		t.Fatalf("batched outpoint not found: %v", err)
+	}
+	if data, err := db.GetMessage(ctx, outpoint); err != nil || data != nil {
+		t.Fatalf("outpoint without a message returned %x, %v", data, err)
+	}
+
+	// Listing sees everything, batched or not
+	entries, _, err := db.ListMessages(ctx, "", 0)
+	if err != nil || len(entries) != len(outpoints) {
+		t.Fatalf("listed %d messages, %v, want %d", len(entries), err,
+			len(outpoints))
+	}
+	for i, entry := range entries {
+		if entry.Outpoint != outpoints[i] {
+			t.Fatalf("entry %d is %s, want %s", i,
+				entry.Outpoint.ToString(), outpoints[i].ToString())
+		}
+	}
+}
+
+// TestBatchForcedFlush checks that block removals, Flush and Close write out
+// the batch, and that the interval does too.
+func TestBatchForcedFlush(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("block removal", func(t *testing.T) {
+		backend := &syncDB{MemoryDB: NewMemoryDB()}
+		db := NewBatchDB(backend, 100, 0)
+		defer db.Close()
+
+		spent, kept := batchOutpoint(1), batchOutpoint(2)
+		for _, outpoint := range []message.Outpoint{spent, kept} {
+			err := db.AddMessage(ctx, outpoint, batchMessage(outpoint),
+				MessageMeta{Source: "test"})
+			if err != nil {
+				t.Fatalf("AddMessage: %v", err)
+			}
+		}
+
+		block := chainhash.Hash{1}
+		removed, err := db.RemoveBlockOutpoints(ctx, block,
+			[]message.Outpoint{spent})
+		if err != nil || len(removed) != 1 || removed[0] != spent {
+			t.Fatalf("block removed %v, %v, want only the batched "+
+				"outpoint", removed, err)
+		}
+		if ok, _ := db.HasOutpoint(ctx, spent); ok {
+			t.Fatal("spent outpoint still found")
+		}
+		checkMessage(t, backend, kept, batchMessage(kept))
+
+		if err := db.RestoreBlockOutpoints(ctx, block); err != nil {
+			t.Fatalf("RestoreBlockOutpoints: %v", err)
+		}
+		checkMessage(t, db, spent, batchMessage(spent))
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		backend := &syncDB{MemoryDB: NewMemoryDB()}
+		db := NewBatchDB(backend, 100, 0)
+		defer db.Close()
+
+		outpoint := batchOutpoint(1)
+		if err := db.AddOutpoint(ctx, outpoint); err != nil {
+			t.Fatalf("AddOutpoint: %v", err)
+		}
+		if err := db.Flush(ctx); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if ok, _ := backend.HasOutpoint(ctx, outpoint); !ok {
+			t.Fatal("flushed outpoint not in the backend")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		backend := &syncDB{MemoryDB: NewMemoryDB()}
+		db := NewBatchDB(backend, 100, time.Hour)
+
+		outpoint := batchOutpoint(1)
+		err := db.AddMessage(ctx, outpoint, batchMessage(outpoint),
+			MessageMeta{Source: "test"})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		checkMessage(t, backend, outpoint, batchMessage(outpoint))
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		backend := &syncDB{MemoryDB: NewMemoryDB()}
+		db := NewBatchDB(backend, 100, 10*time.Millisecond)
+		defer db.Close()
+
+		outpoint := batchOutpoint(1)
+		if err := db.AddOutpoint(ctx, outpoint); err != nil {
+			t.Fatalf("AddOutpoint: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if ok, _ := backend.HasOutpoint(ctx, outpoint); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("batch not written out after its interval")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+// benchmarkWrites stores b.N messages in db, flushing after each write if
+// sync is set as a backend without batching would, and once at the end.
+func benchmarkWrites(b *testing.B, db Database, sync bool) {
+	ctx := context.Background()
+	msgs := make([][]byte, b.N)
+	for i := range msgs {
+		msgs[i] = batchMessage(batchOutpoint(i))
+	}
+
+	b.ResetTimer()
+	for i, data := range msgs {
+		err := db.AddMessage(ctx, batchOutpoint(i), data, MessageMeta{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if sync {
+			if err := db.Flush(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := db.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkWritePerWrite syncs every write to a backend taking syncLatency
+// per sync.
+func BenchmarkWritePerWrite(b *testing.B) {
+	benchmarkWrites(b, &syncDB{MemoryDB: NewMemoryDB()}, true)
+}
+
+// BenchmarkWriteBatched batches writes to the same backend.
+func BenchmarkWriteBatched(b *testing.B) {
+	db := NewBatchDB(&syncDB{MemoryDB: NewMemoryDB()}, DefaultBatchSize,
+		DefaultBatchInterval)
+	defer db.Close()
+	benchmarkWrites(b, db, false)
+}
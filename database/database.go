@@ -2,15 +2,137 @@ package database
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/shaibearary/utxo_chat/message"
 )
 
+// MaxListLimit is the maximum number of messages returned by a single
+// ListMessages call.
+const MaxListLimit = 1000
+
+// ErrInvalidCursor is returned by ListMessages for a malformed cursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrEvicted is returned by GetMessage when the message for a known outpoint
+// was dropped to stay within the storage budget.
+var ErrEvicted = errors.New("message evicted")
+
+// ErrNotPersistent is returned by Open for a database type that keeps
+// nothing on disk.
+var ErrNotPersistent = errors.New("database keeps nothing on disk")
+
+// SourceLocal is the MessageMeta source of messages submitted locally rather
+// than relayed by a peer.
+const SourceLocal = "local"
+
+// MessageMeta is local bookkeeping stored alongside a message. It is never
+// sent over the wire.
+type MessageMeta struct {
+	// ReceivedAt is when the message was accepted.
+	ReceivedAt time.Time
+
+	// Source is the address of the peer that relayed the message, or
+	// SourceLocal.
+	Source string
+
+	// ValidationTime is how long validating the message took.
+	ValidationTime time.Duration
+
+	// PubKey is the 32-byte x-only taproot output key of the UTXO backing
+	// the message, nil for other outputs. Messages are indexed by it.
+	PubKey []byte
+
+	// Channel and ReplyTo are the fields of a structured payload, see
+	// message.Payload. Messages are indexed by both.
+	Channel string
+	ReplyTo *message.Outpoint
+
+	// ChunkGroup is the group of the chunk a structured payload carries,
+	// nil if it carries none. Messages are indexed by it.
+	ChunkGroup *message.ChunkGroup
+
+	// PayloadHash is the SHA256 hash of the payload. Messages are indexed
+	// by it to spot the same payload sent from many outpoints.
+	PayloadHash []byte
+
+	// Expiry is when the message expires as declared by its structured
+	// payload, the zero time if it doesn't.
+	Expiry time.Time
+
+	// SignatureValid is set if the signature of the message was verified
+	// against its UTXO before it was stored, and ValidatedHeight is the
+	// height of the chain tip then, zero if unknown. Stored messages are
+	// served and announced on the strength of this record without being
+	// verified again. Messages imported after their UTXO was spent are
+	// stored unverified.
+	SignatureValid  bool
+	ValidatedHeight int32
+}
+
+// MessageEntry is a stored message along with its outpoint.
+type MessageEntry struct {
+	Outpoint message.Outpoint
+	Data     []byte
+	Meta     MessageMeta
+}
+
+// PayloadCount is the number of valid messages seen with the same payload.
+type PayloadCount struct {
+	// Hash is the SHA256 hash of the payload.
+	Hash [32]byte
+
+	// Count is the number of messages seen with the payload, Stored the
+	// number of them stored and Outpoints their outpoints in insertion
+	// order, at most MaxListLimit.
+	Count     int
+	Stored    int
+	Outpoints []message.Outpoint
+}
+
+// KeyspaceStats are the number of entries of a keyspace and their
+// approximate size in bytes.
+type KeyspaceStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// Stats describe the contents of a database per keyspace.
+type Stats struct {
+	// Outpoints are the known outpoints, whether or not a message is
+	// stored for them, and Messages the stored messages with their
+	// metadata.
+	Outpoints KeyspaceStats
+	Messages  KeyspaceStats
+
+	// Indexes are the entries of the sender, channel, reply, chunk,
+	// payload and expiry indexes of the stored messages.
+	Indexes KeyspaceStats
+
+	// Archive holds the messages kept after their UTXO was spent, Expired
+	// the outpoints whose message expired and Undo the entries recorded
+	// to restore outpoints removed by a block.
+	Archive KeyspaceStats
+	Expired KeyspaceStats
+	Undo    KeyspaceStats
+
+	// Tombstones are the entries of removed data that still take space
+	// until the database is compacted.
+	Tombstones KeyspaceStats
+}
+
 // Database defines the interface for UTXOchat's database operations
 type Database interface {
 	// Close closes the database connection
 	Close() error
 
+	// Flush returns once every write made so far is durable. Backends that
+	// buffer writes must also flush them on Close and keep them visible to
+	// reads until then.
+	Flush(ctx context.Context) error
+
 	// HasOutpoint checks if an outpoint exists in the database
 	HasOutpoint(ctx context.Context, outpoint message.Outpoint) (bool, error)
 
@@ -23,9 +145,122 @@ type Database interface {
 	// RemoveOutpoints removes multiple outpoints from the database
 	RemoveOutpoints(ctx context.Context, outpoints []message.Outpoint) error
 
-	// AddMessage adds a message to the database
-	AddMessage(ctx context.Context, outpoint message.Outpoint, data []byte) error
+	// ListOutpoints returns every known outpoint, whether or not a message
+	// is stored for it, sorted by txid and index.
+	ListOutpoints(ctx context.Context) ([]message.Outpoint, error)
 
-	// GetMessage retrieves a message from the database by outpoint
+	// AddMessage adds a message and its metadata to the database
+	AddMessage(ctx context.Context, outpoint message.Outpoint, data []byte,
+		meta MessageMeta) error
+
+	// GetMessage retrieves a message from the database by outpoint. It
+	// returns ErrEvicted if the message was evicted, in which case the
+	// outpoint is still reported by HasOutpoint.
 	GetMessage(ctx context.Context, outpoint message.Outpoint) ([]byte, error)
+
+	// ExpireMessages drops the stored messages whose Expiry is not after
+	// now and returns their outpoints. The outpoints are kept along with
+	// the sequence number of the dropped message, so that only a
+	// replacement with a greater sequence is accepted for them.
+	ExpireMessages(ctx context.Context, now time.Time) (
+		[]message.Outpoint, error)
+
+	// GetExpiredSequence returns the sequence number of the message
+	// dropped by ExpireMessages for the outpoint, and false if the
+	// outpoint has no such message.
+	GetExpiredSequence(ctx context.Context, outpoint message.Outpoint) (
+		uint32, bool, error)
+
+	// GetArchivedMessage retrieves a message removed because its UTXO was
+	// spent. It returns nil unless the database archives expired messages.
+	GetArchivedMessage(ctx context.Context, outpoint message.Outpoint) (
+		[]byte, error)
+
+	// GetStoredSize returns the payload bytes of every message stored for
+	// the outpoint, replaced ones included, since the outpoint was first
+	// seen. It is reset when the outpoint is removed.
+	GetStoredSize(ctx context.Context, outpoint message.Outpoint) (int, error)
+
+	// GetMessageMeta retrieves the metadata of a message by outpoint. It
+	// returns nil if no message is stored for the outpoint.
+	GetMessageMeta(ctx context.Context, outpoint message.Outpoint) (
+		*MessageMeta, error)
+
+	// ListMessages returns up to limit stored messages in insertion order,
+	// starting after cursor. An empty cursor starts at the beginning. The
+	// returned cursor continues the iteration; an empty page means all
+	// messages have been returned. Limits above MaxListLimit are capped.
+	ListMessages(ctx context.Context, cursor string, limit int) (
+		[]MessageEntry, string, error)
+
+	// ListChannelMessages is ListMessages limited to the messages with a
+	// structured payload posted to channel. Cursors are interchangeable
+	// with those of ListMessages.
+	ListChannelMessages(ctx context.Context, channel string, cursor string,
+		limit int) ([]MessageEntry, string, error)
+
+	// GetThread returns the stored message for root, if any, and every
+	// stored message whose ReplyTo chains to it, in insertion order. At
+	// most MaxListLimit messages are returned.
+	GetThread(ctx context.Context, root message.Outpoint) (
+		[]MessageEntry, error)
+
+	// GetChunkGroup returns the stored messages carrying a chunk of group,
+	// in insertion order. At most MaxListLimit messages are returned.
+	GetChunkGroup(ctx context.Context, group message.ChunkGroup) (
+		[]MessageEntry, error)
+
+	// GetOutpointsByPubKey returns the outpoints of the stored messages
+	// whose UTXO is controlled by the x-only taproot output key pubKey, in
+	// insertion order.
+	GetOutpointsByPubKey(ctx context.Context, pubKey []byte) (
+		[]message.Outpoint, error)
+
+	// GetMessagesByPubKey returns the stored messages whose UTXO is
+	// controlled by pubKey, in insertion order.
+	GetMessagesByPubKey(ctx context.Context, pubKey []byte) (
+		[]MessageEntry, error)
+
+	// CountPayload returns the number of messages seen with the payload
+	// hashing to hash: those stored and those counted by SuppressPayload.
+	CountPayload(ctx context.Context, hash [32]byte) (int, error)
+
+	// SuppressPayload counts a valid message with the payload hashing to
+	// hash that wasn't stored, and returns the new count. Suppressed
+	// messages are forgotten along with the last stored message with the
+	// payload.
+	SuppressPayload(ctx context.Context, hash [32]byte) (int, error)
+
+	// TopPayloads returns up to limit payloads seen more than once, most
+	// seen first.
+	TopPayloads(ctx context.Context, limit int) ([]PayloadCount, error)
+
+	// RemoveBlockOutpoints removes the outpoints spent by a block along
+	// with their messages and records the removed entries so they can be
+	// restored if the block is disconnected by a reorg. It returns the
+	// outpoints that were known and have been removed.
+	RemoveBlockOutpoints(ctx context.Context, blockHash chainhash.Hash,
+		outpoints []message.Outpoint) ([]message.Outpoint, error)
+
+	// RestoreBlockOutpoints restores the outpoints removed for a block that
+	// is no longer part of the best chain
+	RestoreBlockOutpoints(ctx context.Context, blockHash chainhash.Hash) error
+
+	// ForgetBlock discards the restore record of a block that is buried too
+	// deep to be reorganized
+	ForgetBlock(ctx context.Context, blockHash chainhash.Hash) error
+
+	// Stats returns the number of entries and their approximate size per
+	// keyspace. It is cheap enough to call on every metrics scrape.
+	Stats(ctx context.Context) (*Stats, error)
+
+	// Compact reclaims the space held by removed entries, which grows
+	// with the churn of outpoints added and removed as UTXOs are spent.
+	Compact(ctx context.Context) error
+
+	// SetEvictHandler registers fn to be called with the outpoints whose
+	// messages were evicted to stay within the storage budget, once the
+	// call that evicted them released the database. It must be called
+	// before the database is used.
+	SetEvictHandler(fn func(outpoints []message.Outpoint))
 }
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// Reason codes of a failed dry run. They are named like the reject codes
+// peers answer invalid messages with.
+const (
+	ReasonInvalidSignature = "invalid-signature"
+	ReasonDuplicate        = "duplicate-outpoint"
+	ReasonUTXONotFound     = "utxo-not-found"
+	ReasonTooLarge         = "too-large"
+	ReasonExceedsPolicy    = "exceeds-policy"
+	ReasonMalformed        = "malformed"
+	ReasonInvalidUTXO      = "invalid-utxo"
+	ReasonUnconfirmed      = "unconfirmed"
+	ReasonBudgetExceeded   = "budget-exceeded"
+	ReasonExpired          = "expired"
+	ReasonRPCUnavailable   = "rpc-unavailable"
+	ReasonInternal         = "internal-error"
+)
+
+// DryRunResult is the outcome of validating a message without storing it.
+type DryRunResult struct {
+	// OK is true if the message passed every check. Otherwise Reason is
+	// the code of the check it failed and Err the error it failed with.
+	OK     bool
+	Reason string
+	Err    error
+
+	// ScriptType is the type of the UTXO's output script and PubKey its
+	// x-only taproot output key, nil for other outputs.
+	ScriptType ScriptType
+	PubKey     []byte
+
+	// Value is the value of the UTXO in satoshis and Confirmations its
+	// number of confirmations. Both are zero if the UTXO wasn't found.
+	Value         int64
+	Confirmations int64
+}
+
+// DryRun runs every check ValidateMessage and the network path run on a
+// message, looking up its UTXO through the same client, but records
+// nothing in the database. The UTXO fields of the result are filled in as
+// far as the lookup got.
+func (v *Validator) DryRun(ctx context.Context,
+	msg *message.Message) *DryRunResult {
+
+	result := &DryRunResult{}
+	fail := func(err error) *DryRunResult {
+		result.Reason = ReasonFor(err)
+		result.Err = err
+		return result
+	}
+
+	txOut, err := v.LookupUTXO(ctx, msg.Outpoint)
+	if err != nil {
+		return fail(err)
+	}
+	result.ScriptType = v.ClassifyOutput(txOut)
+	result.Confirmations = txOut.Confirmations
+	if value, err := btcutil.NewAmount(txOut.Value); err == nil {
+		result.Value = int64(value)
+	}
+
+	if err := v.VerifyUTXOValue(txOut); err != nil {
+		return fail(err)
+	}
+	pkScript, err := v.GetPKScript(txOut)
+	if err != nil {
+		return fail(err)
+	}
+	result.PubKey = TaprootOutputKey(pkScript)
+
+	if err := v.checkMessage(ctx, msg); err != nil {
+		return fail(err)
+	}
+	err = v.VerifyWitness(string(msg.SignedData()), msg.SignatureWitness(),
+		pkScript)
+	if err != nil {
+		return fail(err)
+	}
+
+	result.OK = true
+	return result
+}
+
+// ReasonFor returns the reason code of an error from validating a message.
+func ReasonFor(err error) string {
+	switch {
+	case errors.Is(err, message.ErrBadSignature),
+		errors.Is(err, ErrScriptMismatch):
+		return ReasonInvalidSignature
+
+	case errors.Is(err, message.ErrDuplicateOutpoint):
+		return ReasonDuplicate
+
+	case errors.Is(err, message.ErrUTXONotFound),
+		errors.Is(err, message.ErrUTXOSpent):
+		return ReasonUTXONotFound
+
+	case errors.Is(err, ErrUnconfirmedOutpoint):
+		return ReasonUnconfirmed
+
+	case errors.Is(err, ErrOutpointBudgetExceeded):
+		return ReasonBudgetExceeded
+
+	case errors.Is(err, message.ErrExpired):
+		return ReasonExpired
+
+	case errors.Is(err, message.ErrPayloadTooLarge):
+		return ReasonTooLarge
+
+	case errors.Is(err, message.ErrExceedsPolicy):
+		return ReasonExceedsPolicy
+
+	case errors.Is(err, ErrInvalidContent):
+		return ReasonMalformed
+
+	case errors.Is(err, ErrUTXOBelowMinimum),
+		errors.Is(err, message.ErrNotTaproot),
+		errors.Is(err, message.ErrUnsupportedScript):
+		return ReasonInvalidUTXO
+
+	case errors.Is(err, message.ErrRPCUnavailable):
+		return ReasonRPCUnavailable
+
+	default:
+		return ReasonInternal
+	}
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestDryRun checks that a valid message, one with a bad signature and one
+// for a spent outpoint get their reason code and UTXO details from a dry
+// run, and that nothing is recorded in the database.
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	vt := newValidatorTest(t)
+
+	valid := vt.outpoint(1, 0)
+	forged := vt.outpoint(2, 0)
+	spent := vt.outpoint(3, 0)
+	vt.addUTXO(valid)
+	vt.addUTXO(forged)
+	vt.addUTXO(spent)
+	vt.client.SpendUTXO(spent.WireOutPoint())
+
+	badSig := vt.sign(forged, 0, "hello")
+	badSig.Signature[0] ^= 0xff
+	tests := []struct {
+		name   string
+		result *DryRunResult
+		ok     bool
+		reason string
+		value  int64
+	}{
+		{"valid", vt.validator.DryRun(ctx, vt.sign(valid, 0, "hello")),
+			true, "", testUTXOValue},
+		{"bad signature", vt.validator.DryRun(ctx, badSig), false,
+			ReasonInvalidSignature, testUTXOValue},
+		{"spent", vt.validator.DryRun(ctx, vt.sign(spent, 0, "hello")),
+			false, ReasonUTXONotFound, 0},
+	}
+	for _, test := range tests {
+		result := test.result
+		if result.OK != test.ok || result.Reason != test.reason ||
+			result.Value != test.value {
+
+			t.Fatalf("%s: got ok %v, reason %q, value %d, %v", test.name,
+				result.OK, result.Reason, result.Value, result.Err)
+		}
+		if test.ok && (result.Err != nil || result.Confirmations < 1 ||
+			!bytes.Equal(result.PubKey, vt.pkScript[2:])) {
+
+			t.Fatalf("%s: got %+v", test.name, result)
+		}
+		if !test.ok && result.Err == nil {
+			t.Fatalf("%s: failed without an error", test.name)
+		}
+	}
+
+	stats, err := vt.db.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Messages.Entries != 0 {
+		t.Fatalf("%d messages stored by dry runs", stats.Messages.Entries)
+	}
+	for _, outpoint := range []message.Outpoint{valid, forged, spent} {
+		if seen, err := vt.db.HasOutpoint(ctx, outpoint); err != nil || seen {
+			t.Fatalf("outpoint %s recorded by a dry run: %v",
+				outpoint.ToString(), err)
+		}
+	}
+
+	// The message validated dry is still accepted for real
+	vt.store(vt.sign(valid, 0, "hello"))
+}
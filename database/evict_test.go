@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// checkEvicted fails the test unless the messages for the outpoints from
+// batchOutpoint(0) to batchOutpoint(n-1) are evicted and the others up to
+// total are stored, with every outpoint still known.
+func checkEvicted(t *testing.T, db Database, n, total int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := 0; i < total; i++ {
+		outpoint := batchOutpoint(i)
+		data, err := db.GetMessage(ctx, outpoint)
+		if i < n && !errors.Is(err, ErrEvicted) {
+			t.Fatalf("message %d gave %x, %v, want ErrEvicted", i, data,
+				err)
+		}
+		if i >= n && (err != nil || data == nil) {
+			t.Fatalf("message %d gave %x, %v, want it stored", i, data,
+				err)
+		}
+		known, err := db.HasOutpoint(ctx, outpoint)
+		if err != nil || !known {
+			t.Fatalf("outpoint %d known: %v, %v", i, known, err)
+		}
+	}
+}
+
+// TestEvictOldest checks that storing past either budget evicts the oldest
+// messages first, reports them to the evict handler in that order, and
+// keeps their outpoints known.
+func TestEvictOldest(t *testing.T) {
+	size := int64(len(batchMessage(batchOutpoint(0))))
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"count", Config{MaxMessages: 3}},
+		{"bytes", Config{MaxMessageBytes: 3*size + size/2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDBWithConfig(test.cfg)
+			var evicted []message.Outpoint
+			db.SetEvictHandler(func(outpoints []message.Outpoint) {
+				evicted = append(evicted, outpoints...)
+			})
+
+			addTestMessages(t, db, 0, 3)
+			if len(evicted) != 0 {
+				t.Fatalf("%d messages evicted within the budget",
+					len(evicted))
+			}
+			addTestMessages(t, db, 3, 2)
+			if len(evicted) != 2 || evicted[0] != batchOutpoint(0) ||
+				evicted[1] != batchOutpoint(1) {
+
+				t.Fatalf("evicted %v, want messages 0 and 1", evicted)
+			}
+			checkEvicted(t, db, 2, 5)
+
+			stats, err := db.Stats(context.Background())
+			if err != nil || stats.Messages.Entries != 3 {
+				t.Fatalf("%d messages stored, %v, want 3",
+					stats.Messages.Entries, err)
+			}
+		})
+	}
+}
+
+// TestEvictedDuplicate checks that a message for an evicted outpoint is
+// still rejected as a duplicate.
+func TestEvictedDuplicate(t *testing.T) {
+	vt := newValidatorTest(t)
+	vt.db = NewMemoryDBWithConfig(Config{MaxMessages: 1})
+	vt.validator = NewValidator(vt.client, vt.db)
+
+	first, second := vt.outpoint(1, 0), vt.outpoint(2, 0)
+	vt.addUTXO(first)
+	vt.addUTXO(second)
+	vt.store(vt.sign(first, 0, "first"))
+	vt.store(vt.sign(second, 0, "second"))
+	if _, err := vt.db.GetMessage(context.Background(), first); !errors.Is(
+		err, ErrEvicted) {
+
+		t.Fatalf("first message gave %v, want ErrEvicted", err)
+	}
+
+	err := vt.validate(vt.sign(first, 0, "first"))
+	if !errors.Is(err, message.ErrDuplicateOutpoint) {
+		t.Fatalf("evicted message accepted again: %v", err)
+	}
+}
@@ -2,16 +2,15 @@ package database
 
 import (
 	"fmt"
+	"time"
 )
 
 // Type represents the type of database.
 type Type string
 
 const (
-	// TypeMemory is an in-memory database.
+	// TypeMemory is an in-memory database. It is the only type so far.
 	TypeMemory Type = "memory"
-	// TypeLevelDB is a LevelDB database.
-	TypeLevelDB Type = "leveldb"
 )
 
 // Config defines the configuration for the database.
@@ -20,17 +19,54 @@ type Config struct {
 	Type Type
 	// Path is the path to the database file.
 	Path string
+	// ArchiveExpired keeps messages whose UTXO was spent in a separate
+	// archive instead of deleting them.
+	ArchiveExpired bool
+	// MaxMessageBytes is the total size of stored messages above which
+	// the oldest messages are evicted. Zero means no limit.
+	MaxMessageBytes int64
+	// MaxMessages is the number of stored messages above which the oldest
+	// messages are evicted. Zero means no limit.
+	MaxMessages int
+	// BatchSize is the number of writes held in a batch before they are
+	// written out, see BatchDB. Zero writes each one through.
+	BatchSize int
+	// BatchInterval is how often batched writes are written out. Zero
+	// holds them until the batch is full or flushed.
+	BatchInterval time.Duration
 }
 
-// New creates a new database based on the configuration.
+// New creates a new database based on the configuration, batching its writes
+// if BatchSize is set.
 func New(cfg Config) (Database, error) {
+	db, err := newBackend(cfg)
+	if err != nil || cfg.BatchSize <= 0 {
+		return db, err
+	}
+	log.Infof("Batching up to %d database writes for %v", cfg.BatchSize,
+		cfg.BatchInterval)
+	return NewBatchDB(db, cfg.BatchSize, cfg.BatchInterval), nil
+}
+
+// newBackend creates the database of the configured type.
+func newBackend(cfg Config) (Database, error) {
 	switch cfg.Type {
 	case TypeMemory:
-		return NewMemoryDB(), nil
-	case TypeLevelDB:
-		// TODO: Implement LevelDB
-		return nil, fmt.Errorf("leveldb not implemented yet")
+		log.Infof("Using in-memory message database")
+		return NewMemoryDBWithConfig(cfg), nil
 	default:
+		// TODO: Add a persistent backend, syncing on Flush so that
+		// BatchDB syncs once per batch
 		return nil, fmt.Errorf("unknown database type: %s", cfg.Type)
 	}
 }
+
+// Open opens the database of a stopped node for offline maintenance. Only
+// database types that keep their data on disk can be opened, others return
+// ErrNotPersistent.
+func Open(cfg Config) (Database, error) {
+	if cfg.Type == TypeMemory {
+		return nil, fmt.Errorf("%w: type %s", ErrNotPersistent, cfg.Type)
+	}
+	return New(cfg)
+}
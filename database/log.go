@@ -0,0 +1,35 @@
+package database
+
+import "github.com/btcsuite/btclog"
+
+// log is the logger for database operations and validLog the logger for
+// message validation. Both are initialized with no output filters, so the
+// package will not perform any logging by default until the caller requests
+// it.
+var (
+	log      btclog.Logger
+	validLog btclog.Logger
+)
+
+// The default amount of logging is none.
+func init() {
+	DisableLog()
+}
+
+// DisableLog disables all library log output. Logging output is disabled by
+// default until UseLogger and UseValidatorLogger are called.
+func DisableLog() {
+	log = btclog.Disabled
+	validLog = btclog.Disabled
+}
+
+// UseLogger uses a specified Logger to output database logging info.
+func UseLogger(logger btclog.Logger) {
+	log = logger
+}
+
+// UseValidatorLogger uses a specified Logger to output message validation
+// logging info.
+func UseValidatorLogger(logger btclog.Logger) {
+	validLog = logger
+}
@@ -1,41 +1,822 @@
 package database
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/shaibearary/utxo_chat/message"
 )
 
 // MemoryDB is an in-memory implementation of the Database interface.
 type MemoryDB struct {
 	outpoints map[message.Outpoint]struct{}
+	messages  map[message.Outpoint]storedMessage
+	removed   map[chainhash.Hash][]removedEntry
 	mu        sync.RWMutex
+
+	// archive holds messages whose UTXO was spent. It is nil unless
+	// expired messages are archived.
+	archive map[message.Outpoint]storedMessage
+
+	// storedSizes holds the payload bytes stored per outpoint, counting
+	// every version of a replaced message.
+	storedSizes map[message.Outpoint]int
+
+	// senders indexes stored messages by the taproot output key in their
+	// metadata.
+	senders map[[32]byte]map[message.Outpoint]struct{}
+
+	// channels and replies index stored messages by the channel and the
+	// outpoint replied to of their structured payload.
+	channels map[string]map[message.Outpoint]struct{}
+	replies  map[message.Outpoint]map[message.Outpoint]struct{}
+
+	// chunks indexes stored messages by the group of the chunk their
+	// structured payload carries.
+	chunks map[message.ChunkGroup]map[message.Outpoint]struct{}
+
+	// payloads indexes stored messages by the hash of their payload.
+	// suppressed holds the number of messages per payload hash that
+	// weren't stored, for hashes that are still indexed.
+	payloads   map[[32]byte]map[message.Outpoint]struct{}
+	suppressed map[[32]byte]int
+
+	// expiring indexes stored messages by the expiry of their structured
+	// payload. expired holds the outpoints whose message was dropped once
+	// it expired, along with the sequence number of that message.
+	expiring map[message.Outpoint]time.Time
+	expired  map[message.Outpoint]uint32
+
+	// evicted holds the outpoints whose message was dropped to stay within
+	// the storage budget. The outpoints themselves are kept.
+	evicted      map[message.Outpoint]struct{}
+	onEvicted    func(outpoints []message.Outpoint)
+	maxBytes     int64
+	maxMessages  int
+	messageBytes int64
+
+	// order records messages in insertion order for ListMessages. Entries
+	// of removed messages are left in place until the next compaction and
+	// are recognized by their sequence number no longer matching seqs.
+	order   []orderEntry
+	seqs    map[message.Outpoint]uint64
+	nextSeq uint64
+	stale   int
+
+	// head is the index in order before which every entry is stale, so
+	// eviction doesn't rescan them.
+	head int
+
+	// indexEntries, indexBytes, archiveBytes, undoEntries and undoBytes
+	// keep the sizes reported by Stats current as entries come and go.
+	indexEntries int
+	indexBytes   int64
+	archiveBytes int64
+	undoEntries  int
+	undoBytes    int64
+}
+
+// Approximate sizes in bytes of the entries of a keyspace, as reported by
+// Stats: an outpoint, an insertion order entry, an expired outpoint with its
+// sequence number, and an index entry keyed by a sender, an outpoint replied
+// to, a chunk group, a payload hash or an expiry time. Channel index entries
+// are keyed by the channel name.
+const (
+	outpointEntrySize = message.OutpointSize
+	orderEntrySize    = 8 + message.OutpointSize
+	expiredEntrySize  = message.OutpointSize + 4
+	senderEntrySize   = 32 + message.OutpointSize
+	replyEntrySize    = 2 * message.OutpointSize
+	chunkEntrySize    = message.ChunkGroupSize + message.OutpointSize
+	payloadEntrySize  = 32 + message.OutpointSize
+	expiryEntrySize   = message.OutpointSize + 8
+)
+
+// storedMessage is a serialized message along with its local metadata.
+type storedMessage struct {
+	data []byte
+	meta MessageMeta
+}
+
+// orderEntry is a message outpoint tagged with its insertion sequence number.
+type orderEntry struct {
+	seq      uint64
+	outpoint message.Outpoint
+}
+
+// removedEntry is an outpoint removed by a block along with its message, if
+// one was stored.
+type removedEntry struct {
+	outpoint   message.Outpoint
+	msg        *storedMessage
+	evicted    bool
+	storedSize int
+
+	// expired is set if the message had expired, expiredSeq then holds
+	// its sequence number.
+	expired    bool
+	expiredSeq uint32
 }
 
 // AddMessage implements Database.
-func (db *MemoryDB) AddMessage(
-	ctx context.Context, outpoint message.Outpoint, data []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+func (db *MemoryDB) AddMessage(ctx context.Context, outpoint message.Outpoint,
+	data []byte, meta MessageMeta) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
 
-	// Store the outpoint in memory
+	// Store a private copy so callers can reuse their buffer
+	stored := make([]byte, len(data))
+	copy(stored, data)
+
+	db.mu.Lock()
 	db.outpoints[outpoint] = struct{}{}
+	db.storedSizes[outpoint] += payloadSize(data)
+	db.setMessage(outpoint, storedMessage{data: stored, meta: meta})
+	evicted := db.evict()
+	db.mu.Unlock()
+
+	db.notifyEvicted(evicted)
 	return nil
 }
 
-// GetMessage implements Database.
-// currently only store outpoints, not message
+// payloadSize returns the payload length recorded in the header of a
+// serialized message.
+func payloadSize(data []byte) int {
+	if len(data) < message.HeaderSize {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint16(data[message.LengthOffset:]))
+}
+
+// GetStoredSize implements Database.
+func (db *MemoryDB) GetStoredSize(
+	ctx context.Context, outpoint message.Outpoint) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.storedSizes[outpoint], nil
+}
+
+// GetMessage implements Database. It returns nil if no message is stored for
+// the outpoint.
 func (db *MemoryDB) GetMessage(
 	ctx context.Context, outpoint message.Outpoint) ([]byte, error) {
-	panic("unimplemented")
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stored, ok := db.messages[outpoint]
+	if !ok {
+		if _, evicted := db.evicted[outpoint]; evicted {
+			return nil, ErrEvicted
+		}
+		return nil, nil
+	}
+	return stored.data, nil
+}
+
+// GetMessageMeta implements Database.
+func (db *MemoryDB) GetMessageMeta(
+	ctx context.Context, outpoint message.Outpoint) (*MessageMeta, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stored, ok := db.messages[outpoint]
+	if !ok {
+		return nil, nil
+	}
+	meta := stored.meta
+	return &meta, nil
+}
+
+// ListMessages implements Database. The cursor is the sequence number of the
+// last returned message, so iteration is stable while new messages arrive.
+func (db *MemoryDB) ListMessages(ctx context.Context, cursor string,
+	limit int) ([]MessageEntry, string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	default:
+	}
+
+	var after uint64
+	if cursor != "" {
+		var err error
+		after, err = strconv.ParseUint(cursor, 16, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	start := sort.Search(len(db.order), func(i int) bool {
+		return db.order[i].seq > after
+	})
+
+	var entries []MessageEntry
+	next := cursor
+	for _, entry := range db.order[start:] {
+		if len(entries) == limit {
+			break
+		}
+		if db.seqs[entry.outpoint] != entry.seq {
+			continue
+		}
+		stored := db.messages[entry.outpoint]
+		entries = append(entries, MessageEntry{
+			Outpoint: entry.outpoint,
+			Data:     stored.data,
+			Meta:     stored.meta,
+		})
+		next = strconv.FormatUint(entry.seq, 16)
+	}
+	return entries, next, nil
+}
+
+// GetOutpointsByPubKey implements Database.
+func (db *MemoryDB) GetOutpointsByPubKey(ctx context.Context,
+	pubKey []byte) ([]message.Outpoint, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.senderOutpoints(pubKey), nil
+}
+
+// GetMessagesByPubKey implements Database.
+func (db *MemoryDB) GetMessagesByPubKey(ctx context.Context,
+	pubKey []byte) ([]MessageEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	outpoints := db.senderOutpoints(pubKey)
+	entries := make([]MessageEntry, 0, len(outpoints))
+	for _, outpoint := range outpoints {
+		stored := db.messages[outpoint]
+		entries = append(entries, MessageEntry{
+			Outpoint: outpoint,
+			Data:     stored.data,
+			Meta:     stored.meta,
+		})
+	}
+	return entries, nil
+}
+
+// ListChannelMessages implements Database. Like ListMessages, the cursor is
+// the sequence number of the last returned message.
+func (db *MemoryDB) ListChannelMessages(ctx context.Context, channel string,
+	cursor string, limit int) ([]MessageEntry, string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	default:
+	}
+
+	var after uint64
+	if cursor != "" {
+		var err error
+		after, err = strconv.ParseUint(cursor, 16, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	indexed := db.channels[channel]
+	outpoints := make([]message.Outpoint, 0, len(indexed))
+	for outpoint := range indexed {
+		if db.seqs[outpoint] > after {
+			outpoints = append(outpoints, outpoint)
+		}
+	}
+	db.sortBySeq(outpoints)
+	if len(outpoints) > limit {
+		outpoints = outpoints[:limit]
+	}
+
+	entries := make([]MessageEntry, 0, len(outpoints))
+	next := cursor
+	for _, outpoint := range outpoints {
+		stored := db.messages[outpoint]
+		entries = append(entries, MessageEntry{
+			Outpoint: outpoint,
+			Data:     stored.data,
+			Meta:     stored.meta,
+		})
+		next = strconv.FormatUint(db.seqs[outpoint], 16)
+	}
+	return entries, next, nil
+}
+
+// GetThread implements Database. Replies are followed breadth first from
+// root, so the deepest replies are the ones left out of a thread exceeding
+// MaxListLimit.
+func (db *MemoryDB) GetThread(ctx context.Context,
+	root message.Outpoint) ([]MessageEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var outpoints []message.Outpoint
+	if _, ok := db.messages[root]; ok {
+		outpoints = append(outpoints, root)
+	}
+
+	// A message can only reply to one other, but a malicious one may
+	// reply to itself or close a loop through a replacement
+	visited := map[message.Outpoint]struct{}{root: {}}
+	queue := []message.Outpoint{root}
+	for len(queue) > 0 && len(outpoints) < MaxListLimit {
+		parent := queue[0]
+		queue = queue[1:]
+		for reply := range db.replies[parent] {
+			if _, ok := visited[reply]; ok {
+				continue
+			}
+			visited[reply] = struct{}{}
+			queue = append(queue, reply)
+			outpoints = append(outpoints, reply)
+		}
+	}
+	if len(outpoints) > MaxListLimit {
+		outpoints = outpoints[:MaxListLimit]
+	}
+	db.sortBySeq(outpoints)
+
+	entries := make([]MessageEntry, 0, len(outpoints))
+	for _, outpoint := range outpoints {
+		stored := db.messages[outpoint]
+		entries = append(entries, MessageEntry{
+			Outpoint: outpoint,
+			Data:     stored.data,
+			Meta:     stored.meta,
+		})
+	}
+	return entries, nil
+}
+
+// GetChunkGroup implements Database.
+func (db *MemoryDB) GetChunkGroup(ctx context.Context,
+	group message.ChunkGroup) ([]MessageEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	indexed := db.chunks[group]
+	outpoints := make([]message.Outpoint, 0, len(indexed))
+	for outpoint := range indexed {
+		outpoints = append(outpoints, outpoint)
+	}
+	db.sortBySeq(outpoints)
+	if len(outpoints) > MaxListLimit {
+		outpoints = outpoints[:MaxListLimit]
+	}
+
+	entries := make([]MessageEntry, 0, len(outpoints))
+	for _, outpoint := range outpoints {
+		stored := db.messages[outpoint]
+		entries = append(entries, MessageEntry{
+			Outpoint: outpoint,
+			Data:     stored.data,
+			Meta:     stored.meta,
+		})
+	}
+	return entries, nil
+}
+
+// CountPayload implements Database.
+func (db *MemoryDB) CountPayload(ctx context.Context,
+	hash [32]byte) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.payloads[hash]) + db.suppressed[hash], nil
+}
+
+// SuppressPayload implements Database. Messages with a payload no stored
+// message has aren't counted, there would be nothing to forget them with.
+func (db *MemoryDB) SuppressPayload(ctx context.Context,
+	hash [32]byte) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored := len(db.payloads[hash])
+	if stored == 0 {
+		return 0, nil
+	}
+	db.suppressed[hash]++
+	return stored + db.suppressed[hash], nil
+}
+
+// TopPayloads implements Database.
+func (db *MemoryDB) TopPayloads(ctx context.Context,
+	limit int) ([]PayloadCount, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var counts []PayloadCount
+	for hash, indexed := range db.payloads {
+		count := len(indexed) + db.suppressed[hash]
+		if count > 1 {
+			counts = append(counts, PayloadCount{
+				Hash:   hash,
+				Count:  count,
+				Stored: len(indexed),
+			})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return bytes.Compare(counts[i].Hash[:], counts[j].Hash[:]) < 0
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+
+	for i := range counts {
+		indexed := db.payloads[counts[i].Hash]
+		outpoints := make([]message.Outpoint, 0, len(indexed))
+		for outpoint := range indexed {
+			outpoints = append(outpoints, outpoint)
+		}
+		db.sortBySeq(outpoints)
+		if len(outpoints) > MaxListLimit {
+			outpoints = outpoints[:MaxListLimit]
+		}
+		counts[i].Outpoints = outpoints
+	}
+	return counts, nil
+}
+
+// senderOutpoints returns the outpoints indexed under pubKey in insertion
+// order. The caller must hold the lock.
+func (db *MemoryDB) senderOutpoints(pubKey []byte) []message.Outpoint {
+	if len(pubKey) != 32 {
+		return nil
+	}
+
+	indexed := db.senders[[32]byte(pubKey)]
+	outpoints := make([]message.Outpoint, 0, len(indexed))
+	for outpoint := range indexed {
+		outpoints = append(outpoints, outpoint)
+	}
+	db.sortBySeq(outpoints)
+	return outpoints
+}
+
+// indexMessage adds a stored message to the sender, channel, reply, chunk,
+// payload and expiry indexes. The caller must hold the write lock.
+func (db *MemoryDB) indexMessage(outpoint message.Outpoint, meta MessageMeta) {
+	if len(meta.PubKey) == 32 {
+		addIndex(db.senders, [32]byte(meta.PubKey), outpoint)
+	}
+	if meta.Channel != "" {
+		addIndex(db.channels, meta.Channel, outpoint)
+	}
+	if meta.ReplyTo != nil {
+		addIndex(db.replies, *meta.ReplyTo, outpoint)
+	}
+	if meta.ChunkGroup != nil {
+		addIndex(db.chunks, *meta.ChunkGroup, outpoint)
+	}
+	if len(meta.PayloadHash) == 32 {
+		addIndex(db.payloads, [32]byte(meta.PayloadHash), outpoint)
+	}
+	if !meta.Expiry.IsZero() {
+		db.expiring[outpoint] = meta.Expiry
+	}
+
+	entries, bytes := indexSize(meta)
+	db.indexEntries += entries
+	db.indexBytes += bytes
+}
+
+// indexSize returns the number of index entries of a stored message with
+// meta and their approximate size.
+func indexSize(meta MessageMeta) (int, int64) {
+	var (
+		entries int
+		bytes   int64
+	)
+	if len(meta.PubKey) == 32 {
+		entries++
+		bytes += senderEntrySize
+	}
+	if meta.Channel != "" {
+		entries++
+		bytes += int64(len(meta.Channel) + message.OutpointSize)
+	}
+	if meta.ReplyTo != nil {
+		entries++
+		bytes += replyEntrySize
+	}
+	if meta.ChunkGroup != nil {
+		entries++
+		bytes += chunkEntrySize
+	}
+	if len(meta.PayloadHash) == 32 {
+		entries++
+		bytes += payloadEntrySize
+	}
+	if !meta.Expiry.IsZero() {
+		entries++
+		bytes += expiryEntrySize
+	}
+	return entries, bytes
+}
+
+// unindexMessage removes a stored message from the sender, channel, reply,
+// chunk, payload and expiry indexes. The count of suppressed messages with
+// its payload is dropped along with the last stored one. The caller must hold
+// the write lock.
+func (db *MemoryDB) unindexMessage(outpoint message.Outpoint) {
+	stored, ok := db.messages[outpoint]
+	if !ok {
+		return
+	}
+
+	meta := stored.meta
+	if len(meta.PubKey) == 32 {
+		removeIndex(db.senders, [32]byte(meta.PubKey), outpoint)
+	}
+	if meta.Channel != "" {
+		removeIndex(db.channels, meta.Channel, outpoint)
+	}
+	if meta.ReplyTo != nil {
+		removeIndex(db.replies, *meta.ReplyTo, outpoint)
+	}
+	if meta.ChunkGroup != nil {
+		removeIndex(db.chunks, *meta.ChunkGroup, outpoint)
+	}
+	if len(meta.PayloadHash) == 32 {
+		hash := [32]byte(meta.PayloadHash)
+		removeIndex(db.payloads, hash, outpoint)
+		if _, ok := db.payloads[hash]; !ok {
+			delete(db.suppressed, hash)
+		}
+	}
+	delete(db.expiring, outpoint)
+
+	entries, bytes := indexSize(meta)
+	db.indexEntries -= entries
+	db.indexBytes -= bytes
+}
+
+// addIndex adds outpoint to the set indexed under key.
+func addIndex[K comparable](index map[K]map[message.Outpoint]struct{},
+	key K, outpoint message.Outpoint) {
+
+	if index[key] == nil {
+		index[key] = make(map[message.Outpoint]struct{})
+	}
+	index[key][outpoint] = struct{}{}
+}
+
+// removeIndex removes outpoint from the set indexed under key, dropping the
+// set once empty.
+func removeIndex[K comparable](index map[K]map[message.Outpoint]struct{},
+	key K, outpoint message.Outpoint) {
+
+	delete(index[key], outpoint)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// sortBySeq sorts outpoints of stored messages in insertion order. The
+// caller must hold the lock.
+func (db *MemoryDB) sortBySeq(outpoints []message.Outpoint) {
+	sort.Slice(outpoints, func(i, j int) bool {
+		return db.seqs[outpoints[i]] < db.seqs[outpoints[j]]
+	})
+}
+
+// setMessage stores a message and appends it to the insertion order. The
+// caller must hold the write lock.
+func (db *MemoryDB) setMessage(outpoint message.Outpoint, msg storedMessage) {
+	if _, exists := db.seqs[outpoint]; exists {
+		db.messageBytes -= int64(len(db.messages[outpoint].data))
+		db.unindexMessage(outpoint)
+		db.stale++
+	}
+	delete(db.evicted, outpoint)
+	delete(db.expired, outpoint)
+
+	db.nextSeq++
+	db.messageBytes += int64(len(msg.data))
+	db.messages[outpoint] = msg
+	db.indexMessage(outpoint, msg.meta)
+	db.seqs[outpoint] = db.nextSeq
+	db.order = append(db.order, orderEntry{
+		seq:      db.nextSeq,
+		outpoint: outpoint,
+	})
+	db.compact()
+}
+
+// deleteMessage removes a stored message. The caller must hold the write
+// lock.
+func (db *MemoryDB) deleteMessage(outpoint message.Outpoint) {
+	delete(db.evicted, outpoint)
+	delete(db.expired, outpoint)
+	if _, exists := db.seqs[outpoint]; !exists {
+		return
+	}
+
+	db.dropMessage(outpoint)
+	db.compact()
+}
+
+// dropMessage removes a stored message without compacting the insertion
+// order. The caller must hold the write lock and check that the message is
+// stored.
+func (db *MemoryDB) dropMessage(outpoint message.Outpoint) {
+	db.messageBytes -= int64(len(db.messages[outpoint].data))
+	db.unindexMessage(outpoint)
+	delete(db.messages, outpoint)
+	delete(db.seqs, outpoint)
+	db.stale++
+}
+
+// compact drops the order entries of removed messages once they make up half
+// of the log. Sequence numbers are kept so outstanding cursors stay valid.
+// The caller must hold the write lock.
+func (db *MemoryDB) compact() {
+	if db.stale < 1024 || db.stale < len(db.order)/2 {
+		return
+	}
+	db.compactOrder()
+}
+
+// compactOrder drops the order entries of removed messages. The caller must
+// hold the write lock.
+func (db *MemoryDB) compactOrder() {
+	order := make([]orderEntry, 0, len(db.seqs))
+	for _, entry := range db.order {
+		if db.seqs[entry.outpoint] == entry.seq {
+			order = append(order, entry)
+		}
+	}
+	db.order = order
+	db.stale = 0
+	db.head = 0
+}
+
+// overBudget reports whether the stored messages exceed the storage budget.
+// The caller must hold the write lock.
+func (db *MemoryDB) overBudget() bool {
+	return (db.maxBytes > 0 && db.messageBytes > db.maxBytes) ||
+		(db.maxMessages > 0 && len(db.messages) > db.maxMessages)
+}
+
+// evict drops the oldest messages until the storage budget is met and
+// returns their outpoints. The outpoints are kept so evicted messages are not
+// accepted again. The caller must hold the write lock.
+func (db *MemoryDB) evict() []message.Outpoint {
+	var evicted []message.Outpoint
+	for db.overBudget() && db.head < len(db.order) {
+		entry := db.order[db.head]
+		db.head++
+		if db.seqs[entry.outpoint] != entry.seq {
+			continue
+		}
+		db.dropMessage(entry.outpoint)
+		db.evicted[entry.outpoint] = struct{}{}
+		evicted = append(evicted, entry.outpoint)
+	}
+	if len(evicted) == 0 {
+		return nil
+	}
+
+	log.Debugf("Evicted %d messages to stay within the storage budget, "+
+		"%d messages (%d bytes) remain", len(evicted), len(db.messages),
+		db.messageBytes)
+	db.compact()
+	return evicted
+}
+
+// notifyEvicted passes the outpoints of evicted messages to the evict
+// handler, if any. The caller must not hold the lock.
+func (db *MemoryDB) notifyEvicted(outpoints []message.Outpoint) {
+	if len(outpoints) > 0 && db.onEvicted != nil {
+		db.onEvicted(outpoints)
+	}
+}
+
+// SetEvictHandler implements Database.
+func (db *MemoryDB) SetEvictHandler(fn func(outpoints []message.Outpoint)) {
+	db.onEvicted = fn
 }
 
 // NewMemoryDB creates a new in-memory database.
 func NewMemoryDB() *MemoryDB {
-	return &MemoryDB{
+	return NewMemoryDBWithConfig(Config{Type: TypeMemory})
+}
+
+// NewMemoryDBWithConfig creates a new in-memory database with the specified
+// configuration.
+func NewMemoryDBWithConfig(cfg Config) *MemoryDB {
+	db := &MemoryDB{
 		outpoints: make(map[message.Outpoint]struct{}),
+		messages:  make(map[message.Outpoint]storedMessage),
+		removed:   make(map[chainhash.Hash][]removedEntry),
+		seqs:      make(map[message.Outpoint]uint64),
+		evicted:   make(map[message.Outpoint]struct{}),
+		senders:   make(map[[32]byte]map[message.Outpoint]struct{}),
+		channels:  make(map[string]map[message.Outpoint]struct{}),
+		replies:   make(map[message.Outpoint]map[message.Outpoint]struct{}),
+		chunks:    make(map[message.ChunkGroup]map[message.Outpoint]struct{}),
+		payloads:  make(map[[32]byte]map[message.Outpoint]struct{}),
+		expiring:  make(map[message.Outpoint]time.Time),
+		expired:   make(map[message.Outpoint]uint32),
+
+		storedSizes: make(map[message.Outpoint]int),
+		suppressed:  make(map[[32]byte]int),
+
+		maxBytes:    cfg.MaxMessageBytes,
+		maxMessages: cfg.MaxMessages,
+	}
+	if cfg.ArchiveExpired {
+		db.archive = make(map[message.Outpoint]storedMessage)
 	}
+	return db
 }
 
 // HasOutpoint checks if the outpoint has been seen before.
@@ -83,6 +864,8 @@ func (db *MemoryDB) RemoveOutpoint(
 	defer db.mu.Unlock()
 
 	delete(db.outpoints, outpoint)
+	delete(db.storedSizes, outpoint)
+	db.deleteMessage(outpoint)
 	return nil
 }
 
@@ -100,7 +883,320 @@ func (db *MemoryDB) RemoveOutpoints(
 
 	for _, outpoint := range outpoints {
 		delete(db.outpoints, outpoint)
+		delete(db.storedSizes, outpoint)
+		db.deleteMessage(outpoint)
+	}
+	return nil
+}
+
+// ListOutpoints implements Database.
+func (db *MemoryDB) ListOutpoints(
+	ctx context.Context) ([]message.Outpoint, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	outpoints := make([]message.Outpoint, 0, len(db.outpoints))
+	for outpoint := range db.outpoints {
+		outpoints = append(outpoints, outpoint)
+	}
+	sort.Slice(outpoints, func(i, j int) bool {
+		return bytes.Compare(outpoints[i][:], outpoints[j][:]) < 0
+	})
+	return outpoints, nil
+}
+
+// RemoveBlockOutpoints removes the outpoints spent by a block and remembers
+// the ones that were present so RestoreBlockOutpoints can bring them back.
+// Their messages are moved to the archive if it is enabled.
+func (db *MemoryDB) RemoveBlockOutpoints(ctx context.Context,
+	blockHash chainhash.Hash, outpoints []message.Outpoint) (
+	[]message.Outpoint, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var (
+		entries []removedEntry
+		removed []message.Outpoint
+	)
+	for _, outpoint := range outpoints {
+		if _, exists := db.outpoints[outpoint]; !exists {
+			continue
+		}
+		_, evicted := db.evicted[outpoint]
+		expiredSeq, expired := db.expired[outpoint]
+		entry := removedEntry{
+			outpoint:   outpoint,
+			evicted:    evicted,
+			storedSize: db.storedSizes[outpoint],
+			expired:    expired,
+			expiredSeq: expiredSeq,
+		}
+		if stored, ok := db.messages[outpoint]; ok {
+			entry.msg = &stored
+			if db.archive != nil {
+				db.archiveBytes += int64(len(stored.data) -
+					len(db.archive[outpoint].data))
+				db.archive[outpoint] = stored
+			}
+		}
+		db.undoEntries++
+		db.undoBytes += entry.size()
+		entries = append(entries, entry)
+		removed = append(removed, outpoint)
+		delete(db.outpoints, outpoint)
+		delete(db.storedSizes, outpoint)
+		db.deleteMessage(outpoint)
+	}
+	db.removed[blockHash] = append(db.removed[blockHash], entries...)
+	return removed, nil
+}
+
+// ExpireMessages implements Database.
+func (db *MemoryDB) ExpireMessages(ctx context.Context,
+	now time.Time) ([]message.Outpoint, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var expired []message.Outpoint
+	for outpoint, expiry := range db.expiring {
+		if expiry.After(now) {
+			continue
+		}
+
+		// Stored messages were validated, so they always parse
+		var sequence uint32
+		if msg, err := message.Deserialize(db.messages[outpoint].data); err == nil {
+			sequence = msg.Sequence
+		}
+		db.dropMessage(outpoint)
+		db.expired[outpoint] = sequence
+		expired = append(expired, outpoint)
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	db.compact()
+
+	sort.Slice(expired, func(i, j int) bool {
+		return bytes.Compare(expired[i][:], expired[j][:]) < 0
+	})
+	return expired, nil
+}
+
+// GetExpiredSequence implements Database.
+func (db *MemoryDB) GetExpiredSequence(ctx context.Context,
+	outpoint message.Outpoint) (uint32, bool, error) {
+	select {
+	case <-ctx.Done():
+		return 0, false, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	sequence, ok := db.expired[outpoint]
+	return sequence, ok, nil
+}
+
+// GetArchivedMessage implements Database.
+func (db *MemoryDB) GetArchivedMessage(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stored, ok := db.archive[outpoint]
+	if !ok {
+		return nil, nil
+	}
+	return stored.data, nil
+}
+
+// RestoreBlockOutpoints restores the outpoints removed by a block.
+func (db *MemoryDB) RestoreBlockOutpoints(ctx context.Context,
+	blockHash chainhash.Hash) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	// Restored messages may push others out, which is reported once the
+	// lock is released
+	var evicted []message.Outpoint
+	defer func() { db.notifyEvicted(evicted) }()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entries := db.removed[blockHash]
+	for _, entry := range entries {
+		db.outpoints[entry.outpoint] = struct{}{}
+		if entry.storedSize > 0 {
+			db.storedSizes[entry.outpoint] = entry.storedSize
+		}
+		if entry.msg != nil {
+			db.setMessage(entry.outpoint, *entry.msg)
+			db.archiveBytes -= int64(len(db.archive[entry.outpoint].data))
+			delete(db.archive, entry.outpoint)
+		}
+		if entry.evicted {
+			db.evicted[entry.outpoint] = struct{}{}
+		}
+		if entry.expired {
+			db.expired[entry.outpoint] = entry.expiredSeq
+		}
 	}
+	db.forgetEntries(entries)
+	delete(db.removed, blockHash)
+	evicted = db.evict()
+
+	log.Debugf("Restored %d outpoints removed by block %s", len(entries),
+		blockHash)
+	return nil
+}
+
+// ForgetBlock discards the restore record of a block.
+func (db *MemoryDB) ForgetBlock(ctx context.Context,
+	blockHash chainhash.Hash) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.forgetEntries(db.removed[blockHash])
+	delete(db.removed, blockHash)
+	return nil
+}
+
+// forgetEntries removes the restore entries of a block from the undo sizes.
+// The caller must hold the write lock.
+func (db *MemoryDB) forgetEntries(entries []removedEntry) {
+	for _, entry := range entries {
+		db.undoEntries--
+		db.undoBytes -= entry.size()
+	}
+}
+
+// size returns the approximate size of a restore entry.
+func (e *removedEntry) size() int64 {
+	size := int64(outpointEntrySize)
+	if e.msg != nil {
+		size += int64(len(e.msg.data))
+	}
+	return size
+}
+
+// Stats implements Database. The sizes are kept up to date as entries are
+// added and removed, so the call doesn't depend on the number of entries.
+func (db *MemoryDB) Stats(ctx context.Context) (*Stats, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return &Stats{
+		Outpoints: KeyspaceStats{
+			Entries: len(db.outpoints),
+			Bytes:   int64(len(db.outpoints)) * outpointEntrySize,
+		},
+		Messages: KeyspaceStats{
+			Entries: len(db.messages),
+			Bytes:   db.messageBytes,
+		},
+		Indexes: KeyspaceStats{
+			Entries: db.indexEntries,
+			Bytes:   db.indexBytes,
+		},
+		Archive: KeyspaceStats{
+			Entries: len(db.archive),
+			Bytes:   db.archiveBytes,
+		},
+		Expired: KeyspaceStats{
+			Entries: len(db.expired),
+			Bytes:   int64(len(db.expired)) * expiredEntrySize,
+		},
+		Undo: KeyspaceStats{
+			Entries: db.undoEntries,
+			Bytes:   db.undoBytes,
+		},
+		Tombstones: KeyspaceStats{
+			Entries: db.stale,
+			Bytes:   int64(db.stale) * orderEntrySize,
+		},
+	}, nil
+}
+
+// Compact implements Database. The insertion order entries of removed
+// messages are dropped and the maps keyed by outpoint are rebuilt, since Go
+// maps keep the memory of deleted keys.
+func (db *MemoryDB) Compact(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stale := db.stale
+	db.compactOrder()
+	db.outpoints = rebuildMap(db.outpoints)
+	db.messages = rebuildMap(db.messages)
+	db.seqs = rebuildMap(db.seqs)
+	db.storedSizes = rebuildMap(db.storedSizes)
+	db.expiring = rebuildMap(db.expiring)
+	db.expired = rebuildMap(db.expired)
+	db.evicted = rebuildMap(db.evicted)
+
+	log.Debugf("Compacted database, dropped %d stale entries", stale)
+	return nil
+}
+
+// rebuildMap returns a copy of m sized for its current entries.
+func rebuildMap[K comparable, V any](m map[K]V) map[K]V {
+	rebuilt := make(map[K]V, len(m))
+	for key, value := range m {
+		rebuilt[key] = value
+	}
+	return rebuilt
+}
+
+// Flush returns immediately, writes are applied as they are made.
+func (db *MemoryDB) Flush(ctx context.Context) error {
 	return nil
 }
 
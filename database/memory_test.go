@@ -0,0 +1,515 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// addTestMessages stores messages for the outpoints from batchOutpoint(first)
+// to batchOutpoint(first+n-1) in db.
+func addTestMessages(t *testing.T, db Database, first, n int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := first; i < first+n; i++ {
+		outpoint := batchOutpoint(i)
+		err := db.AddMessage(ctx, outpoint, batchMessage(outpoint),
+			MessageMeta{Source: "test"})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+}
+
+// TestListMessagesPages checks that 2500 messages are walked in three pages
+// in insertion order without duplicates or gaps, and that a message added
+// during the walk comes after them.
+func TestListMessagesPages(t *testing.T) {
+	const total = 2500
+
+	ctx := context.Background()
+	db := NewMemoryDB()
+	addTestMessages(t, db, 0, total)
+
+	var (
+		cursor string
+		seen   = make(map[message.Outpoint]bool)
+		pages  []int
+	)
+	for {
+		entries, next, err := db.ListMessages(ctx, cursor, MaxListLimit)
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if len(entries) == 0 {
+			if next != cursor {
+				t.Fatalf("empty page moved the cursor to %q", next)
+			}
+			break
+		}
+		pages = append(pages, len(entries))
+		for _, entry := range entries {
+			want := batchOutpoint(len(seen))
+			if entry.Outpoint != want || seen[entry.Outpoint] {
+				t.Fatalf("entry %d is %s, want %s", len(seen),
+					entry.Outpoint.ToString(), want.ToString())
+			}
+			if !bytes.Equal(entry.Data, batchMessage(want)) ||
+				entry.Meta.Source != "test" {
+
+				t.Fatalf("entry %s has data %x and source %q",
+					want.ToString(), entry.Data, entry.Meta.Source)
+			}
+			seen[entry.Outpoint] = true
+		}
+
+		// A message stored during the walk is listed after the others
+		if len(pages) == 1 {
+			addTestMessages(t, db, total, 1)
+		}
+		cursor = next
+	}
+
+	want := []int{MaxListLimit, MaxListLimit, total + 1 - 2*MaxListLimit}
+	if len(pages) != len(want) || pages[0] != want[0] ||
+		pages[1] != want[1] || pages[2] != want[2] {
+
+		t.Fatalf("got pages of %v messages, want %v", pages, want)
+	}
+}
+
+// TestListMessagesLimit checks that the limit is capped at MaxListLimit, and
+// that a limit of zero selects it.
+func TestListMessagesLimit(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	addTestMessages(t, db, 0, MaxListLimit+10)
+
+	for _, limit := range []int{0, -1, MaxListLimit + 1, 10 * MaxListLimit} {
+		entries, _, err := db.ListMessages(ctx, "", limit)
+		if err != nil || len(entries) != MaxListLimit {
+			t.Fatalf("limit %d listed %d messages, %v, want %d", limit,
+				len(entries), err, MaxListLimit)
+		}
+	}
+	entries, next, err := db.ListMessages(ctx, "", 3)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("limit 3 listed %d messages, %v", len(entries), err)
+	}
+	entries, _, err = db.ListMessages(ctx, next, 3)
+	if err != nil || len(entries) != 3 || entries[0].Outpoint !=
+		batchOutpoint(3) {
+
+		t.Fatalf("second page of 3 starts at %v, %v", entries, err)
+	}
+
+	_, _, err = db.ListMessages(ctx, "not a cursor", 3)
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("bad cursor got %v, want ErrInvalidCursor", err)
+	}
+}
+
+// TestListMessagesEmpty checks that an empty database lists no messages and
+// leaves the cursor unchanged.
+func TestListMessagesEmpty(t *testing.T) {
+	db := NewMemoryDB()
+	entries, next, err := db.ListMessages(context.Background(), "", 0)
+	if err != nil || len(entries) != 0 || next != "" {
+		t.Fatalf("got %d messages, cursor %q, %v", len(entries), next, err)
+	}
+}
+
+// TestMessageMeta checks that the metadata stored with a message is returned
+// by GetMessageMeta while GetMessage returns the message as it was received.
+func TestMessageMeta(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+
+	outpoint := batchOutpoint(1)
+	data := batchMessage(outpoint)
+	meta := MessageMeta{
+		ReceivedAt:     time.Unix(1700000000, 0),
+		Source:         "10.0.0.1:8335",
+		ValidationTime: 3 * time.Millisecond,
+	}
+	if err := db.AddMessage(ctx, outpoint, data, meta); err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+
+	got, err := db.GetMessage(ctx, outpoint)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("GetMessage gave %x, %v, want %x", got, err, data)
+	}
+	gotMeta, err := db.GetMessageMeta(ctx, outpoint)
+	if err != nil || gotMeta == nil {
+		t.Fatalf("GetMessageMeta gave %v, %v", gotMeta, err)
+	}
+	if !gotMeta.ReceivedAt.Equal(meta.ReceivedAt) ||
+		gotMeta.Source != meta.Source ||
+		gotMeta.ValidationTime != meta.ValidationTime {
+
+		t.Fatalf("got meta %+v, want %+v", gotMeta, meta)
+	}
+
+	// A message that isn't stored has no metadata
+	gotMeta, err = db.GetMessageMeta(ctx, batchOutpoint(2))
+	if err != nil || gotMeta != nil {
+		t.Fatalf("unknown outpoint gave %v, %v", gotMeta, err)
+	}
+}
+
+// TestArchiveExpired checks that the message of a spent outpoint is kept in
+// the archive when it is enabled, and dropped otherwise.
+func TestArchiveExpired(t *testing.T) {
+	ctx := context.Background()
+	outpoint := batchOutpoint(1)
+
+	for _, archive := range []bool{false, true} {
+		db := NewMemoryDBWithConfig(Config{ArchiveExpired: archive})
+		addTestMessages(t, db, 1, 1)
+		removed, err := db.RemoveBlockOutpoints(ctx, chainhash.Hash{1},
+			[]message.Outpoint{outpoint, batchOutpoint(2)})
+		if err != nil || len(removed) != 1 || removed[0] != outpoint {
+			t.Fatalf("archive %v: removed %v, %v", archive, removed, err)
+		}
+
+		data, err := db.GetMessage(ctx, outpoint)
+		if err != nil || data != nil {
+			t.Fatalf("archive %v: spent message still stored: %x, %v",
+				archive, data, err)
+		}
+		archived, err := db.GetArchivedMessage(ctx, outpoint)
+		if err != nil {
+			t.Fatalf("GetArchivedMessage: %v", err)
+		}
+		switch {
+		case archive && !bytes.Equal(archived, batchMessage(outpoint)):
+			t.Fatalf("archived %x, want the message", archived)
+		case !archive && archived != nil:
+			t.Fatalf("archived %x with the archive disabled", archived)
+		}
+	}
+}
+
+// TestSenderIndex checks that messages are found by the key of their UTXO,
+// and that a message leaves the index when its outpoint is spent.
+func TestSenderIndex(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	key, other := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	for i, pubKey := range [][]byte{key, other, key} {
+		outpoint := batchOutpoint(i)
+		err := db.AddMessage(ctx, outpoint, batchMessage(outpoint),
+			MessageMeta{Source: "test", PubKey: pubKey})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+
+	outpoints, err := db.GetOutpointsByPubKey(ctx, key)
+	if err != nil || len(outpoints) != 2 {
+		t.Fatalf("got %d outpoints for the key, %v, want 2",
+			len(outpoints), err)
+	}
+	entries, err := db.GetMessagesByPubKey(ctx, key)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("got %d messages for the key, %v, want 2", len(entries),
+			err)
+	}
+	for _, entry := range entries {
+		if entry.Outpoint != batchOutpoint(0) &&
+			entry.Outpoint != batchOutpoint(2) ||
+			!bytes.Equal(entry.Data, batchMessage(entry.Outpoint)) {
+
+			t.Fatalf("got message %x of %s for the key", entry.Data,
+				entry.Outpoint.ToString())
+		}
+	}
+
+	_, err = db.RemoveBlockOutpoints(ctx, chainhash.Hash{1},
+		[]message.Outpoint{batchOutpoint(0)})
+	if err != nil {
+		t.Fatalf("RemoveBlockOutpoints: %v", err)
+	}
+	outpoints, err = db.GetOutpointsByPubKey(ctx, key)
+	if err != nil || len(outpoints) != 1 || outpoints[0] != batchOutpoint(2) {
+		t.Fatalf("got %v, %v after the spend", outpoints, err)
+	}
+	entries, err = db.GetMessagesByPubKey(ctx, other)
+	if err != nil || len(entries) != 1 || entries[0].Outpoint !=
+		batchOutpoint(1) {
+
+		t.Fatalf("got %v, %v for the other key", entries, err)
+	}
+}
+
+// addStructured stores a message for batchOutpoint(i) indexed with the
+// channel and reply_to of its structured payload.
+func addStructured(t *testing.T, db Database, i int, channel string,
+	replyTo *message.Outpoint) {
+
+	t.Helper()
+
+	outpoint := batchOutpoint(i)
+	err := db.AddMessage(context.Background(), outpoint,
+		batchMessage(outpoint), MessageMeta{
+			Source:  "test",
+			Channel: channel,
+			ReplyTo: replyTo,
+		})
+	if err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+}
+
+// outpointsOf returns the outpoints of entries.
+func outpointsOf(entries []MessageEntry) []message.Outpoint {
+	outpoints := make([]message.Outpoint, len(entries))
+	for i, entry := range entries {
+		outpoints[i] = entry.Outpoint
+	}
+	return outpoints
+}
+
+// TestThread checks that the thread of a message holds it and the replies
+// chaining to it three deep, in insertion order, and nothing else.
+func TestThread(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+
+	// 0 <- 1 <- 2 <- 3, with 4 replying to a message never stored and 5
+	// unstructured
+	addStructured(t, db, 0, "", nil)
+	for i := 1; i <= 3; i++ {
+		parent := batchOutpoint(i - 1)
+		addStructured(t, db, i, "", &parent)
+	}
+	missing := batchOutpoint(9)
+	addStructured(t, db, 4, "", &missing)
+	addTestMessages(t, db, 5, 1)
+
+	tests := []struct {
+		root message.Outpoint
+		want []int
+	}{
+		{batchOutpoint(0), []int{0, 1, 2, 3}},
+		{batchOutpoint(2), []int{2, 3}},
+		{batchOutpoint(3), []int{3}},
+		{missing, []int{4}},
+		{batchOutpoint(5), []int{5}},
+	}
+	for _, test := range tests {
+		entries, err := db.GetThread(ctx, test.root)
+		if err != nil {
+			t.Fatalf("GetThread: %v", err)
+		}
+		got := outpointsOf(entries)
+		if len(got) != len(test.want) {
+			t.Fatalf("thread of %s has %d messages, want %d",
+				test.root.ToString(), len(got), len(test.want))
+		}
+		for i, want := range test.want {
+			if got[i] != batchOutpoint(want) {
+				t.Fatalf("message %d of the thread of %s is %s, want %s",
+					i, test.root.ToString(), got[i].ToString(),
+					batchOutpoint(want).ToString())
+			}
+		}
+	}
+}
+
+// TestListChannelMessages checks that listing a channel pages through its
+// messages alone in insertion order, while ListMessages still lists the
+// structured and unstructured messages together.
+func TestListChannelMessages(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+
+	var general []message.Outpoint
+	for i := 0; i < 9; i++ {
+		switch i % 3 {
+		case 0:
+			addStructured(t, db, i, "general", nil)
+			general = append(general, batchOutpoint(i))
+		case 1:
+			addStructured(t, db, i, "random", nil)
+		default:
+			addTestMessages(t, db, i, 1)
+		}
+	}
+
+	var (
+		got    []message.Outpoint
+		cursor string
+	)
+	for {
+		entries, next, err := db.ListChannelMessages(ctx, "general",
+			cursor, 2)
+		if err != nil {
+			t.Fatalf("ListChannelMessages: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		got = append(got, outpointsOf(entries)...)
+		cursor = next
+	}
+	if len(got) != len(general) || got[0] != general[0] ||
+		got[1] != general[1] || got[2] != general[2] {
+
+		t.Fatalf("listed %v in the channel, want %v", got, general)
+	}
+
+	entries, _, err := db.ListChannelMessages(ctx, "none", "", 0)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("unknown channel listed %d messages, %v", len(entries),
+			err)
+	}
+	entries, _, err = db.ListMessages(ctx, "", 0)
+	if err != nil || len(entries) != 9 {
+		t.Fatalf("listed %d messages in all, %v, want 9", len(entries), err)
+	}
+}
+
+// TestStatsCompact checks that after adding 10k outpoints and removing half
+// of them, the stats count the remaining outpoints and messages, and that
+// compacting drops the tombstones and keeps every lookup answering as
+// before.
+func TestStatsCompact(t *testing.T) {
+	const (
+		total    = 10000
+		messages = 100
+	)
+
+	ctx := context.Background()
+	db := NewMemoryDB()
+	for i := 0; i < total; i++ {
+		if err := db.AddOutpoint(ctx, batchOutpoint(i)); err != nil {
+			t.Fatalf("AddOutpoint: %v", err)
+		}
+	}
+	addTestMessages(t, db, 0, messages)
+
+	// Every other outpoint is spent, half of those with a message
+	var removed []message.Outpoint
+	for i := 0; i < total; i += 2 {
+		removed = append(removed, batchOutpoint(i))
+	}
+	if err := db.RemoveOutpoints(ctx, removed); err != nil {
+		t.Fatalf("RemoveOutpoints: %v", err)
+	}
+
+	check := func(when string) *Stats {
+		t.Helper()
+
+		stats, err := db.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Stats %s: %v", when, err)
+		}
+		if stats.Outpoints.Entries != total/2 ||
+			stats.Messages.Entries != messages/2 {
+
+			t.Fatalf("%s: %d outpoints and %d messages, want %d and %d",
+				when, stats.Outpoints.Entries, stats.Messages.Entries,
+				total/2, messages/2)
+		}
+		if stats.Outpoints.Bytes == 0 || stats.Messages.Bytes == 0 {
+			t.Fatalf("%s: stats without sizes: %+v", when, stats)
+		}
+		return stats
+	}
+	if stats := check("before compacting"); stats.Tombstones.Entries == 0 {
+		t.Fatal("no tombstones left by the removed messages")
+	}
+
+	if err := db.Compact(ctx); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if stats := check("after compacting"); stats.Tombstones.Entries != 0 {
+		t.Fatalf("%d tombstones left after compacting",
+			stats.Tombstones.Entries)
+	}
+
+	for i := 0; i < total; i++ {
+		outpoint := batchOutpoint(i)
+		known, err := db.HasOutpoint(ctx, outpoint)
+		if err != nil || known != (i%2 == 1) {
+			t.Fatalf("outpoint %d known: %v, %v", i, known, err)
+		}
+		if i >= messages {
+			continue
+		}
+		data, err := db.GetMessage(ctx, outpoint)
+		if err != nil || (data != nil) != (i%2 == 1) {
+			t.Fatalf("message %d stored: %v, %v", i, data != nil, err)
+		}
+	}
+	entries, _, err := db.ListMessages(ctx, "", MaxListLimit)
+	if err != nil || len(entries) != messages/2 {
+		t.Fatalf("listed %d messages, %v, want %d", len(entries), err,
+			messages/2)
+	}
+}
+
+// TestPayloadIndex checks that messages are counted by payload hash, stored
+// or suppressed, and that the index entries and the suppressed count are
+// dropped once the messages with the payload are removed.
+func TestPayloadIndex(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	hash := [32]byte{1}
+
+	// A payload nothing stored has isn't counted as suppressed
+	if count, err := db.SuppressPayload(ctx, hash); err != nil ||
+		count != 0 {
+
+		t.Fatalf("suppressed unstored payload: %d, %v", count, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		outpoint := batchOutpoint(i)
+		err := db.AddMessage(ctx, outpoint, batchMessage(outpoint),
+			MessageMeta{PayloadHash: hash[:]})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.SuppressPayload(ctx, hash); err != nil {
+			t.Fatalf("SuppressPayload: %v", err)
+		}
+	}
+	if count, err := db.CountPayload(ctx, hash); err != nil || count != 5 {
+		t.Fatalf("payload counted %d times, %v, want 5", count, err)
+	}
+	top, err := db.TopPayloads(ctx, 10)
+	if err != nil || len(top) != 1 || top[0].Count != 5 ||
+		top[0].Stored != 3 || len(top[0].Outpoints) != 3 ||
+		top[0].Outpoints[0] != batchOutpoint(0) {
+
+		t.Fatalf("top payloads %+v, %v", top, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.RemoveOutpoint(ctx, batchOutpoint(i)); err != nil {
+			t.Fatalf("RemoveOutpoint: %v", err)
+		}
+	}
+	if count, err := db.CountPayload(ctx, hash); err != nil || count != 0 {
+		t.Fatalf("removed payload counted %d times, %v", count, err)
+	}
+	if top, err := db.TopPayloads(ctx, 10); err != nil || len(top) != 0 {
+		t.Fatalf("top payloads after removal %+v, %v", top, err)
+	}
+	if len(db.payloads) != 0 || len(db.suppressed) != 0 {
+		t.Fatalf("%d payload index entries and %d suppressed counts left",
+			len(db.payloads), len(db.suppressed))
+	}
+}
@@ -1,12 +1,19 @@
 package database
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/shaibearary/utxo_chat/bitcoin"
 	"github.com/shaibearary/utxo_chat/message"
@@ -14,113 +21,497 @@ import (
 	bip322 "github.com/unisat-wallet/libbrc20-indexer/utils/bip322"
 )
 
+var (
+	// ErrInvalidContent is returned when a message payload does not match
+	// its declared content type.
+	ErrInvalidContent = errors.New("invalid content")
+
+	// ErrUTXOBelowMinimum is returned when the UTXO backing a message is
+	// worth less than the configured minimum value.
+	ErrUTXOBelowMinimum = errors.New("utxo value below minimum")
+
+	// ErrScriptMismatch is returned when the script a message is verified
+	// against is not the script of the UTXO it claims.
+	ErrScriptMismatch = errors.New("script does not match utxo")
+
+	// ErrUnconfirmedOutpoint is returned when the UTXO backing a message
+	// has fewer confirmations than required. The message may be accepted
+	// once the UTXO confirms.
+	ErrUnconfirmedOutpoint = errors.New("unconfirmed outpoint")
+
+	// ErrOutpointBudgetExceeded is returned when a message would push the
+	// payload bytes stored for its outpoint over the configured budget.
+	ErrOutpointBudgetExceeded = errors.New("outpoint byte budget exceeded")
+)
+
+// ValidatorConfig holds configuration options for the message validator.
+type ValidatorConfig struct {
+	// MinUtxoValue is the minimum value in satoshis of a UTXO backing a
+	// message. Zero disables the check.
+	MinUtxoValue int64
+
+	// MinConfirmations is the number of confirmations the UTXO backing a
+	// message needs. Zero accepts UTXOs still in the mempool.
+	MinConfirmations int64
+
+	// MaxOutpointBytes is the number of payload bytes a single UTXO can
+	// anchor across all versions of its message. Zero disables the check.
+	MaxOutpointBytes int
+
+	// Limits are the size limits of the messages accepted, at most the
+	// protocol limits.
+	Limits message.Limits
+}
+
+// DefaultMaxOutpointBytes is the default payload byte budget of a UTXO.
+const DefaultMaxOutpointBytes = 65536
+
+// ExpiryClockSkew is how long after the expiry declared by its structured
+// payload a message is still accepted, allowing for clocks that run ahead of
+// the sender's.
+const ExpiryClockSkew = 2 * time.Minute
+
+// DefaultValidatorConfig returns the default configuration for the validator.
+func DefaultValidatorConfig() ValidatorConfig {
+	return ValidatorConfig{
+		MinUtxoValue:     10000,
+		MinConfirmations: 1,
+		MaxOutpointBytes: DefaultMaxOutpointBytes,
+		Limits:           message.DefaultLimits(),
+	}
+}
+
 // Validator handles message validation including UTXO ownership and signatures.
 type Validator struct {
-	client *bitcoin.Client
+	client bitcoin.ChainClient
 	db     Database
+	config ValidatorConfig
 }
 
 // NewValidator creates a new message validator.
-func NewValidator(client *bitcoin.Client, db Database) *Validator {
+func NewValidator(client bitcoin.ChainClient, db Database) *Validator {
+	return NewValidatorWithConfig(client, db, DefaultValidatorConfig())
+}
+
+// NewValidatorWithConfig creates a new message validator with the specified
+// configuration.
+func NewValidatorWithConfig(client bitcoin.ChainClient, db Database,
+	config ValidatorConfig) *Validator {
+
 	return &Validator{
 		client: client,
 		db:     db,
+		config: config,
 	}
 }
 
+// Limits returns the size limits of the messages the validator accepts.
+func (v *Validator) Limits() message.Limits {
+	return v.config.Limits
+}
+
 // ValidateMessage validates a message including UTXO ownership and signature.
+// A message for an outpoint that already has one is only accepted as a
+// replacement with a strictly greater sequence number.
 func (v *Validator) ValidateMessage(
 	ctx context.Context, msg *message.Message, pkScript []byte) error {
 
+	if err := v.checkMessage(ctx, msg); err != nil {
+		return err
+	}
+	validLog.Tracef("Validating message - Outpoint: %s, PubKey: %x",
+		msg.Outpoint.ToString(), pkScript)
+
+	// Verify UTXO ownership. The signature is checked against the script
+	// recomputed from the UTXO, never against one supplied by the sender.
+	if err := v.VerifyUTXOOwnership(ctx, msg.Outpoint, pkScript); err != nil {
+		return fmt.Errorf("UTXO verification failed: %w", err)
+	}
+	messageStr := string(msg.SignedData())
+
+	// An invalid signature must never reach the database, otherwise the
+	// message would be stored and relayed
+	if err := v.VerifyWitness(messageStr, msg.SignatureWitness(), pkScript); err != nil {
+		return err
+	}
+
+	// Add outpoint to the database
+	if err := v.db.AddOutpoint(ctx, msg.Outpoint); err != nil {
+		return fmt.Errorf("failed to add outpoint to database: %v", err)
+	}
+
+	return nil
+}
+
+// checkMessage runs the checks of a message that don't need its UTXO: that
+// its payload is within the size limits, that it replaces the message stored
+// for its outpoint, if any, that its payload matches its content type,
+// hasn't expired and fits the outpoint's budget.
+func (v *Validator) checkMessage(ctx context.Context,
+	msg *message.Message) error {
+
+	if err := v.config.Limits.CheckPayload(len(msg.Payload)); err != nil {
+		return err
+	}
+
 	seen, err := v.db.HasOutpoint(ctx, msg.Outpoint)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
 
 	if seen {
-		return fmt.Errorf("outpoint already seen")
+		if err := v.checkReplacement(ctx, msg); err != nil {
+			return err
+		}
 	}
-	// Log pubkey hex and outpoint for debugging
-	hash, vout := msg.Outpoint.ToTxidIdx()
-	fmt.Printf("Validating message - Outpoint: %s:%d, PubKey: %s\n",
-		hash.String(), vout, pkScript)
 
-	// Verify UTXO ownership
-	// if err := v.VerifyUTXOOwnership(ctx, msg.Outpoint, pkScript); err != nil {
-	// 	return fmt.Errorf("UTXO verification failed: %v", err)
-	// }
-	messageStr := string(msg.Payload)
+	// Reject payloads that don't match their declared content type, such as
+	// invalid UTF-8 in a text message
+	if err := msg.ValidateContent(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidContent, err)
+	}
 
-	if err := v.VerifySignature(messageStr, msg.Signature[:], pkScript); err != nil {
-		return fmt.Errorf("signature verification failed: %v", err)
+	if err := checkExpiry(msg, time.Now()); err != nil {
+		return err
 	}
 
-	// Add outpoint to the database
-	if err := v.db.AddOutpoint(ctx, msg.Outpoint); err != nil {
-		return fmt.Errorf("failed to add outpoint to database: %v", err)
+	return v.checkBudget(ctx, msg)
+}
+
+// checkReplacement returns message.ErrDuplicateOutpoint unless msg has a
+// greater sequence number than the message stored for its outpoint.
+func (v *Validator) checkReplacement(ctx context.Context,
+	msg *message.Message) error {
+
+	if msg.Sequence == 0 {
+		return message.ErrDuplicateOutpoint
 	}
 
+	storedData, err := v.db.GetMessage(ctx, msg.Outpoint)
+	if err != nil && !errors.Is(err, ErrEvicted) {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if storedData == nil {
+		return v.checkExpiredReplacement(ctx, msg)
+	}
+
+	stored, err := message.Deserialize(storedData)
+	if err != nil {
+		return fmt.Errorf("failed to parse stored message: %v", err)
+	}
+	if msg.Sequence <= stored.Sequence {
+		return fmt.Errorf("%w: sequence %d does not replace %d",
+			message.ErrDuplicateOutpoint, msg.Sequence, stored.Sequence)
+	}
 	return nil
 }
 
-// VerifyUTXOOwnership verifies that the given public key owns the specified UTXO.
+// checkExpiredReplacement returns message.ErrDuplicateOutpoint unless msg has a
+// greater sequence number than the message dropped for its outpoint once it
+// expired.
+func (v *Validator) checkExpiredReplacement(ctx context.Context,
+	msg *message.Message) error {
+
+	sequence, expired, err := v.db.GetExpiredSequence(ctx, msg.Outpoint)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if !expired {
+		// Without the stored message its sequence is unknown
+		return message.ErrDuplicateOutpoint
+	}
+	if msg.Sequence <= sequence {
+		return fmt.Errorf("%w: sequence %d does not replace expired %d",
+			message.ErrDuplicateOutpoint, msg.Sequence, sequence)
+	}
+	return nil
+}
+
+// checkExpiry returns message.ErrExpired if the structured payload of msg
+// declares an expiry more than ExpiryClockSkew before now.
+func checkExpiry(msg *message.Message, now time.Time) error {
+	payload, err := message.ParsePayload(msg.Payload)
+	if err != nil || payload.Expiry.IsZero() {
+		return nil
+	}
+	if payload.Expiry.Add(ExpiryClockSkew).Before(now) {
+		return fmt.Errorf("%w: at %v", message.ErrExpired,
+			payload.Expiry.UTC())
+	}
+	return nil
+}
+
+// checkBudget returns ErrOutpointBudgetExceeded if storing msg would push the
+// payload bytes stored for its outpoint over MaxOutpointBytes.
+func (v *Validator) checkBudget(ctx context.Context,
+	msg *message.Message) error {
+
+	if v.config.MaxOutpointBytes <= 0 {
+		return nil
+	}
+
+	stored, err := v.db.GetStoredSize(ctx, msg.Outpoint)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if stored+len(msg.Payload) > v.config.MaxOutpointBytes {
+		return fmt.Errorf("%w: %d bytes stored, %d more exceed %d",
+			ErrOutpointBudgetExceeded, stored, len(msg.Payload),
+			v.config.MaxOutpointBytes)
+	}
+	return nil
+}
+
+// VerifyUTXOOwnership verifies that pkScript is the script of the specified
+// UTXO. The expected script is recomputed from the key or key hash in the
+// UTXO's scriptPubKey, see GetPKScript.
 func (v *Validator) VerifyUTXOOwnership(
 	ctx context.Context, outpoint message.Outpoint, pkScript []byte) error {
 	hash, vout := outpoint.ToTxidIdx()
 	// Get the UTXO from Bitcoin node
-	// Log UTXO lookup details for debugging
-	fmt.Printf("Looking up UTXO - TxID: %s, Vout: %d\n", hash.String(), vout)
+	txOut, err := v.LookupUTXO(ctx, outpoint)
+	if err != nil {
+		return err
+	}
+
+	expected, err := v.GetPKScript(txOut)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expected, pkScript) {
+		return fmt.Errorf("%w: %s:%d", ErrScriptMismatch, hash, vout)
+	}
 
-	// Log public key we're verifying against
-	fmt.Printf("Verifying UTXO ownership against pubkey: %s\n", pkScript)
-	txOut, err := v.client.GetTxOut(hash, vout, false)
+	return nil
+}
+
+// VerifySignature verifies that the message was signed by the owner of the
+// taproot key. It returns message.ErrBadSignature if the key-path signature
+// does not verify against pkScript.
+func (v *Validator) VerifySignature(msg string, signature []byte, pkScript []byte) error {
+	// Convert the signature to a wire.TxWitness
+	return v.VerifyWitness(msg, wire.TxWitness{signature}, pkScript)
+}
+
+// VerifyWitness verifies the BIP322 simple signature of msg by the
+// output with script pkScript. The witness is the one spending pkScript in
+// the BIP322 to_sign transaction: a single schnorr signature for a taproot
+// output, an ECDSA signature and the public key for a P2WPKH output. It
+// returns message.ErrBadSignature if the witness does not verify.
+func (v *Validator) VerifyWitness(msg string, witness wire.TxWitness,
+	pkScript []byte) error {
+
+	if !bip322.VerifySignature(witness, pkScript, msg) {
+		return message.ErrBadSignature
+	}
+
+	return nil
+}
+
+// GetTxOut retrieves a transaction output from the Bitcoin node.
+func (v *Validator) GetTxOut(ctx context.Context, txid *chainhash.Hash, vout uint32, includeMempool bool) (*btcjson.GetTxOutResult, error) {
+	return v.client.GetTxOut(ctx, txid, vout, includeMempool)
+}
+
+// LookupUTXO fetches the UTXO backing a message from the Bitcoin node. It
+// returns message.ErrUTXOSpent if the UTXO has been spent,
+// message.ErrUTXONotFound if it does not exist, ErrUnconfirmedOutpoint if it
+// has fewer confirmations than required and message.ErrRPCUnavailable if the
+// node could not be reached. Spent outputs of confirmed transactions are only
+// told apart from missing ones if the node has txindex enabled.
+func (v *Validator) LookupUTXO(ctx context.Context,
+	outpoint message.Outpoint) (*btcjson.GetTxOutResult, error) {
+
+	hash, vout := outpoint.ToTxidIdx()
+	includeMempool := v.config.MinConfirmations <= 0
+	txOut, err := v.client.GetTxOut(ctx, hash, vout, includeMempool)
 	if err != nil {
-		return fmt.Errorf("failed to get txout: %v", err)
+		return nil, txOutError(err)
 	}
 
-	// Check if UTXO exists
+	// Tell an output waiting for its first confirmation apart from one
+	// that doesn't exist, so the sender knows it may retry
+	if txOut == nil && !includeMempool {
+		txOut, err = v.client.GetTxOut(ctx, hash, vout, true)
+		if err != nil {
+			return nil, txOutError(err)
+		}
+	}
 	if txOut == nil {
-		return fmt.Errorf("utxo not found")
+		return nil, v.missingUTXOError(ctx, outpoint)
 	}
 
-	// TODO: Implement proper script validation for different UTXO types
-	// Currently only checking if the public key hash matches
+	if err := v.VerifyUTXOConfirmations(txOut); err != nil {
+		return nil, err
+	}
+	return txOut, nil
+}
 
+// missingUTXOError tells why the node has no unspent output for outpoint:
+// message.ErrUTXOSpent if its transaction is known and has the output,
+// message.ErrUTXONotFound otherwise.
+func (v *Validator) missingUTXOError(ctx context.Context,
+	outpoint message.Outpoint) error {
+
+	hash, vout := outpoint.ToTxidIdx()
+	tx, err := v.client.GetRawTransaction(ctx, hash)
+	if err != nil {
+		if bitcoin.IsTransportError(err) {
+			return fmt.Errorf("%w: %v", message.ErrRPCUnavailable, err)
+		}
+
+		// Without txindex the node doesn't know confirmed transactions
+		return message.ErrUTXONotFound
+	}
+	if tx == nil || int(vout) >= len(tx.Vout) {
+		return message.ErrUTXONotFound
+	}
+	return fmt.Errorf("%w: %s:%d", message.ErrUTXOSpent, hash, vout)
+}
+
+// txOutError wraps an error from GetTxOut, telling failures to reach the node
+// apart with message.ErrRPCUnavailable.
+func txOutError(err error) error {
+	if bitcoin.IsTransportError(err) {
+		return fmt.Errorf("%w: %v", message.ErrRPCUnavailable, err)
+	}
+	return fmt.Errorf("failed to get txout: %v", err)
+}
+
+// VerifyUTXOConfirmations checks that a transaction output has at least the
+// configured number of confirmations.
+func (v *Validator) VerifyUTXOConfirmations(txOut *btcjson.GetTxOutResult) error {
+	if txOut == nil {
+		return message.ErrUTXONotFound
+	}
+	if txOut.Confirmations < v.config.MinConfirmations {
+		return fmt.Errorf("%w: %d < %d confirmations", ErrUnconfirmedOutpoint,
+			txOut.Confirmations, v.config.MinConfirmations)
+	}
 	return nil
 }
 
-// VerifySignature verifies that the message was signed by the owner of the public key.
-func (v *Validator) VerifySignature(message string, signature []byte, pkScript []byte) error {
-	// Convert pkScript to wire.TxWitness
-	witness := wire.TxWitness{signature}
-	a := bip322.VerifySignature(witness, pkScript, message)
-	fmt.Printf("Signature verification result: %v\n", a)
+// VerifyUTXOValue checks that a transaction output is worth at least the
+// configured minimum value.
+func (v *Validator) VerifyUTXOValue(txOut *btcjson.GetTxOutResult) error {
+	if v.config.MinUtxoValue <= 0 {
+		return nil
+	}
+	if txOut == nil {
+		return message.ErrUTXONotFound
+	}
 
+	// Convert from BTC with proper rounding rather than truncating the
+	// float
+	value, err := btcutil.NewAmount(txOut.Value)
+	if err != nil {
+		return fmt.Errorf("invalid utxo value %v: %v", txOut.Value, err)
+	}
+	if int64(value) < v.config.MinUtxoValue {
+		return fmt.Errorf("%w: %d < %d sats", ErrUTXOBelowMinimum,
+			int64(value), v.config.MinUtxoValue)
+	}
 	return nil
 }
 
-// GetTxOut retrieves a transaction output from the Bitcoin node.
-func (v *Validator) GetTxOut(txid *chainhash.Hash, vout uint32, includeMempool bool) (*btcjson.GetTxOutResult, error) {
-	return v.client.GetTxOut(txid, vout, includeMempool)
+// ScriptType is the kind of output script a message is anchored to.
+type ScriptType int
+
+const (
+	// ScriptUnsupported is any output messages can't be anchored to.
+	ScriptUnsupported ScriptType = iota
+
+	// ScriptTaproot is a segwit v1 pay-to-taproot output, signed for with
+	// a key-path spend.
+	ScriptTaproot
+
+	// ScriptWitnessPubKeyHash is a segwit v0 pay-to-witness-pubkey-hash
+	// output.
+	ScriptWitnessPubKeyHash
+)
+
+// String returns the name of the script type.
+func (t ScriptType) String() string {
+	switch t {
+	case ScriptTaproot:
+		return "p2tr"
+	case ScriptWitnessPubKeyHash:
+		return "p2wpkh"
+	default:
+		return "unsupported"
+	}
 }
 
-// IsTaprootOutput checks if a transaction output is a Taproot output.
-func (v *Validator) IsTaprootOutput(txOut *btcjson.GetTxOutResult) bool {
+// ClassifyScript returns the type of the output script pkScript.
+func ClassifyScript(pkScript []byte) ScriptType {
+	switch {
+	case txscript.IsPayToTaproot(pkScript):
+		return ScriptTaproot
+	case txscript.IsPayToWitnessPubKeyHash(pkScript):
+		return ScriptWitnessPubKeyHash
+	default:
+		return ScriptUnsupported
+	}
+}
+
+// ClassifyOutput returns the script type of a transaction output.
+func (v *Validator) ClassifyOutput(txOut *btcjson.GetTxOutResult) ScriptType {
 	if txOut == nil {
-		return false
+		return ScriptUnsupported
 	}
-	// Taproot outputs start with OP_1 (0x51) followed by a 32-byte key
 	script, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
 	if err != nil {
-		return false
+		return ScriptUnsupported
 	}
-	return len(script) == 34 && script[0] == 0x51
+	return ClassifyScript(script)
 }
 
-// GetTaprootPubKey extracts the Taproot public key from a transaction output.
-func (v *Validator) GetTaprootPKScript(txOut *btcjson.GetTxOutResult) ([]byte, error) {
+// IsTaprootOutput checks if a transaction output is a Taproot output.
+func (v *Validator) IsTaprootOutput(txOut *btcjson.GetTxOutResult) bool {
+	return v.ClassifyOutput(txOut) == ScriptTaproot
+}
+
+// GetPKScript returns the script a message anchored to a transaction output
+// is verified against. It is recomputed from the output key of a taproot
+// output and from the key hash of a P2WPKH output. Other outputs are
+// rejected with message.ErrUnsupportedScript.
+func (v *Validator) GetPKScript(txOut *btcjson.GetTxOutResult) ([]byte, error) {
+	switch v.ClassifyOutput(txOut) {
+	case ScriptTaproot:
+		return v.GetTaprootPKScript(txOut)
+	case ScriptWitnessPubKeyHash:
+		return v.getWitnessPubKeyHashPKScript(txOut)
+	default:
+		return nil, message.ErrUnsupportedScript
+	}
+}
+
+// getWitnessPubKeyHashPKScript returns the P2WPKH script of a P2WPKH
+// transaction output, recomputed from its key hash.
+func (v *Validator) getWitnessPubKeyHashPKScript(
+	txOut *btcjson.GetTxOutResult) ([]byte, error) {
+
+	scriptBytes, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode script hex: %v", err)
+	}
+
+	// The key hash is the 20 bytes after OP_0 OP_DATA_20
+	pkScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(scriptBytes[2:]).
+		Script()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build p2wpkh script: %v", err)
+	}
+	return pkScript, nil
+}
+
+// GetTaprootKey extracts the 32-byte x-only output key from a Taproot
+// transaction output.
+func (v *Validator) GetTaprootKey(txOut *btcjson.GetTxOutResult) (*btcec.PublicKey, error) {
 	if !v.IsTaprootOutput(txOut) {
-		return nil, fmt.Errorf("not a Taproot output")
+		return nil, message.ErrNotTaproot
 	}
 
 	scriptBytes, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
@@ -128,6 +519,34 @@ func (v *Validator) GetTaprootPKScript(txOut *btcjson.GetTxOutResult) ([]byte, e
 		return nil, fmt.Errorf("failed to decode script hex: %v", err)
 	}
 
-	// The Taproot key is the 32 bytes after OP_1
-	return scriptBytes, nil
+	// The Taproot key is the 32 bytes after OP_1 OP_DATA_32
+	key, err := schnorr.ParsePubKey(scriptBytes[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid taproot key: %v", err)
+	}
+	return key, nil
+}
+
+// TaprootOutputKey returns the 32-byte x-only output key of a P2TR script, or
+// nil if pkScript is not a taproot output.
+func TaprootOutputKey(pkScript []byte) []byte {
+	if !txscript.IsPayToTaproot(pkScript) {
+		return nil
+	}
+	return pkScript[2:]
+}
+
+// GetTaprootPKScript returns the P2TR script of a Taproot transaction output,
+// recomputed from its output key.
+func (v *Validator) GetTaprootPKScript(txOut *btcjson.GetTxOutResult) ([]byte, error) {
+	key, err := v.GetTaprootKey(txOut)
+	if err != nil {
+		return nil, err
+	}
+
+	pkScript, err := txscript.PayToTaprootScript(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build taproot script: %v", err)
+	}
+	return pkScript, nil
 }
@@ -0,0 +1,731 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// testUTXOValue is the value in satoshis of the UTXOs in the tests, above
+// the default minimum.
+const testUTXOValue = 50000
+
+// p2pkhScript is a pay-to-pubkey-hash script, which messages can't be
+// anchored to.
+var p2pkhScript = append(append([]byte{0x76, 0xa9, 0x14},
+	make([]byte, 20)...), 0x88, 0xac)
+
+// validatorTest is a validator backed by a mock Bitcoin node and an
+// in-memory database, along with a key controlling the UTXOs it adds.
+type validatorTest struct {
+	t         *testing.T
+	client    *mock.Client
+	db        *MemoryDB
+	validator *Validator
+	key       *btcec.PrivateKey
+	pkScript  []byte
+}
+
+// newValidatorTest creates a validator with the default configuration.
+func newValidatorTest(t *testing.T) *validatorTest {
+	t.Helper()
+
+	key, _ := btcec.PrivKeyFromBytes([]byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20,
+	})
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := mock.NewClient()
+	db := NewMemoryDB()
+	return &validatorTest{
+		t:         t,
+		client:    client,
+		db:        db,
+		validator: NewValidator(client, db),
+		key:       key,
+		pkScript:  pkScript,
+	}
+}
+
+// outpoint returns the outpoint of output vout of a transaction numbered n.
+func (vt *validatorTest) outpoint(n byte, vout uint32) message.Outpoint {
+	return message.NewOutpoint(chainhash.Hash{n}, vout)
+}
+
+// addUTXO adds a confirmed UTXO controlled by the test key.
+func (vt *validatorTest) addUTXO(outpoint message.Outpoint) {
+	vt.client.AddUTXO(outpoint.WireOutPoint(), testUTXOValue, vt.pkScript)
+}
+
+// sign returns a message for outpoint signed by the test key.
+func (vt *validatorTest) sign(outpoint message.Outpoint, sequence uint32,
+	text string) *message.Message {
+
+	vt.t.Helper()
+
+	msg, err := signer.SignReplacement(vt.key, outpoint, sequence,
+		message.ContentTypeText, []byte(text))
+	if err != nil {
+		vt.t.Fatalf("SignReplacement: %v", err)
+	}
+	return msg
+}
+
+// validate looks up the UTXO of msg and validates it, as the network does.
+func (vt *validatorTest) validate(msg *message.Message) error {
+	ctx := context.Background()
+	txOut, err := vt.validator.LookupUTXO(ctx, msg.Outpoint)
+	if err != nil {
+		return err
+	}
+	pkScript, err := vt.validator.GetPKScript(txOut)
+	if err != nil {
+		return err
+	}
+	return vt.validator.ValidateMessage(ctx, msg, pkScript)
+}
+
+// store validates msg and stores it, failing the test if it is rejected.
+func (vt *validatorTest) store(msg *message.Message) {
+	vt.t.Helper()
+
+	if err := vt.validate(msg); err != nil {
+		vt.t.Fatalf("message %s rejected: %v", msg.Outpoint.ToString(), err)
+	}
+	err := vt.db.AddMessage(context.Background(), msg.Outpoint,
+		msg.Serialize(), MessageMeta{})
+	if err != nil {
+		vt.t.Fatalf("AddMessage: %v", err)
+	}
+}
+
+// TestValidatorPreloadedUTXOs checks messages against a UTXO set preloaded
+// into the mock node: a signed message for an owned UTXO is accepted once,
+// a replacement needs a greater sequence, and forged, unknown, spent,
+// unconfirmed and low value UTXOs are rejected.
+func TestValidatorPreloadedUTXOs(t *testing.T) {
+	vt := newValidatorTest(t)
+
+	owned := vt.outpoint(1, 300)
+	spent := vt.outpoint(2, 0)
+	pending := vt.outpoint(3, 1)
+	small := vt.outpoint(4, 0)
+	vt.addUTXO(owned)
+	vt.addUTXO(spent)
+	vt.client.AddMempoolUTXO(pending.WireOutPoint(), testUTXOValue,
+		vt.pkScript)
+	vt.client.AddUTXO(small.WireOutPoint(), 1000, vt.pkScript)
+	vt.client.SpendUTXO(spent.WireOutPoint())
+
+	vt.store(vt.sign(owned, 0, "hello"))
+
+	forged := vt.sign(owned, 2, "forged")
+	forged.Payload = []byte("FORGED")
+
+	tests := []struct {
+		name string
+		msg  *message.Message
+		want error
+	}{
+		{"duplicate", vt.sign(owned, 0, "hello"), message.ErrDuplicateOutpoint},
+		{"forged", forged, message.ErrBadSignature},
+		{"unknown", vt.sign(vt.outpoint(5, 0), 0, "hi"), message.ErrUTXONotFound},
+		{"spent", vt.sign(spent, 0, "hi"), message.ErrUTXOSpent},
+		{"unconfirmed", vt.sign(pending, 0, "hi"), ErrUnconfirmedOutpoint},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := vt.validate(test.msg)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	txOut, err := vt.validator.LookupUTXO(context.Background(), small)
+	if err != nil {
+		t.Fatalf("LookupUTXO: %v", err)
+	}
+	if err := vt.validator.VerifyUTXOValue(txOut); !errors.Is(err,
+		ErrUTXOBelowMinimum) {
+
+		t.Fatalf("low value UTXO gave %v, want ErrUTXOBelowMinimum", err)
+	}
+
+	// A replacement with a greater sequence is accepted, once
+	vt.store(vt.sign(owned, 1, "hello again"))
+	err = vt.validate(vt.sign(owned, 1, "hello again"))
+	if !errors.Is(err, message.ErrDuplicateOutpoint) {
+		t.Fatalf("replayed replacement gave %v, want "+
+			"ErrDuplicateOutpoint", err)
+	}
+
+	// The mempool UTXO is accepted once a block confirms it
+	vt.client.AddBlock()
+	vt.store(vt.sign(pending, 0, "confirmed"))
+}
+
+// TestValidatorReplacement checks that sequence 2 replaces the message
+// stored with sequence 1, that 1 can't replace 2, and that a replacement
+// whose signature doesn't cover its payload is rejected.
+func TestValidatorReplacement(t *testing.T) {
+	ctx := context.Background()
+	vt := newValidatorTest(t)
+	outpoint := vt.outpoint(1, 0)
+	vt.addUTXO(outpoint)
+
+	vt.store(vt.sign(outpoint, 1, "first"))
+	second := vt.sign(outpoint, 2, "second")
+	vt.store(second)
+	data, err := vt.db.GetMessage(ctx, outpoint)
+	if err != nil || !bytes.Equal(data, second.Serialize()) {
+		t.Fatalf("stored %x, %v, want sequence 2", data, err)
+	}
+
+	forged := vt.sign(outpoint, 3, "third")
+	forged.Payload = []byte("THIRD")
+	tests := []struct {
+		name string
+		msg  *message.Message
+		want error
+	}{
+		{"lower", vt.sign(outpoint, 1, "first again"),
+			message.ErrDuplicateOutpoint},
+		{"equal", vt.sign(outpoint, 2, "second again"),
+			message.ErrDuplicateOutpoint},
+		{"zero", vt.sign(outpoint, 0, "none"), message.ErrDuplicateOutpoint},
+		{"forged", forged, message.ErrBadSignature},
+	}
+	for _, test := range tests {
+		if err := vt.validate(test.msg); !errors.Is(err, test.want) {
+			t.Fatalf("%s sequence gave %v, want %v", test.name, err,
+				test.want)
+		}
+	}
+	data, err = vt.db.GetMessage(ctx, outpoint)
+	if err != nil || !bytes.Equal(data, second.Serialize()) {
+		t.Fatalf("rejected replacement stored %x, %v", data, err)
+	}
+}
+
+// TestValidatorBudget checks that the versions of a message may fill the
+// payload byte budget of their UTXO exactly, that one byte more is rejected
+// with ErrOutpointBudgetExceeded, and that a block spending the UTXO clears
+// its accounting until the block is disconnected.
+func TestValidatorBudget(t *testing.T) {
+	const budget = 20
+
+	ctx := context.Background()
+	vt := newValidatorTest(t)
+	cfg := DefaultValidatorConfig()
+	cfg.MaxOutpointBytes = budget
+	vt.validator = NewValidatorWithConfig(vt.client, vt.db, cfg)
+
+	// A single message at and over the budget
+	at, over := vt.outpoint(1, 0), vt.outpoint(2, 0)
+	vt.addUTXO(at)
+	vt.addUTXO(over)
+	vt.store(vt.sign(at, 0, strings.Repeat("a", budget)))
+	err := vt.validate(vt.sign(over, 0, strings.Repeat("a", budget+1)))
+	if !errors.Is(err, ErrOutpointBudgetExceeded) {
+		t.Fatalf("%d bytes gave %v, want ErrOutpointBudgetExceeded",
+			budget+1, err)
+	}
+
+	// Replacements add up to the budget
+	outpoint := vt.outpoint(3, 0)
+	vt.addUTXO(outpoint)
+	vt.store(vt.sign(outpoint, 1, strings.Repeat("b", 8)))
+	vt.store(vt.sign(outpoint, 2, strings.Repeat("c", budget-8)))
+	if size, err := vt.db.GetStoredSize(ctx, outpoint); err != nil ||
+		size != budget {
+
+		t.Fatalf("stored size is %d, %v, want %d", size, err, budget)
+	}
+	err = vt.validate(vt.sign(outpoint, 3, "d"))
+	if !errors.Is(err, ErrOutpointBudgetExceeded) {
+		t.Fatalf("byte over the budget gave %v, want "+
+			"ErrOutpointBudgetExceeded", err)
+	}
+
+	// A block spends the UTXO, and a reorg brings it back
+	block := chainhash.Hash{9}
+	_, err = vt.db.RemoveBlockOutpoints(ctx, block,
+		[]message.Outpoint{outpoint})
+	if err != nil {
+		t.Fatalf("RemoveBlockOutpoints: %v", err)
+	}
+	if size, err := vt.db.GetStoredSize(ctx, outpoint); err != nil ||
+		size != 0 {
+
+		t.Fatalf("stored size of a spent outpoint is %d, %v", size, err)
+	}
+	if err := vt.db.RestoreBlockOutpoints(ctx, block); err != nil {
+		t.Fatalf("RestoreBlockOutpoints: %v", err)
+	}
+	if size, err := vt.db.GetStoredSize(ctx, outpoint); err != nil ||
+		size != budget {
+
+		t.Fatalf("restored size is %d, %v, want %d", size, err, budget)
+	}
+
+	// A budget of zero disables the check
+	cfg.MaxOutpointBytes = 0
+	vt.validator = NewValidatorWithConfig(vt.client, vt.db, cfg)
+	vt.store(vt.sign(outpoint, 3, "d"))
+}
+
+// TestValidatorMinUTXOValue checks that a UTXO worth less than the minimum
+// value is rejected with ErrUTXOBelowMinimum, one worth the minimum or more is
+// accepted, and that a minimum of zero accepts any value.
+func TestValidatorMinUTXOValue(t *testing.T) {
+	const minValue = 10000
+
+	tests := []struct {
+		min   int64
+		value int64
+		ok    bool
+	}{
+		{minValue, minValue - 1, false},
+		{minValue, minValue, true},
+		{minValue, minValue + 1, true},
+		{minValue, 1, false},
+		{0, 1, true},
+		{0, 0, true},
+	}
+	for i, test := range tests {
+		vt := newValidatorTest(t)
+		cfg := DefaultValidatorConfig()
+		cfg.MinUtxoValue = test.min
+		vt.validator = NewValidatorWithConfig(vt.client, vt.db, cfg)
+
+		// The node reports the value in BTC, converted back to
+		// satoshis without losing the last one
+		outpoint := vt.outpoint(byte(i+1), 0)
+		vt.client.AddUTXO(outpoint.WireOutPoint(), test.value, vt.pkScript)
+		txOut, err := vt.validator.LookupUTXO(context.Background(),
+			outpoint)
+		if err != nil {
+			t.Fatalf("LookupUTXO: %v", err)
+		}
+		err = vt.validator.VerifyUTXOValue(txOut)
+		if test.ok && err != nil {
+			t.Fatalf("%d sats with a minimum of %d rejected: %v",
+				test.value, test.min, err)
+		}
+		if !test.ok && !errors.Is(err, ErrUTXOBelowMinimum) {
+			t.Fatalf("%d sats with a minimum of %d gave %v, want "+
+				"ErrUTXOBelowMinimum", test.value, test.min, err)
+		}
+	}
+}
+
+// TestValidatorMinConfirmations checks that a message for a UTXO with fewer
+// confirmations than the minimum is rejected with ErrUnconfirmedOutpoint, and
+// that a minimum of zero accepts a UTXO still in the mempool.
+func TestValidatorMinConfirmations(t *testing.T) {
+	tests := []struct {
+		min    int64
+		blocks int
+		ok     bool
+	}{
+		{0, 0, true},
+		{1, 0, false},
+		{1, 1, true},
+		{2, 1, false},
+		{2, 2, true},
+	}
+	for i, test := range tests {
+		vt := newValidatorTest(t)
+		cfg := DefaultValidatorConfig()
+		cfg.MinConfirmations = test.min
+		vt.validator = NewValidatorWithConfig(vt.client, vt.db, cfg)
+
+		outpoint := vt.outpoint(byte(i+1), 0)
+		vt.client.AddMempoolUTXO(outpoint.WireOutPoint(), testUTXOValue,
+			vt.pkScript)
+		for j := 0; j < test.blocks; j++ {
+			vt.client.AddBlock()
+		}
+
+		err := vt.validate(vt.sign(outpoint, 0, "hello"))
+		if test.ok && err != nil {
+			t.Fatalf("%d confirmations with a minimum of %d rejected: %v",
+				test.blocks, test.min, err)
+		}
+		if !test.ok && !errors.Is(err, ErrUnconfirmedOutpoint) {
+			t.Fatalf("%d confirmations with a minimum of %d gave %v, "+
+				"want ErrUnconfirmedOutpoint", test.blocks, test.min, err)
+		}
+	}
+}
+
+// TestValidatorReorg checks that a UTXO spent by a block that a reorg
+// disconnects is accepted again.
+func TestValidatorReorg(t *testing.T) {
+	vt := newValidatorTest(t)
+
+	outpoint := vt.outpoint(1, 0)
+	vt.addUTXO(outpoint)
+	vt.client.AddBlock(outpoint.WireOutPoint())
+
+	msg := vt.sign(outpoint, 0, "hello")
+	if err := vt.validate(msg); !errors.Is(err, message.ErrUTXOSpent) {
+		t.Fatalf("spent UTXO gave %v, want ErrUTXOSpent", err)
+	}
+
+	if err := vt.client.DisconnectBlock(); err != nil {
+		t.Fatalf("DisconnectBlock: %v", err)
+	}
+	vt.store(msg)
+}
+
+// TestValidatorRPCErrors checks that a Bitcoin node that can't be reached
+// makes lookups fail with message.ErrRPCUnavailable, leaving the message
+// unjudged, and that validation succeeds once the node is back.
+func TestValidatorRPCErrors(t *testing.T) {
+	vt := newValidatorTest(t)
+
+	outpoint := vt.outpoint(1, 0)
+	vt.addUTXO(outpoint)
+	msg := vt.sign(outpoint, 0, "hello")
+
+	vt.client.FailCalls(mock.MethodGetTxOut, 1, syscall.ECONNREFUSED)
+	if err := vt.validate(msg); !errors.Is(err, message.ErrRPCUnavailable) {
+		t.Fatalf("unreachable node gave %v, want ErrRPCUnavailable", err)
+	}
+	seen, err := vt.db.HasOutpoint(context.Background(), outpoint)
+	if err != nil || seen {
+		t.Fatalf("outpoint recorded while the node was unreachable")
+	}
+
+	// Spent outputs are told apart from missing ones with a second
+	// lookup, which may fail too
+	spent := vt.outpoint(2, 0)
+	vt.addUTXO(spent)
+	vt.client.SpendUTXO(spent.WireOutPoint())
+	vt.client.FailCalls(mock.MethodGetRawTransaction, 1, syscall.ECONNRESET)
+	err = vt.validate(vt.sign(spent, 0, "hi"))
+	if !errors.Is(err, message.ErrRPCUnavailable) {
+		t.Fatalf("unreachable node gave %v, want ErrRPCUnavailable", err)
+	}
+
+	vt.store(msg)
+	if calls := vt.client.Calls(mock.MethodGetTxOut); calls < 2 {
+		t.Fatalf("%d GetTxOut calls, want a retry", calls)
+	}
+}
+
+// TestValidatorSwappedPayload checks that a message signed over one payload
+// but carrying another is rejected, and that its outpoint isn't recorded.
+func TestValidatorSwappedPayload(t *testing.T) {
+	vt := newValidatorTest(t)
+
+	outpoint := vt.outpoint(1, 0)
+	vt.addUTXO(outpoint)
+	msg := vt.sign(outpoint, 0, "payload A")
+	msg.Payload = []byte("payload B")
+
+	if err := vt.validate(msg); !errors.Is(err, message.ErrBadSignature) {
+		t.Fatalf("swapped payload gave %v, want ErrBadSignature", err)
+	}
+
+	ctx := context.Background()
+	if seen, err := vt.db.HasOutpoint(ctx, outpoint); err != nil || seen {
+		t.Fatalf("outpoint recorded for a bad signature: %v, %v", seen, err)
+	}
+	if data, err := vt.db.GetMessage(ctx, outpoint); err != nil ||
+		data != nil {
+
+		t.Fatalf("message stored for a bad signature: %x, %v", data, err)
+	}
+
+	// The message as signed is still accepted afterwards
+	vt.store(vt.sign(outpoint, 0, "payload A"))
+}
+
+// TestValidatorInvalidUTF8 checks that a text message whose payload isn't
+// valid UTF-8 is rejected without recording its outpoint, and that the same
+// payload is accepted as binary.
+func TestValidatorInvalidUTF8(t *testing.T) {
+	vt := newValidatorTest(t)
+
+	outpoint := vt.outpoint(1, 0)
+	vt.addUTXO(outpoint)
+	msg, err := signer.SignReplacement(vt.key, outpoint, 0,
+		message.ContentTypeBinary, []byte{'h', 'i', 0xff, 0xfe})
+	if err != nil {
+		t.Fatalf("SignReplacement: %v", err)
+	}
+
+	// The signer refuses it, but a peer can relay it marked as text
+	msg.ContentType = message.ContentTypeText
+	if err := vt.validate(msg); !errors.Is(err, ErrInvalidContent) {
+		t.Fatalf("invalid UTF-8 text gave %v, want ErrInvalidContent", err)
+	}
+	seen, err := vt.db.HasOutpoint(context.Background(), outpoint)
+	if err != nil || seen {
+		t.Fatalf("outpoint recorded for invalid content: %v, %v", seen, err)
+	}
+
+	msg.ContentType = message.ContentTypeBinary
+	vt.store(msg)
+}
+
+// TestValidatorOwnership checks that a message is only accepted when signed
+// by the key of its own UTXO's taproot script, recomputed from the output
+// rather than supplied by the sender.
+func TestValidatorOwnership(t *testing.T) {
+	key := newValidatorTest(t).key
+	other, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherScript, err := signer.TaprootScript(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each test validates a message for one of these UTXOs
+	owned, foreign, legacy := message.NewOutpoint(chainhash.Hash{1}, 0),
+		message.NewOutpoint(chainhash.Hash{2}, 0),
+		message.NewOutpoint(chainhash.Hash{3}, 0)
+	tests := []struct {
+		name     string
+		outpoint message.Outpoint
+		key      *btcec.PrivateKey
+		want     error
+	}{
+		{"own key", owned, key, nil},
+		{"other key", owned, other, message.ErrBadSignature},
+		{"key of another UTXO", foreign, key, message.ErrBadSignature},
+		{"not taproot", legacy, key, message.ErrUnsupportedScript},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vt := newValidatorTest(t)
+			vt.addUTXO(owned)
+			vt.client.AddUTXO(foreign.WireOutPoint(), testUTXOValue,
+				otherScript)
+			vt.client.AddUTXO(legacy.WireOutPoint(), testUTXOValue,
+				p2pkhScript)
+
+			msg, err := signer.SignMessage(test.key, test.outpoint,
+				message.ContentTypeText, []byte("hello"))
+			if err != nil {
+				t.Fatalf("SignMessage: %v", err)
+			}
+			err = vt.validate(msg)
+			if !errors.Is(err, test.want) || (test.want == nil) !=
+				(err == nil) {
+
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+
+			// The script of the signing key only matches its own
+			// UTXO
+			signerScript, err := signer.TaprootScript(test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = vt.validator.VerifyUTXOOwnership(
+				context.Background(), test.outpoint, signerScript)
+			if (test.want == nil) != (err == nil) {
+				t.Fatalf("VerifyUTXOOwnership of the signer's script "+
+					"gave %v", err)
+			}
+			if test.want == message.ErrBadSignature &&
+				!errors.Is(err, ErrScriptMismatch) {
+
+				t.Fatalf("VerifyUTXOOwnership gave %v, want "+
+					"ErrScriptMismatch", err)
+			}
+		})
+	}
+}
+
+// TestValidatorSentinels checks that each way a message fails validation is
+// reported with its sentinel error, which survives further wrapping.
+func TestValidatorSentinels(t *testing.T) {
+	sentinels := []error{
+		message.ErrDuplicateOutpoint,
+		message.ErrUTXONotFound,
+		message.ErrUTXOSpent,
+		message.ErrNotTaproot,
+		message.ErrUnsupportedScript,
+		message.ErrBadSignature,
+		message.ErrPayloadTooLarge,
+	}
+	tests := []struct {
+		name string
+		want error
+		run  func(vt *validatorTest) error
+	}{{
+		name: "duplicate",
+		want: message.ErrDuplicateOutpoint,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.addUTXO(outpoint)
+			vt.store(vt.sign(outpoint, 0, "hello"))
+			return vt.validate(vt.sign(outpoint, 0, "hello"))
+		},
+	}, {
+		name: "not found",
+		want: message.ErrUTXONotFound,
+		run: func(vt *validatorTest) error {
+			return vt.validate(vt.sign(vt.outpoint(1, 0), 0, "hello"))
+		},
+	}, {
+		name: "spent",
+		want: message.ErrUTXOSpent,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.addUTXO(outpoint)
+			vt.client.SpendUTXO(outpoint.WireOutPoint())
+			return vt.validate(vt.sign(outpoint, 0, "hello"))
+		},
+	}, {
+		name: "not taproot key",
+		want: message.ErrNotTaproot,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.client.AddUTXO(outpoint.WireOutPoint(), testUTXOValue,
+				p2pkhScript)
+			txOut, err := vt.validator.LookupUTXO(
+				context.Background(), outpoint)
+			if err != nil {
+				return err
+			}
+			_, err = vt.validator.GetTaprootKey(txOut)
+			return err
+		},
+	}, {
+		name: "not taproot message",
+		want: message.ErrUnsupportedScript,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.client.AddUTXO(outpoint.WireOutPoint(), testUTXOValue,
+				p2pkhScript)
+			return vt.validate(vt.sign(outpoint, 0, "hello"))
+		},
+	}, {
+		name: "bad signature",
+		want: message.ErrBadSignature,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.addUTXO(outpoint)
+			msg := vt.sign(outpoint, 0, "hello")
+			msg.Signature[0] ^= 0xff
+			return vt.validate(msg)
+		},
+	}, {
+		name: "too large",
+		want: message.ErrPayloadTooLarge,
+		run: func(vt *validatorTest) error {
+			outpoint := vt.outpoint(1, 0)
+			vt.addUTXO(outpoint)
+			payload := bytes.Repeat([]byte("x"),
+				message.MaxPayloadSize+1)
+			msg := &message.Message{
+				Outpoint:    outpoint,
+				ContentType: message.ContentTypeText,
+				Length:      uint16(len(payload)),
+				Payload:     payload,
+			}
+			return vt.validate(msg)
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run(newValidatorTest(t))
+			wrapped := fmt.Errorf("peer 10.0.0.1:8335: %w", err)
+			for _, sentinel := range sentinels {
+				want := sentinel == test.want
+				if errors.Is(err, sentinel) != want ||
+					errors.Is(wrapped, sentinel) != want {
+
+					t.Fatalf("got %v, want %v", err, test.want)
+				}
+			}
+		})
+	}
+}
+
+// TestValidatorExpiry checks that a message whose structured payload expired
+// more than ExpiryClockSkew ago is rejected, one within it is accepted, and
+// that once dropped for expiring only a greater sequence replaces it.
+func TestValidatorExpiry(t *testing.T) {
+	ctx := context.Background()
+	vt := newValidatorTest(t)
+
+	// expiring signs a structured payload for outpoint expiring at expiry
+	expiring := func(outpoint message.Outpoint, sequence uint32,
+		expiry time.Time) *message.Message {
+
+		t.Helper()
+
+		payload, err := message.BuildPayload(&message.Payload{
+			Body:   "status",
+			Expiry: expiry,
+		})
+		if err != nil {
+			t.Fatalf("BuildPayload: %v", err)
+		}
+		msg, err := signer.SignReplacement(vt.key, outpoint, sequence,
+			message.ContentTypeBinary, payload)
+		if err != nil {
+			t.Fatalf("SignReplacement: %v", err)
+		}
+		return msg
+	}
+
+	expired := vt.outpoint(1, 0)
+	vt.addUTXO(expired)
+	msg := expiring(expired, 0, time.Now().Add(-ExpiryClockSkew-time.Minute))
+	if err := vt.validate(msg); !errors.Is(err, message.ErrExpired) {
+		t.Fatalf("expired message gave %v, want ErrExpired", err)
+	}
+
+	skewed := vt.outpoint(2, 0)
+	vt.addUTXO(skewed)
+	msg = expiring(skewed, 1, time.Now().Add(-time.Minute))
+	if err := vt.validate(msg); err != nil {
+		t.Fatalf("message expired within the clock skew: %v", err)
+	}
+	err := vt.db.AddMessage(ctx, skewed, msg.Serialize(),
+		MessageMeta{Expiry: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+	dropped, err := vt.db.ExpireMessages(ctx, time.Now())
+	if err != nil || len(dropped) != 1 || dropped[0] != skewed {
+		t.Fatalf("ExpireMessages dropped %v, %v", dropped, err)
+	}
+
+	if err := vt.validate(vt.sign(skewed, 1, "replay")); !errors.Is(err,
+		message.ErrDuplicateOutpoint) {
+
+		t.Fatalf("replayed sequence gave %v, want ErrDuplicateOutpoint",
+			err)
+	}
+	if err := vt.validate(vt.sign(skewed, 2, "next")); err != nil {
+		t.Fatalf("greater sequence after the expiry: %v", err)
+	}
+}
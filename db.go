@@ -0,0 +1,99 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/shaibearary/utxo_chat/database"
+)
+
+// dbCommand runs maintenance on the database of a stopped node: stats prints
+// the entries and approximate size of each keyspace, compact reclaims the
+// space of removed entries.
+func dbCommand(args []string) error {
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	common := addCommonFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: utxochat db stats|compact [flags]")
+		fs.PrintDefaults()
+	}
+	var action string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if action != "stats" && action != "compact" {
+		fs.Usage()
+		return fmt.Errorf("expected stats or compact, got %q", action)
+	}
+
+	// Keep the config loader quiet, its output is meant for the node
+	setLogLevels("warn")
+	cfg, err := resolveConfig(fs, common)
+	if err != nil {
+		return err
+	}
+	db, err := database.Open(newDatabaseConfig(cfg))
+	if errors.Is(err, database.ErrNotPersistent) {
+		return fmt.Errorf("%v, the stats of a running node are served "+
+			"at GET /v1/db/stats", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	unlock, err := lockDataDir(cfg)
+	if err != nil {
+		return fmt.Errorf("%v, stop the node first", err)
+	}
+	defer unlock()
+
+	ctx := context.Background()
+	if action == "compact" {
+		if err := db.Compact(ctx); err != nil {
+			return fmt.Errorf("failed to compact database: %v", err)
+		}
+		fmt.Println("Database compacted")
+		return nil
+	}
+
+	stats, err := db.Stats(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database stats: %v", err)
+	}
+	return printDBStats(stats)
+}
+
+// printDBStats writes database statistics to standard output as a table.
+func printDBStats(stats *database.Stats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "KEYSPACE\tENTRIES\tBYTES\t")
+	for _, keyspace := range []struct {
+		name  string
+		stats database.KeyspaceStats
+	}{
+		{"outpoints", stats.Outpoints},
+		{"messages", stats.Messages},
+		{"indexes", stats.Indexes},
+		{"archive", stats.Archive},
+		{"expired", stats.Expired},
+		{"undo", stats.Undo},
+		{"tombstones", stats.Tombstones},
+	} {
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", keyspace.name,
+			keyspace.stats.Entries, keyspace.stats.Bytes)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/database"
+)
+
+// TestDBCommand checks that db refuses unknown actions and a database type
+// with nothing on disk, pointing to the stats of the running node instead.
+func TestDBCommand(t *testing.T) {
+	t.Cleanup(func() { setLogLevels("info") })
+	dataDir := t.TempDir()
+
+	err := dbCommand([]string{"vacuum", "-datadir", dataDir})
+	if err == nil || !strings.Contains(err.Error(), "stats or compact") {
+		t.Fatalf("unknown action gave %v", err)
+	}
+	for _, action := range []string{"stats", "compact"} {
+		err := dbCommand([]string{action, "-datadir", dataDir})
+		if err == nil || !strings.Contains(err.Error(), "/v1/db/stats") {
+			t.Fatalf("%s of a memory database gave %v", action, err)
+		}
+	}
+}
+
+// TestPrintDBStats checks that every keyspace is printed with its entries
+// and bytes.
+func TestPrintDBStats(t *testing.T) {
+	out, err := captureStdout(t, func() error {
+		return printDBStats(&database.Stats{
+			Outpoints:  database.KeyspaceStats{Entries: 5000, Bytes: 180000},
+			Tombstones: database.KeyspaceStats{Entries: 50, Bytes: 2200},
+		})
+	})
+	if err != nil {
+		t.Fatalf("printDBStats: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("printed %d lines, want a header and 7 keyspaces:\n%s",
+			len(lines), out)
+	}
+	for _, want := range [][]string{{"outpoints", "5000", "180000"},
+		{"tombstones", "50", "2200"}, {"archive", "0", "0"}} {
+
+		found := false
+		for _, line := range lines {
+			if slices.Equal(strings.Fields(line), want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("no line %v in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package descriptor
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// inputCharset are the characters a descriptor may contain, ordered so
+	// that the most common ones differ in their low 5 bits.
+	inputCharset = "0123456789()[],'/*abcdefgh@:$%{}" +
+		"IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~" +
+		"ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+
+	// checksumCharset are the characters of a checksum, the bech32 ones.
+	checksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	// checksumSize is the number of characters of a checksum.
+	checksumSize = 8
+)
+
+// generator is the generator of the BCH code used by descriptor checksums.
+var generator = [5]uint64{
+	0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd,
+}
+
+// polymod returns the remainder of the polynomial with coefficients
+// symbols modulo the generator.
+func polymod(symbols []uint64) uint64 {
+	chk := uint64(1)
+	for _, value := range symbols {
+		top := chk >> 35
+		chk = (chk&0x7ffffffff)<<5 ^ value
+		for i, g := range generator {
+			if (top>>i)&1 != 0 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+// Checksum returns the BIP380 checksum of desc, which must not include one.
+func Checksum(desc string) (string, error) {
+	var symbols, groups []uint64
+	for i := 0; i < len(desc); i++ {
+		v := strings.IndexByte(inputCharset, desc[i])
+		if v < 0 {
+			return "", fmt.Errorf("%w: invalid character %q",
+				ErrInvalidDescriptor, desc[i])
+		}
+		symbols = append(symbols, uint64(v&31))
+		groups = append(groups, uint64(v>>5))
+		if len(groups) == 3 {
+			symbols = append(symbols, groups[0]*9+groups[1]*3+groups[2])
+			groups = groups[:0]
+		}
+	}
+	switch len(groups) {
+	case 1:
+		symbols = append(symbols, groups[0])
+	case 2:
+		symbols = append(symbols, groups[0]*3+groups[1])
+	}
+	symbols = append(symbols, make([]uint64, checksumSize)...)
+
+	chk := polymod(symbols) ^ 1
+	var checksum [checksumSize]byte
+	for i := range checksum {
+		checksum[i] = checksumCharset[(chk>>(5*(7-i)))&31]
+	}
+	return string(checksum[:]), nil
+}
+
+// verifyChecksum checks that checksum is the checksum of desc.
+func verifyChecksum(desc, checksum string) error {
+	if len(checksum) != checksumSize {
+		return fmt.Errorf("%w: checksum %q is not %d characters",
+			ErrBadChecksum, checksum, checksumSize)
+	}
+	expected, err := Checksum(desc)
+	if err != nil {
+		return err
+	}
+	if checksum != expected {
+		return fmt.Errorf("%w: got %s, expected %s", ErrBadChecksum,
+			checksum, expected)
+	}
+	return nil
+}
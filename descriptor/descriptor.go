@@ -0,0 +1,209 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package descriptor parses the single key taproot output descriptors of
+// BIP386, tr(KEY/PATH), holding an extended private key, as printed by
+// bitcoin-cli listdescriptors true.
+package descriptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+)
+
+var (
+	// ErrInvalidDescriptor is returned for a descriptor that is malformed
+	// or not a single key taproot descriptor holding an extended private
+	// key.
+	ErrInvalidDescriptor = errors.New("invalid descriptor")
+
+	// ErrBadChecksum is returned when the checksum following a descriptor
+	// doesn't match it.
+	ErrBadChecksum = errors.New("descriptor checksum mismatch")
+
+	// ErrRangeIndex is returned when deriving a key at an index the
+	// descriptor can't have: other than zero for a descriptor that isn't a
+	// range, or a hardened index.
+	ErrRangeIndex = errors.New("invalid range index")
+)
+
+// Descriptor is a parsed tr(KEY/PATH) descriptor.
+type Descriptor struct {
+	// Key is the extended private key the derivation path starts from.
+	Key *hdkeychain.ExtendedKey
+
+	// Path is the BIP32 derivation path from Key, hardened steps offset by
+	// hdkeychain.HardenedKeyStart. The range step of a range descriptor
+	// is not included.
+	Path []uint32
+
+	// Range is set for a descriptor whose path ends in /*, which stands
+	// for every child index. RangeHardened is set if it ends in /*h.
+	Range         bool
+	RangeHardened bool
+}
+
+// Parse parses a tr(KEY/PATH) descriptor, optionally followed by its
+// #checksum, which must then be valid. KEY may be preceded by its key origin
+// in brackets, which is not needed to derive keys and is only checked for
+// syntax. Hardened steps may be marked with h, H or '.
+func Parse(descriptor string) (*Descriptor, error) {
+	desc := strings.TrimSpace(descriptor)
+	if body, checksum, ok := strings.Cut(desc, "#"); ok {
+		if err := verifyChecksum(body, checksum); err != nil {
+			return nil, err
+		}
+		desc = body
+	}
+
+	name, args, ok := strings.Cut(desc, "(")
+	if !ok || !strings.HasSuffix(args, ")") {
+		return nil, fmt.Errorf("%w: expected tr(KEY/PATH)",
+			ErrInvalidDescriptor)
+	}
+	if name != "tr" {
+		return nil, fmt.Errorf("%w: unsupported script expression %s(), "+
+			"only tr() is supported", ErrInvalidDescriptor, name)
+	}
+	args = strings.TrimSuffix(args, ")")
+	if strings.ContainsAny(args, ",{}()") {
+		return nil, fmt.Errorf("%w: script trees and nested expressions "+
+			"are not supported", ErrInvalidDescriptor)
+	}
+
+	keyExpr, err := stripOrigin(args)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(keyExpr, "/")
+
+	key, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: KEY must be an extended private key: %v",
+			ErrInvalidDescriptor, err)
+	}
+	if !key.IsPrivate() {
+		return nil, fmt.Errorf("%w: KEY must be an extended private key",
+			ErrInvalidDescriptor)
+	}
+
+	d := &Descriptor{Key: key}
+	steps := parts[1:]
+	if len(steps) > 0 {
+		last := steps[len(steps)-1]
+		switch last {
+		case "*":
+			d.Range = true
+		case "*h", "*H", "*'":
+			d.Range = true
+			d.RangeHardened = true
+		}
+		if d.Range {
+			steps = steps[:len(steps)-1]
+		}
+	}
+	for _, step := range steps {
+		index, err := parsePathStep(step)
+		if err != nil {
+			return nil, err
+		}
+		d.Path = append(d.Path, index)
+	}
+	return d, nil
+}
+
+// stripOrigin returns the key expression keyExpr without the [fingerprint/path]
+// key origin preceding it, if any.
+func stripOrigin(keyExpr string) (string, error) {
+	if !strings.HasPrefix(keyExpr, "[") {
+		return keyExpr, nil
+	}
+
+	origin, rest, ok := strings.Cut(keyExpr[1:], "]")
+	if !ok {
+		return "", fmt.Errorf("%w: unterminated key origin",
+			ErrInvalidDescriptor)
+	}
+	parts := strings.Split(origin, "/")
+	if fingerprint, err := hex.DecodeString(parts[0]); err != nil ||
+		len(fingerprint) != 4 {
+
+		return "", fmt.Errorf("%w: key origin fingerprint %q is not 8 hex "+
+			"characters", ErrInvalidDescriptor, parts[0])
+	}
+	for _, step := range parts[1:] {
+		if _, err := parsePathStep(step); err != nil {
+			return "", err
+		}
+	}
+	return rest, nil
+}
+
+// parsePathStep parses a single BIP32 derivation step.
+func parsePathStep(step string) (uint32, error) {
+	if step == "" {
+		return 0, fmt.Errorf("%w: empty derivation step", ErrInvalidDescriptor)
+	}
+
+	var offset uint32
+	num := step
+	switch num[len(num)-1] {
+	case 'h', 'H', '\'':
+		num = num[:len(num)-1]
+		offset = hdkeychain.HardenedKeyStart
+	}
+
+	// ParseUint alone would also accept a sign or underscores
+	for _, c := range num {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: bad derivation step %q",
+				ErrInvalidDescriptor, step)
+		}
+	}
+	index, err := strconv.ParseUint(num, 10, 32)
+	if err != nil || uint32(index) >= hdkeychain.HardenedKeyStart {
+		return 0, fmt.Errorf("%w: bad derivation step %q",
+			ErrInvalidDescriptor, step)
+	}
+	return uint32(index) + offset, nil
+}
+
+// PrivateKey derives the private key of the descriptor. For a range
+// descriptor index is the child index standing for the *, otherwise it must
+// be zero.
+func (d *Descriptor) PrivateKey(index uint32) (*btcec.PrivateKey, error) {
+	path := d.Path
+	switch {
+	case !d.Range && index != 0:
+		return nil, fmt.Errorf("%w: index %d given for a descriptor that "+
+			"isn't a range", ErrRangeIndex, index)
+
+	case d.Range && index >= hdkeychain.HardenedKeyStart:
+		return nil, fmt.Errorf("%w: index %d is hardened, use /*h",
+			ErrRangeIndex, index)
+
+	case d.Range && d.RangeHardened:
+		path = append(path[:len(path):len(path)],
+			index+hdkeychain.HardenedKeyStart)
+
+	case d.Range:
+		path = append(path[:len(path):len(path)], index)
+	}
+
+	key := d.Key
+	for _, step := range path {
+		var err error
+		key, err = key.Derive(step)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive step %d: %v", step, err)
+		}
+	}
+	return key.ECPrivKey()
+}
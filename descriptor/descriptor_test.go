@@ -0,0 +1,209 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package descriptor
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// testMaster is the BIP32 root key of the BIP86 test vectors, derived from
+// the mnemonic "abandon abandon ... about".
+const testMaster = "xprv9s21ZrQH143K3GJpoapnV8SFfukcVBSfeCficPSGfubmSFDx" +
+	"o1kuHnLisriDvSnRRuL2Qrg5ggqHKNVpxR86QEC8w35uxmGoggxtQTPvfUu"
+
+// outputKey returns the hex encoded taproot output key, without a script
+// tree, of the key d derives at index.
+func outputKey(t *testing.T, d *Descriptor, index uint32) string {
+	t.Helper()
+
+	key, err := d.PrivateKey(index)
+	if err != nil {
+		t.Fatalf("PrivateKey(%d): %v", index, err)
+	}
+	output := txscript.ComputeTaprootKeyNoScript(key.PubKey())
+	return hex.EncodeToString(schnorr.SerializePubKey(output))
+}
+
+// TestChecksum checks the checksum of the BIP380 example, and that a
+// character outside the descriptor charset is refused.
+func TestChecksum(t *testing.T) {
+	checksum, err := Checksum("raw(deadbeef)")
+	if err != nil || checksum != "89f8spxm" {
+		t.Fatalf("checksum %q, %v, want 89f8spxm", checksum, err)
+	}
+	if _, err := Checksum("raw(dé)"); !errors.Is(err,
+		ErrInvalidDescriptor) {
+
+		t.Fatalf("non-ASCII descriptor gave %v, want ErrInvalidDescriptor",
+			err)
+	}
+}
+
+// TestParseVectors checks the keys derived from the descriptors of the BIP86
+// test vectors, with and without their checksum and with each hardened
+// marker.
+func TestParseVectors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		index uint32
+		want  string
+	}{
+		{"tr(" + testMaster + "/86h/0h/0h/0/*)", 0,
+			"a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c"},
+		{"tr(" + testMaster + "/86'/0'/0'/0/*)", 1,
+			"a82f29944d65b86ae6b5e5cc75e294ead6c59391a1edc5e016e3498c67fc7bbb"},
+		{"tr(" + testMaster + "/86H/0H/0H/1/0)", 0,
+			"882d74e5d0572d5a816cef0041a96b6c1de832f6f9676d9605c44d5e9a97d3dc"},
+		{"tr([73c5da0a/86h/0h/0h]" + testMaster + "/86h/0h/0h/0/0)", 0,
+			"a60869f0dbcf1dc659c9cecbaf8050135ea9e8cdc487053f1dc6880949dc684c"},
+	}
+	for _, test := range tests {
+		checksum, err := Checksum(test.desc)
+		if err != nil {
+			t.Fatalf("Checksum(%s): %v", test.desc, err)
+		}
+		for _, desc := range []string{test.desc, test.desc + "#" + checksum,
+			" " + test.desc + "\n"} {
+
+			d, err := Parse(desc)
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", desc, err)
+			}
+			if got := outputKey(t, d, test.index); got != test.want {
+				t.Fatalf("%s at %d derived %s, want %s", desc,
+					test.index, got, test.want)
+			}
+		}
+	}
+}
+
+// TestParseRange checks the range flags and path of range descriptors, and
+// the indexes they can be derived at.
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		path     string
+		isRange  bool
+		hardened bool
+		steps    int
+	}{
+		{"/0/1", false, false, 2},
+		{"/0/*", true, false, 1},
+		{"/0/*h", true, true, 1},
+		{"/0/*'", true, true, 1},
+		{"", false, false, 0},
+	}
+	for _, test := range tests {
+		d, err := Parse("tr(" + testMaster + test.path + ")")
+		if err != nil {
+			t.Fatalf("Parse(%s): %v", test.path, err)
+		}
+		if d.Range != test.isRange || d.RangeHardened != test.hardened ||
+			len(d.Path) != test.steps {
+
+			t.Fatalf("%s parsed as %+v", test.path, d)
+		}
+	}
+
+	fixed, _ := Parse("tr(" + testMaster + "/0/1)")
+	if _, err := fixed.PrivateKey(1); !errors.Is(err, ErrRangeIndex) {
+		t.Fatalf("index of a fixed descriptor gave %v, want ErrRangeIndex",
+			err)
+	}
+	ranged, _ := Parse("tr(" + testMaster + "/0/*)")
+	if _, err := ranged.PrivateKey(hdkeychain.HardenedKeyStart); !errors.Is(
+		err, ErrRangeIndex) {
+
+		t.Fatalf("hardened index gave %v, want ErrRangeIndex", err)
+	}
+
+	// A hardened range derives other keys than a plain one
+	hardened, _ := Parse("tr(" + testMaster + "/0/*h)")
+	if outputKey(t, hardened, 0) == outputKey(t, ranged, 0) {
+		t.Fatal("hardened range derived the unhardened key")
+	}
+}
+
+// TestParseChecksum checks that a descriptor with a checksum that doesn't
+// match, or isn't 8 characters, is refused.
+func TestParseChecksum(t *testing.T) {
+	desc := "tr(" + testMaster + "/86h/0h/0h/0/*)"
+	checksum, err := Checksum(desc)
+	if err != nil {
+		t.Fatalf("Checksum: %v", err)
+	}
+
+	// Flipping a character of either part breaks the checksum
+	flipped := []byte(checksum)
+	flipped[0] = checksumCharset[(strings.IndexByte(checksumCharset,
+		flipped[0])+1)%len(checksumCharset)]
+	tests := []string{
+		desc + "#" + string(flipped),
+		strings.Replace(desc, "/0/*", "/1/*", 1) + "#" + checksum,
+		desc + "#" + checksum[:7],
+		desc + "#" + checksum + "q",
+		desc + "#",
+	}
+	for _, bad := range tests {
+		if _, err := Parse(bad); !errors.Is(err, ErrBadChecksum) {
+			t.Fatalf("%s gave %v, want ErrBadChecksum", bad, err)
+		}
+	}
+}
+
+// TestParseInvalid checks that malformed descriptors, truncated paths and
+// unsupported expressions are refused with ErrInvalidDescriptor.
+func TestParseInvalid(t *testing.T) {
+	master, err := hdkeychain.NewKeyFromString(testMaster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		desc string
+	}{
+		{"empty", ""},
+		{"unclosed", "tr(" + testMaster + "/0"},
+		{"wpkh", "wpkh(" + testMaster + "/0)"},
+		{"sh", "sh(wpkh(" + testMaster + "/0))"},
+		{"script tree", "tr(" + testMaster + ",{pk(" + testMaster + ")})"},
+		{"public key", "tr(" + xpub.String() + "/0/*)"},
+		{"WIF key", "tr(L4rK1yDtCWekvXuE6oXD9jCYfFNV2cWRpVuPLBcCU2z8TrisoyY1)"},
+		{"trailing slash", "tr(" + testMaster + "/0/)"},
+		{"empty step", "tr(" + testMaster + "//0)"},
+		{"bare slash", "tr(" + testMaster + "/)"},
+		{"range not last", "tr(" + testMaster + "/*/0)"},
+		{"double marker", "tr(" + testMaster + "/0hh)"},
+		{"signed step", "tr(" + testMaster + "/+1)"},
+		{"step too large", "tr(" + testMaster + "/2147483648)"},
+		{"bad origin", "tr([73c5da/86h]" + testMaster + "/0)"},
+		{"unterminated origin", "tr([73c5da0a/86h" + testMaster + "/0)"},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.desc); !errors.Is(err,
+			ErrInvalidDescriptor) {
+
+			t.Fatalf("%s: got %v, want ErrInvalidDescriptor", test.name,
+				err)
+		}
+	}
+
+	// The refusal of a script expression names it
+	_, err = Parse("wpkh(" + testMaster + ")")
+	if err == nil || !strings.Contains(err.Error(), "wpkh") {
+		t.Fatalf("unsupported expression gave %v", err)
+	}
+}
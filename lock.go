@@ -0,0 +1,173 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/shaibearary/utxo_chat/database"
+)
+
+// lockFileName is the name of the lock file in the data directory.
+const lockFileName = ".lock"
+
+// errLocked is returned when a lock is held by another running process.
+var errLocked = errors.New("in use by another utxochat process")
+
+// fileLock is an exclusive lock held on a file while the node runs. The file
+// holds the PID of the process holding the lock.
+type fileLock struct {
+	file *os.File
+	path string
+}
+
+// acquireLock locks the file at path, creating it if needed. It fails at once
+// with errLocked if another running process holds the lock. A lock left by a
+// process that didn't shut down cleanly is taken over.
+func acquireLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	pid := readLockPID(f)
+	if err := lockFile(f, pid); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) && pid != 0 {
+			return nil, fmt.Errorf("%s is %w (pid %d)", path, err, pid)
+		}
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("%s is %w", path, err)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	if pid != 0 && pid != os.Getpid() {
+		chatLog.Warnf("Recovering stale lock %s of pid %d, which did not "+
+			"shut down cleanly", path, pid)
+	}
+
+	// Record our PID so a second instance can name the holder.
+	pidLine := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt(pidLine, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, fmt.Errorf("failed to write lock file %s: %v", path, err)
+	}
+	return &fileLock{file: f, path: path}, nil
+}
+
+// Release clears the recorded PID and releases the lock. The file is kept,
+// removing it would let a process waiting on the old file and one creating a
+// new file both hold a lock.
+func (l *fileLock) Release() {
+	if err := l.file.Truncate(0); err != nil {
+		chatLog.Warnf("Failed to clear lock file %s: %v", l.path, err)
+	}
+	unlockFile(l.file)
+	l.file.Close()
+}
+
+// readLockPID returns the PID recorded in a lock file, zero if there is none.
+func readLockPID(f *os.File) int {
+	data, err := io.ReadAll(io.LimitReader(f, 32))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// lockDataDir locks the data directory for the lifetime of the node, and the
+// directory of a persistent database kept outside of it. The returned
+// function releases the locks.
+func lockDataDir(cfg *config) (func(), error) {
+	paths := []string{filepath.Join(cfg.DataDir, lockFileName)}
+	if cfg.Database.Type != string(database.TypeMemory) &&
+		!withinDir(cfg.DataDir, cfg.Database.Path) {
+
+		paths = append(paths, cfg.Database.Path+lockFileName)
+	}
+
+	locks := make([]*fileLock, 0, len(paths))
+	release := func() {
+		for _, lock := range locks {
+			lock.Release()
+		}
+	}
+	for _, path := range paths {
+		lock, err := acquireLock(path)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	return release, nil
+}
+
+// withinDir reports whether path is inside dir.
+func withinDir(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkListenAddrs binds and releases each address the node listens on, so
+// an address in use is reported before any subsystem starts.
+func checkListenAddrs(cfg *config) error {
+	addrs := []struct {
+		key  string
+		addr string
+	}{
+		{"network.listen_addr", cfg.Network.ListenAddr},
+	}
+	if cfg.API.Enabled {
+		addrs = append(addrs, struct {
+			key  string
+			addr string
+		}{"api.listen_addr", cfg.API.ListenAddr})
+	}
+
+	for _, a := range addrs {
+		listener, err := net.Listen("tcp", a.addr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("%s %s is already in use, stop the process "+
+				"listening on it or set %[1]s to a free address", a.key,
+				a.addr)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s %s: %v", a.key, a.addr,
+				err)
+		}
+		listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestAcquireLock checks that a lock can't be taken twice, and that it can
+// once released.
+func TestAcquireLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("locks are only told apart by PID on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), lockFileName)
+	lock, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != pid+"\n" {
+		t.Fatalf("lock file holds %q, %v, want our pid", data, err)
+	}
+
+	_, err = acquireLock(path)
+	if !errors.Is(err, errLocked) {
+		t.Fatalf("second lock got %v, want errLocked", err)
+	}
+	if !strings.Contains(err.Error(), "pid "+pid) {
+		t.Fatalf("error %q doesn't name the holder", err)
+	}
+
+	lock.Release()
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Fatalf("released lock file still holds %q", data)
+	}
+
+	lock, err = acquireLock(path)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	lock.Release()
+}
+
+// TestAcquireStaleLock checks that a lock file left by a process that didn't
+// shut down cleanly is taken over.
+func TestAcquireStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockFileName)
+	if err := os.WriteFile(path, []byte("999999999\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	defer lock.Release()
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Fatalf("lock file holds %q, %v, want our pid", data, err)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+)
+
+// lockFile takes the lock on f unless the process with the PID recorded in it
+// is still running. Without flock, a lock left by a process that crashed is
+// only detected stale through the recorded PID.
+func lockFile(f *os.File, pid int) error {
+	if pid != 0 && pid != os.Getpid() && processAlive(pid) {
+		return errLocked
+	}
+	return nil
+}
+
+// unlockFile releases the lock on f.
+func unlockFile(f *os.File) {}
+
+// processAlive reports whether a process with the PID is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
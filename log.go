@@ -0,0 +1,199 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btclog"
+	"github.com/jrick/logrotate/rotator"
+	"github.com/shaibearary/utxo_chat/api"
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/network"
+)
+
+const (
+	// defaultLogDirname is the directory in the data directory holding the
+	// log files.
+	defaultLogDirname = "logs"
+
+	// defaultLogFilename is the name of the log file.
+	defaultLogFilename = "utxochat.log"
+
+	// logRotateThresholdKB is the size in KB a log file grows to before it
+	// is rotated.
+	logRotateThresholdKB = 10 * 1024
+
+	// logMaxRolls is the number of rotated log files kept.
+	logMaxRolls = 3
+)
+
+// logWriter implements an io.Writer that outputs to both standard output and
+// the write-end pipe of an initialized log rotator.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (n int, err error) {
+	os.Stdout.Write(p)
+	if logRotator != nil {
+		logRotator.Write(p)
+	}
+	return len(p), nil
+}
+
+// Loggers per subsystem. A single backend logger is created and all subsystem
+// loggers created from it will write to the backend. When adding new
+// subsystems, add the subsystem logger variable here and to the
+// subsystemLoggers map.
+//
+// Loggers can not be used before the log rotator has been initialized with a
+// log file. This must be performed early during application startup by
+// calling initLogRotator.
+var (
+	// backendLog is the logging backend used to create all subsystem
+	// loggers. The backend must not be used before the log rotator has
+	// been initialized, or data races and/or nil pointer dereferences will
+	// occur.
+	backendLog = btclog.NewBackend(logWriter{})
+
+	// logRotator is one of the logging outputs. It should be closed on
+	// application shutdown.
+	logRotator *rotator.Rotator
+
+	chatLog  = backendLog.Logger("CHAT")
+	netLog   = backendLog.Logger("NET")
+	chainLog = backendLog.Logger("CHAIN")
+	dbLog    = backendLog.Logger("DB")
+	validLog = backendLog.Logger("VALID")
+	apiLog   = backendLog.Logger("API")
+)
+
+// Initialize package-global logger variables.
+func init() {
+	network.UseLogger(netLog)
+	blockchain.UseLogger(chainLog)
+	database.UseLogger(dbLog)
+	database.UseValidatorLogger(validLog)
+	api.UseLogger(apiLog)
+}
+
+// subsystemLoggers maps each subsystem identifier to its associated logger.
+var subsystemLoggers = map[string]btclog.Logger{
+	"CHAT":  chatLog,
+	"NET":   netLog,
+	"CHAIN": chainLog,
+	"DB":    dbLog,
+	"VALID": validLog,
+	"API":   apiLog,
+}
+
+// initLogRotator initializes the logging rotator to write logs to logFile and
+// create roll files in the same directory. It must be called before the
+// package-global log rotator variables are used.
+func initLogRotator(logFile string) error {
+	logDir, _ := filepath.Split(logFile)
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %v", err)
+	}
+	r, err := rotator.New(logFile, logRotateThresholdKB, false, logMaxRolls)
+	if err != nil {
+		return fmt.Errorf("failed to create file rotator: %v", err)
+	}
+
+	logRotator = r
+	return nil
+}
+
+// setLogLevel sets the logging level for provided subsystem. Invalid
+// subsystems are ignored. Uninitialized subsystems are dynamically created as
+// needed.
+func setLogLevel(subsystemID string, logLevel string) {
+	// Ignore invalid subsystems.
+	logger, ok := subsystemLoggers[subsystemID]
+	if !ok {
+		return
+	}
+
+	// Defaults to info if the log level is invalid.
+	level, _ := btclog.LevelFromString(logLevel)
+	logger.SetLevel(level)
+}
+
+// setLogLevels sets the log level for all subsystem loggers to the passed
+// level.
+func setLogLevels(logLevel string) {
+	for subsystemID := range subsystemLoggers {
+		setLogLevel(subsystemID, logLevel)
+	}
+}
+
+// validLogLevel returns whether or not logLevel is a valid debug log level.
+func validLogLevel(logLevel string) bool {
+	_, ok := btclog.LevelFromString(logLevel)
+	return ok
+}
+
+// supportedSubsystems returns a sorted slice of the supported subsystems for
+// logging purposes.
+func supportedSubsystems() []string {
+	subsystems := make([]string, 0, len(subsystemLoggers))
+	for subsysID := range subsystemLoggers {
+		subsystems = append(subsystems, subsysID)
+	}
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// parseAndSetDebugLevels attempts to parse the specified debug level and set
+// the levels accordingly. An appropriate error is returned if anything is
+// invalid. The level is either a single level applied to every subsystem, or
+// a comma separated list of subsystem=level pairs such as "NET=debug,DB=warn".
+func parseAndSetDebugLevels(debugLevel string) error {
+	// When the specified string doesn't have any delimiters, treat it as
+	// the log level for all subsystems.
+	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
+		// Validate debug log level.
+		if !validLogLevel(debugLevel) {
+			return fmt.Errorf("the specified debug level [%v] is invalid",
+				debugLevel)
+		}
+
+		// Change the logging level for all subsystems.
+		setLogLevels(debugLevel)
+		return nil
+	}
+
+	// Split the specified string into subsystem/level pairs while detecting
+	// issues and update the log levels accordingly.
+	for _, logLevelPair := range strings.Split(debugLevel, ",") {
+		if !strings.Contains(logLevelPair, "=") {
+			return fmt.Errorf("the specified debug level contains an "+
+				"invalid subsystem/level pair [%v]", logLevelPair)
+		}
+
+		// Extract the specified subsystem and log level.
+		fields := strings.Split(logLevelPair, "=")
+		subsysID, logLevel := fields[0], fields[1]
+
+		// Validate subsystem.
+		if _, exists := subsystemLoggers[subsysID]; !exists {
+			return fmt.Errorf("the specified subsystem [%v] is invalid -- "+
+				"supported subsystems %v", subsysID, supportedSubsystems())
+		}
+
+		// Validate log level.
+		if !validLogLevel(logLevel) {
+			return fmt.Errorf("the specified debug level [%v] is invalid",
+				logLevel)
+		}
+
+		setLogLevel(subsysID, logLevel)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btclog"
+)
+
+// TestParseAndSetDebugLevels checks that a single level applies to every
+// subsystem, that subsystem=level pairs only change their subsystem, and
+// that unknown levels and subsystems are refused.
+func TestParseAndSetDebugLevels(t *testing.T) {
+	t.Cleanup(func() { setLogLevels("info") })
+
+	if err := parseAndSetDebugLevels("warn"); err != nil {
+		t.Fatalf("parseAndSetDebugLevels: %v", err)
+	}
+	for id, logger := range subsystemLoggers {
+		if logger.Level() != btclog.LevelWarn {
+			t.Fatalf("%s at level %v, want warn", id, logger.Level())
+		}
+	}
+
+	if err := parseAndSetDebugLevels("NET=trace,DB=error"); err != nil {
+		t.Fatalf("parseAndSetDebugLevels: %v", err)
+	}
+	want := map[string]btclog.Level{"NET": btclog.LevelTrace,
+		"DB": btclog.LevelError}
+	for id, logger := range subsystemLoggers {
+		level, ok := want[id]
+		if !ok {
+			level = btclog.LevelWarn
+		}
+		if logger.Level() != level {
+			t.Fatalf("%s at level %v, want %v", id, logger.Level(), level)
+		}
+	}
+
+	for _, bad := range []string{"loud", "NET=loud", "FOO=debug", "NET",
+		"NET=debug,DB"} {
+
+		if err := parseAndSetDebugLevels(bad); err == nil {
+			t.Fatalf("debug level %q accepted", bad)
+		}
+	}
+}
+
+// TestLogLevelFiltering checks that the log file under the data directory
+// only gets the lines at or above the level of their subsystem.
+func TestLogLevelFiltering(t *testing.T) {
+	t.Cleanup(func() { setLogLevels("info") })
+
+	logFile := filepath.Join(t.TempDir(), defaultLogDirname,
+		defaultLogFilename)
+	if err := initLogRotator(logFile); err != nil {
+		t.Fatalf("initLogRotator: %v", err)
+	}
+
+	if err := parseAndSetDebugLevels("info"); err != nil {
+		t.Fatal(err)
+	}
+	netLog.Info("info line at info")
+	netLog.Debug("debug line at info")
+	netLog.Trace("trace line at info")
+	chainLog.Warn("warn line at info")
+
+	// As with -debug
+	if err := parseAndSetDebugLevels("debug"); err != nil {
+		t.Fatal(err)
+	}
+	netLog.Debug("debug line at debug")
+	netLog.Trace("trace line at debug")
+
+	if err := parseAndSetDebugLevels("info,NET=trace"); err == nil {
+		t.Fatal("mixed level list accepted")
+	}
+	if err := parseAndSetDebugLevels("CHAIN=error,NET=trace"); err != nil {
+		t.Fatal(err)
+	}
+	netLog.Trace("trace line at trace")
+	chainLog.Warn("warn line at error")
+
+	logRotator.Close()
+	logRotator = nil
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	log := string(data)
+	for line, want := range map[string]bool{
+		"info line at info":   true,
+		"debug line at info":  false,
+		"trace line at info":  false,
+		"warn line at info":   true,
+		"debug line at debug": true,
+		"trace line at debug": false,
+		"trace line at trace": true,
+		"warn line at error":  false,
+	} {
+		if strings.Contains(log, line) != want {
+			t.Errorf("%q logged: %v, want %v", line, !want, want)
+		}
+	}
+	if !strings.Contains(log, "[INF] NET: info line at info") {
+		t.Fatalf("lines lack their level and subsystem:\n%s", log)
+	}
+}
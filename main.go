@@ -7,24 +7,32 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
 	"runtime/trace"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/shaibearary/utxo_chat/api"
 	"github.com/shaibearary/utxo_chat/bitcoin"
 	"github.com/shaibearary/utxo_chat/blockchain"
 	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
 	"github.com/shaibearary/utxo_chat/network"
 	"github.com/shaibearary/utxo_chat/utils"
 )
@@ -32,6 +40,20 @@ import (
 const (
 	// dbNamePrefix is the prefix for the UTXOchat database name.
 	dbNamePrefix = "utxochat"
+
+	// defaultConfigFile is the config file read when -config is not given.
+	defaultConfigFile = "config.json"
+
+	// defaultTOMLConfigFile is read instead of defaultConfigFile when only
+	// the TOML config exists.
+	defaultTOMLConfigFile = "config.toml"
+
+	// envRPCUser and envRPCPass override the Bitcoin RPC credentials.
+	envRPCUser = "UTXOCHAT_BITCOIN_RPCUSER"
+	envRPCPass = "UTXOCHAT_BITCOIN_RPCPASS"
+
+	// envAPIToken overrides the HTTP API token.
+	envAPIToken = "UTXOCHAT_API_TOKEN"
 )
 
 var (
@@ -39,14 +61,26 @@ var (
 )
 
 // utxoChatMain is the real main function for UTXOchat. It is necessary to work around
-// the fact that deferred functions do not run when os.Exit() is called.
-func utxoChatMain() error {
+// the fact that deferred functions do not run when os.Exit() is called. It runs
+// the node with the start command's arguments.
+func utxoChatMain(args []string) error {
 	// Load configuration and parse command line.
-	tcfg, err := loadConfig()
+	tcfg, err := loadConfig(args)
 	if err != nil {
 		return err
 	}
 	cfg = tcfg
+
+	// Print the effective configuration and exit if requested.
+	if cfg.dumpConfig {
+		return writeConfig(os.Stdout, cfg)
+	}
+
+	// Initialize the log rotator now that the data directory is known.
+	logFile := filepath.Join(cfg.DataDir, defaultLogDirname, defaultLogFilename)
+	if err := initLogRotator(logFile); err != nil {
+		return err
+	}
 	defer func() {
 		if logRotator != nil {
 			logRotator.Close()
@@ -54,23 +88,23 @@ func utxoChatMain() error {
 	}()
 
 	// Show version at startup.
-	log.Printf("UTXOchat Version %s", version())
+	chatLog.Infof("UTXOchat Version %s", version())
 
 	// Get a channel that will be closed when a shutdown signal has been
 	// triggered either from an OS signal such as SIGINT (Ctrl+C) or from
 	// another subsystem such as the RPC server.
 	interrupt := interruptListener()
-	defer log.Println("Shutdown complete")
+	defer chatLog.Info("Shutdown complete")
 
 	// Enable http profiling server if requested.
 	if cfg.Debug.Profile != "" {
 		go func() {
 			listenAddr := net.JoinHostPort("", cfg.Debug.Profile)
-			log.Printf("Profile server listening on %s", listenAddr)
+			chatLog.Infof("Profile server listening on %s", listenAddr)
 			profileRedirect := http.RedirectHandler("/debug/pprof",
 				http.StatusSeeOther)
 			http.Handle("/", profileRedirect)
-			log.Printf("%v", http.ListenAndServe(listenAddr, nil))
+			chatLog.Errorf("%v", http.ListenAndServe(listenAddr, nil))
 		}()
 	}
 
@@ -78,7 +112,7 @@ func utxoChatMain() error {
 	if cfg.Debug.CPUProfile != "" {
 		f, err := os.Create(cfg.Debug.CPUProfile)
 		if err != nil {
-			log.Printf("Unable to create cpu profile: %v", err)
+			chatLog.Errorf("Unable to create cpu profile: %v", err)
 			return err
 		}
 		pprof.StartCPUProfile(f)
@@ -90,7 +124,7 @@ func utxoChatMain() error {
 	if cfg.Debug.MemoryProfile != "" {
 		f, err := os.Create(cfg.Debug.MemoryProfile)
 		if err != nil {
-			log.Printf("Unable to create memory profile: %v", err)
+			chatLog.Errorf("Unable to create memory profile: %v", err)
 			return err
 		}
 		defer f.Close()
@@ -102,7 +136,7 @@ func utxoChatMain() error {
 	if cfg.Debug.TraceProfile != "" {
 		f, err := os.Create(cfg.Debug.TraceProfile)
 		if err != nil {
-			log.Printf("Unable to create execution trace: %v", err)
+			chatLog.Errorf("Unable to create execution trace: %v", err)
 			return err
 		}
 		defer f.Close()
@@ -111,7 +145,7 @@ func utxoChatMain() error {
 
 	// Perform upgrades to UTXOchat as new versions require it.
 	if err := doUpgrades(); err != nil {
-		log.Printf("%v", err)
+		chatLog.Errorf("%v", err)
 		return err
 	}
 
@@ -122,7 +156,21 @@ func utxoChatMain() error {
 
 	// Ensure data directory exists.
 	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
-		log.Printf("Failed to create data directory: %v", err)
+		chatLog.Errorf("Failed to create data directory: %v", err)
+		return err
+	}
+
+	// Refuse to share the data directory with another running node.
+	unlock, err := lockDataDir(cfg)
+	if err != nil {
+		chatLog.Errorf("Failed to lock data directory: %v", err)
+		return err
+	}
+	defer unlock()
+
+	// Report an address in use before connecting to the Bitcoin node.
+	if err := checkListenAddrs(cfg); err != nil {
+		chatLog.Errorf("Failed to listen: %v", err)
 		return err
 	}
 
@@ -133,30 +181,41 @@ func utxoChatMain() error {
 	// Initialize Bitcoin client.
 	bitcoinClient, err := newBitcoinClient(cfg.Bitcoin)
 	if err != nil {
-		log.Printf("Failed to initialize Bitcoin client: %v", err)
+		chatLog.Errorf("Failed to initialize Bitcoin client: %v", err)
 		return err
 	}
 
 	// Check Bitcoin connection.
 	info, err := bitcoinClient.GetBlockchainInfo(ctx)
 	if err != nil {
-		log.Printf("Failed to connect to Bitcoin node: %v", err)
+		chatLog.Errorf("Failed to connect to Bitcoin node: %v", err)
+		return err
+	}
+	chatLog.Infof("Connected to Bitcoin node, chain: %s, blocks: %d", info.Chain, info.Blocks)
+
+	// Watch the health of the nodes to fail over between.
+	if failover, ok := bitcoinClient.(*bitcoin.FailoverClient); ok {
+		failover.Start(ctx)
+	}
+
+	// Refuse to anchor messages to UTXOs of the wrong network.
+	chain := bitcoin.Chain(cfg.Bitcoin.Chain)
+	if info.Chain != chain.RPCName() {
+		err := fmt.Errorf("bitcoin node is on chain %q, configured for %s",
+			info.Chain, chain)
+		chatLog.Errorf("Wrong Bitcoin network: %v", err)
 		return err
 	}
-	log.Printf("Connected to Bitcoin node, chain: %s, blocks: %d", info.Chain, info.Blocks)
 
 	// Initialize database.
-	db, err := database.New(database.Config{
-		Type: database.Type(cfg.Database.Type),
-		Path: cfg.Database.Path,
-	})
+	db, err := database.New(newDatabaseConfig(cfg))
 	if err != nil {
-		log.Printf("Failed to initialize database: %v", err)
+		chatLog.Errorf("Failed to initialize database: %v", err)
 		return err
 	}
 	defer func() {
 		// Ensure the database is sync'd and closed on shutdown.
-		log.Printf("Gracefully shutting down the database...")
+		chatLog.Info("Gracefully shutting down the database...")
 		db.Close()
 	}()
 
@@ -165,41 +224,86 @@ func utxoChatMain() error {
 		return nil
 	}
 
+	// Share one UTXO lookup cache between message validation and the block
+	// handler, which keeps it in step with the chain.
+	chainClient := bitcoinClient
+	if cfg.Bitcoin.UTXOCacheSize > 0 {
+		chainClient = newUTXOCache(bitcoinClient, cfg.Bitcoin)
+	}
+
 	// Initialize message validator.
-	validator := database.NewValidator(bitcoinClient, db)
+	validator := database.NewValidatorWithConfig(chainClient, db, database.ValidatorConfig{
+		MinUtxoValue:     cfg.Message.MinUtxoValue,
+		MinConfirmations: cfg.Message.MinConfirmations,
+		MaxOutpointBytes: cfg.Message.MaxMessageSize,
+		Limits: message.Limits{
+			MaxPayloadSize: cfg.Message.MaxPayloadSize,
+		},
+	})
 
 	// Initialize P2P network.
-	networkCfg := network.Config{
-		ListenAddr:       cfg.Network.ListenAddr,
-		KnownPeers:       cfg.Network.KnownPeers,
-		HandshakeTimeout: cfg.Network.HandshakeTimeout,
-	}
-	networkManager, err := network.NewManager(networkCfg, validator, db)
+	networkManager, err := network.NewManager(newNetworkConfig(cfg), validator, db)
 	if err != nil {
-		log.Printf("Failed to initialize network: %v", err)
+		chatLog.Errorf("Failed to initialize network: %v", err)
 		return err
 	}
+
+	// Initialize block notification handler for cleaning up spent
+	// outpoints. Messages are stored with the height they were validated
+	// at.
+	blockHandler := blockchain.NewHandlerWithConfig(chainClient, db,
+		newBlockchainConfig(cfg))
+	blockHandler.SetExpireHandler(networkManager.AnnounceExpired)
+	networkManager.SetChainTipFunc(func() network.ChainTip {
+		stats := blockHandler.Stats()
+		tip := network.ChainTip{Height: stats.LastBlockHeight}
+		if stats.LastBlockHash != nil {
+			tip.Hash = *stats.LastBlockHash
+		}
+		return tip
+	})
+
 	// Start services.
 	if err := networkManager.Start(ctx); err != nil {
-		log.Printf("Failed to start network: %v", err)
+		chatLog.Errorf("Failed to start network: %v", err)
 		return err
 	}
-
-	// Start block notification handler for cleaning up spent outpoints.
-	blockHandler := blockchain.NewHandlerWithConfig(bitcoinClient, db, blockchain.Config{
-		NotificationsEnabled: cfg.Blockchain.NotificationsEnabled,
-		MaxReorgDepth:        cfg.Blockchain.MaxReorgDepth,
-		ScanFullBlocks:       cfg.Blockchain.ScanFullBlocks,
-		PollInterval:         cfg.Blockchain.PollInterval,
-	})
 	if err := blockHandler.Start(ctx); err != nil {
-		log.Printf("Failed to start block handler: %v", err)
+		chatLog.Errorf("Failed to start block handler: %v", err)
 		return err
 	}
 
+	// Start the HTTP API server if enabled.
+	var apiServer *api.Server
+	if cfg.API.Enabled {
+		token := cfg.API.Token
+		if token == "" {
+			token, err = api.LoadToken(cfg.DataDir)
+			if err != nil {
+				chatLog.Errorf("Failed to set up API token: %v", err)
+				return err
+			}
+		}
+		apiServer = api.NewServerWithConfig(networkManager, blockHandler, db, api.Config{
+			ListenAddr:     cfg.API.ListenAddr,
+			Token:          token,
+			PublicStats:    cfg.API.PublicStats,
+			AllowedOrigins: cfg.API.AllowedOrigins,
+		})
+		if err := apiServer.Start(ctx); err != nil {
+			chatLog.Errorf("Failed to start API server: %v", err)
+			return err
+		}
+	}
+
+	// Apply the reloadable settings of the configuration on SIGHUP.
+	go reloadListener(ctx, func() {
+		reloadConfig(ctx, args, networkManager, blockHandler)
+	})
+
 	// Print startup information.
-	log.Printf("UTXOchat is running on %s", cfg.Network.ListenAddr)
-	log.Printf("Data directory: %s", cfg.DataDir)
+	chatLog.Infof("UTXOchat is running on %s", cfg.Network.ListenAddr)
+	chatLog.Infof("Data directory: %s", cfg.DataDir)
 
 	// Wait until the interrupt signal is received from an OS signal or
 	// shutdown is requested through one of the subsystems.
@@ -208,21 +312,205 @@ func utxoChatMain() error {
 	// Cancel context to signal all services to shut down.
 	cancel()
 
+	// Shutdown API server.
+	if apiServer != nil {
+		chatLog.Info("Gracefully shutting down API server...")
+		if err := apiServer.Stop(); err != nil {
+			chatLog.Errorf("Error stopping API server: %v", err)
+		}
+	}
+
 	// Shutdown network.
-	log.Printf("Gracefully shutting down network...")
+	chatLog.Info("Gracefully shutting down network...")
 	if err := networkManager.Stop(); err != nil {
-		log.Printf("Error stopping network: %v", err)
+		chatLog.Errorf("Error stopping network: %v", err)
 	}
 
 	// Shutdown block handler.
-	log.Printf("Gracefully shutting down block handler...")
+	chatLog.Info("Gracefully shutting down block handler...")
 	if err := blockHandler.Stop(); err != nil {
-		log.Printf("Error stopping block handler: %v", err)
+		chatLog.Errorf("Error stopping block handler: %v", err)
 	}
 
 	return nil
 }
 
+// newNetworkConfig returns the configuration of the network manager.
+func newNetworkConfig(cfg *config) network.Config {
+	return network.Config{
+		ListenAddr:             cfg.Network.ListenAddr,
+		KnownPeers:             cfg.Network.KnownPeers,
+		ExternalPort:           cfg.Network.ExternalPort,
+		DisableAdvertise:       cfg.Network.DisableAdvertise,
+		DisconnectRemovedPeers: cfg.Network.DisconnectRemovedPeers,
+		Chain:                  cfg.Bitcoin.Chain,
+		UserAgent:              "/utxochat:" + version() + "/",
+		HandshakeTimeout:       cfg.Network.HandshakeTimeout,
+		DialTimeout:            cfg.Network.DialTimeout,
+		ReadTimeout:            cfg.Network.ReadTimeout,
+		WriteTimeout:           cfg.Network.WriteTimeout,
+		ShutdownTimeout:        cfg.Network.ShutdownTimeout,
+		DataRateLimit:          cfg.Network.DataRateLimit,
+		DataRateBurst:          cfg.Network.DataRateBurst,
+		InvRateLimit:           cfg.Network.InvRateLimit,
+		InvRateBurst:           cfg.Network.InvRateBurst,
+		MaxRateViolations:      cfg.Network.MaxRateViolations,
+		MaxChecksumFailures:    cfg.Network.MaxChecksumFailures,
+		MaxUnknownFrames:       cfg.Network.MaxUnknownFrames,
+		ThrottleCooldown:       cfg.Network.ThrottleCooldown,
+		DataDir:                cfg.DataDir,
+		TargetOutbound:         cfg.Network.TargetOutbound,
+		MaxInboundPeers:        cfg.Network.MaxInboundPeers,
+		MaxOutboundPeers:       cfg.Network.MaxOutboundPeers,
+		MaxAddrFailures:        cfg.Network.MaxAddrFailures,
+		BadAddrCooldown:        cfg.Network.BadAddrCooldown,
+		BanThreshold:           cfg.Network.BanThreshold,
+		BanDuration:            cfg.Network.BanDuration,
+		MalformedScore:         cfg.Network.MalformedScore,
+		InvalidSignatureScore:  cfg.Network.InvalidSignatureScore,
+		UnknownTypeScore:       cfg.Network.UnknownTypeScore,
+		LowValueScore:          cfg.Network.LowValueScore,
+		DuplicatePayloadScore:  cfg.Network.DuplicatePayloadScore,
+		DuplicateMessageScore:  cfg.Network.DuplicateMessageScore,
+		DisableInventoryServe:  cfg.Network.DisableInventoryServe,
+		MaxInventoryServe:      cfg.Network.MaxInventoryServe,
+		MaxRetryQueue:          cfg.Network.MaxRetryQueue,
+		RetryTTL:               cfg.Network.RetryTTL,
+		ValidationWorkers:      cfg.Network.ValidationWorkers,
+		MaxPeerValidations:     cfg.Network.MaxPeerValidations,
+		AnnounceAcks:           cfg.Network.AnnounceAcks,
+		MaxPeerUploadPerHour:   cfg.Network.MaxPeerUploadPerHour,
+		MaxUploadPerHour:       cfg.Network.MaxUploadPerHour,
+		BlockedPubKeys:         cfg.Network.BlockedPubKeys,
+		BlockedOutpoints:       cfg.Network.BlockedOutpoints,
+		Whitelist:              cfg.Network.Whitelist,
+		WhitelistedPubKeys:     cfg.Network.WhitelistedPubKeys,
+		WhitelistedOutpoints:   cfg.Network.WhitelistedOutpoints,
+		RelayFilterPubKeys:     cfg.Network.RelayFilterPubKeys,
+		RelayFilterChannels:    cfg.Network.RelayFilterChannels,
+		Privacy:                cfg.Network.Privacy,
+		PrivacyMinDelay:        cfg.Network.PrivacyMinDelay,
+		PrivacyMaxDelay:        cfg.Network.PrivacyMaxDelay,
+		MessageCacheSize:       cfg.Network.MessageCacheSize,
+		MaxTipLag:              cfg.Network.MaxTipLag,
+		DeprioritizeLagging:    cfg.Network.DeprioritizeLagging,
+		MaxReplyDepth:          cfg.Network.MaxReplyDepth,
+		MaxDuplicatePayloads:   cfg.Network.MaxDuplicatePayloads,
+		Identity:               cfg.Network.Identity,
+		AllowedPeerKeys:        cfg.Network.AllowedPeerKeys,
+		RejectJournalSize:      cfg.Network.RejectJournalSize,
+		RejectJournalPayloads:  cfg.Network.RejectJournalPayloads,
+		TrustedPeers:           cfg.Network.TrustedPeers,
+		TrustedPeerKeys:        cfg.Network.TrustedPeerKeys,
+	}
+}
+
+// newDatabaseConfig returns the configuration of the database.
+func newDatabaseConfig(cfg *config) database.Config {
+	return database.Config{
+		Type:            database.Type(cfg.Database.Type),
+		Path:            cfg.Database.Path,
+		ArchiveExpired:  cfg.Database.ArchiveExpired,
+		MaxMessageBytes: cfg.Database.MaxMessageBytes,
+		MaxMessages:     cfg.Database.MaxMessages,
+		BatchSize:       cfg.Database.BatchSize,
+		BatchInterval: time.Duration(cfg.Database.BatchInterval) *
+			time.Millisecond,
+	}
+}
+
+// newBlockchainConfig returns the configuration of the block handler.
+func newBlockchainConfig(cfg *config) blockchain.Config {
+	return blockchain.Config{
+		NotificationsEnabled: cfg.Blockchain.NotificationsEnabled,
+		MaxReorgDepth:        cfg.Blockchain.MaxReorgDepth,
+		ScanFullBlocks:       cfg.Blockchain.ScanFullBlocks,
+		PollInterval:         cfg.Blockchain.PollInterval,
+		ZMQBlockEndpoint:     cfg.Blockchain.ZMQBlockEndpoint,
+		StartHeight:          cfg.Blockchain.StartHeight,
+		Reconcile:            blockchain.ReconcileMode(cfg.Blockchain.Reconcile),
+		ReconcileSampleSize:  cfg.Blockchain.ReconcileSampleSize,
+		ReconcileWorkers:     cfg.Blockchain.ReconcileWorkers,
+	}
+}
+
+// reloadListener calls reload each time SIGHUP is received, until ctx is
+// canceled.
+func reloadListener(ctx context.Context, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload()
+		}
+	}
+}
+
+// reloadConfig loads the configuration again and applies its reloadable
+// settings: the log levels, the known peers, the rate limits, the upload caps,
+// the configured blocklist and the block poll interval. Other changed settings
+// are logged as requiring a restart.
+func reloadConfig(ctx context.Context, args []string, m *network.Manager,
+	h *blockchain.Handler) {
+
+	chatLog.Infof("Reloading configuration")
+
+	// Loading the configuration sets the new log levels
+	newCfg, err := loadConfig(args)
+	if err != nil {
+		chatLog.Errorf("Failed to reload configuration: %v", err)
+		return
+	}
+
+	var restart []string
+	if newCfg.DataDir != cfg.DataDir {
+		restart = append(restart, "data_dir")
+	}
+	if !reflect.DeepEqual(newCfg.Bitcoin, cfg.Bitcoin) {
+		restart = append(restart, "bitcoin")
+	}
+	if newCfg.Database != cfg.Database {
+		restart = append(restart, "database")
+	}
+	if !reflect.DeepEqual(newCfg.API, cfg.API) {
+		restart = append(restart, "api")
+	}
+	if newCfg.Message != cfg.Message {
+		restart = append(restart, "message")
+	}
+	debugCfg := newCfg.Debug
+	debugCfg.LogLevel = cfg.Debug.LogLevel
+	if debugCfg != cfg.Debug {
+		restart = append(restart, "debug")
+	}
+
+	changed, err := m.ApplyConfig(ctx, newNetworkConfig(newCfg))
+	if err != nil {
+		chatLog.Errorf("Failed to apply network configuration: %v", err)
+	}
+	for _, name := range changed {
+		restart = append(restart, "network."+name)
+	}
+
+	changed, err = h.ApplyConfig(newBlockchainConfig(newCfg))
+	if err != nil {
+		chatLog.Errorf("Failed to apply blockchain configuration: %v", err)
+	}
+	for _, name := range changed {
+		restart = append(restart, "blockchain."+name)
+	}
+
+	for _, name := range restart {
+		chatLog.Warnf("Changed setting %s requires a restart to take effect",
+			name)
+	}
+}
+
 // interruptListener returns a channel that will be closed when an interrupt
 // signal is received.
 func interruptListener() chan struct{} {
@@ -259,130 +547,295 @@ func version() string {
 	return "0.1.0"
 }
 
-// logRotator is the log file rotator used by UTXOchat.
-var logRotator rotator
-
-// rotator is an interface that is satisfied by log file rotators.
-type rotator interface {
-	Close() error
+// defaultConfig returns the configuration used for every option that is not
+// set in the config file, the environment or on the command line.
+func defaultConfig(dataDir string) config {
+	return config{
+		DataDir: dataDir,
+		Network: networkConfig{
+			KnownPeers:            []string{},
+			HandshakeTimeout:      60,
+			ShutdownTimeout:       network.DefaultShutdownTimeout,
+			DataRateLimit:         network.DefaultDataRateLimit,
+			DataRateBurst:         network.DefaultDataRateBurst,
+			InvRateLimit:          network.DefaultInvRateLimit,
+			InvRateBurst:          network.DefaultInvRateBurst,
+			MaxRateViolations:     network.DefaultMaxRateViolations,
+			MaxChecksumFailures:   network.DefaultMaxChecksumFailures,
+			MaxUnknownFrames:      network.DefaultMaxUnknownFrames,
+			ThrottleCooldown:      network.DefaultThrottleCooldown,
+			TargetOutbound:        network.DefaultTargetOutbound,
+			MaxInboundPeers:       network.DefaultMaxInboundPeers,
+			MaxOutboundPeers:      network.DefaultMaxOutboundPeers,
+			MaxAddrFailures:       network.DefaultMaxAddrFailures,
+			BadAddrCooldown:       network.DefaultBadAddrCooldown,
+			BanThreshold:          network.DefaultBanThreshold,
+			BanDuration:           network.DefaultBanDuration,
+			MalformedScore:        network.DefaultMalformedScore,
+			InvalidSignatureScore: network.DefaultInvalidSignatureScore,
+			UnknownTypeScore:      network.DefaultUnknownTypeScore,
+			LowValueScore:         network.DefaultLowValueScore,
+			DuplicatePayloadScore: network.DefaultDuplicatePayloadScore,
+			DuplicateMessageScore: network.DefaultDuplicateMessageScore,
+			MaxInventoryServe:     network.DefaultMaxInventoryServe,
+			MaxRetryQueue:         network.DefaultMaxRetryQueue,
+			RetryTTL:              network.DefaultRetryTTL,
+			MaxPeerValidations:    network.DefaultMaxPeerValidations,
+			AnnounceAcks:          network.DefaultAnnounceAcks,
+			DialTimeout:           network.DefaultDialTimeout,
+			ReadTimeout:           network.DefaultReadTimeout,
+			WriteTimeout:          network.DefaultWriteTimeout,
+			RejectJournalSize:     network.DefaultRejectJournalSize,
+		},
+		Bitcoin: bitcoinConfig{
+			Chain:               string(bitcoin.ChainMainnet),
+			Backend:             bitcoin.BackendRPC,
+			RPCUser:             "",
+			RPCPass:             "",
+			DisableTLS:          true,
+			RPCTimeout:          bitcoin.DefaultRPCTimeout,
+			UTXOCacheSize:       bitcoin.DefaultCacheSize,
+			UTXOCacheTTL:        int(bitcoin.DefaultCacheTTL / time.Second),
+			FailureThreshold:    bitcoin.DefaultFailureThreshold,
+			HealthCheckInterval: int(bitcoin.DefaultHealthCheckInterval / time.Second),
+		},
+		Database: databaseConfig{
+			Type: string(database.TypeMemory),
+		},
+		Blockchain: blockchainConfig{
+			NotificationsEnabled: true,
+			MaxReorgDepth:        6,
+			ScanFullBlocks:       true,
+			PollInterval:         30,
+			Reconcile:            string(blockchain.ReconcileOff),
+			ReconcileSampleSize:  blockchain.DefaultReconcileSampleSize,
+			ReconcileWorkers:     blockchain.DefaultReconcileWorkers,
+		},
+		API: apiConfig{
+			Enabled:    false,
+			ListenAddr: "127.0.0.1:8336",
+		},
+		Message: messageConfig{
+			MaxPayloadSize:   65433,
+			MaxMessageSize:   65536,
+			MinUtxoValue:     10000,
+			MinConfirmations: 1,
+		},
+		Debug: debugConfig{
+			LogLevel: "info",
+		},
+	}
 }
 
-// loadConfig initializes and parses the config using command line options.
-func loadConfig() (*config, error) {
-	// Get the default data directory for the specified operating system
-	defaultDataDir := utils.AppDataDir("utxochat", false)
+// loadConfig initializes and parses the config using the command line options
+// of the start command. Options are resolved in order of increasing
+// precedence: defaults, the config file, environment variables and command
+// line flags.
+func loadConfig(args []string) (*config, error) {
 	// Parse command line flags
-	configPath := flag.String("config", "config.json", "Path to configuration file")
-	dataDir := flag.String("datadir", defaultDataDir, "Data directory")
-	profile := flag.String("profile", "", "Enable HTTP profiling on given port")
-	cpuProfile := flag.String("cpuprofile", "", "Write CPU profile to the specified file")
-	memProfile := flag.String("memprofile", "", "Write memory profile to the specified file")
-	traceProfile := flag.String("traceprofile", "", "Write execution trace to the specified file")
-	debugFlag := flag.Bool("debug", false, "Enable debug logging")
-	flag.Parse()
-
-	// Set up logging
-	if *debugFlag {
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	common := addCommonFlags(fs)
+	profile := fs.String("profile", "", "Enable HTTP profiling on given port")
+	cpuProfile := fs.String("cpuprofile", "", "Write CPU profile to the specified file")
+	memProfile := fs.String("memprofile", "", "Write memory profile to the specified file")
+	traceProfile := fs.String("traceprofile", "", "Write execution trace to the specified file")
+	debugFlag := fs.Bool("debug", false, "Enable debug logging for all subsystems")
+	dumpConfig := fs.Bool("dump-config", false, "Print the effective configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
 
-	// Try to load config from file
-	var cfg config
-	file, err := os.Open(*configPath)
+	cfg, err := resolveConfig(fs, common)
 	if err != nil {
-		// If config file doesn't exist, use defaults
-		if os.IsNotExist(err) {
-			log.Printf("Config file not found at %s, using defaults and command line options", *configPath)
-			return &config{
-				DataDir: *dataDir,
-				Network: networkConfig{
-					ListenAddr:       "0.0.0.0:8335",
-					KnownPeers:       []string{},
-					HandshakeTimeout: 60,
-				},
-				Bitcoin: bitcoinConfig{
-					RPCURL:     "http://localhost:8332",
-					RPCUser:    "",
-					RPCPass:    "",
-					DisableTLS: true,
-				},
-				Database: databaseConfig{
-					Type: string(database.TypeMemory),
-					Path: filepath.Join(*dataDir, dbNamePrefix+".db"),
-				},
-				Blockchain: blockchainConfig{
-					NotificationsEnabled: true,
-					MaxReorgDepth:        6,
-					ScanFullBlocks:       true,
-					PollInterval:         30,
-				},
-				Message: messageConfig{
-					MaxPayloadSize: 65434,
-					MaxMessageSize: 65536,
-				},
-				Debug: debugConfig{
-					Profile:       *profile,
-					CPUProfile:    *cpuProfile,
-					MemoryProfile: *memProfile,
-					TraceProfile:  *traceProfile,
-					LogLevel:      "info",
-				},
-			}, nil
+		return nil, err
+	}
+
+	// Command line flags override everything else
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "profile":
+			cfg.Debug.Profile = *profile
+		case "cpuprofile":
+			cfg.Debug.CPUProfile = *cpuProfile
+		case "memprofile":
+			cfg.Debug.MemoryProfile = *memProfile
+		case "traceprofile":
+			cfg.Debug.TraceProfile = *traceProfile
 		}
-		return nil, fmt.Errorf("error opening config file: %v", err)
+	})
+
+	if *debugFlag {
+		cfg.Debug.LogLevel = "debug"
+	}
+	if err := parseAndSetDebugLevels(cfg.Debug.LogLevel); err != nil {
+		return nil, err
 	}
-	defer file.Close()
 
-	// Decode the config file
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("error decoding config file: %v", err)
+	cfg.dumpConfig = *dumpConfig
+	return cfg, nil
+}
+
+// commonFlags holds the flags shared by every command.
+type commonFlags struct {
+	configPath string
+	dataDir    string
+}
+
+// addCommonFlags registers the flags shared by every command on fs.
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	common := &commonFlags{}
+	fs.StringVar(&common.configPath, "config", defaultConfigFile,
+		"Path to configuration file (JSON, or TOML with a .toml extension)")
+	fs.StringVar(&common.dataDir, "datadir",
+		utils.AppDataDir("utxochat", false), "Data directory")
+	return common
+}
+
+// resolveConfig builds the configuration from the defaults, the config file,
+// environment variables and the common flags parsed by fs.
+func resolveConfig(fs *flag.FlagSet, common *commonFlags) (*config, error) {
+	cfg := defaultConfig(common.dataDir)
+
+	// Fall back to a TOML config next to the default JSON one
+	path := common.configPath
+	if !flagSet(fs, "config") {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if _, err := os.Stat(defaultTOMLConfigFile); err == nil {
+				path = defaultTOMLConfigFile
+			}
+		}
 	}
 
-	// Override with command line flags if specified
-	if *dataDir != defaultDataDir {
-		cfg.DataDir = *dataDir
+	// Layer the config file on top of the defaults
+	if err := loadConfigFile(path, &cfg); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		chatLog.Infof("Config file not found at %s, using defaults and command line options", path)
 	}
-	if *profile != "" {
-		cfg.Debug.Profile = *profile
+
+	// Sensitive values may be passed through the environment rather than
+	// stored in the config file
+	if rpcUser, ok := os.LookupEnv(envRPCUser); ok {
+		cfg.Bitcoin.RPCUser = rpcUser
 	}
-	if *cpuProfile != "" {
-		cfg.Debug.CPUProfile = *cpuProfile
+	if rpcPass, ok := os.LookupEnv(envRPCPass); ok {
+		cfg.Bitcoin.RPCPass = rpcPass
 	}
-	if *memProfile != "" {
-		cfg.Debug.MemoryProfile = *memProfile
+	if apiToken, ok := os.LookupEnv(envAPIToken); ok {
+		cfg.API.Token = apiToken
 	}
-	if *traceProfile != "" {
-		cfg.Debug.TraceProfile = *traceProfile
+
+	if flagSet(fs, "datadir") {
+		cfg.DataDir = common.dataDir
 	}
 
 	// Validate required fields
 	if cfg.DataDir == "" {
-		cfg.DataDir = *dataDir
+		cfg.DataDir = common.dataDir
+	}
+	if cfg.Bitcoin.Chain == "" {
+		cfg.Bitcoin.Chain = string(bitcoin.ChainMainnet)
+	}
+	chain, err := bitcoin.ParseChain(cfg.Bitcoin.Chain)
+	if err != nil {
+		return nil, err
 	}
+	cfg.Bitcoin.Chain = string(chain)
 	if cfg.Network.ListenAddr == "" {
-		cfg.Network.ListenAddr = "0.0.0.0:8335"
+		cfg.Network.ListenAddr = net.JoinHostPort("0.0.0.0", chain.DefaultPort())
+	}
+	if cfg.Network.MaxInboundPeers < 0 || cfg.Network.MaxOutboundPeers < 0 {
+		return nil, fmt.Errorf("peer connection limits must not be negative")
+	}
+	if cfg.Network.MaxRetryQueue < 0 || cfg.Network.RetryTTL < 0 {
+		return nil, fmt.Errorf("retry queue settings must not be negative")
+	}
+	if cfg.Network.ValidationWorkers < 0 || cfg.Network.MaxPeerValidations < 0 {
+		return nil, fmt.Errorf("validation settings must not be negative")
+	}
+	if cfg.Network.AnnounceAcks < 0 {
+		return nil, fmt.Errorf("announce acks must not be negative")
+	}
+	if cfg.Network.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout must not be negative")
+	}
+	if cfg.Bitcoin.RPCTimeout < 0 {
+		return nil, fmt.Errorf("bitcoin RPC timeout must not be negative")
+	}
+	if cfg.Bitcoin.UTXOCacheSize < 0 || cfg.Bitcoin.UTXOCacheTTL < 0 {
+		return nil, fmt.Errorf("UTXO cache settings must not be negative")
+	}
+	if cfg.Bitcoin.FailureThreshold < 0 || cfg.Bitcoin.HealthCheckInterval < 0 {
+		return nil, fmt.Errorf("bitcoin failover settings must not be negative")
 	}
 	if cfg.Network.HandshakeTimeout == 0 {
 		cfg.Network.HandshakeTimeout = 60
 	}
-	if cfg.Bitcoin.RPCURL == "" {
-		cfg.Bitcoin.RPCURL = "http://localhost:8332"
+	switch cfg.Bitcoin.Backend {
+	case "":
+		cfg.Bitcoin.Backend = bitcoin.BackendRPC
+	case bitcoin.BackendRPC, bitcoin.BackendREST:
+	default:
+		return nil, fmt.Errorf("unknown bitcoin backend %q, expected %s "+
+			"or %s", cfg.Bitcoin.Backend, bitcoin.BackendRPC,
+			bitcoin.BackendREST)
 	}
-	if cfg.Database.Type == "" {
+	switch database.Type(cfg.Database.Type) {
+	case "":
 		cfg.Database.Type = string(database.TypeMemory)
+	case database.TypeMemory:
+	default:
+		return nil, fmt.Errorf("unknown database type %q, expected %s",
+			cfg.Database.Type, database.TypeMemory)
 	}
 	if cfg.Database.Path == "" {
 		cfg.Database.Path = filepath.Join(cfg.DataDir, dbNamePrefix+".db")
 	}
+	if cfg.Database.MaxMessageBytes < 0 || cfg.Database.MaxMessages < 0 {
+		return nil, fmt.Errorf("database storage limits must not be negative")
+	}
+	if cfg.Database.BatchSize < 0 || cfg.Database.BatchInterval < 0 {
+		return nil, fmt.Errorf("database batch settings must not be negative")
+	}
+	if cfg.Database.BatchInterval == 0 {
+		cfg.Database.BatchInterval = int(
+			database.DefaultBatchInterval / time.Millisecond)
+	}
 	if cfg.Blockchain.MaxReorgDepth == 0 {
 		cfg.Blockchain.MaxReorgDepth = 6
 	}
 	if cfg.Blockchain.PollInterval == 0 {
 		cfg.Blockchain.PollInterval = 30
 	}
+	if cfg.Blockchain.StartHeight < 0 {
+		return nil, fmt.Errorf("blockchain start height must not be negative")
+	}
+	reconcile, err := blockchain.ParseReconcileMode(cfg.Blockchain.Reconcile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Blockchain.Reconcile = string(reconcile)
+	if cfg.Blockchain.ReconcileSampleSize < 0 ||
+		cfg.Blockchain.ReconcileWorkers < 0 {
+
+		return nil, fmt.Errorf("reconcile settings must not be negative")
+	}
+	if cfg.API.ListenAddr == "" {
+		cfg.API.ListenAddr = "127.0.0.1:8336"
+	}
+	err = normalizeAddresses(context.Background(), &cfg, chain.DefaultPort())
+	if err != nil {
+		return nil, fmt.Errorf("invalid addresses in config:\n%w", err)
+	}
 	if cfg.Message.MaxPayloadSize == 0 {
-		cfg.Message.MaxPayloadSize = 65434
+		cfg.Message.MaxPayloadSize = 65433
+	}
+	if cfg.Message.MaxPayloadSize < 0 ||
+		cfg.Message.MaxPayloadSize > message.MaxPayloadSize {
+
+		return nil, fmt.Errorf("max_payload_size must be between 1 and %d",
+			message.MaxPayloadSize)
 	}
 	if cfg.Message.MaxMessageSize == 0 {
 		cfg.Message.MaxMessageSize = 65536
@@ -394,70 +847,432 @@ func loadConfig() (*config, error) {
 	return &cfg, nil
 }
 
+// flagSet reports whether the named flag was passed on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// loadConfigFile decodes the config file at path into cfg, leaving options
+// the file doesn't mention untouched. Files with a .toml extension are parsed
+// as TOML with snake_case keys, anything else as JSON.
+func loadConfigFile(path string, cfg *config) error {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return fmt.Errorf("error decoding config file: %v", err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown config options in %s: %v", path, undecoded)
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	// Decode the config file
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("error decoding config file: %v", err)
+	}
+	return nil
+}
+
+// writeConfig writes the effective configuration as JSON with the Bitcoin
+// RPC passwords and the API token redacted.
+func writeConfig(w io.Writer, cfg *config) error {
+	redacted := *cfg
+	if redacted.Bitcoin.RPCPass != "" {
+		redacted.Bitcoin.RPCPass = "********"
+	}
+	redacted.Bitcoin.Endpoints = slices.Clone(cfg.Bitcoin.Endpoints)
+	for i := range redacted.Bitcoin.Endpoints {
+		if redacted.Bitcoin.Endpoints[i].RPCPass != "" {
+			redacted.Bitcoin.Endpoints[i].RPCPass = "********"
+		}
+	}
+	if redacted.API.Token != "" {
+		redacted.API.Token = "********"
+	}
+
+	data, err := json.MarshalIndent(&redacted, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
 // config defines the configuration options for UTXOchat.
 type config struct {
-	DataDir    string
-	Network    networkConfig
-	Bitcoin    bitcoinConfig
-	Database   databaseConfig
-	Blockchain blockchainConfig
-	Message    messageConfig
-	Debug      debugConfig
+	DataDir    string           `toml:"data_dir"`
+	Network    networkConfig    `toml:"network"`
+	Bitcoin    bitcoinConfig    `toml:"bitcoin"`
+	Database   databaseConfig   `toml:"database"`
+	Blockchain blockchainConfig `toml:"blockchain"`
+	API        apiConfig        `toml:"api"`
+	Message    messageConfig    `toml:"message"`
+	Debug      debugConfig      `toml:"debug"`
+
+	// dumpConfig is set by the -dump-config flag and never read from a
+	// config file.
+	dumpConfig bool
 }
 
 // networkConfig defines the network configuration for UTXOchat.
 type networkConfig struct {
-	ListenAddr       string
-	KnownPeers       []string
-	HandshakeTimeout int
+	ListenAddr            string   `toml:"listen_addr"`
+	KnownPeers            []string `toml:"known_peers"`
+	HandshakeTimeout      int      `toml:"handshake_timeout"`
+	ShutdownTimeout       int      `toml:"shutdown_timeout"`
+	DataRateLimit         float64  `toml:"data_rate_limit"`
+	DataRateBurst         int      `toml:"data_rate_burst"`
+	InvRateLimit          float64  `toml:"inv_rate_limit"`
+	InvRateBurst          int      `toml:"inv_rate_burst"`
+	MaxRateViolations     int      `toml:"max_rate_violations"`
+	MaxChecksumFailures   int      `toml:"max_checksum_failures"`
+	MaxUnknownFrames      int      `toml:"max_unknown_frames"`
+	ThrottleCooldown      int      `toml:"throttle_cooldown"`
+	TargetOutbound        int      `toml:"target_outbound"`
+	MaxInboundPeers       int      `toml:"max_inbound_peers"`
+	MaxOutboundPeers      int      `toml:"max_outbound_peers"`
+	MaxAddrFailures       int      `toml:"max_addr_failures"`
+	BadAddrCooldown       int      `toml:"bad_addr_cooldown"`
+	BanThreshold          int      `toml:"ban_threshold"`
+	BanDuration           int      `toml:"ban_duration"`
+	MalformedScore        int      `toml:"malformed_score"`
+	InvalidSignatureScore int      `toml:"invalid_signature_score"`
+	UnknownTypeScore      int      `toml:"unknown_type_score"`
+	LowValueScore         int      `toml:"low_value_score"`
+	DuplicatePayloadScore int      `toml:"duplicate_payload_score"`
+	DuplicateMessageScore int      `toml:"duplicate_message_score"`
+	DisableInventoryServe bool     `toml:"disable_inventory_serve"`
+	MaxInventoryServe     int      `toml:"max_inventory_serve"`
+	MaxRetryQueue         int      `toml:"max_retry_queue"`
+	RetryTTL              int      `toml:"retry_ttl"`
+
+	// ValidationWorkers is the number of messages from peers validated at
+	// once, zero for one per CPU. MaxPeerValidations caps how many of
+	// them may come from a single peer.
+	ValidationWorkers  int `toml:"validation_workers"`
+	MaxPeerValidations int `toml:"max_peer_validations"`
+
+	// AnnounceAcks is the number of peers that must acknowledge a message
+	// authored by this node before it stops being announced to new peers.
+	AnnounceAcks int `toml:"announce_acks"`
+
+	// MaxPeerUploadPerHour and MaxUploadPerHour cap the bytes sent per
+	// hour to a single peer and to all peers, zero for no cap.
+	MaxPeerUploadPerHour uint64 `toml:"max_peer_upload_per_hour"`
+	MaxUploadPerHour     uint64 `toml:"max_upload_per_hour"`
+
+	// DisconnectRemovedPeers disconnects the peers removed from
+	// KnownPeers when the configuration is reloaded.
+	DisconnectRemovedPeers bool `toml:"disconnect_removed_peers"`
+
+	// ResolveKnownPeers resolves the host names in KnownPeers when the
+	// config is loaded, refusing names that don't resolve. Otherwise they
+	// are resolved each time they are dialed.
+	ResolveKnownPeers bool `toml:"resolve_known_peers"`
+
+	// BlockedPubKeys and BlockedOutpoints are the senders, as hex encoded
+	// taproot output keys, and the txid:vout outpoints whose messages are
+	// not stored or relayed by this node.
+	BlockedPubKeys   []string `toml:"blocked_pubkeys"`
+	BlockedOutpoints []string `toml:"blocked_outpoints"`
+
+	// Whitelist only accepts messages whose outpoint is in
+	// WhitelistedOutpoints or whose sender, as a hex encoded taproot output
+	// key, is in WhitelistedPubKeys.
+	Whitelist            bool     `toml:"whitelist"`
+	WhitelistedPubKeys   []string `toml:"whitelisted_pubkeys"`
+	WhitelistedOutpoints []string `toml:"whitelisted_outpoints"`
+
+	// RelayFilterPubKeys and RelayFilterChannels ask outbound peers to
+	// only relay the messages of these senders, as hex encoded taproot
+	// output keys, and channels.
+	RelayFilterPubKeys  []string `toml:"relay_filter_pubkeys"`
+	RelayFilterChannels []string `toml:"relay_filter_channels"`
+
+	// ExternalPort is the port announced to peers for them to dial back,
+	// for nodes behind a port forward. Zero announces the port of
+	// ListenAddr. DisableAdvertise announces that the node doesn't accept
+	// connections, so peers don't gossip its address.
+	ExternalPort     int  `toml:"external_port"`
+	DisableAdvertise bool `toml:"disable_advertise"`
+
+	// Privacy is none, delay or diffusion. With delay, messages authored
+	// by this node are announced after a random delay between
+	// PrivacyMinDelay and PrivacyMaxDelay seconds, with diffusion first
+	// to a single random peer and to the others after another delay.
+	Privacy         string `toml:"privacy"`
+	PrivacyMinDelay int    `toml:"privacy_min_delay"`
+	PrivacyMaxDelay int    `toml:"privacy_max_delay"`
+
+	// MessageCacheSize is the number of bytes of messages kept in memory
+	// to serve getdata requests, zero for 16 MiB and negative for none.
+	MessageCacheSize int64 `toml:"message_cache_size"`
+
+	// MaxTipLag is the number of blocks a peer may be behind our chain tip
+	// before it is reported as lagging. DeprioritizeLagging requests
+	// messages from lagging peers only when no other peer announced them.
+	MaxTipLag           int  `toml:"max_tip_lag"`
+	DeprioritizeLagging bool `toml:"deprioritize_lagging"`
+
+	// MaxReplyDepth is the number of parents fetched from peers along a
+	// chain of replies, 0 for 10 and -1 to disable.
+	MaxReplyDepth int `toml:"max_reply_depth"`
+
+	// MaxDuplicatePayloads is the number of messages with the same payload
+	// stored, 0 for no limit. Further ones are counted but dropped.
+	MaxDuplicatePayloads int `toml:"max_duplicate_payloads"`
+
+	// Identity enables the node identity key stored in the data
+	// directory. AllowedPeerKeys are the identity keys of the only peers
+	// connections are kept with, empty for any peer.
+	Identity        bool     `toml:"identity"`
+	AllowedPeerKeys []string `toml:"allowed_peer_keys"`
+
+	// DialTimeout, ReadTimeout and WriteTimeout are the seconds an
+	// outbound connection may take to open and a frame to be read or
+	// written.
+	DialTimeout  int `toml:"dial_timeout"`
+	ReadTimeout  int `toml:"read_timeout"`
+	WriteTimeout int `toml:"write_timeout"`
+
+	// RejectJournalSize is the size in bytes the journal of rejected
+	// messages in the data directory is kept under, 0 for 1 MiB and -1 to
+	// disable it. RejectJournalPayloads records the first bytes of their
+	// payloads.
+	RejectJournalSize     int  `toml:"reject_journal_size"`
+	RejectJournalPayloads bool `toml:"reject_journal_payloads"`
+
+	// TrustedPeers are the addresses, host:port or a host for any port,
+	// and TrustedPeerKeys the hex encoded identity keys of peers exempt
+	// from rate limits, upload caps and misbehavior scoring.
+	TrustedPeers    []string `toml:"trusted_peers"`
+	TrustedPeerKeys []string `toml:"trusted_peer_keys"`
 }
 
 // bitcoinConfig defines the Bitcoin node configuration for UTXOchat.
 type bitcoinConfig struct {
-	RPCURL     string
-	RPCUser    string
-	RPCPass    string
-	DisableTLS bool
+	// Chain is the Bitcoin network to run on: mainnet, testnet, testnet4,
+	// signet or regtest. It must match the chain of the Bitcoin node.
+	Chain string `toml:"chain"`
+
+	// Backend is rpc or rest. The rest backend reads the chain from the
+	// unauthenticated REST interface at RESTURL, served by bitcoind with
+	// -rest, and ignores the RPC credentials.
+	Backend string `toml:"backend"`
+	RESTURL string `toml:"rest_url"`
+
+	RPCURL  string `toml:"rpc_url"`
+	RPCUser string `toml:"rpc_user"`
+	RPCPass string `toml:"rpc_pass"`
+
+	// RPCCookiePath is the .cookie file written by bitcoind, used when
+	// RPCPass is empty.
+	RPCCookiePath string `toml:"rpc_cookie_path"`
+
+	// DisableTLS connects to the node over plain HTTP. Otherwise the node
+	// certificate is checked against RPCCAFile, a PEM encoded CA
+	// certificate, if set.
+	DisableTLS bool   `toml:"disable_tls"`
+	RPCCAFile  string `toml:"rpc_ca_file"`
+
+	// RPCTimeout is the time in seconds a call to the Bitcoin node may
+	// take before it is abandoned.
+	RPCTimeout int `toml:"rpc_timeout"`
+
+	// UTXOCacheSize is the number of UTXO lookups cached and UTXOCacheTTL
+	// the time in seconds each is kept. A zero size disables the cache.
+	UTXOCacheSize int `toml:"utxo_cache_size"`
+	UTXOCacheTTL  int `toml:"utxo_cache_ttl"`
+
+	// Endpoints are further nodes, used in order when the ones before
+	// can't be reached. The other settings are shared with the node
+	// above, which is preferred.
+	Endpoints []bitcoinEndpoint `toml:"endpoints"`
+
+	// FailureThreshold is the number of calls or health checks in a row
+	// a node may fail before the next one is used, and
+	// HealthCheckInterval the time in seconds between checks of every
+	// node.
+	FailureThreshold    int `toml:"failure_threshold"`
+	HealthCheckInterval int `toml:"health_check_interval"`
+}
+
+// bitcoinEndpoint defines a further Bitcoin node to fail over to.
+type bitcoinEndpoint struct {
+	RPCURL        string `toml:"rpc_url"`
+	RESTURL       string `toml:"rest_url"`
+	RPCUser       string `toml:"rpc_user"`
+	RPCPass       string `toml:"rpc_pass"`
+	RPCCookiePath string `toml:"rpc_cookie_path"`
+	RPCCAFile     string `toml:"rpc_ca_file"`
 }
 
 // databaseConfig defines the database configuration for UTXOchat.
 type databaseConfig struct {
-	Type string
-	Path string
+	Type           string `toml:"type"`
+	Path           string `toml:"path"`
+	ArchiveExpired bool   `toml:"archive_expired"`
+
+	// MaxMessageBytes and MaxMessages bound the stored messages, the
+	// oldest are evicted beyond them. Zero means no limit.
+	MaxMessageBytes int64 `toml:"max_message_bytes"`
+	MaxMessages     int   `toml:"max_messages"`
+
+	// BatchSize is the number of writes batched before they are written
+	// out, zero writes each one through. BatchInterval is how often, in
+	// milliseconds, batched writes are written out anyway.
+	BatchSize     int `toml:"batch_size"`
+	BatchInterval int `toml:"batch_interval"`
 }
 
 // blockchainConfig defines the blockchain configuration for UTXOchat.
 type blockchainConfig struct {
-	NotificationsEnabled bool
-	MaxReorgDepth        int32
-	ScanFullBlocks       bool
-	PollInterval         int
+	NotificationsEnabled bool   `toml:"notifications_enabled"`
+	MaxReorgDepth        int32  `toml:"max_reorg_depth"`
+	ScanFullBlocks       bool   `toml:"scan_full_blocks"`
+	PollInterval         int    `toml:"poll_interval"`
+	ZMQBlockEndpoint     string `toml:"zmq_block_endpoint"`
+
+	// StartHeight is the first block scanned for spent outpoints, to
+	// backfill from a past block. Zero starts after the tip.
+	StartHeight int32 `toml:"start_height"`
+
+	// Reconcile is off, full or sampled, selecting whether the stored
+	// outpoints are checked for spends missed while the node was not
+	// running, all of them or ReconcileSampleSize random ones.
+	// ReconcileWorkers is the number of UTXO lookups made at a time.
+	Reconcile           string `toml:"reconcile"`
+	ReconcileSampleSize int    `toml:"reconcile_sample_size"`
+	ReconcileWorkers    int    `toml:"reconcile_workers"`
+}
+
+// apiConfig defines the HTTP API configuration for UTXOchat.
+type apiConfig struct {
+	Enabled    bool   `toml:"enabled"`
+	ListenAddr string `toml:"listen_addr"`
+
+	// Token is the bearer token requests must carry. Empty uses the token
+	// generated in the api.token file of the data directory.
+	Token string `toml:"token"`
+
+	// PublicStats serves /debug/stats without the token, and
+	// AllowedOrigins lists the origins of browser frontends allowed to
+	// call the API.
+	PublicStats    bool     `toml:"public_stats"`
+	AllowedOrigins []string `toml:"allowed_origins"`
 }
 
 // messageConfig defines the message configuration for UTXOchat.
 type messageConfig struct {
-	MaxPayloadSize int
-	MaxMessageSize int
+	// MaxPayloadSize is the largest payload in bytes the node accepts,
+	// stores and sends, at most the protocol maximum of 65433. Peers are
+	// told so they don't send larger messages.
+	MaxPayloadSize int `toml:"max_payload_size"`
+	// MaxMessageSize is the number of payload bytes a UTXO can anchor,
+	// summed over every version of its message.
+	MaxMessageSize int `toml:"max_message_size"`
+	// MinUtxoValue is the minimum value in satoshis of a UTXO backing a
+	// message. Zero disables the check.
+	MinUtxoValue int64 `toml:"min_utxo_value"`
+	// MinConfirmations is the number of confirmations the UTXO backing a
+	// message needs. Zero accepts unconfirmed UTXOs.
+	MinConfirmations int64 `toml:"min_confirmations"`
 }
 
 // debugConfig defines the debug configuration for UTXOchat.
 type debugConfig struct {
-	Profile       string
-	CPUProfile    string
-	MemoryProfile string
-	TraceProfile  string
-	LogLevel      string
+	Profile       string `toml:"profile"`
+	CPUProfile    string `toml:"cpu_profile"`
+	MemoryProfile string `toml:"memory_profile"`
+	TraceProfile  string `toml:"trace_profile"`
+	LogLevel      string `toml:"log_level"`
 }
 
-// Update newBitcoinClient to use the new package
-func newBitcoinClient(cfg bitcoinConfig) (*bitcoin.Client, error) {
-	return bitcoin.NewClient(bitcoin.Config{
-		RPCURL:  cfg.RPCURL,
-		RPCUser: cfg.RPCUser,
-		RPCPass: cfg.RPCPass,
+// newBitcoinClient creates a client of the Bitcoin node over the backend
+// selected by cfg. With further endpoints configured it is a
+// bitcoin.FailoverClient over all of them.
+func newBitcoinClient(cfg bitcoinConfig) (bitcoin.ChainClient, error) {
+	nodeCfg := bitcoin.Config{
+		Backend:       cfg.Backend,
+		RESTURL:       cfg.RESTURL,
+		RPCURL:        cfg.RPCURL,
+		RPCUser:       cfg.RPCUser,
+		RPCPass:       cfg.RPCPass,
+		RPCCookiePath: cfg.RPCCookiePath,
+		DisableTLS:    cfg.DisableTLS,
+		RPCCAFile:     cfg.RPCCAFile,
+		RPCTimeout:    cfg.RPCTimeout,
+	}
+	if len(cfg.Endpoints) == 0 {
+		return bitcoin.NewChainClient(nodeCfg)
+	}
+
+	configs := []bitcoin.Config{nodeCfg}
+	for _, endpoint := range cfg.Endpoints {
+		nodeCfg.RPCURL = endpoint.RPCURL
+		nodeCfg.RESTURL = endpoint.RESTURL
+		nodeCfg.RPCUser = endpoint.RPCUser
+		nodeCfg.RPCPass = endpoint.RPCPass
+		nodeCfg.RPCCookiePath = endpoint.RPCCookiePath
+		nodeCfg.RPCCAFile = endpoint.RPCCAFile
+		configs = append(configs, nodeCfg)
+	}
+
+	endpoints := make([]bitcoin.Endpoint, 0, len(configs))
+	for _, nodeCfg := range configs {
+		client, err := bitcoin.NewChainClient(nodeCfg)
+		if err != nil {
+			return nil, err
+		}
+		name := nodeCfg.RPCURL
+		if cfg.Backend == bitcoin.BackendREST {
+			name = nodeCfg.RESTURL
+		}
+		endpoints = append(endpoints, bitcoin.Endpoint{
+			Name:   name,
+			Client: client,
+		})
+	}
+	return bitcoin.NewFailoverClient(endpoints, bitcoin.FailoverConfig{
+		FailureThreshold:    cfg.FailureThreshold,
+		HealthCheckInterval: time.Duration(cfg.HealthCheckInterval) * time.Second,
+		Chain:               bitcoin.Chain(cfg.Chain).RPCName(),
 	})
 }
 
+// newUTXOCache wraps client with a UTXO lookup cache configured by cfg.
+func newUTXOCache(client bitcoin.ChainClient,
+	cfg bitcoinConfig) *bitcoin.CachedClient {
+
+	cacheCfg := bitcoin.DefaultCacheConfig()
+	cacheCfg.Size = cfg.UTXOCacheSize
+	cacheCfg.TTL = time.Duration(cfg.UTXOCacheTTL) * time.Second
+	if cacheCfg.NegativeTTL > cacheCfg.TTL {
+		cacheCfg.NegativeTTL = cacheCfg.TTL
+	}
+	return bitcoin.NewCachedClientWithConfig(client, cacheCfg)
+}
+
 func main() {
 	// If GOGC is not explicitly set, override GC percent.
 	if os.Getenv("GOGC") == "" {
@@ -466,7 +1281,7 @@ func main() {
 	}
 
 	// Work around defer not working after os.Exit()
-	if err := utxoChatMain(); err != nil {
+	if err := runCommand(os.Args[1:]); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
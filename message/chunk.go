@@ -0,0 +1,219 @@
+package message
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// ChunkGroupSize is the size of the ID shared by the chunks of a
+	// payload.
+	ChunkGroupSize = 16
+
+	// ChunkHeaderSize is the size of the chunk field value preceding the
+	// data: the group ID, the 2-byte little-endian index and total, and
+	// the content type of the joined payload.
+	ChunkHeaderSize = ChunkGroupSize + 2 + 2 + ContentTypeSize
+
+	// MaxChunks is the largest number of chunks a payload is split into.
+	MaxChunks = math.MaxUint16
+)
+
+var (
+	// ErrInvalidChunks is returned by JoinChunks for chunks that don't
+	// belong together, such as chunks of several groups or repeated
+	// indexes.
+	ErrInvalidChunks = errors.New("invalid chunks")
+
+	// ErrIncompleteChunks is returned by JoinChunks when some chunks of
+	// the group are missing.
+	ErrIncompleteChunks = errors.New("incomplete chunks")
+)
+
+// ChunkGroup identifies the chunks of a payload.
+type ChunkGroup [ChunkGroupSize]byte
+
+// String returns the group ID hex encoded.
+func (g ChunkGroup) String() string {
+	return hex.EncodeToString(g[:])
+}
+
+// ParseChunkGroup parses a hex encoded group ID.
+func ParseChunkGroup(s string) (ChunkGroup, error) {
+	var group ChunkGroup
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != ChunkGroupSize {
+		return group, fmt.Errorf("invalid chunk group %q: expected %d hex "+
+			"encoded bytes", s, ChunkGroupSize)
+	}
+	return ChunkGroup(data), nil
+}
+
+// Chunk is a piece of a payload too large for one message, carried in the
+// structured payload of a message of its own. The chunks of a payload share
+// their group and are joined in index order.
+type Chunk struct {
+	Group ChunkGroup
+	Index uint16
+	Total uint16
+
+	// ContentType is the content type of the joined payload. Data of a
+	// parsed chunk points into the payload it was parsed from.
+	ContentType ContentType
+	Data        []byte
+}
+
+// ChunkCapacity returns the number of payload bytes each chunk carries when
+// the structured payload of a chunk may be at most payloadCap bytes.
+func ChunkCapacity(payloadCap int) int {
+	return payloadCap - len(PayloadMagic) - PayloadFieldHeaderSize -
+		ChunkHeaderSize
+}
+
+// check validates the header of c.
+func (c *Chunk) check() error {
+	if c.Total == 0 || c.Index >= c.Total {
+		return fmt.Errorf("%w: chunk %d of %d", ErrInvalidChunks, c.Index,
+			c.Total)
+	}
+	switch c.ContentType {
+	case ContentTypeText, ContentTypeJSON, ContentTypeBinary:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownContentType,
+			byte(c.ContentType))
+	}
+	return nil
+}
+
+// encode returns the value of the chunk field of c.
+func (c *Chunk) encode() []byte {
+	buf := make([]byte, 0, ChunkHeaderSize+len(c.Data))
+	buf = append(buf, c.Group[:]...)
+	buf = binary.LittleEndian.AppendUint16(buf, c.Index)
+	buf = binary.LittleEndian.AppendUint16(buf, c.Total)
+	buf = append(buf, byte(c.ContentType))
+	return append(buf, c.Data...)
+}
+
+// decodeChunk parses the value of a chunk field.
+func decodeChunk(value []byte) (*Chunk, error) {
+	if len(value) < ChunkHeaderSize {
+		return nil, fmt.Errorf("%w: chunk of %d bytes", ErrInvalidPayload,
+			len(value))
+	}
+	return &Chunk{
+		Group:       ChunkGroup(value[:ChunkGroupSize]),
+		Index:       binary.LittleEndian.Uint16(value[ChunkGroupSize:]),
+		Total:       binary.LittleEndian.Uint16(value[ChunkGroupSize+2:]),
+		ContentType: ContentType(value[ChunkGroupSize+4]),
+		Data:        value[ChunkHeaderSize:],
+	}, nil
+}
+
+// SplitChunks splits payload of type contentType into chunks of group whose
+// structured payloads are at most payloadCap bytes. An empty payload makes a
+// single empty chunk.
+func SplitChunks(group ChunkGroup, contentType ContentType, payload []byte,
+	payloadCap int) ([]*Chunk, error) {
+
+	capacity := ChunkCapacity(payloadCap)
+	if capacity <= 0 {
+		return nil, fmt.Errorf("payload cap of %d bytes leaves no room for "+
+			"chunk data", payloadCap)
+	}
+	total := max((len(payload)+capacity-1)/capacity, 1)
+	if total > MaxChunks {
+		return nil, fmt.Errorf("%w: %d byte payload needs %d chunks, at "+
+			"most %d", ErrPayloadTooLarge, len(payload), total, MaxChunks)
+	}
+
+	chunks := make([]*Chunk, 0, total)
+	for i := range total {
+		end := min((i+1)*capacity, len(payload))
+		chunks = append(chunks, &Chunk{
+			Group:       group,
+			Index:       uint16(i),
+			Total:       uint16(total),
+			ContentType: contentType,
+			Data:        payload[i*capacity : end],
+		})
+	}
+	return chunks, nil
+}
+
+// JoinChunks returns the payload split into chunks and its content type.
+// The chunks may come in any order. It fails with ErrInvalidChunks if they
+// belong to several groups or repeat an index, and with ErrIncompleteChunks
+// if some are missing. The joined payload must match its content type.
+func JoinChunks(chunks []*Chunk) (ContentType, []byte, error) {
+	if len(chunks) == 0 {
+		return 0, nil, fmt.Errorf("%w: no chunks", ErrIncompleteChunks)
+	}
+
+	first := chunks[0]
+	if err := first.check(); err != nil {
+		return 0, nil, err
+	}
+	sorted := make([]*Chunk, first.Total)
+	size := 0
+	for _, chunk := range chunks {
+		if err := chunk.check(); err != nil {
+			return 0, nil, err
+		}
+		switch {
+		case chunk.Group != first.Group:
+			return 0, nil, fmt.Errorf("%w: groups %s and %s",
+				ErrInvalidChunks, first.Group, chunk.Group)
+		case chunk.Total != first.Total ||
+			chunk.ContentType != first.ContentType:
+
+			return 0, nil, fmt.Errorf("%w: chunks of group %s disagree "+
+				"on their total or content type", ErrInvalidChunks,
+				first.Group)
+		case sorted[chunk.Index] != nil:
+			return 0, nil, fmt.Errorf("%w: chunk %d repeated",
+				ErrInvalidChunks, chunk.Index)
+		}
+		sorted[chunk.Index] = chunk
+		size += len(chunk.Data)
+	}
+	if missing := MissingChunks(chunks); len(missing) > 0 {
+		return 0, nil, fmt.Errorf("%w: %d of %d chunks missing",
+			ErrIncompleteChunks, len(missing), first.Total)
+	}
+
+	payload := make([]byte, 0, size)
+	for _, chunk := range sorted {
+		payload = append(payload, chunk.Data...)
+	}
+	joined := &Message{ContentType: first.ContentType, Payload: payload}
+	if err := joined.ValidateContent(); err != nil {
+		return 0, nil, err
+	}
+	return first.ContentType, payload, nil
+}
+
+// MissingChunks returns the indexes of the chunks of a group missing from
+// chunks, in order, going by the total of the first chunk.
+func MissingChunks(chunks []*Chunk) []uint16 {
+	if len(chunks) == 0 {
+		return nil
+	}
+	present := make([]bool, chunks[0].Total)
+	for _, chunk := range chunks {
+		if int(chunk.Index) < len(present) {
+			present[chunk.Index] = true
+		}
+	}
+
+	var missing []uint16
+	for i, ok := range present {
+		if !ok {
+			missing = append(missing, uint16(i))
+		}
+	}
+	return missing
+}
@@ -0,0 +1,67 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestSplitChunks checks that a payload filling chunks exactly makes no
+// extra chunk, that a byte more makes one, and that the structured payload
+// of a full chunk is exactly the cap.
+func TestSplitChunks(t *testing.T) {
+	const payloadCap = 100
+
+	capacity := ChunkCapacity(payloadCap)
+	for _, test := range []struct {
+		size  int
+		total int
+	}{
+		{0, 1},
+		{capacity, 1},
+		{capacity + 1, 2},
+		{3 * capacity, 3},
+	} {
+		chunks, err := SplitChunks(ChunkGroup{1}, ContentTypeBinary,
+			make([]byte, test.size), payloadCap)
+		if err != nil || len(chunks) != test.total {
+			t.Fatalf("%d bytes gave %d chunks, %v, want %d", test.size,
+				len(chunks), err, test.total)
+		}
+		data, err := BuildPayload(&Payload{Chunk: chunks[0]})
+		if err != nil {
+			t.Fatalf("BuildPayload: %v", err)
+		}
+		if test.size >= capacity && len(data) != payloadCap {
+			t.Fatalf("full chunk payload is %d bytes, want %d", len(data),
+				payloadCap)
+		}
+	}
+}
+
+// TestJoinChunksInvalid checks that chunks of several groups, repeated
+// chunks and chunks disagreeing on their total are refused.
+func TestJoinChunksInvalid(t *testing.T) {
+	chunks, err := SplitChunks(ChunkGroup{1}, ContentTypeText,
+		bytes.Repeat([]byte("a"), 200), 100)
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("SplitChunks: %d chunks, %v", len(chunks), err)
+	}
+	other := *chunks[1]
+	other.Group = ChunkGroup{2}
+	total := *chunks[1]
+	total.Total++
+
+	tests := map[string][]*Chunk{
+		"other group": {chunks[0], &other},
+		"repeated":    {chunks[0], chunks[0]},
+		"total":       {chunks[0], &total},
+	}
+	for name, test := range tests {
+		if _, _, err := JoinChunks(test); !errors.Is(err,
+			ErrInvalidChunks) {
+
+			t.Fatalf("%s: got %v, want ErrInvalidChunks", name, err)
+		}
+	}
+}
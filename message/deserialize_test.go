@@ -0,0 +1,192 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+)
+
+// largeMessage returns a serialized message with a payload of the maximum
+// size.
+func largeMessage() []byte {
+	payload := bytes.Repeat([]byte{'x'}, MaxPayloadSize)
+	msg := &Message{
+		Outpoint:    NewOutpoint([32]byte{1}, 2),
+		Signature:   [SignatureSize]byte{3},
+		ContentType: ContentTypeText,
+		Length:      uint16(len(payload)),
+		Payload:     payload,
+		Sequence:    4,
+	}
+	return msg.Serialize()
+}
+
+// TestDeserializeFromBuffer checks that DeserializeFrom reads a message
+// delivered in small reads into the buffer it returns, with the payload
+// pointing into it rather than copied.
+func TestDeserializeFromBuffer(t *testing.T) {
+	data := largeMessage()
+	r := iotest.OneByteReader(bytes.NewReader(data))
+	msg, raw, err := DeserializeFrom(r, len(data))
+	if err != nil {
+		t.Fatalf("DeserializeFrom: %v", err)
+	}
+	if !bytes.Equal(raw, data) || msg.Sequence != 4 ||
+		len(msg.Payload) != MaxPayloadSize {
+
+		t.Fatalf("read %d bytes, sequence %d, %d byte payload", len(raw),
+			msg.Sequence, len(msg.Payload))
+	}
+	if &msg.Payload[0] != &raw[len(raw)-MaxPayloadSize] {
+		t.Fatal("payload copied out of the returned buffer")
+	}
+}
+
+// TestDeserializeFromShortRead checks that a message cut short anywhere is
+// refused, whether the frame announced its full size or the truncated one.
+func TestDeserializeFromShortRead(t *testing.T) {
+	data := largeMessage()
+	for _, n := range []int{0, 1, HeaderSize - 1, HeaderSize,
+		ExtendedHeaderSize, ExtendedHeaderSize + 1, len(data) / 2,
+		len(data) - 1} {
+
+		for _, frameSize := range []int{len(data), n} {
+			r := bytes.NewReader(data[:n])
+			msg, _, err := DeserializeFrom(r, frameSize)
+			if err == nil {
+				t.Fatalf("%d of %d bytes in a %d byte frame read as %+v",
+					n, len(data), frameSize, msg.Outpoint)
+			}
+		}
+	}
+
+	// A reader failing midway reports its error
+	failing := io.MultiReader(bytes.NewReader(data[:HeaderSize+10]),
+		iotest.ErrReader(io.ErrClosedPipe))
+	if _, _, err := DeserializeFrom(failing, len(data)); !errors.Is(err,
+		io.ErrClosedPipe) {
+
+		t.Fatalf("failing reader gave %v", err)
+	}
+}
+
+// TestDeserializeFromLengthMismatch checks that a header declaring a
+// payload larger or smaller than its frame holds is refused before the
+// message is allocated, for version 2, extended and witness messages.
+func TestDeserializeFromLengthMismatch(t *testing.T) {
+	msg := &Message{
+		Outpoint:    NewOutpoint([32]byte{1}, 2),
+		ContentType: ContentTypeText,
+		Length:      10,
+		Payload:     bytes.Repeat([]byte{'x'}, 10),
+	}
+	small := msg.Serialize()
+	msg.Sequence = 1
+	extended := msg.Serialize()
+	msg.Witness = [][]byte{bytes.Repeat([]byte{1}, 64)}
+	witness := msg.Serialize()
+
+	// The large header only comes with its own bytes
+	large := largeMessage()[:HeaderSize]
+
+	tests := []struct {
+		name      string
+		data      []byte
+		frameSize int
+	}{
+		{"payload larger than the frame", large, HeaderSize},
+		{"payload smaller than the frame", small, MaxMessageSize},
+		{"extended payload smaller", extended, len(extended) + 1},
+		{"witness payload larger", witness, len(witness) - 1},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.data)
+		allocated := allocatedBytes(10, func() {
+			r.Reset(test.data)
+			_, _, err := DeserializeFrom(r, test.frameSize)
+			if !errors.Is(err, ErrLengthMismatch) {
+				t.Fatalf("%s: got %v, want ErrLengthMismatch", test.name,
+					err)
+			}
+		})
+		if allocated > 1024 {
+			t.Fatalf("%s: allocated %d bytes", test.name, allocated)
+		}
+	}
+}
+
+// allocatedBytes returns the bytes fn allocates per run, averaged over
+// runs.
+func allocatedBytes(runs int, fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < runs; i++ {
+		fn()
+	}
+	runtime.ReadMemStats(&after)
+	return (after.TotalAlloc - before.TotalAlloc) / uint64(runs)
+}
+
+// TestDeserializeFromAllocs checks that DeserializeFrom allocates the
+// message once, where reading it into a buffer and deserializing it copies
+// the payload a second time.
+func TestDeserializeFromAllocs(t *testing.T) {
+	data := largeMessage()
+	r := bytes.NewReader(data)
+	streamed := allocatedBytes(50, func() {
+		r.Reset(data)
+		if _, _, err := DeserializeFrom(r, len(data)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	copied := allocatedBytes(50, func() {
+		r.Reset(data)
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Deserialize(buf); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if streamed >= copied-MaxPayloadSize/2 || streamed > 2*uint64(len(data)) {
+		t.Fatalf("DeserializeFrom allocated %d bytes, copying %d, for a %d "+
+			"byte message", streamed, copied, len(data))
+	}
+}
+
+// BenchmarkDeserialize reads a message of the maximum size into a buffer
+// and deserializes it, copying the payload.
+func BenchmarkDeserialize(b *testing.B) {
+	data := largeMessage()
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := Deserialize(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDeserializeFrom reads the same message with DeserializeFrom.
+func BenchmarkDeserializeFrom(b *testing.B) {
+	data := largeMessage()
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if _, _, err := DeserializeFrom(r, len(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
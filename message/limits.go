@@ -0,0 +1,60 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrExceedsPolicy is returned for a message within the protocol limits that
+// is larger than the node is configured to accept.
+var ErrExceedsPolicy = errors.New("message exceeds local policy")
+
+// Limits are the size limits a node applies to the messages it accepts. They
+// may be lower than the protocol limits, which every node accepts on the
+// wire, to keep storage small.
+type Limits struct {
+	// MaxPayloadSize is the largest payload accepted in bytes. Zero selects
+	// the protocol maximum MaxPayloadSize.
+	MaxPayloadSize int
+}
+
+// DefaultLimits returns the protocol limits.
+func DefaultLimits() Limits {
+	return Limits{MaxPayloadSize: MaxPayloadSize}
+}
+
+// Validate checks that the limits are within the protocol limits.
+func (l Limits) Validate() error {
+	if l.MaxPayloadSize < 0 || l.MaxPayloadSize > MaxPayloadSize {
+		return fmt.Errorf("max payload size %d must be between 0 and %d",
+			l.MaxPayloadSize, MaxPayloadSize)
+	}
+	return nil
+}
+
+// PayloadCap returns the largest payload accepted in bytes.
+func (l Limits) PayloadCap() int {
+	if l.MaxPayloadSize <= 0 || l.MaxPayloadSize > MaxPayloadSize {
+		return MaxPayloadSize
+	}
+	return l.MaxPayloadSize
+}
+
+// MessageCap returns the size of the largest serialized message whose payload
+// is accepted, the payload cap plus the largest header and witness.
+func (l Limits) MessageCap() int {
+	return WitnessHeaderSize + MaxWitnessSize + l.PayloadCap()
+}
+
+// CheckPayload returns ErrPayloadTooLarge for a payload of size bytes over
+// the protocol limit and ErrExceedsPolicy for one over the payload cap.
+func (l Limits) CheckPayload(size int) error {
+	switch {
+	case size > MaxPayloadSize:
+		return ErrPayloadTooLarge
+	case size > l.PayloadCap():
+		return fmt.Errorf("%w: %d byte payload, at most %d",
+			ErrExceedsPolicy, size, l.PayloadCap())
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestLimits checks that a payload cap is enforced below the protocol
+// maximum with ErrExceedsPolicy, above it with ErrPayloadTooLarge, and that
+// caps outside the protocol limits are refused.
+func TestLimits(t *testing.T) {
+	capped := Limits{MaxPayloadSize: 1024}
+	tests := []struct {
+		limits Limits
+		size   int
+		want   error
+	}{
+		{capped, 1024, nil},
+		{capped, 1025, ErrExceedsPolicy},
+		{capped, MaxPayloadSize + 1, ErrPayloadTooLarge},
+		{DefaultLimits(), MaxPayloadSize, nil},
+		{Limits{}, MaxPayloadSize, nil},
+	}
+	for _, test := range tests {
+		err := test.limits.CheckPayload(test.size)
+		if !errors.Is(err, test.want) || (test.want == nil) != (err == nil) {
+			t.Fatalf("%d bytes under %+v gave %v, want %v", test.size,
+				test.limits, err, test.want)
+		}
+	}
+	if got := capped.MessageCap(); got != WitnessHeaderSize+
+		MaxWitnessSize+1024 {
+
+		t.Fatalf("message cap %d", got)
+	}
+
+	for _, bad := range []int{-1, MaxPayloadSize + 1} {
+		if err := (Limits{MaxPayloadSize: bad}).Validate(); err == nil {
+			t.Fatalf("payload cap %d accepted", bad)
+		}
+	}
+}
@@ -1,103 +1,553 @@
 package message
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 )
 
 const (
+	// ProtocolVersion is the version of the message format. Version 2 added
+	// the content type byte to the header. Version 3 added the optional
+	// sequence number that lets a message replace an earlier one for the
+	// same outpoint. Version 4 added the witness extension carrying
+	// signatures that don't fit the 64-byte signature field.
+	ProtocolVersion = 4
+
 	// OutpointSize is the size of an outpoint (txid + vout)
 	OutpointSize = 36 // 32 bytes for txid + 4 bytes for vout
 
 	// SignatureSize is the size of a signature
 	SignatureSize = 64
 
+	// ContentTypeSize is the size of the content type field
+	ContentTypeSize = 1
+
 	// LengthSize is the size of the length field
 	LengthSize = 2
 
-	// HeaderSize is the total size of the header (outpoint + signature + length)
-	HeaderSize = OutpointSize + SignatureSize + LengthSize
+	// SequenceSize is the size of the sequence field
+	SequenceSize = 4
+
+	// WitnessLengthSize is the size of the witness length field
+	WitnessLengthSize = 2
+
+	// HeaderSize is the total size of the header
+	// (outpoint + signature + content type + length)
+	HeaderSize = OutpointSize + SignatureSize + ContentTypeSize + LengthSize
+
+	// ExtendedHeaderSize is the size of the header of a message with a
+	// non-zero sequence number, which follows the length field. Messages
+	// with sequence 0 use the shorter header so they stay readable by
+	// version 2 nodes.
+	ExtendedHeaderSize = HeaderSize + SequenceSize
+
+	// WitnessHeaderSize is the size of the header of a witness message,
+	// which always has the sequence field followed by the length of the
+	// serialized witness.
+	WitnessHeaderSize = ExtendedHeaderSize + WitnessLengthSize
+
+	// Offsets of the header fields within a serialized message
+	SignatureOffset   = OutpointSize
+	ContentTypeOffset = SignatureOffset + SignatureSize
+	LengthOffset      = ContentTypeOffset + ContentTypeSize
+	SequenceOffset    = LengthOffset + LengthSize
+	WitnessOffset     = SequenceOffset + SequenceSize
 
 	// MaxPayloadSize is the maximum size of the payload
 	// Application define own data structure within the payload
-	MaxPayloadSize = 65434
+	MaxPayloadSize = 65433
+
+	// MaxWitnessSize is the maximum size of a serialized witness
+	MaxWitnessSize = 4096
 
 	// MaxMessageSize is the maximum size of a complete message
-	MaxMessageSize = HeaderSize + MaxPayloadSize
+	MaxMessageSize = WitnessHeaderSize + MaxWitnessSize + MaxPayloadSize
+
+	// WitnessFlag is set in the content type byte of a witness message.
+	// The signature of a witness message is carried as a full BIP322
+	// witness after the header, such as the signature and public key that
+	// spend a P2WPKH output, and its signature field must be zero.
+	WitnessFlag = 0x80
+)
+
+// ContentType describes how the payload of a message should be interpreted.
+type ContentType byte
+
+const (
+	// ContentTypeText is a UTF-8 encoded plain text payload
+	ContentTypeText ContentType = 0x00
+
+	// ContentTypeJSON is a UTF-8 encoded JSON payload
+	ContentTypeJSON ContentType = 0x01
+
+	// ContentTypeBinary is an opaque binary payload
+	ContentTypeBinary ContentType = 0x02
+)
+
+// String returns the name of the content type.
+func (ct ContentType) String() string {
+	switch ct {
+	case ContentTypeText:
+		return "text"
+	case ContentTypeJSON:
+		return "json"
+	case ContentTypeBinary:
+		return "binary"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(ct))
+	}
+}
+
+var (
+	ErrPayloadTooLarge    = errors.New("message exceeds maximum size")
+	ErrInvalidHeader      = errors.New("invalid message header")
+	ErrUnknownContentType = errors.New("unknown content type")
+	ErrInvalidUTF8        = errors.New("payload is not valid UTF-8")
+	ErrInvalidJSON        = errors.New("payload is not valid JSON")
+	ErrInvalidOutpoint    = errors.New("invalid outpoint")
+	ErrTrailingData       = errors.New("data continues after message")
+	ErrInvalidWitness     = errors.New("invalid witness")
+	ErrLengthMismatch     = errors.New("message length does not match its frame")
 )
 
+// Reasons a well-formed message is rejected by validation. They are returned,
+// possibly wrapped, by the validator so that callers can tell them apart with
+// errors.Is.
 var (
-	ErrMessageTooLarge = errors.New("message exceeds maximum size")
-	ErrInvalidHeader   = errors.New("invalid message header")
+	// ErrDuplicateOutpoint is returned when a message for the outpoint has
+	// already been accepted and the new one doesn't replace it.
+	ErrDuplicateOutpoint = errors.New("outpoint already seen")
+
+	// ErrUTXONotFound is returned when the UTXO backing a message does not
+	// exist.
+	ErrUTXONotFound = errors.New("utxo not found")
+
+	// ErrUTXOSpent is returned when the UTXO backing a message existed but
+	// has been spent.
+	ErrUTXOSpent = errors.New("utxo already spent")
+
+	// ErrNotTaproot is returned when a taproot key is requested from an
+	// output that is not a taproot output.
+	ErrNotTaproot = errors.New("utxo is not a taproot output")
+
+	// ErrUnsupportedScript is returned when the UTXO backing a message is
+	// neither a taproot nor a P2WPKH output.
+	ErrUnsupportedScript = errors.New("unsupported utxo script type")
+
+	// ErrBadSignature is returned when a message signature does not verify
+	// against the UTXO's script.
+	ErrBadSignature = errors.New("invalid signature")
+
+	// ErrRPCUnavailable is returned when the Bitcoin node could not be
+	// reached to look up the UTXO backing a message. Nothing is known to be
+	// wrong with the message, it may be validated again once the node is
+	// back.
+	ErrRPCUnavailable = errors.New("bitcoin node unavailable")
 )
 
-// Outpoint represents a Bitcoin transaction output
+// Outpoint represents a Bitcoin transaction output. The first 32 bytes hold
+// the txid in display (big-endian) byte order, followed by the 4-byte
+// little-endian output index. This is the only outpoint representation that
+// crosses package boundaries.
 type Outpoint [36]byte
 
-func (op Outpoint) ToTxidIdx() (*chainhash.Hash, uint32) {
-	// ignoring the returned error here since we are giving it 32 bytes from a
-	// fixed 36 byte array, and the only possible error is due to incorrect
-	// array length
-	// Create a reversed copy of the txid bytes for chainhash.NewHash
-	// since Bitcoin displays txids in big-endian but internally uses little-endian
-	reversedTxid := make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		reversedTxid[i] = op[31-i]
+// NewOutpoint creates the outpoint of output vout of transaction txid. All
+// packing of outpoints goes through it.
+func NewOutpoint(txid chainhash.Hash, vout uint32) Outpoint {
+	var op Outpoint
+	// chainhash.Hash stores the txid in internal (little-endian) byte
+	// order, so reverse it into display order.
+	for i := 0; i < chainhash.HashSize; i++ {
+		op[i] = txid[chainhash.HashSize-1-i]
+	}
+	binary.LittleEndian.PutUint32(op[32:36], vout)
+	return op
+}
+
+// NewOutpointFromTxidIdx creates an outpoint from a transaction hash and
+// output index. It is the inverse of ToTxidIdx.
+func NewOutpointFromTxidIdx(txid *chainhash.Hash, vout uint32) Outpoint {
+	return NewOutpoint(*txid, vout)
+}
+
+// Txid returns the transaction hash of the outpoint.
+func (op Outpoint) Txid() chainhash.Hash {
+	var txid chainhash.Hash
+	for i := 0; i < chainhash.HashSize; i++ {
+		txid[i] = op[chainhash.HashSize-1-i]
 	}
-	hash, _ := chainhash.NewHash(reversedTxid)
-	return hash, binary.LittleEndian.Uint32(op[32:36])
+	return txid
+}
+
+// Vout returns the output index of the outpoint.
+func (op Outpoint) Vout() uint32 {
+	return binary.LittleEndian.Uint32(op[32:36])
+}
+
+// WireOutPoint returns the outpoint as used by btcd, the key UTXOs are
+// looked up with.
+func (op Outpoint) WireOutPoint() wire.OutPoint {
+	return wire.OutPoint{Hash: op.Txid(), Index: op.Vout()}
 }
 
+// ToTxidIdx returns the transaction hash and output index of the outpoint.
+func (op Outpoint) ToTxidIdx() (*chainhash.Hash, uint32) {
+	txid := op.Txid()
+	return &txid, op.Vout()
+}
+
+// ToString returns the outpoint in the canonical "txid:vout" format used by
+// bitcoin-cli. It is the inverse of ParseOutpoint.
 func (op Outpoint) ToString() string {
-	return fmt.Sprintf("%x:%d", op[:32], binary.BigEndian.Uint32(op[32:36]))
+	hash, vout := op.ToTxidIdx()
+	return fmt.Sprintf("%s:%d", hash, vout)
+}
+
+// ParseOutpoint parses an outpoint in the "txid:vout" format.
+func ParseOutpoint(s string) (Outpoint, error) {
+	sep := strings.LastIndexByte(s, ':')
+	if sep < 0 {
+		return Outpoint{}, fmt.Errorf("%w: missing vout in %q",
+			ErrInvalidOutpoint, s)
+	}
+
+	txid, err := chainhash.NewHashFromStr(s[:sep])
+	if err != nil || len(s[:sep]) != 2*chainhash.HashSize {
+		return Outpoint{}, fmt.Errorf("%w: bad txid in %q",
+			ErrInvalidOutpoint, s)
+	}
+
+	vout, err := strconv.ParseUint(s[sep+1:], 10, 32)
+	if err != nil {
+		return Outpoint{}, fmt.Errorf("%w: bad vout in %q",
+			ErrInvalidOutpoint, s)
+	}
+
+	return NewOutpointFromTxidIdx(txid, uint32(vout)), nil
 }
 
 // Message represents a UTXOchat message
 type Message struct {
-	Outpoint  Outpoint // The UTXO that proves ownership
-	Signature [64]byte // The signature proving ownership of the UTXO
-	Length    uint16   // Length of the payload
-	Payload   []byte   // The actual message content
+	Outpoint    Outpoint       // The UTXO that proves ownership
+	Signature   [64]byte       // The signature proving ownership of the UTXO
+	ContentType ContentType    // How the payload should be interpreted
+	Length      uint16         // Length of the payload
+	Sequence    uint32         // Replaces messages with a lower sequence
+	Witness     wire.TxWitness // Replaces Signature if set
+	Payload     []byte         // The actual message content
 }
 
 // NewMessage creates a new message with the given parameters
-func NewMessage(outpoint Outpoint, signature [64]byte, payload []byte) (*Message, error) {
+func NewMessage(outpoint Outpoint, signature [64]byte, contentType ContentType,
+	payload []byte) (*Message, error) {
+
 	if len(payload) > MaxPayloadSize {
-		return nil, ErrMessageTooLarge
+		return nil, ErrPayloadTooLarge
 	}
 
 	return &Message{
-		Outpoint:  outpoint,
-		Signature: signature,
-		Length:    uint16(len(payload)),
-		Payload:   payload,
+		Outpoint:    outpoint,
+		Signature:   signature,
+		ContentType: contentType,
+		Length:      uint16(len(payload)),
+		Payload:     payload,
 	}, nil
 }
 
-// Serialize converts the message to a byte slice
+// ValidateContent checks that the payload matches the declared content type.
+func (m *Message) ValidateContent() error {
+	switch m.ContentType {
+	case ContentTypeText:
+		if !utf8.Valid(m.Payload) {
+			return ErrInvalidUTF8
+		}
+	case ContentTypeJSON:
+		if !utf8.Valid(m.Payload) {
+			return ErrInvalidUTF8
+		}
+		if !json.Valid(m.Payload) {
+			return ErrInvalidJSON
+		}
+	case ContentTypeBinary:
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownContentType, byte(m.ContentType))
+	}
+	return nil
+}
+
+// SignedData returns the data the signature commits to. It is the payload
+// for sequence 0, and the 4-byte little-endian sequence followed by the
+// payload otherwise, so a signature can't be replayed with a higher
+// sequence.
+func (m *Message) SignedData() []byte {
+	if m.Sequence == 0 {
+		return m.Payload
+	}
+
+	data := make([]byte, SequenceSize+len(m.Payload))
+	binary.LittleEndian.PutUint32(data, m.Sequence)
+	copy(data[SequenceSize:], m.Payload)
+	return data
+}
+
+// SignatureWitness returns the BIP322 witness the message is verified with:
+// the witness of a witness message, or the signature as the single item of a
+// taproot key-path spend.
+func (m *Message) SignatureWitness() wire.TxWitness {
+	if len(m.Witness) > 0 {
+		return m.Witness
+	}
+	return wire.TxWitness{m.Signature[:]}
+}
+
+// headerSize returns the size of the header of the message, including the
+// witness of a witness message.
+func (m *Message) headerSize() int {
+	switch {
+	case len(m.Witness) > 0:
+		return WitnessHeaderSize + m.Witness.SerializeSize()
+	case m.Sequence == 0:
+		return HeaderSize
+	default:
+		return ExtendedHeaderSize
+	}
+}
+
+// SerializeSize returns the number of bytes Serialize produces.
+func (m *Message) SerializeSize() int {
+	return m.headerSize() + len(m.Payload)
+}
+
+// Serialize converts the message to a byte slice. Messages with sequence 0
+// use the version 2 header without a sequence field, unless they carry a
+// witness.
 func (m *Message) Serialize() []byte {
-	buf := make([]byte, HeaderSize+len(m.Payload))
+	headerSize := m.headerSize()
+	buf := make([]byte, headerSize+len(m.Payload))
 
 	// Write outpoint
-	copy(buf[0:36], m.Outpoint[:])
+	copy(buf[0:SignatureOffset], m.Outpoint[:])
 
-	// Write signature
-	copy(buf[36:100], m.Signature[:])
+	// Write signature, which stays zero in a witness message
+	if len(m.Witness) == 0 {
+		copy(buf[SignatureOffset:ContentTypeOffset], m.Signature[:])
+	}
+
+	// Write content type
+	buf[ContentTypeOffset] = byte(m.ContentType)
+	if len(m.Witness) > 0 {
+		buf[ContentTypeOffset] |= WitnessFlag
+	}
 
 	// Write payload length
-	binary.LittleEndian.PutUint16(buf[100:102], m.Length)
+	binary.LittleEndian.PutUint16(buf[LengthOffset:HeaderSize], m.Length)
+
+	// Write sequence
+	if m.Sequence != 0 || len(m.Witness) > 0 {
+		binary.LittleEndian.PutUint32(buf[SequenceOffset:], m.Sequence)
+	}
+
+	// Write witness
+	if len(m.Witness) > 0 {
+		var witness bytes.Buffer
+		writeWitness(&witness, m.Witness)
+		binary.LittleEndian.PutUint16(buf[WitnessOffset:],
+			uint16(witness.Len()))
+		copy(buf[WitnessHeaderSize:], witness.Bytes())
+	}
 
 	// Write payload
-	copy(buf[102:], m.Payload)
+	copy(buf[headerSize:], m.Payload)
 
 	return buf
 }
 
-// Deserialize parses a byte slice into a message
+// Deserialize parses a byte slice into a message. Witness messages are
+// recognised by WitnessFlag. Otherwise data that is exactly the size of a
+// message with an extended header is parsed as one, anything else as a
+// message with the version 2 header and sequence 0. Data must hold
+// exactly one message, ErrTrailingData is returned for bytes left over. The
+// payload is copied, so data may be reused.
 func Deserialize(data []byte) (*Message, error) {
+	msg, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, msg.Length)
+	copy(payload, msg.Payload)
+	msg.Payload = payload
+	return msg, nil
+}
+
+// ParseKey returns the outpoint and sequence number of a serialized message of
+// size bytes from prefix, its first min(size, ExtendedHeaderSize) bytes or
+// more, without checking the rest of it. Like Deserialize, a message with
+// neither the witness flag nor the size of an extended header has sequence 0,
+// and a size matching neither header fails with ErrLengthMismatch.
+func ParseKey(prefix []byte, size int) (Outpoint, uint32, error) {
+	if size < HeaderSize || len(prefix) < HeaderSize {
+		return Outpoint{}, 0, ErrInvalidHeader
+	}
+
+	var outpoint Outpoint
+	copy(outpoint[:], prefix[:SignatureOffset])
+
+	length := int(binary.LittleEndian.Uint16(prefix[LengthOffset:HeaderSize]))
+	if prefix[ContentTypeOffset]&WitnessFlag == 0 {
+		switch size {
+		case HeaderSize + length:
+			return outpoint, 0, nil
+		case ExtendedHeaderSize + length:
+		default:
+			return Outpoint{}, 0, fmt.Errorf("%w: %d byte payload in "+
+				"%d bytes", ErrLengthMismatch, length, size)
+		}
+	}
+	if len(prefix) < ExtendedHeaderSize {
+		return Outpoint{}, 0, ErrInvalidHeader
+	}
+	sequence := binary.LittleEndian.Uint32(
+		prefix[SequenceOffset:ExtendedHeaderSize])
+	return outpoint, sequence, nil
+}
+
+// DeserializeFrom reads a single message from r, which holds exactly
+// frameSize bytes, and returns it along with its serialized bytes. The
+// message is read into one buffer that backs both, so neither may be
+// modified. Like Deserialize, the header is recognised by the length of the
+// data, so r must end right after the message as a frame or an
+// io.LimitReader does. A header declaring a message of another size is
+// rejected with ErrLengthMismatch before the message is allocated, and data
+// left after the message with ErrTrailingData.
+func DeserializeFrom(r io.Reader, frameSize int) (*Message, []byte, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrInvalidHeader
+		}
+		return nil, nil, err
+	}
+
+	length := binary.LittleEndian.Uint16(header[LengthOffset:])
+	if length > MaxPayloadSize {
+		return nil, nil, ErrPayloadTooLarge
+	}
+	if header[ContentTypeOffset]&WitnessFlag != 0 {
+		return deserializeWitnessFrom(r, header, length, frameSize)
+	}
+
+	// Read a version 2 message, then check whether the data goes on for
+	// the 4 bytes an extended header adds. Both layouts end up in order in
+	// the same buffer.
+	size := HeaderSize + int(length)
+	if frameSize != size && frameSize != size+SequenceSize {
+		return nil, nil, fmt.Errorf("%w: %d byte payload in %d bytes",
+			ErrLengthMismatch, length, frameSize)
+	}
+	data := make([]byte, size, size+SequenceSize)
+	copy(data, header[:])
+	if n, err := io.ReadFull(r, data[HeaderSize:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, fmt.Errorf("message data too short: "+
+				"expected %d bytes, got %d", size, HeaderSize+n)
+		}
+		return nil, nil, err
+	}
+
+	n, err := io.ReadFull(r, data[size:size+SequenceSize])
+	switch {
+	case err == io.EOF:
+	case err == nil:
+		data = data[:size+SequenceSize]
+		if err := expectEOF(r); err != nil {
+			return nil, nil, err
+		}
+	case err == io.ErrUnexpectedEOF:
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrTrailingData, n)
+	default:
+		return nil, nil, err
+	}
+
+	msg, err := decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, data, nil
+}
+
+// deserializeWitnessFrom reads the rest of a witness message whose header
+// has been read from r, like DeserializeFrom.
+func deserializeWitnessFrom(r io.Reader, header [HeaderSize]byte,
+	length uint16, frameSize int) (*Message, []byte, error) {
+
+	var ext [WitnessHeaderSize - HeaderSize]byte
+	if _, err := io.ReadFull(r, ext[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrInvalidHeader
+		}
+		return nil, nil, err
+	}
+	witnessSize := binary.LittleEndian.Uint16(ext[SequenceSize:])
+	if witnessSize > MaxWitnessSize {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrInvalidWitness,
+			witnessSize)
+	}
+
+	size := WitnessHeaderSize + int(witnessSize) + int(length)
+	if frameSize != size {
+		return nil, nil, fmt.Errorf("%w: %d byte payload and %d byte "+
+			"witness in %d bytes", ErrLengthMismatch, length, witnessSize,
+			frameSize)
+	}
+	data := make([]byte, size)
+	copy(data, header[:])
+	copy(data[HeaderSize:], ext[:])
+	if n, err := io.ReadFull(r, data[WitnessHeaderSize:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, fmt.Errorf("message data too short: "+
+				"expected %d bytes, got %d", size, WitnessHeaderSize+n)
+		}
+		return nil, nil, err
+	}
+	if err := expectEOF(r); err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, data, nil
+}
+
+// expectEOF returns ErrTrailingData unless r has no data left.
+func expectEOF(r io.Reader) error {
+	var extra [1]byte
+	_, err := io.ReadFull(r, extra[:])
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return ErrTrailingData
+	default:
+		return err
+	}
+}
+
+// decode parses a serialized message like Deserialize, leaving the payload
+// pointing into data.
+func decode(data []byte) (*Message, error) {
 	if len(data) < HeaderSize {
 		return nil, ErrInvalidHeader
 	}
@@ -105,25 +555,124 @@ func Deserialize(data []byte) (*Message, error) {
 	msg := &Message{}
 
 	// Read outpoint
-	copy(msg.Outpoint[:], data[0:36])
+	copy(msg.Outpoint[:], data[0:SignatureOffset])
 
 	// Read signature
-	copy(msg.Signature[:], data[36:100])
+	copy(msg.Signature[:], data[SignatureOffset:ContentTypeOffset])
+
+	// Read content type
+	msg.ContentType = ContentType(data[ContentTypeOffset] &^ WitnessFlag)
 
 	// Read payload length
-	msg.Length = binary.LittleEndian.Uint16(data[100:102])
+	msg.Length = binary.LittleEndian.Uint16(data[LengthOffset:HeaderSize])
 
 	// Validate payload length
 	if msg.Length > MaxPayloadSize {
-		return nil, ErrMessageTooLarge
+		return nil, ErrPayloadTooLarge
+	}
+
+	// Read sequence and witness
+	headerSize := HeaderSize
+	switch {
+	case data[ContentTypeOffset]&WitnessFlag != 0:
+		var err error
+		headerSize, err = msg.decodeWitness(data)
+		if err != nil {
+			return nil, err
+		}
+
+	case len(data) == ExtendedHeaderSize+int(msg.Length):
+		msg.Sequence = binary.LittleEndian.Uint32(
+			data[SequenceOffset:ExtendedHeaderSize])
+		if msg.Sequence == 0 {
+			return nil, fmt.Errorf("%w: sequence 0 in extended header",
+				ErrInvalidHeader)
+		}
+		headerSize = ExtendedHeaderSize
 	}
 
 	// Read payload
-	if len(data) < HeaderSize+int(msg.Length) {
-		return nil, fmt.Errorf("message data too short: expected %d bytes, got %d", HeaderSize+msg.Length, len(data))
+	end := headerSize + int(msg.Length)
+	if len(data) < end {
+		return nil, fmt.Errorf("message data too short: expected %d bytes, got %d", end, len(data))
+	}
+	if len(data) > end {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTrailingData, len(data)-end)
 	}
-	msg.Payload = make([]byte, msg.Length)
-	copy(msg.Payload, data[102:102+msg.Length])
+	msg.Payload = data[headerSize:end:end]
 
 	return msg, nil
 }
+
+// decodeWitness reads the sequence and witness of a witness message and
+// returns the size of its header. Every witness has a single encoding: the
+// signature field must be zero, the witness must hold at least one item and
+// fill its length field exactly.
+func (m *Message) decodeWitness(data []byte) (int, error) {
+	if len(data) < WitnessHeaderSize {
+		return 0, ErrInvalidHeader
+	}
+	if m.Signature != [SignatureSize]byte{} {
+		return 0, fmt.Errorf("%w: signature set in witness message",
+			ErrInvalidHeader)
+	}
+	m.Sequence = binary.LittleEndian.Uint32(data[SequenceOffset:WitnessOffset])
+
+	size := int(binary.LittleEndian.Uint16(data[WitnessOffset:]))
+	if size > MaxWitnessSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrInvalidWitness, size)
+	}
+	if len(data) < WitnessHeaderSize+size {
+		return 0, fmt.Errorf("%w: expected %d bytes, got %d",
+			ErrInvalidWitness, size, len(data)-WitnessHeaderSize)
+	}
+
+	r := bytes.NewReader(data[WitnessHeaderSize : WitnessHeaderSize+size])
+	witness, err := readWitness(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidWitness, err)
+	}
+	if r.Len() != 0 {
+		return 0, fmt.Errorf("%w: %d bytes after witness",
+			ErrInvalidWitness, r.Len())
+	}
+	m.Witness = witness
+	return WitnessHeaderSize + size, nil
+}
+
+// writeWitness serializes witness like a transaction input witness: the
+// number of items followed by each item, all length prefixed with Bitcoin
+// variable length integers.
+func writeWitness(w io.Writer, witness wire.TxWitness) error {
+	if err := wire.WriteVarInt(w, 0, uint64(len(witness))); err != nil {
+		return err
+	}
+	for _, item := range witness {
+		if err := wire.WriteVarBytes(w, 0, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readWitness parses a witness serialized by writeWitness. It holds at least
+// one item.
+func readWitness(r io.Reader) (wire.TxWitness, error) {
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > MaxWitnessSize {
+		return nil, fmt.Errorf("bad item count %d", count)
+	}
+
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, MaxWitnessSize,
+			"witness item")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return witness, nil
+}
@@ -0,0 +1,110 @@
+package message_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/message/testvectors"
+)
+
+// FuzzDeserialize checks that Deserialize doesn't panic and that what it
+// accepts is the only encoding of the message it returns.
+func FuzzDeserialize(f *testing.F) {
+	msgs, err := testvectors.Messages()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, data := range msgs {
+		f.Add(data)
+		f.Add(data[:len(data)-1])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := message.Deserialize(data)
+		if err != nil {
+			return
+		}
+		if int(msg.Length) != len(msg.Payload) {
+			t.Fatalf("length %d with a %d byte payload", msg.Length,
+				len(msg.Payload))
+		}
+		if serialized := msg.Serialize(); !bytes.Equal(serialized, data) {
+			t.Fatalf("message serialized to %x, decoded from %x",
+				serialized, data)
+		}
+	})
+}
+
+// FuzzDeserializeFrom checks that DeserializeFrom accepts the same messages
+// as Deserialize and returns their bytes unchanged.
+func FuzzDeserializeFrom(f *testing.F) {
+	msgs, err := testvectors.Messages()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, data := range msgs {
+		f.Add(data, len(data))
+		f.Add(data, len(data)-1)
+		f.Add(data[:message.HeaderSize], len(data))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, frameSize int) {
+		msg, raw, err := message.DeserializeFrom(bytes.NewReader(data),
+			frameSize)
+
+		want, wantErr := message.Deserialize(data)
+		if frameSize != len(data) {
+			if err == nil {
+				t.Fatalf("read a message from %d bytes announced as %d",
+					len(data), frameSize)
+			}
+			return
+		}
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("DeserializeFrom gave %v, Deserialize %v", err,
+				wantErr)
+		}
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(raw, data) {
+			t.Fatalf("returned %x, read %x", raw, data)
+		}
+		if !bytes.Equal(msg.Serialize(), want.Serialize()) {
+			t.Fatalf("decoded %+v, Deserialize %+v", msg, want)
+		}
+	})
+}
+
+// FuzzParseOutpoint checks that ParseOutpoint doesn't panic and that the
+// outpoints it returns are formatted back to a string it parses alike.
+func FuzzParseOutpoint(f *testing.F) {
+	f.Add(testvectors.Txid + ":0")
+	f.Add(testvectors.Txid + ":4294967295")
+	f.Add(testvectors.Txid + ":4294967296")
+	f.Add(testvectors.Txid[2:] + ":1")
+	f.Add(":")
+	file, err := testvectors.Load()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, vector := range file.Vectors {
+		f.Add(fmt.Sprintf("%s:%d", vector.Txid, vector.Vout))
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		outpoint, err := message.ParseOutpoint(s)
+		if err != nil {
+			return
+		}
+		str := outpoint.ToString()
+		parsed, err := message.ParseOutpoint(str)
+		if err != nil || parsed != outpoint {
+			t.Fatalf("%q parsed to %s, which parsed to %x, %v", s, str,
+				parsed, err)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// testTxid is the txid of the outpoints in the tests, in display order.
+const testTxid = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+
+// TestOutpointRoundTrip checks that a txid and vout converted to an Outpoint
+// and back come out unchanged, and that the outpoint holds the txid in
+// display order followed by the little-endian vout.
+func TestOutpointRoundTrip(t *testing.T) {
+	txid, err := chainhash.NewHashFromStr(testTxid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txidBytes, err := hex.DecodeString(testTxid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vout := range []uint32{0, 1, 255, 256, 300, 65535, 65536,
+		0xFFFFFFFF} {
+
+		t.Run(fmt.Sprint(vout), func(t *testing.T) {
+			op := NewOutpointFromTxidIdx(txid, vout)
+
+			gotTxid, gotVout := op.ToTxidIdx()
+			if !gotTxid.IsEqual(txid) || gotVout != vout {
+				t.Fatalf("round trip gave %s:%d, want %s:%d", gotTxid,
+					gotVout, txid, vout)
+			}
+			if op.Txid() != *txid || op.Vout() != vout {
+				t.Fatalf("accessors gave %s:%d, want %s:%d", op.Txid(),
+					op.Vout(), txid, vout)
+			}
+			if wireOp := op.WireOutPoint(); wireOp.Hash != *txid ||
+				wireOp.Index != vout {
+
+				t.Fatalf("wire outpoint %v, want %s:%d", wireOp, txid, vout)
+			}
+
+			want := append(append([]byte(nil), txidBytes...),
+				byte(vout), byte(vout>>8), byte(vout>>16), byte(vout>>24))
+			if string(op[:]) != string(want) {
+				t.Fatalf("outpoint bytes %x, want %x", op[:], want)
+			}
+
+			str := op.ToString()
+			if str != fmt.Sprintf("%s:%d", testTxid, vout) {
+				t.Fatalf("ToString gave %q", str)
+			}
+			parsed, err := ParseOutpoint(str)
+			if err != nil {
+				t.Fatalf("ParseOutpoint(%q): %v", str, err)
+			}
+			if parsed != op {
+				t.Fatalf("ParseOutpoint(%q) = %x, want %x", str, parsed, op)
+			}
+		})
+	}
+}
+
+// TestContentTypeRoundTrip checks that a message of each content type
+// serializes its content type into the header and deserializes back
+// unchanged.
+func TestContentTypeRoundTrip(t *testing.T) {
+	txid, err := chainhash.NewHashFromStr(testTxid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := NewOutpointFromTxidIdx(txid, 1)
+	var signature [64]byte
+	for i := range signature {
+		signature[i] = byte(i)
+	}
+
+	tests := []struct {
+		contentType ContentType
+		payload     []byte
+	}{
+		{ContentTypeText, []byte("héllo ✓")},
+		{ContentTypeJSON, []byte(`{"text":"hello","n":[1,2]}`)},
+		{ContentTypeBinary, []byte{0x00, 0xff, 0xfe, 0x80, 0xc0}},
+	}
+	for _, test := range tests {
+		t.Run(test.contentType.String(), func(t *testing.T) {
+			msg, err := NewMessage(outpoint, signature, test.contentType,
+				test.payload)
+			if err != nil {
+				t.Fatalf("NewMessage: %v", err)
+			}
+			if err := msg.ValidateContent(); err != nil {
+				t.Fatalf("ValidateContent: %v", err)
+			}
+
+			data := msg.Serialize()
+			if len(data) != HeaderSize+len(test.payload) ||
+				ContentType(data[ContentTypeOffset]) != test.contentType {
+
+				t.Fatalf("serialized to %x", data)
+			}
+			got, err := Deserialize(data)
+			if err != nil {
+				t.Fatalf("Deserialize: %v", err)
+			}
+			if got.Outpoint != outpoint || got.Signature != signature ||
+				got.ContentType != test.contentType ||
+				int(got.Length) != len(test.payload) ||
+				!bytes.Equal(got.Payload, test.payload) {
+
+				t.Fatalf("round trip gave %+v", got)
+			}
+		})
+	}
+}
+
+// TestValidateContent checks that payloads not matching their content type
+// are rejected, and that a binary payload may hold anything.
+func TestValidateContent(t *testing.T) {
+	badUTF8 := []byte{'h', 'i', 0xff, 0xfe}
+	tests := []struct {
+		contentType ContentType
+		payload     []byte
+		want        error
+	}{
+		{ContentTypeText, badUTF8, ErrInvalidUTF8},
+		{ContentTypeText, []byte{0xc3}, ErrInvalidUTF8},
+		{ContentTypeJSON, badUTF8, ErrInvalidUTF8},
+		{ContentTypeJSON, []byte("hello"), ErrInvalidJSON},
+		{ContentTypeBinary, badUTF8, nil},
+		{ContentType(0x03), []byte("hello"), ErrUnknownContentType},
+	}
+	for _, test := range tests {
+		msg := &Message{
+			ContentType: test.contentType,
+			Length:      uint16(len(test.payload)),
+			Payload:     test.payload,
+		}
+		err := msg.ValidateContent()
+		if !errors.Is(err, test.want) || (test.want == nil) != (err == nil) {
+			t.Fatalf("%s payload %x gave %v, want %v", test.contentType,
+				test.payload, err, test.want)
+		}
+	}
+}
+
+// TestSequenceRoundTrip checks that a message keeps its sequence through
+// serialization, that sequence 0 uses the version 2 header without a
+// sequence field, and that a version 2 message reads back as sequence 0.
+func TestSequenceRoundTrip(t *testing.T) {
+	txid, err := chainhash.NewHashFromStr(testTxid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("hello")
+
+	for _, sequence := range []uint32{0, 1, 2, 256, 0xFFFFFFFF} {
+		msg := &Message{
+			Outpoint:    NewOutpointFromTxidIdx(txid, 1),
+			Signature:   [SignatureSize]byte{1, 2, 3},
+			ContentType: ContentTypeText,
+			Length:      uint16(len(payload)),
+			Payload:     payload,
+			Sequence:    sequence,
+		}
+		data := msg.Serialize()
+		wantSize := ExtendedHeaderSize + len(payload)
+		if sequence == 0 {
+			wantSize = HeaderSize + len(payload)
+		}
+		if len(data) != wantSize || msg.SerializeSize() != wantSize {
+			t.Fatalf("sequence %d serialized to %d bytes, size %d, want "+
+				"%d", sequence, len(data), msg.SerializeSize(), wantSize)
+		}
+
+		decoded, err := Deserialize(data)
+		if err != nil {
+			t.Fatalf("sequence %d: Deserialize: %v", sequence, err)
+		}
+		if decoded.Sequence != sequence ||
+			!bytes.Equal(decoded.Payload, payload) ||
+			decoded.Signature != msg.Signature {
+
+			t.Fatalf("sequence %d came back as %+v", sequence, decoded)
+		}
+		fromReader, _, err := DeserializeFrom(bytes.NewReader(data),
+			len(data))
+		if err != nil || fromReader.Sequence != sequence {
+			t.Fatalf("sequence %d: DeserializeFrom gave %v, %v",
+				sequence, fromReader, err)
+		}
+		outpoint, keySequence, err := ParseKey(data, len(data))
+		if err != nil || outpoint != msg.Outpoint ||
+			keySequence != sequence {
+
+			t.Fatalf("sequence %d: ParseKey gave %s, %d, %v", sequence,
+				outpoint.ToString(), keySequence, err)
+		}
+
+		// Only sequence 0 signs the bare payload
+		if signed := msg.SignedData(); (sequence == 0) !=
+			bytes.Equal(signed, payload) {
+
+			t.Fatalf("sequence %d signs %x", sequence, signed)
+		}
+	}
+
+	// A message written before sequences were added
+	legacy := make([]byte, HeaderSize+len(payload))
+	legacy[ContentTypeOffset] = byte(ContentTypeText)
+	legacy[LengthOffset] = byte(len(payload))
+	copy(legacy[HeaderSize:], payload)
+	msg, err := Deserialize(legacy)
+	if err != nil || msg.Sequence != 0 || string(msg.Payload) != "hello" {
+		t.Fatalf("version 2 message gave %+v, %v", msg, err)
+	}
+	if !bytes.Equal(msg.Serialize(), legacy) {
+		t.Fatal("version 2 message not serialized as it was received")
+	}
+}
@@ -0,0 +1,252 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// MaxChannelSize is the maximum size of the channel name of a
+	// structured payload.
+	MaxChannelSize = 64
+
+	// PayloadFieldHeaderSize is the size of the type and length preceding
+	// the value of each structured payload field.
+	PayloadFieldHeaderSize = 1 + LengthSize
+
+	// ExpirySize is the size of the expiry field value.
+	ExpirySize = 8
+
+	// maxExpiry is the latest expiry accepted, the last second of year
+	// 9999, which keeps it within the range of time.Time.
+	maxExpiry = 253402300799
+)
+
+// PayloadMagic starts every structured payload. It is not valid UTF-8, so a
+// text or JSON payload is never mistaken for a structured one; structured
+// payloads are sent with ContentTypeBinary.
+var PayloadMagic = []byte{0xf0, 'U', 'C', 0x01}
+
+// PayloadField identifies a field of a structured payload.
+type PayloadField byte
+
+const (
+	// PayloadFieldChannel is the UTF-8 name of the channel the message is
+	// posted to.
+	PayloadFieldChannel PayloadField = 0x01
+
+	// PayloadFieldReplyTo is the outpoint of the message replied to.
+	PayloadFieldReplyTo PayloadField = 0x02
+
+	// PayloadFieldBody is the UTF-8 text of the message.
+	PayloadFieldBody PayloadField = 0x03
+
+	// PayloadFieldExpiry is the time after which the message is dropped,
+	// as 8-byte little-endian unix seconds.
+	PayloadFieldExpiry PayloadField = 0x04
+
+	// PayloadFieldChunk is a piece of a payload split across messages,
+	// see Chunk: the group ID, the 2-byte little-endian index and total,
+	// the content type of the joined payload and the data.
+	PayloadFieldChunk PayloadField = 0x05
+)
+
+var (
+	// ErrNotStructured is returned by ParsePayload for a payload that
+	// doesn't start with PayloadMagic. Such payloads are opaque to the
+	// node.
+	ErrNotStructured = errors.New("payload is not structured")
+
+	// ErrInvalidPayload is returned by ParsePayload for a structured
+	// payload whose fields are malformed.
+	ErrInvalidPayload = errors.New("invalid structured payload")
+
+	// ErrChannelTooLong is returned for a channel name longer than
+	// MaxChannelSize.
+	ErrChannelTooLong = errors.New("channel name too long")
+
+	// ErrExpired is returned for a message whose structured payload
+	// expiry has passed.
+	ErrExpired = errors.New("message expired")
+)
+
+// Payload is the structured payload format shared by chat clients so that
+// replies and channels work across frontends. Every field is optional. It
+// is encoded as PayloadMagic followed by type-length-value fields in
+// ascending type order, each at most once, with a 1-byte type and a 2-byte
+// little-endian length. Fields of unknown types are skipped when parsing so
+// the format can be extended.
+type Payload struct {
+	Channel string
+	ReplyTo *Outpoint
+	Body    string
+
+	// Expiry is when nodes drop the message, the zero time if it only
+	// expires with its UTXO. It has a precision of one second.
+	Expiry time.Time
+
+	// Chunk is set if the message carries a piece of a larger payload.
+	Chunk *Chunk
+}
+
+// SerializeSize returns the number of bytes BuildPayload encodes p into.
+func (p *Payload) SerializeSize() int {
+	size := len(PayloadMagic)
+	if p.Channel != "" {
+		size += PayloadFieldHeaderSize + len(p.Channel)
+	}
+	if p.ReplyTo != nil {
+		size += PayloadFieldHeaderSize + OutpointSize
+	}
+	if p.Body != "" {
+		size += PayloadFieldHeaderSize + len(p.Body)
+	}
+	if !p.Expiry.IsZero() {
+		size += PayloadFieldHeaderSize + ExpirySize
+	}
+	if p.Chunk != nil {
+		size += PayloadFieldHeaderSize + ChunkHeaderSize + len(p.Chunk.Data)
+	}
+	return size
+}
+
+// check validates the fields of p.
+func (p *Payload) check() error {
+	if len(p.Channel) > MaxChannelSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrChannelTooLong,
+			len(p.Channel), MaxChannelSize)
+	}
+	if !utf8.ValidString(p.Channel) || !utf8.ValidString(p.Body) {
+		return ErrInvalidUTF8
+	}
+	if !p.Expiry.IsZero() && (p.Expiry.Unix() <= 0 ||
+		p.Expiry.Unix() > maxExpiry) {
+
+		return fmt.Errorf("expiry %v out of range", p.Expiry)
+	}
+	if p.Chunk != nil {
+		return p.Chunk.check()
+	}
+	return nil
+}
+
+// BuildPayload encodes p as a structured payload. It fails with
+// ErrPayloadTooLarge if the encoding exceeds MaxPayloadSize.
+func BuildPayload(p *Payload) ([]byte, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	size := p.SerializeSize()
+	if size > MaxPayloadSize {
+		return nil, fmt.Errorf("%w: structured payload of %d bytes",
+			ErrPayloadTooLarge, size)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, PayloadMagic...)
+	if p.Channel != "" {
+		buf = appendField(buf, PayloadFieldChannel, []byte(p.Channel))
+	}
+	if p.ReplyTo != nil {
+		buf = appendField(buf, PayloadFieldReplyTo, p.ReplyTo[:])
+	}
+	if p.Body != "" {
+		buf = appendField(buf, PayloadFieldBody, []byte(p.Body))
+	}
+	if !p.Expiry.IsZero() {
+		buf = appendField(buf, PayloadFieldExpiry,
+			binary.LittleEndian.AppendUint64(nil, uint64(p.Expiry.Unix())))
+	}
+	if p.Chunk != nil {
+		buf = appendField(buf, PayloadFieldChunk, p.Chunk.encode())
+	}
+	return buf, nil
+}
+
+// appendField appends a type-length-value field to buf.
+func appendField(buf []byte, field PayloadField, value []byte) []byte {
+	buf = append(buf, byte(field))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// ParsePayload decodes a structured payload. It returns ErrNotStructured if
+// data doesn't start with PayloadMagic, and ErrInvalidPayload if its fields
+// are truncated, repeated or out of order.
+func ParsePayload(data []byte) (*Payload, error) {
+	if !IsStructuredPayload(data) {
+		return nil, ErrNotStructured
+	}
+	if len(data) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	p := &Payload{}
+	rest := data[len(PayloadMagic):]
+	var last PayloadField
+	for len(rest) > 0 {
+		if len(rest) < PayloadFieldHeaderSize {
+			return nil, fmt.Errorf("%w: truncated field header",
+				ErrInvalidPayload)
+		}
+		field := PayloadField(rest[0])
+		length := int(binary.LittleEndian.Uint16(rest[1:]))
+		rest = rest[PayloadFieldHeaderSize:]
+		if length > len(rest) {
+			return nil, fmt.Errorf("%w: field %d needs %d bytes, %d left",
+				ErrInvalidPayload, field, length, len(rest))
+		}
+		if field <= last {
+			return nil, fmt.Errorf("%w: field %d out of order",
+				ErrInvalidPayload, field)
+		}
+		last = field
+		value := rest[:length]
+		rest = rest[length:]
+
+		switch field {
+		case PayloadFieldChannel:
+			p.Channel = string(value)
+
+		case PayloadFieldReplyTo:
+			if length != OutpointSize {
+				return nil, fmt.Errorf("%w: reply_to of %d bytes",
+					ErrInvalidPayload, length)
+			}
+			replyTo := Outpoint(value)
+			p.ReplyTo = &replyTo
+
+		case PayloadFieldBody:
+			p.Body = string(value)
+
+		case PayloadFieldExpiry:
+			if length != ExpirySize {
+				return nil, fmt.Errorf("%w: expiry of %d bytes",
+					ErrInvalidPayload, length)
+			}
+			expiry := int64(binary.LittleEndian.Uint64(value))
+			p.Expiry = time.Unix(expiry, 0)
+
+		case PayloadFieldChunk:
+			chunk, err := decodeChunk(value)
+			if err != nil {
+				return nil, err
+			}
+			p.Chunk = chunk
+		}
+	}
+
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	return p, nil
+}
+
+// IsStructuredPayload reports whether data starts with PayloadMagic.
+func IsStructuredPayload(data []byte) bool {
+	return bytes.HasPrefix(data, PayloadMagic)
+}
@@ -0,0 +1,124 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPayloadRoundTrip checks that structured payloads with any combination
+// of fields come back from ParsePayload as they were built, in the size
+// SerializeSize gives.
+func TestPayloadRoundTrip(t *testing.T) {
+	replyTo := NewOutpoint([32]byte{1, 2, 3}, 300)
+	tests := []*Payload{
+		{},
+		{Channel: "general"},
+		{ReplyTo: &replyTo},
+		{Body: "hello"},
+		{Channel: "general", ReplyTo: &replyTo, Body: "héllo"},
+		{Body: "later", Expiry: time.Unix(1900000000, 0)},
+		{Channel: strings.Repeat("c", MaxChannelSize), Body: "long name"},
+	}
+	for _, p := range tests {
+		data, err := BuildPayload(p)
+		if err != nil {
+			t.Fatalf("BuildPayload(%+v): %v", p, err)
+		}
+		if len(data) != p.SerializeSize() || !IsStructuredPayload(data) {
+			t.Fatalf("%+v built into %d bytes, want %d with the magic",
+				p, len(data), p.SerializeSize())
+		}
+
+		got, err := ParsePayload(data)
+		if err != nil {
+			t.Fatalf("ParsePayload(%x): %v", data, err)
+		}
+		if got.Channel != p.Channel || got.Body != p.Body ||
+			!got.Expiry.Equal(p.Expiry) ||
+			(got.ReplyTo == nil) != (p.ReplyTo == nil) ||
+			got.ReplyTo != nil && *got.ReplyTo != *p.ReplyTo {
+
+			t.Fatalf("parsed %+v, want %+v", got, p)
+		}
+	}
+}
+
+// TestPayloadSize checks that a payload is built up to MaxPayloadSize bytes
+// and refused one byte over, and that a channel name over MaxChannelSize is
+// refused both ways.
+func TestPayloadSize(t *testing.T) {
+	p := &Payload{Channel: "general"}
+	p.Body = strings.Repeat("b", MaxPayloadSize-p.SerializeSize()-
+		PayloadFieldHeaderSize)
+	data, err := BuildPayload(p)
+	if err != nil || len(data) != MaxPayloadSize {
+		t.Fatalf("payload at the limit built into %d bytes, %v",
+			len(data), err)
+	}
+	p.Body += "b"
+	if _, err := BuildPayload(p); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("payload one byte over gave %v, want ErrPayloadTooLarge",
+			err)
+	}
+
+	long := &Payload{Channel: strings.Repeat("c", MaxChannelSize+1)}
+	if _, err := BuildPayload(long); !errors.Is(err, ErrChannelTooLong) {
+		t.Fatalf("long channel gave %v, want ErrChannelTooLong", err)
+	}
+	data = appendField(bytes.Clone(PayloadMagic), PayloadFieldChannel,
+		[]byte(long.Channel))
+	if _, err := ParsePayload(data); !errors.Is(err, ErrInvalidPayload) ||
+		!errors.Is(err, ErrChannelTooLong) {
+
+		t.Fatalf("parsing a long channel gave %v", err)
+	}
+}
+
+// TestParsePayloadInvalid checks that unstructured payloads are told apart,
+// that malformed fields are refused and that unknown fields are skipped.
+func TestParsePayloadInvalid(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("hello"), []byte(`{"a":1}`),
+		PayloadMagic[:3]} {
+
+		if _, err := ParsePayload(data); !errors.Is(err, ErrNotStructured) {
+			t.Fatalf("%q gave %v, want ErrNotStructured", data, err)
+		}
+	}
+
+	magic := func(fields ...[]byte) []byte {
+		return bytes.Join(append([][]byte{PayloadMagic}, fields...), nil)
+	}
+	field := func(f PayloadField, value string) []byte {
+		return appendField(nil, f, []byte(value))
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", magic([]byte{byte(PayloadFieldBody), 5})},
+		{"truncated value", magic(field(PayloadFieldBody, "hello")[:6])},
+		{"repeated", magic(field(PayloadFieldBody, "a"),
+			field(PayloadFieldBody, "b"))},
+		{"out of order", magic(field(PayloadFieldBody, "a"),
+			field(PayloadFieldChannel, "c"))},
+		{"short reply_to", magic(field(PayloadFieldReplyTo, "abc"))},
+		{"invalid UTF-8", magic(field(PayloadFieldBody, "\xff"))},
+	}
+	for _, test := range tests {
+		if _, err := ParsePayload(test.data); !errors.Is(err,
+			ErrInvalidPayload) {
+
+			t.Fatalf("%s: got %v, want ErrInvalidPayload", test.name, err)
+		}
+	}
+
+	// A field added by a later version is skipped
+	data := magic(field(PayloadFieldBody, "hello"), field(0x7f, "new"))
+	p, err := ParsePayload(data)
+	if err != nil || p.Body != "hello" {
+		t.Fatalf("payload with an unknown field parsed as %+v, %v", p, err)
+	}
+}
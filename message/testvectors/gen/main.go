@@ -0,0 +1,52 @@
+// Command gen writes the UTXOchat message test vectors, or checks that a
+// vectors file still matches the output of the current implementation.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shaibearary/utxo_chat/message/testvectors"
+)
+
+func main() {
+	out := flag.String("o", "vectors.json", "File to write the vectors to")
+	check := flag.String("check", "", "Check the vectors in this file "+
+		"instead of writing them")
+	flag.Parse()
+
+	if err := run(*out, *check); err != nil {
+		fmt.Fprintf(os.Stderr, "gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run writes the vectors to out, or checks the ones in check if it is set.
+func run(out, check string) error {
+	if check != "" {
+		data, err := os.ReadFile(check)
+		if err != nil {
+			return err
+		}
+		file, err := testvectors.Parse(data)
+		if err != nil {
+			return err
+		}
+		if err := testvectors.Check(file); err != nil {
+			return fmt.Errorf("%s is out of date: %v", check, err)
+		}
+		fmt.Printf("%s: %d vectors match\n", check, len(file.Vectors))
+		return nil
+	}
+
+	file, err := testvectors.Generate()
+	if err != nil {
+		return err
+	}
+	data, err := testvectors.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0644)
+}
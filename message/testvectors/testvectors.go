@@ -0,0 +1,410 @@
+// Package testvectors generates the canonical test vectors of the UTXOchat
+// message format and its BIP322 signatures, for implementations in other
+// languages to check their encoding and signing against.
+//
+// The vectors are kept in vectors.json, which is written with go generate.
+// Running the generator with -check compares the file with the output of the
+// current implementation and fails if serialization or signing drifted.
+package testvectors
+
+//go:generate go run ./gen -o vectors.json
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+const (
+	// PrivateKey is the hex encoded private key every vector is signed
+	// with, the secret key of the first BIP340 test vector.
+	PrivateKey = "b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef"
+
+	// Txid is the transaction of the outpoint of every vector, the
+	// coinbase of the genesis block.
+	Txid = "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+
+	// bip322Tag is the tag of the BIP322 message hash.
+	bip322Tag = "BIP0322-signed-message"
+)
+
+//go:embed vectors.json
+var vectorsJSON []byte
+
+// File is the content of vectors.json.
+type File struct {
+	// ProtocolVersion is the version of the message format the vectors
+	// were generated for.
+	ProtocolVersion int `json:"protocol_version"`
+
+	// Description explains the fields of a vector.
+	Description []string `json:"description"`
+
+	Vectors []Vector `json:"vectors"`
+}
+
+// Vector is a message signed with PrivateKey, along with every intermediate
+// value of its encoding and signature. Byte strings are hex encoded.
+type Vector struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+
+	// AddressType is the output the message is signed for, p2tr or
+	// p2wpkh, and ScriptPubKey its script. OutputKey is the x-only
+	// taproot output key, empty for other outputs.
+	PrivateKey   string `json:"private_key"`
+	AddressType  string `json:"address_type"`
+	ScriptPubKey string `json:"script_pubkey"`
+	OutputKey    string `json:"output_key,omitempty"`
+
+	// Txid and Vout are the outpoint as shown by bitcoin-cli, Outpoint
+	// its 36 bytes in the message header.
+	Txid     string `json:"txid"`
+	Vout     uint32 `json:"vout"`
+	Outpoint string `json:"outpoint"`
+
+	ContentType uint8  `json:"content_type"`
+	Sequence    uint32 `json:"sequence"`
+	Payload     string `json:"payload"`
+
+	// SignedData is the data the BIP322 signature commits to when it
+	// differs from the payload, which is for a non-zero sequence.
+	// MessageHash is its BIP322 tagged hash.
+	SignedData  string `json:"signed_data,omitempty"`
+	MessageHash string `json:"message_hash"`
+
+	// ToSpendTxid and ToSignTxid are the ids of the virtual BIP322
+	// transactions, as shown by bitcoin-cli, and Witness the witness of
+	// the to_sign input.
+	ToSpendTxid string   `json:"to_spend_txid"`
+	ToSignTxid  string   `json:"to_sign_txid"`
+	Witness     []string `json:"witness"`
+
+	// Header is the serialized message up to the payload, which it is
+	// followed by. MessageSize is the size of the whole message and
+	// MessageSHA256 its SHA256 hash.
+	Header        string `json:"header"`
+	MessageSize   int    `json:"message_size"`
+	MessageSHA256 string `json:"message_sha256"`
+}
+
+// description is the Description of the generated file.
+var description = []string{
+	"Every message is signed with private_key for the output script_pubkey.",
+	"The message is header followed by payload, message_size bytes hashing to message_sha256.",
+	"outpoint is the txid in display order followed by vout as 4 little-endian bytes.",
+	"signed_data is the 4-byte little-endian sequence followed by the payload, or the payload when omitted.",
+	"message_hash is the BIP322 tagged hash of the signed data, committed to by the to_spend transaction.",
+	"witness spends script_pubkey in the to_sign transaction. Taproot messages carry its only item in the signature field, others carry the witness after the header.",
+}
+
+// spec describes a generated vector.
+type spec struct {
+	name        string
+	comment     string
+	addrType    signer.AddressType
+	vout        uint32
+	contentType message.ContentType
+	sequence    uint32
+	payload     []byte
+}
+
+// specs are the generated vectors, in order.
+var specs = []spec{
+	{
+		name:        "text",
+		comment:     "taproot text message with the version 2 header",
+		addrType:    signer.AddressTaproot,
+		vout:        1,
+		contentType: message.ContentTypeText,
+		payload:     []byte("hello, UTXOchat"),
+	},
+	{
+		name:        "empty-payload",
+		comment:     "empty text payload",
+		addrType:    signer.AddressTaproot,
+		vout:        1,
+		contentType: message.ContentTypeText,
+		payload:     []byte{},
+	},
+	{
+		name:        "max-payload",
+		comment:     "binary payload of the maximum size, bytes 0 to 255 repeated",
+		addrType:    signer.AddressTaproot,
+		vout:        1,
+		contentType: message.ContentTypeBinary,
+		payload:     pattern(message.MaxPayloadSize),
+	},
+	{
+		name:        "vout-zero",
+		comment:     "outpoint with vout 0",
+		addrType:    signer.AddressTaproot,
+		vout:        0,
+		contentType: message.ContentTypeText,
+		payload:     []byte("vout 0"),
+	},
+	{
+		name:        "vout-300",
+		comment:     "outpoint with vout 300, which doesn't fit in one byte",
+		addrType:    signer.AddressTaproot,
+		vout:        300,
+		contentType: message.ContentTypeText,
+		payload:     []byte("vout 300"),
+	},
+	{
+		name:        "vout-max",
+		comment:     "outpoint with vout 0xffffffff",
+		addrType:    signer.AddressTaproot,
+		vout:        0xffffffff,
+		contentType: message.ContentTypeText,
+		payload:     []byte("vout 4294967295"),
+	},
+	{
+		name:        "sequence",
+		comment:     "replacement with the extended header carrying the sequence",
+		addrType:    signer.AddressTaproot,
+		vout:        1,
+		contentType: message.ContentTypeJSON,
+		sequence:    0x01020304,
+		payload:     []byte(`{"text":"edited"}`),
+	},
+	{
+		name:        "p2wpkh-witness",
+		comment:     "P2WPKH signature carried in the witness header",
+		addrType:    signer.AddressP2WPKH,
+		vout:        2,
+		contentType: message.ContentTypeText,
+		payload:     []byte("signed with a segwit v0 key"),
+	},
+}
+
+// pattern returns size bytes counting from 0 to 255 and over again.
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// Generate signs and encodes the vectors with the current implementation.
+// Each message is decoded again and must encode to the same bytes.
+func Generate() (*File, error) {
+	keyBytes, err := hex.DecodeString(PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(keyBytes)
+	txid, err := chainhash.NewHashFromStr(Txid)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		ProtocolVersion: message.ProtocolVersion,
+		Description:     description,
+	}
+	for _, s := range specs {
+		vector, err := generate(privKey, txid, s)
+		if err != nil {
+			return nil, fmt.Errorf("vector %s: %v", s.name, err)
+		}
+		file.Vectors = append(file.Vectors, *vector)
+	}
+	return file, nil
+}
+
+// generate creates the vector of s.
+func generate(privKey *btcec.PrivateKey, txid *chainhash.Hash,
+	s spec) (*Vector, error) {
+
+	outpoint := message.NewOutpoint(*txid, s.vout)
+	if err := checkOutpoint(outpoint, txid, s.vout); err != nil {
+		return nil, err
+	}
+	msg, err := signer.SignReplacementFor(privKey, s.addrType, outpoint,
+		s.sequence, s.contentType, s.payload)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := signer.Script(privKey, s.addrType)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData := msg.SignedData()
+	toSpend, toSign, err := signer.BIP322Transactions(pkScript, signedData)
+	if err != nil {
+		return nil, err
+	}
+	messageHash := chainhash.TaggedHash([]byte(bip322Tag), signedData)
+
+	serialized := msg.Serialize()
+	decoded, err := message.Deserialize(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %v", err)
+	}
+	if !bytes.Equal(decoded.Serialize(), serialized) {
+		return nil, fmt.Errorf("decoded message encodes differently")
+	}
+	if decoded.Outpoint != outpoint {
+		return nil, fmt.Errorf("decoded outpoint is %s",
+			decoded.Outpoint.ToString())
+	}
+	headerSize := len(serialized) - len(msg.Payload)
+	digest := sha256.Sum256(serialized)
+
+	vector := &Vector{
+		Name:          s.name,
+		Comment:       s.comment,
+		PrivateKey:    PrivateKey,
+		AddressType:   string(s.addrType),
+		ScriptPubKey:  hex.EncodeToString(pkScript),
+		Txid:          txid.String(),
+		Vout:          s.vout,
+		Outpoint:      hex.EncodeToString(outpoint[:]),
+		ContentType:   uint8(s.contentType),
+		Sequence:      s.sequence,
+		Payload:       hex.EncodeToString(msg.Payload),
+		MessageHash:   hex.EncodeToString(messageHash[:]),
+		ToSpendTxid:   toSpend.TxHash().String(),
+		ToSignTxid:    toSign.TxHash().String(),
+		Header:        hex.EncodeToString(serialized[:headerSize]),
+		MessageSize:   len(serialized),
+		MessageSHA256: hex.EncodeToString(digest[:]),
+	}
+	if s.addrType == signer.AddressTaproot {
+		outputKey := txscript.ComputeTaprootKeyNoScript(privKey.PubKey())
+		vector.OutputKey = hex.EncodeToString(
+			schnorr.SerializePubKey(outputKey))
+	}
+	if s.sequence != 0 {
+		vector.SignedData = hex.EncodeToString(signedData)
+	}
+	for _, item := range msg.SignatureWitness() {
+		vector.Witness = append(vector.Witness, hex.EncodeToString(item))
+	}
+	return vector, nil
+}
+
+// checkOutpoint checks that outpoint converts back to txid and vout, and
+// agrees with the outpoint parsed from their bitcoin-cli form and with the key
+// UTXOs are looked up with.
+func checkOutpoint(outpoint message.Outpoint, txid *chainhash.Hash,
+	vout uint32) error {
+
+	if outpoint.Txid() != *txid || outpoint.Vout() != vout {
+		return fmt.Errorf("outpoint converts back to %s",
+			outpoint.ToString())
+	}
+	parsed, err := message.ParseOutpoint(fmt.Sprintf("%s:%d", txid, vout))
+	if err != nil {
+		return err
+	}
+	if parsed != outpoint {
+		return fmt.Errorf("parsed outpoint is %s", parsed.ToString())
+	}
+	if key := outpoint.WireOutPoint(); key != *wire.NewOutPoint(txid, vout) {
+		return fmt.Errorf("lookup key is %s", key)
+	}
+	return nil
+}
+
+// Load returns the vectors of vectors.json.
+func Load() (*File, error) {
+	return Parse(vectorsJSON)
+}
+
+// Messages returns the serialized messages of vectors.json, for seeding
+// tests and fuzz targets.
+func Messages() ([][]byte, error) {
+	file, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([][]byte, 0, len(file.Vectors))
+	for _, vector := range file.Vectors {
+		data, err := hex.DecodeString(vector.Header + vector.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("vector %s: %v", vector.Name, err)
+		}
+		msgs = append(msgs, data)
+	}
+	return msgs, nil
+}
+
+// Parse parses a vectors file.
+func Parse(data []byte) (*File, error) {
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse test vectors: %v", err)
+	}
+	return &file, nil
+}
+
+// Marshal returns the JSON encoding of file as written to vectors.json.
+func Marshal(file *File) ([]byte, error) {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Check generates the vectors again and returns an error naming the first
+// field of file that differs from the output of the current implementation.
+func Check(file *File) error {
+	current, err := Generate()
+	if err != nil {
+		return err
+	}
+	if file.ProtocolVersion != current.ProtocolVersion {
+		return fmt.Errorf("protocol version is %d, expected %d",
+			file.ProtocolVersion, current.ProtocolVersion)
+	}
+	if len(file.Vectors) != len(current.Vectors) {
+		return fmt.Errorf("%d vectors, expected %d", len(file.Vectors),
+			len(current.Vectors))
+	}
+
+	for i := range current.Vectors {
+		got := reflect.ValueOf(file.Vectors[i])
+		want := reflect.ValueOf(current.Vectors[i])
+		for j := 0; j < want.NumField(); j++ {
+			if reflect.DeepEqual(got.Field(j).Interface(),
+				want.Field(j).Interface()) {
+
+				continue
+			}
+			name, _, _ := strings.Cut(want.Type().Field(j).Tag.Get("json"),
+				",")
+			return fmt.Errorf("vector %s: %s is %v, expected %v",
+				current.Vectors[i].Name, name,
+				abbreviate(got.Field(j).Interface()),
+				abbreviate(want.Field(j).Interface()))
+		}
+	}
+	return nil
+}
+
+// abbreviate formats value for an error, shortening long byte strings.
+func abbreviate(value interface{}) string {
+	s := fmt.Sprint(value)
+	if len(s) > 80 {
+		return s[:77] + "..."
+	}
+	return s
+}
@@ -0,0 +1,27 @@
+package testvectors
+
+import "testing"
+
+// TestVectors checks that vectors.json matches the output of the current
+// implementation, so serialization or signing can't drift unnoticed.
+func TestVectors(t *testing.T) {
+	file, err := Parse(vectorsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(file); err != nil {
+		t.Fatalf("%v, run go generate if the change is intended", err)
+	}
+}
+
+// TestCheckDetectsDrift checks that Check reports a changed field.
+func TestCheckDetectsDrift(t *testing.T) {
+	file, err := Parse(vectorsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Vectors[0].Header = "00" + file.Vectors[0].Header[2:]
+	if err := Check(file); err == nil {
+		t.Fatal("changed header not reported")
+	}
+}
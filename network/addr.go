@@ -0,0 +1,241 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	// addrEntrySize is the size of an address in an addr message: a
+	// 16-byte IPv6 or IPv4-mapped address followed by a 2-byte
+	// little-endian port.
+	addrEntrySize = 18
+
+	// maxAddrPerMessage is the maximum number of addresses in an addr
+	// message.
+	maxAddrPerMessage = 1000
+
+	// getAddrCount is the number of addresses asked for with a getaddr.
+	getAddrCount = 100
+
+	// probeInterval is how long after probing an address announced by a
+	// peer it isn't probed again.
+	probeInterval = time.Hour
+
+	// maxActiveProbes is the number of announced addresses probed at a
+	// time. Announcements beyond it are dropped.
+	maxActiveProbes = 8
+)
+
+// advertisedPort returns the port announced in our version message, zero if
+// we don't accept connections or the connection is a probe.
+func (m *Manager) advertisedPort(probe bool) uint16 {
+	if probe || m.config.DisableAdvertise {
+		return 0
+	}
+	if m.config.ExternalPort != 0 {
+		return uint16(m.config.ExternalPort)
+	}
+	if m.listener == nil {
+		return 0
+	}
+	addr, err := netip.ParseAddrPort(m.listener.Addr().String())
+	if err != nil {
+		return 0
+	}
+	return addr.Port()
+}
+
+// probeAddress checks in the background that a peer accepts connections at
+// addr, the address it announced, by dialing it and completing a handshake.
+// Only then is the address recorded, and given to peers asking for
+// addresses. An address is probed at most once per probeInterval.
+func (m *Manager) probeAddress(addr string) {
+	if m.bans.isBanned(peerHost(addr)) || m.addrManager.IsVerified(addr) {
+		return
+	}
+
+	m.probesMu.Lock()
+	now := time.Now()
+	for probed, at := range m.probes {
+		if now.Sub(at) >= probeInterval {
+			delete(m.probes, probed)
+		}
+	}
+	if _, ok := m.probes[addr]; ok || m.probesActive >= maxActiveProbes {
+		m.probesMu.Unlock()
+		return
+	}
+	m.probes[addr] = now
+	m.probesActive++
+	m.probesMu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			m.probesMu.Lock()
+			m.probesActive--
+			m.probesMu.Unlock()
+		}()
+
+		if err := m.probe(addr); err != nil {
+			log.Debugf("Peer address %s is not reachable: %v", addr, err)
+			return
+		}
+		log.Debugf("Verified peer address %s", addr)
+		m.addrManager.Verified(addr)
+	}()
+}
+
+// probe dials addr, completes a handshake and disconnects.
+func (m *Manager) probe(addr string) error {
+	conn, err := m.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	peer := NewPeer(m.ctx, conn, m)
+	defer peer.cancel()
+	peer.outbound = true
+	peer.probe = true
+	return peer.handshake(bufio.NewReader(conn))
+}
+
+// newAddrPayload encodes an addr payload: a 2-byte little-endian count
+// followed by the addresses. Addresses that aren't an IP address and port
+// are skipped.
+func newAddrPayload(addrs []string) []byte {
+	payload := make([]byte, 2, 2+len(addrs)*addrEntrySize)
+	count := 0
+	for _, addr := range addrs {
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := addrPort.Addr().As16()
+		payload = append(payload, ip[:]...)
+		payload = binary.LittleEndian.AppendUint16(payload, addrPort.Port())
+		count++
+	}
+	binary.LittleEndian.PutUint16(payload, uint16(count))
+	return payload
+}
+
+// parseAddrPayload decodes an addr payload.
+func parseAddrPayload(payload []byte) ([]netip.AddrPort, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("addr too short: %d bytes", len(payload))
+	}
+	count := int(binary.LittleEndian.Uint16(payload))
+	if count > maxAddrPerMessage {
+		return nil, fmt.Errorf("addr has %d addresses, at most %d", count,
+			maxAddrPerMessage)
+	}
+	if len(payload) != 2+count*addrEntrySize {
+		return nil, fmt.Errorf("invalid addr length %d for %d addresses",
+			len(payload), count)
+	}
+
+	addrs := make([]netip.AddrPort, 0, count)
+	for entry := payload[2:]; len(entry) > 0; entry = entry[addrEntrySize:] {
+		ip := netip.AddrFrom16([16]byte(entry[:16])).Unmap()
+		port := binary.LittleEndian.Uint16(entry[16:addrEntrySize])
+		addrs = append(addrs, netip.AddrPortFrom(ip, port))
+	}
+	return addrs, nil
+}
+
+// gossipTo reports whether addr may be given to or learned from the peer.
+// Loopback addresses are only exchanged with peers on the same host.
+func (p *Peer) gossipTo(addr netip.AddrPort) bool {
+	ip := addr.Addr()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsMulticast() ||
+		addr.Port() == 0 {
+
+		return false
+	}
+	if ip.IsLoopback() {
+		peerIP, err := netip.ParseAddr(peerHost(p.addr))
+		return err == nil && peerIP.Unmap().IsLoopback()
+	}
+	return true
+}
+
+// requestAddresses asks a peer supporting address gossip for addresses of
+// peers accepting connections.
+func (p *Peer) requestAddresses() error {
+	if p.services&SFAddr == 0 {
+		return nil
+	}
+
+	p.addrRequested.Store(true)
+	payload := binary.LittleEndian.AppendUint16(nil, getAddrCount)
+	return p.SendMessage(MessageTypeGetAddr, payload)
+}
+
+// handleGetAddrMessage answers the first getaddr of the peer with up to the
+// requested number of verified addresses, chosen at random. The payload is
+// the 2-byte little-endian number of addresses wanted.
+func (p *Peer) handleGetAddrMessage(payload []byte) error {
+	if len(payload) != 2 {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invalid getaddr length: %d", len(payload)))
+	}
+	if p.addrServed.Swap(true) {
+		log.Debugf("Ignoring repeated getaddr from peer %s", p.addr)
+		return nil
+	}
+
+	count := min(int(binary.LittleEndian.Uint16(payload)), maxAddrPerMessage)
+	self := p.listenAddress()
+	addrs := p.manager.addrManager.GossipAddresses(count,
+		func(addr string) bool {
+			addrPort, err := netip.ParseAddrPort(addr)
+			return err == nil && addr != self && addr != p.dialAddr &&
+				p.gossipTo(addrPort)
+		})
+
+	log.Debugf("Sending %d addresses to peer %s", len(addrs), p.addr)
+	return p.SendMessage(MessageTypeAddr, newAddrPayload(addrs))
+}
+
+// handleAddrMessage adds the addresses of an addr answering our getaddr to
+// the candidates for outbound connections. They are only given to other
+// peers once a connection to them completed a handshake. Addresses we didn't
+// ask for are ignored.
+func (p *Peer) handleAddrMessage(payload []byte) error {
+	addrs, err := parseAddrPayload(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+	if !p.addrRequested.Swap(false) {
+		log.Debugf("Ignoring unrequested addr from peer %s", p.addr)
+		return nil
+	}
+
+	learned := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host := addr.Addr().String()
+		if !p.gossipTo(addr) || p.manager.bans.isBanned(host) {
+			continue
+		}
+		learned = append(learned, net.JoinHostPort(host,
+			strconv.Itoa(int(addr.Port()))))
+	}
+
+	added := p.manager.addrManager.AddLearned(learned)
+	log.Debugf("Peer %s sent %d addresses, %d new", p.addr, len(addrs),
+		added)
+	return nil
+}
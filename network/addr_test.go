@@ -0,0 +1,79 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// knows reports whether addr is among the known addresses of node.
+func knows(node *testNode, addr string) bool {
+	for _, known := range node.addrManager.Known() {
+		if known.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// TestAddrGossip checks that a node learns the address of a peer it was
+// never configured with from another peer, and connects to it.
+func TestAddrGossip(t *testing.T) {
+	a := startTestNode(t, testNodeConfig())
+	b := startTestNode(t, testNodeConfig(a.addr))
+	aAddr, bAddr := a.addr, b.addr
+
+	// B records A once its handshake with A completes, and A records B
+	// once it dialed back the port B announced
+	waitFor(t, "B verified A", func() bool {
+		return b.addrManager.IsVerified(aAddr)
+	})
+	waitFor(t, "A verified B", func() bool {
+		return a.addrManager.IsVerified(bAddr)
+	})
+
+	c := startTestNode(t, testNodeConfig(bAddr))
+	cAddr := c.addr
+	if knows(c, aAddr) {
+		t.Fatal("C knows A before connecting to B")
+	}
+	waitFor(t, "C learned A from B", func() bool {
+		return knows(c, aAddr)
+	})
+	waitFor(t, "C connected to A", func() bool {
+		return c.isConnected(aAddr) && a.isConnected(cAddr)
+	})
+
+	// No node gossips or dials its own address
+	for _, node := range []*testNode{a, b, c} {
+		if knows(node, node.addr) {
+			t.Fatalf("node %s knows its own address", node.addr)
+		}
+	}
+}
+
+// TestAddrPayload checks that addresses survive an addr payload and that
+// addresses that aren't an IP address and port are skipped.
+func TestAddrPayload(t *testing.T) {
+	payload := newAddrPayload([]string{"127.0.0.1:8335",
+		"seed.example.com:8335", "[2001:db8::1]:18335"})
+	addrs, err := parseAddrPayload(payload)
+	if err != nil {
+		t.Fatalf("parseAddrPayload: %v", err)
+	}
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:8335"),
+		netip.MustParseAddrPort("[2001:db8::1]:18335"),
+	}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Fatalf("got %v, want %v", addrs, want)
+	}
+
+	if _, err := parseAddrPayload(payload[:len(payload)-1]); err == nil {
+		t.Fatal("truncated addr accepted")
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// peersFileName is the name of the file in the data directory used to
+	// persist known peer addresses.
+	peersFileName = "peers.json"
+
+	// reconnectBaseDelay is the delay before the first retry of a failed
+	// address. It doubles with every consecutive failure.
+	reconnectBaseDelay = time.Second
+
+	// reconnectMaxDelay caps the exponential backoff between retries.
+	reconnectMaxDelay = 5 * time.Minute
+
+	// maxKnownAddresses is the number of known addresses beyond which
+	// addresses learned from peers are dropped.
+	maxKnownAddresses = 10000
+
+	// maxGossipAge is how long after its last handshake an address is
+	// still given to peers asking for addresses.
+	maxGossipAge = 7 * 24 * time.Hour
+)
+
+// knownAddress tracks connection attempts to a single peer address.
+type knownAddress struct {
+	Addr        string    `json:"addr"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	BadUntil    time.Time `json:"bad_until"`
+
+	// LastSeen is when a frame was last received from the peer and
+	// UserAgent the software it announced.
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+
+	// LastVerified is when a handshake with the peer at the address last
+	// completed, which shows it accepts connections there.
+	LastVerified time.Time `json:"last_verified,omitempty"`
+
+	// PeerKey is the hex encoded identity key the peer at the address
+	// last proved it holds, empty if it has none.
+	PeerKey string `json:"peer_key,omitempty"`
+}
+
+// KnownPeer describes a known peer address and what was learned about it
+// when it was last connected.
+type KnownPeer struct {
+	Addr      string
+	UserAgent string
+	Connected bool
+
+	// PeerKey is the identity key of the peer, empty if it has none.
+	PeerKey string
+
+	// LastSeen is when a frame was last received from the peer,
+	// LastSuccess when it was last connected to and LastAttempt when it was
+	// last dialed or disconnected. They are zero if that never happened.
+	LastSeen    time.Time
+	LastSuccess time.Time
+	LastAttempt time.Time
+
+	// BadUntil is the end of the cooldown of an address that failed too
+	// often, zero if it isn't in one.
+	BadUntil time.Time
+}
+
+// nextAttempt returns the earliest time the address should be dialed again.
+func (ka *knownAddress) nextAttempt() time.Time {
+	next := ka.nextRetry()
+	if ka.BadUntil.After(next) {
+		next = ka.BadUntil
+	}
+	return next
+}
+
+// nextRetry returns the end of the backoff after the last failed attempt,
+// ignoring the bad address cooldown.
+func (ka *knownAddress) nextRetry() time.Time {
+	if ka.Attempts == 0 {
+		return ka.LastAttempt
+	}
+
+	delay := reconnectBaseDelay
+	for i := 1; i < ka.Attempts && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return ka.LastAttempt.Add(delay)
+}
+
+// gossipable reports whether the address is given to peers asking for
+// addresses: it completed a handshake recently and hasn't failed since.
+func (ka *knownAddress) gossipable(now time.Time) bool {
+	return !ka.LastVerified.IsZero() &&
+		now.Sub(ka.LastVerified) < maxGossipAge &&
+		ka.Attempts == 0 && !now.Before(ka.BadUntil)
+}
+
+// AddrManager keeps track of known peer addresses, their connection history
+// and whether they are currently considered bad. It optionally persists the
+// addresses to a peers.json file in the data directory.
+type AddrManager struct {
+	path        string
+	maxFailures int
+	badCooldown time.Duration
+
+	addrs map[string]*knownAddress
+	mu    sync.Mutex
+}
+
+// NewAddrManager creates a new address manager. If dataDir is empty the
+// addresses are only kept in memory. Addresses failing maxFailures times in a
+// row are not retried for badCooldown.
+func NewAddrManager(dataDir string, maxFailures int,
+	badCooldown time.Duration) *AddrManager {
+
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, peersFileName)
+	}
+
+	return &AddrManager{
+		path:        path,
+		maxFailures: maxFailures,
+		badCooldown: badCooldown,
+		addrs:       make(map[string]*knownAddress),
+	}
+}
+
+// Load reads previously persisted addresses. A missing file is not an error.
+func (a *AddrManager) Load() error {
+	if a.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", a.path, err)
+	}
+
+	var addrs []*knownAddress
+	if err := json.Unmarshal(data, &addrs); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", a.path, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ka := range addrs {
+		if ka.Addr == "" {
+			continue
+		}
+		a.addrs[ka.Addr] = ka
+	}
+	return nil
+}
+
+// Save persists the known addresses to the data directory.
+func (a *AddrManager) Save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	addrs := make([]*knownAddress, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		addrs = append(addrs, ka)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Addr < addrs[j].Addr
+	})
+	data, err := json.MarshalIndent(addrs, "", "  ")
+	a.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode peers: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// peers file behind.
+	tmpPath := a.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+// AddAddress adds an address to the set of known addresses if it is not
+// already known.
+func (a *AddrManager) AddAddress(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.addrs[addr]; !ok {
+		a.addrs[addr] = &knownAddress{Addr: addr}
+	}
+}
+
+// AddLearned adds the addresses learned from a peer that aren't known yet,
+// until maxKnownAddresses are known. It returns the number added.
+func (a *AddrManager) AddLearned(addrs []string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if len(a.addrs) >= maxKnownAddresses {
+			break
+		}
+		if _, ok := a.addrs[addr]; ok {
+			continue
+		}
+		a.addrs[addr] = &knownAddress{Addr: addr}
+		added++
+	}
+	return added
+}
+
+// Remove forgets addr, so it is no longer a candidate for outbound
+// connections.
+func (a *AddrManager) Remove(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.addrs, addr)
+}
+
+// Attempt records a connection attempt to addr.
+func (a *AddrManager) Attempt(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.lookup(addr)
+	ka.LastAttempt = time.Now()
+}
+
+// Good records a successful connection to addr and resets its failure count.
+func (a *AddrManager) Good(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.lookup(addr)
+	ka.Attempts = 0
+	ka.LastSuccess = time.Now()
+	ka.BadUntil = time.Time{}
+}
+
+// Failed records a failed connection attempt to addr. After maxFailures
+// consecutive failures the address is considered bad for the cooldown period.
+func (a *AddrManager) Failed(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.lookup(addr)
+	ka.Attempts++
+	ka.LastAttempt = time.Now()
+	if a.maxFailures > 0 && ka.Attempts >= a.maxFailures {
+		ka.BadUntil = ka.LastAttempt.Add(a.badCooldown)
+		ka.Attempts = 0
+	}
+}
+
+// Verified records that a handshake with the peer at addr completed, so it
+// accepts connections there, and resets its failure count.
+func (a *AddrManager) Verified(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.lookup(addr)
+	ka.Attempts = 0
+	ka.LastSuccess = time.Now()
+	ka.LastVerified = ka.LastSuccess
+	ka.BadUntil = time.Time{}
+}
+
+// Identified records that the peer at addr holds the identity key, so the
+// other addresses known for the same key are stale: the node moved. They are
+// forgotten and returned.
+func (a *AddrManager) Identified(addr, key string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lookup(addr).PeerKey = key
+	var moved []string
+	for other, ka := range a.addrs {
+		if other != addr && ka.PeerKey == key {
+			delete(a.addrs, other)
+			moved = append(moved, other)
+		}
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+// IsVerified reports whether addr would be given to peers asking for
+// addresses.
+func (a *AddrManager) IsVerified(addr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[addr]
+	return ok && ka.gossipable(time.Now())
+}
+
+// GossipAddresses returns up to n addresses, chosen at random, of peers that
+// recently completed a handshake and for which keep returns true.
+func (a *AddrManager) GossipAddresses(n int, keep func(string) bool) []string {
+	a.mu.Lock()
+	now := time.Now()
+	var addrs []string
+	for _, ka := range a.addrs {
+		if ka.gossipable(now) {
+			addrs = append(addrs, ka.Addr)
+		}
+	}
+	a.mu.Unlock()
+
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	selected := addrs[:0]
+	for _, addr := range addrs {
+		if len(selected) == n {
+			break
+		}
+		if keep(addr) {
+			selected = append(selected, addr)
+		}
+	}
+	return selected
+}
+
+// Seen records the user agent of the peer at addr and when it was last heard
+// from. A zero lastSeen keeps the previous time.
+func (a *AddrManager) Seen(addr, userAgent string, lastSeen time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka := a.lookup(addr)
+	if userAgent != "" {
+		ka.UserAgent = userAgent
+	}
+	if !lastSeen.IsZero() {
+		ka.LastSeen = lastSeen
+	}
+}
+
+// Known returns every known address, sorted by address.
+func (a *AddrManager) Known() []KnownPeer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	known := make([]KnownPeer, 0, len(a.addrs))
+	for _, ka := range a.addrs {
+		peer := KnownPeer{
+			Addr:        ka.Addr,
+			UserAgent:   ka.UserAgent,
+			PeerKey:     ka.PeerKey,
+			LastSeen:    ka.LastSeen,
+			LastSuccess: ka.LastSuccess,
+			LastAttempt: ka.LastAttempt,
+		}
+		if time.Now().Before(ka.BadUntil) {
+			peer.BadUntil = ka.BadUntil
+		}
+		known = append(known, peer)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].Addr < known[j].Addr
+	})
+	return known
+}
+
+// IsBad reports whether addr is currently in its bad address cooldown.
+func (a *AddrManager) IsBad(addr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ka, ok := a.addrs[addr]
+	return ok && time.Now().Before(ka.BadUntil)
+}
+
+// Candidates returns the known addresses whose backoff has elapsed, ordered
+// by how recently they were last connected to successfully. The addresses
+// prefer, if not nil, returns true for given the address and the identity key
+// last seen there come first and skip the bad address cooldown. The number of
+// them is returned along with the addresses.
+func (a *AddrManager) Candidates(prefer func(addr, peerKey string) bool) (
+	[]string, int) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	var ready []*knownAddress
+	preferred := make(map[*knownAddress]bool)
+	for _, ka := range a.addrs {
+		if prefer != nil && prefer(ka.Addr, ka.PeerKey) {
+			if ka.nextRetry().After(now) {
+				continue
+			}
+			preferred[ka] = true
+		} else if ka.nextAttempt().After(now) {
+			continue
+		}
+		ready = append(ready, ka)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if preferred[ready[i]] != preferred[ready[j]] {
+			return preferred[ready[i]]
+		}
+		return ready[i].LastSuccess.After(ready[j].LastSuccess)
+	})
+
+	addrs := make([]string, len(ready))
+	for i, ka := range ready {
+		addrs[i] = ka.Addr
+	}
+	return addrs, len(preferred)
+}
+
+// lookup returns the entry for addr, creating it if necessary. The caller
+// must hold the lock.
+func (a *AddrManager) lookup(addr string) *knownAddress {
+	ka, ok := a.addrs[addr]
+	if !ok {
+		ka = &knownAddress{Addr: addr}
+		a.addrs[addr] = ka
+	}
+	return ka
+}
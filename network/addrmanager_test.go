@@ -0,0 +1,163 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// candidate reports whether addr is among the addresses a would dial now.
+func candidate(a *AddrManager, addr string) bool {
+	addrs, _ := a.Candidates(nil)
+	return slices.Contains(addrs, addr)
+}
+
+// TestReconnectAfterRestart checks that a node reconnects to a known peer
+// that restarted within the first steps of its backoff.
+func TestReconnectAfterRestart(t *testing.T) {
+	aCfg := testNodeConfig()
+	a := startTestNode(t, aCfg)
+	bCfg := testNodeConfig(a.addr)
+	bCfg.DataDir = t.TempDir()
+	b := startTestNode(t, bCfg)
+	waitFor(t, "B connected to A", func() bool {
+		return b.isConnected(a.addr)
+	})
+
+	a.Stop()
+	waitFor(t, "B noticed A stopped", func() bool {
+		return !b.isConnected(a.addr)
+	})
+
+	// A restarts on the same address after B's first retry failed
+	time.Sleep(reconnectBaseDelay + reconnectInterval)
+	aCfg.ListenAddr = a.addr
+	restarted := startTestNode(t, aCfg)
+	start := time.Now()
+	waitFor(t, "B reconnected to A", func() bool {
+		return b.isConnected(restarted.addr)
+	})
+
+	// One more doubling of the backoff, and a check of the loop
+	if waited := time.Since(start); waited > 4*reconnectBaseDelay+
+		reconnectInterval {
+
+		t.Fatalf("reconnected after %v", waited)
+	}
+	if b.addrManager.IsBad(a.addr) {
+		t.Fatal("restarted peer marked bad")
+	}
+
+	// B remembers A in its data directory when it stops
+	b.Stop()
+	saved := NewAddrManager(bCfg.DataDir, DefaultMaxAddrFailures, time.Hour)
+	if err := saved.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !saved.IsVerified(a.addr) {
+		t.Fatalf("%s not saved to %s", a.addr, peersFileName)
+	}
+}
+
+// TestAddrManagerPersist checks that the known addresses and their history
+// are saved to peers.json and loaded back.
+func TestAddrManagerPersist(t *testing.T) {
+	dir := t.TempDir()
+	a := NewAddrManager(dir, 3, time.Hour)
+	a.AddAddress("10.0.0.1:8335")
+	a.AddAddress("10.0.0.2:8335")
+	a.Verified("10.0.0.1:8335")
+	a.Seen("10.0.0.1:8335", "/utxochat:0.1/", time.Now())
+	for i := 0; i < 3; i++ {
+		a.Failed("10.0.0.2:8335")
+	}
+	if err := a.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded := NewAddrManager(dir, 3, time.Hour)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	want, got := a.Known(), loaded.Known()
+	if len(got) != 2 {
+		t.Fatalf("loaded %d addresses, want 2", len(got))
+	}
+	for i := range want {
+		if got[i].Addr != want[i].Addr ||
+			got[i].UserAgent != want[i].UserAgent ||
+			!got[i].LastSuccess.Equal(want[i].LastSuccess) ||
+			!got[i].BadUntil.Equal(want[i].BadUntil) {
+
+			t.Fatalf("loaded %+v, want %+v", got[i], want[i])
+		}
+	}
+	if !loaded.IsVerified("10.0.0.1:8335") ||
+		!loaded.IsBad("10.0.0.2:8335") {
+
+		t.Fatal("history lost on load")
+	}
+
+	// A data directory without peers.json starts empty
+	empty := NewAddrManager(t.TempDir(), 3, time.Hour)
+	if err := empty.Load(); err != nil || len(empty.Known()) != 0 {
+		t.Fatalf("loaded %d addresses, %v, from nothing",
+			len(empty.Known()), err)
+	}
+}
+
+// TestAddrManagerBadCooldown checks that an address is retried with a
+// growing backoff, skipped for the cooldown once it failed too often, and
+// dialed again once the cooldown ended or it was connected to.
+func TestAddrManagerBadCooldown(t *testing.T) {
+	const addr = "10.0.0.1:8335"
+
+	a := NewAddrManager("", 3, time.Hour)
+	a.AddAddress(addr)
+	if !candidate(a, addr) {
+		t.Fatal("new address not dialed")
+	}
+
+	a.Failed(addr)
+	if candidate(a, addr) || a.IsBad(addr) {
+		t.Fatal("address dialed again within its backoff")
+	}
+	ka := a.lookup(addr)
+	ka.LastAttempt = time.Now().Add(-reconnectBaseDelay)
+	if !candidate(a, addr) {
+		t.Fatal("address not dialed after its backoff")
+	}
+	if retry := ka.nextRetry().Sub(ka.LastAttempt); retry !=
+		reconnectBaseDelay {
+
+		t.Fatalf("backoff after a failure is %v", retry)
+	}
+
+	a.Failed(addr)
+	a.Failed(addr)
+	if !a.IsBad(addr) || candidate(a, addr) {
+		t.Fatal("address dialed after three failures")
+	}
+	if until := a.Known()[0].BadUntil; time.Until(until) <= 59*time.Minute {
+		t.Fatalf("cooldown ends at %v, want in an hour", until)
+	}
+
+	// Its cooldown ends
+	ka.BadUntil = time.Now().Add(-time.Second)
+	if a.IsBad(addr) || !candidate(a, addr) {
+		t.Fatal("address not dialed after its cooldown")
+	}
+
+	// Or it connects to us
+	for i := 0; i < 3; i++ {
+		a.Failed(addr)
+	}
+	a.Good(addr)
+	if a.IsBad(addr) || !candidate(a, addr) {
+		t.Fatal("address still bad after a connection")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// announceTimeout is how long after announcing a message to a peer
+	// it counts as ignored if the peer didn't fetch it.
+	announceTimeout = 2 * time.Minute
+
+	// maxTrackedAnnouncements is the number of announcements per peer
+	// waiting for a getdata that are tracked. Announcements beyond it are
+	// not counted.
+	maxTrackedAnnouncements = 4096
+
+	// fetchLatencySamples is the number of recent fetch latencies per peer
+	// the median is computed over.
+	fetchLatencySamples = 128
+)
+
+// AnnounceStats tells how many of the messages announced to a peer with an
+// inv it fetched with a getdata.
+type AnnounceStats struct {
+	// Announced is the number of outpoints announced, Fetched the number
+	// the peer asked for within announceTimeout and Ignored the number it
+	// didn't. The others are still waiting.
+	Announced uint64
+	Fetched   uint64
+	Ignored   uint64
+
+	// MedianFetchLatency is the median time from announcement to getdata
+	// over the recent fetches, zero if there were none.
+	MedianFetchLatency time.Duration
+}
+
+// Conversion returns the fraction of the settled announcements the peer
+// fetched, zero if none settled yet.
+func (s AnnounceStats) Conversion() float64 {
+	if s.Fetched+s.Ignored == 0 {
+		return 0
+	}
+	return float64(s.Fetched) / float64(s.Fetched+s.Ignored)
+}
+
+// announcement is an outpoint announced to a peer, waiting for its getdata.
+type announcement struct {
+	outpoint message.Outpoint
+	at       time.Time
+}
+
+// announceTracker records the outpoints announced to a peer until it fetches
+// them or announceTimeout passes. It is safe for concurrent use.
+type announceTracker struct {
+	waiting map[message.Outpoint]*list.Element
+	order   *list.List
+
+	announced uint64
+	fetched   uint64
+	ignored   uint64
+
+	// latencies holds the recent fetch latencies, next the index
+	// overwritten by the next one once it is full.
+	latencies []time.Duration
+	next      int
+
+	mu sync.Mutex
+}
+
+// newAnnounceTracker creates an empty announcement tracker.
+func newAnnounceTracker() *announceTracker {
+	return &announceTracker{
+		waiting: make(map[message.Outpoint]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// announce records that outpoints were announced at now. Outpoints already
+// waiting keep their first announcement.
+func (a *announceTracker) announce(outpoints []message.Outpoint,
+	now time.Time) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+	for _, outpoint := range outpoints {
+		if _, ok := a.waiting[outpoint]; ok {
+			continue
+		}
+		if a.order.Len() >= maxTrackedAnnouncements {
+			return
+		}
+		a.waiting[outpoint] = a.order.PushBack(&announcement{outpoint, now})
+		a.announced++
+	}
+}
+
+// fetch records that the peer asked for outpoint at now. Getdata for
+// outpoints that aren't waiting, because they weren't announced or were
+// fetched already, isn't counted.
+func (a *announceTracker) fetch(outpoint message.Outpoint, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+	elem, ok := a.waiting[outpoint]
+	if !ok {
+		return
+	}
+	a.order.Remove(elem)
+	delete(a.waiting, outpoint)
+	a.fetched++
+
+	latency := now.Sub(elem.Value.(*announcement).at)
+	if len(a.latencies) < fetchLatencySamples {
+		a.latencies = append(a.latencies, latency)
+		return
+	}
+	a.latencies[a.next] = latency
+	a.next = (a.next + 1) % fetchLatencySamples
+}
+
+// expire counts the announcements older than announceTimeout as ignored. The
+// caller must hold the lock.
+func (a *announceTracker) expire(now time.Time) {
+	for elem := a.order.Front(); elem != nil; elem = a.order.Front() {
+		entry := elem.Value.(*announcement)
+		if now.Sub(entry.at) < announceTimeout {
+			return
+		}
+		a.order.Remove(elem)
+		delete(a.waiting, entry.outpoint)
+		a.ignored++
+	}
+}
+
+// stats returns the counters of the tracker at now.
+func (a *announceTracker) stats(now time.Time) AnnounceStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+	stats := AnnounceStats{
+		Announced: a.announced,
+		Fetched:   a.fetched,
+		Ignored:   a.ignored,
+	}
+	if len(a.latencies) > 0 {
+		sorted := slices.Clone(a.latencies)
+		slices.Sort(sorted)
+		stats.MedianFetchLatency = sorted[len(sorted)/2]
+	}
+	return stats
+}
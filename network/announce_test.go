@@ -0,0 +1,131 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestAnnounceTracker checks the counters and median latency of the
+// announcement tracker, that announcements count as ignored after
+// announceTimeout and that no more than maxTrackedAnnouncements wait.
+func TestAnnounceTracker(t *testing.T) {
+	tracker := newAnnounceTracker()
+	start := time.Now()
+	outpoints := []message.Outpoint{inventoryOutpoint(0),
+		inventoryOutpoint(1), inventoryOutpoint(2), inventoryOutpoint(3)}
+	tracker.announce(outpoints, start)
+
+	// Announcing again, or fetching twice or unannounced, isn't counted
+	tracker.announce(outpoints[:1], start.Add(time.Second))
+	for i, latency := range []time.Duration{time.Second, 3 * time.Second,
+		2 * time.Second} {
+
+		tracker.fetch(outpoints[i], start.Add(latency))
+	}
+	tracker.fetch(outpoints[0], start.Add(4*time.Second))
+	tracker.fetch(inventoryOutpoint(4), start.Add(4*time.Second))
+
+	stats := tracker.stats(start.Add(announceTimeout))
+	want := AnnounceStats{
+		Announced:          4,
+		Fetched:            3,
+		Ignored:            1,
+		MedianFetchLatency: 2 * time.Second,
+	}
+	if stats != want {
+		t.Fatalf("got %+v, want %+v", stats, want)
+	}
+	if conversion := stats.Conversion(); conversion != 0.75 {
+		t.Fatalf("conversion %v, want 0.75", conversion)
+	}
+
+	full := newAnnounceTracker()
+	for i := 0; i < maxTrackedAnnouncements+10; i++ {
+		full.announce([]message.Outpoint{inventoryOutpoint(i)}, start)
+	}
+	if len(full.waiting) != maxTrackedAnnouncements ||
+		full.order.Len() != maxTrackedAnnouncements {
+
+		t.Fatalf("%d announcements waiting, want %d", len(full.waiting),
+			maxTrackedAnnouncements)
+	}
+}
+
+// TestAnnounceConversion checks that a fresh peer fetches every message
+// announced to it, a conversion of 1, while outpoints announced again once
+// it has them are ignored.
+func TestAnnounceConversion(t *testing.T) {
+	const count = 5
+
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	startTestNodeWith(t, testNodeConfig(node.addr), node.client,
+		database.NewMemoryDB())
+	waitFor(t, "nodes connected", func() bool {
+		return len(node.Stats().Peers) == 1
+	})
+	node.peersMu.RLock()
+	var peer *Peer
+	for _, p := range node.peers {
+		peer = p
+	}
+	node.peersMu.RUnlock()
+
+	// fetched waits until the peer fetched n announcements in all
+	fetched := func(n uint64) {
+		t.Helper()
+		waitFor(t, "announcements fetched", func() bool {
+			return node.Stats().Peers[0].Announce.Fetched == n
+		})
+	}
+	submit := func(i int) message.Outpoint {
+		t.Helper()
+		msg := signTestMessage(t, node.client, inventoryOutpoint(i),
+			"announced")
+		if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+		return msg.Outpoint
+	}
+
+	var outpoints []message.Outpoint
+	for i := 0; i < count; i++ {
+		outpoints = append(outpoints, submit(i))
+	}
+	fetched(count)
+	stats := peer.announcements.stats(time.Now().Add(announceTimeout))
+	if stats.Announced != count || stats.Conversion() != 1 {
+		t.Fatalf("fresh peer: %+v, conversion %v", stats,
+			stats.Conversion())
+	}
+	if stats.MedianFetchLatency <= 0 {
+		t.Fatal("no fetch latency recorded")
+	}
+
+	// The peer fetching a new message after the repeated announcement
+	// shows it read and ignored it
+	if err := peer.SendMessage(MessageTypeInv,
+		newInvPayload(outpoints...)); err != nil {
+
+		t.Fatalf("SendMessage: %v", err)
+	}
+	submit(count)
+	fetched(count + 1)
+	repeated := peer.announcements.stats(time.Now().Add(announceTimeout))
+	round := AnnounceStats{
+		Fetched: repeated.Fetched - stats.Fetched - 1,
+		Ignored: repeated.Ignored - stats.Ignored,
+	}
+	if round.Ignored != count || round.Conversion() != 0 {
+		t.Fatalf("repeated announcements: %+v, conversion %v", round,
+			round.Conversion())
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// maxPendingParents is the number of parents of replies fetched at a
+	// time. References beyond it are dropped.
+	maxPendingParents = 1024
+
+	// maxMissingParents is the number of parents no peer had that are
+	// remembered, to report their replies as dangling.
+	maxMissingParents = 10000
+)
+
+// replyBackfill tracks the messages replied to that aren't known locally and
+// are being fetched from peers, and those no peer had.
+type replyBackfill struct {
+	// pending maps the parents being fetched to their depth, the number
+	// of replies fetched along the chain leading to them plus one.
+	pending map[message.Outpoint]int
+
+	// missing holds the parents that no peer answered for.
+	missing map[message.Outpoint]struct{}
+
+	mu sync.Mutex
+}
+
+// newReplyBackfill creates an empty reply backfill.
+func newReplyBackfill() *replyBackfill {
+	return &replyBackfill{
+		pending: make(map[message.Outpoint]int),
+		missing: make(map[message.Outpoint]struct{}),
+	}
+}
+
+// resolve records that the message for outpoint arrived. It returns the
+// depth the message was fetched at, zero if it wasn't fetched as a parent.
+func (b *replyBackfill) resolve(outpoint message.Outpoint) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	depth := b.pending[outpoint]
+	delete(b.pending, outpoint)
+	delete(b.missing, outpoint)
+	return depth
+}
+
+// isPending reports whether outpoint is being fetched as a parent.
+func (b *replyBackfill) isPending(outpoint message.Outpoint) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.pending[outpoint]
+	return ok
+}
+
+// isMissing reports whether no peer had the message for outpoint.
+func (b *replyBackfill) isMissing(outpoint message.Outpoint) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.missing[outpoint]
+	return ok
+}
+
+// setMissing records that no peer had the message for outpoint. The caller
+// must hold the lock.
+func (b *replyBackfill) setMissing(outpoint message.Outpoint) {
+	delete(b.pending, outpoint)
+	if len(b.missing) >= maxMissingParents {
+		for forget := range b.missing {
+			delete(b.missing, forget)
+			break
+		}
+	}
+	b.missing[outpoint] = struct{}{}
+}
+
+// backfillParent fetches the message a reply refers to when it isn't known
+// locally, asking source first and the other peers after it. It also records
+// that msg arrived, in case it was such a parent itself. Parents are fetched
+// along a chain of replies up to MaxReplyDepth messages. The caller holds
+// the lock of msg's outpoint.
+func (m *Manager) backfillParent(ctx context.Context, msg *message.Message,
+	meta *database.MessageMeta, source *Peer) {
+
+	depth := m.backfill.resolve(msg.Outpoint)
+	if meta.ReplyTo == nil || m.config.MaxReplyDepth < 0 {
+		return
+	}
+	parent := *meta.ReplyTo
+	if depth >= m.config.MaxReplyDepth {
+		log.Debugf("Not fetching parent %s of %s, %d replies deep",
+			parent.ToString(), msg.Outpoint.ToString(), depth)
+		return
+	}
+
+	known, err := m.db.HasOutpoint(ctx, parent)
+	if err == nil && !known {
+		var archived []byte
+		archived, err = m.db.GetArchivedMessage(ctx, parent)
+		known = archived != nil
+	}
+	if err != nil {
+		log.Warnf("Error looking up parent %s of %s: %v", parent.ToString(),
+			msg.Outpoint.ToString(), err)
+		return
+	}
+	if known {
+		return
+	}
+
+	m.fetchParent(parent, depth+1, source)
+}
+
+// fetchParent requests the parent of a reply from source, or the first
+// connected peer if it is nil, and remembers the other peers to ask if it
+// doesn't answer. The parent is reported missing right away without peers.
+func (m *Manager) fetchParent(parent message.Outpoint, depth int,
+	source *Peer) {
+
+	peers := m.backfillPeers(source)
+
+	m.backfill.mu.Lock()
+	defer m.backfill.mu.Unlock()
+
+	if _, ok := m.backfill.pending[parent]; ok {
+		return
+	}
+	if len(peers) == 0 {
+		log.Debugf("No peer to fetch parent %s from", parent.ToString())
+		m.backfill.setMissing(parent)
+		return
+	}
+	if len(m.backfill.pending) >= maxPendingParents {
+		log.Debugf("Not fetching parent %s, %d parents pending",
+			parent.ToString(), len(m.backfill.pending))
+		return
+	}
+	m.backfill.pending[parent] = depth
+
+	var first *Peer
+	now := time.Now()
+	for _, peer := range peers {
+		if m.requests.request(parent, peer, now) && first == nil {
+			first = peer
+		}
+	}
+	if first != nil {
+		log.Debugf("Fetching parent %s from peer %s", parent.ToString(),
+			first.addr)
+		go first.requestData(parent)
+	}
+}
+
+// backfillPeers returns the peers that completed the handshake, source
+// first.
+func (m *Manager) backfillPeers(source *Peer) []*Peer {
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	peers := make([]*Peer, 0, len(m.peers))
+	if source != nil {
+		peers = append(peers, source)
+	}
+	for _, peer := range m.peers {
+		if peer == source || peer.disconnecting() {
+			continue
+		}
+		if version, _ := peer.announced(); version == 0 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// expireBackfill reports the parents that are no longer requested from any
+// peer without having arrived as missing, so the replies to them are
+// reported as dangling.
+func (m *Manager) expireBackfill() {
+	m.backfill.mu.Lock()
+	defer m.backfill.mu.Unlock()
+
+	for parent := range m.backfill.pending {
+		if m.requests.inflight(parent) {
+			continue
+		}
+		log.Infof("No peer had parent %s, its replies are dangling",
+			parent.ToString())
+		m.backfill.setMissing(parent)
+	}
+}
+
+// ParentMissing reports whether the message replied to with parent couldn't
+// be fetched from any peer, making the replies to it dangling.
+func (m *Manager) ParentMissing(parent message.Outpoint) bool {
+	return m.backfill.isMissing(parent)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// TestBackfillParent checks that a node joining late, which is only
+// announced a reply, fetches the message it replies to from the peer that
+// sent it, keeping it even if its UTXO was spent meanwhile.
+func TestBackfillParent(t *testing.T) {
+	tests := []struct {
+		name  string
+		spent bool
+	}{
+		{"unspent", false},
+		{"spent", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testBackfillParent(t, test.spent)
+		})
+	}
+}
+
+// testBackfillParent runs TestBackfillParent with the UTXO of the parent
+// spent or not on the late node's chain.
+func testBackfillParent(t *testing.T, spent bool) {
+	ctx := context.Background()
+	late := startTestNode(t, testNodeConfig())
+	node := startTestNode(t, testNodeConfig(late.addr))
+	waitFor(t, "nodes connected", func() bool {
+		return len(late.Stats().Peers) == 1
+	})
+
+	// The parent was relayed before the late node joined, so only the
+	// reply is announced to it
+	key, pkScript := testSender(t, 7)
+	parent := signTestMessage(t, node.client, inventoryOutpoint(0),
+		"parent")
+	if !spent {
+		late.client.AddUTXO(parent.Outpoint.WireOutPoint(), 50000,
+			pkScript)
+	}
+	err := node.db.AddMessage(ctx, parent.Outpoint, parent.Serialize(),
+		database.MessageMeta{})
+	if err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+
+	outpoint := inventoryOutpoint(1)
+	node.client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	late.client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	payload, err := message.BuildPayload(&message.Payload{
+		ReplyTo: &parent.Outpoint,
+		Body:    "reply",
+	})
+	if err != nil {
+		t.Fatalf("BuildPayload: %v", err)
+	}
+	reply, err := signer.SignMessage(key, outpoint, message.ContentTypeBinary,
+		payload)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if _, err := node.SubmitMessage(ctx, reply.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	waitFor(t, "parent fetched", func() bool {
+		data, err := late.db.GetMessage(ctx, parent.Outpoint)
+		return err == nil && data != nil
+	})
+	if data, err := late.db.GetMessage(ctx, reply.Outpoint); err != nil ||
+		data == nil {
+
+		t.Fatalf("reply not stored: %v", err)
+	}
+	if late.ParentMissing(parent.Outpoint) {
+		t.Fatal("fetched parent reported missing")
+	}
+}
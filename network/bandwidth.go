@@ -0,0 +1,172 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// bandwidthWindow is the period upload caps apply to.
+const bandwidthWindow = time.Hour
+
+// errBusy is returned when a getdata request is refused because an upload cap
+// was reached. It is answered with RejectBusy.
+var errBusy = errors.New("upload cap reached")
+
+// bandwidthMeter counts the bytes sent to and received from peers, in total
+// and in the current window. A window starts with the first traffic after the
+// previous one ended.
+type bandwidthMeter struct {
+	window time.Duration
+
+	mu            sync.Mutex
+	start         time.Time
+	sent          uint64
+	received      uint64
+	totalSent     uint64
+	totalReceived uint64
+}
+
+// newBandwidthMeter creates a bandwidth meter whose windows last window.
+func newBandwidthMeter(window time.Duration) *bandwidthMeter {
+	return &bandwidthMeter{
+		window: window,
+		start:  time.Now(),
+	}
+}
+
+// roll starts a new window if the current one ended before now. The caller
+// must hold mu.
+func (b *bandwidthMeter) roll(now time.Time) {
+	if now.Sub(b.start) < b.window {
+		return
+	}
+	b.start = now
+	b.sent, b.received = 0, 0
+}
+
+// addSent records n bytes sent at now.
+func (b *bandwidthMeter) addSent(n uint64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(now)
+	b.sent += n
+	b.totalSent += n
+}
+
+// addReceived records n bytes received at now.
+func (b *bandwidthMeter) addReceived(n uint64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(now)
+	b.received += n
+	b.totalReceived += n
+}
+
+// usage returns the bytes sent and received in the window current at now.
+func (b *bandwidthMeter) usage(now time.Time) (sent, received uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(now)
+	return b.sent, b.received
+}
+
+// totals returns the bytes sent and received since the meter was created.
+func (b *bandwidthMeter) totals() (sent, received uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.totalSent, b.totalReceived
+}
+
+// BandwidthStats describes the traffic of the node with all its peers.
+type BandwidthStats struct {
+	// BytesSent and BytesReceived are the bytes exchanged with peers since
+	// the manager was created, SentWindow and ReceivedWindow those
+	// exchanged in the current hour.
+	BytesSent      uint64
+	BytesReceived  uint64
+	SentWindow     uint64
+	ReceivedWindow uint64
+
+	// MaxUploadPerHour and MaxPeerUploadPerHour are the configured upload
+	// caps, zero if unlimited.
+	MaxUploadPerHour     uint64
+	MaxPeerUploadPerHour uint64
+
+	// BusyRejects is the number of requested messages refused because an
+	// upload cap was reached.
+	BusyRejects uint64
+}
+
+// BandwidthStats returns the bandwidth counters of the node.
+func (m *Manager) BandwidthStats() BandwidthStats {
+	sent, received := m.bandwidth.totals()
+	sentWindow, receivedWindow := m.bandwidth.usage(time.Now())
+	return BandwidthStats{
+		BytesSent:            sent,
+		BytesReceived:        received,
+		SentWindow:           sentWindow,
+		ReceivedWindow:       receivedWindow,
+		MaxUploadPerHour:     m.settings().MaxUploadPerHour,
+		MaxPeerUploadPerHour: m.settings().MaxPeerUploadPerHour,
+		BusyRejects:          m.busyRejects.Load(),
+	}
+}
+
+// recordReceived updates the traffic counters after n bytes were read from
+// the peer.
+func (p *Peer) recordReceived(n uint64) {
+	now := time.Now()
+	p.bytesReceived.Add(n)
+	p.bandwidth.addReceived(n, now)
+	p.manager.bandwidth.addReceived(n, now)
+}
+
+// checkUploadCap returns errBusy if sending a frame with a payload of pending
+// bytes to the peer would go over the upload cap of the peer or of the node
+// for the current window. Frames queued for the peer but not written yet
+// count as sent. Trusted peers are not capped, though what they are sent
+// counts towards the cap of the node.
+func (p *Peer) checkUploadCap(pending int) error {
+	if p.trusted.Load() {
+		return nil
+	}
+
+	now := time.Now()
+	queued := uint64(p.queuedBytes.Load()) +
+		uint64(headerSize(p.checksum)+pending)
+
+	if limit := p.manager.settings().MaxPeerUploadPerHour; limit > 0 {
+		if sent, _ := p.bandwidth.usage(now); sent+queued > limit {
+			return fmt.Errorf("%w: %d bytes sent to this peer in the "+
+				"last hour, at most %d", errBusy, sent, limit)
+		}
+	}
+	if limit := p.manager.settings().MaxUploadPerHour; limit > 0 {
+		if sent, _ := p.manager.bandwidth.usage(now); sent+queued > limit {
+			return fmt.Errorf("%w: %d bytes sent by this node in the "+
+				"last hour, at most %d", errBusy, sent, limit)
+		}
+	}
+	return nil
+}
+
+// rejectBusy answers a getdata for outpoint refused by checkUploadCap.
+func (p *Peer) rejectBusy(outpoint message.Outpoint, err error) error {
+	p.manager.busyRejects.Add(1)
+	log.Debugf("Not sending message %s to peer %s: %v",
+		outpoint.ToString(), p.addr, err)
+	return p.SendMessage(MessageTypeReject,
+		newRejectPayload(outpoint, RejectBusy, err.Error()))
+}
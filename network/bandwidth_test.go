@@ -0,0 +1,105 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestPeerUploadCap checks that once a peer was sent as many bytes as its
+// hourly cap allows, its getdata requests get a busy reject, and that it is
+// served again after the window rolls.
+func TestPeerUploadCap(t *testing.T) {
+	m, _, db := newTestManager(t)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newTestPeer(t, m, conn, "10.0.0.1:8335")
+	go p.readMessages(bufio.NewReader(conn))
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := message.Message{
+		Outpoint:    outpoint,
+		ContentType: message.ContentTypeText,
+		Length:      5,
+		Payload:     []byte("hello"),
+	}
+	msgData := msg.Serialize()
+	err := db.AddMessage(context.Background(), outpoint, msgData,
+		database.MessageMeta{})
+	if err != nil {
+		t.Fatalf("AddMessage: %v", err)
+	}
+
+	// The cap fits two data frames but not a third
+	frameSize := uint64(headerSize(false) + len(msgData))
+	cfg := *m.settings()
+	cfg.MaxPeerUploadPerHour = 3*frameSize - 1
+	m.live.Store(&cfg)
+
+	// request sends a getdata for the message and returns the type of the
+	// answer once the peer counted it.
+	request := func() MessageType {
+		t.Helper()
+
+		remote.SetDeadline(time.Now().Add(5 * time.Second))
+		err := writeFrame(remote, MessageTypeGetData, outpoint[:], false)
+		if err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+		msgType, payload, err := readFrame(remote, DefaultMaxFrameSize,
+			false)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		if msgType == MessageTypeReject {
+			_, code, _, err := parseRejectPayload(payload)
+			if err != nil || code != RejectBusy {
+				t.Fatalf("rejected with %s, %v, want busy", code, err)
+			}
+		}
+		waitFor(t, "answer counted", func() bool {
+			return p.queuedBytes.Load() == 0
+		})
+		return msgType
+	}
+
+	for i := 0; i < 2; i++ {
+		if msgType := request(); msgType != MessageTypeData {
+			t.Fatalf("request %d answered with %d under the cap", i,
+				msgType)
+		}
+	}
+	if sent, _ := p.bandwidth.usage(time.Now()); sent != 2*frameSize {
+		t.Fatalf("%d bytes sent, want %d", sent, 2*frameSize)
+	}
+	for i := 0; i < 2; i++ {
+		if msgType := request(); msgType != MessageTypeReject {
+			t.Fatalf("request over the cap answered with %d", msgType)
+		}
+	}
+	if stats := m.BandwidthStats(); stats.BusyRejects != 2 {
+		t.Fatalf("%d busy rejects counted, want 2", stats.BusyRejects)
+	}
+
+	// Once the window is over the peer is served again
+	p.bandwidth.mu.Lock()
+	p.bandwidth.start = p.bandwidth.start.Add(-bandwidthWindow)
+	p.bandwidth.mu.Unlock()
+	if msgType := request(); msgType != MessageTypeData {
+		t.Fatalf("request after the window rolled answered with %d",
+			msgType)
+	}
+	if sent, _ := p.bandwidth.usage(time.Now()); sent != frameSize {
+		t.Fatalf("%d bytes sent in the new window, want %d", sent,
+			frameSize)
+	}
+}
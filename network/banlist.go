@@ -0,0 +1,231 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bansFileName is the name of the file in the data directory used to persist
+// banned peers.
+const bansFileName = "bans.json"
+
+// Misbehavior describes a kind of protocol violation by a peer.
+type Misbehavior int
+
+const (
+	// MisbehaviorMalformed is a frame or message that could not be parsed.
+	MisbehaviorMalformed Misbehavior = iota
+
+	// MisbehaviorInvalidSignature is a message whose signature does not
+	// verify against its UTXO.
+	MisbehaviorInvalidSignature
+
+	// MisbehaviorUnknownType is a frame with an unknown message type.
+	MisbehaviorUnknownType
+
+	// MisbehaviorLowValue is a message backed by a UTXO worth less than the
+	// minimum value.
+	MisbehaviorLowValue
+
+	// MisbehaviorDuplicatePayload is a message with a payload already
+	// stored from MaxDuplicatePayloads other outpoints.
+	MisbehaviorDuplicatePayload
+
+	// MisbehaviorDuplicateMessage is a data message known already, scored
+	// once per duplicatesPerScore of them.
+	MisbehaviorDuplicateMessage
+)
+
+// String returns a human readable description of the misbehavior.
+func (m Misbehavior) String() string {
+	switch m {
+	case MisbehaviorMalformed:
+		return "malformed message"
+	case MisbehaviorInvalidSignature:
+		return "invalid signature"
+	case MisbehaviorUnknownType:
+		return "unknown message type"
+	case MisbehaviorLowValue:
+		return "utxo below minimum value"
+	case MisbehaviorDuplicatePayload:
+		return "duplicate payload"
+	case MisbehaviorDuplicateMessage:
+		return "duplicate message"
+	default:
+		return fmt.Sprintf("misbehavior(%d)", int(m))
+	}
+}
+
+// misbehaviorError is returned by message handlers when a peer violated the
+// protocol in a way that should count against its misbehavior score.
+type misbehaviorError struct {
+	kind Misbehavior
+	err  error
+}
+
+func (e *misbehaviorError) Error() string {
+	return e.err.Error()
+}
+
+func (e *misbehaviorError) Unwrap() error {
+	return e.err
+}
+
+// misbehaving wraps err so the peer is scored for the given misbehavior.
+func misbehaving(kind Misbehavior, err error) error {
+	return &misbehaviorError{kind: kind, err: err}
+}
+
+// misbehaviorKind returns the misbehavior carried by err, if any.
+func misbehaviorKind(err error) (Misbehavior, bool) {
+	var mErr *misbehaviorError
+	if errors.As(err, &mErr) {
+		return mErr.kind, true
+	}
+	return 0, false
+}
+
+// BanInfo describes a banned peer host.
+type BanInfo struct {
+	Host  string    `json:"host"`
+	Until time.Time `json:"until"`
+}
+
+// banList tracks banned peer hosts and optionally persists them to a
+// bans.json file in the data directory.
+type banList struct {
+	path string
+
+	bans map[string]time.Time
+	mu   sync.Mutex
+}
+
+// newBanList creates a new ban list. If dataDir is empty the bans are only
+// kept in memory.
+func newBanList(dataDir string) *banList {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, bansFileName)
+	}
+
+	return &banList{
+		path: path,
+		bans: make(map[string]time.Time),
+	}
+}
+
+// load reads previously persisted bans, skipping expired ones. A missing file
+// is not an error.
+func (b *banList) load() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", b.path, err)
+	}
+
+	var bans []BanInfo
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", b.path, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.Until.After(now) {
+			b.bans[ban.Host] = ban.Until
+		}
+	}
+	return nil
+}
+
+// save persists the current bans to the data directory.
+func (b *banList) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode bans: %v", err)
+	}
+
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+// ban bans host until the given time.
+func (b *banList) ban(host string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans[host] = until
+}
+
+// unban lifts the ban on host. It returns false if host was not banned.
+func (b *banList) unban(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.bans[host]; !ok {
+		return false
+	}
+	delete(b.bans, host)
+	return true
+}
+
+// isBanned reports whether host is currently banned.
+func (b *banList) isBanned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.bans[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.bans, host)
+		return false
+	}
+	return true
+}
+
+// list returns the active bans sorted by host.
+func (b *banList) list() []BanInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]BanInfo, 0, len(b.bans))
+	for host, until := range b.bans {
+		if now.After(until) {
+			delete(b.bans, host)
+			continue
+		}
+		bans = append(bans, BanInfo{Host: host, Until: until})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Host < bans[j].Host
+	})
+	return bans
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// badLengthPayload returns a data message whose length field claims more
+// payload than it carries.
+func badLengthPayload() []byte {
+	msg := message.Message{
+		ContentType: message.ContentTypeText,
+		Length:      2,
+		Payload:     []byte("hi"),
+	}
+	data := msg.Serialize()
+	data[message.LengthOffset] = 5
+	return data
+}
+
+// refused reports whether node closed a connection from us without a
+// handshake.
+func refused(t *testing.T, node *testNode) bool {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", node.addr)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+// TestBanMalformed checks that a host whose connections sent three data
+// messages with an invalid payload length is banned, that it can then
+// neither connect nor be dialed, and that the ban survives a restart.
+func TestBanMalformed(t *testing.T) {
+	cfg := testNodeConfig()
+	cfg.DataDir = t.TempDir()
+	node := startTestNode(t, cfg)
+
+	for i := 0; i < 3; i++ {
+		if len(node.ListBans()) != 0 {
+			t.Fatalf("banned after %d malformed messages", i)
+		}
+		remote := dialTestNode(t, node)
+		remote.send(MessageTypeData, badLengthPayload())
+		if !remote.disconnected() {
+			t.Fatalf("still connected after malformed message %d", i+1)
+		}
+	}
+
+	bans := node.ListBans()
+	if len(bans) != 1 || bans[0].Host != "127.0.0.1" {
+		t.Fatalf("got bans %v, want 127.0.0.1", bans)
+	}
+	if !refused(t, node) {
+		t.Fatal("connection from a banned host accepted")
+	}
+	if err := node.connectToPeer("127.0.0.1:8335"); err == nil {
+		t.Fatal("dialed a banned host")
+	}
+
+	restarted := startTestNode(t, cfg)
+	bans = restarted.ListBans()
+	if len(bans) != 1 || bans[0].Host != "127.0.0.1" {
+		t.Fatalf("got bans %v after a restart, want 127.0.0.1", bans)
+	}
+	if !refused(t, restarted) {
+		t.Fatal("connection from a banned host accepted after a restart")
+	}
+}
+
+// TestMisbehaviorScoreDisabled checks that a misbehavior with a negative
+// score doesn't count towards a ban, while a zero score selects the default.
+func TestMisbehaviorScoreDisabled(t *testing.T) {
+	cfg := testNodeConfig()
+	cfg.MalformedScore = -1
+	node := startTestNode(t, cfg)
+	if node.config.MalformedScore != -1 ||
+		node.config.InvalidSignatureScore != DefaultInvalidSignatureScore {
+
+		t.Fatalf("got malformed score %d and invalid signature score %d",
+			node.config.MalformedScore, node.config.InvalidSignatureScore)
+	}
+
+	for i := 0; i < 4; i++ {
+		remote := dialTestNode(t, node)
+		remote.send(MessageTypeData, badLengthPayload())
+		if !remote.disconnected() {
+			t.Fatalf("still connected after malformed message %d", i+1)
+		}
+	}
+	if bans := node.ListBans(); len(bans) != 0 {
+		t.Fatalf("banned for an unscored misbehavior: %v", bans)
+	}
+	node.scoresMu.Lock()
+	score := node.scores["127.0.0.1"]
+	node.scoresMu.Unlock()
+	if score != 0 {
+		t.Fatalf("got score %d, want 0", score)
+	}
+}
+
+// TestMisbehaviorLowValue checks that a message backed by a UTXO below the
+// minimum value is scored as such, rather than as an invalid signature.
+func TestMisbehaviorLowValue(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, outpoint, "hello")
+
+	// The same output, worth less than the minimum
+	node.client.AddUTXO(outpoint.WireOutPoint(), 1000,
+		utxoScript(t, node.client, outpoint))
+
+	remote := dialTestNode(t, node)
+	remote.send(MessageTypeData, msg.Serialize())
+	waitFor(t, "low value message scored", func() bool {
+		node.scoresMu.Lock()
+		defer node.scoresMu.Unlock()
+		return node.scores["127.0.0.1"] != 0
+	})
+	node.scoresMu.Lock()
+	score := node.scores["127.0.0.1"]
+	node.scoresMu.Unlock()
+	if score != DefaultLowValueScore {
+		t.Fatalf("got score %d, want %d", score, DefaultLowValueScore)
+	}
+	if stored, _ := node.db.HasOutpoint(context.Background(),
+		outpoint); stored {
+
+		t.Fatal("low value message stored")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// batchEntryHeaderSize is the size of the 4-byte little-endian length
+	// preceding every message in a batch. Messages don't carry their total
+	// length, their header is recognised by the size of the data.
+	batchEntryHeaderSize = 4
+
+	// maxBatchSize is the maximum payload size of a batch frame. Batches
+	// are cut before they would exceed it, and it always leaves room for
+	// a message of the maximum size.
+	maxBatchSize = 2 << 20
+)
+
+// batchEntry is a message delivered in a batch frame.
+type batchEntry struct {
+	// outpoint is the outpoint the entry starts with, zero if it is too
+	// short to hold one.
+	outpoint message.Outpoint
+
+	// msg is the decoded message and msgData its serialized bytes. err
+	// says why the entry failed to decode or was refused, msg is nil then.
+	msg     *message.Message
+	msgData []byte
+	err     error
+}
+
+// batchBuilder builds batch payloads: a 2-byte little-endian count followed
+// by that many messages, each preceded by its batchEntryHeaderSize length.
+type batchBuilder struct {
+	payload []byte
+	count   int
+}
+
+// add appends msgData to the batch. It returns false if the batch already
+// holds messages and msgData would push it over maxBatchSize.
+func (b *batchBuilder) add(msgData []byte) bool {
+	if b.payload == nil {
+		b.payload = make([]byte, 2, maxBatchSize)
+	}
+	size := batchEntryHeaderSize + len(msgData)
+	if b.count > 0 && len(b.payload)+size > maxBatchSize {
+		return false
+	}
+
+	b.payload = binary.LittleEndian.AppendUint32(b.payload,
+		uint32(len(msgData)))
+	b.payload = append(b.payload, msgData...)
+	b.count++
+	return true
+}
+
+// take returns the batch payload, nil if it is empty, and starts a new batch.
+func (b *batchBuilder) take() []byte {
+	if b.count == 0 {
+		return nil
+	}
+
+	payload := b.payload
+	binary.LittleEndian.PutUint16(payload[:2], uint16(b.count))
+	b.payload, b.count = nil, 0
+	return payload
+}
+
+// parseBatchPayload parses a batch payload built by batchBuilder. Entries
+// are decoded independently, one that fails to decode or exceeds limits is
+// returned with its error. An error is only returned if the batch itself is
+// malformed.
+func parseBatchPayload(payload []byte, limits message.Limits) ([]batchEntry,
+	error) {
+
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("batch message too short: %d bytes",
+			len(payload))
+	}
+
+	count := int(binary.LittleEndian.Uint16(payload[:2]))
+	rest := payload[2:]
+	entries := make([]batchEntry, 0, count)
+	for i := 0; i < count; i++ {
+		if len(rest) < batchEntryHeaderSize {
+			return nil, fmt.Errorf("batch entry %d of %d truncated", i,
+				count)
+		}
+		size := binary.LittleEndian.Uint32(rest)
+		rest = rest[batchEntryHeaderSize:]
+		if uint64(size) > uint64(len(rest)) {
+			return nil, fmt.Errorf("batch entry %d length %d exceeds the "+
+				"%d bytes left", i, size, len(rest))
+		}
+		data := rest[:size:size]
+		rest = rest[size:]
+
+		var entry batchEntry
+		if len(data) >= message.OutpointSize {
+			copy(entry.outpoint[:], data)
+		}
+		msg, err := message.Deserialize(data)
+		if err == nil {
+			err = limits.CheckPayload(len(msg.Payload))
+		}
+		if err != nil {
+			entry.err = err
+		} else {
+			entry.msg, entry.msgData = msg, data
+		}
+		entries = append(entries, entry)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d bytes after the %d batch entries",
+			len(rest), count)
+	}
+	return entries, nil
+}
+
+// handleGetDataBatch processes a get data message from a peer supporting
+// batches, read from r. The payload has the inv format, and the messages we
+// have are sent back in the order requested, in batch frames of at most
+// maxBatchSize bytes.
+func (p *Peer) handleGetDataBatch(r io.Reader) error {
+	outpoints, err := readInvPayload(r)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	var batch batchBuilder
+	sent, batches := 0, 0
+	send := func() error {
+		frame := batch.take()
+		if frame == nil {
+			return nil
+		}
+		batches++
+		return p.SendMessage(MessageTypeDataBatch, frame)
+	}
+
+	now := time.Now()
+	for _, outpoint := range outpoints {
+		p.announcements.fetch(outpoint, now)
+		msgData, err := p.manager.getMessageFromDB(p.ctx, outpoint)
+		if errors.Is(err, database.ErrEvicted) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get message from database: %v", err)
+		}
+		if msgData == nil || !p.acceptsMessage(msgData) {
+			continue
+		}
+
+		// The batch being built isn't queued yet
+		pending := len(batch.payload) + batchEntryHeaderSize + len(msgData)
+		if err := p.checkUploadCap(pending); err != nil {
+			if err := p.rejectBusy(outpoint, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !batch.add(msgData) {
+			if err := send(); err != nil {
+				return err
+			}
+			batch.add(msgData)
+		}
+		sent++
+	}
+	if err := send(); err != nil {
+		return err
+	}
+
+	log.Debugf("Sent %d of %d requested messages to peer %s in %d batches",
+		sent, len(outpoints), p.addr, batches)
+	return nil
+}
+
+// handleDataBatchMessage processes a batch frame from a peer, whose entries
+// were decoded while the frame was read. Each message is handed to the
+// validation workers on its own and answered with its own ack or reject, so
+// one invalid entry doesn't cost the rest of the batch.
+func (p *Peer) handleDataBatchMessage(frame inboundFrame) error {
+	if !p.batchData {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("batch from a peer that didn't negotiate batches"))
+	}
+	if frame.decodeErr != nil {
+		return misbehaving(MisbehaviorMalformed, frame.decodeErr)
+	}
+
+	for _, entry := range frame.batch {
+		if errors.Is(entry.err, message.ErrExceedsPolicy) {
+			p.manager.rejectMessage(entry.outpoint, nil, p.addr,
+				entry.err)
+			p.answerBatchEntry(entry.outpoint, entry.err)
+			continue
+		}
+		if entry.err != nil {
+			err := misbehaving(MisbehaviorMalformed,
+				fmt.Errorf("failed to deserialize message: %w", entry.err))
+			p.manager.rejectMessage(entry.outpoint, nil, p.addr, err)
+			p.answerBatchEntry(entry.outpoint, err)
+			continue
+		}
+		p.knownInv.add(inventoryKey{entry.msg.Outpoint, entry.msg.Sequence})
+
+		// Batches answer our getdata, anything we didn't ask for is
+		// rate limited like a data frame unless the peer is trusted
+		if !p.trusted.Load() &&
+			!p.manager.requests.requestedFrom(entry.msg.Outpoint, p) &&
+			!p.dataLimiter.allow() {
+
+			p.rateViolations++
+			p.throttled.Add(1)
+			p.manager.throttledMsgs.Add(1)
+			if p.rateViolations > p.manager.settings().MaxRateViolations {
+				p.manager.recordThrottled(p.addr)
+				return fmt.Errorf("peer repeatedly exceeded its rate limit")
+			}
+			continue
+		}
+
+		p.manager.queueValidation(p, entry.msg, entry.msgData, true)
+	}
+	return nil
+}
+
+// answerBatchEntry answers a message delivered in a batch like answerData,
+// except that a protocol violation only adds to the misbehavior score of the
+// peer rather than costing the connection, until the peer is banned.
+func (p *Peer) answerBatchEntry(outpoint message.Outpoint, err error) {
+	err = p.answerData(outpoint, err)
+	if kind, ok := misbehaviorKind(err); ok {
+		log.Debugf("Peer %s sent invalid message %s in a batch: %v",
+			p.addr, outpoint.ToString(), err)
+		p.manager.addMisbehavior(p, kind)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// batchCount is the number of messages requested at once in the batch tests.
+const batchCount = 100
+
+// TestGetDataBatch checks that a getdata for 100 outpoints from a peer
+// supporting batches is answered with every message, in order, in as few
+// batch frames as maxBatchSize allows.
+func TestGetDataBatch(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+
+	// Messages of 30000 bytes take several batches
+	text := strings.Repeat("b", 30000)
+	outpoints := make([]message.Outpoint, batchCount)
+	var msgSize int
+	for i := range outpoints {
+		outpoints[i] = inventoryOutpoint(i)
+		msg := message.Message{
+			Outpoint:    outpoints[i],
+			ContentType: message.ContentTypeText,
+			Length:      uint16(len(text)),
+			Payload:     []byte(text),
+		}
+		msgData := msg.Serialize()
+		msgSize = len(msgData)
+		err := node.db.AddMessage(ctx, outpoints[i], msgData,
+			database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+	perBatch := (maxBatchSize - 2) / (batchEntryHeaderSize + msgSize)
+	wantBatches := (batchCount + perBatch - 1) / perBatch
+
+	remote := dialTestNodeServices(t, node, SFBatchData)
+	remote.send(MessageTypeGetData, newInvPayload(outpoints...))
+
+	var received []message.Outpoint
+	batches := 0
+	for len(received) < batchCount {
+		frame, ok := remote.next(MessageTypeDataBatch, MessageTypeData)
+		if !ok {
+			t.Fatalf("%d of %d messages received", len(received),
+				batchCount)
+		}
+		if frame.msgType != MessageTypeDataBatch {
+			t.Fatal("message sent outside a batch")
+		}
+		if len(frame.payload) > maxBatchSize {
+			t.Fatalf("batch of %d bytes", len(frame.payload))
+		}
+		entries, err := parseBatchPayload(frame.payload,
+			message.DefaultLimits())
+		if err != nil {
+			t.Fatalf("parseBatchPayload: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.err != nil {
+				t.Fatalf("batch entry %s: %v", entry.outpoint.ToString(),
+					entry.err)
+			}
+			received = append(received, entry.msg.Outpoint)
+		}
+		batches++
+	}
+	if batches != wantBatches {
+		t.Fatalf("received %d batches, want %d", batches, wantBatches)
+	}
+	for i, outpoint := range received {
+		if outpoint != outpoints[i] {
+			t.Fatalf("message %d is %s, want %s", i, outpoint.ToString(),
+				outpoints[i].ToString())
+		}
+	}
+}
+
+// TestDataBatchCorruptEntry checks that a batch answering the getdata for
+// 100 announced outpoints, with one corrupted entry, has that entry rejected
+// while the other 99 are acked and stored.
+func TestDataBatchCorruptEntry(t *testing.T) {
+	const corrupt = 37
+
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	remote := dialTestNodeServices(t, node, SFBatchData)
+
+	outpoints := make([]message.Outpoint, batchCount)
+	msgs := make([][]byte, batchCount)
+	for i := range outpoints {
+		outpoints[i] = inventoryOutpoint(i)
+		msgs[i] = signTestMessage(t, node.client, outpoints[i],
+			"batched").Serialize()
+	}
+	msgs[corrupt] = bytes.Clone(msgs[corrupt])
+	msgs[corrupt][message.SignatureOffset] ^= 0xff
+
+	// The node asks for everything announced in one getdata
+	remote.send(MessageTypeInv, newInvPayload(outpoints...))
+	frame, ok := remote.next(MessageTypeGetData)
+	if !ok {
+		t.Fatal("announced outpoints not requested")
+	}
+	requested, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil || len(requested) != batchCount {
+		t.Fatalf("requested %d outpoints, %v, want %d", len(requested), err,
+			batchCount)
+	}
+
+	var batch batchBuilder
+	for _, msgData := range msgs {
+		if !batch.add(msgData) {
+			t.Fatal("messages don't fit in one batch")
+		}
+	}
+	remote.send(MessageTypeDataBatch, batch.take())
+
+	acked := 0
+	for i := 0; i < batchCount; i++ {
+		frame, ok := remote.next(MessageTypeAck, MessageTypeReject)
+		if !ok {
+			t.Fatalf("%d of %d messages answered", i, batchCount)
+		}
+		if frame.msgType == MessageTypeAck {
+			acked++
+			continue
+		}
+		outpoint, code, _, err := parseRejectPayload(frame.payload)
+		if err != nil || outpoint != outpoints[corrupt] {
+			t.Fatalf("rejected %s with %s, %v", outpoint.ToString(), code,
+				err)
+		}
+	}
+	if acked != batchCount-1 {
+		t.Fatalf("%d messages acked, want %d", acked, batchCount-1)
+	}
+
+	for i, outpoint := range outpoints {
+		data, err := node.db.GetMessage(ctx, outpoint)
+		if err != nil || (data != nil) != (i != corrupt) {
+			t.Fatalf("message %d stored: %v, %v", i, data != nil, err)
+		}
+	}
+	if len(node.Stats().Peers) != 1 {
+		t.Fatal("peer disconnected for one corrupted entry")
+	}
+}
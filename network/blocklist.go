@@ -0,0 +1,347 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// blocklistFileName is the name of the file in the data directory used to
+// persist the blocklist.
+const blocklistFileName = "blocklist.json"
+
+// ErrBlocked is returned for a valid message this node doesn't store or relay
+// because its sender or outpoint is blocked. Peers relaying it are answered
+// with an ack, they did nothing wrong.
+var ErrBlocked = errors.New("message blocked")
+
+// ErrNotBlocked is returned when unblocking a sender or outpoint that isn't
+// blocked.
+var ErrNotBlocked = errors.New("not blocked")
+
+// Blocklist lists the blocked senders, as hex encoded x-only taproot output
+// keys, and the blocked outpoints.
+type Blocklist struct {
+	PubKeys   []string `json:"pubkeys"`
+	Outpoints []string `json:"outpoints"`
+}
+
+// blocklist holds the senders and outpoints whose messages this node doesn't
+// store or relay. It only affects the local node, the messages are still
+// valid on the network. It is optionally persisted to a blocklist.json file
+// in the data directory and is safe for concurrent use.
+type blocklist struct {
+	path string
+
+	pubKeys   map[[32]byte]struct{}
+	outpoints map[message.Outpoint]struct{}
+	mu        sync.Mutex
+}
+
+// newBlocklist creates an empty blocklist. If dataDir is empty it is only
+// kept in memory.
+func newBlocklist(dataDir string) *blocklist {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, blocklistFileName)
+	}
+
+	return &blocklist{
+		path:      path,
+		pubKeys:   make(map[[32]byte]struct{}),
+		outpoints: make(map[message.Outpoint]struct{}),
+	}
+}
+
+// merge adds the entries of list.
+func (b *blocklist) merge(list *Blocklist) error {
+	pubKeys, outpoints, err := parseEntries(list.PubKeys, list.Outpoints)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for pubKey := range pubKeys {
+		b.pubKeys[pubKey] = struct{}{}
+	}
+	for outpoint := range outpoints {
+		b.outpoints[outpoint] = struct{}{}
+	}
+	return nil
+}
+
+// parseEntries parses hex encoded x-only taproot output keys and txid:vout
+// outpoints into sets.
+func parseEntries(pubKeyList, outpointList []string) (map[[32]byte]struct{},
+	map[message.Outpoint]struct{}, error) {
+
+	pubKeys := make(map[[32]byte]struct{}, len(pubKeyList))
+	for _, value := range pubKeyList {
+		pubKey, err := hex.DecodeString(value)
+		if err != nil || len(pubKey) != 32 {
+			return nil, nil, fmt.Errorf("invalid pubkey %q: expected 32 "+
+				"hex encoded bytes", value)
+		}
+		pubKeys[[32]byte(pubKey)] = struct{}{}
+	}
+
+	outpoints := make(map[message.Outpoint]struct{}, len(outpointList))
+	for _, value := range outpointList {
+		outpoint, err := message.ParseOutpoint(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		outpoints[outpoint] = struct{}{}
+	}
+	return pubKeys, outpoints, nil
+}
+
+// formatEntries is the inverse of parseEntries, returning sorted lists.
+func formatEntries(pubKeys map[[32]byte]struct{},
+	outpoints map[message.Outpoint]struct{}) ([]string, []string) {
+
+	pubKeyList := make([]string, 0, len(pubKeys))
+	for pubKey := range pubKeys {
+		pubKeyList = append(pubKeyList, hex.EncodeToString(pubKey[:]))
+	}
+	outpointList := make([]string, 0, len(outpoints))
+	for outpoint := range outpoints {
+		outpointList = append(outpointList, outpoint.ToString())
+	}
+	sort.Strings(pubKeyList)
+	sort.Strings(outpointList)
+	return pubKeyList, outpointList
+}
+
+// load reads the blocklist persisted by a previous run. A missing file is not
+// an error.
+func (b *blocklist) load() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", b.path, err)
+	}
+
+	var list Blocklist
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", b.path, err)
+	}
+	if err := b.merge(&list); err != nil {
+		return fmt.Errorf("invalid entry in %s: %v", b.path, err)
+	}
+	return nil
+}
+
+// save persists the blocklist to the data directory.
+func (b *blocklist) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(b.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode blocklist: %v", err)
+	}
+
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+// blockPubKey blocks a sender. It returns false if it was already blocked.
+func (b *blocklist) blockPubKey(pubKey [32]byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.pubKeys[pubKey]; ok {
+		return false
+	}
+	b.pubKeys[pubKey] = struct{}{}
+	return true
+}
+
+// unblockPubKey unblocks a sender. It returns false if it wasn't blocked.
+func (b *blocklist) unblockPubKey(pubKey [32]byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.pubKeys[pubKey]; !ok {
+		return false
+	}
+	delete(b.pubKeys, pubKey)
+	return true
+}
+
+// blockOutpoint blocks an outpoint. It returns false if it was already
+// blocked.
+func (b *blocklist) blockOutpoint(outpoint message.Outpoint) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.outpoints[outpoint]; ok {
+		return false
+	}
+	b.outpoints[outpoint] = struct{}{}
+	return true
+}
+
+// unblockOutpoint unblocks an outpoint. It returns false if it wasn't
+// blocked.
+func (b *blocklist) unblockOutpoint(outpoint message.Outpoint) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.outpoints[outpoint]; !ok {
+		return false
+	}
+	delete(b.outpoints, outpoint)
+	return true
+}
+
+// isBlocked reports whether a message for outpoint from the sender pubKey,
+// nil for outputs other than taproot, is blocked.
+func (b *blocklist) isBlocked(outpoint message.Outpoint, pubKey []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.outpoints[outpoint]; ok {
+		return true
+	}
+	if len(pubKey) != 32 {
+		return false
+	}
+	_, ok := b.pubKeys[[32]byte(pubKey)]
+	return ok
+}
+
+// list returns the blocked senders and outpoints, sorted.
+func (b *blocklist) list() *Blocklist {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := &Blocklist{}
+	list.PubKeys, list.Outpoints = formatEntries(b.pubKeys, b.outpoints)
+	return list
+}
+
+// BlockPubKey stops storing and relaying the messages of the sender pubKey, an
+// x-only taproot output key, and purges those already stored.
+func (m *Manager) BlockPubKey(ctx context.Context, pubKey []byte) error {
+	if len(pubKey) != 32 {
+		return fmt.Errorf("invalid pubkey length %d", len(pubKey))
+	}
+	if !m.blocklist.blockPubKey([32]byte(pubKey)) {
+		return nil
+	}
+	if err := m.blocklist.save(); err != nil {
+		log.Warnf("Failed to save blocklist: %v", err)
+	}
+
+	outpoints, err := m.db.GetOutpointsByPubKey(ctx, pubKey)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if err := m.purgeBlocked(ctx, outpoints); err != nil {
+		return err
+	}
+
+	log.Infof("Blocked sender %x, purged %d messages", pubKey, len(outpoints))
+	return nil
+}
+
+// UnblockPubKey stores and relays the messages of the sender pubKey again.
+// Messages purged when it was blocked are not restored.
+func (m *Manager) UnblockPubKey(pubKey []byte) error {
+	if len(pubKey) != 32 || !m.blocklist.unblockPubKey([32]byte(pubKey)) {
+		return fmt.Errorf("%w: sender %x", ErrNotBlocked, pubKey)
+	}
+
+	log.Infof("Unblocked sender %x", pubKey)
+	return m.blocklist.save()
+}
+
+// BlockOutpoint stops storing and relaying the messages for outpoint and
+// purges the one already stored.
+func (m *Manager) BlockOutpoint(ctx context.Context,
+	outpoint message.Outpoint) error {
+
+	if !m.blocklist.blockOutpoint(outpoint) {
+		return nil
+	}
+	if err := m.blocklist.save(); err != nil {
+		log.Warnf("Failed to save blocklist: %v", err)
+	}
+
+	if err := m.purgeBlocked(ctx, []message.Outpoint{outpoint}); err != nil {
+		return err
+	}
+
+	log.Infof("Blocked outpoint %s", outpoint.ToString())
+	return nil
+}
+
+// UnblockOutpoint stores and relays the messages for outpoint again.
+func (m *Manager) UnblockOutpoint(outpoint message.Outpoint) error {
+	if !m.blocklist.unblockOutpoint(outpoint) {
+		return fmt.Errorf("%w: outpoint %s", ErrNotBlocked,
+			outpoint.ToString())
+	}
+
+	log.Infof("Unblocked outpoint %s", outpoint.ToString())
+	return m.blocklist.save()
+}
+
+// ListBlocked returns the blocked senders and outpoints.
+func (m *Manager) ListBlocked() *Blocklist {
+	return m.blocklist.list()
+}
+
+// purgeBlocked removes newly blocked outpoints along with their stored
+// messages, stops announcing the ones originated locally and tells
+// subscribers which messages were removed.
+func (m *Manager) purgeBlocked(ctx context.Context,
+	outpoints []message.Outpoint) error {
+
+	if len(outpoints) == 0 {
+		return nil
+	}
+	var stored []message.Outpoint
+	for _, outpoint := range outpoints {
+		meta, err := m.db.GetMessageMeta(ctx, outpoint)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		if meta != nil {
+			stored = append(stored, outpoint)
+		}
+	}
+	if err := m.db.RemoveOutpoints(ctx, outpoints); err != nil {
+		return fmt.Errorf("failed to purge blocked messages: %v", err)
+	}
+	m.msgCache.remove(outpoints...)
+	m.journal.remove(outpoints)
+	m.publishRemoved(stored, RemovalBlocked)
+	return nil
+}
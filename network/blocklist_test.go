@@ -0,0 +1,163 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// nextInv returns the outpoints of the next inv remote receives.
+func nextInv(t *testing.T, remote *testRemote) []message.Outpoint {
+	t.Helper()
+
+	frame, ok := remote.next(MessageTypeInv)
+	if !ok {
+		t.Fatal("no inv received")
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil {
+		t.Fatalf("readInvPayload: %v", err)
+	}
+	return outpoints
+}
+
+// TestBlockPubKey checks that blocking a sender purges its stored messages,
+// that its new messages are acked but neither stored, served nor announced,
+// and that they are accepted again once it is unblocked. The blocklist is
+// kept in the data directory.
+func TestBlockPubKey(t *testing.T) {
+	const blocked, other = 8, 9
+
+	ctx := context.Background()
+	cfg := testNodeConfig()
+	cfg.DataDir = t.TempDir()
+	node := startTestNode(t, cfg)
+	relay, watcher := dialTestNode(t, node), dialTestNode(t, node)
+
+	// relayFrom relays a message for the outpoint numbered i signed by the
+	// key of seed, and waits for its ack
+	relayFrom := func(seed, i byte) message.Outpoint {
+		t.Helper()
+
+		outpoint := message.NewOutpoint([32]byte{i}, 0)
+		msg := signSeedMessage(t, node.client, seed, outpoint, "hello")
+		relay.send(MessageTypeData, msg.Serialize())
+		frame, ok := relay.next(MessageTypeAck, MessageTypeReject)
+		if !ok || frame.msgType != MessageTypeAck {
+			t.Fatalf("message %d not acked", i)
+		}
+		return outpoint
+	}
+	stored := func(outpoint message.Outpoint) bool {
+		t.Helper()
+
+		data, err := node.db.GetMessage(ctx, outpoint)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		return data != nil
+	}
+
+	before := relayFrom(blocked, 1)
+	nextInv(t, watcher)
+	_, pkScript := testSender(t, blocked)
+	if err := node.BlockPubKey(ctx, pkScript[2:]); err != nil {
+		t.Fatalf("BlockPubKey: %v", err)
+	}
+	if stored(before) {
+		t.Fatal("message of the blocked sender not purged")
+	}
+
+	// A blocked message is acked, then only the next one is announced
+	dropped := relayFrom(blocked, 2)
+	allowed := relayFrom(other, 3)
+	if stored(dropped) || !stored(allowed) {
+		t.Fatal("blocked message stored or the other one not")
+	}
+	if inv := nextInv(t, watcher); len(inv) != 1 || inv[0] != allowed {
+		t.Fatalf("announced %v, want only %s", inv, allowed.ToString())
+	}
+	if n := node.Stats().MessagesBlocked; n != 1 {
+		t.Fatalf("%d messages blocked, want 1", n)
+	}
+
+	// Nor is it served
+	watcher.send(MessageTypeGetData, dropped[:])
+	watcher.send(MessageTypeGetData, allowed[:])
+	frame, ok := watcher.next(MessageTypeData)
+	if msg, err := message.Deserialize(frame.payload); !ok || err != nil ||
+		msg.Outpoint != allowed {
+
+		t.Fatalf("served %x, want only the allowed message", frame.payload)
+	}
+
+	// The blocklist survives a restart
+	saved := newBlocklist(cfg.DataDir)
+	if err := saved.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !saved.isBlocked(dropped, pkScript[2:]) {
+		t.Fatalf("sender not saved to %s", blocklistFileName)
+	}
+
+	if err := node.UnblockPubKey(pkScript[2:]); err != nil {
+		t.Fatalf("UnblockPubKey: %v", err)
+	}
+	after := relayFrom(blocked, 4)
+	if !stored(after) {
+		t.Fatal("message of the unblocked sender not stored")
+	}
+	if inv := nextInv(t, watcher); len(inv) != 1 || inv[0] != after {
+		t.Fatalf("announced %v, want %s", inv, after.ToString())
+	}
+	err := node.UnblockPubKey(pkScript[2:])
+	if !errors.Is(err, ErrNotBlocked) {
+		t.Fatalf("unblocking again gave %v, want ErrNotBlocked", err)
+	}
+}
+
+// TestBlockOutpoint checks that blocking an outpoint purges its message and
+// refuses it locally, while the other outpoints of the sender are kept.
+func TestBlockOutpoint(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+
+	var outpoints []message.Outpoint
+	for i := byte(1); i <= 2; i++ {
+		outpoint := message.NewOutpoint([32]byte{i}, 0)
+		msg := signTestMessage(t, node.client, outpoint, "hello")
+		if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+		outpoints = append(outpoints, outpoint)
+	}
+
+	if err := node.BlockOutpoint(ctx, outpoints[0]); err != nil {
+		t.Fatalf("BlockOutpoint: %v", err)
+	}
+	for i, outpoint := range outpoints {
+		data, err := node.db.GetMessage(ctx, outpoint)
+		if err != nil || (data != nil) != (i == 1) {
+			t.Fatalf("outpoint %d stored: %v, %v", i, data != nil, err)
+		}
+	}
+
+	msg := signTestMessage(t, node.client, outpoints[0], "again")
+	if _, err := node.SubmitMessage(ctx, msg.Serialize()); !errors.Is(err,
+		ErrBlocked) {
+
+		t.Fatalf("blocked outpoint submitted: %v", err)
+	}
+	if list := node.ListBlocked(); len(list.Outpoints) != 1 ||
+		list.Outpoints[0] != outpoints[0].ToString() {
+
+		t.Fatalf("listed %+v", list)
+	}
+}
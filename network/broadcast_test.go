@@ -0,0 +1,197 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// recordConn is a connection keeping what is written to it instead of
+// sending it, or discarding it if discard is set.
+type recordConn struct {
+	net.Conn
+	discard bool
+	written bytes.Buffer
+}
+
+// Write implements net.Conn.
+func (c *recordConn) Write(b []byte) (int, error) {
+	if c.discard {
+		return len(b), nil
+	}
+	return c.written.Write(b)
+}
+
+// newBroadcastPeers adds n peers to m, half of them exchanging frames with
+// a checksum, whose writers aren't running. Their connections record what
+// writeQueued writes to them, unless discard is set.
+func newBroadcastPeers(tb testing.TB, m *Manager, n int,
+	discard bool) ([]*Peer, []*recordConn) {
+
+	tb.Helper()
+
+	peers := make([]*Peer, n)
+	conns := make([]*recordConn, n)
+	for i := range peers {
+		conn, remote := net.Pipe()
+		tb.Cleanup(func() {
+			conn.Close()
+			remote.Close()
+		})
+		p := NewPeer(context.Background(), conn, m)
+		p.addr = fmt.Sprintf("10.0.0.%d:8335", i+1)
+		p.checksum = i%2 == 0
+		conns[i] = &recordConn{Conn: conn, discard: discard}
+		p.conn = conns[i]
+
+		m.peersMu.Lock()
+		m.peers[p.addr] = p
+		m.peersMu.Unlock()
+		peers[i] = p
+	}
+	return peers, conns
+}
+
+// writeQueuedFrames writes the frames queued for each peer to its
+// connection, returning the number written.
+func writeQueuedFrames(tb testing.TB, peers []*Peer) int {
+	tb.Helper()
+
+	var written int
+	for _, p := range peers {
+		for len(p.sendQueue) > 0 {
+			if err := p.writeQueued(<-p.sendQueue); err != nil {
+				tb.Fatalf("writeQueued: %v", err)
+			}
+			written++
+		}
+	}
+	return written
+}
+
+// TestBroadcastIdentical checks that every peer is written the same bytes
+// for an announcement and a relayed replacement, those of writeFrame with or
+// without a checksum, from a single frame shared with the message cache, and
+// that the source peer is written nothing.
+func TestBroadcastIdentical(t *testing.T) {
+	const count = 8
+
+	m, client, _ := newTestManager(t)
+	peers, conns := newBroadcastPeers(t, m, count, false)
+	source := peers[0]
+
+	msg := signTestMessage(t, client, inventoryOutpoint(1), "shared")
+	replacement := *msg
+	replacement.Sequence = 1
+	msgData := replacement.Serialize()
+	m.msgCache.put(msg.Outpoint, msgData)
+	cached, err := m.getDataFrame(context.Background(), msg.Outpoint)
+	if err != nil || cached == nil {
+		t.Fatalf("getDataFrame: %v", err)
+	}
+
+	meta := &database.MessageMeta{}
+	m.broadcastToOtherPeers(source, msg, msg.Serialize(), meta)
+	m.broadcastToOtherPeers(source, &replacement, msgData, meta)
+	for _, p := range peers[1:] {
+		if len(p.sendQueue) != 2 {
+			t.Fatalf("%d frames queued for %s, want 2", len(p.sendQueue),
+				p.addr)
+		}
+		queue := []outboundFrame{<-p.sendQueue, <-p.sendQueue}
+		if queue[1].shared != cached {
+			t.Fatalf("%s not queued the cached frame", p.addr)
+		}
+		p.sendQueue <- queue[0]
+		p.sendQueue <- queue[1]
+	}
+	if n := writeQueuedFrames(t, peers); n != 2*(count-1) {
+		t.Fatalf("%d frames written, want %d", n, 2*(count-1))
+	}
+
+	for i, conn := range conns {
+		var want bytes.Buffer
+		if i > 0 {
+			checksum := peers[i].checksum
+			inv := newInvPayload(msg.Outpoint)
+			if err := writeFrame(&want, MessageTypeInv, inv,
+				checksum); err != nil {
+
+				t.Fatal(err)
+			}
+			if err := writeFrame(&want, MessageTypeData, msgData,
+				checksum); err != nil {
+
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(conn.written.Bytes(), want.Bytes()) {
+			t.Fatalf("peer %d written %x, want %x", i,
+				conn.written.Bytes(), want.Bytes())
+		}
+	}
+	if !bytes.Equal(conns[1].written.Bytes(), conns[3].written.Bytes()) ||
+		!bytes.Equal(conns[2].written.Bytes(), conns[4].written.Bytes()) {
+
+		t.Fatal("peers written different bytes")
+	}
+	if !bytes.Equal(cached.payload(), msgData) {
+		t.Fatal("shared frame modified by the writes")
+	}
+}
+
+// BenchmarkBroadcast relays a replacement message with a payload of the
+// largest size to 32 peers and writes the frames queued for them, from a
+// frame serialized once and shared, and from the message serialized for
+// each peer as before.
+func BenchmarkBroadcast(b *testing.B) {
+	const count = 32
+
+	m, _, _ := newTestManager(b)
+	peers, _ := newBroadcastPeers(b, m, count, true)
+	msg := &message.Message{
+		Outpoint:    inventoryOutpoint(1),
+		ContentType: message.ContentTypeBinary,
+		Length:      message.MaxPayloadSize,
+		Payload:     make([]byte, message.MaxPayloadSize),
+	}
+	msgData := msg.Serialize()
+	meta := &database.MessageMeta{}
+
+	// Every run relays a new replacement, which the peers don't know yet
+	b.Run("shared", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(msgData)))
+		for i := 0; i < b.N; i++ {
+			msg.Sequence++
+			m.broadcastToOtherPeers(nil, msg, msgData, meta)
+			if n := writeQueuedFrames(b, peers); n != count {
+				b.Fatalf("%d frames written", n)
+			}
+		}
+	})
+	b.Run("per-peer", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(msgData)))
+		for i := 0; i < b.N; i++ {
+			for _, p := range peers {
+				err := p.SendMessage(MessageTypeData, msgData)
+				if err != nil {
+					b.Fatalf("SendMessage: %v", err)
+				}
+			}
+			if n := writeQueuedFrames(b, peers); n != count {
+				b.Fatalf("%d frames written", n)
+			}
+		}
+	})
+}
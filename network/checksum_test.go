@@ -0,0 +1,105 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// sendCorrupted writes a data frame for msgData whose last payload byte
+// changed after the checksum was computed.
+func (r *testRemote) sendCorrupted(msgData []byte) {
+	r.t.Helper()
+
+	var frame bytes.Buffer
+	if err := writeFrame(&frame, MessageTypeData, msgData,
+		r.checksum); err != nil {
+
+		r.t.Fatalf("writeFrame: %v", err)
+	}
+	data := frame.Bytes()
+	data[len(data)-1] ^= 0x01
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.conn.Write(data); err != nil {
+		r.t.Fatalf("Write: %v", err)
+	}
+}
+
+// TestChecksumCorrupted checks that a data frame corrupted in transit is
+// dropped before its message is validated once checksums are negotiated,
+// while without them it reaches the validator, and that a peer sending
+// corrupted frames repeatedly is disconnected.
+func TestChecksumCorrupted(t *testing.T) {
+	ctx := context.Background()
+
+	for _, services := range []ServiceFlag{SFChecksum, 0} {
+		node := startTestNode(t, testNodeConfig())
+		remote := dialTestNodeServices(t, node, services)
+
+		// storeValid relays a valid message and waits until it is stored.
+		// Frames are handled in order, so a corrupted message sent before
+		// reached the validator by then, if at all.
+		storeValid := func(n byte) {
+			t.Helper()
+
+			outpoint := message.NewOutpoint([32]byte{n}, 0)
+			remote.send(MessageTypeData, signTestMessage(t, node.client,
+				outpoint, "hello").Serialize())
+			waitFor(t, "valid message stored", func() bool {
+				stored, _ := node.db.HasOutpoint(ctx, outpoint)
+				return stored
+			})
+		}
+
+		// The UTXO lookups of one message
+		storeValid(1)
+		perMessage := node.client.Calls(mock.MethodGetTxOut)
+
+		corrupted := message.NewOutpoint([32]byte{2}, 0)
+		remote.sendCorrupted(signTestMessage(t, node.client, corrupted,
+			"hello").Serialize())
+
+		// Without checksums the corrupted message fails its signature,
+		// which gets the peer disconnected
+		if services == 0 {
+			waitFor(t, "corrupted message rejected", func() bool {
+				return node.Stats().MessagesRejected == 1
+			})
+			if lookups := node.client.Calls(mock.MethodGetTxOut); lookups ==
+				perMessage {
+
+				t.Fatal("corrupted message rejected without validation")
+			}
+			continue
+		}
+
+		storeValid(3)
+		stored, _ := node.db.HasOutpoint(ctx, corrupted)
+		lookups := node.client.Calls(mock.MethodGetTxOut) - 2*perMessage
+		if stored || lookups != 0 || node.Stats().MessagesRejected != 0 {
+			t.Fatalf("corrupted frame validated: stored %v, %d UTXO "+
+				"lookups, %d rejected", stored, lookups,
+				node.Stats().MessagesRejected)
+		}
+
+		for i := 0; i < DefaultMaxChecksumFailures; i++ {
+			remote.sendCorrupted(signTestMessage(t, node.client,
+				corrupted, "hello").Serialize())
+		}
+		if !remote.disconnected() {
+			t.Fatalf("peer not disconnected after %d corrupted frames",
+				DefaultMaxChecksumFailures+1)
+		}
+	}
+}
@@ -4,23 +4,420 @@
 
 package network
 
+import "runtime"
+
 // Config defines the network configuration for UTXOchat.
 type Config struct {
 	// ListenAddr is the address to listen on for incoming connections.
 	ListenAddr string
 
+	// ExternalPort is the port announced to peers as the one this node
+	// accepts connections on, for nodes behind a port forward. Zero
+	// announces the port of ListenAddr. With DisableAdvertise the node
+	// announces that it doesn't accept connections, so peers neither
+	// probe nor gossip its address.
+	ExternalPort     int
+	DisableAdvertise bool
+
 	// Known peers to connect to on startup.
 	KnownPeers []string
 
+	// DisconnectRemovedPeers disconnects the outbound peers removed from
+	// KnownPeers when the configuration is reloaded. Otherwise they are
+	// only no longer dialed.
+	DisconnectRemovedPeers bool
+
+	// Chain is the Bitcoin chain the node serves, such as "mainnet" or
+	// "regtest". Peers announcing a different chain in the handshake are
+	// disconnected. Empty accepts any chain.
+	Chain string
+
+	// UserAgent names the software of this node to peers in the
+	// handshake, at most 255 bytes. Empty selects DefaultUserAgent.
+	UserAgent string
+
 	// HandshakeTimeout is the timeout for peer handshake in seconds.
 	HandshakeTimeout int
+
+	// DialTimeout is the time in seconds an outbound connection may take
+	// to be established.
+	DialTimeout int
+
+	// ReadTimeout is the time in seconds a frame may take to arrive once
+	// its first byte was received, and WriteTimeout the time a frame may
+	// take to be written. A peer missing either is disconnected.
+	ReadTimeout  int
+	WriteTimeout int
+
+	// ShutdownTimeout is the time in seconds Stop waits for peers to
+	// disconnect before closing their connections and returning.
+	ShutdownTimeout int
+
+	// MaxFrameSize is the largest frame payload in bytes accepted from a
+	// peer. Zero selects DefaultMaxFrameSize.
+	MaxFrameSize uint32
+
+	// DataRateLimit is the sustained number of data messages per second
+	// accepted from a single peer.
+	DataRateLimit float64
+
+	// DataRateBurst is the number of data messages a peer may send in a
+	// burst before DataRateLimit applies.
+	DataRateBurst int
+
+	// InvRateLimit is the sustained number of inv and getdata messages per
+	// second accepted from a single peer.
+	InvRateLimit float64
+
+	// InvRateBurst is the number of inv and getdata messages a peer may send
+	// in a burst before InvRateLimit applies.
+	InvRateBurst int
+
+	// MaxRateViolations is the number of throttled messages tolerated from a
+	// peer before it is disconnected.
+	MaxRateViolations int
+
+	// MaxChecksumFailures is the number of frames failing their checksum
+	// tolerated from a peer before it is disconnected.
+	MaxChecksumFailures int
+
+	// MaxUnknownFrames is the number of frames of unknown types tolerated
+	// in a row from a peer on a later protocol version before it is
+	// disconnected.
+	MaxUnknownFrames int
+
+	// ThrottleCooldown is the time in seconds during which a peer that was
+	// disconnected for exceeding its rate limit will not be dialed again.
+	ThrottleCooldown int
+
+	// DataDir is the directory in which known peer addresses are persisted.
+	// If empty, addresses are only kept in memory.
+	DataDir string
+
+	// TargetOutbound is the number of outbound peers the node tries to stay
+	// connected to.
+	TargetOutbound int
+
+	// MaxInboundPeers is the maximum number of inbound connections. When
+	// all are taken, a long idle inbound peer is evicted for a new one or
+	// the new connection is closed.
+	MaxInboundPeers int
+
+	// MaxOutboundPeers is the maximum number of outbound connections. It
+	// caps TargetOutbound.
+	MaxOutboundPeers int
+
+	// MaxAddrFailures is the number of consecutive failed dials after which
+	// an address is considered bad.
+	MaxAddrFailures int
+
+	// BadAddrCooldown is the time in seconds a bad address is not retried.
+	BadAddrCooldown int
+
+	// BanThreshold is the misbehavior score at which a peer is banned.
+	BanThreshold int
+
+	// BanDuration is the time in seconds a misbehaving peer stays banned.
+	BanDuration int
+
+	// MalformedScore is the misbehavior score added for a malformed frame
+	// or message. Zero selects the default of this and the scores below, a
+	// negative score stops scoring that misbehavior.
+	MalformedScore int
+
+	// InvalidSignatureScore is the misbehavior score added for a message
+	// with an invalid signature.
+	InvalidSignatureScore int
+
+	// UnknownTypeScore is the misbehavior score added for a frame with an
+	// unknown message type.
+	UnknownTypeScore int
+
+	// LowValueScore is the misbehavior score added for a message backed by
+	// a UTXO worth less than the minimum value.
+	LowValueScore int
+
+	// DuplicatePayloadScore is the misbehavior score added for a message
+	// suppressed by MaxDuplicatePayloads. It doesn't cost the connection.
+	DuplicatePayloadScore int
+
+	// DuplicateMessageScore is the misbehavior score added for every ten
+	// data messages a peer sends that are known already. They are skipped
+	// without being validated and don't cost the connection.
+	DuplicateMessageScore int
+
+	// DisableInventoryServe stops the node from answering getinv requests
+	// with its full inventory, for resource constrained nodes.
+	DisableInventoryServe bool
+
+	// MaxInventoryServe is the maximum number of outpoints announced in
+	// response to a single getinv request.
+	MaxInventoryServe int
+
+	// MaxRetryQueue is the maximum number of messages held for another
+	// validation attempt while the Bitcoin node is unreachable. Held
+	// messages are spooled in DataDir to survive a restart.
+	MaxRetryQueue int
+
+	// RetryTTL is the time in seconds a held message waits for the Bitcoin
+	// node to come back before it is dropped.
+	RetryTTL int
+
+	// ValidationWorkers is the number of data messages from peers
+	// validated at the same time. Zero selects one per CPU.
+	ValidationWorkers int
+
+	// MaxPeerValidations is the number of data messages from a single peer
+	// that may wait for or be in validation. Reading from the peer pauses
+	// beyond it, so one peer can't take over the validation workers. Zero
+	// selects DefaultMaxPeerValidations.
+	MaxPeerValidations int
+
+	// BlockedPubKeys and BlockedOutpoints are the hex encoded x-only
+	// taproot output keys and the txid:vout outpoints whose messages this
+	// node validates but doesn't store or relay. They are added to the
+	// blocklist persisted in DataDir, which can also be changed at runtime.
+	BlockedPubKeys   []string
+	BlockedOutpoints []string
+
+	// Whitelist restricts the node to messages whose outpoint is in
+	// WhitelistedOutpoints or whose sender, a hex encoded x-only taproot
+	// output key, is in WhitelistedPubKeys, for private deployments. The
+	// list can be replaced at runtime, and is then persisted in DataDir
+	// in place of the configured one.
+	Whitelist            bool
+	WhitelistedPubKeys   []string
+	WhitelistedOutpoints []string
+
+	// AnnounceAcks is the number of peers that must acknowledge a message
+	// originated by this node before it stops being announced to every
+	// peer that connects. Zero selects DefaultAnnounceAcks.
+	AnnounceAcks int
+
+	// MaxPeerUploadPerHour is the number of bytes that may be sent to a
+	// single peer per hour. Once reached, its getdata requests are
+	// answered with a busy reject. MaxUploadPerHour is the same cap over
+	// all peers, after which the node stops serving getdata while still
+	// validating and storing what it receives. Zero means unlimited.
+	MaxPeerUploadPerHour uint64
+	MaxUploadPerHour     uint64
+
+	// RelayFilterPubKeys and RelayFilterChannels are the senders, hex
+	// encoded x-only taproot output keys, and the channels of the
+	// structured payload this node wants to be relayed. If any are set,
+	// outbound peers supporting relay filters are asked to only relay
+	// their messages, for lightweight clients. At most 1000 entries.
+	RelayFilterPubKeys  []string
+	RelayFilterChannels []string
+
+	// Privacy is the origin privacy mode, PrivacyNone, PrivacyDelay or
+	// PrivacyDiffusion, hiding from the first peers to learn about a
+	// message that this node authored it. Empty selects PrivacyNone.
+	// PrivacyMinDelay and PrivacyMaxDelay bound in seconds the random
+	// delay before each announcement step. Zero selects their defaults.
+	Privacy         string
+	PrivacyMinDelay int
+	PrivacyMaxDelay int
+
+	// MessageCacheSize is the number of bytes of recently stored and
+	// served messages kept in memory to answer getdata requests. Zero
+	// selects DefaultMessageCacheSize, a negative size disables the cache.
+	MessageCacheSize int64
+
+	// MaxTipLag is the number of blocks a peer's chain tip may be behind
+	// ours before the peer is reported as lagging. Lagging peers are kept,
+	// but with DeprioritizeLagging messages they announced are requested
+	// from them only after the other peers that announced them. Zero
+	// selects DefaultMaxTipLag.
+	MaxTipLag           int
+	DeprioritizeLagging bool
+
+	// MaxReplyDepth is the number of messages fetched from peers along a
+	// chain of replies whose parents aren't known locally. Zero selects
+	// DefaultMaxReplyDepth, a negative depth disables fetching parents.
+	MaxReplyDepth int
+
+	// RejectJournalSize is the number of bytes the reject journal, a
+	// record of the recently rejected messages persisted in DataDir, may
+	// take. Zero selects DefaultRejectJournalSize, a negative size
+	// disables the journal.
+	RejectJournalSize int
+
+	// RejectJournalPayloads records the first 256 bytes of the payload of
+	// rejected messages in the reject journal.
+	RejectJournalPayloads bool
+
+	// MaxDuplicatePayloads is the number of messages with the same payload
+	// stored, zero for no limit. Further messages with the payload are
+	// validated and counted, but neither stored nor relayed.
+	MaxDuplicatePayloads int
+
+	// Identity enables the node identity, a key stored in DataDir on first
+	// start that the node proves it holds in every handshake, so peers
+	// recognize it across changing addresses.
+	Identity bool
+
+	// AllowedPeerKeys are the hex encoded identity keys of the only peers
+	// connections are kept with, in either direction. Peers without an
+	// identity or with another one are sent a reject and disconnected
+	// after the handshake. Setting it enables Identity. Empty allows
+	// every peer.
+	AllowedPeerKeys []string
+
+	// TrustedPeers are the addresses, host:port or a host for any port,
+	// and TrustedPeerKeys the hex encoded identity keys of peers exempt
+	// from rate limits, upload caps and misbehavior scoring, such as the
+	// other nodes of the same operator. Their messages are still
+	// validated. They are added to the trusted peers persisted in
+	// DataDir, which can also be changed at runtime.
+	TrustedPeers    []string
+	TrustedPeerKeys []string
 }
 
+// Default rate limiting settings.
+const (
+	DefaultDataRateLimit     = 10
+	DefaultDataRateBurst     = 50
+	DefaultInvRateLimit      = 50
+	DefaultInvRateBurst      = 200
+	DefaultMaxRateViolations = 50
+	DefaultThrottleCooldown  = 600
+)
+
+// DefaultHandshakeTimeout is the default time in seconds a peer has to
+// complete the version handshake.
+const DefaultHandshakeTimeout = 60
+
+// DefaultDialTimeout is the default time in seconds an outbound connection
+// may take to be established.
+const DefaultDialTimeout = 10
+
+// DefaultReadTimeout and DefaultWriteTimeout are the default times in seconds
+// a frame may take to be read and written.
+const (
+	DefaultReadTimeout  = 60
+	DefaultWriteTimeout = 30
+)
+
+// DefaultShutdownTimeout is the default time in seconds Stop waits for peers
+// to disconnect.
+const DefaultShutdownTimeout = 10
+
+// DefaultMaxChecksumFailures is the default number of corrupted frames
+// tolerated from a peer.
+const DefaultMaxChecksumFailures = 3
+
+// DefaultMaxUnknownFrames is the default number of frames of unknown types
+// tolerated in a row from a peer.
+const DefaultMaxUnknownFrames = 16
+
+// Default address manager settings.
+const (
+	DefaultTargetOutbound  = 8
+	DefaultMaxAddrFailures = 5
+	DefaultBadAddrCooldown = 3600
+)
+
+// Default connection limits.
+const (
+	DefaultMaxInboundPeers  = 64
+	DefaultMaxOutboundPeers = 8
+)
+
+// Default misbehavior scoring settings.
+const (
+	DefaultBanThreshold          = 100
+	DefaultBanDuration           = 24 * 60 * 60
+	DefaultMalformedScore        = 34
+	DefaultInvalidSignatureScore = 50
+	DefaultUnknownTypeScore      = 20
+	DefaultLowValueScore         = 10
+	DefaultDuplicatePayloadScore = 1
+	DefaultDuplicateMessageScore = 1
+)
+
+// DefaultMaxInventoryServe is the default maximum number of outpoints served
+// per getinv request.
+const DefaultMaxInventoryServe = 10000
+
+// Default settings for messages held while the Bitcoin node is unreachable.
+const (
+	DefaultMaxRetryQueue = 1000
+	DefaultRetryTTL      = 600
+)
+
+// DefaultMaxPeerValidations is the default number of data messages from a
+// peer in validation at once.
+const DefaultMaxPeerValidations = 16
+
+// DefaultUserAgent is the default user agent announced to peers.
+const DefaultUserAgent = "/utxochat/"
+
+// DefaultMessageCacheSize is the default number of bytes of messages cached
+// for getdata requests.
+const DefaultMessageCacheSize = 16 << 20
+
+// DefaultMaxTipLag is the default number of blocks a peer may be behind our
+// chain tip before it is reported as lagging.
+const DefaultMaxTipLag = 3
+
+// DefaultMaxReplyDepth is the default number of parents fetched along a
+// chain of replies.
+const DefaultMaxReplyDepth = 10
+
+// DefaultRejectJournalSize is the default number of bytes the reject journal
+// may take.
+const DefaultRejectJournalSize = 1 << 20
+
+// DefaultAnnounceAcks is the default number of peers that must acknowledge a
+// locally originated message.
+const DefaultAnnounceAcks = 1
+
 // NewDefaultConfig returns a default network configuration.
 func NewDefaultConfig() Config {
 	return Config{
-		ListenAddr:       "0.0.0.0:8335",
-		KnownPeers:       []string{},
-		HandshakeTimeout: 60,
+		ListenAddr:            "0.0.0.0:8335",
+		KnownPeers:            []string{},
+		UserAgent:             DefaultUserAgent,
+		HandshakeTimeout:      DefaultHandshakeTimeout,
+		DialTimeout:           DefaultDialTimeout,
+		ReadTimeout:           DefaultReadTimeout,
+		WriteTimeout:          DefaultWriteTimeout,
+		ShutdownTimeout:       DefaultShutdownTimeout,
+		MaxFrameSize:          DefaultMaxFrameSize,
+		DataRateLimit:         DefaultDataRateLimit,
+		DataRateBurst:         DefaultDataRateBurst,
+		InvRateLimit:          DefaultInvRateLimit,
+		InvRateBurst:          DefaultInvRateBurst,
+		MaxRateViolations:     DefaultMaxRateViolations,
+		MaxChecksumFailures:   DefaultMaxChecksumFailures,
+		MaxUnknownFrames:      DefaultMaxUnknownFrames,
+		ThrottleCooldown:      DefaultThrottleCooldown,
+		TargetOutbound:        DefaultTargetOutbound,
+		MaxInboundPeers:       DefaultMaxInboundPeers,
+		MaxOutboundPeers:      DefaultMaxOutboundPeers,
+		MaxAddrFailures:       DefaultMaxAddrFailures,
+		BadAddrCooldown:       DefaultBadAddrCooldown,
+		BanThreshold:          DefaultBanThreshold,
+		BanDuration:           DefaultBanDuration,
+		MalformedScore:        DefaultMalformedScore,
+		InvalidSignatureScore: DefaultInvalidSignatureScore,
+		UnknownTypeScore:      DefaultUnknownTypeScore,
+		LowValueScore:         DefaultLowValueScore,
+		DuplicatePayloadScore: DefaultDuplicatePayloadScore,
+		DuplicateMessageScore: DefaultDuplicateMessageScore,
+		MaxInventoryServe:     DefaultMaxInventoryServe,
+		MaxRetryQueue:         DefaultMaxRetryQueue,
+		RetryTTL:              DefaultRetryTTL,
+		ValidationWorkers:     runtime.NumCPU(),
+		MaxPeerValidations:    DefaultMaxPeerValidations,
+		AnnounceAcks:          DefaultAnnounceAcks,
+		Privacy:               PrivacyNone,
+		PrivacyMinDelay:       DefaultPrivacyMinDelay,
+		PrivacyMaxDelay:       DefaultPrivacyMaxDelay,
+		MessageCacheSize:      DefaultMessageCacheSize,
+		MaxTipLag:             DefaultMaxTipLag,
+		MaxReplyDepth:         DefaultMaxReplyDepth,
+		RejectJournalSize:     DefaultRejectJournalSize,
 	}
 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package network
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blackholeAddr returns the address of a listener that never accepts, whose
+// backlog is filled so that further connection attempts get no answer.
+func blackholeAddr(t *testing.T) string {
+	t.Helper()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socket: %v", err)
+	}
+	file := os.NewFile(uintptr(fd), "blackhole")
+	defer file.Close()
+	err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	listener, err := net.FileListener(file)
+	if err != nil {
+		t.Fatalf("FileListener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	addr := listener.Addr().String()
+
+	// Connect until an attempt times out, which shows the backlog is full
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 16 {
+			t.Skip("connection backlog can't be filled")
+		}
+	}
+	return addr
+}
+
+// failedDials returns the number of failed connection attempts to addr.
+func failedDials(node *testNode, addr string) int {
+	node.addrManager.mu.Lock()
+	defer node.addrManager.mu.Unlock()
+
+	return node.addrManager.lookup(addr).Attempts
+}
+
+// TestDialBlackhole checks that known peers that never answer don't hold up
+// Start, nor a reachable known peer for longer than DialTimeout, that they
+// are given up on concurrently after DialTimeout, and that Stop doesn't wait
+// for their dials.
+func TestDialBlackhole(t *testing.T) {
+	reachable := startTestNode(t, testNodeConfig())
+	var known []string
+	for i := 0; i < 3; i++ {
+		known = append(known, blackholeAddr(t))
+	}
+	known = append(known, reachable.addr)
+
+	cfg := testNodeConfig(known...)
+	cfg.DialTimeout = 1
+	start := time.Now()
+	node := startTestNode(t, cfg)
+	if took := time.Since(start); took > time.Second/2 {
+		t.Fatalf("Start took %v with blackholed peers", took)
+	}
+
+	bound := time.Second + time.Second/2
+	for !node.isConnected(reachable.addr) {
+		if time.Since(start) > bound {
+			t.Fatalf("reachable peer not connected within %v", bound)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, addr := range known[:3] {
+		for failedDials(node, addr) == 0 {
+			if time.Since(start) > bound {
+				t.Fatalf("dial to %s not given up within %v", addr,
+					bound)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if node.isConnected(addr) {
+			t.Fatalf("connected to blackholed peer %s", addr)
+		}
+	}
+
+	if err := stopWithin(t, node, time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// ErrDuplicatePayload is returned for a valid message whose payload was
+// already stored for MaxDuplicatePayloads other outpoints, as is typical of
+// spam sent from many cheap UTXOs. The message is counted but not stored.
+var ErrDuplicatePayload = errors.New("duplicate payload")
+
+// payloadHash returns the SHA256 hash of the payload of msg, which messages
+// are indexed by in the database.
+func payloadHash(msg *message.Message) []byte {
+	hash := sha256.Sum256(msg.Payload)
+	return hash[:]
+}
+
+// duplicatePayload reports whether storing msg, whose payload hashes to hash,
+// would exceed MaxDuplicatePayloads. A replacement of a message with the same
+// payload doesn't add to the count.
+func (m *Manager) duplicatePayload(ctx context.Context, msg *message.Message,
+	hash []byte) (bool, error) {
+
+	if m.config.MaxDuplicatePayloads <= 0 {
+		return false, nil
+	}
+	count, err := m.db.CountPayload(ctx, [32]byte(hash))
+	if err != nil || count < m.config.MaxDuplicatePayloads {
+		return false, err
+	}
+	meta, err := m.db.GetMessageMeta(ctx, msg.Outpoint)
+	if err != nil {
+		return false, err
+	}
+	return meta == nil || !bytes.Equal(meta.PayloadHash, hash), nil
+}
+
+// suppressPayload counts a valid message that isn't stored because its
+// payload was seen too often. The peer that relayed it is scored, lightly
+// since it couldn't know the payload before we asked for it.
+func (m *Manager) suppressPayload(ctx context.Context, msg *message.Message,
+	hash []byte, source *Peer) error {
+
+	count, err := m.db.SuppressPayload(ctx, [32]byte(hash))
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	m.messagesSuppressed.Add(1)
+	log.Debugf("Suppressed message %s, payload %x seen %d times",
+		msg.Outpoint.ToString(), hash, count)
+	if source != nil {
+		m.addMisbehavior(source, MisbehaviorDuplicatePayload)
+	}
+	return fmt.Errorf("%w: %x seen %d times", ErrDuplicatePayload, hash,
+		count)
+}
+
+// TopPayloads returns up to limit payloads seen more than once, most seen
+// first, to spot campaigns sending the same payload from many outpoints.
+func (m *Manager) TopPayloads(ctx context.Context,
+	limit int) ([]database.PayloadCount, error) {
+
+	return m.db.TopPayloads(ctx, limit)
+}
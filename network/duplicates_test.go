@@ -0,0 +1,95 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestDuplicatePayload checks that with MaxDuplicatePayloads of 3, the same
+// payload relayed from 5 outpoints is stored and announced 3 times, while
+// the 4th and 5th messages are rejected and suppressed but counted, costing
+// the relaying peer its connection no more than its light score.
+func TestDuplicatePayload(t *testing.T) {
+	const relayed = 5
+
+	ctx := context.Background()
+	cfg := testNodeConfig()
+	cfg.MaxDuplicatePayloads = 3
+	node := startTestNode(t, cfg)
+	watcher := dialTestNode(t, node)
+	remote := dialTestNode(t, node)
+	waitFor(t, "peers connected", func() bool {
+		return len(node.Stats().Peers) == 2
+	})
+
+	var msgs []*message.Message
+	for i := 0; i < relayed; i++ {
+		msg := signTestMessage(t, node.client, inventoryOutpoint(i),
+			"buy now")
+		msgs = append(msgs, msg)
+		_, code, _ := response(t, remote, msg)
+		stored := i < cfg.MaxDuplicatePayloads
+		if stored && code != 0 {
+			t.Fatalf("message %d rejected with %s", i, code)
+		}
+		if !stored && code != RejectDuplicatePayload {
+			t.Fatalf("message %d got %s, want %s", i, code,
+				RejectDuplicatePayload)
+		}
+		data, err := node.db.GetMessage(ctx, msg.Outpoint)
+		if err != nil || (data != nil) != stored {
+			t.Fatalf("message %d stored: %v, %v", i, data != nil, err)
+		}
+	}
+
+	hash := [32]byte(payloadHash(msgs[0]))
+	count, err := node.db.CountPayload(ctx, hash)
+	if err != nil || count != relayed {
+		t.Fatalf("payload counted %d times, %v, want %d", count, err,
+			relayed)
+	}
+	if suppressed := node.Stats().MessagesSuppressed; suppressed != 2 {
+		t.Fatalf("%d messages suppressed, want 2", suppressed)
+	}
+	top, err := node.TopPayloads(ctx, 10)
+	if err != nil || len(top) != 1 || top[0].Hash != hash ||
+		top[0].Count != relayed ||
+		top[0].Stored != cfg.MaxDuplicatePayloads {
+
+		t.Fatalf("top payloads %+v, %v", top, err)
+	}
+
+	// A message announced after the duplicates shows the watcher was only
+	// announced the stored ones
+	other := signTestMessage(t, node.client, inventoryOutpoint(relayed),
+		"something else")
+	if _, code, _ := response(t, remote, other); code != 0 {
+		t.Fatalf("other payload rejected with %s", code)
+	}
+	want := []message.Outpoint{msgs[0].Outpoint, msgs[1].Outpoint,
+		msgs[2].Outpoint, other.Outpoint}
+	var announced []message.Outpoint
+	for len(announced) < len(want) {
+		announced = append(announced, nextInv(t, watcher)...)
+	}
+	if len(announced) != len(want) {
+		t.Fatalf("announced %d outpoints, want %d", len(announced),
+			len(want))
+	}
+	for i, outpoint := range announced {
+		if outpoint != want[i] {
+			t.Fatalf("announced %s, want %s", outpoint.ToString(),
+				want[i].ToString())
+		}
+	}
+
+	if len(node.Stats().Peers) != 2 {
+		t.Fatal("peer disconnected for relaying duplicates")
+	}
+}
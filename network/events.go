@@ -0,0 +1,345 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// subscriptionQueueSize is the number of events a subscription
+	// buffers before its oldest events are dropped.
+	subscriptionQueueSize = 256
+
+	// eventBacklogSize is the number of recent events kept for clients
+	// catching up after a reconnection.
+	eventBacklogSize = 256
+)
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	// EventMessageAdded reports a message that passed validation and was
+	// stored for an outpoint without one.
+	EventMessageAdded EventType = iota
+
+	// EventMessageReplaced reports a message that passed validation and
+	// was stored in place of the message of its outpoint, with
+	// RemovalReplaced as the reason.
+	EventMessageReplaced
+
+	// EventMessageRemoved reports an outpoint whose message was dropped,
+	// for the reason given with the event.
+	EventMessageRemoved
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventMessageAdded:
+		return "message_added"
+	case EventMessageReplaced:
+		return "message_replaced"
+	case EventMessageRemoved:
+		return "message_removed"
+	default:
+		return "unknown"
+	}
+}
+
+// RemovalReason tells why a message is no longer stored.
+type RemovalReason int
+
+const (
+	// RemovalNone is the reason of events that don't remove a message.
+	RemovalNone RemovalReason = iota
+
+	// RemovalSpent is given when the UTXO of the message was spent.
+	RemovalSpent
+
+	// RemovalReplaced is given when a message with a greater sequence
+	// number superseded it.
+	RemovalReplaced
+
+	// RemovalExpired is given when the expiry of its structured payload
+	// passed.
+	RemovalExpired
+
+	// RemovalEvicted is given when it was dropped to keep the database
+	// within its storage budget.
+	RemovalEvicted
+
+	// RemovalBlocked is given when its sender or outpoint was blocked.
+	RemovalBlocked
+
+	// RemovalInvalid is given when it failed to verify again during a
+	// revalidation.
+	RemovalInvalid
+)
+
+// String returns the name of the removal reason, empty for RemovalNone.
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalNone:
+		return ""
+	case RemovalSpent:
+		return "spent"
+	case RemovalReplaced:
+		return "replaced"
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	case RemovalBlocked:
+		return "blocked"
+	case RemovalInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change to the stored messages delivered to subscribers.
+type Event struct {
+	// ID numbers the events published since the manager started, from 1.
+	// Time is when the event was published.
+	ID   uint64
+	Time time.Time
+
+	Type     EventType
+	Outpoint message.Outpoint
+
+	// Reason tells why the previous message of the outpoint is gone, for
+	// EventMessageReplaced and EventMessageRemoved.
+	Reason RemovalReason
+
+	// Message and Meta describe the stored message of an
+	// EventMessageAdded or EventMessageReplaced.
+	Message *message.Message
+	Meta    database.MessageMeta
+}
+
+// Subscription receives the events published by the manager. Events are
+// buffered up to subscriptionQueueSize, beyond which the oldest are dropped
+// so that a slow subscriber never holds up validation.
+type Subscription struct {
+	bus *eventBus
+
+	// pubKey, if set, limits message events to those whose UTXO is
+	// controlled by this taproot output key.
+	pubKey []byte
+
+	events  chan Event
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Events returns the channel delivering the events. It is closed when the
+// subscription is closed, including when the manager stops.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the subscriber fell
+// behind.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the delivery of events. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+// matches reports whether ev passes the subscription's filter.
+func (s *Subscription) matches(ev *Event) bool {
+	return eventMatches(ev, s.pubKey)
+}
+
+// eventMatches reports whether ev passes a filter on the sender pubKey, nil
+// for any sender. Removal events always do, the sender of a dropped message
+// is no longer known.
+func eventMatches(ev *Event, pubKey []byte) bool {
+	if pubKey == nil || ev.Type == EventMessageRemoved {
+		return true
+	}
+	return bytes.Equal(pubKey, ev.Meta.PubKey)
+}
+
+// deliver queues ev, dropping the oldest queued event if the queue is full.
+// The caller must hold the bus lock, so deliver never races with itself.
+func (s *Subscription) deliver(ev Event) {
+	for {
+		select {
+		case s.events <- ev:
+			return
+		default:
+		}
+
+		select {
+		case <-s.events:
+			s.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// eventBus fans events out to the subscriptions and keeps the recent ones in
+// a ring buffer. It is safe for concurrent use.
+type eventBus struct {
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	// backlog holds the last eventBacklogSize events, the oldest at next
+	// once it is full. lastID is the ID of the last event published.
+	backlog []Event
+	next    int
+	lastID  uint64
+
+	mu sync.Mutex
+}
+
+// newEventBus creates an event bus without subscriptions.
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe adds a subscription with the given sender filter. A subscription
+// to a closed bus gets no events and its channel is closed right away.
+func (b *eventBus) subscribe(pubKey []byte) *Subscription {
+	sub := &Subscription{
+		bus:    b,
+		pubKey: pubKey,
+		events: make(chan Event, subscriptionQueueSize),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		sub.once.Do(func() { close(sub.events) })
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+// remove drops a subscription and closes its channel.
+func (b *eventBus) remove(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, sub)
+	sub.once.Do(func() { close(sub.events) })
+}
+
+// publish numbers ev, records it in the backlog and delivers it to every
+// subscription whose filter it passes.
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	ev.ID = b.lastID
+	ev.Time = time.Now()
+	if len(b.backlog) < eventBacklogSize {
+		b.backlog = append(b.backlog, ev)
+	} else {
+		b.backlog[b.next] = ev
+		b.next = (b.next + 1) % eventBacklogSize
+	}
+
+	for sub := range b.subs {
+		if sub.matches(&ev) {
+			sub.deliver(ev)
+		}
+	}
+}
+
+// recent returns up to limit of the events in the backlog published after
+// the event with ID after that pass the filter on pubKey, oldest first. The
+// last ones are returned if more match.
+func (b *eventBus) recent(after uint64, limit int, pubKey []byte) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var events []Event
+	for i := range b.backlog {
+		ev := &b.backlog[(b.next+i)%len(b.backlog)]
+		if ev.ID > after && eventMatches(ev, pubKey) {
+			events = append(events, *ev)
+		}
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// close closes every subscription and refuses new ones.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		sub.once.Do(func() { close(sub.events) })
+	}
+}
+
+// len returns the number of subscriptions.
+func (b *eventBus) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs)
+}
+
+// Subscribe returns a subscription to the messages added, replaced and removed
+// from now on. A non-nil pubKey limits the events of stored messages to those
+// whose UTXO is controlled by that x-only taproot output key. The
+// subscription must be closed once no longer needed.
+func (m *Manager) Subscribe(pubKey []byte) *Subscription {
+	return m.events.subscribe(pubKey)
+}
+
+// RecentEvents returns up to limit of the last eventBacklogSize events with
+// an ID greater than after, oldest first, so a client that reconnects can
+// catch up on the events it missed. Zero limits return every such event, and
+// pubKey filters them like Subscribe.
+func (m *Manager) RecentEvents(after uint64, limit int,
+	pubKey []byte) []Event {
+
+	return m.events.recent(after, limit, pubKey)
+}
+
+// publishRemoved publishes an EventMessageRemoved for each outpoint.
+func (m *Manager) publishRemoved(outpoints []message.Outpoint,
+	reason RemovalReason) {
+
+	for _, outpoint := range outpoints {
+		m.events.publish(Event{
+			Type:     EventMessageRemoved,
+			Outpoint: outpoint,
+			Reason:   reason,
+		})
+	}
+}
+
+// messagesEvicted is the evict handler of the database, publishing the
+// messages it dropped to stay within its storage budget.
+func (m *Manager) messagesEvicted(outpoints []message.Outpoint) {
+	m.publishRemoved(outpoints, RemovalEvicted)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// submitReplacement submits a message for outpoint with the given sequence
+// number and payload, signed by the key testSender returns for seed 7.
+func submitReplacement(t *testing.T, node *testNode,
+	outpoint message.Outpoint, sequence uint32,
+	contentType message.ContentType, payload []byte) {
+
+	t.Helper()
+
+	key, pkScript := testSender(t, 7)
+	node.client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	msg, err := signer.SignReplacement(key, outpoint, sequence, contentType,
+		payload)
+	if err != nil {
+		t.Fatalf("SignReplacement: %v", err)
+	}
+	if _, err := node.SubmitMessage(context.Background(),
+		msg.Serialize()); err != nil {
+
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+}
+
+// submitText submits a text message for outpoint.
+func submitText(t *testing.T, node *testNode, outpoint message.Outpoint) {
+	t.Helper()
+
+	submitReplacement(t, node, outpoint, 0, message.ContentTypeText,
+		[]byte("hello"))
+}
+
+// TestRemovalReasons checks that a subscriber is told why a message is gone
+// for each path that removes one: a block spending its UTXO, a replacement,
+// its expiry, the storage budget, the blocklist and a failed revalidation.
+func TestRemovalReasons(t *testing.T) {
+	ctx := context.Background()
+	outpoint := inventoryOutpoint(0)
+
+	tests := []struct {
+		reason   RemovalReason
+		evType   EventType
+		dbConfig database.Config
+		trigger  func(t *testing.T, node *testNode)
+	}{{
+		reason: RemovalSpent,
+		evType: EventMessageRemoved,
+		trigger: func(t *testing.T, node *testNode) {
+			submitText(t, node, outpoint)
+			err := node.db.RemoveOutpoints(ctx,
+				[]message.Outpoint{outpoint})
+			if err != nil {
+				t.Fatalf("RemoveOutpoints: %v", err)
+			}
+			node.AnnounceExpired([]message.Outpoint{outpoint})
+		},
+	}, {
+		reason: RemovalReplaced,
+		evType: EventMessageReplaced,
+		trigger: func(t *testing.T, node *testNode) {
+			submitText(t, node, outpoint)
+			submitReplacement(t, node, outpoint, 1,
+				message.ContentTypeText, []byte("edited"))
+		},
+	}, {
+		reason: RemovalExpired,
+		evType: EventMessageRemoved,
+		trigger: func(t *testing.T, node *testNode) {
+			expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+			payload, err := message.BuildPayload(&message.Payload{
+				Body:   "soon gone",
+				Expiry: expiry,
+			})
+			if err != nil {
+				t.Fatalf("BuildPayload: %v", err)
+			}
+			submitReplacement(t, node, outpoint, 0,
+				message.ContentTypeBinary, payload)
+			node.sweepExpired(ctx, expiry)
+		},
+	}, {
+		reason:   RemovalEvicted,
+		evType:   EventMessageRemoved,
+		dbConfig: database.Config{MaxMessages: 1},
+		trigger: func(t *testing.T, node *testNode) {
+			submitText(t, node, outpoint)
+			submitText(t, node, inventoryOutpoint(1))
+		},
+	}, {
+		reason: RemovalBlocked,
+		evType: EventMessageRemoved,
+		trigger: func(t *testing.T, node *testNode) {
+			submitText(t, node, outpoint)
+			if err := node.BlockOutpoint(ctx, outpoint); err != nil {
+				t.Fatalf("BlockOutpoint: %v", err)
+			}
+		},
+	}, {
+		reason: RemovalInvalid,
+		evType: EventMessageRemoved,
+		trigger: func(t *testing.T, node *testNode) {
+			submitText(t, node, outpoint)
+
+			// The memory database hands out the bytes it holds
+			data, err := node.db.GetMessage(ctx, outpoint)
+			if err != nil || data == nil {
+				t.Fatalf("GetMessage: %v", err)
+			}
+			data[len(data)-1] ^= 0x01
+			if _, err := node.Revalidate(ctx); err != nil {
+				t.Fatalf("Revalidate: %v", err)
+			}
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.reason.String(), func(t *testing.T) {
+			db := database.NewMemoryDBWithConfig(test.dbConfig)
+			node := startTestNodeWith(t, testNodeConfig(),
+				mock.NewClient(), db)
+			sub := node.Subscribe(nil)
+			defer sub.Close()
+
+			test.trigger(t, node)
+			timeout := time.After(5 * time.Second)
+			for {
+				var ev Event
+				select {
+				case ev = <-sub.Events():
+				case <-timeout:
+					t.Fatal("no removal event")
+				}
+				if ev.Type == EventMessageAdded {
+					if ev.Reason != RemovalNone {
+						t.Fatalf("added message with reason %s",
+							ev.Reason)
+					}
+					continue
+				}
+				if ev.Type != test.evType || ev.Reason != test.reason ||
+					ev.Outpoint != outpoint {
+
+					t.Fatalf("got %s event for %s with reason %s, "+
+						"want %s for %s", ev.Type,
+						ev.Outpoint.ToString(), ev.Reason, test.evType,
+						outpoint.ToString())
+				}
+				break
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"time"
+)
+
+// expirySweepInterval is how often messages whose structured payload expired
+// are dropped.
+const expirySweepInterval = 10 * time.Second
+
+// expiryLoop periodically drops the messages whose structured payload
+// expired.
+func (m *Manager) expiryLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case now := <-ticker.C:
+			m.sweepExpired(ctx, now)
+		}
+	}
+}
+
+// sweepExpired drops the messages whose structured payload expiry is not
+// after now and announces them to peers like messages whose UTXO was spent,
+// and to subscribers as expired. Their outpoints stay known, so the dropped
+// messages are not accepted again.
+func (m *Manager) sweepExpired(ctx context.Context, now time.Time) {
+	outpoints, err := m.db.ExpireMessages(ctx, now)
+	if err != nil {
+		log.Warnf("Failed to drop expired messages: %v", err)
+		return
+	}
+	if len(outpoints) == 0 {
+		return
+	}
+
+	log.Debugf("Dropped %d messages past their expiry", len(outpoints))
+	m.announceRemoved(outpoints, RemovalExpired)
+}
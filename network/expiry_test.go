@@ -0,0 +1,93 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// TestSweepExpired checks that a message expiring in a second is dropped by
+// the first sweep after that, that peers and subscribers are told, and that
+// its outpoint stays known.
+func TestSweepExpired(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	watcher := dialTestNode(t, node)
+	waitFor(t, "watcher connected", func() bool {
+		return len(node.Stats().Peers) == 1
+	})
+	sub := node.Subscribe(nil)
+	defer sub.Close()
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	key, pkScript := testSender(t, 7)
+	node.client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+	expiry := time.Now().Add(time.Second).Truncate(time.Second)
+	payload, err := message.BuildPayload(&message.Payload{
+		Body:   "away",
+		Expiry: expiry,
+	})
+	if err != nil {
+		t.Fatalf("BuildPayload: %v", err)
+	}
+	msg, err := signer.SignMessage(key, outpoint, message.ContentTypeBinary,
+		payload)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	// A sweep before the expiry keeps the message
+	node.sweepExpired(ctx, expiry.Add(-time.Millisecond))
+	if data, err := node.db.GetMessage(ctx, outpoint); err != nil ||
+		data == nil {
+
+		t.Fatalf("message dropped before its expiry: %v", err)
+	}
+
+	time.Sleep(time.Until(expiry))
+	node.sweepExpired(ctx, time.Now())
+	if data, err := node.db.GetMessage(ctx, outpoint); err != nil ||
+		data != nil {
+
+		t.Fatalf("expired message still stored: %v", err)
+	}
+	if ok, err := node.db.HasOutpoint(ctx, outpoint); err != nil || !ok {
+		t.Fatalf("outpoint of the expired message forgotten: %v", err)
+	}
+
+	frame, ok := watcher.next(MessageTypeExpire)
+	if !ok {
+		t.Fatal("expiry not announced")
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil || len(outpoints) != 1 || outpoints[0] != outpoint {
+		t.Fatalf("announced expired %v, %v", outpoints, err)
+	}
+	for ev := range sub.Events() {
+		if ev.Type != EventMessageRemoved {
+			continue
+		}
+		if ev.Outpoint != outpoint || ev.Reason != RemovalExpired {
+			t.Fatalf("got removal of %s for %s", ev.Outpoint.ToString(),
+				ev.Reason)
+		}
+		break
+	}
+
+	// The dropped message can't be replayed
+	_, err = node.SubmitMessage(ctx, msg.Serialize())
+	if err == nil {
+		t.Fatal("expired message accepted again")
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// frameHeaderSize is the size of a frame header: a 1-byte message type
+	// followed by a 4-byte little-endian payload length.
+	frameHeaderSize = 5
+
+	// checksumSize is the size of the payload checksum appended to the
+	// frame header once both peers negotiated checksums.
+	checksumSize = 4
+
+	// DefaultMaxFrameSize is the default maximum payload size accepted in a
+	// single frame. It leaves a small amount of room above the largest
+	// message for protocol overhead.
+	DefaultMaxFrameSize = message.MaxMessageSize + 1024
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame announces a payload larger
+	// than the configured maximum.
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+	// ErrBadChecksum is returned when the payload of a frame does not match
+	// the checksum in its header. The whole frame has been consumed, so
+	// the next frame can still be read.
+	ErrBadChecksum = errors.New("frame checksum mismatch")
+
+	// errTrailingPayload is returned when a payload goes on after the
+	// items it announces.
+	errTrailingPayload = errors.New("payload has trailing data")
+)
+
+// frameChecksum returns the first 4 bytes of the double SHA-256 of payload.
+func frameChecksum(payload []byte) []byte {
+	hash := chainhash.DoubleHashB(payload)
+	return hash[:checksumSize]
+}
+
+// headerSize returns the size of a frame header with or without a checksum.
+func headerSize(checksum bool) int {
+	if checksum {
+		return frameHeaderSize + checksumSize
+	}
+	return frameHeaderSize
+}
+
+// writeFrame writes a single frame of the form
+// [1-byte type][4-byte little-endian payload length][payload] to w. With
+// checksum set, the header is followed by the 4-byte frameChecksum of the
+// payload. The frame is written with a single call to Write so concurrent
+// frames on the same connection are never interleaved when the caller holds
+// the write lock.
+func writeFrame(w io.Writer, msgType MessageType, payload []byte,
+	checksum bool) error {
+
+	hdrSize := headerSize(checksum)
+	buf := make([]byte, hdrSize+len(payload))
+	buf[0] = byte(msgType)
+	binary.LittleEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	if checksum {
+		copy(buf[frameHeaderSize:hdrSize], frameChecksum(payload))
+	}
+	copy(buf[hdrSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// sharedFrame is a frame serialized once to be written to any number of
+// peers, with or without a checksum, such as a relayed message. The send
+// queues of the peers and the message cache hold references to the same
+// bytes, which are released once the last of them dropped its reference, so
+// they must never be modified.
+type sharedFrame struct {
+	msgType MessageType
+
+	// data holds the frame with a checksum: the type, the length and the
+	// checksum, followed by the payload.
+	data []byte
+}
+
+// newSharedFrame serializes a frame carrying a copy of payload.
+func newSharedFrame(msgType MessageType, payload []byte) *sharedFrame {
+	hdrSize := headerSize(true)
+	data := make([]byte, hdrSize+len(payload))
+	data[0] = byte(msgType)
+	binary.LittleEndian.PutUint32(data[1:frameHeaderSize], uint32(len(payload)))
+	copy(data[hdrSize:], payload)
+	copy(data[frameHeaderSize:hdrSize], frameChecksum(data[hdrSize:]))
+	return &sharedFrame{msgType: msgType, data: data}
+}
+
+// payload returns the payload of the frame.
+func (f *sharedFrame) payload() []byte {
+	return f.data[headerSize(true):]
+}
+
+// writeTo writes the frame to w like writeFrame. Without a checksum, the
+// header and the payload are written from the shared bytes with a single
+// vectored write where w supports it.
+func (f *sharedFrame) writeTo(w io.Writer, checksum bool) error {
+	if checksum {
+		_, err := w.Write(f.data)
+		return err
+	}
+
+	bufs := net.Buffers{f.data[:frameHeaderSize], f.payload()}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// frameHeader is a decoded frame header.
+type frameHeader struct {
+	msgType  MessageType
+	length   uint32
+	checksum [checksumSize]byte
+}
+
+// readFrameHeader reads a frame header from r. Frames announcing a payload
+// larger than maxSize are rejected before any payload bytes are read.
+func readFrameHeader(r io.Reader, maxSize uint32, checksum bool) (frameHeader,
+	error) {
+
+	var buf [frameHeaderSize + checksumSize]byte
+	if _, err := io.ReadFull(r, buf[:headerSize(checksum)]); err != nil {
+		return frameHeader{}, err
+	}
+
+	hdr := frameHeader{
+		msgType: MessageType(buf[0]),
+		length:  binary.LittleEndian.Uint32(buf[1:frameHeaderSize]),
+	}
+	copy(hdr.checksum[:], buf[frameHeaderSize:])
+	if hdr.length > maxSize {
+		return hdr, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge,
+			hdr.length, maxSize)
+	}
+	return hdr, nil
+}
+
+// payloadError wraps an error reading the payload of a frame. The header
+// announced the payload, so a stream ending before it is io.ErrUnexpectedEOF
+// rather than the io.EOF of a connection closed between frames.
+func payloadError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("failed to read frame payload: %w", err)
+}
+
+// expectEnd returns errTrailingPayload if r, a payload being parsed, has
+// bytes left.
+func expectEnd(r io.Reader) error {
+	var extra [1]byte
+	_, err := io.ReadFull(r, extra[:])
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return errTrailingPayload
+	default:
+		return err
+	}
+}
+
+// readFrame reads a single frame from r and returns its message type and
+// payload. Frames announcing a payload larger than maxSize are rejected
+// before any payload bytes are read. With checksum set, the header carries a
+// payload checksum and frames failing it return ErrBadChecksum along with
+// their type and payload. Errors reading the frame header are returned
+// unwrapped so callers can detect io.EOF and network errors.
+func readFrame(r io.Reader, maxSize uint32, checksum bool) (MessageType,
+	[]byte, error) {
+
+	hdr, err := readFrameHeader(r, maxSize, checksum)
+	if err != nil {
+		return hdr.msgType, nil, err
+	}
+
+	payload := make([]byte, hdr.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return hdr.msgType, nil, payloadError(err)
+	}
+
+	if checksum && !bytes.Equal(hdr.checksum[:], frameChecksum(payload)) {
+		return hdr.msgType, payload, fmt.Errorf("%w: type %d, %d bytes",
+			ErrBadChecksum, hdr.msgType, hdr.length)
+	}
+
+	return hdr.msgType, payload, nil
+}
+
+// inboundFrame is a frame read by readInboundFrame.
+type inboundFrame struct {
+	msgType MessageType
+	size    int // payload size announced in the header
+	payload []byte
+
+	// msg is the message of a data frame, decoded while the frame was
+	// read. decodeErr says why a data frame failed to decode, payload is
+	// nil then.
+	msg       *message.Message
+	decodeErr error
+
+	// outpoint is the outpoint of a data message refused for exceeding
+	// the local limits, whose decodeErr is message.ErrExceedsPolicy, or of
+	// one skipped because it is known already, whose decodeErr is
+	// message.ErrDuplicateOutpoint. sequence is the sequence number of
+	// the latter.
+	outpoint message.Outpoint
+	sequence uint32
+
+	// batch holds the entries of a batch frame. decodeErr says why the
+	// batch itself is malformed, entries failing to decode carry their
+	// own error.
+	batch []batchEntry
+}
+
+// readInboundFrame reads a frame like readFrame. Data frames are decoded as
+// they are read with message.DeserializeFrom, so the message is read into a
+// single buffer that is shared by the payload and the decoded message, sized
+// by the frame length. Data messages whose header declares another length
+// fail with message.ErrLengthMismatch. Data messages over limits are refused
+// with message.ErrExceedsPolicy, those too large for any payload within
+// limits are skipped without buffering them.
+// Data messages for which known, if set, reports their outpoint and sequence
+// number as known already are skipped after their header, without buffering
+// them. Batch frames may be up to maxBatch bytes, zero if the peer doesn't
+// send them, and have their entries decoded after the checksum is verified.
+func readInboundFrame(r io.Reader, maxSize, maxBatch uint32, checksum bool,
+	limits message.Limits,
+	known func(message.Outpoint, uint32) bool) (inboundFrame, error) {
+
+	hdr, err := readFrameHeader(r, max(maxSize, maxBatch), checksum)
+	frame := inboundFrame{msgType: hdr.msgType, size: int(hdr.length)}
+	if err != nil {
+		return frame, err
+	}
+	if hdr.msgType != MessageTypeDataBatch && hdr.length > maxSize {
+		return frame, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge,
+			hdr.length, maxSize)
+	}
+
+	if hdr.msgType != MessageTypeData {
+		frame.payload = make([]byte, hdr.length)
+		if _, err := io.ReadFull(r, frame.payload); err != nil {
+			return frame, payloadError(err)
+		}
+		if checksum && !bytes.Equal(hdr.checksum[:], frameChecksum(frame.payload)) {
+			return frame, fmt.Errorf("%w: type %d, %d bytes", ErrBadChecksum,
+				hdr.msgType, hdr.length)
+		}
+		if hdr.msgType == MessageTypeDataBatch {
+			frame.batch, frame.decodeErr = parseBatchPayload(frame.payload,
+				limits)
+		}
+		return frame, nil
+	}
+
+	body := &io.LimitedReader{R: r, N: int64(hdr.length)}
+	src := io.Reader(body)
+	var hasher hash.Hash
+	if checksum {
+		hasher = sha256.New()
+		src = io.TeeReader(body, hasher)
+	}
+
+	switch {
+	case hdr.length > uint32(limits.MessageCap()) &&
+		hdr.length <= message.MaxMessageSize:
+
+		// Only the outpoint is read so the sender can be told which
+		// message was refused
+		if _, err := io.ReadFull(src, frame.outpoint[:]); err == nil {
+			frame.decodeErr = fmt.Errorf("%w: %d byte message",
+				message.ErrExceedsPolicy, hdr.length)
+		} else {
+			frame.decodeErr = message.ErrInvalidHeader
+		}
+
+	default:
+		// A replayed message costs a header read, neither a payload
+		// buffer nor a validation
+		var prefix [message.ExtendedHeaderSize]byte
+		n, _ := io.ReadFull(src, prefix[:min(int(hdr.length), len(prefix))])
+		outpoint, sequence, err := message.ParseKey(prefix[:n],
+			int(hdr.length))
+		if err == nil && known != nil && known(outpoint, sequence) {
+			frame.outpoint, frame.sequence = outpoint, sequence
+			frame.decodeErr = message.ErrDuplicateOutpoint
+			break
+		}
+		frame.msg, frame.payload, frame.decodeErr = message.DeserializeFrom(
+			io.MultiReader(bytes.NewReader(prefix[:n]), src),
+			int(hdr.length))
+	}
+	if frame.msg != nil {
+		if err := limits.CheckPayload(len(frame.msg.Payload)); err != nil {
+			frame.outpoint = frame.msg.Outpoint
+			frame.msg, frame.payload, frame.decodeErr = nil, nil, err
+		}
+	}
+
+	// Consume whatever the decoder left so the next frame can be read
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return frame, fmt.Errorf("failed to read frame payload: %w", err)
+	}
+	if body.N != 0 {
+		return frame, fmt.Errorf("failed to read frame payload: %w",
+			io.ErrUnexpectedEOF)
+	}
+
+	if checksum {
+		hash := sha256.Sum256(hasher.Sum(nil))
+		if !bytes.Equal(hdr.checksum[:], hash[:checksumSize]) {
+			return frame, fmt.Errorf("%w: type %d, %d bytes", ErrBadChecksum,
+				hdr.msgType, hdr.length)
+		}
+	}
+
+	return frame, nil
+}
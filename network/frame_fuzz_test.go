@@ -0,0 +1,134 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/message/testvectors"
+)
+
+// fuzzMaxFrame is the maximum frame size of the fuzz targets, small enough
+// for the fuzzer to reach but over the largest test vector.
+const fuzzMaxFrame = 8192
+
+// vectorOutpoints returns the outpoints of the test vector messages.
+func vectorOutpoints(f *testing.F) []message.Outpoint {
+	msgs, err := testvectors.Messages()
+	if err != nil {
+		f.Fatal(err)
+	}
+	var outpoints []message.Outpoint
+	for _, data := range msgs {
+		var outpoint message.Outpoint
+		copy(outpoint[:], data)
+		outpoints = append(outpoints, outpoint)
+	}
+	return outpoints
+}
+
+// FuzzReadInboundFrame checks that reading frames doesn't panic, that data
+// frames decode to messages serializing back to their payload, and that
+// each frame read consumes exactly its announced size.
+func FuzzReadInboundFrame(f *testing.F) {
+	msgs, err := testvectors.Messages()
+	if err != nil {
+		f.Fatal(err)
+	}
+	var batch batchBuilder
+	for _, checksum := range []bool{false, true} {
+		var stream bytes.Buffer
+		for _, data := range msgs {
+			writeFrame(&stream, MessageTypeData, data, checksum)
+			batch.add(data)
+		}
+		writeFrame(&stream, MessageTypeDataBatch, batch.take(), checksum)
+		writeFrame(&stream, MessageTypeInv,
+			newInvPayload(vectorOutpoints(f)...), checksum)
+		f.Add(stream.Bytes(), checksum)
+		f.Add(stream.Bytes()[:stream.Len()/2], checksum)
+	}
+
+	limits := message.DefaultLimits()
+	known := func(outpoint message.Outpoint, sequence uint32) bool {
+		return outpoint[0]&1 == 1
+	}
+	f.Fuzz(func(t *testing.T, data []byte, checksum bool) {
+		r := bytes.NewReader(data)
+		for {
+			before := r.Len()
+			frame, err := readInboundFrame(r, fuzzMaxFrame, fuzzMaxFrame,
+				checksum, limits, known)
+			if err != nil {
+				return
+			}
+			if read := before - r.Len(); read != headerSize(checksum)+
+				frame.size {
+
+				t.Fatalf("read %d bytes of a frame of %d", read,
+					frame.size)
+			}
+			if frame.msg == nil {
+				continue
+			}
+			if frame.decodeErr != nil {
+				t.Fatalf("message decoded along with %v", frame.decodeErr)
+			}
+			if !bytes.Equal(frame.msg.Serialize(), frame.payload) {
+				t.Fatalf("message serialized to %x, read %x",
+					frame.msg.Serialize(), frame.payload)
+			}
+			if known(frame.msg.Outpoint, frame.msg.Sequence) {
+				t.Fatalf("known message %s decoded",
+					frame.msg.Outpoint.ToString())
+			}
+		}
+	})
+}
+
+// FuzzReadInvPayload checks that the outpoints read from an inv payload
+// make up the whole payload.
+func FuzzReadInvPayload(f *testing.F) {
+	outpoints := vectorOutpoints(f)
+	f.Add(newInvPayload(outpoints...))
+	f.Add(newInvPayload(outpoints[0]))
+	f.Add(newInvPayload())
+	f.Add(newInvPayload(outpoints...)[:message.OutpointSize])
+	f.Add([]byte{0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		outpoints, err := readInvPayload(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if payload := newInvPayload(outpoints...); !bytes.Equal(payload,
+			data) {
+
+			t.Fatalf("read %d outpoints from %x", len(outpoints), data)
+		}
+	})
+}
+
+// FuzzReadGetDataPayload checks that a getdata payload is read only when it
+// is exactly one outpoint.
+func FuzzReadGetDataPayload(f *testing.F) {
+	for _, outpoint := range vectorOutpoints(f) {
+		f.Add(outpoint[:])
+		f.Add(append(outpoint[:], 0))
+		f.Add(outpoint[1:])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		outpoint, err := readGetDataPayload(bytes.NewReader(data))
+		if (err == nil) != (len(data) == message.OutpointSize) {
+			t.Fatalf("%d byte payload gave %v", len(data), err)
+		}
+		if err == nil && !bytes.Equal(outpoint[:], data) {
+			t.Fatalf("read %x from %x", outpoint, data)
+		}
+	})
+}
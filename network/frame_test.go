@@ -0,0 +1,304 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// testFrame is a frame written by the framing tests or read from a test
+// node.
+type testFrame struct {
+	msgType MessageType
+	payload []byte
+}
+
+// testFrames are frames of several types and sizes, including an empty one.
+var testFrames = []testFrame{
+	{MessageTypeInv, bytes.Repeat([]byte{0x01}, 36)},
+	{MessageTypeData, bytes.Repeat([]byte("data"), 1000)},
+	{MessageTypeGetAddr, nil},
+	{MessageTypeGetData, bytes.Repeat([]byte{0xff}, 36)},
+}
+
+// writeTestFrames writes frames to a new buffer.
+func writeTestFrames(t *testing.T, frames []testFrame,
+	checksum bool) *bytes.Buffer {
+
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		err := writeFrame(&buf, frame.msgType, frame.payload, checksum)
+		if err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	return &buf
+}
+
+// TestReadFrameConcatenated checks that concatenated frames are read back in
+// order with their types and payloads, and that the stream ends with io.EOF.
+func TestReadFrameConcatenated(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		buf := writeTestFrames(t, testFrames, checksum)
+
+		for i, want := range testFrames {
+			msgType, payload, err := readFrame(buf, DefaultMaxFrameSize,
+				checksum)
+			if err != nil {
+				t.Fatalf("checksum %v, frame %d: %v", checksum, i, err)
+			}
+			if msgType != want.msgType ||
+				!bytes.Equal(payload, want.payload) {
+
+				t.Fatalf("checksum %v, frame %d: got type %d with %d "+
+					"bytes, want type %d with %d bytes", checksum, i,
+					msgType, len(payload), want.msgType, len(want.payload))
+			}
+		}
+
+		if _, _, err := readFrame(buf, DefaultMaxFrameSize,
+			checksum); err != io.EOF {
+
+			t.Fatalf("checksum %v: read after the last frame gave %v, "+
+				"want io.EOF", checksum, err)
+		}
+	}
+}
+
+// TestReadFrameTruncated checks that a stream cut in the header or the
+// payload of its last frame fails with io.ErrUnexpectedEOF after the
+// complete frames were read.
+func TestReadFrameTruncated(t *testing.T) {
+	full := writeTestFrames(t, testFrames, false).Bytes()
+	lastSize := frameHeaderSize + len(testFrames[len(testFrames)-1].payload)
+
+	tests := []struct {
+		name string
+		cut  int
+	}{
+		{"in header", lastSize - 2},
+		{"after header", lastSize - frameHeaderSize},
+		{"in payload", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(full[:len(full)-test.cut])
+			for i := 0; i < len(testFrames)-1; i++ {
+				if _, _, err := readFrame(buf, DefaultMaxFrameSize,
+					false); err != nil {
+
+					t.Fatalf("frame %d: %v", i, err)
+				}
+			}
+
+			_, payload, err := readFrame(buf, DefaultMaxFrameSize, false)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("truncated frame gave %v, want "+
+					"io.ErrUnexpectedEOF", err)
+			}
+			if payload != nil {
+				t.Fatalf("truncated frame returned %d payload bytes",
+					len(payload))
+			}
+		})
+	}
+}
+
+// TestReadFrameTooLarge checks that a frame announcing a payload over the
+// maximum is rejected before its payload is read.
+func TestReadFrameTooLarge(t *testing.T) {
+	buf := writeTestFrames(t, testFrames[1:2], false)
+	unread := buf.Len() - frameHeaderSize
+
+	_, _, err := readFrame(buf, 100, false)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+	if buf.Len() != unread {
+		t.Fatalf("%d payload bytes read, want none", unread-buf.Len())
+	}
+}
+
+// TestReadFrameBadChecksum checks that a corrupted frame fails its checksum
+// without desynchronizing the stream.
+func TestReadFrameBadChecksum(t *testing.T) {
+	data := writeTestFrames(t, testFrames[:2], true).Bytes()
+	data[headerSize(true)] ^= 0xff
+
+	buf := bytes.NewBuffer(data)
+	msgType, _, err := readFrame(buf, DefaultMaxFrameSize, true)
+	if !errors.Is(err, ErrBadChecksum) || msgType != testFrames[0].msgType {
+		t.Fatalf("corrupted frame gave type %d, %v, want type %d, "+
+			"ErrBadChecksum", msgType, err, testFrames[0].msgType)
+	}
+
+	msgType, payload, err := readFrame(buf, DefaultMaxFrameSize, true)
+	if err != nil || msgType != testFrames[1].msgType ||
+		!bytes.Equal(payload, testFrames[1].payload) {
+
+		t.Fatalf("frame after the corrupted one: type %d, %d bytes, %v",
+			msgType, len(payload), err)
+	}
+}
+
+// TestReadFrameReplayed checks that a stored message replayed 100 times is
+// skipped after its header: its payload is never buffered, its UTXO never
+// looked up, and every copy is counted as a duplicate.
+func TestReadFrameReplayed(t *testing.T) {
+	const replays = 100
+
+	m, client, _ := newTestManager(t)
+	msg := signTestMessage(t, client, message.NewOutpoint([32]byte{9}, 1),
+		strings.Repeat("x", 60000))
+	msgData := msg.Serialize()
+	if err := m.ImportMessage(context.Background(), msgData, false); err != nil {
+		t.Fatalf("ImportMessage: %v", err)
+	}
+
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newTestPeer(t, m, conn, "10.0.0.1:8335")
+	go io.Copy(io.Discard, remote)
+
+	stream := writeTestFrames(t, []testFrame{{MessageTypeData, msgData}},
+		false).Bytes()
+	lookups := client.Calls(mock.MethodGetTxOut)
+
+	var before, after runtime.MemStats
+	frames := make([]inboundFrame, replays)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := range frames {
+		frame, err := readInboundFrame(bytes.NewReader(stream),
+			DefaultMaxFrameSize, 0, false, m.validator.Limits(),
+			p.knownData)
+		if err != nil {
+			t.Fatalf("readInboundFrame: %v", err)
+		}
+		frames[i] = frame
+	}
+	runtime.ReadMemStats(&after)
+
+	// Reading the header takes a few small allocations, a fraction of the
+	// payload size
+	allocated := (after.TotalAlloc - before.TotalAlloc) / replays
+	if allocated >= uint64(len(msgData)/8) {
+		t.Fatalf("a replay allocated %d bytes, a payload is %d",
+			allocated, len(msgData))
+	}
+	for _, frame := range frames {
+		if !errors.Is(frame.decodeErr, message.ErrDuplicateOutpoint) ||
+			frame.msg != nil || frame.payload != nil {
+
+			t.Fatalf("replay decoded: %v", frame.decodeErr)
+		}
+		if err := p.handleDataMessage(frame); err != nil {
+			t.Fatalf("handleDataMessage: %v", err)
+		}
+	}
+
+	if calls := client.Calls(mock.MethodGetTxOut) - lookups; calls != 0 {
+		t.Fatalf("replays made %d gettxout calls, want none", calls)
+	}
+	if skipped := p.duplicatesSkipped.Load(); skipped != replays {
+		t.Fatalf("%d duplicates counted, want %d", skipped, replays)
+	}
+}
+
+// TestReadFrameLengthMismatch checks that a data frame whose message header
+// declares a payload larger or smaller than the frame holds is refused with
+// message.ErrLengthMismatch, leaving the stream at the next frame.
+func TestReadFrameLengthMismatch(t *testing.T) {
+	msg := message.Message{
+		Outpoint:    message.NewOutpoint([32]byte{1}, 0),
+		ContentType: message.ContentTypeText,
+		Length:      message.MaxPayloadSize - 100,
+	}
+	msg.Payload = make([]byte, msg.Length)
+	large := msg.Serialize()[:message.HeaderSize]
+
+	msg.Length, msg.Payload = 10, make([]byte, 10)
+	padded := append(msg.Serialize(), make([]byte, 1000)...)
+
+	for name, payload := range map[string][]byte{"larger": large,
+		"smaller": padded} {
+
+		buf := writeTestFrames(t, []testFrame{{MessageTypeData, payload},
+			testFrames[0]}, false)
+		frame, err := readInboundFrame(buf, DefaultMaxFrameSize, 0, false,
+			message.DefaultLimits(), nil)
+		if err != nil || !errors.Is(frame.decodeErr,
+			message.ErrLengthMismatch) || frame.payload != nil {
+
+			t.Fatalf("payload %s than the frame gave %v, %v", name, err,
+				frame.decodeErr)
+		}
+
+		msgType, next, err := readFrame(buf, DefaultMaxFrameSize, false)
+		if err != nil || msgType != testFrames[0].msgType ||
+			!bytes.Equal(next, testFrames[0].payload) {
+
+			t.Fatalf("payload %s: frame after the mismatch: type %d, %v",
+				name, msgType, err)
+		}
+	}
+}
+
+// TestSlowFrameRead checks that a peer sending the start of a frame and
+// then stalling is disconnected after ReadTimeout, while a peer that stays
+// silent between frames is not.
+func TestSlowFrameRead(t *testing.T) {
+	m, _, _ := newTestManager(t)
+	m.config.ReadTimeout = 1
+
+	peers := make([]*Peer, 2)
+	remotes := make([]net.Conn, 2)
+	for i := range peers {
+		var conn net.Conn
+		conn, remotes[i] = net.Pipe()
+		defer remotes[i].Close()
+		peers[i] = newTestPeer(t, m, conn, fmt.Sprintf("10.0.0.%d:8335",
+			i+1))
+		go peers[i].readMessages(bufio.NewReader(conn))
+		go io.Copy(io.Discard, remotes[i])
+	}
+	stalled, silent := peers[0], peers[1]
+
+	// Two bytes of a header, and nothing more
+	_, err := remotes[0].Write([]byte{byte(MessageTypeInv), 36})
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	start := time.Now()
+	select {
+	case <-stalled.disconnect:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled peer still connected")
+	}
+	if waited := time.Since(start); waited < time.Second/2 {
+		t.Fatalf("stalled peer disconnected after %v", waited)
+	}
+
+	select {
+	case <-silent.disconnect:
+		t.Fatal("silent peer disconnected")
+	default:
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// identityFileName is the name of the file in the data directory
+	// holding the private key of the node identity.
+	identityFileName = "identity.key"
+
+	// challengeSize is the size of the random challenge sent in the
+	// version message of every connection. The identity signature of the
+	// other side covers it, so the signature can't be replayed on another
+	// connection.
+	challengeSize = 32
+
+	// peerKeySize is the size of an identity key, a BIP340 x-only public
+	// key.
+	peerKeySize = schnorr.PubKeyBytesLen
+)
+
+// identityTag is the BIP340 tag of the hash signed to prove an identity.
+var identityTag = []byte("UTXOchat/identity")
+
+// ErrUnauthorizedPeer is returned by the handshake when AllowedPeerKeys is
+// set and the peer has no identity or one that isn't listed.
+var ErrUnauthorizedPeer = errors.New("peer not allowed")
+
+// loadIdentity returns the identity key stored in dataDir, creating the file
+// with a new key on first use. Without a data directory the key only lasts
+// for this run.
+func loadIdentity(dataDir string) (*btcec.PrivateKey, error) {
+	if dataDir == "" {
+		return btcec.NewPrivateKey()
+	}
+
+	path := filepath.Join(dataDir, identityFileName)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		keyBytes, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(keyBytes) != btcec.PrivKeyBytesLen {
+			return nil, fmt.Errorf("invalid identity key in %s", path)
+		}
+		key, _ := btcec.PrivKeyFromBytes(keyBytes)
+		return key, nil
+
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("failed to read identity key: %v", err)
+	}
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+	data = []byte(hex.EncodeToString(key.Serialize()) + "\n")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write identity key: %v", err)
+	}
+	log.Infof("Generated node identity %x in %s",
+		schnorr.SerializePubKey(key.PubKey()), path)
+	return key, nil
+}
+
+// identityHash returns the hash signed by the holder of key: it covers the
+// challenge the signing side sent and the one the verifying side sent.
+func identityHash(key, signerChallenge, verifierChallenge []byte) []byte {
+	return chainhash.TaggedHash(identityTag, key, signerChallenge,
+		verifierChallenge)[:]
+}
+
+// IdentityKey returns the hex encoded identity key peers know this node by,
+// empty if it has none.
+func (m *Manager) IdentityKey() string {
+	if m.identity == nil {
+		return ""
+	}
+	return hex.EncodeToString(schnorr.SerializePubKey(m.identity.PubKey()))
+}
+
+// identityKey returns the identity key sent in our version message, nil
+// without an identity.
+func (m *Manager) identityKey() []byte {
+	if m.identity == nil {
+		return nil
+	}
+	return schnorr.SerializePubKey(m.identity.PubKey())
+}
+
+// sendIdentity proves to the peer that we hold the key of our version
+// message by signing both challenges.
+func (p *Peer) sendIdentity(remote *versionMsg) error {
+	hash := identityHash(p.manager.identityKey(), p.challenge[:],
+		remote.challenge)
+	sig, err := schnorr.Sign(p.manager.identity, hash)
+	if err != nil {
+		return fmt.Errorf("failed to sign identity: %v", err)
+	}
+
+	frame := outboundFrame{
+		msgType: MessageTypeIdentity,
+		payload: sig.Serialize(),
+	}
+	if err := writeFrame(p.conn, frame.msgType, frame.payload, false); err != nil {
+		return err
+	}
+	p.recordSent(frame)
+	return nil
+}
+
+// readIdentity reads the identity message of a peer that announced a key in
+// its version message and checks that its signature covers our challenge.
+func (p *Peer) readIdentity(reader *bufio.Reader, remote *versionMsg) error {
+	msgType, payload, err := readFrame(reader, p.manager.config.MaxFrameSize,
+		false)
+	if err != nil {
+		return err
+	}
+	p.bytesReceived.Add(uint64(headerSize(false) + len(payload)))
+	p.lastRecv.Store(time.Now().UnixNano())
+	if msgType != MessageTypeIdentity {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("expected identity, got message type %d", msgType))
+	}
+
+	pubKey, err := schnorr.ParsePubKey(remote.identity)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invalid identity key: %v", err))
+	}
+	sig, err := schnorr.ParseSignature(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invalid identity signature: %v", err))
+	}
+	hash := identityHash(remote.identity, remote.challenge, p.challenge[:])
+	if !sig.Verify(hash, pubKey) {
+		return misbehaving(MisbehaviorInvalidSignature,
+			fmt.Errorf("identity signature of %x does not verify",
+				remote.identity))
+	}
+
+	p.mutex.Lock()
+	p.peerKey = hex.EncodeToString(remote.identity)
+	p.mutex.Unlock()
+	return nil
+}
+
+// authorize checks the identity of the peer against AllowedPeerKeys. A peer
+// that isn't allowed is sent a reject telling why before it is disconnected,
+// in the frame format the handshake settled.
+func (p *Peer) authorize(remote *versionMsg) error {
+	allowed := p.manager.allowedPeers
+	if len(allowed) == 0 {
+		return nil
+	}
+	if remote != nil && remote.identity != nil {
+		if _, ok := allowed[[32]byte(remote.identity)]; ok {
+			return nil
+		}
+	}
+
+	err := fmt.Errorf("%w: no identity", ErrUnauthorizedPeer)
+	if remote != nil && remote.identity != nil {
+		err = fmt.Errorf("%w: identity %x", ErrUnauthorizedPeer,
+			remote.identity)
+	}
+	frame := outboundFrame{
+		msgType: MessageTypeReject,
+		payload: newRejectPayload(message.Outpoint{}, RejectUnauthorizedPeer,
+			err.Error()),
+	}
+	if writeErr := writeFrame(p.conn, frame.msgType, frame.payload,
+		p.checksum); writeErr == nil {
+
+		p.recordSent(frame)
+	}
+	return err
+}
+
+// identity returns the hex encoded identity key the peer proved it holds in
+// the handshake, empty if it has none.
+func (p *Peer) identity() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.peerKey
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// newIdentity creates a data directory holding a new identity key, and
+// returns the directory, the key and its hex encoded public key.
+func newIdentity(t *testing.T) (string, *btcec.PrivateKey, string) {
+	t.Helper()
+
+	dataDir := t.TempDir()
+	key, err := loadIdentity(dataDir)
+	if err != nil {
+		t.Fatalf("loadIdentity: %v", err)
+	}
+	return dataDir, key,
+		hex.EncodeToString(schnorr.SerializePubKey(key.PubKey()))
+}
+
+// startIdentityNode starts a node with the identity stored in dataDir,
+// connecting only with the peers holding the allowed keys, if any.
+func startIdentityNode(t *testing.T, dataDir string, allowed []string,
+	knownPeers ...string) *testNode {
+
+	t.Helper()
+
+	cfg := testNodeConfig(knownPeers...)
+	cfg.DataDir = dataDir
+	cfg.Identity = true
+	cfg.AllowedPeerKeys = allowed
+	return startTestNode(t, cfg)
+}
+
+// peerKeys returns the identity keys of the peers of node.
+func peerKeys(node *testNode) []string {
+	var keys []string
+	for _, peer := range node.Stats().Peers {
+		keys = append(keys, peer.PeerKey)
+	}
+	return keys
+}
+
+// TestAllowedPeerKeys checks that two nodes listing each other's identity
+// connect and know each other by it, while a third node with an unlisted
+// identity is refused with RejectUnauthorizedPeer.
+func TestAllowedPeerKeys(t *testing.T) {
+	dirA, _, keyA := newIdentity(t)
+	dirB, _, keyB := newIdentity(t)
+	dirC, _, _ := newIdentity(t)
+
+	a := startIdentityNode(t, dirA, []string{keyB})
+	if a.IdentityKey() != keyA {
+		t.Fatalf("node identity %s, want %s stored in its data directory",
+			a.IdentityKey(), keyA)
+	}
+	b := startIdentityNode(t, dirB, []string{keyA}, a.addr)
+	waitFor(t, "allowed peers connected", func() bool {
+		return len(a.Stats().Peers) == 1 && len(b.Stats().Peers) == 1
+	})
+	if keys := peerKeys(a); keys[0] != keyB {
+		t.Fatalf("peer identity %s, want %s", keys[0], keyB)
+	}
+	if keys := peerKeys(b); keys[0] != keyA {
+		t.Fatalf("peer identity %s, want %s", keys[0], keyA)
+	}
+
+	// The unlisted node is told why before its connection is closed
+	c := startIdentityNode(t, dirC, nil, a.addr)
+	waitFor(t, "unlisted peer disconnected", func() bool {
+		for _, known := range c.addrManager.Known() {
+			if known.Addr == a.addr && !known.LastSeen.IsZero() {
+				return true
+			}
+		}
+		return false
+	})
+	if keys := peerKeys(a); len(keys) != 1 || keys[0] != keyB {
+		t.Fatalf("peers %v, want only %s", keys, keyB)
+	}
+	if len(c.Stats().Peers) != 0 {
+		t.Fatal("unlisted node still connected")
+	}
+}
+
+// TestIdentityReplay checks that an identity signature is only accepted
+// over the challenge the node sent on the same connection, so one recorded
+// from another connection can't be replayed to pass the allowlist.
+func TestIdentityReplay(t *testing.T) {
+	dirA, _, _ := newIdentity(t)
+	_, keyB, pubB := newIdentity(t)
+	node := startIdentityNode(t, dirA, []string{pubB})
+
+	tests := []struct {
+		name   string
+		replay bool
+	}{
+		{"own challenge", false},
+		{"replayed", true},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", node.addr)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+
+		challenge := make([]byte, challengeSize)
+		challenge[0] = 1
+		identity := schnorr.SerializePubKey(keyB.PubKey())
+		err = writeFrame(conn, MessageTypeVersion,
+			newVersionPayload(versionMsg{
+				version:   ProtocolVersion,
+				userAgent: "/test/",
+				challenge: challenge,
+				identity:  identity,
+			}), false)
+		if err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+		msgType, payload := readTestFrame(t, conn)
+		if msgType != MessageTypeVersion {
+			t.Fatalf("got message type %d, want version", msgType)
+		}
+		remote, err := parseVersionPayload(payload)
+		if err != nil {
+			t.Fatalf("parseVersionPayload: %v", err)
+		}
+		if msgType, _ := readTestFrame(t, conn); msgType !=
+			MessageTypeIdentity {
+
+			t.Fatalf("got message type %d, want identity", msgType)
+		}
+
+		// A replayed signature covers the challenge of another
+		// connection
+		signed := remote.challenge
+		if test.replay {
+			signed = make([]byte, challengeSize)
+		}
+		sig, err := schnorr.Sign(keyB, identityHash(identity, challenge,
+			signed))
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		err = writeFrame(conn, MessageTypeIdentity, sig.Serialize(), false)
+		if err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+
+		if !test.replay {
+			waitFor(t, "peer connected", func() bool {
+				keys := peerKeys(node)
+				return len(keys) == 1 && keys[0] == pubB
+			})
+			conn.Close()
+			waitFor(t, "peer disconnected", func() bool {
+				return len(node.Stats().Peers) == 0
+			})
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := readFrame(conn, DefaultMaxFrameSize,
+			false); err == nil {
+
+			t.Fatal("replayed identity signature accepted")
+		}
+		if len(node.Stats().Peers) != 0 {
+			t.Fatal("peer with a replayed signature connected")
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// inventoryOutpoint returns the outpoint of the i-th stored test message.
+func inventoryOutpoint(i int) message.Outpoint {
+	var txid [32]byte
+	binary.LittleEndian.PutUint32(txid[:], uint32(i))
+	return message.NewOutpoint(txid, 0)
+}
+
+// storedMessages returns the number of messages node stores.
+func storedMessages(t *testing.T, node *testNode) int {
+	t.Helper()
+
+	stats, err := node.db.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	return stats.Messages.Entries
+}
+
+// TestInventorySync checks that a node started after another stored
+// messages, which it never announced, ends up with all of them.
+func TestInventorySync(t *testing.T) {
+	const n = 50
+
+	ctx := context.Background()
+	a := startTestNode(t, testNodeConfig())
+	b := startTestNode(t, testNodeConfig())
+	for i := 0; i < n; i++ {
+		outpoint := inventoryOutpoint(i)
+		msg := signTestMessage(t, a.client, outpoint, "before B")
+		b.client.AddUTXO(outpoint.WireOutPoint(), 50000,
+			utxoScript(t, a.client, outpoint))
+
+		err := a.db.AddMessage(ctx, outpoint, msg.Serialize(),
+			database.MessageMeta{ReceivedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+
+	if err := b.connectToPeer(a.addr); err != nil {
+		t.Fatalf("connectToPeer: %v", err)
+	}
+	waitFor(t, "B synced", func() bool {
+		return storedMessages(t, b) == n
+	})
+	for i := 0; i < n; i++ {
+		want, _ := a.db.GetMessage(ctx, inventoryOutpoint(i))
+		got, _ := b.db.GetMessage(ctx, inventoryOutpoint(i))
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d synced as %x, want %x", i, got, want)
+		}
+	}
+}
+
+// servedInventory stores n messages in a node started with cfg and returns
+// the outpoints it announces in answer to a getinv for limit of them.
+func servedInventory(t *testing.T, cfg Config, n int,
+	limit uint32) [][]message.Outpoint {
+
+	t.Helper()
+
+	node := startTestNode(t, cfg)
+	for i := 0; i < n; i++ {
+		msg := message.Message{
+			Outpoint:    inventoryOutpoint(i),
+			ContentType: message.ContentTypeText,
+			Length:      2,
+			Payload:     []byte("hi"),
+		}
+		err := node.db.AddMessage(context.Background(), msg.Outpoint,
+			msg.Serialize(), database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+
+	remote := dialTestNode(t, node)
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, limit)
+	remote.send(MessageTypeGetInv, payload)
+
+	// Everything is announced at once, so a short gap ends it
+	var invs [][]message.Outpoint
+	for {
+		select {
+		case frame, ok := <-remote.frames:
+			if !ok {
+				t.Fatal("disconnected after getinv")
+			}
+			if frame.msgType != MessageTypeInv {
+				continue
+			}
+			outpoints, err := readInvPayload(
+				bytes.NewReader(frame.payload))
+			if err != nil {
+				t.Fatalf("readInvPayload: %v", err)
+			}
+			invs = append(invs, outpoints)
+		case <-time.After(500 * time.Millisecond):
+			return invs
+		}
+	}
+}
+
+// TestGetInv checks that a getinv is answered with the stored outpoints,
+// oldest first, in inv messages of at most maxInvPerMessage, up to the
+// requested limit and MaxInventoryServe, and not at all with
+// DisableInventoryServe.
+func TestGetInv(t *testing.T) {
+	const n = maxInvPerMessage + 200
+
+	capped := testNodeConfig()
+	capped.MaxInventoryServe = 10
+	disabled := testNodeConfig()
+	disabled.DisableInventoryServe = true
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		limit uint32
+		want  []int
+	}{
+		{"all", testNodeConfig(), 0, []int{maxInvPerMessage, 200}},
+		{"limit", testNodeConfig(), 5, []int{5}},
+		{"capped", capped, 0, []int{10}},
+		{"limit above cap", capped, 20, []int{10}},
+		{"disabled", disabled, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invs := servedInventory(t, test.cfg, n, test.limit)
+			if len(invs) != len(test.want) {
+				t.Fatalf("got %d invs, want %d", len(invs),
+					len(test.want))
+			}
+			next := 0
+			for i, inv := range invs {
+				if len(inv) != test.want[i] {
+					t.Fatalf("inv %d has %d outpoints, want %d", i,
+						len(inv), test.want[i])
+				}
+				for _, outpoint := range inv {
+					if outpoint != inventoryOutpoint(next) {
+						t.Fatalf("outpoint %d is %s", next,
+							outpoint.ToString())
+					}
+					next++
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// invFilterHeaderSize is the size of the invfilter payload preceding
+	// the short IDs: a 16-byte SipHash key, the 4-byte little-endian number
+	// of short IDs in the whole filter and the 2-byte little-endian number
+	// of short IDs in this message.
+	invFilterHeaderSize = 16 + 4 + 2
+
+	// shortIDSize is the size of a short ID.
+	shortIDSize = 8
+
+	// maxShortIDsPerMessage is the maximum number of short IDs sent in a
+	// single invfilter message, which keeps it well below the maximum
+	// frame size.
+	maxShortIDsPerMessage = 4000
+
+	// maxInvFilterItems is the maximum number of short IDs in a filter.
+	// Nodes storing more messages leave the newest ones out, which the
+	// peer then announces again.
+	maxInvFilterItems = 1 << 17
+
+	// maxInvFilterDuplicates is the fraction of repeated short IDs above
+	// which a filter is ignored. Short IDs of distinct outpoints only
+	// collide by chance once in 2^64, so a filter full of repeats wasn't
+	// built from the sender's inventory with its key.
+	maxInvFilterDuplicates = 0.01
+)
+
+// invFilter is the inventory a peer already has, sent as invfilter messages
+// ahead of a getinv. Outpoints are matched by their short ID, the SipHash-2-4
+// of the outpoint under a key the peer picks for each request, so that an
+// outpoint can't be crafted to collide for every node.
+type invFilter struct {
+	k0, k1 uint64
+
+	// total is the number of short IDs announced for the filter, received
+	// the number of those that arrived so far.
+	total    int
+	received int
+
+	ids        map[uint64]struct{}
+	duplicates int
+}
+
+// complete reports whether all the short IDs of the filter arrived.
+func (f *invFilter) complete() bool {
+	return f.received == f.total
+}
+
+// has reports whether the peer has the message for outpoint. A nil filter
+// has nothing.
+func (f *invFilter) has(outpoint message.Outpoint) bool {
+	if f == nil {
+		return false
+	}
+	_, ok := f.ids[shortID(f.k0, f.k1, outpoint)]
+	return ok
+}
+
+// shortID returns the short ID of outpoint under the key k0, k1.
+func shortID(k0, k1 uint64, outpoint message.Outpoint) uint64 {
+	return sipHash24(k0, k1, outpoint[:])
+}
+
+// sipHash24 returns the SipHash-2-4 of data under the key k0, k1.
+func sipHash24(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	last := uint64(len(data)) << 56
+	for ; len(data) >= 8; data = data[8:] {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var tail [8]byte
+	copy(tail[:], data)
+	last |= binary.LittleEndian.Uint64(tail[:])
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// newInvFilterPayload builds an invfilter payload carrying ids, part of a
+// filter of total short IDs under the key k0, k1.
+func newInvFilterPayload(k0, k1 uint64, total int, ids []uint64) []byte {
+	payload := make([]byte, invFilterHeaderSize+len(ids)*shortIDSize)
+	binary.LittleEndian.PutUint64(payload[0:8], k0)
+	binary.LittleEndian.PutUint64(payload[8:16], k1)
+	binary.LittleEndian.PutUint32(payload[16:20], uint32(total))
+	binary.LittleEndian.PutUint16(payload[20:22], uint16(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(
+			payload[invFilterHeaderSize+i*shortIDSize:], id)
+	}
+	return payload
+}
+
+// parseInvFilterPayload parses an invfilter payload built by
+// newInvFilterPayload.
+func parseInvFilterPayload(payload []byte) (k0, k1 uint64, total int,
+	ids []uint64, err error) {
+
+	if len(payload) < invFilterHeaderSize {
+		return 0, 0, 0, nil, fmt.Errorf("invfilter message too short: "+
+			"%d bytes", len(payload))
+	}
+
+	k0 = binary.LittleEndian.Uint64(payload[0:8])
+	k1 = binary.LittleEndian.Uint64(payload[8:16])
+	total = int(binary.LittleEndian.Uint32(payload[16:20]))
+	count := int(binary.LittleEndian.Uint16(payload[20:22]))
+	items := payload[invFilterHeaderSize:]
+	if len(items) != count*shortIDSize {
+		return 0, 0, 0, nil, fmt.Errorf("invfilter count %d does not "+
+			"match payload length %d", count, len(items))
+	}
+	if total > maxInvFilterItems {
+		return 0, 0, 0, nil, fmt.Errorf("invfilter of %d short IDs, at "+
+			"most %d", total, maxInvFilterItems)
+	}
+
+	ids = make([]uint64, count)
+	for i := range ids {
+		ids[i] = binary.LittleEndian.Uint64(items[i*shortIDSize:])
+	}
+	return k0, k1, total, ids, nil
+}
+
+// handleInvFilterMessage processes an invfilter message from a peer,
+// collecting the short IDs until the getinv they precede. A message with
+// another key starts a new filter.
+func (p *Peer) handleInvFilterMessage(payload []byte) error {
+	if !p.compactInv {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invfilter without negotiating compact inventory"))
+	}
+
+	k0, k1, total, ids, err := parseInvFilterPayload(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	filter := p.invFilter
+	if filter == nil || filter.k0 != k0 || filter.k1 != k1 ||
+		filter.total != total || filter.complete() {
+
+		filter = &invFilter{
+			k0:    k0,
+			k1:    k1,
+			total: total,
+			ids:   make(map[uint64]struct{}, total),
+		}
+		p.invFilter = filter
+	}
+	if filter.received+len(ids) > filter.total {
+		return misbehaving(MisbehaviorMalformed, fmt.Errorf(
+			"invfilter exceeds the %d short IDs announced", total))
+	}
+
+	for _, id := range ids {
+		if _, ok := filter.ids[id]; ok {
+			filter.duplicates++
+			continue
+		}
+		filter.ids[id] = struct{}{}
+	}
+	filter.received += len(ids)
+	return nil
+}
+
+// takeInvFilter returns the filter the peer sent ahead of its getinv and
+// clears it. It returns nil, so that the full inventory is announced, if the
+// peer sent none or sent one that is incomplete or too inconsistent to trust.
+func (p *Peer) takeInvFilter() *invFilter {
+	filter := p.invFilter
+	p.invFilter = nil
+	if filter == nil {
+		return nil
+	}
+
+	if !filter.complete() {
+		log.Debugf("Ignoring incomplete inventory filter from peer %s: "+
+			"%d of %d short IDs", p.addr, filter.received, filter.total)
+		return nil
+	}
+	if float64(filter.duplicates) > float64(filter.total)*maxInvFilterDuplicates {
+		log.Debugf("Ignoring inventory filter from peer %s: %d of %d "+
+			"short IDs repeated", p.addr, filter.duplicates, filter.total)
+		return nil
+	}
+	return filter
+}
+
+// sendInvFilter sends the short IDs of our stored messages, oldest first,
+// ahead of a getinv so that the peer only announces those we are missing.
+// Nothing is sent when we store no messages.
+func (p *Peer) sendInvFilter() error {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("failed to generate filter key: %v", err)
+	}
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	var ids []uint64
+	var cursor string
+	for len(ids) < maxInvFilterItems {
+		entries, next, err := p.manager.ListMessages(p.ctx, cursor,
+			min(maxInvFilterItems-len(ids), database.MaxListLimit))
+		if err != nil {
+			return fmt.Errorf("failed to list messages: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			ids = append(ids, shortID(k0, k1, entry.Outpoint))
+		}
+		cursor = next
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for start := 0; start < len(ids); start += maxShortIDsPerMessage {
+		end := min(start+maxShortIDsPerMessage, len(ids))
+		err := p.SendMessage(MessageTypeInvFilter,
+			newInvFilterPayload(k0, k1, len(ids), ids[start:end]))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Sent inventory filter of %d messages to peer %s", len(ids),
+		p.addr)
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// inventorySize is the number of messages stored by the nodes syncing their
+// inventory in the tests, of which inventoryMissing are missing from the
+// requesting side.
+const (
+	inventorySize    = 10000
+	inventoryMissing = 10
+)
+
+// fillInventory stores placeholder messages for the outpoints numbered from
+// first to last-1 in db. They are only announced, never validated.
+func fillInventory(t *testing.T, db database.Database, first, last int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := first; i < last; i++ {
+		err := db.AddMessage(ctx, inventoryOutpoint(i), []byte("stored"),
+			database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+}
+
+// TestSipHash24 checks sipHash24 against the reference test vectors, with
+// the key 00 01 .. 0f and messages 00 01 .. of each length.
+func TestSipHash24(t *testing.T) {
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		length int
+		want   uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+		{63, 0x958a324ceb064572},
+	}
+	for _, test := range tests {
+		if got := sipHash24(k0, k1, data[:test.length]); got != test.want {
+			t.Fatalf("SipHash of %d bytes is %#x, want %#x", test.length,
+				got, test.want)
+		}
+	}
+}
+
+// TestInvFilterPayload checks that an invfilter payload round-trips and that
+// malformed ones are refused.
+func TestInvFilterPayload(t *testing.T) {
+	ids := []uint64{1, 2, 1 << 63}
+	payload := newInvFilterPayload(7, 8, 10, ids)
+	k0, k1, total, got, err := parseInvFilterPayload(payload)
+	if err != nil || k0 != 7 || k1 != 8 || total != 10 || len(got) != 3 ||
+		got[0] != ids[0] || got[2] != ids[2] {
+
+		t.Fatalf("parsed %d, %d, %d, %v, %v", k0, k1, total, got, err)
+	}
+
+	for _, bad := range [][]byte{
+		payload[:invFilterHeaderSize-1],
+		payload[:len(payload)-1],
+		newInvFilterPayload(7, 8, maxInvFilterItems+1, ids),
+	} {
+		if _, _, _, _, err := parseInvFilterPayload(bad); err == nil {
+			t.Fatalf("parsed malformed payload %x", bad)
+		}
+	}
+}
+
+// filteredInventory sends a getinv to node from remote, after an invfilter of
+// the outpoints numbered from 0 to have-1 if have isn't zero, and returns the
+// outpoints it announces.
+func filteredInventory(t *testing.T, remote *testRemote,
+	have int) []message.Outpoint {
+
+	t.Helper()
+
+	if have > 0 {
+		ids := make([]uint64, have)
+		for i := range ids {
+			ids[i] = shortID(3, 4, inventoryOutpoint(i))
+		}
+		for start := 0; start < have; start += maxShortIDsPerMessage {
+			end := min(start+maxShortIDsPerMessage, have)
+			remote.send(MessageTypeInvFilter,
+				newInvFilterPayload(3, 4, have, ids[start:end]))
+		}
+	}
+	remote.send(MessageTypeGetInv, make([]byte, 4))
+
+	// The data of a message requested next arrives after the invs
+	first := inventoryOutpoint(0)
+	remote.send(MessageTypeGetData, first[:])
+	var outpoints []message.Outpoint
+	for {
+		frame, ok := remote.next(MessageTypeInv, MessageTypeData)
+		if !ok {
+			t.Fatal("getinv not answered")
+		}
+		if frame.msgType == MessageTypeData {
+			return outpoints
+		}
+		inv, err := readInvPayload(bytes.NewReader(frame.payload))
+		if err != nil {
+			t.Fatalf("readInvPayload: %v", err)
+		}
+		outpoints = append(outpoints, inv...)
+	}
+}
+
+// TestCompactInventory checks that a peer whose inventory filter matches all
+// but 10 of 10000 stored messages is announced only those 10, and every
+// message without a filter.
+func TestCompactInventory(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	fillInventory(t, node.db, 0, inventorySize)
+
+	remote := dialTestNodeServices(t, node, SFCompactInv)
+	have := inventorySize - inventoryMissing
+	served := filteredInventory(t, remote, have)
+	if len(served) != inventoryMissing {
+		t.Fatalf("announced %d outpoints, want %d", len(served),
+			inventoryMissing)
+	}
+	for i, outpoint := range served {
+		if outpoint != inventoryOutpoint(have+i) {
+			t.Fatalf("announced %s, want %s", outpoint.ToString(),
+				inventoryOutpoint(have+i).ToString())
+		}
+	}
+
+	// Without a filter, or once it was used, everything is announced
+	if n := len(filteredInventory(t, remote, 0)); n != inventorySize {
+		t.Fatalf("announced %d outpoints without a filter, want %d", n,
+			inventorySize)
+	}
+
+	// A peer that didn't negotiate filters can't send one
+	legacy := dialTestNode(t, node)
+	legacy.send(MessageTypeInvFilter, newInvFilterPayload(3, 4, 1,
+		[]uint64{1}))
+	if !legacy.disconnected() {
+		t.Fatal("invfilter accepted without negotiating it")
+	}
+}
+
+// TestCompactInventoryFallback checks that a filter announcing more short
+// IDs than it carries, or made of repeats, is ignored in favor of the full
+// inventory.
+func TestCompactInventoryFallback(t *testing.T) {
+	const stored = 100
+
+	node := startTestNode(t, testNodeConfig())
+	fillInventory(t, node.db, 0, stored)
+
+	remote := dialTestNodeServices(t, node, SFCompactInv)
+	remote.send(MessageTypeInvFilter, newInvFilterPayload(3, 4, stored,
+		[]uint64{shortID(3, 4, inventoryOutpoint(0))}))
+	if n := len(filteredInventory(t, remote, 0)); n != stored {
+		t.Fatalf("incomplete filter left %d of %d outpoints", n, stored)
+	}
+
+	repeats := make([]uint64, stored)
+	for i := range repeats {
+		repeats[i] = shortID(3, 4, inventoryOutpoint(i%2))
+	}
+	remote.send(MessageTypeInvFilter, newInvFilterPayload(3, 4, stored,
+		repeats))
+	if n := len(filteredInventory(t, remote, 0)); n != stored {
+		t.Fatalf("filter of repeats left %d of %d outpoints", n, stored)
+	}
+}
+
+// TestCompactInventorySync checks that a node connecting to a peer storing
+// 10 messages it lacks out of 10000 has only those 10 announced, and fetches
+// them.
+func TestCompactInventorySync(t *testing.T) {
+	server := startTestNode(t, testNodeConfig())
+	have := inventorySize - inventoryMissing
+	fillInventory(t, server.db, 0, have)
+
+	// The missing messages are valid for the syncing node's Bitcoin node
+	client, db := mock.NewClient(), database.NewMemoryDB()
+	fillInventory(t, db, 0, have)
+	for i := have; i < inventorySize; i++ {
+		msg := signTestMessage(t, client, inventoryOutpoint(i), "missing")
+		err := server.db.AddMessage(context.Background(),
+			inventoryOutpoint(i), msg.Serialize(), database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("AddMessage: %v", err)
+		}
+	}
+	startTestNodeWith(t, testNodeConfig(server.addr), client, db)
+
+	waitFor(t, "missing messages synced", func() bool {
+		for i := have; i < inventorySize; i++ {
+			ok, err := db.HasOutpoint(context.Background(),
+				inventoryOutpoint(i))
+			if err != nil || !ok {
+				return false
+			}
+		}
+		return true
+	})
+	for _, peer := range server.Stats().Peers {
+		if n := peer.Announce.Announced; n != inventoryMissing {
+			t.Fatalf("announced %d outpoints to the syncing node, want %d",
+				n, inventoryMissing)
+		}
+	}
+}
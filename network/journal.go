@@ -0,0 +1,329 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// pendingFileName is the name of the file in the data directory used to
+// persist the locally originated messages waiting to be acknowledged.
+const pendingFileName = "pending.json"
+
+// pendingAnnounce is a locally originated message not yet acknowledged by
+// enough peers.
+type pendingAnnounce struct {
+	Outpoint string    `json:"outpoint"`
+	Data     []byte    `json:"data"`
+	Added    time.Time `json:"added"`
+
+	// Acks holds the addresses of the peers that acknowledged the
+	// message.
+	Acks []string `json:"acks,omitempty"`
+
+	outpoint message.Outpoint
+	sequence uint32
+}
+
+// announceJournal tracks the messages originated by this node until enough
+// peers acknowledged them, so that peers connecting later still learn about
+// messages that could not be relayed when they were created. It is
+// optionally persisted to a pending.json file in the data directory, along
+// with the messages, and is safe for concurrent use.
+type announceJournal struct {
+	path string
+
+	// acks is the number of peers that must acknowledge a message before
+	// it is dropped from the journal.
+	acks int
+
+	entries map[message.Outpoint]*pendingAnnounce
+	mu      sync.Mutex
+}
+
+// newAnnounceJournal creates an empty journal dropping messages once acks
+// peers acknowledged them. If dataDir is empty the journal is only kept in
+// memory.
+func newAnnounceJournal(dataDir string, acks int) *announceJournal {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, pendingFileName)
+	}
+
+	return &announceJournal{
+		path:    path,
+		acks:    acks,
+		entries: make(map[message.Outpoint]*pendingAnnounce),
+	}
+}
+
+// load reads the journal persisted by a previous run.
+func (j *announceJournal) load() error {
+	if j.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", j.path, err)
+	}
+
+	var entries []*pendingAnnounce
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", j.path, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range entries {
+		msg, err := message.Deserialize(entry.Data)
+		if err != nil {
+			log.Warnf("Dropping pending message %s: %v", entry.Outpoint, err)
+			continue
+		}
+		entry.outpoint = msg.Outpoint
+		entry.sequence = msg.Sequence
+		j.entries[msg.Outpoint] = entry
+	}
+	return nil
+}
+
+// save persists the journal to the data directory. The caller must hold
+// j.mu.
+func (j *announceJournal) save() {
+	if j.path == "" {
+		return
+	}
+
+	entries := make([]*pendingAnnounce, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Added.Before(entries[b].Added)
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Warnf("Failed to encode pending messages: %v", err)
+		return
+	}
+
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Warnf("Failed to write %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		log.Warnf("Failed to save pending messages: %v", err)
+	}
+}
+
+// add records a locally originated message. A replacement takes the place of
+// the message it replaces and needs acknowledging again.
+func (j *announceJournal) add(msg *message.Message, msgData []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[msg.Outpoint] = &pendingAnnounce{
+		Outpoint: msg.Outpoint.ToString(),
+		Data:     msgData,
+		Added:    time.Now(),
+		outpoint: msg.Outpoint,
+		sequence: msg.Sequence,
+	}
+	j.save()
+}
+
+// ack records that the peer at addr acknowledged the message for outpoint,
+// dropping it from the journal once enough peers did. It reports whether the
+// message was dropped.
+func (j *announceJournal) ack(outpoint message.Outpoint, addr string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.entries[outpoint]
+	if !ok {
+		return false
+	}
+	for _, acked := range entry.Acks {
+		if acked == addr {
+			return false
+		}
+	}
+	entry.Acks = append(entry.Acks, addr)
+
+	if len(entry.Acks) < j.acks {
+		j.save()
+		return false
+	}
+	delete(j.entries, outpoint)
+	j.save()
+	return true
+}
+
+// remove drops the messages for the given outpoints, such as when their UTXO
+// was spent.
+func (j *announceJournal) remove(outpoints []message.Outpoint) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	removed := false
+	for _, outpoint := range outpoints {
+		if _, ok := j.entries[outpoint]; ok {
+			delete(j.entries, outpoint)
+			removed = true
+		}
+	}
+	if removed {
+		j.save()
+	}
+}
+
+// pending returns the messages waiting to be acknowledged, oldest first.
+func (j *announceJournal) pending() []*pendingAnnounce {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]*pendingAnnounce, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Added.Before(entries[b].Added)
+	})
+	return entries
+}
+
+// len returns the number of messages waiting to be acknowledged.
+func (j *announceJournal) len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.entries)
+}
+
+// originate validates, stores and relays a message authored by this node,
+// recording it in the journal until enough peers acknowledged it.
+func (m *Manager) originate(ctx context.Context,
+	msgData []byte) (*message.Message, error) {
+
+	msg, err := m.processMessage(ctx, msgData, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.journal.add(msg, msgData)
+	return msg, nil
+}
+
+// restorePending stores again the journaled messages missing from the
+// database, as after a restart. Messages still stored with a valid signature
+// are trusted without a UTXO lookup. Messages whose UTXO is gone are dropped
+// from the journal, those that can't be checked yet are kept for the next
+// start.
+func (m *Manager) restorePending(ctx context.Context) {
+	defer m.wg.Done()
+
+	for _, entry := range m.journal.pending() {
+		if m.storedValid(ctx, entry.outpoint, entry.Data) {
+			continue
+		}
+		_, err := m.processMessage(ctx, entry.Data, nil)
+		switch {
+		case err == nil:
+			log.Debugf("Restored pending message %s", entry.Outpoint)
+
+		case errors.Is(err, message.ErrDuplicateOutpoint):
+			// Still stored, nothing to restore
+
+		case errors.Is(err, message.ErrRPCUnavailable):
+			log.Warnf("Failed to restore pending message %s: %v",
+				entry.Outpoint, err)
+
+		default:
+			log.Infof("Dropping pending message %s: %v", entry.Outpoint,
+				err)
+			m.journal.remove([]message.Outpoint{entry.outpoint})
+		}
+	}
+}
+
+// storedValid reports whether msgData is stored for outpoint with a verified
+// signature.
+func (m *Manager) storedValid(ctx context.Context, outpoint message.Outpoint,
+	msgData []byte) bool {
+
+	meta, err := m.db.GetMessageMeta(ctx, outpoint)
+	if err != nil || meta == nil || !meta.SignatureValid {
+		return false
+	}
+	stored, err := m.db.GetMessage(ctx, outpoint)
+	return err == nil && bytes.Equal(stored, msgData)
+}
+
+// announcePending announces the journaled messages to a peer that just
+// completed the handshake. Like relayed messages, new messages are announced
+// with an inv and replacements are sent in full, and only those matching the
+// relay filter of the peer and within its payload limit. Messages waiting for
+// their privacy delay are left to announceOrigin.
+func (m *Manager) announcePending(peer *Peer) {
+	filter := peer.filter.Load()
+	var outpoints []message.Outpoint
+	for _, entry := range m.journal.pending() {
+		if !peer.acceptsMessage(entry.Data) || m.isHeld(entry.outpoint) {
+			continue
+		}
+		if filter != nil {
+			meta, err := m.db.GetMessageMeta(peer.ctx, entry.outpoint)
+			if err != nil || meta == nil || !filter.matchesMeta(meta) {
+				continue
+			}
+		}
+		key := inventoryKey{entry.outpoint, entry.sequence}
+		if !peer.knownInv.add(key) {
+			continue
+		}
+		if entry.sequence > 0 {
+			if err := peer.sendDataMessage(entry.Data); err != nil {
+				log.Debugf("Failed to send pending message to peer %s: %v",
+					peer.addr, err)
+				return
+			}
+			continue
+		}
+		outpoints = append(outpoints, entry.outpoint)
+	}
+
+	for start := 0; start < len(outpoints); start += maxInvPerMessage {
+		end := min(start+maxInvPerMessage, len(outpoints))
+		peer.getDataCredit.Add(int64(end - start))
+		err := peer.SendMessage(MessageTypeInv,
+			newInvPayload(outpoints[start:end]...))
+		if err != nil {
+			log.Debugf("Failed to announce pending messages to peer %s: %v",
+				peer.addr, err)
+			return
+		}
+	}
+	if len(outpoints) > 0 {
+		log.Debugf("Announced %d pending messages to peer %s",
+			len(outpoints), peer.addr)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestAnnouncePending checks that a message originated while the node has no
+// peers is announced to the first peer that connects and sent to it on
+// request, and that it leaves the journal once that peer acknowledged it.
+func TestAnnouncePending(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msgData := signTestMessage(t, node.client, outpoint, "offline").
+		Serialize()
+	if _, err := node.SubmitMessage(ctx, msgData); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+	if n := node.Stats().PendingAnnounce; n != 1 {
+		t.Fatalf("%d messages pending, want 1", n)
+	}
+
+	remote := dialTestNode(t, node)
+	frame, ok := remote.next(MessageTypeInv)
+	if !ok {
+		t.Fatal("pending message not announced")
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil || len(outpoints) != 1 || outpoints[0] != outpoint {
+		t.Fatalf("announced %v, %v, want %s", outpoints, err,
+			outpoint.ToString())
+	}
+
+	remote.send(MessageTypeGetData, outpoint[:])
+	frame, ok = remote.next(MessageTypeData)
+	if !ok || !bytes.Equal(frame.payload, msgData) {
+		t.Fatalf("got data %x, want the message", frame.payload)
+	}
+	if n := node.Stats().PendingAnnounce; n != 1 {
+		t.Fatalf("%d messages pending before the ack, want 1", n)
+	}
+
+	remote.send(MessageTypeAck, outpoint[:])
+	waitFor(t, "message acknowledged", func() bool {
+		return node.Stats().PendingAnnounce == 0
+	})
+}
+
+// TestAnnouncePendingSpent checks that a pending message leaves the journal
+// once its UTXO is spent.
+func TestAnnouncePendingSpent(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, outpoint, "spent soon")
+	if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+	node.AnnounceExpired([]message.Outpoint{outpoint})
+	if n := node.Stats().PendingAnnounce; n != 0 {
+		t.Fatalf("%d messages pending after the spend, want 0", n)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// maxKnownInventory is the number of messages remembered per peer as known
+// to it.
+const maxKnownInventory = 50000
+
+// inventoryKey identifies a message version. Inv announcements carry no
+// sequence and are recorded with sequence 0, so replacements, which are
+// relayed as data, are still sent to peers that only know an older version.
+type inventoryKey struct {
+	outpoint message.Outpoint
+	sequence uint32
+}
+
+// knownInventory is a bounded set of the messages a peer is known to have,
+// because it announced them to us or we sent them. Beyond its limit the least
+// recently seen entries are forgotten. It is safe for concurrent use.
+type knownInventory struct {
+	limit   int
+	entries map[inventoryKey]*list.Element
+	order   *list.List
+	mu      sync.Mutex
+}
+
+// newKnownInventory creates an inventory set holding at most limit entries.
+func newKnownInventory(limit int) *knownInventory {
+	return &knownInventory{
+		limit:   limit,
+		entries: make(map[inventoryKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add records key and reports whether it wasn't known before.
+func (k *knownInventory) add(key inventoryKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if elem, ok := k.entries[key]; ok {
+		k.order.MoveToBack(elem)
+		return false
+	}
+
+	if k.order.Len() >= k.limit {
+		oldest := k.order.Front()
+		k.order.Remove(oldest)
+		delete(k.entries, oldest.Value.(inventoryKey))
+	}
+	k.entries[key] = k.order.PushBack(key)
+	return true
+}
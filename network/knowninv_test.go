@@ -0,0 +1,98 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestKnownInventoryLimit checks that the set forgets the least recently
+// seen entry beyond its limit, and tells versions of an outpoint apart.
+func TestKnownInventoryLimit(t *testing.T) {
+	key := func(i byte, sequence uint32) inventoryKey {
+		return inventoryKey{message.NewOutpoint([32]byte{i}, 0), sequence}
+	}
+
+	k := newKnownInventory(2)
+	if !k.add(key(1, 0)) || !k.add(key(2, 0)) || k.add(key(1, 0)) {
+		t.Fatal("new entries not told from known ones")
+	}
+	if !k.add(key(1, 1)) {
+		t.Fatal("replacement taken for the known version")
+	}
+
+	// Seeing 1 again kept it, so 2 was forgotten for the replacement
+	if k.add(key(1, 0)) {
+		t.Fatal("recently seen entry forgotten")
+	}
+	if !k.add(key(2, 0)) {
+		t.Fatal("least recently seen entry kept beyond the limit")
+	}
+}
+
+// TestRelayTriangle checks that in three connected nodes each outpoint
+// submitted to one of them is announced to each neighbor at most once, and
+// not again when it is broadcast once more.
+func TestRelayTriangle(t *testing.T) {
+	const count = 3
+
+	ctx := context.Background()
+	a := startTestNode(t, testNodeConfig())
+	b := startTestNode(t, testNodeConfig(a.addr))
+	c := startTestNode(t, testNodeConfig(a.addr, b.addr))
+	nodes := map[string]*testNode{"A": a, "B": b, "C": c}
+	waitFor(t, "nodes connected", func() bool {
+		for _, node := range nodes {
+			if len(node.Stats().Peers) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	var msgs []*message.Message
+	for i := byte(1); i <= count; i++ {
+		outpoint := message.NewOutpoint([32]byte{i}, 0)
+		msg := signTestMessage(t, a.client, outpoint, "hello")
+		script := utxoScript(t, a.client, outpoint)
+		b.client.AddUTXO(outpoint.WireOutPoint(), 50000, script)
+		c.client.AddUTXO(outpoint.WireOutPoint(), 50000, script)
+		if _, err := a.SubmitMessage(ctx, msg.Serialize()); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	waitFor(t, "messages relayed", func() bool {
+		return b.Stats().MessagesStored == count &&
+			c.Stats().MessagesStored == count
+	})
+
+	// A broadcasts them again, as if it received them once more
+	for _, msg := range msgs {
+		a.broadcastToOtherPeers(nil, msg, msg.Serialize(),
+			&database.MessageMeta{})
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	for name, node := range nodes {
+		for _, peer := range node.Stats().Peers {
+			if n := peer.Announce.Announced; n > count {
+				t.Errorf("%s announced %d outpoints to %s, want at most %d",
+					name, n, peer.Addr, count)
+			}
+		}
+	}
+	for _, peer := range a.Stats().Peers {
+		if n := peer.Announce.Announced; n != count {
+			t.Errorf("A announced %d outpoints to %s, want %d", n,
+				peer.Addr, count)
+		}
+	}
+}
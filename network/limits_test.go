@@ -0,0 +1,150 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// tryHandshake connects to node and sends a version message, reporting
+// whether the node answered with its own rather than closing the
+// connection. The connection is closed when the test ends.
+func tryHandshake(t *testing.T, node *testNode) (net.Conn, bool) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", node.addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	version := newVersionPayload(versionMsg{
+		version:   ProtocolVersion,
+		userAgent: "/test/",
+		challenge: make([]byte, challengeSize),
+	})
+	if err := writeFrame(conn, MessageTypeVersion, version, false); err != nil {
+		return conn, false
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, _, err := readFrame(conn, DefaultMaxFrameSize, false)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("node neither answered nor closed the connection")
+	}
+	conn.SetReadDeadline(time.Time{})
+	return conn, err == nil && msgType == MessageTypeVersion
+}
+
+// closedByNode reports whether the node closed conn, reading past the
+// frames it still sends.
+func closedByNode(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := readFrame(conn, DefaultMaxFrameSize, false)
+		if err != nil {
+			return !errors.Is(err, os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// TestInboundLimit checks that of limit+5 connections only limit are
+// established and the rest closed, and that an inbound peer idle for long
+// enough is evicted for a new one.
+func TestInboundLimit(t *testing.T) {
+	const limit = 3
+
+	cfg := testNodeConfig()
+	cfg.MaxInboundPeers = limit
+	node := startTestNode(t, cfg)
+
+	var established []net.Conn
+	for i := 0; i < limit+5; i++ {
+		if conn, ok := tryHandshake(t, node); ok {
+			established = append(established, conn)
+		}
+	}
+	if len(established) != limit {
+		t.Fatalf("%d of %d connections established, want %d",
+			len(established), limit+5, limit)
+	}
+	stats := node.Stats()
+	if len(stats.Peers) != limit || stats.InboundPeers != limit ||
+		stats.MaxInboundPeers != limit || stats.InboundRejected != 5 ||
+		stats.InboundEvicted != 0 {
+
+		t.Fatalf("%d peers, %d/%d inbound slots, %d rejected, %d evicted",
+			len(stats.Peers), stats.InboundPeers, stats.MaxInboundPeers,
+			stats.InboundRejected, stats.InboundEvicted)
+	}
+
+	// The first peer falls silent past the eviction threshold
+	idle := established[0].LocalAddr().String()
+	node.peersMu.RLock()
+	peer := node.peers[idle]
+	node.peersMu.RUnlock()
+	if peer == nil {
+		t.Fatalf("no peer for %s", idle)
+	}
+	peer.lastRecv.Store(time.Now().Add(-inboundEvictIdle - time.Second).
+		UnixNano())
+
+	conn, ok := tryHandshake(t, node)
+	if !ok {
+		t.Fatal("connection refused while an idle peer could be evicted")
+	}
+	if !closedByNode(established[0]) {
+		t.Fatal("idle peer not evicted")
+	}
+	waitFor(t, "idle peer removed", func() bool {
+		return !node.isConnected(idle)
+	})
+	stats = node.Stats()
+	if stats.InboundPeers != limit || stats.InboundEvicted != 1 ||
+		!node.isConnected(conn.LocalAddr().String()) {
+
+		t.Fatalf("%d inbound peers, %d evicted after the new connection",
+			stats.InboundPeers, stats.InboundEvicted)
+	}
+
+	// The active peers are not evicted
+	if _, ok := tryHandshake(t, node); ok {
+		t.Fatal("connection accepted with only active peers")
+	}
+}
+
+// TestOutboundLimit checks that a node dials no more known peers than
+// MaxOutboundPeers, even when its target is higher.
+func TestOutboundLimit(t *testing.T) {
+	a := startTestNode(t, testNodeConfig())
+	b := startTestNode(t, testNodeConfig())
+	cfg := testNodeConfig(a.addr, b.addr)
+	cfg.MaxOutboundPeers = 1
+	cfg.TargetOutbound = 2
+	node := startTestNode(t, cfg)
+
+	waitFor(t, "node dialed a peer", func() bool {
+		return node.Stats().OutboundPeers == 1
+	})
+	time.Sleep(3 * reconnectInterval)
+	stats := node.Stats()
+	if stats.OutboundPeers != 1 || stats.MaxOutboundPeers != 1 ||
+		len(stats.Peers) != 1 {
+
+		t.Fatalf("%d outbound peers of %d slots, %d peers",
+			stats.OutboundPeers, stats.MaxOutboundPeers, len(stats.Peers))
+	}
+
+	other := a.addr
+	if node.isConnected(a.addr) {
+		other = b.addr
+	}
+	if err := node.connectToPeer(other); err == nil {
+		t.Fatalf("dialed %s with every outbound slot taken", other)
+	}
+}
@@ -6,16 +6,36 @@ package network
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/shaibearary/utxo_chat/database"
 	"github.com/shaibearary/utxo_chat/message"
 )
 
+const (
+	// maxConcurrentDials is the number of outbound connections attempted
+	// at a time, so unreachable addresses don't hold up the others.
+	maxConcurrentDials = 8
+
+	// reconnectInterval is how often the reconnect loop checks whether more
+	// outbound peers are needed.
+	reconnectInterval = time.Second
+
+	// inboundEvictIdle is how long an inbound peer must have been silent
+	// before it is evicted to make room for a new inbound connection.
+	inboundEvictIdle = 2 * time.Minute
+)
+
 // Manager handles the network operations for UTXOchat.
 type Manager struct {
 	config    Config
@@ -25,25 +45,402 @@ type Manager struct {
 	peers   map[string]*Peer
 	peersMu sync.RWMutex
 
+	// throttled maps peer hosts disconnected for exceeding their rate limit
+	// to the time they may be dialed again.
+	throttled   map[string]time.Time
+	throttledMu sync.Mutex
+
+	throttledMsgs       atomic.Uint64
+	throttleDisconnects atomic.Uint64
+
+	// unknownFrames counts frames of unknown types skipped.
+	unknownFrames atomic.Uint64
+
+	// bandwidth counts the traffic with all peers, for the node's upload
+	// cap. busyRejects counts getdata items refused because of a cap.
+	bandwidth   *bandwidthMeter
+	busyRejects atomic.Uint64
+
+	// startTime is when Start was called, used to report uptime.
+	startTime time.Time
+
+	messagesStored   atomic.Uint64
+	messagesRejected atomic.Uint64
+
+	// rejects records the rejected messages for abuse analysis, nil if
+	// the reject journal is disabled.
+	rejects *rejectJournal
+
+	// messagesBlocked counts valid messages dropped because of the
+	// blocklist.
+	messagesBlocked atomic.Uint64
+
+	// messagesSuppressed counts valid messages dropped because their
+	// payload was stored too often.
+	messagesSuppressed atomic.Uint64
+
+	// inboundRejected counts inbound connections refused because every
+	// slot was taken, inboundEvicted idle inbound peers evicted for them.
+	inboundRejected atomic.Uint64
+	inboundEvicted  atomic.Uint64
+
+	addrManager *AddrManager
+
+	// nonce is sent in our version message to detect connections to
+	// ourselves.
+	nonce uint64
+
+	// identity is the key of the node identity, nil if it has none.
+	// allowedPeers holds the identity keys of AllowedPeerKeys.
+	identity     *btcec.PrivateKey
+	allowedPeers map[[32]byte]struct{}
+
+	// probes maps the addresses announced by peers to when they were last
+	// probed, probesActive is the number of probes in flight.
+	probes       map[string]time.Time
+	probesActive int
+	probesMu     sync.Mutex
+
+	bans *banList
+
+	// scores holds the accumulated misbehavior score per peer host.
+	scores   map[string]int
+	scoresMu sync.Mutex
+
+	// requests tracks outpoints requested from peers with getdata.
+	requests *requestTracker
+
+	// retries holds messages from peers waiting for the Bitcoin node to
+	// become reachable. retriesDropped counts those given up on.
+	retries        *retryQueue
+	retriesDropped atomic.Uint64
+
+	// rpcDegraded is set while UTXO lookups fail to reach the Bitcoin node.
+	rpcDegraded atomic.Bool
+
+	// validations queues data messages from peers for the validation
+	// workers. outpointLocks keeps messages for the same outpoint from
+	// being validated at the same time, whatever their source.
+	validations   chan *validationJob
+	outpointLocks *outpointLocks
+
+	// events fans accepted and expired messages out to subscribers.
+	events *eventBus
+
+	// journal holds the messages originated by this node until enough
+	// peers acknowledged them.
+	journal *announceJournal
+
+	// held holds the outpoints of originated messages waiting for their
+	// privacy delay.
+	held   map[message.Outpoint]struct{}
+	heldMu sync.Mutex
+
+	// msgCache holds recently stored and served messages, so that getdata
+	// for a message many peers want doesn't read the database each time.
+	msgCache *messageCache
+
+	// backfill tracks the parents of replies fetched from peers.
+	backfill *replyBackfill
+
+	// blocklist holds the senders and outpoints whose messages are not
+	// stored or relayed.
+	blocklist *blocklist
+
+	// trusted holds the peers exempt from rate limits, upload caps and
+	// misbehavior scoring.
+	trusted *trustList
+
+	// whitelist holds the only senders and outpoints whose messages are
+	// accepted in whitelist mode.
+	whitelist *whitelist
+
+	// relayFilter is the filter sent to outbound peers supporting it, nil
+	// to be relayed every message.
+	relayFilter *relayFilter
+
+	// chainTip returns the best block processed, whose height is recorded
+	// with the messages validated, nil if unknown.
+	chainTip func() ChainTip
+
+	// live is the configuration last applied by ApplyConfig. Only its
+	// reloadable settings differ from config. reloadMu serializes reloads.
+	live     atomic.Pointer[Config]
+	reloadMu sync.Mutex
+
+	// ctx is derived from the context given to Start and canceled by Stop.
+	// Peers derive theirs from it, so that their validations and RPC calls
+	// are abandoned on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	listener net.Listener
 	quit     chan struct{}
 	wg       sync.WaitGroup
+
+	// quitOnce makes Stop safe to call more than once.
+	quitOnce sync.Once
+}
+
+// applyDefaults replaces the zero settings of cfg with their defaults.
+func applyDefaults(cfg *Config) error {
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if cfg.DataRateLimit == 0 {
+		cfg.DataRateLimit = DefaultDataRateLimit
+	}
+	if cfg.DataRateBurst == 0 {
+		cfg.DataRateBurst = DefaultDataRateBurst
+	}
+	if cfg.InvRateLimit == 0 {
+		cfg.InvRateLimit = DefaultInvRateLimit
+	}
+	if cfg.InvRateBurst == 0 {
+		cfg.InvRateBurst = DefaultInvRateBurst
+	}
+	if cfg.MaxRateViolations == 0 {
+		cfg.MaxRateViolations = DefaultMaxRateViolations
+	}
+	if cfg.HandshakeTimeout == 0 {
+		cfg.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = DefaultReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = DefaultWriteTimeout
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if cfg.MaxChecksumFailures == 0 {
+		cfg.MaxChecksumFailures = DefaultMaxChecksumFailures
+	}
+	if cfg.MaxUnknownFrames == 0 {
+		cfg.MaxUnknownFrames = DefaultMaxUnknownFrames
+	}
+	if cfg.ThrottleCooldown == 0 {
+		cfg.ThrottleCooldown = DefaultThrottleCooldown
+	}
+	if cfg.TargetOutbound == 0 {
+		cfg.TargetOutbound = DefaultTargetOutbound
+	}
+	if cfg.MaxInboundPeers == 0 {
+		cfg.MaxInboundPeers = DefaultMaxInboundPeers
+	}
+	if cfg.MaxOutboundPeers == 0 {
+		cfg.MaxOutboundPeers = DefaultMaxOutboundPeers
+	}
+	if cfg.MaxAddrFailures == 0 {
+		cfg.MaxAddrFailures = DefaultMaxAddrFailures
+	}
+	if cfg.BadAddrCooldown == 0 {
+		cfg.BadAddrCooldown = DefaultBadAddrCooldown
+	}
+	if cfg.BanThreshold == 0 {
+		cfg.BanThreshold = DefaultBanThreshold
+	}
+	if cfg.BanDuration == 0 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+	if cfg.MalformedScore == 0 {
+		cfg.MalformedScore = DefaultMalformedScore
+	}
+	if cfg.InvalidSignatureScore == 0 {
+		cfg.InvalidSignatureScore = DefaultInvalidSignatureScore
+	}
+	if cfg.UnknownTypeScore == 0 {
+		cfg.UnknownTypeScore = DefaultUnknownTypeScore
+	}
+	if cfg.LowValueScore == 0 {
+		cfg.LowValueScore = DefaultLowValueScore
+	}
+	if cfg.DuplicatePayloadScore == 0 {
+		cfg.DuplicatePayloadScore = DefaultDuplicatePayloadScore
+	}
+	if cfg.DuplicateMessageScore == 0 {
+		cfg.DuplicateMessageScore = DefaultDuplicateMessageScore
+	}
+	if cfg.MaxInventoryServe == 0 {
+		cfg.MaxInventoryServe = DefaultMaxInventoryServe
+	}
+	if cfg.MaxRetryQueue == 0 {
+		cfg.MaxRetryQueue = DefaultMaxRetryQueue
+	}
+	if cfg.RetryTTL == 0 {
+		cfg.RetryTTL = DefaultRetryTTL
+	}
+	if cfg.ValidationWorkers == 0 {
+		cfg.ValidationWorkers = runtime.NumCPU()
+	}
+	if cfg.MaxPeerValidations == 0 {
+		cfg.MaxPeerValidations = DefaultMaxPeerValidations
+	}
+	if cfg.AnnounceAcks == 0 {
+		cfg.AnnounceAcks = DefaultAnnounceAcks
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	if cfg.MaxReplyDepth == 0 {
+		cfg.MaxReplyDepth = DefaultMaxReplyDepth
+	}
+	if cfg.RejectJournalSize == 0 {
+		cfg.RejectJournalSize = DefaultRejectJournalSize
+	}
+	if cfg.MaxTipLag == 0 {
+		cfg.MaxTipLag = DefaultMaxTipLag
+	}
+	if cfg.MessageCacheSize == 0 {
+		cfg.MessageCacheSize = DefaultMessageCacheSize
+	}
+	if cfg.Privacy == "" {
+		cfg.Privacy = PrivacyNone
+	}
+	if cfg.PrivacyMinDelay == 0 {
+		cfg.PrivacyMinDelay = DefaultPrivacyMinDelay
+	}
+	if cfg.PrivacyMaxDelay == 0 {
+		cfg.PrivacyMaxDelay = DefaultPrivacyMaxDelay
+	}
+	if err := validatePrivacy(cfg); err != nil {
+		return err
+	}
+	if cfg.ExternalPort < 0 || cfg.ExternalPort > 65535 {
+		return fmt.Errorf("invalid external port %d", cfg.ExternalPort)
+	}
+	if len(cfg.UserAgent) > maxUserAgentSize {
+		return fmt.Errorf("user agent of %d bytes, at most %d",
+			len(cfg.UserAgent), maxUserAgentSize)
+	}
+	return nil
 }
 
 // NewManager creates a new network manager.
 func NewManager(cfg Config, v *database.Validator, db database.Database) (*Manager, error) {
-	return &Manager{
+	if err := applyDefaults(&cfg); err != nil {
+		return nil, err
+	}
+
+	blocked := newBlocklist(cfg.DataDir)
+	err := blocked.merge(&Blocklist{
+		PubKeys:   cfg.BlockedPubKeys,
+		Outpoints: cfg.BlockedOutpoints,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocklist: %v", err)
+	}
+
+	trusted := newTrustList(cfg.DataDir)
+	err = trusted.merge(&TrustedPeers{
+		Addrs: cfg.TrustedPeers,
+		Keys:  cfg.TrustedPeerKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted peers: %v", err)
+	}
+
+	allowed := newWhitelist(cfg.DataDir, cfg.Whitelist)
+	err = allowed.set(&Whitelist{
+		PubKeys:   cfg.WhitelistedPubKeys,
+		Outpoints: cfg.WhitelistedOutpoints,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid whitelist: %v", err)
+	}
+
+	if err := v.Limits().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid message limits: %v", err)
+	}
+
+	relayFilter, err := newRelayFilter(cfg.RelayFilterPubKeys,
+		cfg.RelayFilterChannels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay filter: %v", err)
+	}
+
+	allowedPeers, _, err := parseEntries(cfg.AllowedPeerKeys, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed peer keys: %v", err)
+	}
+
+	var identity *btcec.PrivateKey
+	if cfg.Identity || len(allowedPeers) > 0 {
+		identity, err = loadIdentity(cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	m := &Manager{
 		config:    cfg,
 		validator: v,
 		db:        db,
 		peers:     make(map[string]*Peer),
-		quit:      make(chan struct{}),
-	}, nil
+		throttled: make(map[string]time.Time),
+		addrManager: NewAddrManager(cfg.DataDir, cfg.MaxAddrFailures,
+			time.Duration(cfg.BadAddrCooldown)*time.Second),
+		nonce:        binary.LittleEndian.Uint64(nonce[:]),
+		identity:     identity,
+		allowedPeers: allowedPeers,
+		probes:       make(map[string]time.Time),
+		bans:         newBanList(cfg.DataDir),
+		scores:       make(map[string]int),
+		requests: newRequestTracker(getDataTimeout,
+			cfg.DeprioritizeLagging),
+		retries: newRetryQueue(cfg.MaxRetryQueue,
+			time.Duration(cfg.RetryTTL)*time.Second, cfg.DataDir),
+		validations:   make(chan *validationJob, validationQueueSize),
+		outpointLocks: newOutpointLocks(),
+		events:        newEventBus(),
+		journal:       newAnnounceJournal(cfg.DataDir, cfg.AnnounceAcks),
+		held:          make(map[message.Outpoint]struct{}),
+		msgCache:      newMessageCache(cfg.MessageCacheSize),
+		backfill:      newReplyBackfill(),
+		bandwidth:     newBandwidthMeter(bandwidthWindow),
+		blocklist:     blocked,
+		whitelist:     allowed,
+		relayFilter:   relayFilter,
+		quit:          make(chan struct{}),
+	}
+	m.trusted = trusted
+	m.rejects = newRejectJournal(cfg.DataDir, cfg.RejectJournalSize,
+		cfg.RejectJournalPayloads)
+	m.live.Store(&cfg)
+	db.SetEvictHandler(m.messagesEvicted)
+	return m, nil
+}
+
+// validatedHeight returns the height recorded with a message validated now.
+func (m *Manager) validatedHeight() int32 {
+	return m.currentTip().Height
 }
 
 // Start initializes the network and starts listening for connections.
 func (m *Manager) Start(ctx context.Context) error {
-	log.Printf("Starting network manager on %s", m.config.ListenAddr)
+	log.Infof("Starting network manager on %s", m.config.ListenAddr)
+	if m.identity != nil {
+		log.Infof("Node identity %s", m.IdentityKey())
+	}
+	m.startTime = time.Now()
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.ctx = ctx
+
+	// The whitelist set at runtime before a restart replaces the
+	// configured one. Failing to read it must not open the node to
+	// everyone else.
+	if err := m.whitelist.load(); err != nil {
+		return err
+	}
 
 	// Start listening for incoming connections
 	listener, err := net.Listen("tcp", m.config.ListenAddr)
@@ -52,15 +449,81 @@ func (m *Manager) Start(ctx context.Context) error {
 	}
 	m.listener = listener
 
+	// Seed the address manager from disk and the configured known peers
+	if err := m.addrManager.Load(); err != nil {
+		log.Warnf("Failed to load known peer addresses: %v", err)
+	}
+	for _, addr := range m.config.KnownPeers {
+		m.addrManager.AddAddress(addr)
+	}
+
+	// Restore bans from a previous run
+	if err := m.bans.load(); err != nil {
+		log.Warnf("Failed to load banned peers: %v", err)
+	}
+
+	// Add the senders and outpoints blocked at runtime before a restart
+	if err := m.blocklist.load(); err != nil {
+		log.Warnf("Failed to load blocklist: %v", err)
+	}
+
+	// Add the peers trusted at runtime before a restart
+	if err := m.trusted.load(); err != nil {
+		log.Warnf("Failed to load trusted peers: %v", err)
+	}
+
+	// Store again the messages originated before a restart that no peer
+	// acknowledged yet
+	if err := m.journal.load(); err != nil {
+		log.Warnf("Failed to load pending messages: %v", err)
+	}
+	m.wg.Add(1)
+	go m.restorePending(ctx)
+
+	// Record rejected messages, after those of previous runs
+	if err := m.rejects.load(); err != nil {
+		log.Warnf("Failed to load reject journal: %v", err)
+	}
+	if m.rejects != nil {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.rejects.run(ctx)
+		}()
+	}
+
 	// Accept incoming connections
 	m.wg.Add(1)
 	go m.acceptConnections(ctx)
 
-	// Connect to known peers
-	for _, addr := range m.config.KnownPeers {
-		if err := m.connectToPeer(addr); err != nil {
-			log.Printf("Failed to connect to peer %s: %v", addr, err)
-		}
+	// Connect to known peers and keep reconnecting as peers drop
+	m.wg.Add(1)
+	go m.reconnectLoop(ctx)
+
+	// Retry getdata requests that timed out with other peers
+	m.wg.Add(1)
+	go m.requestTimeoutLoop(ctx)
+
+	// Validate messages held while the Bitcoin node was unreachable,
+	// including those spooled before a restart
+	if err := m.retries.restore(); err != nil {
+		log.Warnf("Failed to restore spooled messages: %v", err)
+	}
+	m.wg.Add(1)
+	go m.retryLoop(ctx)
+
+	// Drop messages past the expiry declared by their payload
+	m.wg.Add(1)
+	go m.expiryLoop(ctx)
+
+	// Tell peers about new blocks, so each side sees who lags behind
+	m.wg.Add(1)
+	go m.tipLoop(ctx)
+
+	// Validate data messages from peers off their read loops
+	for i := 0; i < m.config.ValidationWorkers; i++ {
+		m.wg.Add(1)
+		go m.validationWorker(ctx)
 	}
 
 	return nil
@@ -68,27 +531,67 @@ func (m *Manager) Start(ctx context.Context) error {
 
 // Stop shuts down the network manager.
 func (m *Manager) Stop() error {
-	log.Println("Stopping network manager")
+	log.Info("Stopping network manager")
 
 	// Signal all goroutines to quit
-	close(m.quit)
+	m.quitOnce.Do(func() { close(m.quit) })
 
 	// Close listener
 	if m.listener != nil {
 		m.listener.Close()
 	}
 
-	// Disconnect all peers
-	m.peersMu.Lock()
+	// Abandon validations and RPC calls in flight. This also disconnects
+	// peers added from now on.
+	if m.cancel != nil {
+		m.cancel()
+	}
+
+	// Disconnect all peers, which unblocks their reads. The list is copied
+	// first since each peer's connection handler removes it from the list
+	// as it exits.
+	m.peersMu.RLock()
+	peers := make([]*Peer, 0, len(m.peers))
 	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	m.peersMu.RUnlock()
+
+	for _, peer := range peers {
 		peer.Disconnect()
 	}
-	m.peersMu.Unlock()
 
-	// Wait for all goroutines to finish
-	m.wg.Wait()
+	// Wait for all goroutines, including the peer handlers, to finish.
+	// Peers stuck writing to a connection that doesn't drain are cut off.
+	var err error
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	timeout := time.Duration(m.config.ShutdownTimeout) * time.Second
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		for _, peer := range peers {
+			peer.conn.Close()
+		}
+		err = fmt.Errorf("peers still connected after %v, closed their "+
+			"connections", timeout)
+	}
+
+	// No more events can be published, end the subscriptions
+	m.events.close()
 
-	return nil
+	// Persist known peer addresses and bans for the next start
+	if err := m.addrManager.Save(); err != nil {
+		log.Warnf("Failed to save known peer addresses: %v", err)
+	}
+	if err := m.bans.save(); err != nil {
+		log.Warnf("Failed to save banned peers: %v", err)
+	}
+
+	return err
 }
 
 // acceptConnections handles incoming connections.
@@ -110,40 +613,109 @@ func (m *Manager) acceptConnections(ctx context.Context) {
 			case <-m.quit:
 				return
 			default:
-				log.Printf("Error accepting connection: %v", err)
+				log.Warnf("Error accepting connection: %v", err)
 				continue
 			}
 		}
 
-		// Handle the new connection
+		// Refuse banned peers outright
+		if m.bans.isBanned(peerHost(conn.RemoteAddr().String())) {
+			log.Debugf("Rejecting connection from banned peer %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// Turn the connection away when every inbound slot is taken by
+		// an active peer
+		if !m.makeInboundRoom() {
+			log.Debugf("Rejecting connection from %s: all %d inbound slots "+
+				"are taken", conn.RemoteAddr(), m.config.MaxInboundPeers)
+			m.inboundRejected.Add(1)
+			conn.Close()
+			continue
+		}
+
+		// Handle the new connection. The peer is added to the list
+		// right away so the next connection sees its slot taken.
+		peer := m.addPeer(conn, "")
 		m.wg.Add(1)
-		go m.handleConnection(conn)
+		go m.handleConnection(peer)
 	}
 }
 
-// handleConnection processes a new connection.
-func (m *Manager) handleConnection(conn net.Conn) {
-	defer m.wg.Done()
-	defer conn.Close()
+// makeInboundRoom reports whether another inbound peer may connect. When all
+// MaxInboundPeers slots are taken, the inbound peer that has been silent the
+// longest is evicted if it has been silent for at least inboundEvictIdle, so
+// a flood of connections can't push out active peers.
+func (m *Manager) makeInboundRoom() bool {
+	var (
+		count     int
+		idlest    *Peer
+		idleSince time.Time
+	)
+	m.peersMu.RLock()
+	for _, peer := range m.peers {
+		if peer.outbound || peer.disconnecting() {
+			continue
+		}
+		count++
+		if last := peer.lastActivity(); idlest == nil || last.Before(idleSince) {
+			idlest, idleSince = peer, last
+		}
+	}
+	m.peersMu.RUnlock()
 
-	addr := conn.RemoteAddr().String()
-	log.Printf("New connection from %s", addr)
+	if count < m.config.MaxInboundPeers {
+		return true
+	}
+	if idlest == nil || time.Since(idleSince) < inboundEvictIdle {
+		return false
+	}
+
+	log.Infof("Evicting inbound peer %s, idle since %v, to make room",
+		idlest.addr, idleSince.Format(time.RFC3339))
+	m.inboundEvicted.Add(1)
+	idlest.Disconnect()
+	return true
+}
 
-	// Create a new peer
-	peer := NewPeer(conn, m)
+// addPeer creates a peer for conn and adds it to the peer list. dialAddr is
+// the address that was dialed for outbound connections and empty for inbound
+// ones.
+func (m *Manager) addPeer(conn net.Conn, dialAddr string) *Peer {
+	peer := NewPeer(m.ctx, conn, m)
+	peer.dialAddr = dialAddr
+	peer.outbound = dialAddr != ""
 
-	// Add peer to the map
 	m.peersMu.Lock()
-	m.peers[addr] = peer
+	m.peers[peer.addr] = peer
 	m.peersMu.Unlock()
+	return peer
+}
 
-	// Remove peer when done
-	defer func() {
-		m.peersMu.Lock()
-		delete(m.peers, addr)
-		m.peersMu.Unlock()
-		log.Printf("Connection from %s closed", addr)
-	}()
+// handleConnection handles a peer added by addPeer until it disconnects.
+func (m *Manager) handleConnection(peer *Peer) {
+	defer m.wg.Done()
+	defer peer.conn.Close()
+
+	log.Infof("New connection from %s", peer.addr)
+	if peer.outbound {
+		// Start the backoff from the moment the connection drops, and
+		// remember the peer for listing known peers later
+		defer func() {
+			if peer.forget.Load() {
+				m.addrManager.Remove(peer.dialAddr)
+				return
+			}
+			m.addrManager.Attempt(peer.dialAddr)
+			_, userAgent := peer.announced()
+			m.addrManager.Seen(peer.dialAddr, userAgent,
+				unixNanoTime(peer.lastRecv.Load()))
+		}()
+	}
+
+	// Remove peer when done. This is the only place peers leave the list.
+	defer m.removePeerFromList(peer)
 
 	// Handle peer communication
 	peer.Handle()
@@ -151,80 +723,797 @@ func (m *Manager) handleConnection(conn net.Conn) {
 
 // connectToPeer establishes a connection to a peer.
 func (m *Manager) connectToPeer(addr string) error {
-	log.Printf("Connecting to peer %s", addr)
+	log.Infof("Connecting to peer %s", addr)
+
+	// Refuse banned peers and peers recently disconnected for flooding us
+	if m.bans.isBanned(peerHost(addr)) {
+		return fmt.Errorf("peer %s is banned", addr)
+	}
+	if m.isThrottled(addr) {
+		return fmt.Errorf("peer %s is cooling down after exceeding its rate limit", addr)
+	}
 
 	// Check if already connected
-	m.peersMu.RLock()
-	_, exists := m.peers[addr]
-	m.peersMu.RUnlock()
-	if exists {
+	if m.isConnected(addr) {
 		return fmt.Errorf("already connected to %s", addr)
 	}
+	if m.outboundCount() >= m.config.MaxOutboundPeers {
+		return fmt.Errorf("all %d outbound slots are taken",
+			m.config.MaxOutboundPeers)
+	}
 
 	// Connect to peer
-	conn, err := net.Dial("tcp", addr)
+	m.addrManager.Attempt(addr)
+	conn, err := m.dial(addr)
 	if err != nil {
+		m.addrManager.Failed(addr)
 		return fmt.Errorf("failed to connect to %s: %v", addr, err)
 	}
+	m.addrManager.Good(addr)
 
 	// Handle the connection
+	peer := m.addPeer(conn, addr)
 	m.wg.Add(1)
-	go m.handleConnection(conn)
+	go m.handleConnection(peer)
 
 	return nil
 }
 
-// getMessageFromDB retrieves a message from the database by outpoint.
-// Note: In a production system, you would enhance database.Database interface to include this
+// dial opens a connection to addr, giving up after DialTimeout or when the
+// manager stops.
+func (m *Manager) dial(addr string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout: time.Duration(m.config.DialTimeout) * time.Second,
+	}
+	return dialer.DialContext(m.ctx, "tcp", addr)
+}
+
+// dialAll connects to addrs concurrently and returns once every dial
+// finished.
+func (m *Manager) dialAll(addrs []string) {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.connectToPeer(addr); err != nil {
+				log.Debugf("Failed to connect to peer %s: %v", addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// isConnected reports whether we have a connection to addr, either by its
+// remote address, by the address we dialed or by the address an inbound peer
+// announced it listens on.
+func (m *Manager) isConnected(addr string) bool {
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	for key, peer := range m.peers {
+		if key == addr || peer.dialAddr == addr ||
+			peer.listenAddress() == addr {
+
+			return true
+		}
+	}
+	return false
+}
+
+// outboundCount returns the number of connected outbound peers.
+func (m *Manager) outboundCount() int {
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	count := 0
+	for _, peer := range m.peers {
+		if peer.outbound {
+			count++
+		}
+	}
+	return count
+}
+
+// reconnectLoop keeps the node connected to the target number of outbound
+// peers, dialing known addresses whose backoff has elapsed.
+func (m *Manager) reconnectLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		m.fillOutbound()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requestTimeoutLoop periodically asks another peer for data we requested
+// but never received.
+func (m *Manager) requestTimeoutLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(requestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case now := <-ticker.C:
+			retries := make(map[*Peer][]message.Outpoint)
+			for outpoint, peer := range m.requests.expire(now) {
+				log.Debugf("Request for %s timed out, asking peer %s",
+					outpoint.ToString(), peer.addr)
+				retries[peer] = append(retries[peer], outpoint)
+			}
+			for peer, outpoints := range retries {
+				go peer.requestData(outpoints...)
+			}
+			m.expireBackfill()
+		}
+	}
+}
+
+// fillOutbound dials candidate addresses until the target number of outbound
+// peers is reached or no candidates remain. The target never exceeds
+// MaxOutboundPeers. Trusted peers are dialed first, even once the target is
+// reached as long as MaxOutboundPeers isn't. Up to maxConcurrentDials
+// addresses are dialed at a time.
+func (m *Manager) fillOutbound() {
+	target := min(m.config.TargetOutbound, m.config.MaxOutboundPeers)
+	candidates, trusted := m.addrManager.Candidates(m.trustsAddr)
+	for len(candidates) > 0 {
+		needed := max(target-m.outboundCount(), trusted)
+		if needed <= 0 {
+			return
+		}
+		select {
+		case <-m.quit:
+			return
+		default:
+		}
+
+		var batch []string
+		for len(candidates) > 0 &&
+			len(batch) < min(needed, maxConcurrentDials) {
+
+			addr := candidates[0]
+			candidates = candidates[1:]
+			trusted = max(trusted-1, 0)
+			if m.isConnected(addr) || m.isThrottled(addr) ||
+				m.bans.isBanned(peerHost(addr)) {
+
+				continue
+			}
+			batch = append(batch, addr)
+		}
+		m.dialAll(batch)
+	}
+}
+
+// SubmitMessage validates a serialized message submitted locally, stores it
+// and announces it to all connected peers. It runs through the same path as
+// messages delivered by peers.
+func (m *Manager) SubmitMessage(ctx context.Context, msgData []byte) (*message.Message, error) {
+	return m.originate(ctx, msgData)
+}
+
+// Reason codes of a dry run refused by the node's policy rather than by the
+// validator, see DryRunMessage.
+const (
+	ReasonNotWhitelisted   = "not-whitelisted"
+	ReasonBlocked          = "blocked"
+	ReasonDuplicatePayload = "duplicate-payload"
+)
+
+// DryRunMessage reports whether SubmitMessage would accept msg, without
+// storing or announcing it. On top of the checks of the validator's DryRun,
+// the whitelist, the blocklist and MaxDuplicatePayloads are applied.
+func (m *Manager) DryRunMessage(ctx context.Context,
+	msg *message.Message) *database.DryRunResult {
+
+	result := m.validator.DryRun(ctx, msg)
+	switch {
+	case !result.OK:
+
+	case !m.whitelist.allows(msg.Outpoint, result.PubKey):
+		result.OK = false
+		result.Reason = ReasonNotWhitelisted
+		result.Err = fmt.Errorf("%w: %s", ErrNotWhitelisted,
+			msg.Outpoint.ToString())
+
+	case m.blocklist.isBlocked(msg.Outpoint, result.PubKey):
+		result.OK = false
+		result.Reason = ReasonBlocked
+		result.Err = fmt.Errorf("%w: %s", ErrBlocked,
+			msg.Outpoint.ToString())
+
+	default:
+		duplicate, err := m.duplicatePayload(ctx, msg, payloadHash(msg))
+		if err == nil && duplicate {
+			result.OK = false
+			result.Reason = ReasonDuplicatePayload
+			result.Err = fmt.Errorf("%w: %s", ErrDuplicatePayload,
+				msg.Outpoint.ToString())
+		}
+	}
+	return result
+}
+
+// ImportMessage validates a message read from an archive and stores it like
+// SubmitMessage. With trust set, a message whose UTXO no longer exists, as is
+// expected for messages whose UTXO was spent since the archive was written,
+// is stored without checking its signature, which needs the UTXO. Such
+// messages are not announced to peers, which would reject them.
+func (m *Manager) ImportMessage(ctx context.Context, msgData []byte,
+	trust bool) error {
+
+	if !trust {
+		_, err := m.processMessage(ctx, msgData, nil)
+		return err
+	}
+
+	msg, err := message.Deserialize(msgData)
+	if err != nil {
+		return fmt.Errorf("failed to deserialize message: %w", err)
+	}
+	_, err = m.validator.LookupUTXO(ctx, msg.Outpoint)
+	if !errors.Is(err, message.ErrUTXOSpent) &&
+		!errors.Is(err, message.ErrUTXONotFound) {
+
+		_, err := m.processMessage(ctx, msgData, nil)
+		return err
+	}
+
+	// Like accepted messages, store at most one copy however many imports
+	// of the outpoint race
+	m.outpointLocks.lock(msg.Outpoint)
+	defer m.outpointLocks.unlock(msg.Outpoint)
+
+	_, err = m.storeUnverified(ctx, msg, msgData, database.SourceImport)
+	return err
+}
+
+// storeUnverified stores a message whose UTXO no longer exists without
+// checking its signature, recorded as coming from sourceAddr. The caller
+// holds the lock of the message's outpoint.
+func (m *Manager) storeUnverified(ctx context.Context, msg *message.Message,
+	msgData []byte, sourceAddr string) (*database.MessageMeta, error) {
+
+	if err := msg.ValidateContent(); err != nil {
+		return nil, fmt.Errorf("%w: %v", database.ErrInvalidContent, err)
+	}
+	seen, err := m.db.HasOutpoint(ctx, msg.Outpoint)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if seen {
+		return nil, message.ErrDuplicateOutpoint
+	}
+
+	// The sender of a spent UTXO is unknown, only the outpoint can be
+	// blocked or whitelisted
+	if m.blocklist.isBlocked(msg.Outpoint, nil) {
+		m.messagesBlocked.Add(1)
+		return nil, fmt.Errorf("%w: %s", ErrBlocked,
+			msg.Outpoint.ToString())
+	}
+	if !m.whitelist.allows(msg.Outpoint, nil) {
+		err := fmt.Errorf("%w: %s", ErrNotWhitelisted,
+			msg.Outpoint.ToString())
+		m.rejectMessage(msg.Outpoint, msg, sourceAddr, err)
+		return nil, err
+	}
+
+	meta := database.MessageMeta{
+		ReceivedAt:  time.Now(),
+		Source:      sourceAddr,
+		PayloadHash: payloadHash(msg),
+	}
+	setThreadMeta(&meta, msg)
+	if err := m.storeMessageInDB(ctx, msg.Outpoint, msgData, meta); err != nil {
+		return nil, fmt.Errorf("failed to save message to database: %v",
+			err)
+	}
+	m.messagesStored.Add(1)
+	return &meta, nil
+}
+
+// BroadcastLocalMessage validates a message authored by this node, stores it
+// and announces it to all connected peers.
+func (m *Manager) BroadcastLocalMessage(ctx context.Context, msg *message.Message) error {
+	if int(msg.Length) != len(msg.Payload) {
+		return fmt.Errorf("payload length %d does not match length field %d",
+			len(msg.Payload), msg.Length)
+	}
+
+	_, err := m.originate(ctx, msg.Serialize())
+	return err
+}
+
+// processMessage deserializes a message and hands it to acceptMessage.
+// source is nil for locally submitted messages. Validation failures are
+// tagged with the misbehavior they represent.
+func (m *Manager) processMessage(ctx context.Context, msgData []byte,
+	source *Peer) (*message.Message, error) {
+
+	if len(msgData) < message.HeaderSize {
+		err := misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("data message too short: %d bytes", len(msgData)))
+		m.rejectMessage(message.Outpoint{}, nil, sourceAddress(source), err)
+		return nil, err
+	}
+
+	// Deserialize the message
+	msg, err := message.Deserialize(msgData)
+	if err != nil {
+		err = misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("failed to deserialize message: %w", err))
+		m.rejectMessage(message.Outpoint(msgData[:message.OutpointSize]),
+			nil, sourceAddress(source), err)
+		return nil, err
+	}
+
+	return m.acceptMessage(ctx, msg, msgData, source)
+}
+
+// sourceAddress returns the address messages from source are recorded as
+// coming from, database.SourceLocal for local messages.
+func sourceAddress(source *Peer) string {
+	if source == nil {
+		return database.SourceLocal
+	}
+	return source.addr
+}
+
+// acceptMessage validates a deserialized message, stores it and relays it to
+// every peer except source. msgData holds the serialized message.
+func (m *Manager) acceptMessage(ctx context.Context, msg *message.Message,
+	msgData []byte, source *Peer) (*message.Message, error) {
+
+	return m.acceptMessageFrom(ctx, msg, msgData, source,
+		sourceAddress(source))
+}
+
+// acceptMessageFrom is acceptMessage for a message recorded as coming from
+// sourceAddr, which is database.SourceLocal for local messages. source may be
+// nil for a message from a peer that is no longer connected.
+func (m *Manager) acceptMessageFrom(ctx context.Context, msg *message.Message,
+	msgData []byte, source *Peer, sourceAddr string) (*message.Message,
+	error) {
+
+	log.Debugf("Received message - Outpoint: %s, Sequence: %d, Payload length: %d bytes",
+		msg.Outpoint.ToString(), msg.Sequence, msg.Length)
+
+	// Whatever the outcome, the data arrived so the request is no longer
+	// in flight
+	defer m.requests.done(msg.Outpoint)
+
+	// Validate one message per outpoint at a time, a replacement could
+	// otherwise pass the sequence check against the message it races
+	m.outpointLocks.lock(msg.Outpoint)
+	defer m.outpointLocks.unlock(msg.Outpoint)
+
+	// In whitelist mode, refuse what can't be whitelisted before spending
+	// a UTXO lookup on it
+	if !m.whitelist.mayAllow(msg.Outpoint) {
+		err := fmt.Errorf("%w: %s", ErrNotWhitelisted,
+			msg.Outpoint.ToString())
+		m.rejectMessage(msg.Outpoint, msg, sourceAddr, err)
+		return nil, err
+	}
+
+	// Validate the message using our validator
+	start := time.Now()
+	pkScript, err := m.extractPKScript(ctx, msg.Outpoint)
+	m.setRPCDegraded(errors.Is(err, message.ErrRPCUnavailable))
+	if err != nil {
+		err = fmt.Errorf("failed to extract public key: %w", err)
+		if errors.Is(err, message.ErrRPCUnavailable) {
+			// Nothing is known about the message yet
+			return nil, err
+		}
+
+		// The parent of a reply may have been spent since, it is kept
+		// unverified for the thread
+		if m.backfill.isPending(msg.Outpoint) &&
+			(errors.Is(err, message.ErrUTXOSpent) ||
+				errors.Is(err, message.ErrUTXONotFound)) {
+
+			return m.acceptSpentParent(ctx, msg, msgData, source,
+				sourceAddr)
+		}
+		m.rejectMessage(msg.Outpoint, msg, sourceAddr, err)
+		if errors.Is(err, database.ErrUTXOBelowMinimum) {
+			return nil, misbehaving(MisbehaviorLowValue, err)
+		}
+		return nil, err
+	}
+
+	if err := m.validator.ValidateMessage(ctx, msg, pkScript); err != nil {
+		// Duplicates are expected while relaying and aren't counted
+		// as rejected, neither are messages that couldn't be checked
+		// because the Bitcoin node went away
+		err = fmt.Errorf("invalid message: %w", err)
+		if !errors.Is(err, message.ErrDuplicateOutpoint) &&
+			!errors.Is(err, message.ErrRPCUnavailable) {
+
+			m.rejectMessage(msg.Outpoint, msg, sourceAddr, err)
+		}
+		switch {
+		case errors.Is(err, message.ErrBadSignature),
+			errors.Is(err, database.ErrScriptMismatch):
+			return nil, misbehaving(MisbehaviorInvalidSignature, err)
+		case errors.Is(err, database.ErrInvalidContent):
+			return nil, misbehaving(MisbehaviorMalformed, err)
+		}
+		return nil, err
+	}
+
+	pubKey := database.TaprootOutputKey(pkScript)
+	if !m.whitelist.allows(msg.Outpoint, pubKey) {
+		err := fmt.Errorf("%w: %s", ErrNotWhitelisted,
+			msg.Outpoint.ToString())
+		m.rejectMessage(msg.Outpoint, msg, sourceAddr, err)
+		return nil, err
+	}
+
+	// Blocked messages are valid, so the peer relaying them is acked, but
+	// this node doesn't keep them
+	if m.blocklist.isBlocked(msg.Outpoint, pubKey) {
+		m.messagesBlocked.Add(1)
+		log.Debugf("Dropping blocked message %s", msg.Outpoint.ToString())
+		return nil, fmt.Errorf("%w: %s", ErrBlocked, msg.Outpoint.ToString())
+	}
+
+	// The same payload from too many outpoints is likely spam
+	hash := payloadHash(msg)
+	duplicate, err := m.duplicatePayload(ctx, msg, hash)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if duplicate {
+		return nil, m.suppressPayload(ctx, msg, hash, source)
+	}
+
+	// If valid, save to database and broadcast to other peers
+	meta := database.MessageMeta{
+		ReceivedAt:      time.Now(),
+		Source:          sourceAddr,
+		ValidationTime:  time.Since(start),
+		PubKey:          pubKey,
+		PayloadHash:     hash,
+		SignatureValid:  true,
+		ValidatedHeight: m.validatedHeight(),
+	}
+	setThreadMeta(&meta, msg)
+
+	// Subscribers are told whether the message supersedes a stored one
+	previous, err := m.db.GetMessageMeta(ctx, msg.Outpoint)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	if err := m.storeMessageInDB(ctx, msg.Outpoint, msgData, meta); err != nil {
+		return nil, fmt.Errorf("failed to save message to database: %v", err)
+	}
+
+	// Our own messages must survive a crash once peers learn about them
+	if sourceAddr == database.SourceLocal {
+		if err := m.db.Flush(ctx); err != nil {
+			return nil, fmt.Errorf("failed to flush message to "+
+				"database: %v", err)
+		}
+	}
+	m.messagesStored.Add(1)
+	event := Event{
+		Type:     EventMessageAdded,
+		Outpoint: msg.Outpoint,
+		Message:  msg,
+		Meta:     meta,
+	}
+	if previous != nil {
+		event.Type = EventMessageReplaced
+		event.Reason = RemovalReplaced
+	}
+	m.events.publish(event)
+	if sourceAddr == database.SourceLocal {
+		m.announceOrigin(msg, msgData, &meta)
+	} else {
+		m.broadcastToOtherPeers(source, msg, msgData, &meta)
+	}
+	m.backfillParent(ctx, msg, &meta, source)
+
+	return msg, nil
+}
+
+// acceptSpentParent stores the parent of a reply fetched from a peer after its
+// UTXO was spent. Like imported messages, it is stored without checking its
+// signature and not announced to peers, which would reject it.
+func (m *Manager) acceptSpentParent(ctx context.Context, msg *message.Message,
+	msgData []byte, source *Peer, sourceAddr string) (*message.Message,
+	error) {
+
+	meta, err := m.storeUnverified(ctx, msg, msgData, sourceAddr)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Stored parent %s without verifying it, its UTXO is spent",
+		msg.Outpoint.ToString())
+	m.backfillParent(ctx, msg, meta, source)
+	return msg, nil
+}
+
+// setThreadMeta records the channel, the outpoint replied to, the expiry and
+// the chunk group of a message with a structured payload in meta, so it is
+// indexed by them. Other payloads are opaque and stored as is.
+func setThreadMeta(meta *database.MessageMeta, msg *message.Message) {
+	payload, err := message.ParsePayload(msg.Payload)
+	if err != nil {
+		return
+	}
+	meta.Channel = payload.Channel
+	meta.ReplyTo = payload.ReplyTo
+	meta.Expiry = payload.Expiry
+	if payload.Chunk != nil {
+		group := payload.Chunk.Group
+		meta.ChunkGroup = &group
+	}
+}
+
+// setRPCDegraded records whether the last UTXO lookup failed to reach the
+// Bitcoin node, logging when that changes.
+func (m *Manager) setRPCDegraded(degraded bool) {
+	if m.rpcDegraded.Swap(degraded) == degraded {
+		return
+	}
+	if degraded {
+		log.Warnf("Bitcoin node unreachable, holding messages from peers " +
+			"until it is back")
+	} else {
+		log.Infof("Bitcoin node reachable again")
+	}
+}
+
+// extractPKScript looks up the UTXO backing a message and returns the script
+// its signature must verify against.
+func (m *Manager) extractPKScript(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+
+	// Get the UTXO from Bitcoin node. Spent UTXOs are reported as
+	// message.ErrUTXOSpent, missing ones as message.ErrUTXONotFound and
+	// unconfirmed ones as database.ErrUnconfirmedOutpoint.
+	txOut, err := m.validator.LookupUTXO(ctx, outpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get UTXO info: %w", err)
+	}
+
+	// Check that the UTXO is worth enough to back a message
+	if err := m.validator.VerifyUTXOValue(txOut); err != nil {
+		return nil, err
+	}
+
+	// Recompute the script from the UTXO's output key or key hash. Outputs
+	// other than taproot and P2WPKH are rejected with
+	// message.ErrUnsupportedScript.
+	pkScript, err := m.validator.GetPKScript(txOut)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract output script: %w", err)
+	}
+
+	return pkScript, nil
+}
+
+// ListMessages pages through the stored messages in the order they were
+// accepted. See database.Database.ListMessages for the cursor semantics.
+func (m *Manager) ListMessages(ctx context.Context, cursor string,
+	limit int) ([]database.MessageEntry, string, error) {
+
+	return m.db.ListMessages(ctx, cursor, limit)
+}
+
+// ListChannelMessages pages through the stored messages posted to channel in
+// the order they were accepted.
+func (m *Manager) ListChannelMessages(ctx context.Context, channel string,
+	cursor string, limit int) ([]database.MessageEntry, string, error) {
+
+	return m.db.ListChannelMessages(ctx, channel, cursor, limit)
+}
+
+// Limits returns the size limits of the messages the node accepts.
+func (m *Manager) Limits() message.Limits {
+	return m.validator.Limits()
+}
+
+// getMessageFromDB retrieves a message by outpoint from the message cache, or
+// from the database if it isn't cached. Messages whose UTXO was spent are
+// read from the archive, if it is kept, so that peers can still fetch the
+// parents of replies. It returns nil if the message is not known and
+// database.ErrEvicted if it was evicted. The message is shared and must not
+// be modified.
 func (m *Manager) getMessageFromDB(ctx context.Context, outpoint message.Outpoint) ([]byte, error) {
-	// This is a placeholder implementation
-	// In a real implementation, you would call m.db.GetMessage(ctx, outpoint)
-	log.Printf("Getting message for outpoint %s", outpoint.ToString())
+	frame, err := m.getDataFrame(ctx, outpoint)
+	if frame == nil {
+		return nil, err
+	}
+	return frame.payload(), nil
+}
+
+// getDataFrame is getMessageFromDB returning the data frame sending the
+// message, shared with the message cache.
+func (m *Manager) getDataFrame(ctx context.Context,
+	outpoint message.Outpoint) (*sharedFrame, error) {
 
-	// TODO: Implement proper message storage and retrieval
-	// For now, just return nil (message not found)
-	return nil, nil
+	log.Tracef("Getting message for outpoint %s", outpoint.ToString())
+	return m.msgCache.get(ctx, outpoint, m.loadMessage)
 }
 
-// storeMessageInDB stores a message in the database.
-// Note: In a production system, you would enhance database.Database interface to include this
-func (m *Manager) storeMessageInDB(ctx context.Context, outpoint message.Outpoint, msgData []byte) error {
-	// This is a placeholder implementation
-	// In a real implementation, you would call m.db.AddMessage(ctx, outpoint, msgData)
-	log.Printf("Storing message for outpoint %s (%d bytes)", outpoint.ToString(), len(msgData))
+// loadMessage reads a message from the database, or from the archive if its
+// UTXO was spent.
+func (m *Manager) loadMessage(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+
+	msgData, err := m.db.GetMessage(ctx, outpoint)
+	if err != nil || msgData != nil {
+		return msgData, err
+	}
+	return m.db.GetArchivedMessage(ctx, outpoint)
+}
 
-	// TODO: Implement proper message storage
+// storeMessageInDB stores a message and its local metadata in the database.
+func (m *Manager) storeMessageInDB(ctx context.Context, outpoint message.Outpoint,
+	msgData []byte, meta database.MessageMeta) error {
+
+	log.Debugf("Storing message for outpoint %s (%d bytes)", outpoint.ToString(), len(msgData))
+	if err := m.db.AddMessage(ctx, outpoint, msgData, meta); err != nil {
+		return err
+	}
+	m.msgCache.put(outpoint, msgData)
 	return nil
 }
 
-// broadcastToOtherPeers sends a message to all connected peers except the source peer.
-func (m *Manager) broadcastToOtherPeers(sourcePeer *Peer, outpoint message.Outpoint, msgData []byte) {
+// broadcastToOtherPeers sends a message to all connected peers except the
+// source peer, peers known to have it already, peers whose relay filter
+// doesn't match its sender or channel in meta and peers that don't accept its
+// payload size. New messages are announced with an inv. Replacements are sent
+// in full, since peers that know the outpoint would not request it again. The
+// frame is serialized once and queued to every peer.
+func (m *Manager) broadcastToOtherPeers(sourcePeer *Peer, msg *message.Message,
+	msgData []byte, meta *database.MessageMeta) {
+
+	key := inventoryKey{msg.Outpoint, msg.Sequence}
+	var frame *sharedFrame
+
 	m.peersMu.RLock()
 	defer m.peersMu.RUnlock()
 
 	for _, peer := range m.peers {
-		// Skip source peer
-		if peer == sourcePeer {
+		// Skip the source peer, peers that don't want or accept the
+		// message and peers that already have it
+		if peer == sourcePeer || !peer.filter.Load().matchesMeta(meta) ||
+			!peer.acceptsPayload(len(msg.Payload)) ||
+			!peer.knownInv.add(key) {
+
 			continue
 		}
 
-		// Send inventory message
-		go func(p *Peer) {
-			// Create inv message with this outpoint
-			header := make([]byte, 3) // 1 byte type + 2 bytes count (1)
-			header[0] = byte(MessageTypeInv)
-			binary.LittleEndian.PutUint16(header[1:], 1) // 1 inventory item
+		// Queuing doesn't block, full queues drop the inv or the peer
+		if frame == nil {
+			frame = m.relayFrame(msg, msgData)
+		}
+		if err := peer.sendShared(frame); err != nil {
+			log.Debugf("Failed to broadcast to peer %s: %v", peer.addr, err)
+		}
+	}
+}
+
+// relayFrame returns the frame relaying msg, serialized as msgData: an inv
+// for a new message, the message itself for a replacement, taken from the
+// message cache if it holds it.
+func (m *Manager) relayFrame(msg *message.Message,
+	msgData []byte) *sharedFrame {
+
+	if msg.Sequence == 0 {
+		return newSharedFrame(MessageTypeInv, newInvPayload(msg.Outpoint))
+	}
+	if frame := m.msgCache.peek(msg.Outpoint, msgData); frame != nil {
+		return frame
+	}
+	return newSharedFrame(MessageTypeData, msgData)
+}
+
+// newInvPayload builds an inv payload announcing the given outpoints: a 2-byte
+// little-endian count followed by the outpoints themselves.
+func newInvPayload(outpoints ...message.Outpoint) []byte {
+	payload := make([]byte, 2+len(outpoints)*message.OutpointSize)
+	binary.LittleEndian.PutUint16(payload[:2], uint16(len(outpoints)))
+	for i, outpoint := range outpoints {
+		copy(payload[2+i*message.OutpointSize:], outpoint[:])
+	}
+	return payload
+}
+
+// readInvPayload reads an inv payload built by newInvPayload from r, which
+// must end with it.
+func readInvPayload(r io.Reader) ([]message.Outpoint, error) {
+	var countBytes [2]byte
+	if _, err := io.ReadFull(r, countBytes[:]); err != nil {
+		return nil, fmt.Errorf("inv message too short: %w", err)
+	}
+
+	// The count is only trusted as far as the payload goes on
+	count := int(binary.LittleEndian.Uint16(countBytes[:]))
+	outpoints := make([]message.Outpoint, 0, min(count, maxInvPerMessage))
+	for i := 0; i < count; i++ {
+		var outpoint message.Outpoint
+		if _, err := io.ReadFull(r, outpoint[:]); err != nil {
+			return nil, fmt.Errorf("inv count %d exceeds the %d items "+
+				"in the payload", count, i)
+		}
+		outpoints = append(outpoints, outpoint)
+	}
+	if err := expectEnd(r); err != nil {
+		return nil, fmt.Errorf("inv count %d does not match payload "+
+			"length: %w", count, err)
+	}
+	return outpoints, nil
+}
+
+// readGetDataPayload reads a getdata payload holding a single outpoint from
+// r, which must end with it.
+func readGetDataPayload(r io.Reader) (message.Outpoint, error) {
+	var outpoint message.Outpoint
+	if _, err := io.ReadFull(r, outpoint[:]); err != nil {
+		return outpoint, fmt.Errorf("getdata message too short: %w", err)
+	}
+	if err := expectEnd(r); err != nil {
+		return outpoint, fmt.Errorf("invalid getdata length: %w", err)
+	}
+	return outpoint, nil
+}
+
+// AnnounceExpired notifies all connected peers and subscribers that the
+// messages for the given outpoints were dropped because their UTXO was spent.
+func (m *Manager) AnnounceExpired(outpoints []message.Outpoint) {
+	m.announceRemoved(outpoints, RemovalSpent)
+}
 
-			// Add outpoint
-			payload := outpoint[:]
-			// Combine header and payload
-			data := append(header, payload...)
+// announceRemoved notifies all connected peers that the messages for the
+// given outpoints were dropped, and subscribers why. The outpoints are sent
+// to peers in expire messages of at most maxInvPerMessage items.
+func (m *Manager) announceRemoved(outpoints []message.Outpoint,
+	reason RemovalReason) {
 
-			// Send to peer
-			if err := p.SendMessage(MessageTypeInv, data); err != nil {
-				log.Printf("Failed to broadcast to peer %s: %v", p.addr, err)
+	m.msgCache.remove(outpoints...)
+	m.publishRemoved(outpoints, reason)
+	m.journal.remove(outpoints)
+
+	var payloads [][]byte
+	for start := 0; start < len(outpoints); start += maxInvPerMessage {
+		end := min(start+maxInvPerMessage, len(outpoints))
+		payloads = append(payloads, newInvPayload(outpoints[start:end]...))
+	}
+
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	for _, peer := range m.peers {
+		for _, payload := range payloads {
+			if err := peer.SendMessage(MessageTypeExpire, payload); err != nil {
+				log.Debugf("Failed to send expire to peer %s: %v", peer.addr, err)
+				break
 			}
-		}(peer)
+		}
 	}
 }
 
@@ -235,8 +1524,167 @@ func (m *Manager) removePeerFromList(peer *Peer) {
 	m.peersMu.Lock()
 	defer m.peersMu.Unlock()
 
-	if _, exists := m.peers[addr]; exists {
+	if m.peers[addr] == peer {
 		delete(m.peers, addr)
-		log.Printf("Removed peer %s from list", addr)
+		log.Debugf("Removed peer %s from list", addr)
+	}
+}
+
+// RateLimitStats holds counters describing inbound rate limiting.
+type RateLimitStats struct {
+	// ThrottledMessages is the number of messages dropped because a peer
+	// exceeded its rate limit.
+	ThrottledMessages uint64
+
+	// Disconnects is the number of peers disconnected for repeatedly
+	// exceeding their rate limit.
+	Disconnects uint64
+}
+
+// RateLimitStats returns the inbound rate limiting counters.
+func (m *Manager) RateLimitStats() RateLimitStats {
+	return RateLimitStats{
+		ThrottledMessages: m.throttledMsgs.Load(),
+		Disconnects:       m.throttleDisconnects.Load(),
+	}
+}
+
+// recordThrottled notes that the peer at addr was disconnected for exceeding
+// its rate limit so it is not dialed again until the cooldown expires.
+func (m *Manager) recordThrottled(addr string) {
+	m.throttleDisconnects.Add(1)
+
+	m.throttledMu.Lock()
+	defer m.throttledMu.Unlock()
+
+	cooldown := time.Duration(m.settings().ThrottleCooldown) * time.Second
+	m.throttled[peerHost(addr)] = time.Now().Add(cooldown)
+}
+
+// isThrottled reports whether the peer at addr is still cooling down after
+// being disconnected for exceeding its rate limit.
+func (m *Manager) isThrottled(addr string) bool {
+	m.throttledMu.Lock()
+	defer m.throttledMu.Unlock()
+
+	host := peerHost(addr)
+	until, ok := m.throttled[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(m.throttled, host)
+		return false
+	}
+	return true
+}
+
+// BanPeer bans the host of addr for the given duration and disconnects any
+// peers connected from it.
+func (m *Manager) BanPeer(addr string, duration time.Duration) error {
+	host := peerHost(addr)
+	if host == "" {
+		return fmt.Errorf("invalid peer address %q", addr)
+	}
+
+	log.Infof("Banning peer %s for %v", host, duration)
+	m.bans.ban(host, time.Now().Add(duration))
+
+	m.scoresMu.Lock()
+	delete(m.scores, host)
+	m.scoresMu.Unlock()
+
+	// Collect matching peers first since Disconnect removes the peer from
+	// the peer map.
+	var banned []*Peer
+	m.peersMu.RLock()
+	for key, peer := range m.peers {
+		if peerHost(key) == host {
+			banned = append(banned, peer)
+		}
+	}
+	m.peersMu.RUnlock()
+
+	for _, peer := range banned {
+		peer.Disconnect()
+	}
+
+	return m.bans.save()
+}
+
+// UnbanPeer lifts the ban on the host of addr.
+func (m *Manager) UnbanPeer(addr string) error {
+	host := peerHost(addr)
+	if !m.bans.unban(host) {
+		return fmt.Errorf("peer %s is not banned", host)
+	}
+
+	log.Infof("Unbanned peer %s", host)
+	return m.bans.save()
+}
+
+// ListBans returns the currently banned peer hosts.
+func (m *Manager) ListBans() []BanInfo {
+	return m.bans.list()
+}
+
+// addMisbehavior adds the score for the given misbehavior to the peer's host
+// and bans it once the score reaches the configured threshold. It returns
+// true if the peer was banned. Trusted peers are not scored.
+func (m *Manager) addMisbehavior(peer *Peer, kind Misbehavior) bool {
+	// The flag is only set once the handshake completed
+	if m.trusts(peer) {
+		log.Debugf("Trusted peer %s misbehaved (%v), not scored",
+			peer.addr, kind)
+		return false
+	}
+
+	var points int
+	switch kind {
+	case MisbehaviorMalformed:
+		points = m.config.MalformedScore
+	case MisbehaviorInvalidSignature:
+		points = m.config.InvalidSignatureScore
+	case MisbehaviorUnknownType:
+		points = m.config.UnknownTypeScore
+	case MisbehaviorLowValue:
+		points = m.config.LowValueScore
+	case MisbehaviorDuplicatePayload:
+		points = m.config.DuplicatePayloadScore
+	case MisbehaviorDuplicateMessage:
+		points = m.config.DuplicateMessageScore
+	}
+	if points < 0 {
+		log.Debugf("Peer %s misbehaved (%v), not scored", peer.addr, kind)
+		return false
+	}
+
+	host := peerHost(peer.addr)
+
+	m.scoresMu.Lock()
+	m.scores[host] += points
+	score := m.scores[host]
+	m.scoresMu.Unlock()
+
+	log.Warnf("Peer %s misbehaved (%v), score now %d", peer.addr, kind, score)
+
+	if score < m.config.BanThreshold {
+		return false
+	}
+
+	duration := time.Duration(m.config.BanDuration) * time.Second
+	if err := m.BanPeer(peer.addr, duration); err != nil {
+		log.Warnf("Failed to persist ban for %s: %v", host, err)
+	}
+	return true
+}
+
+// peerHost returns the host part of a peer address, or the address itself if
+// it has no port.
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
+	return host
 }
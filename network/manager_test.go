@@ -0,0 +1,404 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/blockchain"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// importers is the number of goroutines importing the same message at once.
+const importers = 16
+
+// signTestMessage adds a UTXO controlled by a fixed key to client and returns
+// a message signed for it.
+func signTestMessage(t testing.TB, client *mock.Client,
+	outpoint message.Outpoint, text string) *message.Message {
+
+	t.Helper()
+
+	return signSeedMessage(t, client, 7, outpoint, text)
+}
+
+// testSender returns the taproot key made of seed bytes and the script of
+// its UTXOs, which pays to its x-only output key.
+func testSender(t testing.TB, seed byte) (*btcec.PrivateKey, []byte) {
+	t.Helper()
+
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{seed}, 32))
+	pkScript, err := signer.TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pkScript
+}
+
+// signSeedMessage is signTestMessage for the key testSender returns for
+// seed.
+func signSeedMessage(t testing.TB, client *mock.Client, seed byte,
+	outpoint message.Outpoint, text string) *message.Message {
+
+	t.Helper()
+
+	key, pkScript := testSender(t, seed)
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+
+	msg, err := signer.SignMessage(key, outpoint, message.ContentTypeText,
+		[]byte(text))
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	return msg
+}
+
+// utxoScript returns the script of the UTXO of outpoint in client.
+func utxoScript(t *testing.T, client *mock.Client,
+	outpoint message.Outpoint) []byte {
+
+	t.Helper()
+
+	txid := outpoint.Txid()
+	txOut, err := client.GetTxOut(context.Background(), &txid,
+		outpoint.Vout(), false)
+	if err != nil || txOut == nil {
+		t.Fatalf("GetTxOut: %v, %v", txOut, err)
+	}
+	pkScript, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkScript
+}
+
+// importConcurrently imports msgData from importers goroutines at once and
+// returns the number of imports that succeeded. The others must fail as
+// duplicates. The UTXO lookups of client are slowed down so that the imports
+// overlap.
+func importConcurrently(t *testing.T, m *Manager, client *mock.Client,
+	msgData []byte, trust bool) int {
+
+	t.Helper()
+
+	client.SetLatency(5 * time.Millisecond)
+	defer client.SetLatency(0)
+
+	var (
+		wg       sync.WaitGroup
+		start    = make(chan struct{})
+		errs     = make(chan error, importers)
+		accepted int
+	)
+	for i := 0; i < importers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- m.ImportMessage(context.Background(), msgData, trust)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, message.ErrDuplicateOutpoint):
+			t.Fatalf("import failed: %v", err)
+		}
+	}
+	return accepted
+}
+
+// checkStoredOnce fails the test unless m stored a single message, msgData.
+func checkStoredOnce(t *testing.T, m *Manager, msgData []byte) {
+	t.Helper()
+
+	entries, _, err := m.ListMessages(context.Background(), "", 0)
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].Data, msgData) {
+		t.Fatalf("%d messages stored, want the imported one only",
+			len(entries))
+	}
+	if stored := m.messagesStored.Load(); stored != 1 {
+		t.Fatalf("%d messages counted as stored, want 1", stored)
+	}
+}
+
+// TestImportMessageConcurrent checks that a message imported by many
+// goroutines at once is stored and announced once.
+func TestImportMessageConcurrent(t *testing.T) {
+	m, client, _ := newTestManager(t)
+	peerConn, conn := net.Pipe()
+	newTestPeer(t, m, peerConn, "10.0.0.2:8335")
+
+	outpoint := message.NewOutpoint([32]byte{1}, 300)
+	msgData := signTestMessage(t, client, outpoint, "hello").Serialize()
+
+	// The peer reads its frames while the imports run
+	invs := make(chan []message.Outpoint, importers)
+	go func() {
+		defer close(invs)
+		for {
+			msgType, payload, err := readFrame(conn, DefaultMaxFrameSize,
+				false)
+			if err != nil {
+				return
+			}
+			if msgType != MessageTypeInv {
+				continue
+			}
+			outpoints, err := readInvPayload(bytes.NewReader(payload))
+			if err == nil {
+				invs <- outpoints
+			}
+		}
+	}()
+
+	accepted := importConcurrently(t, m, client, msgData, false)
+	if accepted != 1 {
+		t.Fatalf("%d of %d concurrent imports accepted, want 1",
+			accepted, importers)
+	}
+	checkStoredOnce(t, m, msgData)
+
+	events := m.RecentEvents(0, 0, nil)
+	if len(events) != 1 || events[0].Type != EventMessageAdded {
+		t.Fatalf("%d events published, want one message added",
+			len(events))
+	}
+
+	select {
+	case outpoints := <-invs:
+		if len(outpoints) != 1 || outpoints[0] != outpoint {
+			t.Fatalf("announced %d outpoints, want only %s",
+				len(outpoints), outpoint.ToString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not announced")
+	}
+	select {
+	case <-invs:
+		t.Fatal("message announced twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestImportMessageConcurrentSpent checks that a trusted message whose UTXO
+// was spent, imported by many goroutines at once, is stored once without
+// being announced.
+func TestImportMessageConcurrentSpent(t *testing.T) {
+	m, client, _ := newTestManager(t)
+
+	outpoint := message.NewOutpoint([32]byte{2}, 0)
+	msgData := signTestMessage(t, client, outpoint, "hello").Serialize()
+	client.SpendUTXO(outpoint.WireOutPoint())
+
+	accepted := importConcurrently(t, m, client, msgData, true)
+	if accepted != 1 {
+		t.Fatalf("%d of %d concurrent imports accepted, want 1",
+			accepted, importers)
+	}
+	checkStoredOnce(t, m, msgData)
+}
+
+// TestImportArchive checks that messages imported from an archive are
+// validated again, rejecting those whose UTXO is gone unless the import is
+// trusted.
+func TestImportArchive(t *testing.T) {
+	ctx := context.Background()
+	src, srcClient, srcDB := newTestManager(t)
+	dst, dstClient, dstDB := newTestManager(t)
+
+	for i := byte(1); i <= 3; i++ {
+		outpoint := message.NewOutpoint([32]byte{i}, 0)
+		msgData := signTestMessage(t, srcClient, outpoint, "hello").
+			Serialize()
+		if err := src.ImportMessage(ctx, msgData, false); err != nil {
+			t.Fatalf("ImportMessage: %v", err)
+		}
+
+		// The UTXO of the last message was spent since
+		if i < 3 {
+			dstClient.AddUTXO(outpoint.WireOutPoint(), 50000,
+				utxoScript(t, srcClient, outpoint))
+		}
+	}
+	var archive bytes.Buffer
+	if _, err := database.Export(ctx, srcDB, &archive); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	for _, test := range []struct {
+		trust                          bool
+		accepted, rejected, duplicates int
+	}{
+		{false, 2, 1, 0},
+		{true, 1, 0, 2},
+	} {
+		result, err := database.Import(ctx,
+			bytes.NewReader(archive.Bytes()),
+			func(ctx context.Context, msgData []byte) error {
+				return dst.ImportMessage(ctx, msgData, test.trust)
+			})
+		if err != nil || result.Accepted != test.accepted ||
+			result.Rejected != test.rejected ||
+			result.Duplicates != test.duplicates {
+
+			t.Fatalf("trust %v: imported %+v, %v", test.trust, result, err)
+		}
+	}
+	if n := dstClient.Calls(mock.MethodGetTxOut); n == 0 {
+		t.Fatal("imported messages not validated")
+	}
+
+	meta, err := dstDB.GetMessageMeta(ctx,
+		message.NewOutpoint([32]byte{3}, 0))
+	if err != nil || meta == nil || meta.Source != database.SourceImport {
+		t.Fatalf("trusted message stored with %+v, %v", meta, err)
+	}
+}
+
+// TestMessageMetaSource checks that a stored message records when it was
+// received, with "local" as the source of a submitted message and the peer's
+// address as the source of a relayed one.
+func TestMessageMetaSource(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+
+	local := message.NewOutpoint([32]byte{1}, 0)
+	before := time.Now()
+	msg := signTestMessage(t, node.client, local, "submitted")
+	if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	relayed := message.NewOutpoint([32]byte{2}, 0)
+	msg = signTestMessage(t, node.client, relayed, "relayed")
+	remote := dialTestNode(t, node)
+	remote.send(MessageTypeData, msg.Serialize())
+	waitFor(t, "relayed message stored", func() bool {
+		stored, _ := node.db.HasOutpoint(ctx, relayed)
+		return stored
+	})
+
+	for outpoint, source := range map[message.Outpoint]string{
+		local:   database.SourceLocal,
+		relayed: remote.conn.LocalAddr().String(),
+	} {
+		meta, err := node.db.GetMessageMeta(ctx, outpoint)
+		if err != nil || meta == nil {
+			t.Fatalf("GetMessageMeta: %v, %v", meta, err)
+		}
+		if meta.Source != source {
+			t.Fatalf("message from %s has source %q", source,
+				meta.Source)
+		}
+		if meta.ReceivedAt.Before(before.Truncate(time.Second)) ||
+			meta.ReceivedAt.After(time.Now()) {
+
+			t.Fatalf("message from %s received at %v", source,
+				meta.ReceivedAt)
+		}
+	}
+}
+
+// TestBroadcastLocalMessage checks that a message authored by the node is
+// stored and announced to its peers, and that one whose length field doesn't
+// match its payload is refused.
+func TestBroadcastLocalMessage(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	remote := dialTestNode(t, node)
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, outpoint, "authored")
+	if err := node.BroadcastLocalMessage(ctx, msg); err != nil {
+		t.Fatalf("BroadcastLocalMessage: %v", err)
+	}
+	data, err := node.db.GetMessage(ctx, outpoint)
+	if err != nil || !bytes.Equal(data, msg.Serialize()) {
+		t.Fatalf("stored %x, %v, want the message", data, err)
+	}
+	frame, ok := remote.next(MessageTypeInv)
+	if !ok {
+		t.Fatal("message not announced")
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil || len(outpoints) != 1 || outpoints[0] != outpoint {
+		t.Fatalf("announced %v, %v, want %s", outpoints, err,
+			outpoint.ToString())
+	}
+
+	bad := signTestMessage(t, node.client, message.NewOutpoint([32]byte{2},
+		0), "authored")
+	bad.Length++
+	if err := node.BroadcastLocalMessage(ctx, bad); err == nil {
+		t.Fatal("message with a bad length field broadcast")
+	}
+	if stored, _ := node.db.HasOutpoint(ctx, bad.Outpoint); stored {
+		t.Fatal("message with a bad length field stored")
+	}
+}
+
+// TestExpireSpent checks that once the block handler sees a block spending
+// the UTXO of a stored message, the message is dropped and connected peers
+// are sent an expire frame for its outpoint.
+func TestExpireSpent(t *testing.T) {
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	remote := dialTestNode(t, node)
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, outpoint, "spent soon")
+	if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+
+	cfg := blockchain.DefaultConfig()
+	cfg.NotificationsEnabled = false
+	cfg.PollInterval = 1
+	handler := blockchain.NewHandlerWithConfig(node.client, node.db, cfg)
+	handler.SetExpireHandler(node.AnnounceExpired)
+	if err := handler.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { handler.Stop() })
+
+	node.client.AddBlock(outpoint.WireOutPoint())
+	frame, ok := remote.next(MessageTypeExpire)
+	if !ok {
+		t.Fatal("no expire frame")
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err != nil || len(outpoints) != 1 || outpoints[0] != outpoint {
+		t.Fatalf("expired %v, %v, want %s", outpoints, err,
+			outpoint.ToString())
+	}
+
+	data, err := node.db.GetMessage(ctx, outpoint)
+	if err != nil || data != nil {
+		t.Fatalf("spent message still stored: %x, %v", data, err)
+	}
+	if known, err := node.db.HasOutpoint(ctx, outpoint); err != nil || known {
+		t.Fatalf("spent outpoint still known: %v, %v", known, err)
+	}
+}
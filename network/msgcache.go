@@ -0,0 +1,231 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// messageCacheEntryOverhead approximates the memory used by a cache entry
+// besides the message, counted against the cache size.
+const messageCacheEntryOverhead = 128
+
+// MessageCacheStats holds counters describing the cache of serialized
+// messages served to peers.
+type MessageCacheStats struct {
+	// Hits and Misses count the lookups answered from the cache and from
+	// the database.
+	Hits   uint64
+	Misses uint64
+
+	// Entries and Bytes are the messages cached and the memory they use,
+	// MaxBytes the configured bound.
+	Entries  int
+	Bytes    int64
+	MaxBytes int64
+}
+
+// cachedMessage is a serialized message in the cache, kept as the data frame
+// sending it.
+type cachedMessage struct {
+	outpoint message.Outpoint
+	frame    *sharedFrame
+}
+
+// size returns the bytes the entry counts against the cache size.
+func (c *cachedMessage) size() int64 {
+	return int64(len(c.frame.data)) + messageCacheEntryOverhead
+}
+
+// messageLoad is a database read of a message shared by the lookups of the
+// outpoint made while it is in flight.
+type messageLoad struct {
+	done  chan struct{}
+	frame *sharedFrame
+	err   error
+
+	// stale is set when the message is removed or replaced during the
+	// read, whose result must then not be cached.
+	stale bool
+}
+
+// messageCache is an LRU cache bounded in bytes of the serialized messages
+// recently stored or served, so that a message requested by many peers is
+// read from the database once. Messages are cached as data frames, which are
+// queued as they are to every peer sent the message. Evicting a message only
+// drops the reference of the cache to its frame. Messages the database evicts
+// to stay within its limits may still be served from the cache until they are
+// evicted from it too. It is safe for concurrent use.
+type messageCache struct {
+	maxBytes int64
+
+	entries map[message.Outpoint]*list.Element
+	order   *list.List
+	bytes   int64
+	loads   map[message.Outpoint]*messageLoad
+	mu      sync.Mutex
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// newMessageCache creates a cache holding up to maxBytes. A cache of zero or
+// fewer bytes caches nothing.
+func newMessageCache(maxBytes int64) *messageCache {
+	return &messageCache{
+		maxBytes: maxBytes,
+		entries:  make(map[message.Outpoint]*list.Element),
+		order:    list.New(),
+		loads:    make(map[message.Outpoint]*messageLoad),
+	}
+}
+
+// get returns the data frame of the cached message for outpoint, or reads the
+// message with load and caches it. Concurrent lookups of an outpoint missing
+// from the cache share a single read. It returns nil for messages that are
+// not found, which aren't cached.
+func (c *messageCache) get(ctx context.Context, outpoint message.Outpoint,
+	load func(context.Context, message.Outpoint) ([]byte, error)) (
+	*sharedFrame, error) {
+
+	c.mu.Lock()
+	if elem, ok := c.entries[outpoint]; ok {
+		c.order.MoveToFront(elem)
+		frame := elem.Value.(*cachedMessage).frame
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return frame, nil
+	}
+	c.misses.Add(1)
+	if pending, ok := c.loads[outpoint]; ok {
+		c.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.frame, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	pending := &messageLoad{done: make(chan struct{})}
+	c.loads[outpoint] = pending
+	c.mu.Unlock()
+
+	data, err := load(ctx, outpoint)
+	if err == nil && data != nil {
+		pending.frame = newSharedFrame(MessageTypeData, data)
+	}
+	pending.err = err
+
+	c.mu.Lock()
+	delete(c.loads, outpoint)
+	if !pending.stale && pending.frame != nil {
+		c.insert(&cachedMessage{outpoint: outpoint, frame: pending.frame})
+	}
+	c.mu.Unlock()
+	close(pending.done)
+
+	return pending.frame, pending.err
+}
+
+// peek returns the data frame of the cached message for outpoint if it is
+// msgData, or nil.
+func (c *messageCache) peek(outpoint message.Outpoint,
+	msgData []byte) *sharedFrame {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[outpoint]
+	if !ok {
+		return nil
+	}
+	frame := elem.Value.(*cachedMessage).frame
+	if !bytes.Equal(frame.payload(), msgData) {
+		return nil
+	}
+	return frame
+}
+
+// put caches a data frame carrying a copy of msgData for outpoint, replacing
+// any older version.
+func (c *messageCache) put(outpoint message.Outpoint, msgData []byte) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	entry := &cachedMessage{
+		outpoint: outpoint,
+		frame:    newSharedFrame(MessageTypeData, msgData),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pending, ok := c.loads[outpoint]; ok {
+		pending.stale = true
+	}
+	c.insert(entry)
+}
+
+// remove drops the messages for outpoints, which were removed from the
+// database or superseded.
+func (c *messageCache) remove(outpoints ...message.Outpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, outpoint := range outpoints {
+		if pending, ok := c.loads[outpoint]; ok {
+			pending.stale = true
+		}
+		if elem, ok := c.entries[outpoint]; ok {
+			c.drop(elem)
+		}
+	}
+}
+
+// insert adds entry, replacing the cached version of its outpoint, and
+// evicts the least recently used entries beyond the size of the cache. An
+// entry larger than the whole cache isn't cached. The caller must hold mu.
+func (c *messageCache) insert(entry *cachedMessage) {
+	if elem, ok := c.entries[entry.outpoint]; ok {
+		c.drop(elem)
+	}
+	if entry.size() > c.maxBytes {
+		return
+	}
+	for c.bytes+entry.size() > c.maxBytes {
+		c.drop(c.order.Back())
+	}
+	c.entries[entry.outpoint] = c.order.PushFront(entry)
+	c.bytes += entry.size()
+}
+
+// drop removes a cached entry. The caller must hold mu.
+func (c *messageCache) drop(elem *list.Element) {
+	entry := elem.Value.(*cachedMessage)
+	c.order.Remove(elem)
+	delete(c.entries, entry.outpoint)
+	c.bytes -= entry.size()
+}
+
+// stats returns the cache counters.
+func (c *messageCache) stats() MessageCacheStats {
+	c.mu.Lock()
+	entries, size := c.order.Len(), c.bytes
+	c.mu.Unlock()
+
+	return MessageCacheStats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Entries:  entries,
+		Bytes:    size,
+		MaxBytes: max(c.maxBytes, 0),
+	}
+}
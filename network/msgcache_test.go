@@ -0,0 +1,188 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// cacheEntrySize returns the bytes a message of n bytes counts against the
+// size of the message cache.
+func cacheEntrySize(n int) int64 {
+	entry := &cachedMessage{
+		frame: newSharedFrame(MessageTypeData, make([]byte, n)),
+	}
+	return entry.size()
+}
+
+// cached returns which of outpoints are in c.
+func cached(c *messageCache, outpoints ...message.Outpoint) []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	in := make([]bool, len(outpoints))
+	for i, outpoint := range outpoints {
+		_, in[i] = c.entries[outpoint]
+	}
+	return in
+}
+
+// TestMessageCacheEviction checks that a message too large for the room left
+// in the cache evicts as many of the least recently used messages as it
+// needs, and that a message larger than the cache isn't cached.
+func TestMessageCacheEviction(t *testing.T) {
+	const small = 100
+
+	smallSize := cacheEntrySize(small)
+	c := newMessageCache(3 * smallSize)
+	a, b, d := inventoryOutpoint(0), inventoryOutpoint(1),
+		inventoryOutpoint(2)
+	for _, outpoint := range []message.Outpoint{a, b, d} {
+		c.put(outpoint, make([]byte, small))
+	}
+
+	// Reading a makes b the least recently used
+	if frame, err := c.get(context.Background(), a, nil); err != nil ||
+		frame == nil {
+
+		t.Fatalf("cached message not found: %v", err)
+	}
+
+	// The large message takes the room of two small ones
+	large := inventoryOutpoint(3)
+	largeLen := small + int(smallSize)
+	if cacheEntrySize(largeLen) != 2*smallSize {
+		t.Fatalf("large entry of %d bytes", cacheEntrySize(largeLen))
+	}
+	c.put(large, make([]byte, largeLen))
+	got := cached(c, a, b, d, large)
+	if !got[0] || got[1] || got[2] || !got[3] {
+		t.Fatalf("cached a, b, d, large: %v, want only a and large", got)
+	}
+	if stats := c.stats(); stats.Entries != 2 ||
+		stats.Bytes != 3*smallSize {
+
+		t.Fatalf("cache holds %d entries of %d bytes", stats.Entries,
+			stats.Bytes)
+	}
+
+	// A message larger than the cache leaves it unchanged
+	huge := inventoryOutpoint(4)
+	c.put(huge, make([]byte, 3*small+int(2*smallSize)))
+	if got := cached(c, a, large, huge); !got[0] || !got[1] || got[2] {
+		t.Fatalf("cached a, large, huge: %v", got)
+	}
+}
+
+// TestMessageCacheInvalidation checks that a message removed from the
+// database or replaced is no longer served from the cache.
+func TestMessageCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newTestManager(t)
+
+	spent, replaced := inventoryOutpoint(0), inventoryOutpoint(1)
+	for _, outpoint := range []message.Outpoint{spent, replaced} {
+		err := m.storeMessageInDB(ctx, outpoint, []byte("first"),
+			database.MessageMeta{})
+		if err != nil {
+			t.Fatalf("storeMessageInDB: %v", err)
+		}
+	}
+	if frame, err := m.getDataFrame(ctx, spent); err != nil ||
+		frame == nil || m.msgCache.stats().Hits != 1 {
+
+		t.Fatalf("stored message not served from the cache: %v", err)
+	}
+
+	if err := m.db.RemoveOutpoint(ctx, spent); err != nil {
+		t.Fatalf("RemoveOutpoint: %v", err)
+	}
+	m.AnnounceExpired([]message.Outpoint{spent})
+	if frame, err := m.getDataFrame(ctx, spent); err != nil || frame != nil {
+		t.Fatalf("spent message served: %v", err)
+	}
+
+	err := m.storeMessageInDB(ctx, replaced, []byte("second"),
+		database.MessageMeta{})
+	if err != nil {
+		t.Fatalf("storeMessageInDB: %v", err)
+	}
+	frame, err := m.getDataFrame(ctx, replaced)
+	if err != nil || frame == nil ||
+		!bytes.Equal(frame.payload(), []byte("second")) {
+
+		t.Fatalf("replaced message served: %v", err)
+	}
+
+	// A read the message was removed during isn't cached
+	c := newMessageCache(1 << 20)
+	_, err = c.get(ctx, spent, func(context.Context, message.Outpoint) (
+		[]byte, error) {
+
+		c.remove(spent)
+		return []byte("stale"), nil
+	})
+	if err != nil || cached(c, spent)[0] {
+		t.Fatalf("message read across its removal cached: %v", err)
+	}
+}
+
+// countingDB counts the messages read from a database.
+type countingDB struct {
+	*database.MemoryDB
+	reads atomic.Int64
+}
+
+// GetMessage implements database.Database.
+func (db *countingDB) GetMessage(ctx context.Context,
+	outpoint message.Outpoint) ([]byte, error) {
+
+	db.reads.Add(1)
+	return db.MemoryDB.GetMessage(ctx, outpoint)
+}
+
+// BenchmarkGetDataConcurrent serves 100 concurrent getdata requests for a
+// message that isn't cached yet, reporting the database reads they cost,
+// which should be one.
+func BenchmarkGetDataConcurrent(b *testing.B) {
+	const requests = 100
+
+	ctx := context.Background()
+	m, _, memDB := newTestManager(b)
+	db := &countingDB{MemoryDB: memDB}
+	m.db = db
+	outpoint := inventoryOutpoint(0)
+	err := memDB.AddMessage(ctx, outpoint, bytes.Repeat([]byte{1}, 1000),
+		database.MessageMeta{})
+	if err != nil {
+		b.Fatalf("AddMessage: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.msgCache.remove(outpoint)
+
+		var wg sync.WaitGroup
+		for j := 0; j < requests; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				frame, err := m.getDataFrame(ctx, outpoint)
+				if err != nil || frame == nil {
+					b.Errorf("getDataFrame: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(db.reads.Load())/float64(b.N), "reads/op")
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// startCappedNode is startTestNode for a node accepting payloads of at most
+// payloadCap bytes.
+func startCappedNode(t *testing.T, cfg Config, payloadCap int) *testNode {
+	t.Helper()
+
+	client := mock.NewClient()
+	db := database.NewMemoryDB()
+	vcfg := database.DefaultValidatorConfig()
+	vcfg.Limits.MaxPayloadSize = payloadCap
+	m, err := NewManager(cfg, database.NewValidatorWithConfig(client, db,
+		vcfg), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { m.Stop() })
+	return &testNode{
+		Manager: m,
+		client:  client,
+		db:      db,
+		addr:    m.listener.Addr().String(),
+	}
+}
+
+// TestPayloadCap checks that a node capped at 1KB payloads refuses a 2KB
+// message from a peer with an exceeds-policy reject without scoring it, and
+// when it is submitted locally, while a default node accepts it.
+func TestPayloadCap(t *testing.T) {
+	ctx := context.Background()
+	capped := startCappedNode(t, testNodeConfig(), 1024)
+	open := startTestNode(t, testNodeConfig())
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	text := strings.Repeat("x", 2048)
+	for name, node := range map[string]*testNode{"capped": capped,
+		"default": open} {
+
+		msg := signTestMessage(t, node.client, outpoint, text)
+		remote := dialTestNode(t, node)
+		_, code, _ := response(t, remote, msg)
+
+		stored, err := node.db.GetMessage(ctx, outpoint)
+		if err != nil {
+			t.Fatalf("%s: GetMessage: %v", name, err)
+		}
+		if node == open {
+			if code != 0 || stored == nil {
+				t.Fatalf("default node answered %s, stored %v", code,
+					stored != nil)
+			}
+			continue
+		}
+		if code != RejectExceedsPolicy || stored != nil {
+			t.Fatalf("capped node answered %s, stored %v", code,
+				stored != nil)
+		}
+		if len(node.Stats().Peers) != 1 {
+			t.Fatal("peer disconnected for a message over the cap")
+		}
+		node.scoresMu.Lock()
+		score := node.scores["127.0.0.1"]
+		node.scoresMu.Unlock()
+		if score != 0 {
+			t.Fatalf("peer scored %d for a message over the cap", score)
+		}
+
+		_, err = node.SubmitMessage(ctx, msg.Serialize())
+		if !errors.Is(err, message.ErrExceedsPolicy) {
+			t.Fatalf("local message over the cap gave %v, want "+
+				"ErrExceedsPolicy", err)
+		}
+	}
+}
+
+// TestPayloadCapAnnounced checks that a node learns the payload cap of its
+// peer from the handshake and doesn't announce it larger messages.
+func TestPayloadCapAnnounced(t *testing.T) {
+	ctx := context.Background()
+	capped := startCappedNode(t, testNodeConfig(), 1024)
+	node := startTestNode(t, testNodeConfig(capped.addr))
+	waitFor(t, "connected to the capped node", func() bool {
+		return node.isConnected(capped.addr)
+	})
+
+	node.peersMu.RLock()
+	var peer *Peer
+	for _, p := range node.peers {
+		peer = p
+	}
+	node.peersMu.RUnlock()
+	if got := peer.maxPayload.Load(); got != 1024 {
+		t.Fatalf("peer announced a cap of %d bytes, want 1024", got)
+	}
+
+	large := signTestMessage(t, node.client, inventoryOutpoint(0),
+		strings.Repeat("x", 2048))
+	small := signTestMessage(t, node.client, inventoryOutpoint(1), "small")
+	for _, outpoint := range []message.Outpoint{large.Outpoint,
+		small.Outpoint} {
+
+		capped.client.AddUTXO(outpoint.WireOutPoint(), 50000,
+			utxoScript(t, node.client, outpoint))
+	}
+	for _, msg := range []*message.Message{large, small} {
+		if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+	}
+
+	// The small message is relayed, the large one never asked for
+	waitFor(t, "small message relayed", func() bool {
+		data, _ := capped.db.GetMessage(ctx, small.Outpoint)
+		return data != nil
+	})
+	if known, err := capped.db.HasOutpoint(ctx, large.Outpoint); err != nil ||
+		known {
+
+		t.Fatalf("message over the cap announced: %v", err)
+	}
+	if rejected := capped.Stats().MessagesRejected; rejected != 0 {
+		t.Fatalf("%d messages rejected by the capped node", rejected)
+	}
+}
@@ -6,15 +6,19 @@ package network
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/shaibearary/utxo_chat/database"
 	"github.com/shaibearary/utxo_chat/message"
 )
 
@@ -28,385 +32,1093 @@ const (
 	MessageTypeGetData MessageType = 0x02
 	// MessageTypeData is sent to deliver messages
 	MessageTypeData MessageType = 0x03
+	// MessageTypeAck is sent in response to an accepted data message
+	MessageTypeAck MessageType = 0x04
+	// MessageTypeReject is sent in response to a rejected data message
+	MessageTypeReject MessageType = 0x05
+	// MessageTypeGetInv is sent to request announcements of all stored
+	// messages
+	MessageTypeGetInv MessageType = 0x06
+	// MessageTypeExpire is sent to announce messages dropped because their
+	// UTXO was spent or their payload expired
+	MessageTypeExpire MessageType = 0x07
+	// MessageTypeVersion is exchanged once when a connection is opened to
+	// negotiate optional protocol features
+	MessageTypeVersion MessageType = 0x08
+	// MessageTypeInvFilter is sent ahead of a getinv with the short IDs of
+	// the messages the sender already has
+	MessageTypeInvFilter MessageType = 0x09
+	// MessageTypeDataBatch is sent instead of data frames to deliver the
+	// messages requested by a getdata from a peer supporting batches
+	MessageTypeDataBatch MessageType = 0x0a
+	// MessageTypeSetFilter is sent to a peer supporting relay filters to
+	// only be relayed the messages of some senders or channels
+	MessageTypeSetFilter MessageType = 0x0b
+	// MessageTypeGetAddr is sent to a peer supporting address gossip to
+	// ask for addresses of peers accepting connections
+	MessageTypeGetAddr MessageType = 0x0c
+	// MessageTypeAddr is sent in response to a getaddr with addresses of
+	// peers accepting connections
+	MessageTypeAddr MessageType = 0x0d
+	// MessageTypeTip is sent to peers on protocol version 6 or later when
+	// the best block of the sender changed
+	MessageTypeTip MessageType = 0x0e
+	// MessageTypeIdentity is sent during the handshake by a peer that
+	// announced an identity key, with a signature proving it holds it
+	MessageTypeIdentity MessageType = 0x0f
+
+	// maxMessageType is the highest message type of the peer protocol.
+	// Types up to it that we don't know were added by a later protocol
+	// version, higher ones are never valid.
+	maxMessageType MessageType = 0x7f
 )
 
+const (
+	// maxInvPerMessage is the maximum number of outpoints announced in a
+	// single inv message. It keeps inv frames well below the maximum frame
+	// size.
+	maxInvPerMessage = 1000
+
+	// outboundQueueSize is the number of frames that may be queued for a
+	// peer before backpressure applies.
+	outboundQueueSize = 256
+
+	// flushTimeout is the maximum time spent flushing queued frames, such as
+	// a reject explaining why the peer is dropped, on disconnect.
+	flushTimeout = 5 * time.Second
+)
+
+// errQueueFull is returned by SendMessage when the outbound queue of a peer
+// is full.
+var errQueueFull = errors.New("outbound queue full")
+
+// outboundFrame is a complete message waiting in a peer's outbound queue.
+type outboundFrame struct {
+	msgType MessageType
+	payload []byte
+
+	// shared is set for a frame serialized once for several peers, which
+	// carries payload.
+	shared *sharedFrame
+}
+
 // Peer represents a connected peer
 type Peer struct {
 	conn       net.Conn
 	manager    *Manager
 	addr       string
+	dialAddr   string // address dialed for outbound peers
+	outbound   bool
 	connected  bool
 	disconnect chan struct{}
 	mutex      sync.Mutex // Protects fields from concurrent access
-	ctx        context.Context
+
+	// ctx is canceled when the peer disconnects or the manager stops.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// forget is set when dialAddr was removed from the known peers, so it
+	// is not remembered once the peer disconnects.
+	forget atomic.Bool
+
+	// disconnectOnce makes Disconnect safe to call from the read loop, the
+	// writer and Manager.Stop at the same time.
+	disconnectOnce sync.Once
+
+	// sendQueue holds frames waiting to be written by writeMessages, the
+	// only goroutine writing to conn.
+	sendQueue  chan outboundFrame
+	writerDone chan struct{}
+
+	dataLimiter    *tokenBucket
+	invLimiter     *tokenBucket
+	rateViolations int
+	throttled      atomic.Uint64
+
+	// trusted is set once the handshake completed for a peer in the
+	// trusted peers, which is neither rate limited nor capped, and
+	// updated when they change.
+	trusted atomic.Bool
+
+	// validations holds a token per data message from the peer queued for
+	// or in validation, at most MaxPeerValidations.
+	validations chan struct{}
+
+	// pendingData holds the messages from the peer queued for or in
+	// validation, so that the peer resending one of them is skipped.
+	pendingData   map[inventoryKey]struct{}
+	pendingDataMu sync.Mutex
+
+	// duplicatesSkipped is the number of data messages from the peer
+	// skipped because they were known already.
+	duplicatesSkipped atomic.Uint64
+
+	// getDataCredit is the number of outpoints announced to the peer in
+	// response to getinv. Getdata requests for them are not rate limited.
+	getDataCredit atomic.Int64
+
+	// knownInv holds the messages the peer announced or was sent, which
+	// are not announced to it again.
+	knownInv *knownInventory
+
+	// announcements tracks which outpoints announced to the peer it
+	// fetched.
+	announcements *announceTracker
+
+	// version and services are the protocol version and service flags
+	// advertised by the peer, version is zero for legacy peers. checksum,
+	// compactInv and batchData are set when both sides support frame
+	// checksums, inventory filters and batches. They are only written by
+	// the handshake, before the writer starts, under mutex since stats
+	// reads them concurrently.
+	version    uint32
+	services   ServiceFlag
+	checksum   bool
+	compactInv bool
+	batchData  bool
+
+	// userAgent is the software the peer announced in the handshake,
+	// written along with version.
+	userAgent string
+
+	// challenge is the random challenge of our version message, which the
+	// identity signature of the peer must cover. peerKey is the hex
+	// encoded identity key the peer proved it holds, written by the
+	// handshake under mutex.
+	challenge [challengeSize]byte
+	peerKey   string
+
+	// listenAddr is the address an inbound peer announced it accepts
+	// connections on, its host with the port from the handshake. It is
+	// written along with version and empty if the peer doesn't listen.
+	listenAddr string
+
+	// probe is set for connections only made to verify that a peer accepts
+	// connections, which don't announce our own port.
+	probe bool
+
+	// addrRequested is set while a getaddr we sent is unanswered, and
+	// addrServed once the peer's getaddr was answered. Only one is
+	// answered per connection.
+	addrRequested atomic.Bool
+	addrServed    atomic.Bool
+
+	// maxPayload is the largest payload the peer announced it accepts,
+	// zero until the handshake or if it did not say. Larger messages are
+	// neither announced nor sent to it.
+	maxPayload atomic.Uint32
+
+	// tip is the best block the peer announced, nil until it does.
+	// lagging is set while it is more than MaxTipLag blocks behind ours.
+	tip     atomic.Pointer[ChainTip]
+	lagging atomic.Bool
+
+	// filter selects the messages relayed to the peer, nil for all of
+	// them. It is replaced by the read loop when the peer sends a
+	// setfilter.
+	filter atomic.Pointer[relayFilter]
+
+	// invFilter holds the inventory filter the peer is sending ahead of
+	// its getinv. It is only used by the read loop.
+	invFilter *invFilter
+
+	// checksumFailures is the number of frames from the peer that failed
+	// their checksum.
+	checksumFailures int
+
+	// unknownFrames is the number of frames of unknown types the peer sent
+	// in a row.
+	unknownFrames int
+
+	// Traffic counters. The last activity times are unix nanoseconds.
+	connectedAt   time.Time
+	bytesReceived atomic.Uint64
+	bytesSent     atomic.Uint64
+	lastRecv      atomic.Int64
+	lastSend      atomic.Int64
+
+	// bandwidth counts the traffic with the peer in the current window,
+	// for its upload cap. queuedBytes is the size of the frames queued
+	// for the peer but not written yet.
+	bandwidth   *bandwidthMeter
+	queuedBytes atomic.Int64
+}
+
+// NewPeer creates a peer for conn. It is disconnected once ctx, usually the
+// context of the manager, is canceled.
+func NewPeer(ctx context.Context, conn net.Conn, manager *Manager) *Peer {
+	ctx, cancel := context.WithCancel(ctx)
+	limits := manager.settings()
+	p := &Peer{
+		conn:          conn,
+		manager:       manager,
+		addr:          conn.RemoteAddr().String(),
+		connected:     true,
+		disconnect:    make(chan struct{}),
+		ctx:           ctx,
+		cancel:        cancel,
+		sendQueue:     make(chan outboundFrame, outboundQueueSize),
+		writerDone:    make(chan struct{}),
+		connectedAt:   time.Now(),
+		knownInv:      newKnownInventory(maxKnownInventory),
+		announcements: newAnnounceTracker(),
+		validations:   make(chan struct{}, manager.config.MaxPeerValidations),
+		pendingData:   make(map[inventoryKey]struct{}),
+		dataLimiter: newTokenBucket(limits.DataRateLimit,
+			limits.DataRateBurst),
+		invLimiter: newTokenBucket(limits.InvRateLimit,
+			limits.InvRateBurst),
+		bandwidth: newBandwidthMeter(bandwidthWindow),
+	}
+	rand.Read(p.challenge[:])
+
+	// Disconnect when the manager stops
+	context.AfterFunc(ctx, p.Disconnect)
+	return p
+}
+
+// announced returns the protocol version and user agent the peer announced
+// in the handshake.
+func (p *Peer) announced() (uint32, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.version, p.userAgent
+}
+
+// listenAddress returns the address an inbound peer announced it accepts
+// connections on, empty if it didn't.
+func (p *Peer) listenAddress() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.listenAddr
 }
 
-// NewPeer creates a new peer
-func NewPeer(conn net.Conn, manager *Manager) *Peer {
-	return &Peer{
-		conn:       conn,
-		manager:    manager,
-		addr:       conn.RemoteAddr().String(),
-		connected:  true,
-		disconnect: make(chan struct{}),
-		ctx:        context.Background(),
+// acceptsPayload reports whether the peer accepts a message with a payload
+// of size bytes, as far as it announced.
+func (p *Peer) acceptsPayload(size int) bool {
+	limit := p.maxPayload.Load()
+	return limit == 0 || size <= int(limit)
+}
+
+// acceptsMessage is acceptsPayload for the serialized message msgData.
+func (p *Peer) acceptsMessage(msgData []byte) bool {
+	if len(msgData) < message.HeaderSize {
+		return true
+	}
+	size := binary.LittleEndian.Uint16(msgData[message.LengthOffset:])
+	return p.acceptsPayload(int(size))
+}
+
+// Throttled returns the number of messages from this peer dropped for
+// exceeding its rate limit.
+func (p *Peer) Throttled() uint64 {
+	return p.throttled.Load()
+}
+
+// allowMessage applies the per-peer rate limit for the given message type. It
+// returns false if the message should be dropped. Traffic we asked for, such
+// as data we requested or getdata for inventory we served, and traffic from
+// trusted peers is not limited.
+func (p *Peer) allowMessage(msgType MessageType, payload []byte) bool {
+	if p.trusted.Load() {
+		return true
+	}
+
+	var limiter *tokenBucket
+	switch msgType {
+	case MessageTypeData:
+		if len(payload) >= message.OutpointSize {
+			var outpoint message.Outpoint
+			copy(outpoint[:], payload)
+			if p.manager.requests.requestedFrom(outpoint, p) {
+				return true
+			}
+		}
+		limiter = p.dataLimiter
+	case MessageTypeGetData:
+		// A getdata from a peer supporting batches spends a credit per
+		// outpoint
+		items := int64(1)
+		if p.batchData && len(payload) >= 2 {
+			items = int64(binary.LittleEndian.Uint16(payload))
+		}
+		if p.getDataCredit.Add(-items) >= 0 {
+			return true
+		}
+		p.getDataCredit.Add(items)
+		limiter = p.invLimiter
+	case MessageTypeInv, MessageTypeGetInv, MessageTypeExpire,
+		MessageTypeInvFilter, MessageTypeSetFilter, MessageTypeGetAddr,
+		MessageTypeAddr, MessageTypeTip:
+		limiter = p.invLimiter
+	case MessageTypeAck, MessageTypeReject, MessageTypeVersion:
+		return true
+	case MessageTypeDataBatch:
+		// Entries we didn't request are limited one by one
+		return true
+	default:
+		// Frames we skip still cost reading them
+		limiter = p.invLimiter
+	}
+
+	if limiter.allow() {
+		return true
 	}
+
+	p.rateViolations++
+	p.throttled.Add(1)
+	p.manager.throttledMsgs.Add(1)
+	return false
 }
 
-// Handle starts handling communication with the peer
+// Handle starts handling communication with the peer. It returns once the
+// peer is disconnected and its queued frames have been flushed.
 func (p *Peer) Handle() {
-	// Set read deadline for the initial handshake
-	p.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	reader := bufio.NewReader(p.conn)
+	if err := p.handshake(reader); err != nil {
+		log.Debugf("Handshake with peer %s failed: %v", p.addr, err)
+		if errors.Is(err, errSelfConnection) && p.outbound {
+			p.forget.Store(true)
+		}
+		if kind, ok := misbehaviorKind(err); ok {
+			p.manager.addMisbehavior(p, kind)
+		}
+		p.Disconnect()
+		return
+	}
+
+	// Trust may depend on the identity proven in the handshake
+	if p.manager.trusts(p) {
+		log.Debugf("Peer %s is trusted", p.addr)
+		p.trusted.Store(true)
+	}
 
-	// TODO: Implement peer handshake
+	// Frames queued during the handshake are written now that the frame
+	// format is settled
+	go p.writeMessages()
+	defer func() {
+		<-p.writerDone
+	}()
 
-	// If we get here, handshake was successful
-	// Reset the deadline for normal operation
-	p.conn.SetReadDeadline(time.Time{})
+	// Remember that outbound peers accept connections, and check that
+	// inbound peers do where they say so they can be dialed back
+	if p.outbound {
+		p.manager.addrManager.Verified(p.dialAddr)
+		if key := p.identity(); key != "" {
+			for _, old := range p.manager.addrManager.Identified(p.dialAddr,
+				key) {
 
-	// Start reading messages from peer
-	p.readMessages()
+				log.Infof("Peer %s with identity %s moved from %s",
+					p.dialAddr, key, old)
+			}
+		}
+	} else if listenAddr := p.listenAddress(); listenAddr != "" {
+		p.manager.probeAddress(listenAddr)
+	}
+
+	// Announce our own messages that too few peers have seen
+	p.manager.announcePending(p)
 
+	// Ask outbound and trusted peers for everything they have so messages
+	// broadcast before we came online are synced, or the part of it we
+	// filter for
+	if p.outbound || p.trusted.Load() {
+		if err := p.sendRelayFilter(); err != nil {
+			log.Debugf("Failed to send relay filter to peer %s: %v", p.addr, err)
+		}
+		if err := p.requestInventory(0); err != nil {
+			log.Debugf("Failed to request inventory from peer %s: %v", p.addr, err)
+		}
+	}
+	if p.outbound {
+		if err := p.requestAddresses(); err != nil {
+			log.Debugf("Failed to request addresses from peer %s: %v", p.addr, err)
+		}
+	}
+
+	// Start reading messages from peer
+	p.readMessages(reader)
 }
 
 // readMessages reads and processes incoming messages from the peer
-func (p *Peer) readMessages() {
+func (p *Peer) readMessages(reader *bufio.Reader) {
 	defer func() {
 		p.Disconnect()
 	}()
-	reader := bufio.NewReader(p.conn)
 
 	for {
 		select {
 		case <-p.disconnect:
-			log.Printf("Disconnect signal received for peer %s", p.addr)
+			log.Debugf("Disconnect signal received for peer %s", p.addr)
+			return
+		case <-p.ctx.Done():
 			return
 		default:
 		}
 
 		// Log the incoming message
-		log.Printf("Receiving message from peer %s", p.addr)
+		log.Tracef("Receiving message from peer %s", p.addr)
 
-		// --- Read Message Type ---
-		// Read exactly one byte for the message type
-		msgTypeByte, err := reader.ReadByte()
+		// --- Read Frame ---
+		var maxBatch uint32
+		if p.batchData {
+			maxBatch = maxBatchSize
+		}
+		frame, err := p.readNextFrame(reader, maxBatch)
+		msgType, payload := frame.msgType, frame.payload
+		if errors.Is(err, ErrBadChecksum) {
+			p.recordReceived(uint64(headerSize(true) + frame.size))
+			p.checksumFailures++
+			if p.checksumFailures > p.manager.config.MaxChecksumFailures {
+				log.Warnf("Peer %s repeatedly sent corrupted frames. Disconnecting.", p.addr)
+				return
+			}
+			log.Debugf("Dropping frame from peer %s: %v", p.addr, err)
+			continue
+		}
 		if err != nil {
 			// Handle common errors cleanly
+			var netErr net.Error
+			select {
+			case <-p.disconnect:
+				log.Debugf("Disconnect signal received for peer %s", p.addr)
+				return
+			default:
+			}
 			if err == io.EOF {
-				log.Printf("Connection closed by peer %s (EOF)", p.addr)
-			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("Read timeout from peer %s: %v", p.addr, err)
-				// You might want to continue here or disconnect depending on your protocol
-			} else if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				// This specific check might be redundant if EOF covers it, but can be explicit
-				log.Printf("Attempted read on closed connection from peer %s", p.addr)
+				log.Debugf("Connection closed by peer %s (EOF)", p.addr)
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Debugf("Read timeout from peer %s: %v", p.addr, err)
+			} else if errors.Is(err, net.ErrClosed) {
+				log.Debugf("Attempted read on closed connection from peer %s", p.addr)
 			} else {
-				log.Printf("Error reading message type from peer %s: %v", p.addr, err)
+				log.Debugf("Error reading frame from peer %s: %v", p.addr, err)
 			}
 			return // Disconnect on any read error
 		}
 
-		msgType := MessageType(msgTypeByte)
-		log.Printf("Received message type %d (0x%x) from peer %s", msgType, msgType, p.addr)
+		p.recordReceived(uint64(headerSize(p.checksum) + frame.size))
+		p.lastRecv.Store(time.Now().UnixNano())
+
+		log.Tracef("Received message type %d (0x%x, %d bytes) from peer %s",
+			msgType, msgType, frame.size, p.addr)
+
+		// --- Apply rate limits ---
+		if !p.allowMessage(msgType, payload) {
+			if p.rateViolations > p.manager.settings().MaxRateViolations {
+				log.Warnf("Peer %s repeatedly exceeded its rate limit. Disconnecting.", p.addr)
+				p.manager.recordThrottled(p.addr)
+				return
+			}
+			log.Debugf("Dropping message type %d from peer %s: rate limit exceeded", msgType, p.addr)
+			continue
+		}
 
 		// --- Process based on message type ---
-		// Now read the rest of the message based on its type
+		var handleErr error
 		switch msgType {
 		case MessageTypeInv:
-			// Pass the reader to the handler function
-			if err := p.handleInvMessage(reader); err != nil {
-				log.Printf("Error handling inv message from peer %s: %v", p.addr, err)
-				return
-			}
+			handleErr = p.handleInvMessage(bytes.NewReader(payload))
 
 		case MessageTypeGetData:
-			// Pass the reader to the handler function
-			if err := p.handleGetDataMessage(reader); err != nil {
-				log.Printf("Error handling getdata message from peer %s: %v", p.addr, err)
-				return
-			}
+			handleErr = p.handleGetDataMessage(bytes.NewReader(payload))
 
 		case MessageTypeData:
-			// Pass the reader to the handler function
-			if err := p.handleDataMessage(reader); err != nil {
-				log.Printf("Error handling data message from peer %s: %v", p.addr, err)
-				return
-			}
+			handleErr = p.handleDataMessage(frame)
+
+		case MessageTypeDataBatch:
+			handleErr = p.handleDataBatchMessage(frame)
+
+		case MessageTypeGetInv:
+			handleErr = p.handleGetInvMessage(payload)
+
+		case MessageTypeAck:
+			handleErr = p.handleAckMessage(payload)
+
+		case MessageTypeReject:
+			handleErr = p.handleRejectMessage(payload)
+
+		case MessageTypeExpire:
+			handleErr = p.handleExpireMessage(payload)
+
+		case MessageTypeInvFilter:
+			handleErr = p.handleInvFilterMessage(payload)
+
+		case MessageTypeSetFilter:
+			handleErr = p.handleSetFilterMessage(payload)
+
+		case MessageTypeGetAddr:
+			handleErr = p.handleGetAddrMessage(payload)
+
+		case MessageTypeAddr:
+			handleErr = p.handleAddrMessage(payload)
+
+		case MessageTypeTip:
+			handleErr = p.handleTipMessage(payload)
+
+		case MessageTypeVersion, MessageTypeIdentity:
+			handleErr = misbehaving(MisbehaviorMalformed,
+				fmt.Errorf("unexpected message type %d after "+
+					"handshake", msgType))
 
 		default:
-			log.Printf("Received unknown message type %d from peer %s. Disconnecting.", msgType, p.addr)
-			return // Disconnect on unknown type
+			handleErr = p.skipUnknown(msgType)
+			if handleErr == nil {
+				continue
+			}
+		}
+		p.unknownFrames = 0
+
+		if handleErr != nil {
+			log.Warnf("Error handling message type %d from peer %s: %v. Disconnecting.",
+				msgType, p.addr, handleErr)
+			if kind, ok := misbehaviorKind(handleErr); ok {
+				p.manager.addMisbehavior(p, kind)
+			}
+			return // Disconnect on any handling error
 		}
 	}
 }
 
-// handleInvMessage processes an inventory message from a peer
-func (p *Peer) handleInvMessage(reader *bufio.Reader) error {
-	// Read count of inventory items
-	countBytes := make([]byte, 2)
-	if _, err := io.ReadFull(reader, countBytes); err != nil {
-		return fmt.Errorf("failed to read inv count: %v", err)
+// readNextFrame waits for the next frame from the peer and reads it with
+// readInboundFrame. Peers may stay silent as long as they like, but once a
+// frame started the rest of it must arrive within ReadTimeout, so a peer
+// can't hold a frame buffer by trickling its bytes in.
+func (p *Peer) readNextFrame(reader *bufio.Reader,
+	maxBatch uint32) (inboundFrame, error) {
+
+	if _, err := reader.Peek(1); err != nil {
+		return inboundFrame{}, err
 	}
 
-	count := binary.LittleEndian.Uint16(countBytes)
+	timeout := time.Duration(p.manager.config.ReadTimeout) * time.Second
+	p.setReadDeadline(time.Now().Add(timeout))
+	defer p.setReadDeadline(time.Time{})
+
+	return readInboundFrame(reader, p.manager.config.MaxFrameSize, maxBatch,
+		p.checksum, p.manager.validator.Limits(), p.knownData)
+}
+
+// setReadDeadline sets the read deadline of the connection, unless the peer
+// is disconnecting, which already unblocked its reads.
+func (p *Peer) setReadDeadline(t time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.connected {
+		p.conn.SetReadDeadline(t)
+	}
+}
 
-	// Read each inventory item (txid + vout)
-	for i := uint16(0); i < count; i++ {
-		outpointBytes := make([]byte, message.OutpointSize)
-		if _, err := io.ReadFull(reader, outpointBytes); err != nil {
-			return fmt.Errorf("failed to read outpoint %d: %v", i, err)
+// skipUnknown drops a frame of a type we don't know. A peer on a later
+// protocol version may send types added since ours, which are ignored up to
+// MaxUnknownFrames in a row. Anything else is a protocol violation.
+func (p *Peer) skipUnknown(msgType MessageType) error {
+	if p.version <= ProtocolVersion || msgType > maxMessageType {
+		return misbehaving(MisbehaviorUnknownType,
+			fmt.Errorf("unknown message type %d", msgType))
+	}
+
+	p.unknownFrames++
+	p.manager.unknownFrames.Add(1)
+	if p.unknownFrames > p.manager.config.MaxUnknownFrames {
+		return misbehaving(MisbehaviorUnknownType, fmt.Errorf(
+			"%d frames of unknown types in a row", p.unknownFrames))
+	}
+
+	log.Debugf("Ignoring unknown message type %d from peer %s on protocol "+
+		"version %d", msgType, p.addr, p.version)
+	return nil
+}
+
+// handleInvMessage processes an inventory message from a peer, read from r.
+// The payload is a 2-byte little-endian item count followed by that many
+// outpoints.
+func (p *Peer) handleInvMessage(r io.Reader) error {
+	outpoints, err := readInvPayload(r)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	var wanted []message.Outpoint
+	for _, outpoint := range outpoints {
+		p.knownInv.add(inventoryKey{outpoint: outpoint})
+
+		// Don't fetch what we would refuse anyway
+		if !p.manager.whitelist.mayAllow(outpoint) {
+			continue
 		}
-		var outpoint message.Outpoint
-		copy(outpoint[:], outpointBytes[:])
 
 		// Check in the database if we've already seen this outpoint
 		hasOutpoint, err := p.manager.db.HasOutpoint(p.ctx, outpoint)
 		if err != nil {
-			log.Printf("Error checking outpoint in database: %v", err)
+			log.Warnf("Error checking outpoint in database: %v", err)
 			continue
 		}
 
-		// If we don't have it, request it
-		if !hasOutpoint {
-			// Queue a get data request
-			go p.requestData(outpoint)
+		// If we don't have it and haven't asked another peer yet, request
+		// it
+		if !hasOutpoint && p.manager.requests.request(outpoint, p, time.Now()) {
+			wanted = append(wanted, outpoint)
 		}
 	}
 
+	if len(wanted) > 0 {
+		go p.requestData(wanted...)
+	}
 	return nil
 }
 
-// handleGetDataMessage processes a get data message from a peer
-func (p *Peer) handleGetDataMessage(reader *bufio.Reader) error {
-	// Read outpoint
-	outpointBytes := make([]byte, message.OutpointSize)
-	if _, err := io.ReadFull(reader, outpointBytes); err != nil {
-		return fmt.Errorf("failed to read outpoint: %v", err)
+// handleExpireMessage processes an expire message from a peer. The payload
+// has the inv format. Expiry is only logged: the node learns about spent
+// UTXOs from its own Bitcoin node rather than trusting peers.
+func (p *Peer) handleExpireMessage(payload []byte) error {
+	outpoints, err := readInvPayload(bytes.NewReader(payload))
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
 	}
 
-	// Convert to outpoint
-	var outpoint message.Outpoint
-	copy(outpoint[:], outpointBytes[:])
+	log.Debugf("Peer %s expired %d messages", p.addr, len(outpoints))
+	return nil
+}
+
+// handleGetDataMessage processes a get data message from a peer, read from
+// r. The payload is a single outpoint, or has the inv format for peers
+// supporting batches.
+func (p *Peer) handleGetDataMessage(r io.Reader) error {
+	if p.batchData {
+		return p.handleGetDataBatch(r)
+	}
+	outpoint, err := readGetDataPayload(r)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+	p.announcements.fetch(outpoint, time.Now())
 
 	// Get the message from database
-	msgData, err := p.manager.getMessageFromDB(p.ctx, outpoint)
+	frame, err := p.manager.getDataFrame(p.ctx, outpoint)
+	if errors.Is(err, database.ErrEvicted) {
+		log.Debugf("Peer requested evicted message: %s", outpoint.ToString())
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get message from database: %v", err)
 	}
 
 	// If we don't have the message, ignore
-	if msgData == nil {
-		log.Printf("Peer requested message we don't have: %s", outpoint.ToString())
+	if frame == nil {
+		log.Debugf("Peer requested message we don't have: %s", outpoint.ToString())
+		return nil
+	}
+	msgData := frame.payload()
+	if !p.acceptsMessage(msgData) {
+		log.Debugf("Not sending message %s over the payload limit of "+
+			"peer %s", outpoint.ToString(), p.addr)
 		return nil
 	}
 
-	// Send the message
-	return p.sendDataMessage(msgData)
+	if err := p.checkUploadCap(len(msgData)); err != nil {
+		return p.rejectBusy(outpoint, err)
+	}
+
+	// Send the frame shared with the message cache
+	return p.sendShared(frame)
 }
 
-// handleDataMessage processes a data message from a peer
-func (p *Peer) handleDataMessage(reader *bufio.Reader) error {
-	// Read the outpoint (36 bytes)
-	outpointBuf := make([]byte, message.OutpointSize)
-	if _, err := io.ReadFull(reader, outpointBuf); err != nil {
-		return fmt.Errorf("failed to read outpoint: %v", err)
+// handleGetInvMessage processes a getinv message from a peer. The payload is
+// a 4-byte little-endian limit on the number of outpoints to announce, where
+// zero asks for as many as the node is willing to serve. The stored outpoints
+// are announced oldest first in inv messages of at most maxInvPerMessage
+// items, skipping those matched by an inventory filter the peer sent ahead
+// and those its relay filter doesn't match.
+func (p *Peer) handleGetInvMessage(payload []byte) error {
+	if len(payload) != 4 {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invalid getinv length: %d", len(payload)))
 	}
 
-	// Read the signature (64 bytes)
-	signatureBuf := make([]byte, message.SignatureSize)
-	if _, err := io.ReadFull(reader, signatureBuf); err != nil {
-		return fmt.Errorf("failed to read signature: %v", err)
+	filter := p.takeInvFilter()
+	relay := p.filter.Load()
+	if p.manager.config.DisableInventoryServe {
+		log.Debugf("Ignoring getinv from peer %s: inventory serving disabled", p.addr)
+		return nil
 	}
 
-	// Read the length (2 bytes)
-	lengthBuf := make([]byte, message.LengthSize)
-	if _, err := io.ReadFull(reader, lengthBuf); err != nil {
-		return fmt.Errorf("failed to read length: %v", err)
+	limit := int(binary.LittleEndian.Uint32(payload))
+	if limit == 0 || limit > p.manager.config.MaxInventoryServe {
+		limit = p.manager.config.MaxInventoryServe
 	}
 
-	// Extract payload length
-	payloadLength := binary.LittleEndian.Uint16(lengthBuf)
-
-	// Check for reasonable size
-	if payloadLength > message.MaxPayloadSize {
-		return fmt.Errorf("invalid payload length: %d", payloadLength)
-	}
+	var cursor string
+	served, filtered := 0, 0
+	for served < limit {
+		entries, next, err := p.manager.ListMessages(p.ctx, cursor,
+			maxInvPerMessage)
+		if err != nil {
+			return fmt.Errorf("failed to list messages: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
 
-	// Allocate buffer for the entire message
-	totalSize := message.HeaderSize + int(payloadLength)
-	msgData := make([]byte, totalSize)
+		outpoints := make([]message.Outpoint, 0, len(entries))
+		for _, entry := range entries {
+			if served+len(outpoints) == limit {
+				break
+			}
+			if !relay.matchesMeta(&entry.Meta) {
+				continue
+			}
+			p.knownInv.add(inventoryKey{outpoint: entry.Outpoint})
+			if filter.has(entry.Outpoint) {
+				filtered++
+				continue
+			}
+			outpoints = append(outpoints, entry.Outpoint)
+		}
+		cursor = next
+		if len(outpoints) == 0 {
+			continue
+		}
 
-	// Copy header components to the buffer
-	copy(msgData[0:message.OutpointSize], outpointBuf)
-	copy(msgData[message.OutpointSize:message.OutpointSize+message.SignatureSize], signatureBuf)
-	copy(msgData[message.OutpointSize+message.SignatureSize:message.HeaderSize], lengthBuf)
-	// Read the payload if there is any
-	// Read the payload directly into the message buffer based on payload length
-	payloadBuf := make([]byte, payloadLength)
-	if payloadLength > 0 {
-		if _, err := io.ReadFull(reader, payloadBuf); err != nil {
-			return fmt.Errorf("failed to read message payload: %v", err)
+		// Repeated getinv requests must not build up unlimited credit
+		credit := p.getDataCredit.Add(int64(len(outpoints)))
+		if max := int64(p.manager.config.MaxInventoryServe); credit > max {
+			p.getDataCredit.Store(max)
 		}
-		// Copy payload into the message data buffer
-		copy(msgData[message.HeaderSize:], payloadBuf)
+		if err := p.SendMessage(MessageTypeInv, newInvPayload(outpoints...)); err != nil {
+			return err
+		}
+		served += len(outpoints)
 	}
 
-	// Log the message parts for debugging
-	var outpoint message.Outpoint
-	copy(outpoint[:], outpointBuf)
-	log.Printf("Received message - Outpoint: %x:%d, Payload length: %d bytes",
-		outpointBuf[:32], binary.LittleEndian.Uint32(outpointBuf[32:36]), payloadLength)
+	log.Debugf("Announced %d stored messages to peer %s, %d it already has",
+		served, p.addr, filtered)
+	return nil
+}
 
-	// Deserialize the message
-	msg, err := message.Deserialize(msgData)
-	if err != nil {
-		return fmt.Errorf("failed to deserialize message: %v", err)
+// handleDataMessage processes a data frame from a peer, whose message was
+// decoded while the frame was read. The message is handed to the validation
+// workers, which answer the peer with an ack if it was accepted or a reject
+// explaining why it wasn't.
+func (p *Peer) handleDataMessage(frame inboundFrame) error {
+	if frame.msg != nil {
+		p.knownInv.add(inventoryKey{frame.msg.Outpoint, frame.msg.Sequence})
 	}
 
-	// Validate the message using our validator
-	// Get public key from payload (this would depend on your message format)
-	pkScript, err := p.extractPKScript(outpoint[:])
-	if err != nil {
-		return fmt.Errorf("failed to extract public key: %v", err)
+	if errors.Is(frame.decodeErr, message.ErrDuplicateOutpoint) {
+		return p.skipDuplicate(frame.outpoint, frame.sequence)
 	}
-
-	// Use context from peer
-	if err := p.manager.validator.ValidateMessage(p.ctx, msg, pkScript); err != nil {
-		return fmt.Errorf("invalid message: %v", err)
+	if errors.Is(frame.decodeErr, message.ErrExceedsPolicy) {
+		p.manager.rejectMessage(frame.outpoint, nil, p.addr,
+			frame.decodeErr)
+		return p.answerData(frame.outpoint, frame.decodeErr)
+	}
+	if frame.decodeErr != nil {
+		// Messages that failed to decode are rejected with a zero
+		// outpoint
+		err := misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("failed to deserialize message: %w", frame.decodeErr))
+		p.manager.rejectMessage(message.Outpoint{}, nil, p.addr, err)
+		return p.answerData(message.Outpoint{}, err)
 	}
 
-	// If valid, save to database and broadcast to other peers
+	p.manager.queueValidation(p, frame.msg, frame.payload, false)
+	return nil
+}
 
-	// Store original message data in database
-	if err := p.manager.storeMessageInDB(p.ctx, msg.Outpoint, msgData); err != nil {
-		return fmt.Errorf("failed to save message to database: %v", err)
+// answerData answers a data message with an ack if it was accepted or only
+// dropped because it is blocked, or a reject explaining err otherwise. It
+// returns err if it is a protocol violation that costs the connection.
+func (p *Peer) answerData(outpoint message.Outpoint, err error) error {
+	if err == nil || errors.Is(err, ErrBlocked) {
+		return p.SendMessage(MessageTypeAck, outpoint[:])
 	}
 
-	// Broadcast to other peers
-	p.manager.broadcastToOtherPeers(p, msg.Outpoint, msgData)
+	code := rejectCodeFor(err)
+	reject := newRejectPayload(outpoint, code, err.Error())
+	if sendErr := p.SendMessage(MessageTypeReject, reject); sendErr != nil {
+		log.Debugf("Failed to send reject to peer %s: %v", p.addr, sendErr)
+	}
 
+	// Only protocol violations cost the connection. A duplicate or spent
+	// outpoint is answered with the reject alone.
+	if _, ok := misbehaviorKind(err); ok {
+		return err
+	}
+	log.Debugf("Rejected message %s from peer %s (%s): %v",
+		outpoint.ToString(), p.addr, code, err)
 	return nil
 }
 
-// Helper function to extract public key from payload
-// The format will depend on your specific implementation
-func (p *Peer) extractPKScript(outpoint []byte) ([]byte, error) {
-	// Extract the txid and vout from the outpoint
-	txid, _ := message.Outpoint(outpoint).ToTxidIdx()
-
-	// Get the UTXO from Bitcoin node
-	// Convert txid to chainhash.Hash (reversing the bytes)
+// handleAckMessage processes an ack for a data message we sent. The payload
+// is the accepted outpoint.
+func (p *Peer) handleAckMessage(payload []byte) error {
+	if len(payload) != message.OutpointSize {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("invalid ack length: %d", len(payload)))
+	}
 
-	// Convert vout bytes to uint32 (little-endian)
-	voutValue := binary.LittleEndian.Uint32(outpoint[32:36])
+	var outpoint message.Outpoint
+	copy(outpoint[:], payload)
+	log.Debugf("Peer %s accepted message %s", p.addr, outpoint.ToString())
+	if p.manager.journal.ack(outpoint, p.addr) {
+		log.Debugf("Message %s acknowledged by enough peers",
+			outpoint.ToString())
+	}
+	return nil
+}
 
-	txOut, err := p.manager.validator.GetTxOut(txid, voutValue, false)
+// handleRejectMessage processes a reject for a data message we sent.
+func (p *Peer) handleRejectMessage(payload []byte) error {
+	outpoint, code, reason, err := parseRejectPayload(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get UTXO info: %v", err)
+		return misbehaving(MisbehaviorMalformed, err)
 	}
 
-	// Check if the UTXO exists
-	if txOut == nil {
-		return nil, fmt.Errorf("outpoint does not exist or is spent")
+	if code == RejectUnauthorizedPeer {
+		log.Warnf("Peer %s does not allow our identity %s: %s", p.addr,
+			p.manager.IdentityKey(), reason)
+		return nil
 	}
 
-	// Check if the UTXO is a taproot output
-	if !p.manager.validator.IsTaprootOutput(txOut) {
-		return nil, fmt.Errorf("outpoint is not a taproot output")
+	log.Debugf("Peer %s rejected message %s (%s): %s", p.addr,
+		outpoint.ToString(), code, reason)
+
+	// A busy peer won't send what we asked for, ask the next peer that
+	// announced it rather than waiting for the request to time out
+	if code == RejectBusy {
+		if next := p.manager.requests.reassign(outpoint, p,
+			time.Now()); next != nil {
+
+			go next.requestData(outpoint)
+		}
 	}
+	return nil
+}
 
-	// Extract the taproot pubkey from the UTXO
-	pkScript, err := p.manager.validator.GetTaprootPKScript(txOut)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract taproot pubkey: %v", err)
+// requestInventory sends a getinv message asking the peer to announce up to
+// limit stored messages. Zero leaves the limit to the peer. Peers supporting
+// inventory filters are first told which messages we have.
+func (p *Peer) requestInventory(limit uint32) error {
+	if p.compactInv {
+		if err := p.sendInvFilter(); err != nil {
+			return err
+		}
 	}
 
-	return pkScript, nil
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, limit)
+	return p.SendMessage(MessageTypeGetInv, payload)
 }
 
-// requestData sends a getdata message to the peer
-func (p *Peer) requestData(outpoint message.Outpoint) error {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-
-	if !p.connected {
-		return fmt.Errorf("peer disconnected")
+// requestData sends getdata messages to the peer. Peers supporting batches
+// are asked for up to maxInvPerMessage outpoints at once, others for one per
+// message.
+func (p *Peer) requestData(outpoints ...message.Outpoint) error {
+	if !p.batchData {
+		for _, outpoint := range outpoints {
+			if err := p.SendMessage(MessageTypeGetData, outpoint[:]); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	// Prepare getdata message
-	msgBytes := make([]byte, 1+message.OutpointSize)
-	msgBytes[0] = byte(MessageTypeGetData)
-	copy(msgBytes[1:37], outpoint[:])
-
-	// Send message
-	_, err := p.conn.Write(msgBytes)
-	return err
+	for start := 0; start < len(outpoints); start += maxInvPerMessage {
+		end := min(start+maxInvPerMessage, len(outpoints))
+		payload := newInvPayload(outpoints[start:end]...)
+		if err := p.SendMessage(MessageTypeGetData, payload); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // sendDataMessage sends a data message to the peer
 func (p *Peer) sendDataMessage(msgData []byte) error {
+	return p.SendMessage(MessageTypeData, msgData)
+}
+
+// SendMessage queues a single framed message for the peer. When the outbound
+// queue is full inv and expire messages are dropped, since they are only
+// announcements, and getdata requests wait for room, since they are always sent from
+// their own goroutine. Any other message disconnects the peer.
+func (p *Peer) SendMessage(msgType MessageType, data []byte) error {
+	return p.queueFrame(outboundFrame{msgType: msgType, payload: data})
+}
+
+// sendShared queues a frame serialized once for several peers like
+// SendMessage, without copying it.
+func (p *Peer) sendShared(frame *sharedFrame) error {
+	return p.queueFrame(outboundFrame{
+		msgType: frame.msgType,
+		payload: frame.payload(),
+		shared:  frame,
+	})
+}
+
+// queueFrame adds frame to the outbound queue as described by SendMessage.
+func (p *Peer) queueFrame(frame outboundFrame) error {
+	msgType := frame.msgType
+
 	p.mutex.Lock()
-	defer p.mutex.Unlock()
+	connected := p.connected
+	p.mutex.Unlock()
+	if !connected {
+		return fmt.Errorf("peer disconnected")
+	}
 
-	if !p.connected {
+	select {
+	case p.sendQueue <- frame:
+		p.queued(frame)
+		return nil
+	case <-p.disconnect:
 		return fmt.Errorf("peer disconnected")
+	default:
 	}
 
-	// Prepare data message header
-	header := make([]byte, 5) // 1 byte type + 4 bytes length
-	header[0] = byte(MessageTypeData)
-	binary.LittleEndian.PutUint32(header[1:], uint32(len(msgData)))
+	if msgType == MessageTypeGetData {
+		timer := time.NewTimer(
+			time.Duration(p.manager.config.WriteTimeout) * time.Second)
+		defer timer.Stop()
 
-	// Send header
-	if _, err := p.conn.Write(header); err != nil {
-		return err
+		select {
+		case p.sendQueue <- frame:
+			p.queued(frame)
+			return nil
+		case <-p.disconnect:
+			return fmt.Errorf("peer disconnected")
+		case <-timer.C:
+		}
+	}
+
+	if msgType == MessageTypeInv || msgType == MessageTypeExpire {
+		log.Debugf("Dropping message type %d for peer %s: %v", msgType,
+			p.addr, errQueueFull)
+		return errQueueFull
 	}
 
-	// Send message data
-	_, err := p.conn.Write(msgData)
-	return err
+	log.Warnf("Peer %s is not reading its messages. Disconnecting.", p.addr)
+	p.Disconnect()
+	return errQueueFull
 }
 
-// SendMessage sends a message to the peer
-func (p *Peer) SendMessage(msgType MessageType, data []byte) error {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+// queued accounts for a frame added to the send queue, recording the
+// outpoints announced by an inv.
+func (p *Peer) queued(frame outboundFrame) {
+	p.queuedBytes.Add(int64(len(frame.payload)))
+	if frame.msgType != MessageTypeInv {
+		return
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(frame.payload))
+	if err == nil {
+		p.announcements.announce(outpoints, time.Now())
+	}
+}
 
-	if !p.connected {
-		return fmt.Errorf("peer disconnected")
+// writeMessages writes queued frames to the connection until the peer is
+// disconnected. It then flushes what is left in the queue and closes the
+// connection.
+func (p *Peer) writeMessages() {
+	defer close(p.writerDone)
+	defer p.conn.Close()
+
+	timeout := time.Duration(p.manager.config.WriteTimeout) * time.Second
+	for {
+		select {
+		case frame := <-p.sendQueue:
+			p.conn.SetWriteDeadline(time.Now().Add(timeout))
+			if err := p.writeQueued(frame); err != nil {
+				log.Debugf("Error writing to peer %s: %v", p.addr, err)
+				p.Disconnect()
+				return
+			}
+			p.recordSent(frame)
+
+		case <-p.disconnect:
+			p.flushQueue()
+			return
+		}
 	}
+}
 
-	// Write message type
-	if _, err := p.conn.Write([]byte{byte(msgType)}); err != nil {
-		return err
+// writeQueued writes a frame taken from the outbound queue to the connection,
+// from the shared bytes if it has them.
+func (p *Peer) writeQueued(frame outboundFrame) error {
+	if frame.shared != nil {
+		return frame.shared.writeTo(p.conn, p.checksum)
 	}
+	return writeFrame(p.conn, frame.msgType, frame.payload, p.checksum)
+}
 
-	// Write data
-	_, err := p.conn.Write(data)
-	return err
+// recordSent updates the traffic counters after frame was written.
+func (p *Peer) recordSent(frame outboundFrame) {
+	now := time.Now()
+	n := uint64(headerSize(p.checksum) + len(frame.payload))
+	p.bytesSent.Add(n)
+	p.bandwidth.addSent(n, now)
+	p.manager.bandwidth.addSent(n, now)
+	p.queuedBytes.Add(-int64(len(frame.payload)))
+	p.lastSend.Store(now.UnixNano())
 }
 
-// Disconnect closes the connection to the peer
-func (p *Peer) Disconnect() {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+// flushQueue writes the frames still queued when the peer is disconnected,
+// giving up after flushTimeout.
+func (p *Peer) flushQueue() {
+	p.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	for {
+		select {
+		case frame := <-p.sendQueue:
+			if err := p.writeQueued(frame); err != nil {
+				return
+			}
+			p.recordSent(frame)
+		default:
+			return
+		}
+	}
+}
 
-	if !p.connected {
-		return
+// disconnecting reports whether Disconnect was called.
+func (p *Peer) disconnecting() bool {
+	select {
+	case <-p.disconnect:
+		return true
+	default:
+		return false
 	}
+}
 
-	log.Printf("Disconnecting peer %s", p.addr)
+// lastActivity returns the time a frame was last read from the peer, or the
+// time it connected if it never sent one.
+func (p *Peer) lastActivity() time.Time {
+	if last := p.lastRecv.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return p.connectedAt
+}
 
-	// Close connection
-	p.conn.Close()
-	p.connected = false
+// Disconnect closes the connection to the peer. Reading stops immediately,
+// while frames already queued are flushed before the connection is closed.
+// It is safe to call Disconnect more than once and from multiple goroutines.
+// The peer is removed from the manager's peer list once Handle returns.
+func (p *Peer) Disconnect() {
+	p.disconnectOnce.Do(func() {
+		log.Infof("Disconnecting peer %s", p.addr)
 
-	// Signal disconnect
-	close(p.disconnect)
+		p.mutex.Lock()
+		p.connected = false
+		p.mutex.Unlock()
 
-	// Log closure *before* removing from list
-	log.Printf("Connection from %s closed", p.addr)
+		// Unblock the reader. The writer closes the connection once the
+		// queue is flushed.
+		p.conn.SetReadDeadline(time.Now())
 
-	// Remove from manager's peer list
-	p.manager.removePeerFromList(p)
+		// Signal disconnect and abandon work done for the peer
+		close(p.disconnect)
+		p.cancel()
+	})
 }
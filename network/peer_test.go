@@ -0,0 +1,420 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// newTestManager creates a manager backed by a mock Bitcoin node and an
+// in-memory database, without starting it.
+func newTestManager(t testing.TB) (*Manager, *mock.Client,
+	*database.MemoryDB) {
+
+	t.Helper()
+
+	client := mock.NewClient()
+	db := database.NewMemoryDB()
+	m, err := NewManager(NewDefaultConfig(),
+		database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	m.ctx = context.Background()
+	return m, client, db
+}
+
+// newTestPeer adds a peer of m on conn, as if its handshake completed, and
+// starts its writer. The peer is disconnected when the test ends.
+func newTestPeer(t *testing.T, m *Manager, conn net.Conn,
+	addr string) *Peer {
+
+	t.Helper()
+
+	p := NewPeer(context.Background(), conn, m)
+	p.addr = addr
+
+	m.peersMu.Lock()
+	m.peers[addr] = p
+	m.peersMu.Unlock()
+
+	go p.writeMessages()
+	t.Cleanup(p.Disconnect)
+	return p
+}
+
+// testNode is a started manager backed by a mock Bitcoin node and an
+// in-memory database, listening on addr.
+type testNode struct {
+	*Manager
+	client *mock.Client
+	db     *database.MemoryDB
+	addr   string
+}
+
+// testNodeConfig returns the configuration of a test node listening on a
+// free loopback port and dialing knownPeers.
+func testNodeConfig(knownPeers ...string) Config {
+	cfg := NewDefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.KnownPeers = knownPeers
+	cfg.ValidationWorkers = 1
+	return cfg
+}
+
+// startTestNode starts a manager with cfg. It is stopped when the test
+// ends.
+func startTestNode(t testing.TB, cfg Config) *testNode {
+	t.Helper()
+
+	return startTestNodeWith(t, cfg, mock.NewClient(), database.NewMemoryDB())
+}
+
+// startTestNodeWith is startTestNode for a node using client and db.
+func startTestNodeWith(t testing.TB, cfg Config, client *mock.Client,
+	db *database.MemoryDB) *testNode {
+
+	t.Helper()
+
+	m, err := NewManager(cfg, database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { m.Stop() })
+	return &testNode{
+		Manager: m,
+		client:  client,
+		db:      db,
+		addr:    m.listener.Addr().String(),
+	}
+}
+
+// waitFor fails the test unless cond holds within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testRemote is a connection to a test node from a peer driven by the
+// test, which negotiated no optional services unless it was dialed with
+// dialTestNodeServices.
+type testRemote struct {
+	t    testing.TB
+	conn net.Conn
+
+	// checksum is set if the remote offered SFChecksum, so frames in both
+	// directions carry a checksum.
+	checksum bool
+
+	// frames receives the frames the node sends and is closed once the
+	// node disconnects.
+	frames chan testFrame
+
+	writeMu sync.Mutex
+}
+
+// dialTestNode connects to node and completes the handshake. The connection
+// is closed when the test ends.
+func dialTestNode(t testing.TB, node *testNode) *testRemote {
+	t.Helper()
+
+	return dialTestNodeServices(t, node, 0)
+}
+
+// dialTestNodeServices is dialTestNode for a remote offering services.
+func dialTestNodeServices(t testing.TB, node *testNode,
+	services ServiceFlag) *testRemote {
+
+	t.Helper()
+
+	return dialTestNodeVersion(t, node, ProtocolVersion, services)
+}
+
+// dialTestNodeVersion is dialTestNode for a remote on the given protocol
+// version offering services.
+func dialTestNodeVersion(t testing.TB, node *testNode, protocolVersion uint32,
+	services ServiceFlag) *testRemote {
+
+	t.Helper()
+
+	conn, err := net.Dial("tcp", node.addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	version := newVersionPayload(versionMsg{
+		version:   protocolVersion,
+		services:  services,
+		userAgent: "/test/",
+		challenge: make([]byte, challengeSize),
+	})
+	if err := writeFrame(conn, MessageTypeVersion, version, false); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if msgType, _ := readTestFrame(t, conn); msgType != MessageTypeVersion {
+		t.Fatalf("got message type %d, want version", msgType)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Batches are larger than any other frame
+	maxFrameSize := uint32(DefaultMaxFrameSize)
+	if services&SFBatchData != 0 {
+		maxFrameSize = maxBatchSize
+	}
+	r := &testRemote{
+		t:        t,
+		conn:     conn,
+		checksum: services&SFChecksum != 0,
+		frames:   make(chan testFrame, 4096),
+	}
+	go func() {
+		defer close(r.frames)
+		for {
+			msgType, payload, err := readFrame(conn, maxFrameSize,
+				r.checksum)
+			if err != nil {
+				return
+			}
+			r.frames <- testFrame{msgType, payload}
+		}
+	}()
+	return r
+}
+
+// send writes a frame to the node, reporting whether it could be written.
+func (r *testRemote) send(msgType MessageType, payload []byte) bool {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return writeFrame(r.conn, msgType, payload, r.checksum) == nil
+}
+
+// next returns the next frame of one of the given types the node sent,
+// skipping others, and false if the node disconnected or none arrived within
+// a few seconds.
+func (r *testRemote) next(types ...MessageType) (testFrame, bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-r.frames:
+			if !ok {
+				return testFrame{}, false
+			}
+			for _, msgType := range types {
+				if frame.msgType == msgType {
+					return frame, true
+				}
+			}
+		case <-timeout:
+			return testFrame{}, false
+		}
+	}
+}
+
+// disconnected reports whether the node closed the connection within a few
+// seconds, draining the frames sent before.
+func (r *testRemote) disconnected() bool {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-r.frames:
+			if !ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// readTestFrame reads a frame from conn, failing the test after a timeout.
+func readTestFrame(t testing.TB, conn net.Conn) (MessageType, []byte) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, payload, err := readFrame(conn, DefaultMaxFrameSize, false)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	return msgType, payload
+}
+
+// TestInvLoopback checks that an inv broadcast by one node reaches another
+// over a connection with the message type written once, and that the
+// receiving peer decodes exactly the announced outpoint and requests it.
+func TestInvLoopback(t *testing.T) {
+	sender, _, _ := newTestManager(t)
+	receiver, _, _ := newTestManager(t)
+
+	sendConn, recvConn := net.Pipe()
+	newTestPeer(t, sender, sendConn, "10.0.0.2:8335")
+	recvPeer := newTestPeer(t, receiver, recvConn, "10.0.0.1:8335")
+
+	payload := []byte("hello")
+	msg := &message.Message{
+		Outpoint:    message.NewOutpoint([32]byte{1, 2, 3}, 300),
+		ContentType: message.ContentTypeText,
+		Length:      uint16(len(payload)),
+		Payload:     payload,
+	}
+	sender.broadcastToOtherPeers(nil, msg, msg.Serialize(),
+		&database.MessageMeta{})
+
+	msgType, inv := readTestFrame(t, recvConn)
+	if msgType != MessageTypeInv {
+		t.Fatalf("got message type %d, want inv", msgType)
+	}
+	outpoints, err := readInvPayload(bytes.NewReader(inv))
+	if err != nil {
+		t.Fatalf("readInvPayload: %v", err)
+	}
+	if len(outpoints) != 1 || outpoints[0] != msg.Outpoint {
+		t.Fatalf("inv announced %d outpoints, want only %s",
+			len(outpoints), msg.Outpoint.ToString())
+	}
+
+	// The receiver asks for the message it doesn't have
+	if err := recvPeer.handleInvMessage(bytes.NewReader(inv)); err != nil {
+		t.Fatalf("handleInvMessage: %v", err)
+	}
+	msgType, getData := readTestFrame(t, sendConn)
+	if msgType != MessageTypeGetData {
+		t.Fatalf("got message type %d, want getdata", msgType)
+	}
+	if string(getData) != string(msg.Outpoint[:]) {
+		t.Fatalf("getdata for %x, want %s", getData,
+			msg.Outpoint.ToString())
+	}
+}
+
+// TestDisconnectConcurrent checks that peers blocked reading can be
+// disconnected from several goroutines while the manager stops, and that
+// stopping it again is harmless.
+func TestDisconnectConcurrent(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	remotes := make([]*testRemote, 3)
+	for i := range remotes {
+		remotes[i] = dialTestNode(t, node)
+	}
+	waitFor(t, "all peers connected", func() bool {
+		node.peersMu.RLock()
+		defer node.peersMu.RUnlock()
+		return len(node.peers) == len(remotes)
+	})
+
+	node.peersMu.RLock()
+	peers := make([]*Peer, 0, len(node.peers))
+	for _, peer := range node.peers {
+		peers = append(peers, peer)
+	}
+	node.peersMu.RUnlock()
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for _, peer := range peers {
+				peer.Disconnect()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		if err := node.Stop(); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+	}()
+	close(start)
+	wg.Wait()
+
+	if err := node.Stop(); err != nil {
+		t.Fatalf("second Stop: %v", err)
+	}
+	for i, remote := range remotes {
+		if !remote.disconnected() {
+			t.Fatalf("peer %d still connected", i)
+		}
+	}
+	node.peersMu.RLock()
+	defer node.peersMu.RUnlock()
+	if len(node.peers) != 0 {
+		t.Fatalf("%d peers left after Stop", len(node.peers))
+	}
+}
+
+// TestSkipUnknownType checks that a frame of type 0x7f from a peer on a later
+// protocol version is skipped while the frames after it are still handled,
+// and that the connection is dropped for it on our version, for a type
+// beyond maxMessageType or after MaxUnknownFrames in a row.
+func TestSkipUnknownType(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+
+	later := dialTestNodeVersion(t, node, ProtocolVersion+1, 0)
+	later.send(maxMessageType, []byte("from the future"))
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msgData := signTestMessage(t, node.client, outpoint, "hello").Serialize()
+	later.send(MessageTypeData, msgData)
+	if frame, ok := later.next(MessageTypeAck, MessageTypeReject); !ok ||
+		frame.msgType != MessageTypeAck {
+
+		t.Fatal("message after the unknown frame not acked")
+	}
+	if n := node.Stats().UnknownFrames; n != 1 {
+		t.Fatalf("%d unknown frames counted, want 1", n)
+	}
+
+	tests := []struct {
+		name    string
+		version uint32
+		msgType MessageType
+		frames  int
+	}{
+		{"our version", ProtocolVersion, maxMessageType, 1},
+		{"invalid type", ProtocolVersion + 1, maxMessageType + 1, 1},
+		{"too many", ProtocolVersion + 1, maxMessageType,
+			DefaultMaxUnknownFrames + 1},
+	}
+	for _, test := range tests {
+		remote := dialTestNodeVersion(t, node, test.version, 0)
+		for i := 0; i < test.frames; i++ {
+			remote.send(test.msgType, nil)
+		}
+		if !remote.disconnected() {
+			t.Fatalf("%s: peer still connected", test.name)
+		}
+	}
+
+	// The peer that skipped a frame is still there
+	later.send(MessageTypeGetData, outpoint[:])
+	if _, ok := later.next(MessageTypeData); !ok {
+		t.Fatal("peer on a later version disconnected")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newQueuedPeer returns a peer of a manager with a WriteTimeout of one second
+// whose writer isn't running, so the frames sent to it stay queued.
+func newQueuedPeer(t *testing.T) *Peer {
+	t.Helper()
+
+	m, _, _ := newTestManager(t)
+	m.config.WriteTimeout = 1
+	conn, remote := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+	})
+	return NewPeer(context.Background(), conn, m)
+}
+
+// fillQueue fills the outbound queue of p.
+func fillQueue(t *testing.T, p *Peer) {
+	t.Helper()
+
+	for i := 0; i < outboundQueueSize; i++ {
+		if err := p.SendMessage(MessageTypeAck, []byte{byte(i)}); err != nil {
+			t.Fatalf("SendMessage %d: %v", i, err)
+		}
+	}
+}
+
+// TestSendBackpressure checks what happens to a frame sent to a peer whose
+// outbound queue is full: an inv is dropped, a getdata waits for room up to
+// WriteTimeout and anything else disconnects the peer.
+func TestSendBackpressure(t *testing.T) {
+	p := newQueuedPeer(t)
+	fillQueue(t, p)
+
+	for _, msgType := range []MessageType{MessageTypeInv,
+		MessageTypeExpire} {
+
+		err := p.SendMessage(msgType, nil)
+		if !errors.Is(err, errQueueFull) {
+			t.Fatalf("message type %d got %v, want errQueueFull",
+				msgType, err)
+		}
+		if p.disconnecting() {
+			t.Fatalf("message type %d disconnected the peer", msgType)
+		}
+	}
+
+	// A getdata is queued once a frame was written
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		<-p.sendQueue
+	}()
+	if err := p.SendMessage(MessageTypeGetData, nil); err != nil {
+		t.Fatalf("getdata waiting for room: %v", err)
+	}
+
+	// But gives up after WriteTimeout
+	start := time.Now()
+	err := p.SendMessage(MessageTypeGetData, nil)
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("getdata got %v, want errQueueFull", err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("getdata gave up after %v, want a second", waited)
+	}
+	if !p.disconnecting() {
+		t.Fatal("peer not disconnected after a getdata timed out")
+	}
+
+	for _, msgType := range []MessageType{MessageTypeData,
+		MessageTypeReject, MessageTypeAck} {
+
+		p := newQueuedPeer(t)
+		fillQueue(t, p)
+		start := time.Now()
+		err := p.SendMessage(msgType, nil)
+		if !errors.Is(err, errQueueFull) {
+			t.Fatalf("message type %d got %v, want errQueueFull",
+				msgType, err)
+		}
+		if time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("message type %d waited for room", msgType)
+		}
+		if !p.disconnecting() {
+			t.Fatalf("message type %d didn't disconnect the peer",
+				msgType)
+		}
+		if err := p.SendMessage(MessageTypeInv, nil); err == nil {
+			t.Fatal("message queued for a disconnected peer")
+		}
+	}
+}
+
+// TestSendConcurrent checks that frames sent to a peer from 50 goroutines at
+// once arrive whole and in the order each goroutine sent them.
+func TestSendConcurrent(t *testing.T) {
+	const (
+		senders = 50
+		frames  = 40
+	)
+
+	m, _, _ := newTestManager(t)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newTestPeer(t, m, conn, "10.0.0.1:8335")
+
+	// Each payload holds its sender and sequence number, repeated to a
+	// size that varies between frames
+	payload := func(sender, seq int) []byte {
+		var item [8]byte
+		binary.LittleEndian.PutUint32(item[:4], uint32(sender))
+		binary.LittleEndian.PutUint32(item[4:], uint32(seq))
+		return bytes.Repeat(item[:], 1+(sender*frames+seq)%64)
+	}
+
+	var wg sync.WaitGroup
+	for sender := 0; sender < senders; sender++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 0; seq < frames; seq++ {
+				// getdata waits for room rather than dropping
+				// the frame or the peer
+				err := p.SendMessage(MessageTypeGetData,
+					payload(sender, seq))
+				if err != nil {
+					t.Errorf("SendMessage: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	next := make([]int, senders)
+	remote.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for i := 0; i < senders*frames; i++ {
+		msgType, data, err := readFrame(remote, DefaultMaxFrameSize, false)
+		if err != nil {
+			t.Fatalf("readFrame %d: %v", i, err)
+		}
+		if msgType != MessageTypeGetData || len(data) < 8 {
+			t.Fatalf("frame %d has type %d and %d bytes", i, msgType,
+				len(data))
+		}
+		sender := int(binary.LittleEndian.Uint32(data))
+		seq := int(binary.LittleEndian.Uint32(data[4:]))
+		if sender >= senders || seq != next[sender] {
+			t.Fatalf("frame %d is %d of sender %d", i, seq, sender)
+		}
+		if !bytes.Equal(data, payload(sender, seq)) {
+			t.Fatalf("frame %d of sender %d corrupted", seq, sender)
+		}
+		next[sender]++
+	}
+	wg.Wait()
+}
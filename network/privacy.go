@@ -0,0 +1,161 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// Origin privacy modes, selecting how messages originated by this node are
+// first announced. Without privacy, every peer learns about a message at
+// once, so the first peer to receive it can tell who authored it.
+const (
+	// PrivacyNone announces originated messages to every peer at once.
+	PrivacyNone = "none"
+
+	// PrivacyDelay holds originated messages for a random delay before
+	// announcing them like relayed messages.
+	PrivacyDelay = "delay"
+
+	// PrivacyDiffusion holds originated messages for a random delay,
+	// announces them to a single random peer, and to the others after a
+	// second delay.
+	PrivacyDiffusion = "diffusion"
+)
+
+// Default bounds in seconds of the random delay applied to originated
+// messages with origin privacy.
+const (
+	DefaultPrivacyMinDelay = 1
+	DefaultPrivacyMaxDelay = 5
+)
+
+// validatePrivacy checks the origin privacy settings of cfg.
+func validatePrivacy(cfg *Config) error {
+	switch cfg.Privacy {
+	case PrivacyNone, PrivacyDelay, PrivacyDiffusion:
+	default:
+		return fmt.Errorf("unknown privacy mode %q, expected %s, %s or %s",
+			cfg.Privacy, PrivacyNone, PrivacyDelay, PrivacyDiffusion)
+	}
+	if cfg.PrivacyMinDelay < 0 || cfg.PrivacyMinDelay > cfg.PrivacyMaxDelay {
+		return fmt.Errorf("invalid privacy delay bounds %d-%d",
+			cfg.PrivacyMinDelay, cfg.PrivacyMaxDelay)
+	}
+	return nil
+}
+
+// privacyDelay returns a random delay within the configured bounds.
+func (m *Manager) privacyDelay() time.Duration {
+	minDelay := time.Duration(m.config.PrivacyMinDelay) * time.Second
+	maxDelay := time.Duration(m.config.PrivacyMaxDelay) * time.Second
+	return minDelay + time.Duration(rand.Int63n(int64(maxDelay-minDelay)+1))
+}
+
+// announceOrigin relays a message originated by this node according to the
+// privacy mode. With privacy, the message is held until its announcement,
+// and not announced to connecting peers either.
+func (m *Manager) announceOrigin(msg *message.Message, msgData []byte,
+	meta *database.MessageMeta) {
+
+	if m.config.Privacy == PrivacyNone {
+		m.broadcastToOtherPeers(nil, msg, msgData, meta)
+		return
+	}
+
+	m.heldMu.Lock()
+	m.held[msg.Outpoint] = struct{}{}
+	m.heldMu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			m.heldMu.Lock()
+			delete(m.held, msg.Outpoint)
+			m.heldMu.Unlock()
+		}()
+
+		// A message still held on shutdown stays in the journal and is
+		// announced to the peers connecting after a restart
+		if !m.waitPrivacyDelay() {
+			return
+		}
+		var first *Peer
+		if m.config.Privacy == PrivacyDiffusion {
+			first = m.diffuse(msg, msgData, meta)
+			if first != nil && !m.waitPrivacyDelay() {
+				return
+			}
+		}
+		log.Debugf("Announcing originated message %s", msg.Outpoint.ToString())
+		m.broadcastToOtherPeers(first, msg, msgData, meta)
+	}()
+}
+
+// waitPrivacyDelay waits for a random privacy delay. It returns false if the
+// manager was stopped meanwhile.
+func (m *Manager) waitPrivacyDelay() bool {
+	timer := time.NewTimer(m.privacyDelay())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-m.quit:
+		return false
+	}
+}
+
+// diffuse announces a message to a single peer chosen at random among those
+// it would be relayed to, like broadcastToOtherPeers. It returns the peer,
+// nil if there is none.
+func (m *Manager) diffuse(msg *message.Message, msgData []byte,
+	meta *database.MessageMeta) *Peer {
+
+	key := inventoryKey{msg.Outpoint, msg.Sequence}
+
+	m.peersMu.RLock()
+	candidates := make([]*Peer, 0, len(m.peers))
+	for _, peer := range m.peers {
+		if peer.filter.Load().matchesMeta(meta) &&
+			peer.acceptsPayload(len(msg.Payload)) {
+
+			candidates = append(candidates, peer)
+		}
+	}
+	m.peersMu.RUnlock()
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, peer := range candidates {
+		if !peer.knownInv.add(key) {
+			continue
+		}
+		log.Debugf("Diffusing originated message %s to peer %s",
+			msg.Outpoint.ToString(), peer.addr)
+		if err := peer.sendShared(m.relayFrame(msg, msgData)); err != nil {
+			log.Debugf("Failed to diffuse to peer %s: %v", peer.addr, err)
+		}
+		return peer
+	}
+	return nil
+}
+
+// isHeld reports whether an originated message is waiting for its privacy
+// delay.
+func (m *Manager) isHeld(outpoint message.Outpoint) bool {
+	m.heldMu.Lock()
+	defer m.heldMu.Unlock()
+
+	_, ok := m.held[outpoint]
+	return ok
+}
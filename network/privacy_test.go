@@ -0,0 +1,110 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestPrivacyDelay checks that the random privacy delays fall within the
+// configured bounds.
+func TestPrivacyDelay(t *testing.T) {
+	m, _, _ := newTestManager(t)
+	m.config.PrivacyMinDelay = 2
+	m.config.PrivacyMaxDelay = 4
+	for i := 0; i < 1000; i++ {
+		delay := m.privacyDelay()
+		if delay < 2*time.Second || delay > 4*time.Second {
+			t.Fatalf("delay %v outside 2s-4s", delay)
+		}
+	}
+
+	cfg := NewDefaultConfig()
+	cfg.PrivacyMinDelay, cfg.PrivacyMaxDelay = 5, 1
+	if err := validatePrivacy(&cfg); err == nil {
+		t.Fatal("inverted delay bounds accepted")
+	}
+	cfg = NewDefaultConfig()
+	cfg.Privacy = "onion"
+	if err := validatePrivacy(&cfg); err == nil {
+		t.Fatal("unknown privacy mode accepted")
+	}
+}
+
+// TestPrivacyModes checks when each of three peers is announced a message
+// submitted to the node: at once without privacy, after the delay with the
+// delay mode, and one peer after the delay and the others after a second
+// delay with diffusion. Messages are only ever announced with an inv.
+func TestPrivacyModes(t *testing.T) {
+	const delay = time.Second
+
+	tests := []struct {
+		mode string
+
+		// after are the delays after which the peers are announced the
+		// message, in order.
+		after []time.Duration
+	}{
+		{PrivacyNone, []time.Duration{0, 0, 0}},
+		{PrivacyDelay, []time.Duration{delay, delay, delay}},
+		{PrivacyDiffusion, []time.Duration{delay, 2 * delay, 2 * delay}},
+	}
+	for i, test := range tests {
+		cfg := testNodeConfig()
+		cfg.Privacy = test.mode
+		cfg.PrivacyMinDelay = int(delay / time.Second)
+		cfg.PrivacyMaxDelay = int(delay / time.Second)
+		node := startTestNode(t, cfg)
+		remotes := []*testRemote{dialTestNode(t, node),
+			dialTestNode(t, node), dialTestNode(t, node)}
+		waitFor(t, "peers connected", func() bool {
+			return len(node.Stats().Peers) == len(remotes)
+		})
+
+		outpoint := message.NewOutpoint([32]byte{byte(i + 1)}, 0)
+		msg := signTestMessage(t, node.client, outpoint, "private")
+		start := time.Now()
+		_, err := node.SubmitMessage(context.Background(), msg.Serialize())
+		if err != nil {
+			t.Fatalf("%s: SubmitMessage: %v", test.mode, err)
+		}
+		held := node.isHeld(outpoint)
+		if held != (test.mode != PrivacyNone) {
+			t.Fatalf("%s: message held %v", test.mode, held)
+		}
+
+		announced := make(chan time.Duration, len(remotes))
+		for _, remote := range remotes {
+			go func() {
+				frame, ok := remote.next(MessageTypeInv, MessageTypeData)
+				if !ok || frame.msgType != MessageTypeInv {
+					announced <- -1
+					return
+				}
+				announced <- time.Since(start)
+			}()
+		}
+		var after []time.Duration
+		for range remotes {
+			after = append(after, <-announced)
+		}
+		slices.Sort(after)
+
+		// Each announcement comes after its delay, and well before the
+		// next one
+		for j, elapsed := range after {
+			want := test.after[j]
+			if elapsed < want || elapsed >= want+delay/2 {
+				t.Fatalf("%s: peers announced after %v, want %v",
+					test.mode, after, test.after)
+			}
+		}
+	}
+}
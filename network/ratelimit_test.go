@@ -0,0 +1,93 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// testDataPayload returns a data message for an outpoint the node doesn't
+// know, told apart by n.
+func testDataPayload(n uint32) []byte {
+	var outpoint message.Outpoint
+	binary.LittleEndian.PutUint32(outpoint[:], n+1)
+	msg := message.Message{
+		Outpoint:    outpoint,
+		ContentType: message.ContentTypeText,
+		Length:      2,
+		Payload:     []byte("hi"),
+	}
+	return msg.Serialize()
+}
+
+// TestRateLimitFlood checks that a peer sending 1000 data messages within a
+// second is throttled and disconnected, while a peer connected at the same
+// time that stays under the limit is answered in full.
+func TestRateLimitFlood(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	flooder := dialTestNode(t, node)
+	compliant := dialTestNode(t, node)
+	compliantAddr := compliant.conn.LocalAddr().String()
+
+	const (
+		flood      = 1000
+		compliance = 20
+	)
+	done := make(chan int)
+	go func() {
+		var answered int
+		for i := uint32(0); i < compliance; i++ {
+			if !compliant.send(MessageTypeData, testDataPayload(1e6+i)) {
+				break
+			}
+			if _, ok := compliant.next(MessageTypeAck,
+				MessageTypeReject); !ok {
+
+				break
+			}
+			answered++
+			time.Sleep(100 * time.Millisecond)
+		}
+		done <- answered
+	}()
+
+	for i := uint32(0); i < flood; i++ {
+		if !flooder.send(MessageTypeData, testDataPayload(i)) {
+			break
+		}
+	}
+	if !flooder.disconnected() {
+		t.Fatal("flooding peer still connected")
+	}
+
+	if answered := <-done; answered != compliance {
+		t.Fatalf("compliant peer got %d of %d answers", answered, compliance)
+	}
+
+	stats := node.RateLimitStats()
+	if stats.Disconnects != 1 || stats.ThrottledMessages <=
+		DefaultMaxRateViolations {
+
+		t.Fatalf("got %d disconnects and %d throttled messages",
+			stats.Disconnects, stats.ThrottledMessages)
+	}
+	if !node.isThrottled(flooder.conn.LocalAddr().String()) {
+		t.Fatal("flooding peer not cooling down")
+	}
+
+	node.peersMu.RLock()
+	peer := node.peers[compliantAddr]
+	node.peersMu.RUnlock()
+	if peer == nil {
+		t.Fatal("compliant peer disconnected")
+	}
+	if throttled := peer.Throttled(); throttled != 0 {
+		t.Fatalf("compliant peer had %d messages throttled", throttled)
+	}
+}
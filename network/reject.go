@@ -0,0 +1,207 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// maxRejectReasonSize is the maximum length in bytes of the human readable
+// reason in a reject message.
+const maxRejectReasonSize = 256
+
+// RejectCode describes why a data message was rejected.
+type RejectCode byte
+
+const (
+	// RejectInvalidSignature is sent when the message signature does not
+	// verify against its UTXO.
+	RejectInvalidSignature RejectCode = 0x01
+
+	// RejectDuplicate is sent when a message for the outpoint was already
+	// accepted.
+	RejectDuplicate RejectCode = 0x02
+
+	// RejectUTXONotFound is sent when the UTXO backing the message does not
+	// exist or has been spent.
+	RejectUTXONotFound RejectCode = 0x03
+
+	// RejectTooLarge is sent when the message exceeds the maximum size.
+	RejectTooLarge RejectCode = 0x04
+
+	// RejectMalformed is sent when the message could not be parsed or its
+	// payload does not match its content type.
+	RejectMalformed RejectCode = 0x05
+
+	// RejectInvalidUTXO is sent when the UTXO exists but can't back a
+	// message, for example because it is worth too little.
+	RejectInvalidUTXO RejectCode = 0x06
+
+	// RejectUnconfirmed is sent when the UTXO backing the message does not
+	// have enough confirmations yet. The message may be sent again once it
+	// does.
+	RejectUnconfirmed RejectCode = 0x07
+
+	// RejectBudgetExceeded is sent when the message would push the bytes
+	// stored for its outpoint over the node's per-UTXO budget.
+	RejectBudgetExceeded RejectCode = 0x08
+
+	// RejectNotWhitelisted is sent by a node in whitelist mode when neither
+	// the outpoint nor the sender of the message is whitelisted.
+	RejectNotWhitelisted RejectCode = 0x09
+
+	// RejectExpired is sent when the expiry declared by the structured
+	// payload of the message has passed.
+	RejectExpired RejectCode = 0x0a
+
+	// RejectBusy is sent in answer to a getdata when the node reached the
+	// upload cap of the peer or its own. The message may be requested
+	// again later or from another peer.
+	RejectBusy RejectCode = 0x0b
+
+	// RejectExceedsPolicy is sent when the message is within the protocol
+	// limits but larger than the node is configured to accept. The peer
+	// isn't penalized for it.
+	RejectExceedsPolicy RejectCode = 0x0c
+
+	// RejectDuplicatePayload is sent when the payload of the message was
+	// already seen from more outpoints than the node stores. The peer is
+	// only lightly penalized for it.
+	RejectDuplicatePayload RejectCode = 0x0d
+
+	// RejectUnauthorizedPeer is sent after the handshake, with the zero
+	// outpoint, to a peer whose identity isn't in AllowedPeerKeys before
+	// it is disconnected.
+	RejectUnauthorizedPeer RejectCode = 0x0e
+
+	// RejectInternal is sent when the message could not be processed
+	// because of a local error.
+	RejectInternal RejectCode = 0xff
+)
+
+// String returns the name of the reject code.
+func (c RejectCode) String() string {
+	switch c {
+	case RejectInvalidSignature:
+		return "invalid-signature"
+	case RejectDuplicate:
+		return "duplicate-outpoint"
+	case RejectUTXONotFound:
+		return "utxo-not-found"
+	case RejectTooLarge:
+		return "too-large"
+	case RejectMalformed:
+		return "malformed"
+	case RejectInvalidUTXO:
+		return "invalid-utxo"
+	case RejectUnconfirmed:
+		return "unconfirmed"
+	case RejectBudgetExceeded:
+		return "budget-exceeded"
+	case RejectNotWhitelisted:
+		return "not-whitelisted"
+	case RejectExpired:
+		return "expired"
+	case RejectBusy:
+		return "busy"
+	case RejectExceedsPolicy:
+		return "exceeds-policy"
+	case RejectDuplicatePayload:
+		return "duplicate-payload"
+	case RejectUnauthorizedPeer:
+		return "unauthorized-peer"
+	case RejectInternal:
+		return "internal-error"
+	default:
+		return fmt.Sprintf("reject(%d)", byte(c))
+	}
+}
+
+// rejectCodeFor maps an error from processing a data message to the reject
+// code sent back to the peer.
+func rejectCodeFor(err error) RejectCode {
+	switch {
+	case errors.Is(err, message.ErrBadSignature),
+		errors.Is(err, database.ErrScriptMismatch):
+		return RejectInvalidSignature
+
+	case errors.Is(err, message.ErrDuplicateOutpoint):
+		return RejectDuplicate
+
+	case errors.Is(err, message.ErrUTXONotFound),
+		errors.Is(err, message.ErrUTXOSpent):
+		return RejectUTXONotFound
+
+	case errors.Is(err, database.ErrUnconfirmedOutpoint):
+		return RejectUnconfirmed
+
+	case errors.Is(err, database.ErrOutpointBudgetExceeded):
+		return RejectBudgetExceeded
+
+	case errors.Is(err, ErrNotWhitelisted):
+		return RejectNotWhitelisted
+
+	case errors.Is(err, message.ErrExpired):
+		return RejectExpired
+
+	case errors.Is(err, message.ErrPayloadTooLarge):
+		return RejectTooLarge
+
+	case errors.Is(err, message.ErrExceedsPolicy):
+		return RejectExceedsPolicy
+
+	case errors.Is(err, errBusy):
+		return RejectBusy
+
+	case errors.Is(err, ErrDuplicatePayload):
+		return RejectDuplicatePayload
+
+	case errors.Is(err, database.ErrUTXOBelowMinimum),
+		errors.Is(err, message.ErrNotTaproot),
+		errors.Is(err, message.ErrUnsupportedScript):
+		return RejectInvalidUTXO
+	}
+
+	if kind, ok := misbehaviorKind(err); ok && kind == MisbehaviorMalformed {
+		return RejectMalformed
+	}
+	return RejectInternal
+}
+
+// newRejectPayload builds a reject payload: the outpoint, the reject code and
+// a human readable reason filling the rest of the payload.
+func newRejectPayload(outpoint message.Outpoint, code RejectCode,
+	reason string) []byte {
+
+	if len(reason) > maxRejectReasonSize {
+		reason = reason[:maxRejectReasonSize]
+	}
+
+	payload := make([]byte, 0, message.OutpointSize+1+len(reason))
+	payload = append(payload, outpoint[:]...)
+	payload = append(payload, byte(code))
+	payload = append(payload, reason...)
+	return payload
+}
+
+// parseRejectPayload parses a reject payload built by newRejectPayload.
+func parseRejectPayload(payload []byte) (message.Outpoint, RejectCode, string, error) {
+	var outpoint message.Outpoint
+	if len(payload) < message.OutpointSize+1 ||
+		len(payload) > message.OutpointSize+1+maxRejectReasonSize {
+
+		return outpoint, 0, "", fmt.Errorf("invalid reject length: %d",
+			len(payload))
+	}
+
+	copy(outpoint[:], payload)
+	code := RejectCode(payload[message.OutpointSize])
+	reason := string(payload[message.OutpointSize+1:])
+	return outpoint, code, reason, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// response sends msg to node from remote and returns the outpoint and code
+// of the reject it answers with, or RejectCode 0 for an ack.
+func response(t *testing.T, remote *testRemote,
+	msg *message.Message) (message.Outpoint, RejectCode, string) {
+
+	t.Helper()
+
+	if !remote.send(MessageTypeData, msg.Serialize()) {
+		t.Fatal("send failed")
+	}
+	frame, ok := remote.next(MessageTypeAck, MessageTypeReject)
+	if !ok {
+		t.Fatal("no ack or reject")
+	}
+	if frame.msgType == MessageTypeAck {
+		var outpoint message.Outpoint
+		if len(frame.payload) != message.OutpointSize {
+			t.Fatalf("ack of %d bytes", len(frame.payload))
+		}
+		copy(outpoint[:], frame.payload)
+		return outpoint, 0, ""
+	}
+	outpoint, code, reason, err := parseRejectPayload(frame.payload)
+	if err != nil {
+		t.Fatalf("parseRejectPayload: %v", err)
+	}
+	return outpoint, code, reason
+}
+
+// TestRejectCodes checks that a data message is acked when stored, and
+// rejected with the code of the reason it wasn't otherwise.
+func TestRejectCodes(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+
+	valid := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, valid, "hello")
+	forged := signTestMessage(t, node.client,
+		message.NewOutpoint([32]byte{2}, 0), "hello")
+	forged.Signature[0] ^= 0xff
+	spent := signTestMessage(t, node.client,
+		message.NewOutpoint([32]byte{3}, 0), "hello")
+	node.client.SpendUTXO(spent.Outpoint.WireOutPoint())
+	pending := message.NewOutpoint([32]byte{4}, 0)
+	unconfirmed := signTestMessage(t, mock.NewClient(), pending, "hello")
+	node.client.AddMempoolUTXO(pending.WireOutPoint(), 50000,
+		utxoScript(t, node.client, valid))
+
+	tests := []struct {
+		name string
+		msg  *message.Message
+		want RejectCode
+	}{
+		{"stored", msg, 0},
+		{"duplicate", msg, RejectDuplicate},
+		{"invalid signature", forged, RejectInvalidSignature},
+		{"spent", spent, RejectUTXONotFound},
+		{"unconfirmed", unconfirmed, RejectUnconfirmed},
+	}
+	for _, test := range tests {
+		remote := dialTestNode(t, node)
+		outpoint, code, reason := response(t, remote, test.msg)
+		if outpoint != test.msg.Outpoint || code != test.want {
+			t.Fatalf("%s: got %s for %s, want %s", test.name, code,
+				outpoint.ToString(), test.want)
+		}
+		if code != 0 && reason == "" {
+			t.Fatalf("%s: reject without a reason", test.name)
+		}
+	}
+}
+
+// TestRejectCodeFor checks that validation errors, wrapped as the validator
+// returns them, map to their own reject codes.
+func TestRejectCodeFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want RejectCode
+	}{
+		{message.ErrDuplicateOutpoint, RejectDuplicate},
+		{database.ErrUnconfirmedOutpoint, RejectUnconfirmed},
+		{database.ErrOutpointBudgetExceeded, RejectBudgetExceeded},
+	}
+	for _, test := range tests {
+		err := fmt.Errorf("%w: details", test.err)
+		if code := rejectCodeFor(err); code != test.want {
+			t.Fatalf("%v gave %s, want %s", err, code, test.want)
+		}
+	}
+}
+
+// TestRejectPayload checks that a reject payload parses back, with a long
+// reason truncated, and that payloads of a bad length are refused.
+func TestRejectPayload(t *testing.T) {
+	outpoint := message.NewOutpoint([32]byte{1}, 300)
+	long := strings.Repeat("x", 2*maxRejectReasonSize)
+	for _, reason := range []string{"", "duplicate", long} {
+		payload := newRejectPayload(outpoint, RejectDuplicate, reason)
+		gotOutpoint, code, gotReason, err := parseRejectPayload(payload)
+		if err != nil {
+			t.Fatalf("parseRejectPayload: %v", err)
+		}
+		want := reason
+		if len(want) > maxRejectReasonSize {
+			want = want[:maxRejectReasonSize]
+		}
+		if gotOutpoint != outpoint || code != RejectDuplicate ||
+			gotReason != want {
+
+			t.Fatalf("parsed %s, %s, %q", gotOutpoint.ToString(), code,
+				gotReason)
+		}
+	}
+
+	for _, size := range []int{0, message.OutpointSize,
+		message.OutpointSize + 2 + maxRejectReasonSize} {
+
+		if _, _, _, err := parseRejectPayload(
+			bytes.Repeat([]byte{1}, size)); err == nil {
+
+			t.Fatalf("reject payload of %d bytes parsed", size)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// rejectsFileName is the name of the file in the data directory holding
+	// the reject journal, one JSON entry per line, oldest first.
+	rejectsFileName = "rejects.jsonl"
+
+	// rejectQueueSize is the number of entries waiting to be written to
+	// the reject journal. Rejections beyond it are counted and dropped.
+	rejectQueueSize = 1024
+
+	// rejectPayloadPrefix is the number of payload bytes recorded per
+	// rejected message with RejectJournalPayloads.
+	rejectPayloadPrefix = 256
+
+	// maxRejectErrorSize is the length error descriptions are cut to.
+	maxRejectErrorSize = 256
+
+	// maxRejectList is the largest number of entries RecentRejects returns.
+	maxRejectList = 1000
+)
+
+// RejectEntry records a message the node rejected.
+type RejectEntry struct {
+	Time time.Time `json:"time"`
+
+	// Source is the address of the peer that sent the message, or
+	// database.SourceLocal.
+	Source string `json:"source"`
+
+	// Outpoint is empty for a message that couldn't be decoded.
+	Outpoint string `json:"outpoint,omitempty"`
+
+	// Reason is the name of the reject code, see RejectCode, and Error the
+	// description of the failed check.
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+
+	// Payload holds the first bytes of the payload, only recorded with
+	// RejectJournalPayloads, and PayloadSize its full size.
+	Payload     []byte `json:"payload,omitempty"`
+	PayloadSize int    `json:"payload_size"`
+}
+
+// rejectJournal keeps the recently rejected messages for abuse analysis, in
+// memory and in a file of the data directory capped at maxSize bytes. Entries
+// are queued without blocking the validation that rejected them and written
+// by run. Once the file would grow past maxSize the oldest entries are
+// dropped and it is rewritten at three quarters of it. It is safe for
+// concurrent use, and a nil journal records nothing.
+type rejectJournal struct {
+	path     string
+	maxSize  int
+	payloads bool
+
+	queue   chan *RejectEntry
+	dropped atomic.Uint64
+
+	// entries are the journaled entries, oldest first, lines their
+	// encoding and size the total size of lines.
+	entries []*RejectEntry
+	lines   [][]byte
+	size    int
+	mu      sync.Mutex
+}
+
+// newRejectJournal creates a journal of at most maxSize bytes in dataDir,
+// recording payloads if payloads is set. A negative maxSize disables it and
+// returns nil. If dataDir is empty the journal is only kept in memory.
+func newRejectJournal(dataDir string, maxSize int,
+	payloads bool) *rejectJournal {
+
+	if maxSize < 0 {
+		return nil
+	}
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, rejectsFileName)
+	}
+	return &rejectJournal{
+		path:     path,
+		maxSize:  maxSize,
+		payloads: payloads,
+		queue:    make(chan *RejectEntry, rejectQueueSize),
+	}
+}
+
+// load reads the journal written by a previous run, rewriting it if it
+// exceeds the size now configured. Lines that can't be decoded are skipped.
+func (j *rejectJournal) load() error {
+	if j == nil || j.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", j.path, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry RejectEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		line := append(bytes.Clone(scanner.Bytes()), '\n')
+		j.entries = append(j.entries, &entry)
+		j.lines = append(j.lines, line)
+		j.size += len(line)
+	}
+	if j.size > j.maxSize || j.size != len(data) {
+		j.trim()
+		return j.rewrite()
+	}
+	return nil
+}
+
+// record queues an entry for a message rejected with err. msg is nil for a
+// message that couldn't be decoded, whose outpoint may be zero. If the queue
+// is full the entry is dropped and counted.
+func (j *rejectJournal) record(outpoint message.Outpoint, msg *message.Message,
+	source string, err error) {
+
+	if j == nil {
+		return
+	}
+
+	entry := &RejectEntry{
+		Time:   time.Now(),
+		Source: source,
+		Reason: rejectCodeFor(err).String(),
+		Error:  err.Error(),
+	}
+	if outpoint != (message.Outpoint{}) {
+		entry.Outpoint = outpoint.ToString()
+	}
+	if len(entry.Error) > maxRejectErrorSize {
+		entry.Error = entry.Error[:maxRejectErrorSize]
+	}
+	if msg != nil {
+		entry.PayloadSize = len(msg.Payload)
+		if j.payloads {
+			prefix := msg.Payload[:min(len(msg.Payload),
+				rejectPayloadPrefix)]
+			entry.Payload = bytes.Clone(prefix)
+		}
+	}
+
+	select {
+	case j.queue <- entry:
+	default:
+		j.dropped.Add(1)
+	}
+}
+
+// run writes the queued entries until ctx is done, then those still queued.
+func (j *rejectJournal) run(ctx context.Context) {
+	for {
+		select {
+		case entry := <-j.queue:
+			j.write(j.drain(entry))
+		case <-ctx.Done():
+			if batch := j.drain(nil); len(batch) > 0 {
+				j.write(batch)
+			}
+			return
+		}
+	}
+}
+
+// drain returns first, if set, followed by the entries queued so far.
+func (j *rejectJournal) drain(first *RejectEntry) []*RejectEntry {
+	var batch []*RejectEntry
+	if first != nil {
+		batch = append(batch, first)
+	}
+	for {
+		select {
+		case entry := <-j.queue:
+			batch = append(batch, entry)
+		default:
+			return batch
+		}
+	}
+}
+
+// write adds a batch of entries to the journal, appending them to the file,
+// or rewriting it without the oldest entries if it would exceed maxSize.
+func (j *rejectJournal) write(batch []*RejectEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var appended []byte
+	for _, entry := range batch {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Warnf("Failed to encode reject entry: %v", err)
+			continue
+		}
+		line = append(line, '\n')
+		j.entries = append(j.entries, entry)
+		j.lines = append(j.lines, line)
+		j.size += len(line)
+		appended = append(appended, line...)
+	}
+
+	if j.size > j.maxSize {
+		j.trim()
+		if err := j.rewrite(); err != nil {
+			log.Warnf("Failed to save reject journal: %v", err)
+		}
+		return
+	}
+	if err := j.append(appended); err != nil {
+		log.Warnf("Failed to save reject journal: %v", err)
+	}
+}
+
+// trim drops the oldest entries until those left take at most three
+// quarters of maxSize, so the file isn't rewritten on every write once full.
+// The caller must hold j.mu.
+func (j *rejectJournal) trim() {
+	target := j.maxSize / 4 * 3
+	drop := 0
+	for drop < len(j.lines) && j.size > target {
+		j.size -= len(j.lines[drop])
+		drop++
+	}
+	j.entries = append([]*RejectEntry(nil), j.entries[drop:]...)
+	j.lines = append([][]byte(nil), j.lines[drop:]...)
+}
+
+// append adds encoded entries to the end of the file. The caller must hold
+// j.mu.
+func (j *rejectJournal) append(data []byte) error {
+	if j.path == "" || len(data) == 0 {
+		return nil
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rewrite replaces the file with the entries kept. The caller must hold
+// j.mu.
+func (j *rejectJournal) rewrite() error {
+	if j.path == "" {
+		return nil
+	}
+
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, bytes.Join(j.lines, nil),
+		0600); err != nil {
+
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, j.path)
+}
+
+// recent returns up to limit journaled entries, newest first, with reason
+// and source if they are set.
+func (j *rejectJournal) recent(reason, source string,
+	limit int) []RejectEntry {
+
+	if j == nil {
+		return nil
+	}
+	if limit <= 0 || limit > maxRejectList {
+		limit = maxRejectList
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var entries []RejectEntry
+	for i := len(j.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := j.entries[i]
+		if (reason != "" && entry.Reason != reason) ||
+			(source != "" && entry.Source != source) {
+
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// stats returns the number of entries journaled and dropped because the
+// queue was full.
+func (j *rejectJournal) stats() (int, uint64) {
+	if j == nil {
+		return 0, 0
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return len(j.entries), j.dropped.Load()
+}
+
+// rejectMessage counts a message rejected with err and records it in the
+// reject journal. msg is nil for a message that couldn't be decoded.
+func (m *Manager) rejectMessage(outpoint message.Outpoint,
+	msg *message.Message, source string, err error) {
+
+	m.messagesRejected.Add(1)
+	m.rejects.record(outpoint, msg, source, err)
+}
+
+// RecentRejects returns up to limit of the recently rejected messages, newest
+// first, and the number of rejections dropped from the journal. A non-empty
+// reason, the name of a reject code, or source, the address of a peer,
+// returns only the messages rejected for it or sent by it.
+func (m *Manager) RecentRejects(reason, source string,
+	limit int) ([]RejectEntry, uint64) {
+
+	_, dropped := m.rejects.stats()
+	return m.rejects.recent(reason, source, limit), dropped
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestRejectJournal checks that messages rejected for several reasons, sent
+// locally and by a peer, are journaled newest first with their source,
+// outpoint and payload prefix, can be filtered, and are kept in the data
+// directory.
+func TestRejectJournal(t *testing.T) {
+	ctx := context.Background()
+	cfg := testNodeConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.RejectJournalPayloads = true
+	node := startTestNode(t, cfg)
+	remote := dialTestNode(t, node)
+	peerAddr := remote.conn.LocalAddr().String()
+
+	forged := signTestMessage(t, node.client, inventoryOutpoint(1),
+		strings.Repeat("a", 2*rejectPayloadPrefix))
+	forged.Signature[0] ^= 0xff
+	if _, err := node.SubmitMessage(ctx, forged.Serialize()); err == nil {
+		t.Fatal("forged message accepted")
+	}
+	if _, err := node.SubmitMessage(ctx, []byte{1, 2, 3}); err == nil {
+		t.Fatal("truncated message accepted")
+	}
+	spent := signTestMessage(t, node.client, inventoryOutpoint(2), "spent")
+	node.client.SpendUTXO(spent.Outpoint.WireOutPoint())
+	if _, code, _ := response(t, remote, spent); code != RejectUTXONotFound {
+		t.Fatalf("spent message got %s", code)
+	}
+	unconfirmed := signTestMessage(t, mock.NewClient(), inventoryOutpoint(3),
+		"unconfirmed")
+	_, pkScript := testSender(t, 7)
+	node.client.AddMempoolUTXO(unconfirmed.Outpoint.WireOutPoint(), 50000,
+		pkScript)
+	if _, code, _ := response(t, remote, unconfirmed); code !=
+		RejectUnconfirmed {
+
+		t.Fatalf("unconfirmed message got %s", code)
+	}
+	waitFor(t, "rejects journaled", func() bool {
+		return node.Stats().RejectsJournaled == 4
+	})
+
+	want := []struct {
+		reason   RejectCode
+		source   string
+		outpoint string
+	}{
+		{RejectUnconfirmed, peerAddr, unconfirmed.Outpoint.ToString()},
+		{RejectUTXONotFound, peerAddr, spent.Outpoint.ToString()},
+		{RejectMalformed, database.SourceLocal, ""},
+		{RejectInvalidSignature, database.SourceLocal,
+			forged.Outpoint.ToString()},
+	}
+	entries, dropped := node.RecentRejects("", "", 0)
+	if len(entries) != len(want) || dropped != 0 {
+		t.Fatalf("%d entries journaled, %d dropped, want %d", len(entries),
+			dropped, len(want))
+	}
+	for i, entry := range entries {
+		if entry.Reason != want[i].reason.String() ||
+			entry.Source != want[i].source ||
+			entry.Outpoint != want[i].outpoint || entry.Error == "" {
+
+			t.Fatalf("entry %d is %+v, want %s from %s", i, entry,
+				want[i].reason, want[i].source)
+		}
+	}
+	sample := entries[3]
+	prefix := forged.Payload[:rejectPayloadPrefix]
+	if sample.PayloadSize != len(forged.Payload) ||
+		string(sample.Payload) != string(prefix) {
+
+		t.Fatalf("payload sample of %d bytes out of %d, want the first %d "+
+			"of %d", len(sample.Payload), sample.PayloadSize,
+			rejectPayloadPrefix, len(forged.Payload))
+	}
+
+	if entries, _ := node.RecentRejects(RejectMalformed.String(), "",
+		0); len(entries) != 1 || entries[0].Outpoint != "" {
+
+		t.Fatalf("malformed rejects: %+v", entries)
+	}
+	if entries, _ := node.RecentRejects("", peerAddr, 0); len(entries) != 2 {
+		t.Fatalf("%d rejects from the peer, want 2", len(entries))
+	}
+	if entries, _ := node.RecentRejects("", "", 1); len(entries) != 1 ||
+		entries[0].Reason != RejectUnconfirmed.String() {
+
+		t.Fatalf("latest reject: %+v", entries)
+	}
+
+	// The journal a restarted node loads holds the same entries
+	reloaded := newRejectJournal(cfg.DataDir, DefaultRejectJournalSize, false)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got := reloaded.recent("", "", 0)
+	if !slices.EqualFunc(got, entries, func(a, b RejectEntry) bool {
+		return a.Reason == b.Reason && a.Outpoint == b.Outpoint &&
+			a.Time.Equal(b.Time) && string(a.Payload) == string(b.Payload)
+	}) {
+		t.Fatalf("reloaded %d entries, want the %d journaled", len(got),
+			len(entries))
+	}
+}
+
+// TestRejectJournalCap checks that the journal file never grows past its
+// size, dropping the oldest entries, and that rejections coming faster than
+// they are written are dropped and counted instead of blocking.
+func TestRejectJournalCap(t *testing.T) {
+	const (
+		maxSize = 4096
+		written = 50
+	)
+
+	dir := t.TempDir()
+	journal := newRejectJournal(dir, maxSize, false)
+	for i := 1; i <= written; i++ {
+		journal.record(inventoryOutpoint(i), nil, database.SourceLocal,
+			fmt.Errorf("%w: reject %d", message.ErrBadSignature, i))
+		journal.write(journal.drain(nil))
+
+		info, err := os.Stat(filepath.Join(dir, rejectsFileName))
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Size() > maxSize || int(info.Size()) != journal.size {
+			t.Fatalf("journal file of %d bytes after %d entries, holding "+
+				"%d, cap %d", info.Size(), i, journal.size, maxSize)
+		}
+	}
+	count, dropped := journal.stats()
+	if count >= written || dropped != 0 {
+		t.Fatalf("%d of %d entries kept, %d dropped", count, written,
+			dropped)
+	}
+	latest := journal.recent("", "", 1)
+	if len(latest) != 1 ||
+		latest[0].Outpoint != inventoryOutpoint(written).ToString() {
+
+		t.Fatalf("latest entry %+v", latest)
+	}
+
+	reloaded := newRejectJournal(dir, maxSize, false)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n, _ := reloaded.stats(); n != count {
+		t.Fatalf("reloaded %d entries, want %d", n, count)
+	}
+
+	// Nothing writes the queue here, so it overflows
+	queued := newRejectJournal("", maxSize, false)
+	err := errors.New("rejected")
+	for i := 0; i < rejectQueueSize+5; i++ {
+		queued.record(inventoryOutpoint(i), nil, database.SourceLocal, err)
+	}
+	if _, dropped := queued.stats(); dropped != 5 {
+		t.Fatalf("%d rejections dropped from a full queue, want 5", dropped)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// maxRelayFilterEntries is the maximum number of senders and channels in a
+// relay filter.
+const maxRelayFilterEntries = 1000
+
+// relayFilter selects the messages relayed to a peer that sent a setfilter:
+// those of the listed senders, x-only taproot output keys, and those posted
+// to the listed channels of the structured payload.
+type relayFilter struct {
+	pubKeys  map[[32]byte]struct{}
+	channels map[string]struct{}
+}
+
+// newRelayFilter parses a relay filter from hex encoded pubkeys and channel
+// names. It returns nil, relaying everything, if both lists are empty.
+func newRelayFilter(pubKeys, channels []string) (*relayFilter, error) {
+	if len(pubKeys)+len(channels) == 0 {
+		return nil, nil
+	}
+	if len(pubKeys)+len(channels) > maxRelayFilterEntries {
+		return nil, fmt.Errorf("relay filter has %d entries, at most %d",
+			len(pubKeys)+len(channels), maxRelayFilterEntries)
+	}
+
+	filter := &relayFilter{
+		pubKeys:  make(map[[32]byte]struct{}, len(pubKeys)),
+		channels: make(map[string]struct{}, len(channels)),
+	}
+	for _, value := range pubKeys {
+		pubKey, err := hex.DecodeString(value)
+		if err != nil || len(pubKey) != 32 {
+			return nil, fmt.Errorf("invalid pubkey %q: expected 32 hex "+
+				"encoded bytes", value)
+		}
+		filter.pubKeys[[32]byte(pubKey)] = struct{}{}
+	}
+	for _, channel := range channels {
+		if err := checkFilterChannel(channel); err != nil {
+			return nil, err
+		}
+		filter.channels[channel] = struct{}{}
+	}
+	return filter, nil
+}
+
+// checkFilterChannel checks that channel can be matched by a relay filter.
+func checkFilterChannel(channel string) error {
+	switch {
+	case channel == "":
+		return fmt.Errorf("empty channel name")
+	case len(channel) > message.MaxChannelSize:
+		return fmt.Errorf("%w: %d bytes, at most %d",
+			message.ErrChannelTooLong, len(channel),
+			message.MaxChannelSize)
+	case !utf8.ValidString(channel):
+		return fmt.Errorf("channel name is not valid UTF-8")
+	}
+	return nil
+}
+
+// matches reports whether a message of the sender pubKey posted to channel
+// is relayed. A nil filter matches every message.
+func (f *relayFilter) matches(pubKey []byte, channel string) bool {
+	if f == nil {
+		return true
+	}
+	if len(pubKey) == 32 {
+		if _, ok := f.pubKeys[[32]byte(pubKey)]; ok {
+			return true
+		}
+	}
+	_, ok := f.channels[channel]
+	return ok
+}
+
+// matchesMeta reports whether the stored message with meta is relayed.
+func (f *relayFilter) matchesMeta(meta *database.MessageMeta) bool {
+	return f.matches(meta.PubKey, meta.Channel)
+}
+
+// size returns the number of entries of the filter.
+func (f *relayFilter) size() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.pubKeys) + len(f.channels)
+}
+
+// payload encodes the filter as a setfilter payload: a 2-byte little-endian
+// number of pubkeys followed by the 32-byte pubkeys, then a 2-byte
+// little-endian number of channels, each a 1-byte length followed by the
+// UTF-8 name. A nil filter encodes as two zero counts, which clears the
+// filter of the peer.
+func (f *relayFilter) payload() []byte {
+	payload := make([]byte, 2, 4+32*f.size())
+	if f == nil {
+		return append(payload, 0, 0)
+	}
+
+	binary.LittleEndian.PutUint16(payload, uint16(len(f.pubKeys)))
+	for pubKey := range f.pubKeys {
+		payload = append(payload, pubKey[:]...)
+	}
+	payload = binary.LittleEndian.AppendUint16(payload,
+		uint16(len(f.channels)))
+	for channel := range f.channels {
+		payload = append(payload, byte(len(channel)))
+		payload = append(payload, channel...)
+	}
+	return payload
+}
+
+// parseRelayFilterPayload decodes a setfilter payload. It returns nil for an
+// empty filter.
+func parseRelayFilterPayload(payload []byte) (*relayFilter, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("setfilter too short: %d bytes", len(payload))
+	}
+	numPubKeys := int(binary.LittleEndian.Uint16(payload))
+	payload = payload[2:]
+	if numPubKeys > maxRelayFilterEntries {
+		return nil, fmt.Errorf("setfilter has %d pubkeys, at most %d",
+			numPubKeys, maxRelayFilterEntries)
+	}
+	if len(payload) < numPubKeys*32+2 {
+		return nil, fmt.Errorf("setfilter pubkey count %d exceeds payload",
+			numPubKeys)
+	}
+
+	filter := &relayFilter{
+		pubKeys:  make(map[[32]byte]struct{}, numPubKeys),
+		channels: make(map[string]struct{}),
+	}
+	for i := 0; i < numPubKeys; i++ {
+		filter.pubKeys[[32]byte(payload[:32])] = struct{}{}
+		payload = payload[32:]
+	}
+
+	numChannels := int(binary.LittleEndian.Uint16(payload))
+	payload = payload[2:]
+	if numPubKeys+numChannels > maxRelayFilterEntries {
+		return nil, fmt.Errorf("setfilter has %d entries, at most %d",
+			numPubKeys+numChannels, maxRelayFilterEntries)
+	}
+	for i := 0; i < numChannels; i++ {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return nil, fmt.Errorf("setfilter channel %d exceeds payload",
+				i)
+		}
+		channel := string(payload[1 : 1+int(payload[0])])
+		if err := checkFilterChannel(channel); err != nil {
+			return nil, fmt.Errorf("setfilter channel %d: %v", i, err)
+		}
+		filter.channels[channel] = struct{}{}
+		payload = payload[1+len(channel):]
+	}
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("setfilter has %d trailing bytes",
+			len(payload))
+	}
+
+	if filter.size() == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// handleSetFilterMessage replaces the relay filter of the peer. From then on
+// only the messages it matches are announced or sent to the peer, an empty
+// filter restores full relay.
+func (p *Peer) handleSetFilterMessage(payload []byte) error {
+	filter, err := parseRelayFilterPayload(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	p.filter.Store(filter)
+	log.Debugf("Peer %s set a relay filter of %d senders and channels",
+		p.addr, filter.size())
+	return nil
+}
+
+// sendRelayFilter asks the peer to relay only the messages matched by the
+// configured relay filter, if there is one and the peer supports it.
+func (p *Peer) sendRelayFilter() error {
+	filter := p.manager.relayFilter
+	if filter == nil || p.services&SFRelayFilter == 0 {
+		return nil
+	}
+
+	log.Debugf("Asking peer %s to relay %d senders and channels", p.addr,
+		filter.size())
+	return p.SendMessage(MessageTypeSetFilter, filter.payload())
+}
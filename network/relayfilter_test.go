@@ -0,0 +1,137 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+	"github.com/shaibearary/utxo_chat/signer"
+)
+
+// TestRelayFilterPayload checks that a relay filter survives its setfilter
+// encoding, and that filters over maxRelayFilterEntries are refused.
+func TestRelayFilterPayload(t *testing.T) {
+	_, pkScript := testSender(t, 8)
+	filter, err := newRelayFilter([]string{hex.EncodeToString(pkScript[2:])},
+		[]string{"news", "général"})
+	if err != nil {
+		t.Fatalf("newRelayFilter: %v", err)
+	}
+	parsed, err := parseRelayFilterPayload(filter.payload())
+	if err != nil {
+		t.Fatalf("parseRelayFilterPayload: %v", err)
+	}
+	if parsed.size() != 3 || !parsed.matches(pkScript[2:], "") ||
+		!parsed.matches(nil, "général") || parsed.matches(nil, "other") {
+
+		t.Fatalf("parsed %+v", parsed)
+	}
+
+	empty, err := parseRelayFilterPayload((*relayFilter)(nil).payload())
+	if err != nil || empty != nil {
+		t.Fatalf("empty filter parsed as %+v, %v", empty, err)
+	}
+
+	channels := make([]string, maxRelayFilterEntries+1)
+	for i := range channels {
+		channels[i] = fmt.Sprint(i)
+	}
+	if _, err := newRelayFilter(nil, channels); err == nil {
+		t.Fatal("oversized filter accepted")
+	}
+	oversized := &relayFilter{channels: make(map[string]struct{})}
+	for _, channel := range channels {
+		oversized.channels[channel] = struct{}{}
+	}
+	if _, err := parseRelayFilterPayload(oversized.payload()); err == nil {
+		t.Fatal("oversized setfilter accepted")
+	}
+}
+
+// TestRelayFilter checks that of three broadcast messages, a peer that set a
+// relay filter is only announced the one of the filtered sender and the one
+// posted to the filtered channel, while an unfiltered peer is announced all
+// three.
+func TestRelayFilter(t *testing.T) {
+	const sender, other = 8, 9
+
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	filtered := dialTestNodeServices(t, node, SFRelayFilter)
+	unfiltered := dialTestNode(t, node)
+
+	_, pkScript := testSender(t, sender)
+	filter, err := newRelayFilter([]string{hex.EncodeToString(pkScript[2:])},
+		[]string{"news"})
+	if err != nil {
+		t.Fatalf("newRelayFilter: %v", err)
+	}
+	filtered.send(MessageTypeSetFilter, filter.payload())
+	waitFor(t, "relay filter set", func() bool {
+		node.peersMu.RLock()
+		defer node.peersMu.RUnlock()
+		for _, peer := range node.peers {
+			if peer.filter.Load() != nil {
+				return true
+			}
+		}
+		return false
+	})
+
+	// The unmatched message goes first, so the filtered peer being
+	// announced the later ones shows it was skipped
+	unmatched := signSeedMessage(t, node.client, other,
+		inventoryOutpoint(0), "unmatched")
+	bySender := signSeedMessage(t, node.client, sender,
+		inventoryOutpoint(1), "by sender")
+
+	key, otherScript := testSender(t, other)
+	outpoint := inventoryOutpoint(2)
+	node.client.AddUTXO(outpoint.WireOutPoint(), 50000, otherScript)
+	payload, err := message.BuildPayload(&message.Payload{
+		Channel: "news",
+		Body:    "in channel",
+	})
+	if err != nil {
+		t.Fatalf("BuildPayload: %v", err)
+	}
+	inChannel, err := signer.SignMessage(key, outpoint,
+		message.ContentTypeBinary, payload)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+
+	for _, msg := range []*message.Message{unmatched, bySender, inChannel} {
+		if _, err := node.SubmitMessage(ctx, msg.Serialize()); err != nil {
+			t.Fatalf("SubmitMessage: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		remote *testRemote
+		want   []message.Outpoint
+	}{
+		{"filtered", filtered, []message.Outpoint{bySender.Outpoint,
+			inChannel.Outpoint}},
+		{"unfiltered", unfiltered, []message.Outpoint{unmatched.Outpoint,
+			bySender.Outpoint, inChannel.Outpoint}},
+	}
+	for _, test := range tests {
+		var announced []message.Outpoint
+		for len(announced) < len(test.want) {
+			announced = append(announced, nextInv(t, test.remote)...)
+		}
+		if !slices.Equal(announced, test.want) {
+			t.Fatalf("%s peer announced %d messages, want %d", test.name,
+				len(announced), len(test.want))
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// reloadableSettings are the fields of Config that ApplyConfig changes on a
+// running manager.
+var reloadableSettings = []string{
+	"KnownPeers",
+	"DisconnectRemovedPeers",
+	"DataRateLimit",
+	"DataRateBurst",
+	"InvRateLimit",
+	"InvRateBurst",
+	"MaxRateViolations",
+	"ThrottleCooldown",
+	"MaxPeerUploadPerHour",
+	"MaxUploadPerHour",
+	"BlockedPubKeys",
+	"BlockedOutpoints",
+}
+
+// settings returns the configuration last applied by ApplyConfig. It must be
+// used rather than config to read the reloadable settings.
+func (m *Manager) settings() *Config {
+	return m.live.Load()
+}
+
+// ApplyConfig applies the reloadable settings of cfg to the running manager:
+// the known peers, the rate limits, the upload caps and the configured
+// blocklist. Newly known peers are dialed right away, and entries added to
+// the blocklist purge the messages already stored for them. It returns the
+// names of the other settings of cfg that differ from the running ones,
+// which only take effect after a restart.
+func (m *Manager) ApplyConfig(ctx context.Context, cfg Config) ([]string,
+	error) {
+
+	if err := applyDefaults(&cfg); err != nil {
+		return nil, err
+	}
+	newPubKeys, newOutpoints, err := parseEntries(cfg.BlockedPubKeys,
+		cfg.BlockedOutpoints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocklist: %v", err)
+	}
+
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	old := m.settings()
+	live := *old
+	restart := changedSettings(old, &cfg)
+	for _, name := range reloadableSettings {
+		reflect.ValueOf(&live).Elem().FieldByName(name).Set(
+			reflect.ValueOf(cfg).FieldByName(name))
+	}
+	m.live.Store(&live)
+
+	// Existing peers keep the tokens they have left
+	m.peersMu.RLock()
+	for _, peer := range m.peers {
+		peer.dataLimiter.set(live.DataRateLimit, live.DataRateBurst)
+		peer.invLimiter.set(live.InvRateLimit, live.InvRateBurst)
+	}
+	m.peersMu.RUnlock()
+
+	m.applyKnownPeers(old.KnownPeers, live.KnownPeers,
+		live.DisconnectRemovedPeers)
+
+	// Old entries are valid, they were parsed when applied
+	oldPubKeys, oldOutpoints, _ := parseEntries(old.BlockedPubKeys,
+		old.BlockedOutpoints)
+	if err := m.applyBlocklist(ctx, oldPubKeys, oldOutpoints, newPubKeys,
+		newOutpoints); err != nil {
+		return restart, err
+	}
+
+	log.Infof("Applied network configuration")
+	return restart, nil
+}
+
+// changedSettings returns the names of the settings that are not reloadable
+// and differ between old and cfg.
+func changedSettings(old, cfg *Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*cfg)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if slices.Contains(reloadableSettings, name) {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(),
+			newValue.Field(i).Interface()) {
+
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// applyKnownPeers dials the peers added to the known peers and forgets the
+// removed ones, disconnecting them if disconnect is set.
+func (m *Manager) applyKnownPeers(old, known []string, disconnect bool) {
+	for _, addr := range old {
+		if slices.Contains(known, addr) {
+			continue
+		}
+		m.addrManager.Remove(addr)
+		if !disconnect {
+			continue
+		}
+		m.peersMu.RLock()
+		for _, peer := range m.peers {
+			if peer.outbound && peer.dialAddr == addr {
+				log.Infof("Peer %s was removed from the known peers", addr)
+				peer.forget.Store(true)
+				peer.Disconnect()
+			}
+		}
+		m.peersMu.RUnlock()
+	}
+
+	var added []string
+	for _, addr := range known {
+		if slices.Contains(old, addr) {
+			continue
+		}
+		m.addrManager.AddAddress(addr)
+		added = append(added, addr)
+	}
+	if len(added) == 0 || m.listener == nil {
+		return
+	}
+
+	// Dial outside of the caller, a peer may take DialTimeout to answer
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		for batch := range slices.Chunk(added, maxConcurrentDials) {
+			select {
+			case <-m.quit:
+				return
+			default:
+			}
+			m.dialAll(batch)
+		}
+	}()
+}
+
+// applyBlocklist blocks the senders and outpoints added to the configured
+// blocklist and unblocks the removed ones.
+func (m *Manager) applyBlocklist(ctx context.Context,
+	oldPubKeys map[[32]byte]struct{},
+	oldOutpoints map[message.Outpoint]struct{},
+	pubKeys map[[32]byte]struct{},
+	outpoints map[message.Outpoint]struct{}) error {
+
+	for pubKey := range oldPubKeys {
+		if _, ok := pubKeys[pubKey]; ok {
+			continue
+		}
+		err := m.UnblockPubKey(pubKey[:])
+		if err != nil && !errors.Is(err, ErrNotBlocked) {
+			log.Warnf("Failed to unblock sender %x: %v", pubKey, err)
+		}
+	}
+	for outpoint := range oldOutpoints {
+		if _, ok := outpoints[outpoint]; ok {
+			continue
+		}
+		err := m.UnblockOutpoint(outpoint)
+		if err != nil && !errors.Is(err, ErrNotBlocked) {
+			log.Warnf("Failed to unblock outpoint %s: %v",
+				outpoint.ToString(), err)
+		}
+	}
+
+	for pubKey := range pubKeys {
+		if _, ok := oldPubKeys[pubKey]; ok {
+			continue
+		}
+		if err := m.BlockPubKey(ctx, pubKey[:]); err != nil {
+			return err
+		}
+	}
+	for outpoint := range outpoints {
+		if _, ok := oldOutpoints[outpoint]; ok {
+			continue
+		}
+		if err := m.BlockOutpoint(ctx, outpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
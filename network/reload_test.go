@@ -0,0 +1,51 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// TestApplyConfigKnownPeers checks that a peer added to the known peers of a
+// running node is dialed, that the new rate limits reach connected peers,
+// and that a changed listen address is reported as requiring a restart.
+func TestApplyConfigKnownPeers(t *testing.T) {
+	a := startTestNode(t, testNodeConfig())
+	bCfg := testNodeConfig()
+	b := startTestNode(t, bCfg)
+
+	cfg := bCfg
+	cfg.KnownPeers = []string{a.addr}
+	cfg.DataRateLimit = 1
+	cfg.DataRateBurst = 2
+	restart, err := b.ApplyConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+	if len(restart) != 0 {
+		t.Fatalf("reloadable settings reported as needing a restart: %v",
+			restart)
+	}
+	waitFor(t, "added known peer dialed", func() bool {
+		return b.isConnected(a.addr)
+	})
+	if live := b.settings(); live.DataRateLimit != 1 ||
+		live.DataRateBurst != 2 {
+
+		t.Fatalf("rate limit %v, burst %d not applied",
+			live.DataRateLimit, live.DataRateBurst)
+	}
+
+	cfg.ListenAddr = "127.0.0.1:1"
+	restart, err = b.ApplyConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ApplyConfig: %v", err)
+	}
+	if !slices.Contains(restart, "ListenAddr") {
+		t.Fatalf("changed listen address not reported: %v", restart)
+	}
+}
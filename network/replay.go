@@ -0,0 +1,81 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// duplicatesPerScore is the number of known data messages a peer may send
+// per DuplicateMessageScore added to its misbehavior score. Peers relaying
+// the same replacement race each other, so honest peers send a few.
+const duplicatesPerScore = 10
+
+// setPending records that the message with key from the peer is queued for or
+// in validation, or no longer if pending is false.
+func (p *Peer) setPending(key inventoryKey, pending bool) {
+	p.pendingDataMu.Lock()
+	defer p.pendingDataMu.Unlock()
+
+	if pending {
+		p.pendingData[key] = struct{}{}
+	} else {
+		delete(p.pendingData, key)
+	}
+}
+
+// knownData reports whether a data message from the peer for outpoint with
+// the sequence number is known already, either stored or sent by the peer and
+// waiting for validation. The same message waiting for validation from
+// another peer isn't known, an invalid copy sent first must not shadow it.
+func (p *Peer) knownData(outpoint message.Outpoint, sequence uint32) bool {
+	p.pendingDataMu.Lock()
+	_, pending := p.pendingData[inventoryKey{outpoint, sequence}]
+	p.pendingDataMu.Unlock()
+
+	return pending || p.manager.storedData(p.ctx, outpoint, sequence)
+}
+
+// skipDuplicate answers a data message skipped because it is known already,
+// as validation answers a duplicate. Every duplicatesPerScore of them add
+// DuplicateMessageScore to the misbehavior score of the peer.
+func (p *Peer) skipDuplicate(outpoint message.Outpoint, sequence uint32) error {
+	p.knownInv.add(inventoryKey{outpoint, sequence})
+	p.manager.requests.done(outpoint)
+
+	log.Debugf("Skipped known message %s (sequence %d) from peer %s",
+		outpoint.ToString(), sequence, p.addr)
+	if p.duplicatesSkipped.Add(1)%duplicatesPerScore == 0 {
+		p.manager.addMisbehavior(p, MisbehaviorDuplicateMessage)
+	}
+	return p.answerData(outpoint, message.ErrDuplicateOutpoint)
+}
+
+// storedData reports whether validation would reject a message for outpoint
+// with the sequence number as a duplicate: the outpoint was seen and the
+// message has sequence 0, or the message stored for it has that sequence
+// number or a greater one. Errors report the message as unknown, leaving it
+// to validation.
+func (m *Manager) storedData(ctx context.Context, outpoint message.Outpoint,
+	sequence uint32) bool {
+
+	seen, err := m.db.HasOutpoint(ctx, outpoint)
+	if err != nil || !seen {
+		return false
+	}
+	if sequence == 0 {
+		return true
+	}
+
+	frame, err := m.getDataFrame(ctx, outpoint)
+	if err != nil || frame == nil {
+		return false
+	}
+	stored := frame.payload()
+	_, storedSequence, err := message.ParseKey(stored, len(stored))
+	return err == nil && sequence <= storedSequence
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// getDataTimeout is how long we wait for requested data before asking
+	// another peer that announced the same outpoint.
+	getDataTimeout = 30 * time.Second
+
+	// requestCheckInterval is how often in-flight requests are checked for
+	// timeouts.
+	requestCheckInterval = 5 * time.Second
+)
+
+// inflightRequest is a getdata request waiting for its data.
+type inflightRequest struct {
+	peer      *Peer
+	requested time.Time
+
+	// announcers are other peers that announced the outpoint while the
+	// request was in flight, in the order they did so.
+	announcers []*Peer
+}
+
+// requestTracker tracks outpoints requested with getdata so the same message
+// is only requested from one peer at a time.
+type requestTracker struct {
+	timeout time.Duration
+
+	// deprioritizeLagging falls back to the announcers lagging behind our
+	// chain tip only after the others. Trusted announcers are always
+	// fallen back to first.
+	deprioritizeLagging bool
+
+	requests map[message.Outpoint]*inflightRequest
+	mu       sync.Mutex
+}
+
+// newRequestTracker creates a request tracker that gives up on a peer after
+// timeout. Trusted peers are asked first and, with deprioritizeLagging, peers
+// lagging behind our chain tip last.
+func newRequestTracker(timeout time.Duration,
+	deprioritizeLagging bool) *requestTracker {
+
+	return &requestTracker{
+		timeout:             timeout,
+		deprioritizeLagging: deprioritizeLagging,
+		requests:            make(map[message.Outpoint]*inflightRequest),
+	}
+}
+
+// request records that peer announced outpoint. It returns true if outpoint
+// should be requested from peer now, or false if a request is already in
+// flight, in which case peer is remembered as a fallback.
+func (t *requestTracker) request(outpoint message.Outpoint, peer *Peer,
+	now time.Time) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.requests[outpoint]
+	if !ok {
+		t.requests[outpoint] = &inflightRequest{
+			peer:      peer,
+			requested: now,
+		}
+		return true
+	}
+
+	if req.peer == peer {
+		return false
+	}
+	insert := len(req.announcers)
+	for i, announcer := range req.announcers {
+		if announcer == peer {
+			return false
+		}
+		if insert == len(req.announcers) &&
+			t.rank(announcer) > t.rank(peer) {
+
+			insert = i
+		}
+	}
+	req.announcers = slices.Insert(req.announcers, insert, peer)
+	return false
+}
+
+// rank orders the announcers of an outpoint, lowest first: trusted peers,
+// then the others, then with deprioritizeLagging those lagging behind our
+// chain tip.
+func (t *requestTracker) rank(peer *Peer) int {
+	switch {
+	case peer.trusted.Load():
+		return 0
+	case t.deprioritizeLagging && peer.lagging.Load():
+		return 2
+	default:
+		return 1
+	}
+}
+
+// requestedFrom reports whether outpoint is currently requested from peer.
+func (t *requestTracker) requestedFrom(outpoint message.Outpoint,
+	peer *Peer) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.requests[outpoint]
+	return ok && req.peer == peer
+}
+
+// inflight reports whether outpoint is currently requested from a peer.
+func (t *requestTracker) inflight(outpoint message.Outpoint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.requests[outpoint]
+	return ok
+}
+
+// done clears the request for outpoint once its data arrived.
+func (t *requestTracker) done(outpoint message.Outpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, outpoint)
+}
+
+// reassign moves the request for outpoint from peer, which won't answer it,
+// to the next peer that announced the outpoint and returns that peer. Without
+// another announcer the request is dropped and nil is returned.
+func (t *requestTracker) reassign(outpoint message.Outpoint, peer *Peer,
+	now time.Time) *Peer {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	req, ok := t.requests[outpoint]
+	if !ok || req.peer != peer {
+		return nil
+	}
+	if len(req.announcers) == 0 {
+		delete(t.requests, outpoint)
+		return nil
+	}
+
+	req.peer = req.announcers[0]
+	req.announcers = req.announcers[1:]
+	req.requested = now
+	return req.peer
+}
+
+// expire reassigns timed out requests to the next peer that announced the
+// outpoint and returns the requests to send. Requests without another
+// announcer are dropped so a later inv can ask again.
+func (t *requestTracker) expire(now time.Time) map[message.Outpoint]*Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	retries := make(map[message.Outpoint]*Peer)
+	for outpoint, req := range t.requests {
+		if now.Sub(req.requested) < t.timeout {
+			continue
+		}
+		if len(req.announcers) == 0 {
+			delete(t.requests, outpoint)
+			continue
+		}
+
+		req.peer = req.announcers[0]
+		req.announcers = req.announcers[1:]
+		req.requested = now
+		retries[outpoint] = req.peer
+	}
+	return retries
+}
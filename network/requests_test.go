@@ -0,0 +1,86 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// getDataCounts returns the number of getdata frames for outpoint each of
+// remotes received during window.
+func getDataCounts(t *testing.T, outpoint message.Outpoint,
+	window time.Duration, remotes ...*testRemote) []int {
+
+	t.Helper()
+
+	counts := make([]int, len(remotes))
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		for i, remote := range remotes {
+			select {
+			case frame, ok := <-remote.frames:
+				if !ok {
+					t.Fatalf("remote %d disconnected", i)
+				}
+				if frame.msgType == MessageTypeGetData &&
+					bytes.Equal(frame.payload, outpoint[:]) {
+
+					counts[i]++
+				}
+			default:
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return counts
+}
+
+// TestGetDataDeduplicated checks that an outpoint announced by two peers is
+// only requested from one of them.
+func TestGetDataDeduplicated(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	a, b := dialTestNode(t, node), dialTestNode(t, node)
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	a.send(MessageTypeInv, newInvPayload(outpoint))
+	b.send(MessageTypeInv, newInvPayload(outpoint))
+	a.send(MessageTypeInv, newInvPayload(outpoint))
+
+	counts := getDataCounts(t, outpoint, time.Second, a, b)
+	if counts[0]+counts[1] != 1 {
+		t.Fatalf("sent %v getdata requests, want one", counts)
+	}
+	if !node.requests.inflight(outpoint) {
+		t.Fatal("request not in flight")
+	}
+}
+
+// TestGetDataTimeout checks that an outpoint is requested from the second
+// peer that announced it once the first didn't answer in time.
+func TestGetDataTimeout(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	node.requests.mu.Lock()
+	node.requests.timeout = 100 * time.Millisecond
+	node.requests.mu.Unlock()
+	a, b := dialTestNode(t, node), dialTestNode(t, node)
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	a.send(MessageTypeInv, newInvPayload(outpoint))
+	waitFor(t, "request to A", func() bool {
+		return node.requests.inflight(outpoint)
+	})
+	b.send(MessageTypeInv, newInvPayload(outpoint))
+
+	// The timeouts are checked every requestCheckInterval
+	counts := getDataCounts(t, outpoint, requestCheckInterval+time.Second,
+		a, b)
+	if counts[0] != 1 || counts[1] != 1 {
+		t.Fatalf("sent %v getdata requests, want one to each", counts)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// retryInterval is how often held messages are validated again while the
+// Bitcoin node is unreachable.
+const retryInterval = 5 * time.Second
+
+// heldMessage is a message waiting for the Bitcoin node to come back so it
+// can be validated.
+type heldMessage struct {
+	msg     *message.Message
+	msgData []byte
+
+	// source is the peer that sent the message. It is answered with an
+	// ack or reject once the message is validated, if still connected.
+	// It is nil for a message restored from the spool after a restart,
+	// sourceAddr is the address of the peer either way.
+	source     *Peer
+	sourceAddr string
+
+	held time.Time
+}
+
+// retryQueue holds messages whose validation failed because the Bitcoin node
+// was unreachable, oldest first. Messages are dropped once they have waited
+// longer than the TTL, and new ones are refused while the queue is full. The
+// queue is mirrored to a spool on disk, so the messages are validated after a
+// restart. It is safe for concurrent use.
+type retryQueue struct {
+	limit int
+	ttl   time.Duration
+	spool *spool
+
+	entries map[inventoryKey]*list.Element
+	order   *list.List
+	mu      sync.Mutex
+}
+
+// newRetryQueue creates a retry queue holding at most limit messages for at
+// most ttl each, spooled to dataDir unless it is empty.
+func newRetryQueue(limit int, ttl time.Duration, dataDir string) *retryQueue {
+	return &retryQueue{
+		limit:   limit,
+		ttl:     ttl,
+		spool:   newSpool(dataDir),
+		entries: make(map[inventoryKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add holds a message and reports whether it is queued, which includes the
+// case of it already being queued. Failing to spool it only costs the
+// message if the node restarts before it is validated.
+func (q *retryQueue) add(held *heldMessage) bool {
+	if !q.push(held) {
+		return false
+	}
+	if err := q.spool.write(held); err != nil {
+		log.Warnf("Failed to spool message %s: %v",
+			held.msg.Outpoint.ToString(), err)
+	}
+	return true
+}
+
+// push adds a held message to the queue without spooling it, and reports
+// whether it is queued.
+func (q *retryQueue) push(held *heldMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := inventoryKey{held.msg.Outpoint, held.msg.Sequence}
+	if _, ok := q.entries[key]; ok {
+		return true
+	}
+	if q.order.Len() >= q.limit {
+		return false
+	}
+	q.entries[key] = q.order.PushBack(held)
+	return true
+}
+
+// restore queues the messages spooled by a previous run, oldest first. Those
+// that no longer fit in the queue are dropped.
+func (q *retryQueue) restore() error {
+	spooled, err := q.spool.load()
+	if err != nil {
+		return err
+	}
+
+	for _, held := range spooled {
+		if !q.push(held) {
+			log.Warnf("Dropping spooled message %s from peer %s: the "+
+				"queue is full", held.msg.Outpoint.ToString(),
+				held.sourceAddr)
+			q.spool.remove(held)
+		}
+	}
+	if len(spooled) > 0 {
+		log.Infof("Restored %d messages waiting for the Bitcoin node",
+			len(spooled))
+	}
+	return nil
+}
+
+// remove drops a held message from the queue.
+func (q *retryQueue) remove(held *heldMessage) {
+	q.mu.Lock()
+	key := inventoryKey{held.msg.Outpoint, held.msg.Sequence}
+	elem, ok := q.entries[key]
+	if ok {
+		q.order.Remove(elem)
+		delete(q.entries, key)
+	}
+	q.mu.Unlock()
+
+	if ok {
+		q.spool.remove(held)
+	}
+}
+
+// expire drops and returns the messages held longer than the TTL at now.
+func (q *retryQueue) expire(now time.Time) []*heldMessage {
+	q.mu.Lock()
+	var expired []*heldMessage
+	for elem := q.order.Front(); elem != nil; elem = q.order.Front() {
+		held := elem.Value.(*heldMessage)
+		if now.Sub(held.held) < q.ttl {
+			break
+		}
+		q.order.Remove(elem)
+		delete(q.entries, inventoryKey{held.msg.Outpoint, held.msg.Sequence})
+		expired = append(expired, held)
+	}
+	q.mu.Unlock()
+
+	for _, held := range expired {
+		q.spool.remove(held)
+	}
+	return expired
+}
+
+// pending returns the held messages, oldest first.
+func (q *retryQueue) pending() []*heldMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	held := make([]*heldMessage, 0, q.order.Len())
+	for elem := q.order.Front(); elem != nil; elem = elem.Next() {
+		held = append(held, elem.Value.(*heldMessage))
+	}
+	return held
+}
+
+// len returns the number of held messages.
+func (q *retryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.order.Len()
+}
+
+// holdMessage queues a message from source whose validation failed because
+// the Bitcoin node was unreachable. It returns false if the queue is full.
+func (m *Manager) holdMessage(msg *message.Message, msgData []byte,
+	source *Peer) bool {
+
+	held := &heldMessage{
+		msg:        msg,
+		msgData:    msgData,
+		source:     source,
+		sourceAddr: source.addr,
+		held:       time.Now(),
+	}
+	if !m.retries.add(held) {
+		log.Debugf("Dropping message %s from peer %s: %d messages are "+
+			"already waiting for the Bitcoin node", msg.Outpoint.ToString(),
+			source.addr, m.config.MaxRetryQueue)
+		m.retriesDropped.Add(1)
+		return false
+	}
+
+	log.Debugf("Holding message %s from peer %s until the Bitcoin node is "+
+		"reachable", msg.Outpoint.ToString(), source.addr)
+	return true
+}
+
+// retryLoop periodically validates the held messages again.
+func (m *Manager) retryLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case now := <-ticker.C:
+			m.retryHeld(ctx, now)
+		}
+	}
+}
+
+// retryHeld drops expired held messages and validates the others again,
+// oldest first, until the Bitcoin node turns out to be still unreachable.
+// The peers that sent them are answered as if the messages had just arrived.
+func (m *Manager) retryHeld(ctx context.Context, now time.Time) {
+	for _, held := range m.retries.expire(now) {
+		log.Debugf("Dropping message %s from peer %s, the Bitcoin node was "+
+			"unreachable for %v", held.msg.Outpoint.ToString(),
+			held.sourceAddr, now.Sub(held.held))
+		m.retriesDropped.Add(1)
+		err := fmt.Errorf("%w for %v", message.ErrRPCUnavailable,
+			m.retries.ttl)
+		m.rejectMessage(held.msg.Outpoint, held.msg, held.sourceAddr, err)
+
+		if held.source != nil && !held.source.disconnecting() {
+			held.source.answerData(held.msg.Outpoint, err)
+		}
+	}
+
+	for _, held := range m.retries.pending() {
+		_, err := m.acceptMessageFrom(ctx, held.msg, held.msgData,
+			held.source, held.sourceAddr)
+		if errors.Is(err, message.ErrRPCUnavailable) {
+			return
+		}
+		m.retries.remove(held)
+
+		peer := held.source
+		if peer == nil {
+			if err != nil {
+				log.Debugf("Spooled message %s from peer %s rejected: %v",
+					held.msg.Outpoint.ToString(), held.sourceAddr, err)
+			}
+			continue
+		}
+		if peer.disconnecting() {
+			continue
+		}
+		if err := peer.answerData(held.msg.Outpoint, err); err != nil {
+			if kind, ok := misbehaviorKind(err); ok {
+				log.Warnf("Held message from peer %s was invalid: %v. "+
+					"Disconnecting.", peer.addr, err)
+				m.addMisbehavior(peer, kind)
+				peer.Disconnect()
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestRetryUnreachable checks that a message from a peer whose UTXO lookup
+// fails while the Bitcoin node is unreachable is held rather than rejected,
+// and validated once the node answers again, without the peer being
+// disconnected.
+func TestRetryUnreachable(t *testing.T) {
+	const failures = 3
+
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	remote := dialTestNode(t, node)
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msgData := signTestMessage(t, node.client, outpoint, "hello").Serialize()
+	node.client.FailCalls(mock.MethodGetTxOut, failures, syscall.ECONNREFUSED)
+	remote.send(MessageTypeData, msgData)
+	waitFor(t, "message held", func() bool {
+		stats := node.Stats()
+		return stats.HeldMessages == 1 && stats.RPCDegraded
+	})
+
+	// Retry until the node answers, instead of waiting for the retry loop
+	for i := 0; ; i++ {
+		if i > failures {
+			t.Fatalf("message still held after %d retries", i)
+		}
+		node.retryHeld(ctx, time.Now())
+		if node.Stats().HeldMessages == 0 {
+			break
+		}
+	}
+
+	frame, ok := remote.next(MessageTypeAck, MessageTypeReject)
+	if !ok || frame.msgType != MessageTypeAck ||
+		!bytes.Equal(frame.payload, outpoint[:]) {
+
+		t.Fatalf("peer got %v, %v, want an ack", frame.msgType, ok)
+	}
+	stats := node.Stats()
+	if stats.RPCDegraded || stats.MessagesStored != 1 ||
+		stats.MessagesRejected != 0 || len(stats.Peers) != 1 {
+
+		t.Fatalf("degraded %v, %d stored, %d rejected, %d peers",
+			stats.RPCDegraded, stats.MessagesStored, stats.MessagesRejected,
+			len(stats.Peers))
+	}
+	if stored, _ := node.db.HasOutpoint(ctx, outpoint); !stored {
+		t.Fatal("held message not stored")
+	}
+}
+
+// TestRetryQueueLimit checks that the queue refuses messages beyond its
+// limit, holds a message only once and drops messages past their TTL.
+func TestRetryQueueLimit(t *testing.T) {
+	start := time.Now()
+	outpoint := func(i byte) message.Outpoint {
+		return message.NewOutpoint([32]byte{i}, 0)
+	}
+	held := func(i byte, at time.Duration) *heldMessage {
+		return &heldMessage{
+			msg:  &message.Message{Outpoint: outpoint(i)},
+			held: start.Add(at),
+		}
+	}
+
+	q := newRetryQueue(2, time.Minute, "")
+	if !q.add(held(1, 0)) || !q.add(held(2, time.Second)) ||
+		!q.add(held(1, 0)) || q.len() != 2 {
+
+		t.Fatalf("queued %d messages, want 2", q.len())
+	}
+	if q.add(held(3, 0)) {
+		t.Fatal("message queued beyond the limit")
+	}
+
+	expired := q.expire(start.Add(time.Minute))
+	if len(expired) != 1 || expired[0].msg.Outpoint != outpoint(1) || q.len() != 1 {
+		t.Fatalf("expired %d messages, %d left", len(expired), q.len())
+	}
+	if !q.add(held(3, 0)) {
+		t.Fatal("message refused after one expired")
+	}
+}
+
+// spooled returns the number of messages in the spool of dataDir.
+func spooled(t *testing.T, dataDir string) int {
+	t.Helper()
+
+	held, err := newSpool(dataDir).load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return len(held)
+}
+
+// TestSpoolRetry checks that messages relayed while the Bitcoin node is
+// unreachable are spooled, then stored and announced in arrival order once
+// it answers again, and that the spool drains to empty. Messages spooled
+// before a restart are validated by the restarted node.
+func TestSpoolRetry(t *testing.T) {
+	const count = 3
+
+	ctx := context.Background()
+	cfg := testNodeConfig()
+	cfg.DataDir = t.TempDir()
+	client, db := mock.NewClient(), database.NewMemoryDB()
+	node := startTestNodeWith(t, cfg, client, db)
+	relay, watcher := dialTestNode(t, node), dialTestNode(t, node)
+
+	// relayDown relays the messages numbered from first while the Bitcoin
+	// node is down, and waits until they are spooled
+	relayDown := func(relay *testRemote, first int) []message.Outpoint {
+		t.Helper()
+
+		client.SetError(mock.MethodGetTxOut, syscall.ECONNREFUSED)
+		var outpoints []message.Outpoint
+		for i := first; i < first+count; i++ {
+			outpoint := inventoryOutpoint(i)
+			msg := signTestMessage(t, client, outpoint, "spooled")
+			relay.send(MessageTypeData, msg.Serialize())
+			outpoints = append(outpoints, outpoint)
+		}
+		waitFor(t, "messages spooled", func() bool {
+			return spooled(t, cfg.DataDir) == count
+		})
+		return outpoints
+	}
+
+	outpoints := relayDown(relay, 0)
+	client.SetError(mock.MethodGetTxOut, nil)
+	node.retryHeld(ctx, time.Now())
+
+	var announced []message.Outpoint
+	for len(announced) < count {
+		announced = append(announced, nextInv(t, watcher)...)
+	}
+	for i, outpoint := range outpoints {
+		if announced[i] != outpoint {
+			t.Fatalf("announced %s as message %d, want %s",
+				announced[i].ToString(), i, outpoint.ToString())
+		}
+		if stored, _ := db.HasOutpoint(ctx, outpoint); !stored {
+			t.Fatalf("spooled message %d not stored", i)
+		}
+	}
+	if n := spooled(t, cfg.DataDir); n != 0 || node.Stats().HeldMessages != 0 {
+		t.Fatalf("%d messages left in the spool, %d held", n,
+			node.Stats().HeldMessages)
+	}
+
+	// Messages spooled when the node stops are validated after a restart
+	outpoints = relayDown(relay, count)
+	node.Stop()
+	client.SetError(mock.MethodGetTxOut, nil)
+	restarted := startTestNodeWith(t, cfg, client, db)
+	if n := restarted.Stats().HeldMessages; n != count {
+		t.Fatalf("%d spooled messages restored, want %d", n, count)
+	}
+	restarted.retryHeld(ctx, time.Now())
+	for i, outpoint := range outpoints {
+		if stored, _ := db.HasOutpoint(ctx, outpoint); !stored {
+			t.Fatalf("message %d spooled before the restart not stored", i)
+		}
+	}
+	if n := spooled(t, cfg.DataDir); n != 0 {
+		t.Fatalf("%d messages left in the spool after the restart", n)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+var (
+	// errCorrupt is returned for a stored message that no longer verifies.
+	errCorrupt = errors.New("stored message does not verify")
+
+	// errUnverifiable is returned for a stored message whose UTXO is gone
+	// and whose output key wasn't recorded.
+	errUnverifiable = errors.New("output script unknown")
+)
+
+// RevalidateFailure is a stored message that no longer verifies.
+type RevalidateFailure struct {
+	Outpoint message.Outpoint
+	Err      error
+}
+
+// RevalidateResult is the outcome of Revalidate.
+type RevalidateResult struct {
+	// Checked is the number of messages verified, Unverifiable the number
+	// of those whose output script couldn't be recovered.
+	Checked      int
+	Unverifiable int
+
+	// Invalid are the messages that failed to verify and were removed.
+	Invalid []RevalidateFailure
+}
+
+// Revalidate verifies every stored message again, ignoring the validation
+// record it was stored with: that it decodes for its outpoint, that its
+// payload matches its content type and that its signature verifies against
+// the script of its UTXO. Messages whose UTXO was spent are checked against
+// the recorded output key. The messages that fail, which points at a corrupt
+// database, are removed without announcing it to the peers. The pass stops
+// with message.ErrRPCUnavailable if the Bitcoin node can't be reached.
+func (m *Manager) Revalidate(ctx context.Context) (*RevalidateResult, error) {
+	result := &RevalidateResult{}
+	cursor := ""
+	for {
+		entries, next, err := m.db.ListMessages(ctx, cursor,
+			database.MaxListLimit)
+		if err != nil {
+			return result, fmt.Errorf("failed to list messages: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			err := m.revalidateEntry(ctx, &entry)
+			result.Checked++
+			switch {
+			case err == nil:
+
+			case errors.Is(err, errUnverifiable):
+				result.Unverifiable++
+
+			case errors.Is(err, errCorrupt):
+				log.Warnf("Stored message %s is invalid: %v",
+					entry.Outpoint.ToString(), err)
+				if err := m.removeCorrupt(ctx, &entry); err != nil {
+					return result, err
+				}
+				result.Invalid = append(result.Invalid,
+					RevalidateFailure{entry.Outpoint, err})
+
+			default:
+				return result, fmt.Errorf("failed to revalidate "+
+					"message %s: %w", entry.Outpoint.ToString(), err)
+			}
+		}
+		cursor = next
+	}
+
+	log.Infof("Revalidated %d stored messages, %d invalid, %d unverifiable",
+		result.Checked, len(result.Invalid), result.Unverifiable)
+	return result, nil
+}
+
+// revalidateEntry verifies a stored message. Definite failures are wrapped
+// in errCorrupt.
+func (m *Manager) revalidateEntry(ctx context.Context,
+	entry *database.MessageEntry) error {
+
+	msg, err := message.Deserialize(entry.Data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	if msg.Outpoint != entry.Outpoint {
+		return fmt.Errorf("%w: stored for outpoint %s", errCorrupt,
+			msg.Outpoint.ToString())
+	}
+	if err := msg.ValidateContent(); err != nil {
+		return fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+
+	pkScript, err := m.revalidationScript(ctx, entry)
+	if err != nil {
+		return err
+	}
+	err = m.validator.VerifyWitness(string(msg.SignedData()),
+		msg.SignatureWitness(), pkScript)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return nil
+}
+
+// revalidationScript returns the script a stored message must be signed for:
+// the one of its UTXO, or the taproot script of the recorded output key if
+// the UTXO is no longer available.
+func (m *Manager) revalidationScript(ctx context.Context,
+	entry *database.MessageEntry) ([]byte, error) {
+
+	recorded := entry.Meta.PubKey
+	txOut, err := m.validator.LookupUTXO(ctx, entry.Outpoint)
+	switch {
+	case err == nil:
+		pkScript, err := m.validator.GetPKScript(txOut)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorrupt, err)
+		}
+		outputKey := database.TaprootOutputKey(pkScript)
+		if recorded != nil && !bytes.Equal(recorded, outputKey) {
+			return nil, fmt.Errorf("%w: recorded key %x is not the "+
+				"output key", errCorrupt, recorded)
+		}
+		return pkScript, nil
+
+	case errors.Is(err, message.ErrUTXOSpent),
+		errors.Is(err, message.ErrUTXONotFound),
+		errors.Is(err, database.ErrUnconfirmedOutpoint):
+
+		if recorded == nil {
+			return nil, errUnverifiable
+		}
+		pubKey, err := schnorr.ParsePubKey(recorded)
+		if err != nil {
+			return nil, fmt.Errorf("%w: recorded key: %v", errCorrupt,
+				err)
+		}
+		return txscript.PayToTaprootScript(pubKey)
+
+	default:
+		return nil, err
+	}
+}
+
+// removeCorrupt removes a stored message that failed to verify, unless it
+// was replaced in the meantime.
+func (m *Manager) removeCorrupt(ctx context.Context,
+	entry *database.MessageEntry) error {
+
+	m.outpointLocks.lock(entry.Outpoint)
+	defer m.outpointLocks.unlock(entry.Outpoint)
+
+	stored, err := m.db.GetMessage(ctx, entry.Outpoint)
+	if err != nil || !bytes.Equal(stored, entry.Data) {
+		return nil
+	}
+
+	outpoints := []message.Outpoint{entry.Outpoint}
+	if err := m.db.RemoveOutpoints(ctx, outpoints); err != nil {
+		return fmt.Errorf("failed to remove invalid message: %v", err)
+	}
+	m.msgCache.remove(outpoints...)
+	m.journal.remove(outpoints)
+	m.publishRemoved(outpoints, RemovalInvalid)
+	return nil
+}
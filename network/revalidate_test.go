@@ -0,0 +1,74 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestRevalidateCorrupt checks that a stored message with a corrupted
+// payload byte is flagged and removed by Revalidate, while the intact ones
+// are left as they were.
+func TestRevalidateCorrupt(t *testing.T) {
+	ctx := context.Background()
+	m, client, db := newTestManager(t)
+
+	var (
+		outpoints []message.Outpoint
+		stored    [][]byte
+	)
+	for i := byte(1); i <= 3; i++ {
+		outpoint := message.NewOutpoint([32]byte{i}, 0)
+		msgData := signTestMessage(t, client, outpoint, "hello").Serialize()
+		if err := m.ImportMessage(ctx, msgData, false); err != nil {
+			t.Fatalf("ImportMessage: %v", err)
+		}
+		outpoints, stored = append(outpoints, outpoint),
+			append(stored, msgData)
+	}
+
+	// The memory database hands out the bytes it holds, so flipping one
+	// corrupts the stored message as a disk error would
+	corrupt := outpoints[1]
+	data, err := db.GetMessage(ctx, corrupt)
+	if err != nil || data == nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	data[len(data)-1] ^= 0x01
+
+	result, err := m.Revalidate(ctx)
+	if err != nil {
+		t.Fatalf("Revalidate: %v", err)
+	}
+	if result.Checked != 3 || len(result.Invalid) != 1 ||
+		result.Unverifiable != 0 {
+
+		t.Fatalf("checked %d, %d invalid, %d unverifiable, want 3, 1, 0",
+			result.Checked, len(result.Invalid), result.Unverifiable)
+	}
+	failure := result.Invalid[0]
+	if failure.Outpoint != corrupt || !errors.Is(failure.Err, errCorrupt) {
+		t.Fatalf("flagged %s: %v, want %s", failure.Outpoint.ToString(),
+			failure.Err, corrupt.ToString())
+	}
+
+	for i, outpoint := range outpoints {
+		data, err := db.GetMessage(ctx, outpoint)
+		if err != nil {
+			t.Fatalf("GetMessage: %v", err)
+		}
+		switch {
+		case outpoint == corrupt && data != nil:
+			t.Fatal("corrupted message still stored")
+		case outpoint != corrupt && !bytes.Equal(data, stored[i]):
+			t.Fatalf("intact message %d changed to %x", i, data)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// stopWithin stops node and fails the test unless Stop returned within
+// bound. It returns the error of Stop.
+func stopWithin(t *testing.T, node *testNode, bound time.Duration) error {
+	t.Helper()
+
+	start := time.Now()
+	err := node.Stop()
+	if took := time.Since(start); took > bound {
+		t.Fatalf("Stop took %v, want under %v", took, bound)
+	}
+	return err
+}
+
+// TestStopBlockedRead checks that a node stops promptly while a peer is
+// blocked in the middle of reading a frame, and while a message from a peer
+// is waiting for a Bitcoin node that doesn't answer.
+func TestStopBlockedRead(t *testing.T) {
+	node := startTestNode(t, testNodeConfig())
+	partial := dialTestNode(t, node)
+	validating := dialTestNode(t, node)
+	waitFor(t, "peers connected", func() bool {
+		return len(node.Stats().Peers) == 2
+	})
+
+	// Half a frame header leaves the node reading the rest
+	partial.conn.Write([]byte{byte(MessageTypeData), 0xff})
+
+	// The UTXO lookup only returns once its context is canceled
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, node.client, outpoint, "stuck")
+	node.client.SetLatency(time.Hour)
+	validating.send(MessageTypeData, msg.Serialize())
+	waitFor(t, "UTXO lookup started", func() bool {
+		return node.client.Calls(mock.MethodGetTxOut) > 0
+	})
+
+	if err := stopWithin(t, node, 2*time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for name, remote := range map[string]*testRemote{"reading": partial,
+		"validating": validating} {
+
+		if !remote.disconnected() {
+			t.Fatalf("%s peer still connected", name)
+		}
+	}
+}
+
+// TestStopHungPeer checks that Stop gives up on a peer stuck writing to a
+// connection nobody reads after ShutdownTimeout, closing it.
+func TestStopHungPeer(t *testing.T) {
+	cfg := testNodeConfig()
+	cfg.ShutdownTimeout = 1
+	node := startTestNode(t, cfg)
+
+	// The handshake of an outbound peer on a pipe nobody reads blocks
+	// writing the version for HandshakeTimeout. Reading its first byte
+	// tells the write started.
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	peer := node.addPeer(conn, "10.0.0.1:8335")
+	node.wg.Add(1)
+	go node.handleConnection(peer)
+	if _, err := remote.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	err := stopWithin(t, node, time.Second+time.Second/2)
+	if err == nil {
+		t.Fatal("Stop reported no hung peer")
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Fatal("connection of the hung peer not closed")
+	}
+}
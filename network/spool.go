@@ -0,0 +1,157 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+const (
+	// spoolDirName is the name of the directory in the data directory
+	// holding the messages waiting for the Bitcoin node.
+	spoolDirName = "spool"
+
+	// spoolFileExt is the extension of a spooled message file.
+	spoolFileExt = ".msg"
+)
+
+// spool persists held messages to a directory, one file per message, so
+// messages received while the Bitcoin node is unreachable survive a restart.
+// A file is named after the time its message was held, the outpoint and the
+// sequence, so sorting the names restores the arrival order. It holds the
+// 1-byte length prefixed address of the peer that sent the message, followed
+// by the serialized message.
+type spool struct {
+	dir string
+}
+
+// newSpool creates a spool in dataDir. If dataDir is empty nothing is
+// persisted.
+func newSpool(dataDir string) *spool {
+	var dir string
+	if dataDir != "" {
+		dir = filepath.Join(dataDir, spoolDirName)
+	}
+	return &spool{dir: dir}
+}
+
+// fileName returns the name of the file of a held message.
+func (s *spool) fileName(held *heldMessage) string {
+	return fmt.Sprintf("%020d-%x-%d%s", held.held.UnixNano(),
+		held.msg.Outpoint[:], held.msg.Sequence, spoolFileExt)
+}
+
+// write persists a held message.
+func (s *spool) write(held *heldMessage) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", s.dir, err)
+	}
+
+	addr := held.sourceAddr
+	if len(addr) > 255 {
+		addr = addr[:255]
+	}
+	data := make([]byte, 0, 1+len(addr)+len(held.msgData))
+	data = append(data, byte(len(addr)))
+	data = append(data, addr...)
+	data = append(data, held.msgData...)
+
+	path := filepath.Join(s.dir, s.fileName(held))
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// remove deletes the file of a held message.
+func (s *spool) remove(held *heldMessage) {
+	if s.dir == "" {
+		return
+	}
+
+	path := filepath.Join(s.dir, s.fileName(held))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove spooled message: %v", err)
+	}
+}
+
+// load reads the messages spooled by a previous run, oldest first. Files
+// that can't be read are deleted.
+func (s *spool) load() ([]*heldMessage, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %v", s.dir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spoolFileExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var held []*heldMessage
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		entry, err := readSpoolFile(path, name)
+		if err != nil {
+			log.Warnf("Dropping spooled message %s: %v", name, err)
+			os.Remove(path)
+			continue
+		}
+		held = append(held, entry)
+	}
+	return held, nil
+}
+
+// readSpoolFile reads the held message spooled at path.
+func readSpoolFile(path, name string) (*heldMessage, error) {
+	stamp, _, _ := strings.Cut(name, "-")
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad file name")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return nil, fmt.Errorf("truncated file")
+	}
+	addrLen := int(data[0])
+	msgData := data[1+addrLen:]
+	msg, err := message.Deserialize(msgData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &heldMessage{
+		msg:        msg,
+		msgData:    msgData,
+		sourceAddr: string(data[1 : 1+addrLen]),
+		held:       time.Unix(0, nanos),
+	}, nil
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"sort"
+	"time"
+)
+
+// PeerStats describes the traffic of a connected peer.
+type PeerStats struct {
+	Addr        string
+	Outbound    bool
+	ConnectedAt time.Time
+
+	// Version is the protocol version and UserAgent the software the peer
+	// announced in the handshake, zero and empty for legacy peers.
+	Version   uint32
+	UserAgent string
+
+	// PeerKey is the identity key the peer proved it holds in the
+	// handshake, empty if it has none.
+	PeerKey string
+
+	// Trusted is set for a peer in the trusted peers, exempt from rate
+	// limits, upload caps and misbehavior scoring.
+	Trusted bool
+
+	BytesReceived uint64
+	BytesSent     uint64
+
+	// ReceivedWindow and SentWindow are the bytes exchanged with the peer
+	// in the current hour, which its upload cap applies to.
+	ReceivedWindow uint64
+	SentWindow     uint64
+
+	// LastRecv and LastSend are the times a frame was last read from and
+	// written to the peer. They are zero if that never happened.
+	LastRecv time.Time
+	LastSend time.Time
+
+	// Tip is the best block the peer announced, nil if it didn't. Lagging
+	// is set while it is more than MaxTipLag blocks behind ours.
+	Tip     *ChainTip
+	Lagging bool
+
+	// Announce tells how many of the messages announced to the peer it
+	// fetched.
+	Announce AnnounceStats
+
+	// DuplicatesSkipped is the number of data messages the peer sent that
+	// were known already, skipped without being validated.
+	DuplicatesSkipped uint64
+}
+
+// Stats holds counters describing the state of the network manager.
+type Stats struct {
+	// Peers describes every connected peer, sorted by address.
+	Peers []PeerStats
+
+	// IdentityKey is the identity key of this node, empty if it has none.
+	IdentityKey string
+
+	// InboundPeers and OutboundPeers are the connection slots in use,
+	// MaxInboundPeers and MaxOutboundPeers the configured limits.
+	InboundPeers     int
+	OutboundPeers    int
+	MaxInboundPeers  int
+	MaxOutboundPeers int
+
+	// InboundRejected is the number of inbound connections closed because
+	// every slot was taken. InboundEvicted is the number of idle inbound
+	// peers evicted to make room for a new connection.
+	InboundRejected uint64
+	InboundEvicted  uint64
+
+	// MessagesStored is the number of messages accepted and stored since
+	// the manager started, whether delivered by peers or submitted
+	// locally.
+	MessagesStored uint64
+
+	// MessagesRejected is the number of messages that failed validation.
+	// Duplicates of stored messages are not counted.
+	MessagesRejected uint64
+
+	// MessagesBlocked is the number of valid messages dropped because
+	// their sender or outpoint is blocked.
+	MessagesBlocked uint64
+
+	// MessagesSuppressed is the number of valid messages dropped because
+	// their payload was already stored MaxDuplicatePayloads times.
+	MessagesSuppressed uint64
+
+	// RejectsJournaled is the number of entries in the reject journal and
+	// RejectsDropped the number of rejections left out of it because they
+	// came faster than it could be written.
+	RejectsJournaled int
+	RejectsDropped   uint64
+
+	RateLimit    RateLimitStats
+	Bandwidth    BandwidthStats
+	MessageCache MessageCacheStats
+
+	// UnknownFrames is the number of frames of unknown types skipped
+	// because the peer is on a later protocol version.
+	UnknownFrames uint64
+
+	// RPCDegraded is set while UTXO lookups fail to reach the Bitcoin
+	// node. Messages from peers are held meanwhile: HeldMessages is the
+	// number waiting and HeldDropped the number given up on because the
+	// queue was full or they waited too long.
+	RPCDegraded  bool
+	HeldMessages int
+	HeldDropped  uint64
+
+	// ValidationQueue is the number of messages from peers waiting for a
+	// validation worker.
+	ValidationQueue int
+
+	// Subscribers is the number of open event subscriptions.
+	Subscribers int
+
+	// PendingAnnounce is the number of messages originated by this node
+	// that too few peers acknowledged yet.
+	PendingAnnounce int
+
+	// Uptime is the time since the manager was started.
+	Uptime time.Duration
+}
+
+// Stats returns the network counters and a snapshot of the connected peers.
+func (m *Manager) Stats() Stats {
+	m.peersMu.RLock()
+	peers := make([]PeerStats, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer.stats())
+	}
+	m.peersMu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	stats := Stats{
+		Peers:              peers,
+		IdentityKey:        m.IdentityKey(),
+		MaxInboundPeers:    m.config.MaxInboundPeers,
+		MaxOutboundPeers:   m.config.MaxOutboundPeers,
+		InboundRejected:    m.inboundRejected.Load(),
+		InboundEvicted:     m.inboundEvicted.Load(),
+		MessagesStored:     m.messagesStored.Load(),
+		MessagesRejected:   m.messagesRejected.Load(),
+		MessagesBlocked:    m.messagesBlocked.Load(),
+		MessagesSuppressed: m.messagesSuppressed.Load(),
+		RateLimit:          m.RateLimitStats(),
+		Bandwidth:          m.BandwidthStats(),
+		UnknownFrames:      m.unknownFrames.Load(),
+		RPCDegraded:        m.rpcDegraded.Load(),
+		HeldMessages:       m.retries.len(),
+		HeldDropped:        m.retriesDropped.Load(),
+		ValidationQueue:    len(m.validations),
+		Subscribers:        m.events.len(),
+		PendingAnnounce:    m.journal.len(),
+		MessageCache:       m.msgCache.stats(),
+	}
+	stats.RejectsJournaled, stats.RejectsDropped = m.rejects.stats()
+	for _, peer := range peers {
+		if peer.Outbound {
+			stats.OutboundPeers++
+		} else {
+			stats.InboundPeers++
+		}
+	}
+	if !m.startTime.IsZero() {
+		stats.Uptime = time.Since(m.startTime)
+	}
+	return stats
+}
+
+// KnownPeers returns the peer addresses this node knows of, sorted by
+// address, including those it was connected to in earlier runs. Inbound peers
+// connect from arbitrary ports and are not remembered.
+func (m *Manager) KnownPeers() []KnownPeer {
+	known := m.addrManager.Known()
+
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	byAddr := make(map[string]*Peer, len(m.peers))
+	for _, peer := range m.peers {
+		if peer.outbound {
+			byAddr[peer.dialAddr] = peer
+		}
+	}
+	for i := range known {
+		peer, ok := byAddr[known[i].Addr]
+		if !ok {
+			continue
+		}
+		known[i].Connected = true
+		if _, userAgent := peer.announced(); userAgent != "" {
+			known[i].UserAgent = userAgent
+		}
+		if lastRecv := unixNanoTime(peer.lastRecv.Load()); !lastRecv.IsZero() {
+			known[i].LastSeen = lastRecv
+		}
+	}
+	return known
+}
+
+// stats returns the traffic counters of the peer.
+func (p *Peer) stats() PeerStats {
+	version, userAgent := p.announced()
+	now := time.Now()
+	sentWindow, receivedWindow := p.bandwidth.usage(now)
+	return PeerStats{
+		Addr:           p.addr,
+		Outbound:       p.outbound,
+		ConnectedAt:    p.connectedAt,
+		Version:        version,
+		UserAgent:      userAgent,
+		PeerKey:        p.identity(),
+		Trusted:        p.trusted.Load(),
+		BytesReceived:  p.bytesReceived.Load(),
+		BytesSent:      p.bytesSent.Load(),
+		ReceivedWindow: receivedWindow,
+		SentWindow:     sentWindow,
+		LastRecv:       unixNanoTime(p.lastRecv.Load()),
+		LastSend:       unixNanoTime(p.lastSend.Load()),
+		Tip:            p.tip.Load(),
+		Lagging:        p.lagging.Load(),
+		Announce:       p.announcements.stats(now),
+
+		DuplicatesSkipped: p.duplicatesSkipped.Load(),
+	}
+}
+
+// unixNanoTime converts unix nanoseconds to a time, mapping 0 to the zero
+// time.
+func unixNanoTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestStatsRelay checks that once a message submitted to one of two
+// connected nodes is relayed to the other, both report one connected peer
+// and one stored message.
+func TestStatsRelay(t *testing.T) {
+	ctx := context.Background()
+	a := startTestNode(t, testNodeConfig())
+	b := startTestNode(t, testNodeConfig(a.addr))
+	waitFor(t, "B connected to A", func() bool {
+		return len(a.Stats().Peers) == 1 && b.isConnected(a.addr)
+	})
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	msg := signTestMessage(t, a.client, outpoint, "hello")
+	b.client.AddUTXO(outpoint.WireOutPoint(), 50000,
+		utxoScript(t, a.client, outpoint))
+	if _, err := a.SubmitMessage(ctx, msg.Serialize()); err != nil {
+		t.Fatalf("SubmitMessage: %v", err)
+	}
+	waitFor(t, "message relayed to B", func() bool {
+		return b.Stats().MessagesStored == 1
+	})
+
+	for name, node := range map[string]*testNode{"A": a, "B": b} {
+		stats := node.Stats()
+		if len(stats.Peers) != 1 || stats.MessagesStored != 1 ||
+			stats.MessagesRejected != 0 {
+
+			t.Fatalf("%s has %d peers, %d messages stored, %d "+
+				"rejected, want 1, 1, 0", name, len(stats.Peers),
+				stats.MessagesStored, stats.MessagesRejected)
+		}
+		peer := stats.Peers[0]
+		if peer.Outbound != (node == b) {
+			t.Fatalf("%s sees its peer as outbound: %v", name,
+				peer.Outbound)
+		}
+		if peer.BytesReceived == 0 || peer.BytesSent == 0 ||
+			peer.LastRecv.IsZero() || peer.LastSend.IsZero() {
+
+			t.Fatalf("%s has no traffic with its peer: %+v", name, peer)
+		}
+		if stats.Uptime <= 0 {
+			t.Fatalf("%s up for %v", name, stats.Uptime)
+		}
+	}
+	if a.Stats().Peers[0].BytesSent < uint64(len(msg.Serialize())) {
+		t.Fatal("relayed message not counted in the bytes sent")
+	}
+}
+
+// TestPeerCounters checks that the traffic counters of a peer advance as
+// frames are written to and read from it.
+func TestPeerCounters(t *testing.T) {
+	m, _, _ := newTestManager(t)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := newTestPeer(t, m, conn, "10.0.0.1:8335")
+	go p.readMessages(bufio.NewReader(conn))
+
+	before := p.stats()
+	if before.BytesSent != 0 || before.BytesReceived != 0 ||
+		!before.LastSend.IsZero() || !before.LastRecv.IsZero() {
+
+		t.Fatalf("new peer has traffic: %+v", before)
+	}
+
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+	if err := p.SendMessage(MessageTypeAck, outpoint[:]); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := readFrame(remote, DefaultMaxFrameSize,
+		false); err != nil {
+
+		t.Fatalf("readFrame: %v", err)
+	}
+	if err := writeFrame(remote, MessageTypeAck, outpoint[:],
+		false); err != nil {
+
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	frameSize := uint64(headerSize(false) + len(outpoint))
+	waitFor(t, "frames counted", func() bool {
+		stats := p.stats()
+		return stats.BytesSent == frameSize &&
+			stats.BytesReceived == frameSize
+	})
+	after := p.stats()
+	if after.LastSend.Before(before.ConnectedAt) ||
+		after.LastRecv.Before(before.ConnectedAt) {
+
+		t.Fatalf("last activity %v, %v before connecting at %v",
+			after.LastSend, after.LastRecv, before.ConnectedAt)
+	}
+}
+
+// TestStatsConcurrent checks that peer snapshots can be taken while the
+// peer exchanges frames and its handshake details and address history
+// change. It is meant to run with -race.
+func TestStatsConcurrent(t *testing.T) {
+	const (
+		addr   = "10.0.0.1:8335"
+		rounds = 200
+	)
+
+	m, _, _ := newTestManager(t)
+	m.addrManager.AddAddress(addr)
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := NewPeer(context.Background(), conn, m)
+	p.addr, p.dialAddr, p.outbound = addr, addr, true
+	m.peersMu.Lock()
+	m.peers[addr] = p
+	m.peersMu.Unlock()
+	go p.writeMessages()
+	t.Cleanup(p.Disconnect)
+	go p.readMessages(bufio.NewReader(conn))
+
+	// The remote echoes every frame back
+	go func() {
+		for {
+			msgType, payload, err := readFrame(remote,
+				DefaultMaxFrameSize, false)
+			if err != nil {
+				return
+			}
+			if writeFrame(remote, msgType, payload, false) != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		outpoint := message.NewOutpoint([32]byte{1}, 0)
+		for i := 0; i < rounds; i++ {
+			if err := p.SendMessage(MessageTypeAck,
+				outpoint[:]); err != nil {
+
+				t.Errorf("SendMessage: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			p.mutex.Lock()
+			p.version, p.userAgent = ProtocolVersion,
+				fmt.Sprintf("/test:%d/", i)
+			p.mutex.Unlock()
+			m.addrManager.Seen(addr, "/test/", time.Now())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			stats := m.Stats()
+			if len(stats.Peers) != 1 || stats.OutboundPeers != 1 {
+				t.Errorf("snapshot of %d peers, %d outbound",
+					len(stats.Peers), stats.OutboundPeers)
+				return
+			}
+			known := m.KnownPeers()
+			if len(known) != 1 || !known[0].Connected {
+				t.Errorf("known peers %+v", known)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	waitFor(t, "echoes counted", func() bool {
+		stats := p.stats()
+		return stats.BytesReceived == stats.BytesSent &&
+			stats.BytesSent == rounds*uint64(headerSize(false)+
+				message.OutpointSize)
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const (
+	// tipVersion is the protocol version that added the chain tip to the
+	// version message and the tip message.
+	tipVersion = 6
+
+	// versionTipSize is the size of a chain tip in a version or tip
+	// message: a 4-byte little-endian height followed by the block hash.
+	versionTipSize = 4 + chainhash.HashSize
+
+	// tipCheckInterval is how often our chain tip is checked for changes
+	// to announce to peers.
+	tipCheckInterval = 5 * time.Second
+)
+
+// ChainTip identifies the best block processed by a node. A zero hash means
+// the tip is unknown.
+type ChainTip struct {
+	Height int32
+	Hash   chainhash.Hash
+}
+
+// known reports whether the tip identifies a block.
+func (t ChainTip) known() bool {
+	return t.Hash != chainhash.Hash{}
+}
+
+// appendTip appends the encoding of tip to payload.
+func appendTip(payload []byte, tip ChainTip) []byte {
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(tip.Height))
+	return append(payload, tip.Hash[:]...)
+}
+
+// parseTip decodes a chain tip encoded by appendTip.
+func parseTip(payload []byte) (ChainTip, error) {
+	if len(payload) != versionTipSize {
+		return ChainTip{}, fmt.Errorf("invalid tip length: %d", len(payload))
+	}
+	tip := ChainTip{Height: int32(binary.LittleEndian.Uint32(payload[:4]))}
+	copy(tip.Hash[:], payload[4:])
+	return tip, nil
+}
+
+// SetChainTipFunc registers fn to report the best block processed, which is
+// recorded with each message validated and announced to peers, so that
+// peers whose Bitcoin node lags behind can be told apart. It must be called
+// before Start.
+func (m *Manager) SetChainTipFunc(fn func() ChainTip) {
+	m.chainTip = fn
+}
+
+// currentTip returns our chain tip, the zero tip if it is unknown.
+func (m *Manager) currentTip() ChainTip {
+	if m.chainTip == nil {
+		return ChainTip{}
+	}
+	return m.chainTip()
+}
+
+// tipLoop announces our chain tip to peers each time it changes and checks
+// again which peers lag behind it.
+func (m *Manager) tipLoop(ctx context.Context) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(tipCheckInterval)
+	defer ticker.Stop()
+
+	last := m.currentTip()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case <-ticker.C:
+		}
+
+		tip := m.currentTip()
+		if tip == last || !tip.known() {
+			continue
+		}
+		last = tip
+
+		payload := appendTip(nil, tip)
+		m.peersMu.RLock()
+		for _, peer := range m.peers {
+			peer.checkLag(tip)
+			if version, _ := peer.announced(); version < tipVersion {
+				continue
+			}
+			if err := peer.SendMessage(MessageTypeTip, payload); err != nil {
+				log.Debugf("Failed to send tip to peer %s: %v", peer.addr,
+					err)
+			}
+		}
+		m.peersMu.RUnlock()
+	}
+}
+
+// handleTipMessage records the chain tip a peer announced after its best
+// block changed.
+func (p *Peer) handleTipMessage(payload []byte) error {
+	tip, err := parseTip(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	log.Tracef("Peer %s is at height %d, block %s", p.addr, tip.Height,
+		tip.Hash)
+	p.setTip(tip)
+	return nil
+}
+
+// setTip records the chain tip of the peer and whether it lags behind ours.
+func (p *Peer) setTip(tip ChainTip) {
+	if !tip.known() {
+		return
+	}
+	p.tip.Store(&tip)
+	p.checkLag(p.manager.currentTip())
+}
+
+// checkLag updates whether the peer lags more than MaxTipLag blocks behind
+// ours, logging when that changes. Lagging peers are kept, since their
+// Bitcoin node may catch up any time.
+func (p *Peer) checkLag(ours ChainTip) {
+	tip := p.tip.Load()
+	lagging := tip != nil && ours.known() &&
+		ours.Height-tip.Height > int32(p.manager.config.MaxTipLag)
+	if p.lagging.Swap(lagging) == lagging {
+		return
+	}
+	if lagging {
+		log.Warnf("Peer %s is %d blocks behind our chain tip at height %d, "+
+			"it may relay spent messages and refuse new ones", p.addr,
+			ours.Height-tip.Height, ours.Height)
+	} else {
+		log.Infof("Peer %s caught up with our chain tip", p.addr)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+)
+
+// startTipNode is startTestNode for a node reporting the tip of client as
+// its chain tip.
+func startTipNode(t *testing.T, cfg Config, client *mock.Client) *testNode {
+	t.Helper()
+
+	db := database.NewMemoryDB()
+	m, err := NewManager(cfg, database.NewValidator(client, db), db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	m.SetChainTipFunc(func() ChainTip {
+		height := client.Height()
+		hash, err := client.GetBlockHash(context.Background(), height)
+		if err != nil {
+			return ChainTip{}
+		}
+		return ChainTip{Height: height, Hash: *hash}
+	})
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { m.Stop() })
+	return &testNode{
+		Manager: m,
+		client:  client,
+		db:      db,
+		addr:    m.listener.Addr().String(),
+	}
+}
+
+// mineBlocks adds n blocks to the chain of client.
+func mineBlocks(client *mock.Client, n int) {
+	for i := 0; i < n; i++ {
+		client.AddBlock()
+	}
+}
+
+// peerLagging reports whether node has a single peer, flagged as lagging.
+func peerLagging(node *testNode) bool {
+	peers := node.Stats().Peers
+	return len(peers) == 1 && peers[0].Lagging
+}
+
+// TestLaggingPeer checks that a peer whose Bitcoin node is more than
+// MaxTipLag blocks behind ours is flagged as lagging from the handshake,
+// without flagging us on its side, and that the flag is cleared once its
+// node catches up and it announces its new tip.
+func TestLaggingPeer(t *testing.T) {
+	ahead := mock.NewClient()
+	mineBlocks(ahead, 10)
+	behind := mock.NewClient()
+	mineBlocks(behind, 10-DefaultMaxTipLag-1)
+
+	node := startTipNode(t, testNodeConfig(), ahead)
+	lagging := startTipNode(t, testNodeConfig(node.addr), behind)
+	waitFor(t, "lagging peer flagged", func() bool {
+		return peerLagging(node)
+	})
+	if peers := node.Stats().Peers; peers[0].Tip == nil ||
+		peers[0].Tip.Height != behind.Height() {
+
+		t.Fatalf("peer tip %+v, want height %d", peers[0].Tip,
+			behind.Height())
+	}
+	waitFor(t, "peer connected", func() bool {
+		return len(lagging.Stats().Peers) == 1
+	})
+	if peerLagging(lagging) {
+		t.Fatal("peer ahead of us flagged as lagging")
+	}
+
+	// Within MaxTipLag blocks the peer is no longer lagging
+	mineBlocks(behind, 1)
+	waitFor(t, "lagging flag cleared", func() bool {
+		peers := node.Stats().Peers
+		return len(peers) == 1 && !peers[0].Lagging
+	})
+	if tip := node.Stats().Peers[0].Tip; tip == nil ||
+		tip.Height != behind.Height() {
+
+		t.Fatalf("peer tip %+v after catching up, want height %d", tip,
+			behind.Height())
+	}
+}
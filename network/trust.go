@@ -0,0 +1,307 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// trustedFileName is the name of the file in the data directory used to
+// persist the trusted peers.
+const trustedFileName = "trusted.json"
+
+// ErrNotTrusted is returned when distrusting a peer address or identity key
+// that isn't trusted.
+var ErrNotTrusted = errors.New("not trusted")
+
+// TrustedPeers lists the trusted peers, by address, either a host or a
+// host:port, and by hex encoded identity key.
+type TrustedPeers struct {
+	Addrs []string `json:"addrs"`
+	Keys  []string `json:"keys"`
+}
+
+// trustList holds the peers exempt from rate limits, upload caps and
+// misbehavior scoring, such as the other nodes of the same operator. Trust
+// never skips the validation of their messages. The list is optionally
+// persisted to a trusted.json file in the data directory and is safe for
+// concurrent use.
+type trustList struct {
+	path string
+
+	addrs map[string]struct{}
+	keys  map[[32]byte]struct{}
+	mu    sync.RWMutex
+}
+
+// newTrustList creates an empty trust list. If dataDir is empty it is only
+// kept in memory.
+func newTrustList(dataDir string) *trustList {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, trustedFileName)
+	}
+
+	return &trustList{
+		path:  path,
+		addrs: make(map[string]struct{}),
+		keys:  make(map[[32]byte]struct{}),
+	}
+}
+
+// parseTrustedAddr checks a trusted peer address, a host or a host:port.
+func parseTrustedAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" || strings.ContainsAny(addr, " /") {
+		return "", fmt.Errorf("invalid peer address %q", addr)
+	}
+	return addr, nil
+}
+
+// merge adds the entries of list.
+func (t *trustList) merge(list *TrustedPeers) error {
+	addrs := make([]string, 0, len(list.Addrs))
+	for _, value := range list.Addrs {
+		addr, err := parseTrustedAddr(value)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	keys, _, err := parseEntries(list.Keys, nil)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, addr := range addrs {
+		t.addrs[addr] = struct{}{}
+	}
+	for key := range keys {
+		t.keys[key] = struct{}{}
+	}
+	return nil
+}
+
+// load reads the trusted peers persisted by a previous run. A missing file is
+// not an error.
+func (t *trustList) load() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", t.path, err)
+	}
+
+	var list TrustedPeers
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", t.path, err)
+	}
+	if err := t.merge(&list); err != nil {
+		return fmt.Errorf("invalid entry in %s: %v", t.path, err)
+	}
+	return nil
+}
+
+// save persists the trusted peers to the data directory.
+func (t *trustList) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(t.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode trusted peers: %v", err)
+	}
+
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, t.path)
+}
+
+// setAddr trusts addr if trust is set, or distrusts it. It returns false if
+// nothing changed.
+func (t *trustList) setAddr(addr string, trust bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.addrs[addr]; ok == trust {
+		return false
+	}
+	if trust {
+		t.addrs[addr] = struct{}{}
+	} else {
+		delete(t.addrs, addr)
+	}
+	return true
+}
+
+// setKey trusts the identity key if trust is set, or distrusts it. It
+// returns false if nothing changed.
+func (t *trustList) setKey(key [32]byte, trust bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.keys[key]; ok == trust {
+		return false
+	}
+	if trust {
+		t.keys[key] = struct{}{}
+	} else {
+		delete(t.keys, key)
+	}
+	return true
+}
+
+// trusts reports whether a peer known by any of addrs, host:port addresses,
+// or holding the hex encoded identity key, empty if it has none, is trusted.
+// An address without a port trusts every port of the host.
+func (t *trustList) trusts(addrs []string, key string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.addrs) == 0 && len(t.keys) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr == "" {
+			continue
+		}
+		if _, ok := t.addrs[addr]; ok {
+			return true
+		}
+		if _, ok := t.addrs[peerHost(addr)]; ok {
+			return true
+		}
+	}
+	if decoded, err := hex.DecodeString(key); err == nil &&
+		len(decoded) == 32 {
+
+		_, ok := t.keys[[32]byte(decoded)]
+		return ok
+	}
+	return false
+}
+
+// list returns the trusted addresses and identity keys, sorted.
+func (t *trustList) list() *TrustedPeers {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	list := &TrustedPeers{Addrs: make([]string, 0, len(t.addrs))}
+	for addr := range t.addrs {
+		list.Addrs = append(list.Addrs, addr)
+	}
+	sort.Strings(list.Addrs)
+	list.Keys, _ = formatEntries(t.keys, nil)
+	return list
+}
+
+// trusts reports whether the peer is trusted, by its address, the address it
+// was dialed at or announced it listens on, or its identity key.
+func (m *Manager) trusts(peer *Peer) bool {
+	return m.trusted.trusts([]string{peer.addr, peer.dialAddr,
+		peer.listenAddress()}, peer.identity())
+}
+
+// trustsAddr reports whether the peer at the known address addr, which last
+// proved it holds the identity key, empty if none, is trusted.
+func (m *Manager) trustsAddr(addr, key string) bool {
+	return m.trusted.trusts([]string{addr}, key)
+}
+
+// updateTrust applies a change of the trusted peers to the connected peers.
+func (m *Manager) updateTrust() {
+	m.peersMu.RLock()
+	defer m.peersMu.RUnlock()
+
+	for _, peer := range m.peers {
+		trusted := m.trusts(peer)
+		if peer.trusted.Swap(trusted) != trusted {
+			log.Infof("Peer %s is now trusted: %v", peer.addr, trusted)
+		}
+	}
+}
+
+// TrustedPeers returns the trusted peer addresses and identity keys.
+func (m *Manager) TrustedPeers() *TrustedPeers {
+	return m.trusted.list()
+}
+
+// TrustAddr trusts the peers at addr, a host:port or a host for every port of
+// it, along with those connected already.
+func (m *Manager) TrustAddr(addr string) error {
+	addr, err := parseTrustedAddr(addr)
+	if err != nil {
+		return err
+	}
+	if !m.trusted.setAddr(addr, true) {
+		return nil
+	}
+
+	log.Infof("Trusted peer address %s", addr)
+	m.updateTrust()
+	if err := m.trusted.save(); err != nil {
+		log.Warnf("Failed to save trusted peers: %v", err)
+	}
+	return nil
+}
+
+// DistrustAddr stops trusting the peers at addr.
+func (m *Manager) DistrustAddr(addr string) error {
+	if !m.trusted.setAddr(strings.TrimSpace(addr), false) {
+		return fmt.Errorf("%w: address %s", ErrNotTrusted, addr)
+	}
+
+	log.Infof("Distrusted peer address %s", addr)
+	m.updateTrust()
+	return m.trusted.save()
+}
+
+// TrustKey trusts the peers proving they hold the identity key, along with
+// those connected already.
+func (m *Manager) TrustKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("invalid identity key length %d", len(key))
+	}
+	if !m.trusted.setKey([32]byte(key), true) {
+		return nil
+	}
+
+	log.Infof("Trusted peer identity %x", key)
+	m.updateTrust()
+	if err := m.trusted.save(); err != nil {
+		log.Warnf("Failed to save trusted peers: %v", err)
+	}
+	return nil
+}
+
+// DistrustKey stops trusting the peers holding the identity key.
+func (m *Manager) DistrustKey(key []byte) error {
+	if len(key) != 32 || !m.trusted.setKey([32]byte(key), false) {
+		return fmt.Errorf("%w: identity %x", ErrNotTrusted, key)
+	}
+
+	log.Infof("Distrusted peer identity %x", key)
+	m.updateTrust()
+	return m.trusted.save()
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestTrustedFlood checks that a peer trusted at runtime flooding 1000 data
+// messages within a second stays connected with all of them validated and
+// stored, and isn't scored for invalid ones, while an untrusted peer doing
+// the same is throttled and disconnected.
+func TestTrustedFlood(t *testing.T) {
+	const flood = 1000
+
+	ctx := context.Background()
+	node := startTestNode(t, testNodeConfig())
+	trusted := dialTestNode(t, node)
+	untrusted := dialTestNode(t, node)
+	trustedAddr := trusted.conn.LocalAddr().String()
+	waitFor(t, "peers connected", func() bool {
+		return len(node.Stats().Peers) == 2
+	})
+
+	if err := node.TrustAddr(trustedAddr); err != nil {
+		t.Fatalf("TrustAddr: %v", err)
+	}
+	node.peersMu.RLock()
+	peer := node.peers[trustedAddr]
+	other := node.peers[untrusted.conn.LocalAddr().String()]
+	node.peersMu.RUnlock()
+	if peer == nil || !peer.stats().Trusted {
+		t.Fatal("connected peer not trusted")
+	}
+	if other == nil || other.stats().Trusted {
+		t.Fatal("other peer trusted")
+	}
+
+	msgs := make([]*message.Message, flood)
+	for i := range msgs {
+		msgs[i] = signTestMessage(t, node.client, inventoryOutpoint(i+1),
+			"backlog")
+	}
+	for _, msg := range msgs {
+		if !trusted.send(MessageTypeData, msg.Serialize()) {
+			t.Fatal("trusted peer disconnected while flooding")
+		}
+	}
+	for i := range msgs {
+		frame, ok := trusted.next(MessageTypeAck, MessageTypeReject)
+		if !ok {
+			t.Fatalf("trusted peer got %d of %d answers", i, flood)
+		}
+		if frame.msgType != MessageTypeAck {
+			_, code, reason, _ := parseRejectPayload(frame.payload)
+			t.Fatalf("trusted peer message rejected with %s: %s", code,
+				reason)
+		}
+	}
+	for _, msg := range msgs {
+		data, err := node.db.GetMessage(ctx, msg.Outpoint)
+		if err != nil || data == nil {
+			t.Fatalf("message %s not stored: %v",
+				msg.Outpoint.ToString(), err)
+		}
+	}
+
+	if peer.Throttled() != 0 {
+		t.Fatalf("trusted peer had %d messages throttled", peer.Throttled())
+	}
+
+	for i := uint32(0); i < flood; i++ {
+		if !untrusted.send(MessageTypeData, testDataPayload(i)) {
+			break
+		}
+	}
+	if !untrusted.disconnected() {
+		t.Fatal("untrusted flooding peer still connected")
+	}
+	if node.RateLimitStats().Disconnects != 1 {
+		t.Fatal("untrusted flooding peer not throttled")
+	}
+	if len(node.Stats().Peers) != 1 {
+		t.Fatal("trusted peer disconnected")
+	}
+
+	// Trust doesn't skip validation, though the invalid message isn't
+	// scored against the host before the peer is disconnected
+	score := func() int {
+		node.scoresMu.Lock()
+		defer node.scoresMu.Unlock()
+		return node.scores[peerHost(trustedAddr)]
+	}
+	before := score()
+	forged := signTestMessage(t, node.client, inventoryOutpoint(flood+1),
+		"forged")
+	forged.Signature[0] ^= 0xff
+	if _, code, _ := response(t, trusted, forged); code !=
+		RejectInvalidSignature {
+
+		t.Fatalf("forged message from the trusted peer got %s", code)
+	}
+	if !trusted.disconnected() {
+		t.Fatal("trusted peer still connected after an invalid message")
+	}
+	if after := score(); after != before {
+		t.Fatalf("trusted peer scored %d points", after-before)
+	}
+}
+
+// TestTrustList checks that a trusted host trusts every port of it, a
+// host:port only that port, an identity key wherever the peer connects from,
+// and that the list persisted in the data directory loads back.
+func TestTrustList(t *testing.T) {
+	dir := t.TempDir()
+	key := strings.Repeat("ab", 32)
+	list := newTrustList(dir)
+	err := list.merge(&TrustedPeers{
+		Addrs: []string{"10.0.0.1", "10.0.0.2:8335"},
+		Keys:  []string{key},
+	})
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if err := list.merge(&TrustedPeers{Addrs: []string{"a b"}}); err == nil {
+		t.Fatal("invalid address trusted")
+	}
+
+	tests := []struct {
+		addr string
+		key  string
+		want bool
+	}{
+		{"10.0.0.1:1234", "", true},
+		{"10.0.0.2:8335", "", true},
+		{"10.0.0.2:1234", "", false},
+		{"10.0.0.3:8335", key, true},
+		{"10.0.0.3:8335", strings.Repeat("cd", 32), false},
+	}
+	for _, test := range tests {
+		if got := list.trusts([]string{test.addr}, test.key); got !=
+			test.want {
+
+			t.Fatalf("%s with key %q trusted: %v", test.addr, test.key,
+				got)
+		}
+	}
+
+	if err := list.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	loaded := newTrustList(dir)
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got, want := loaded.list(), list.list()
+	if !slices.Equal(got.Addrs, want.Addrs) ||
+		!slices.Equal(got.Keys, want.Keys) {
+
+		t.Fatalf("loaded %+v, want %+v", got, want)
+	}
+}
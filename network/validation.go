@@ -0,0 +1,167 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// validationQueueSize is the number of data messages that may wait for a
+// validation worker before the peers delivering them block.
+const validationQueueSize = 256
+
+// validationJob is a data message from a peer waiting to be validated.
+type validationJob struct {
+	msg     *message.Message
+	msgData []byte
+	source  *Peer
+
+	// batched is set for a message delivered in a batch frame.
+	batched bool
+}
+
+// outpointLocks serializes the validation of messages for the same outpoint,
+// so a message and its replacement are never checked against the database
+// at the same time. Messages for different outpoints don't wait for each
+// other.
+type outpointLocks struct {
+	locks map[message.Outpoint]*outpointLock
+	mu    sync.Mutex
+}
+
+// outpointLock is the lock of an outpoint along with the number of
+// goroutines holding or waiting for it. It is dropped when none are left.
+type outpointLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// newOutpointLocks creates an empty set of outpoint locks.
+func newOutpointLocks() *outpointLocks {
+	return &outpointLocks{
+		locks: make(map[message.Outpoint]*outpointLock),
+	}
+}
+
+// lock blocks until the lock of outpoint is held.
+func (l *outpointLocks) lock(outpoint message.Outpoint) {
+	l.mu.Lock()
+	entry, ok := l.locks[outpoint]
+	if !ok {
+		entry = &outpointLock{}
+		l.locks[outpoint] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+}
+
+// unlock releases the lock of outpoint.
+func (l *outpointLocks) unlock(outpoint message.Outpoint) {
+	l.mu.Lock()
+	entry := l.locks[outpoint]
+	entry.refs--
+	if entry.refs == 0 {
+		delete(l.locks, outpoint)
+	}
+	l.mu.Unlock()
+
+	entry.mu.Unlock()
+}
+
+// queueValidation hands a data message from peer to the validation workers.
+// It blocks while the peer has MaxPeerValidations messages in flight or the
+// queue is full, which stops reading from the peer until there is room. The
+// message is dropped if the peer or the manager shuts down meanwhile. batched
+// is set for a message delivered in a batch frame.
+func (m *Manager) queueValidation(peer *Peer, msg *message.Message,
+	msgData []byte, batched bool) {
+
+	select {
+	case peer.validations <- struct{}{}:
+	case <-peer.ctx.Done():
+		return
+	case <-m.quit:
+		return
+	}
+
+	job := &validationJob{
+		msg:     msg,
+		msgData: msgData,
+		source:  peer,
+		batched: batched,
+	}
+	key := inventoryKey{msg.Outpoint, msg.Sequence}
+	peer.setPending(key, true)
+	select {
+	case m.validations <- job:
+		return
+	case <-peer.ctx.Done():
+	case <-m.quit:
+	}
+	peer.setPending(key, false)
+	<-peer.validations
+	log.Debugf("Dropping message %s from peer %s, shutting down",
+		msg.Outpoint.ToString(), peer.addr)
+}
+
+// validationWorker validates queued data messages until the manager stops.
+func (m *Manager) validationWorker(ctx context.Context) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.quit:
+			return
+		case job := <-m.validations:
+			m.validate(ctx, job)
+		}
+	}
+}
+
+// validate accepts a queued data message and answers the peer that sent it
+// with an ack or a reject. A peer whose message turns out to be a protocol
+// violation is scored and disconnected, unless the message came in a batch.
+func (m *Manager) validate(ctx context.Context, job *validationJob) {
+	peer := job.source
+	defer func() {
+		peer.setPending(inventoryKey{job.msg.Outpoint, job.msg.Sequence},
+			false)
+		<-peer.validations
+	}()
+
+	_, err := m.acceptMessage(ctx, job.msg, job.msgData, peer)
+
+	// A message that couldn't be checked because the Bitcoin node is
+	// unreachable is answered once it is back
+	if errors.Is(err, message.ErrRPCUnavailable) &&
+		m.holdMessage(job.msg, job.msgData, peer) {
+
+		return
+	}
+
+	if peer.disconnecting() {
+		return
+	}
+	if job.batched {
+		peer.answerBatchEntry(job.msg.Outpoint, err)
+		return
+	}
+	if err := peer.answerData(job.msg.Outpoint, err); err != nil {
+		log.Warnf("Error handling message type %d from peer %s: %v. "+
+			"Disconnecting.", MessageTypeData, peer.addr, err)
+		if kind, ok := misbehaviorKind(err); ok {
+			m.addMisbehavior(peer, kind)
+		}
+		peer.Disconnect()
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// validationNodeConfig returns the configuration of a test node validating
+// with workers and letting peers send data messages as fast as they can.
+func validationNodeConfig(workers int) Config {
+	cfg := testNodeConfig()
+	cfg.ValidationWorkers = workers
+	cfg.DataRateLimit = 1e6
+	cfg.DataRateBurst = 1e6
+	return cfg
+}
+
+// relayWindow is the number of messages relayMessages sends ahead of their
+// answers, which keeps the acks and relayed invs queued for a peer below
+// outboundQueueSize.
+const relayWindow = 32
+
+// relayMessages signs count messages for outpoints numbered from first,
+// sends them to node from remote and waits for their answers. It returns
+// the number of messages acked.
+func relayMessages(t testing.TB, node *testNode, remote *testRemote,
+	first, count int) int {
+
+	msgs := make([][]byte, count)
+	for i := range msgs {
+		var txid [32]byte
+		binary.LittleEndian.PutUint32(txid[:], uint32(first+i))
+		outpoint := message.NewOutpoint(txid, 0)
+		msgs[i] = signTestMessage(t, node.client, outpoint,
+			fmt.Sprintf("message %d", first+i)).Serialize()
+	}
+
+	window := make(chan struct{}, relayWindow)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for _, msgData := range msgs {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			if !remote.send(MessageTypeData, msgData) {
+				return
+			}
+		}
+	}()
+
+	acked := 0
+	for i := 0; i < count; i++ {
+		frame, ok := remote.next(MessageTypeAck, MessageTypeReject)
+		if !ok {
+			break
+		}
+		<-window
+		if frame.msgType == MessageTypeAck {
+			acked++
+		}
+	}
+	return acked
+}
+
+// TestValidationConcurrent checks that 4 peers each sending 200 messages at
+// once get every one of them validated, stored and acked.
+func TestValidationConcurrent(t *testing.T) {
+	const (
+		peers   = 4
+		perPeer = 200
+	)
+
+	node := startTestNode(t, validationNodeConfig(4))
+	remotes := make([]*testRemote, peers)
+	for i := range remotes {
+		remotes[i] = dialTestNode(t, node)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		acked [peers]int
+	)
+	for i, remote := range remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acked[i] = relayMessages(t, node, remote, i*perPeer, perPeer)
+		}()
+	}
+	wg.Wait()
+
+	for i, n := range acked {
+		if n != perPeer {
+			t.Errorf("peer %d got %d of %d messages acked", i, n, perPeer)
+		}
+	}
+	stats := node.Stats()
+	if stats.MessagesStored != peers*perPeer || stats.MessagesRejected != 0 ||
+		len(stats.Peers) != peers || stats.ValidationQueue != 0 {
+
+		t.Fatalf("%d stored, %d rejected, %d peers, %d queued",
+			stats.MessagesStored, stats.MessagesRejected, len(stats.Peers),
+			stats.ValidationQueue)
+	}
+}
+
+// TestOutpointLocks checks that the lock of an outpoint is held by one
+// goroutine at a time, that other outpoints don't wait for it and that
+// unused locks are dropped.
+func TestOutpointLocks(t *testing.T) {
+	const goroutines = 8
+
+	locks := newOutpointLocks()
+	outpoint := message.NewOutpoint([32]byte{1}, 0)
+
+	var (
+		wg             sync.WaitGroup
+		holders, worst atomic.Int32
+	)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			locks.lock(outpoint)
+			n := holders.Add(1)
+			if n > worst.Load() {
+				worst.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+			holders.Add(-1)
+			locks.unlock(outpoint)
+		}()
+	}
+
+	// Another outpoint is locked while the first is contended
+	other := message.NewOutpoint([32]byte{2}, 0)
+	done := make(chan struct{})
+	go func() {
+		locks.lock(other)
+		locks.unlock(other)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("other outpoint waited for a contended one")
+	}
+
+	wg.Wait()
+	if n := worst.Load(); n != 1 {
+		t.Fatalf("%d goroutines held the lock at once", n)
+	}
+	if n := len(locks.locks); n != 0 {
+		t.Fatalf("%d locks left after use", n)
+	}
+}
+
+// BenchmarkValidation measures how many data messages from one peer a node
+// validates and stores per second with a worker per CPU.
+func BenchmarkValidation(b *testing.B) {
+	node := startTestNode(b, validationNodeConfig(0))
+	remote := dialTestNode(b, node)
+
+	b.ResetTimer()
+	if acked := relayMessages(b, node, remote, 0, b.N); acked != b.N {
+		b.Fatalf("%d of %d messages acked", acked, b.N)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the version of the peer protocol advertised in the
+// version handshake. Version 2 added the chain to the version message,
+// version 3 the user agent, version 4 the listening port and nonce, version
+// 5 the largest payload accepted, version 6 the chain tip and version 7 the
+// identity challenge and key.
+const ProtocolVersion uint32 = 7
+
+// identityVersion is the first protocol version whose peers read an identity
+// message after the version message.
+const identityVersion uint32 = 7
+
+// versionPayloadSize is the size of a version 1 payload: a 4-byte
+// little-endian protocol version followed by 8 bytes of service flags. Later
+// versions append a 1-byte length prefixed chain name and user agent, then a
+// 2-byte little-endian listening port, an 8-byte nonce, the 4-byte
+// little-endian largest payload accepted, the chain tip, and the identity
+// challenge followed by a 1-byte length prefixed identity key. Longer payloads
+// are accepted so later versions can extend it.
+const versionPayloadSize = 12
+
+// versionListenSize is the size of the listening port and nonce.
+const versionListenSize = 10
+
+// versionLimitsSize is the size of the largest payload accepted.
+const versionLimitsSize = 4
+
+// maxUserAgentSize is the maximum size of the user agent announced in the
+// version message.
+const maxUserAgentSize = 255
+
+// ErrChainMismatch is returned by the handshake when the peer serves a
+// different Bitcoin chain.
+var ErrChainMismatch = errors.New("peer is on a different chain")
+
+// errSelfConnection is returned by the handshake when the peer answers with
+// our own nonce, so we dialed ourselves.
+var errSelfConnection = errors.New("connected to ourselves")
+
+// ServiceFlag identifies an optional protocol feature supported by a peer.
+type ServiceFlag uint64
+
+const (
+	// SFChecksum means the peer can add a payload checksum to every frame
+	// header.
+	SFChecksum ServiceFlag = 1 << iota
+
+	// SFCompactInv means the peer accepts an inventory filter ahead of a
+	// getinv and only announces the messages it doesn't match.
+	SFCompactInv
+
+	// SFBatchData means the peer sends getdata for several outpoints at
+	// once and answers them with batch frames.
+	SFBatchData
+
+	// SFRelayFilter means the peer accepts a setfilter and then only
+	// relays the messages of the senders and channels it lists.
+	SFRelayFilter
+
+	// SFAddr means the peer answers a getaddr with the addresses of peers
+	// it verified accept connections.
+	SFAddr
+)
+
+// localServices are the service flags advertised to peers.
+const localServices = SFChecksum | SFCompactInv | SFBatchData | SFRelayFilter |
+	SFAddr
+
+// versionMsg is the content of a version message.
+type versionMsg struct {
+	version  uint32
+	services ServiceFlag
+
+	// chain is the Bitcoin chain the peer serves, empty if the peer did
+	// not say.
+	chain string
+
+	// userAgent names the software of the peer, empty if the peer did not
+	// say.
+	userAgent string
+
+	// listenPort is the port the peer accepts connections on at its
+	// address, zero if it doesn't or did not say. nonce is random for each
+	// run of the peer, zero if it did not say.
+	listenPort uint16
+	nonce      uint64
+
+	// maxPayload is the largest payload in bytes the peer accepts in a
+	// data message, zero if it did not say.
+	maxPayload uint32
+
+	// tip is the best block of the peer, the zero tip if it did not say
+	// or doesn't know.
+	tip ChainTip
+
+	// challenge is random for each connection, nil if the peer did not
+	// say. identity is the identity key of the peer, which it proves it
+	// holds with an identity message, nil if it has none.
+	challenge []byte
+	identity  []byte
+}
+
+// newVersionPayload encodes a version message payload.
+func newVersionPayload(msg versionMsg) []byte {
+	payload := make([]byte, versionPayloadSize,
+		versionPayloadSize+2+len(msg.chain)+len(msg.userAgent)+
+			versionListenSize+versionLimitsSize+versionTipSize+
+			challengeSize+1+len(msg.identity))
+	binary.LittleEndian.PutUint32(payload[:4], msg.version)
+	binary.LittleEndian.PutUint64(payload[4:12], uint64(msg.services))
+	payload = append(payload, byte(len(msg.chain)))
+	payload = append(payload, msg.chain...)
+	payload = append(payload, byte(len(msg.userAgent)))
+	payload = append(payload, msg.userAgent...)
+	payload = binary.LittleEndian.AppendUint16(payload, msg.listenPort)
+	payload = binary.LittleEndian.AppendUint64(payload, msg.nonce)
+	payload = binary.LittleEndian.AppendUint32(payload, msg.maxPayload)
+	payload = appendTip(payload, msg.tip)
+	payload = append(payload, msg.challenge...)
+	payload = append(payload, byte(len(msg.identity)))
+	return append(payload, msg.identity...)
+}
+
+// parseVersionPayload decodes a version message payload.
+func parseVersionPayload(payload []byte) (*versionMsg, error) {
+	if len(payload) < versionPayloadSize {
+		return nil, fmt.Errorf("invalid version length: %d", len(payload))
+	}
+	msg := &versionMsg{
+		version:  binary.LittleEndian.Uint32(payload[:4]),
+		services: ServiceFlag(binary.LittleEndian.Uint64(payload[4:12])),
+	}
+	if len(payload) == versionPayloadSize {
+		return msg, nil
+	}
+
+	chainLen := int(payload[versionPayloadSize])
+	if len(payload) < versionPayloadSize+1+chainLen {
+		return nil, fmt.Errorf("invalid version chain length: %d", chainLen)
+	}
+	start := versionPayloadSize + 1
+	msg.chain = string(payload[start : start+chainLen])
+	rest := payload[start+chainLen:]
+	if len(rest) == 0 {
+		return msg, nil
+	}
+
+	agentLen := int(rest[0])
+	if len(rest) < 1+agentLen {
+		return nil, fmt.Errorf("invalid version user agent length: %d",
+			agentLen)
+	}
+	msg.userAgent = sanitizeUserAgent(string(rest[1 : 1+agentLen]))
+	rest = rest[1+agentLen:]
+	if len(rest) == 0 {
+		return msg, nil
+	}
+
+	if len(rest) < versionListenSize {
+		return nil, fmt.Errorf("invalid version listening port length: %d",
+			len(rest))
+	}
+	msg.listenPort = binary.LittleEndian.Uint16(rest[:2])
+	msg.nonce = binary.LittleEndian.Uint64(rest[2:versionListenSize])
+	rest = rest[versionListenSize:]
+	if len(rest) == 0 {
+		return msg, nil
+	}
+
+	if len(rest) < versionLimitsSize {
+		return nil, fmt.Errorf("invalid version payload limit length: %d",
+			len(rest))
+	}
+	msg.maxPayload = binary.LittleEndian.Uint32(rest[:versionLimitsSize])
+	rest = rest[versionLimitsSize:]
+	if len(rest) == 0 {
+		return msg, nil
+	}
+
+	if len(rest) < versionTipSize {
+		return nil, fmt.Errorf("invalid version tip length: %d", len(rest))
+	}
+	tip, err := parseTip(rest[:versionTipSize])
+	if err != nil {
+		return nil, err
+	}
+	msg.tip = tip
+	rest = rest[versionTipSize:]
+	if len(rest) == 0 {
+		return msg, nil
+	}
+
+	if len(rest) < challengeSize+1 {
+		return nil, fmt.Errorf("invalid version challenge length: %d",
+			len(rest))
+	}
+	msg.challenge = rest[:challengeSize]
+	keyLen := int(rest[challengeSize])
+	rest = rest[challengeSize+1:]
+	if keyLen != 0 && (keyLen != peerKeySize || len(rest) < keyLen) {
+		return nil, fmt.Errorf("invalid version identity length: %d",
+			keyLen)
+	}
+	if keyLen != 0 {
+		msg.identity = rest[:keyLen]
+	}
+	return msg, nil
+}
+
+// sanitizeUserAgent drops the characters of a user agent that aren't
+// printable ASCII, so it can be logged and displayed safely.
+func sanitizeUserAgent(userAgent string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, userAgent)
+}
+
+// handshake exchanges version messages with the peer and enables the
+// features both sides support. The dialing side sends its version first and
+// the listening side answers with its own. A listening side that receives
+// any other frame first is talking to a node that predates the handshake, so
+// it leaves the frame unread and keeps using legacy frames.
+func (p *Peer) handshake(reader *bufio.Reader) error {
+	timeout := time.Duration(p.manager.config.HandshakeTimeout) * time.Second
+	p.conn.SetDeadline(time.Now().Add(timeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	select {
+	case <-p.disconnect:
+		return fmt.Errorf("peer disconnected")
+	default:
+	}
+
+	if !p.outbound {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return err
+		}
+		if MessageType(first[0]) != MessageTypeVersion {
+			log.Debugf("Peer %s sent no version, using legacy frames", p.addr)
+			return p.authorize(nil)
+		}
+	} else if err := p.sendVersion(); err != nil {
+		return err
+	}
+
+	msgType, payload, err := readFrame(reader, p.manager.config.MaxFrameSize,
+		false)
+	if err != nil {
+		return err
+	}
+	p.bytesReceived.Add(uint64(headerSize(false) + len(payload)))
+	p.lastRecv.Store(time.Now().UnixNano())
+	if msgType != MessageTypeVersion {
+		return misbehaving(MisbehaviorMalformed,
+			fmt.Errorf("expected version, got message type %d", msgType))
+	}
+
+	remote, err := parseVersionPayload(payload)
+	if err != nil {
+		return misbehaving(MisbehaviorMalformed, err)
+	}
+
+	// Answer before checking the chain so the dialer learns why it is
+	// disconnected
+	if !p.outbound {
+		if err := p.sendVersion(); err != nil {
+			return err
+		}
+	}
+
+	chain := p.manager.config.Chain
+	if remote.chain != "" && chain != "" && remote.chain != chain {
+		return fmt.Errorf("%w: %s, we are on %s", ErrChainMismatch,
+			remote.chain, chain)
+	}
+	if remote.nonce != 0 && remote.nonce == p.manager.nonce {
+		return errSelfConnection
+	}
+
+	// Prove our identity to peers that read it and check theirs, which
+	// covers our challenge so it can't be replayed from another connection
+	if p.manager.identity != nil && remote.version >= identityVersion {
+		if err := p.sendIdentity(remote); err != nil {
+			return err
+		}
+	}
+	if remote.identity != nil {
+		if err := p.readIdentity(reader, remote); err != nil {
+			return err
+		}
+	}
+
+	p.mutex.Lock()
+	p.version = remote.version
+	p.services = remote.services
+	p.userAgent = remote.userAgent
+	if remote.listenPort != 0 && !p.outbound {
+		p.listenAddr = net.JoinHostPort(peerHost(p.addr),
+			strconv.Itoa(int(remote.listenPort)))
+	}
+	p.mutex.Unlock()
+	p.maxPayload.Store(remote.maxPayload)
+	p.setTip(remote.tip)
+	p.checksum = remote.services&localServices&SFChecksum != 0
+	p.compactInv = remote.services&localServices&SFCompactInv != 0
+	p.batchData = remote.services&localServices&SFBatchData != 0
+	log.Debugf("Peer %s runs %q on protocol version %d on chain %q, "+
+		"services %#x, listening on port %d, max payload %d, tip height "+
+		"%d, checksums %v, compact inventory %v, batches %v, identity %x",
+		p.addr, remote.userAgent, remote.version, remote.chain,
+		uint64(remote.services), remote.listenPort, remote.maxPayload,
+		remote.tip.Height, p.checksum, p.compactInv, p.batchData,
+		remote.identity)
+	return p.authorize(remote)
+}
+
+// sendVersion writes our version message directly to the connection. It is
+// only used during the handshake, before the writer goroutine starts.
+func (p *Peer) sendVersion() error {
+	frame := outboundFrame{
+		msgType: MessageTypeVersion,
+		payload: newVersionPayload(versionMsg{
+			version:    ProtocolVersion,
+			services:   localServices,
+			chain:      p.manager.config.Chain,
+			userAgent:  p.manager.config.UserAgent,
+			listenPort: p.manager.advertisedPort(p.probe),
+			nonce:      p.manager.nonce,
+			maxPayload: uint32(p.manager.validator.Limits().PayloadCap()),
+			tip:        p.manager.currentTip(),
+			challenge:  p.challenge[:],
+			identity:   p.manager.identityKey(),
+		}),
+	}
+	if err := writeFrame(p.conn, frame.msgType, frame.payload, false); err != nil {
+		return err
+	}
+	p.recordSent(frame)
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// chainNodeConfig returns the configuration of a test node on chain.
+func chainNodeConfig(chain string) Config {
+	cfg := testNodeConfig()
+	cfg.Chain = chain
+	return cfg
+}
+
+// TestHandshakeChainMismatch checks that two nodes on different chains drop
+// the connection in the handshake while two on the same chain stay
+// connected, and that a peer on another chain is told ours before it is
+// disconnected.
+func TestHandshakeChainMismatch(t *testing.T) {
+	a := startTestNode(t, chainNodeConfig("main"))
+	regtest := startTestNode(t, chainNodeConfig("regtest"))
+	if err := regtest.connectToPeer(a.addr); err != nil {
+		t.Fatalf("connectToPeer: %v", err)
+	}
+	waitFor(t, "connection across chains dropped", func() bool {
+		return len(regtest.Stats().Peers) == 0 &&
+			len(a.Stats().Peers) == 0
+	})
+	if regtest.addrManager.IsVerified(a.addr) {
+		t.Fatal("peer on another chain recorded as verified")
+	}
+
+	mainnet := startTestNode(t, chainNodeConfig("main"))
+	if err := mainnet.connectToPeer(a.addr); err != nil {
+		t.Fatalf("connectToPeer: %v", err)
+	}
+	waitFor(t, "same chain handshake", func() bool {
+		return mainnet.addrManager.IsVerified(a.addr)
+	})
+	time.Sleep(100 * time.Millisecond)
+	if !mainnet.isConnected(a.addr) {
+		t.Fatal("peer on the same chain disconnected")
+	}
+
+	// A peer dialing in from regtest reads our version, then the node
+	// hangs up
+	conn, err := net.Dial("tcp", a.addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	version := newVersionPayload(versionMsg{
+		version:   ProtocolVersion,
+		chain:     "regtest",
+		challenge: make([]byte, challengeSize),
+	})
+	if err := writeFrame(conn, MessageTypeVersion, version, false); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	msgType, payload := readTestFrame(t, conn)
+	if msgType != MessageTypeVersion {
+		t.Fatalf("got message type %d, want version", msgType)
+	}
+	remote, err := parseVersionPayload(payload)
+	if err != nil || remote.chain != "main" {
+		t.Fatalf("node announced chain %q, %v", remote.chain, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = readFrame(conn, DefaultMaxFrameSize, false)
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("node kept the connection of a peer on another chain: %v",
+			err)
+	}
+}
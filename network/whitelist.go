@@ -0,0 +1,206 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// whitelistFileName is the name of the file in the data directory used to
+// persist the whitelist set through the API.
+const whitelistFileName = "whitelist.json"
+
+var (
+	// ErrNotWhitelisted is returned in whitelist mode for a message whose
+	// outpoint and sender are both missing from the whitelist.
+	ErrNotWhitelisted = errors.New("message not whitelisted")
+
+	// ErrWhitelistDisabled is returned when changing the whitelist of a
+	// node that doesn't run in whitelist mode.
+	ErrWhitelistDisabled = errors.New("whitelist mode disabled")
+)
+
+// Whitelist lists the senders, as hex encoded x-only taproot output keys, and
+// the outpoints whose messages are accepted in whitelist mode.
+type Whitelist struct {
+	PubKeys   []string `json:"pubkeys"`
+	Outpoints []string `json:"outpoints"`
+}
+
+// whitelist holds the only senders and outpoints whose messages a node in
+// whitelist mode accepts, for private deployments where a closed group
+// registered its UTXOs. The list can be replaced at runtime, in which case it
+// is persisted to a whitelist.json file in the data directory that takes the
+// place of the configured list on the next start. It is safe for concurrent
+// use.
+type whitelist struct {
+	path    string
+	enabled bool
+
+	pubKeys   map[[32]byte]struct{}
+	outpoints map[message.Outpoint]struct{}
+	mu        sync.RWMutex
+}
+
+// newWhitelist creates an empty whitelist, which only restricts messages if
+// enabled is set. If dataDir is empty it is only kept in memory.
+func newWhitelist(dataDir string, enabled bool) *whitelist {
+	var path string
+	if dataDir != "" {
+		path = filepath.Join(dataDir, whitelistFileName)
+	}
+
+	return &whitelist{
+		path:      path,
+		enabled:   enabled,
+		pubKeys:   make(map[[32]byte]struct{}),
+		outpoints: make(map[message.Outpoint]struct{}),
+	}
+}
+
+// set replaces the entries with those of list.
+func (w *whitelist) set(list *Whitelist) error {
+	pubKeys, outpoints, err := parseEntries(list.PubKeys, list.Outpoints)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pubKeys = pubKeys
+	w.outpoints = outpoints
+	return nil
+}
+
+// load replaces the entries with the whitelist persisted by a previous run,
+// if any.
+func (w *whitelist) load() error {
+	if w.path == "" || !w.enabled {
+		return nil
+	}
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", w.path, err)
+	}
+
+	var list Whitelist
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", w.path, err)
+	}
+	if err := w.set(&list); err != nil {
+		return fmt.Errorf("invalid entry in %s: %v", w.path, err)
+	}
+
+	log.Infof("Loaded whitelist of %d senders and %d outpoints from %s",
+		len(list.PubKeys), len(list.Outpoints), w.path)
+	return nil
+}
+
+// save persists the whitelist to the data directory.
+func (w *whitelist) save() error {
+	if w.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(w.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode whitelist: %v", err)
+	}
+
+	tmpPath := w.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+	}
+	return os.Rename(tmpPath, w.path)
+}
+
+// mayAllow reports whether a message for outpoint can be whitelisted before
+// its UTXO is looked up. Only an outpoint missing from the list while no
+// senders are listed is known to be refused.
+func (w *whitelist) mayAllow(outpoint message.Outpoint) bool {
+	if !w.enabled {
+		return true
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if _, ok := w.outpoints[outpoint]; ok {
+		return true
+	}
+	return len(w.pubKeys) > 0
+}
+
+// allows reports whether a message for outpoint from the sender pubKey, nil
+// for outputs other than taproot, is whitelisted.
+func (w *whitelist) allows(outpoint message.Outpoint, pubKey []byte) bool {
+	if !w.enabled {
+		return true
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if _, ok := w.outpoints[outpoint]; ok {
+		return true
+	}
+	if len(pubKey) != 32 {
+		return false
+	}
+	_, ok := w.pubKeys[[32]byte(pubKey)]
+	return ok
+}
+
+// list returns the whitelisted senders and outpoints, sorted.
+func (w *whitelist) list() *Whitelist {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	list := &Whitelist{}
+	list.PubKeys, list.Outpoints = formatEntries(w.pubKeys, w.outpoints)
+	return list
+}
+
+// WhitelistEnabled reports whether the node only accepts whitelisted
+// messages.
+func (m *Manager) WhitelistEnabled() bool {
+	return m.whitelist.enabled
+}
+
+// Whitelist returns the whitelisted senders and outpoints.
+func (m *Manager) Whitelist() *Whitelist {
+	return m.whitelist.list()
+}
+
+// SetWhitelist replaces the whitelisted senders and outpoints, taking effect
+// for the next message. Messages already stored are kept.
+func (m *Manager) SetWhitelist(list *Whitelist) error {
+	if !m.whitelist.enabled {
+		return ErrWhitelistDisabled
+	}
+	if err := m.whitelist.set(list); err != nil {
+		return err
+	}
+
+	if err := m.whitelist.save(); err != nil {
+		log.Warnf("Failed to save whitelist: %v", err)
+	}
+
+	log.Infof("Whitelist replaced: %d senders, %d outpoints",
+		len(list.PubKeys), len(list.Outpoints))
+	return nil
+}
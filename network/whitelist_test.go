@@ -0,0 +1,114 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestWhitelist checks that a node with a two-entry whitelist accepts a
+// whitelisted message, and rejects another before looking up its UTXO or
+// even requesting it.
+func TestWhitelist(t *testing.T) {
+	allowed := message.NewOutpoint([32]byte{1}, 0)
+	cfg := testNodeConfig()
+	cfg.Whitelist = true
+	cfg.WhitelistedOutpoints = []string{allowed.ToString(),
+		message.NewOutpoint([32]byte{2}, 0).ToString()}
+	node := startTestNode(t, cfg)
+	remote := dialTestNode(t, node)
+
+	msg := signTestMessage(t, node.client, allowed, "member")
+	if outpoint, code, _ := response(t, remote, msg); code != 0 ||
+		outpoint != allowed {
+
+		t.Fatalf("whitelisted message got %s for %s", code,
+			outpoint.ToString())
+	}
+
+	lookups := node.client.Calls(mock.MethodGetTxOut)
+	other := message.NewOutpoint([32]byte{3}, 0)
+	msg = signTestMessage(t, node.client, other, "outsider")
+	if outpoint, code, _ := response(t, remote, msg); code !=
+		RejectNotWhitelisted || outpoint != other {
+
+		t.Fatalf("message not whitelisted got %s for %s, want %s", code,
+			outpoint.ToString(), RejectNotWhitelisted)
+	}
+	if n := node.client.Calls(mock.MethodGetTxOut) - lookups; n != 0 {
+		t.Fatalf("%d UTXO lookups for a message not whitelisted", n)
+	}
+
+	// Only the whitelisted outpoint of an inv is requested
+	next := message.NewOutpoint([32]byte{2}, 0)
+	remote.send(MessageTypeInv, newInvPayload(other, next))
+	frame, ok := remote.next(MessageTypeGetData)
+	if !ok || !bytes.Equal(frame.payload, next[:]) {
+		t.Fatalf("requested %x, want %s", frame.payload, next.ToString())
+	}
+}
+
+// TestSetWhitelist checks that the whitelist is replaced at runtime and
+// kept across restarts, and that it can't be set outside whitelist mode.
+func TestSetWhitelist(t *testing.T) {
+	first := message.NewOutpoint([32]byte{1}, 0)
+	second := message.NewOutpoint([32]byte{2}, 0)
+	cfg := testNodeConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Whitelist = true
+	cfg.WhitelistedOutpoints = []string{first.ToString()}
+	node := startTestNode(t, cfg)
+	remote := dialTestNode(t, node)
+
+	_, pkScript := testSender(t, 7)
+	err := node.SetWhitelist(&Whitelist{
+		PubKeys:   []string{hex.EncodeToString(pkScript[2:])},
+		Outpoints: []string{second.ToString()},
+	})
+	if err != nil {
+		t.Fatalf("SetWhitelist: %v", err)
+	}
+
+	// The sender is allowed any outpoint, the replaced outpoint is not
+	msg := signTestMessage(t, node.client, message.NewOutpoint([32]byte{3},
+		0), "sender")
+	if _, code, _ := response(t, remote, msg); code != 0 {
+		t.Fatalf("message of a whitelisted sender got %s", code)
+	}
+	msg = signSeedMessage(t, node.client, 8, first, "replaced")
+	if _, code, _ := response(t, remote, msg); code !=
+		RejectNotWhitelisted {
+
+		t.Fatalf("outpoint removed from the whitelist got %s", code)
+	}
+	if err := node.SetWhitelist(&Whitelist{
+		Outpoints: []string{"not an outpoint"},
+	}); err == nil {
+		t.Fatal("invalid whitelist set")
+	}
+
+	saved := newWhitelist(cfg.DataDir, true)
+	if err := saved.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !saved.allows(second, nil) || saved.allows(first, nil) {
+		t.Fatalf("whitelist saved as %+v", saved.list())
+	}
+
+	open, _, _ := newTestManager(t)
+	err = open.SetWhitelist(&Whitelist{})
+	if !errors.Is(err, ErrWhitelistDisabled) {
+		t.Fatalf("SetWhitelist outside whitelist mode gave %v", err)
+	}
+	if !open.whitelist.allows(first, nil) {
+		t.Fatal("message refused outside whitelist mode")
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	// defaultReadWidth is the line width used when standard output is not
+	// a terminal.
+	defaultReadWidth = 80
+
+	// minReadWidth is the narrowest a message body is wrapped to, however
+	// deep its reply is indented.
+	minReadWidth = 20
+
+	// maxReadDepth bounds the indentation of replies.
+	maxReadDepth = 6
+
+	// readIndent indents a reply below its parent.
+	readIndent = "  "
+)
+
+// readMessage holds the fields of an API message that read shows.
+type readMessage struct {
+	Outpoint    string     `json:"outpoint"`
+	ContentType string     `json:"content_type"`
+	Payload     string     `json:"payload"`
+	PayloadHex  string     `json:"payload_hex"`
+	Channel     string     `json:"channel"`
+	ReplyTo     string     `json:"reply_to"`
+	Body        string     `json:"body"`
+	ReceivedAt  *time.Time `json:"received_at"`
+	PubKey      string     `json:"pubkey"`
+}
+
+// readFilter selects the messages read shows.
+type readFilter struct {
+	sender string
+	since  time.Time
+}
+
+// matches reports whether msg passes the filter.
+func (f *readFilter) matches(msg *readMessage) bool {
+	if f.sender != "" && msg.PubKey != f.sender {
+		return false
+	}
+	if !f.since.IsZero() &&
+		(msg.ReceivedAt == nil || msg.ReceivedAt.Before(f.since)) {
+
+		return false
+	}
+	return true
+}
+
+// readCommand prints the messages stored by a node as text, replies indented
+// below the messages they answer. With -follow it keeps polling the node and
+// prints new messages as they arrive.
+func readCommand(args []string) error {
+	fs := flag.NewFlagSet("read", flag.ContinueOnError)
+	client := addClientFlags(fs)
+	channel := fs.String("channel", "", "Only show messages posted to this channel")
+	sender := fs.String("sender", "", "Only show messages of this sender, a hex encoded taproot output key")
+	since := fs.String("since", "", "Only show messages received after this time, RFC 3339 or a duration ago such as 2h")
+	follow := fs.Bool("follow", false, "Keep printing new messages as they arrive")
+	interval := fs.Duration("interval", 5*time.Second, "How often to poll for new messages with -follow")
+	width := fs.Int("width", 0, "Line width to wrap to (default the terminal width)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := &readFilter{sender: strings.ToLower(*sender)}
+	if filter.sender != "" {
+		pubKey, err := hex.DecodeString(filter.sender)
+		if err != nil || len(pubKey) != 32 {
+			return fmt.Errorf("invalid -sender %q: expected 32 hex "+
+				"encoded bytes", *sender)
+		}
+	}
+	if *since != "" {
+		var err error
+		filter.since, err = parseSince(*since, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("-interval must be positive")
+	}
+	if *width <= 0 {
+		*width = terminalWidth()
+	}
+
+	endpoint, err := client.apiURL(fs, "/v1/messages")
+	if err != nil {
+		return err
+	}
+	if *channel != "" {
+		endpoint += "?" + url.Values{"channel": {*channel}}.Encode()
+	}
+
+	var msgs []*readMessage
+	cursor, err := fetchMessages(client, endpoint, "", func(msg *readMessage) {
+		if filter.matches(msg) {
+			msgs = append(msgs, msg)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range threadOrder(msgs) {
+		formatMessage(os.Stdout, entry.msg, entry.depth, entry.orphan,
+			*width)
+	}
+	if !*follow {
+		if len(msgs) == 0 {
+			fmt.Println("No messages")
+		}
+		return nil
+	}
+
+	return followMessages(os.Stdout, client, endpoint, cursor, filter,
+		*width, *interval, interruptListener())
+}
+
+// followMessages polls endpoint for the messages stored after cursor every
+// interval and prints those matching filter, until quit is closed. Replies
+// are indented once, since the thread they belong to was printed earlier.
+// Failed polls are reported and retried.
+func followMessages(w io.Writer, client *clientFlags, endpoint, cursor string,
+	filter *readFilter, width int, interval time.Duration,
+	quit <-chan struct{}) error {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return nil
+		}
+
+		next, err := fetchMessages(client, endpoint, cursor, func(msg *readMessage) {
+			if !filter.matches(msg) {
+				return
+			}
+			depth := 0
+			if msg.ReplyTo != "" {
+				depth = 1
+			}
+			formatMessage(w, msg, depth, msg.ReplyTo != "", width)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to poll for messages: %v\n",
+				err)
+		}
+		cursor = next
+	}
+}
+
+// fetchMessages calls fn with every message listed by endpoint after cursor,
+// page by page, and returns the cursor after the last one. On error the
+// cursor after the last complete page is returned.
+func fetchMessages(client *clientFlags, endpoint, cursor string,
+	fn func(*readMessage)) (string, error) {
+
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	for {
+		pageURL := endpoint
+		if cursor != "" {
+			pageURL += sep + url.Values{"cursor": {cursor}}.Encode()
+		}
+		body, err := client.apiRequest(http.MethodGet, pageURL, nil)
+		if err != nil {
+			return cursor, err
+		}
+
+		var page struct {
+			Messages []*readMessage `json:"messages"`
+			Cursor   string         `json:"cursor"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return cursor, fmt.Errorf("invalid response: %v", err)
+		}
+		if len(page.Messages) == 0 {
+			return cursor, nil
+		}
+		for _, msg := range page.Messages {
+			fn(msg)
+		}
+		cursor = page.Cursor
+	}
+}
+
+// parseSince parses the -since flag, an RFC 3339 time or a duration before
+// now.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	ago, err := time.ParseDuration(value)
+	if err != nil || ago < 0 {
+		return time.Time{}, fmt.Errorf("invalid -since %q: expected an "+
+			"RFC 3339 time or a positive duration", value)
+	}
+	return now.Add(-ago), nil
+}
+
+// terminalWidth returns the width of the terminal on standard output, or
+// defaultReadWidth if it is not a terminal.
+func terminalWidth() int {
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		return defaultReadWidth
+	}
+	width, _, err := term.GetSize(fd)
+	if err != nil || width <= 0 {
+		return defaultReadWidth
+	}
+	return width
+}
+
+// threadEntry is a message in the order read prints it.
+type threadEntry struct {
+	msg   *readMessage
+	depth int
+
+	// orphan is set for replies whose parent isn't shown.
+	orphan bool
+}
+
+// threadOrder orders msgs for printing: messages that don't reply to a shown
+// message by time received, each followed by its replies, recursively.
+func threadOrder(msgs []*readMessage) []threadEntry {
+	sorted := make([]*readMessage, len(msgs))
+	copy(sorted, msgs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return receivedBefore(sorted[i], sorted[j])
+	})
+
+	shown := make(map[string]bool, len(sorted))
+	for _, msg := range sorted {
+		shown[msg.Outpoint] = true
+	}
+	replies := make(map[string][]*readMessage)
+	var roots []*readMessage
+	for _, msg := range sorted {
+		if msg.ReplyTo != "" && shown[msg.ReplyTo] {
+			replies[msg.ReplyTo] = append(replies[msg.ReplyTo], msg)
+			continue
+		}
+		roots = append(roots, msg)
+	}
+
+	entries := make([]threadEntry, 0, len(sorted))
+	visited := make(map[string]bool, len(sorted))
+	var walk func(msg *readMessage, depth int, orphan bool)
+	walk = func(msg *readMessage, depth int, orphan bool) {
+		if visited[msg.Outpoint] {
+			return
+		}
+		visited[msg.Outpoint] = true
+		entries = append(entries, threadEntry{msg, depth, orphan})
+		for _, reply := range replies[msg.Outpoint] {
+			walk(reply, depth+1, false)
+		}
+	}
+	for _, msg := range roots {
+		walk(msg, 0, msg.ReplyTo != "")
+	}
+
+	// Replacements can make replies form a cycle without a root
+	for _, msg := range sorted {
+		walk(msg, 0, true)
+	}
+	return entries
+}
+
+// receivedBefore orders messages by the time they were received, those
+// without one first.
+func receivedBefore(a, b *readMessage) bool {
+	switch {
+	case a.ReceivedAt == nil:
+		return b.ReceivedAt != nil
+	case b.ReceivedAt == nil:
+		return false
+	}
+	return a.ReceivedAt.Before(*b.ReceivedAt)
+}
+
+// formatMessage writes msg to w as a header line with the time it was
+// received, its sender, channel and outpoint followed by its wrapped text,
+// everything indented by depth. Orphaned replies name the message they
+// answer.
+func formatMessage(w io.Writer, msg *readMessage, depth int, orphan bool,
+	width int) {
+
+	indent := strings.Repeat(readIndent, min(depth, maxReadDepth))
+
+	received := "-"
+	if msg.ReceivedAt != nil {
+		received = msg.ReceivedAt.Local().Format("2006-01-02 15:04:05")
+	}
+	header := []string{received, abbreviateKey(msg.PubKey)}
+	if msg.Channel != "" {
+		header = append(header, "#"+escapeText(msg.Channel, false))
+	}
+	header = append(header, abbreviateOutpoint(msg.Outpoint))
+	if orphan {
+		header = append(header, "re "+abbreviateOutpoint(msg.ReplyTo))
+	}
+	fmt.Fprintf(w, "%s%s\n", indent, strings.Join(header, "  "))
+
+	bodyIndent := indent + readIndent
+	bodyWidth := max(width-len(bodyIndent), minReadWidth)
+	for _, line := range wrapText(messageText(msg), bodyWidth) {
+		fmt.Fprintf(w, "%s%s\n", bodyIndent, line)
+	}
+	fmt.Fprintln(w)
+}
+
+// messageText returns the text read shows for msg, escaped: the body of a
+// structured payload, a text or JSON payload, or a summary of other content.
+func messageText(msg *readMessage) string {
+	switch {
+	case msg.Body != "":
+		return escapeText(msg.Body, true)
+	case msg.Payload != "":
+		return escapeText(msg.Payload, true)
+	}
+	return fmt.Sprintf("<%s, %d bytes>", escapeText(msg.ContentType, false),
+		len(msg.PayloadHex)/2)
+}
+
+// abbreviateKey shortens a hex encoded pubkey to its first and last bytes.
+func abbreviateKey(pubKey string) string {
+	if pubKey == "" {
+		return "unknown"
+	}
+	if len(pubKey) <= 12 {
+		return escapeText(pubKey, false)
+	}
+	return escapeText(pubKey[:8]+".."+pubKey[len(pubKey)-4:], false)
+}
+
+// abbreviateOutpoint shortens the txid of a txid:vout outpoint.
+func abbreviateOutpoint(outpoint string) string {
+	txid, vout, ok := strings.Cut(outpoint, ":")
+	if !ok || len(txid) <= 8 {
+		return escapeText(outpoint, false)
+	}
+	return escapeText(txid[:8]+":"+vout, false)
+}
+
+// escapeText makes untrusted text safe to print to a terminal: control
+// characters, which could move the cursor or change colors, bidirectional
+// formatting characters, which could reorder what is shown, and invalid
+// UTF-8 are replaced by Go escapes. Tabs become spaces, and newlines are
+// kept if keepNewlines is set.
+func escapeText(s string, keepNewlines bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case r == '\n' && keepNewlines:
+			b.WriteByte('\n')
+		case r == '\t':
+			b.WriteString("    ")
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r < 0x100 && unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// wrapText splits text into lines of at most width runes, breaking at spaces
+// where possible and at the newlines of the text. Words longer than width are
+// split.
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var line []rune
+		for _, word := range strings.Fields(paragraph) {
+			runes := []rune(word)
+			for len(runes) > 0 {
+				space := 0
+				if len(line) > 0 {
+					space = 1
+				}
+				if len(line)+space+len(runes) <= width {
+					if space == 1 {
+						line = append(line, ' ')
+					}
+					line = append(line, runes...)
+					break
+				}
+				if len(line) > 0 {
+					lines = append(lines, string(line))
+					line = line[:0]
+					continue
+				}
+				lines = append(lines, string(runes[:width]))
+				runes = runes[width:]
+			}
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2025 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEscapeText checks that text from the network can't reach the terminal
+// as control sequences.
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		keepNewlines bool
+		want         string
+	}{
+		{"plain", "hello, world", false, "hello, world"},
+		{"unicode", "héllo 世界", false, "héllo 世界"},
+		{"escape sequence", "\x1b[31mred\x1b[0m", false, `\x1b[31mred\x1b[0m`},
+		{"carriage return", "safe\rfake", false, `safe\x0dfake`},
+		{"c1 control", "a\u009bb", false, `a\x9bb`},
+		{"bidi override", "abc\u202edcba", false, `abc\u202edcba`},
+		{"invalid utf8", "a\xffb", false, `a\xffb`},
+		{"backslash", `\x1b`, false, `\\x1b`},
+		{"tab", "a\tb", false, "a    b"},
+		{"newline kept", "a\nb", true, "a\nb"},
+		{"newline escaped", "a\nb", false, `a\x0ab`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := escapeText(test.text, test.keepNewlines)
+			if got != test.want {
+				t.Fatalf("escapeText(%q) = %q, want %q", test.text, got,
+					test.want)
+			}
+		})
+	}
+}
+
+// TestWrapText checks that text is wrapped at spaces and newlines, and that
+// words wider than a line are split.
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"hello world again", 11, []string{"hello world", "again"}},
+		{"hello  world", 20, []string{"hello world"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"a abcdefgh", 4, []string{"a", "abcd", "efgh"}},
+		{"first\n\nthird", 20, []string{"first", "", "third"}},
+		{"世界世界世界", 4, []string{"世界世界", "世界"}},
+		{"", 10, []string{""}},
+	}
+	for _, test := range tests {
+		got := wrapText(test.text, test.width)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrapText(%q, %d) = %q, want %q", test.text,
+				test.width, got, test.want)
+		}
+	}
+}
+
+// testReceived returns a receive time minutes after a fixed time.
+func testReceived(minutes int) *time.Time {
+	received := time.Date(2025, 3, 1, 12, minutes, 0, 0, time.Local)
+	return &received
+}
+
+// testOutpoint returns an outpoint of the fake API numbered n.
+func testOutpoint(n int) string {
+	return strings.Repeat(strconv.Itoa(n%10), 64) + ":" + strconv.Itoa(n)
+}
+
+// TestFormatMessage checks the header and the wrapped, escaped and indented
+// body of a message.
+func TestFormatMessage(t *testing.T) {
+	msg := &readMessage{
+		Outpoint:   testOutpoint(1),
+		Channel:    "dev\x1b]0",
+		ReplyTo:    testOutpoint(2),
+		Body:       "hello there \x1b[2Jeveryone",
+		ReceivedAt: testReceived(5),
+		PubKey:     strings.Repeat("ab", 32),
+	}
+
+	var buf bytes.Buffer
+	formatMessage(&buf, msg, 1, true, 26)
+	want := "  2025-03-01 12:05:00  abababab..abab  #dev\\x1b]0  " +
+		"11111111:1  re 22222222:2\n" +
+		"    hello there\n" +
+		"    \\x1b[2Jeveryone\n" +
+		"\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	formatMessage(&buf, &readMessage{
+		Outpoint:    testOutpoint(3),
+		ContentType: "binary",
+		PayloadHex:  "00010203",
+	}, maxReadDepth+3, false, 80)
+	indent := strings.Repeat(readIndent, maxReadDepth)
+	want = indent + "-  unknown  33333333:3\n" +
+		indent + readIndent + "<binary, 4 bytes>\n\n"
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// TestThreadOrder checks that replies follow the messages they answer and
+// that replies to messages not shown are marked orphaned.
+func TestThreadOrder(t *testing.T) {
+	root := &readMessage{Outpoint: "root", ReceivedAt: testReceived(1)}
+	reply := &readMessage{Outpoint: "reply", ReplyTo: "root",
+		ReceivedAt: testReceived(3)}
+	nested := &readMessage{Outpoint: "nested", ReplyTo: "reply",
+		ReceivedAt: testReceived(4)}
+	orphan := &readMessage{Outpoint: "orphan", ReplyTo: "gone",
+		ReceivedAt: testReceived(2)}
+	other := &readMessage{Outpoint: "other", ReceivedAt: testReceived(5)}
+
+	entries := threadOrder([]*readMessage{other, nested, reply, orphan,
+		root})
+	want := []threadEntry{
+		{root, 0, false},
+		{reply, 1, false},
+		{nested, 2, false},
+		{orphan, 0, true},
+		{other, 0, false},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		for _, entry := range entries {
+			t.Logf("%s depth %d orphan %v", entry.msg.Outpoint, entry.depth,
+				entry.orphan)
+		}
+		t.Fatal("unexpected order")
+	}
+}
+
+// fakeMessagesAPI serves /v1/messages from a list of messages that can grow,
+// with the index of the next message as the cursor. Its first failures
+// requests fail.
+type fakeMessagesAPI struct {
+	mu       sync.Mutex
+	msgs     []*readMessage
+	failures int
+	channels []string
+}
+
+// add appends a message to the list.
+func (f *fakeMessagesAPI) add(msg *readMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs = append(f.msgs, msg)
+}
+
+// ServeHTTP implements http.Handler.
+func (f *fakeMessagesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != "/v1/messages" ||
+		r.Header.Get("Authorization") != "Bearer token" {
+
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	f.channels = append(f.channels, r.URL.Query().Get("channel"))
+
+	start := 0
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		start, _ = strconv.Atoi(cursor)
+	}
+	end := min(start+2, len(f.msgs))
+	page := struct {
+		Messages []*readMessage `json:"messages"`
+		Cursor   string         `json:"cursor"`
+	}{Messages: f.msgs[start:end], Cursor: strconv.Itoa(end)}
+	if page.Messages == nil {
+		page.Messages = []*readMessage{}
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer.
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestFollowMessages checks that -follow prints each message stored after
+// the first listing once, filtered, across pages and failed polls.
+func TestFollowMessages(t *testing.T) {
+	api := &fakeMessagesAPI{}
+	for i := 0; i < 3; i++ {
+		api.add(&readMessage{Outpoint: testOutpoint(i), Body: "old",
+			ReceivedAt: testReceived(i)})
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := &clientFlags{apiAddr: server.URL, apiToken: "token"}
+	endpoint := server.URL + "/v1/messages?channel=dev"
+	var seen int
+	cursor, err := fetchMessages(client, endpoint, "",
+		func(*readMessage) { seen++ })
+	if err != nil || seen != 3 || cursor != "3" {
+		t.Fatalf("listed %d messages up to cursor %q, %v, want 3 up to "+
+			"\"3\"", seen, cursor, err)
+	}
+
+	sender := strings.Repeat("cd", 32)
+	filter := &readFilter{sender: sender}
+	var out syncBuffer
+	quit := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- followMessages(&out, client, endpoint, cursor, filter, 80,
+			5*time.Millisecond, quit)
+	}()
+
+	api.mu.Lock()
+	api.failures = 2
+	api.mu.Unlock()
+	api.add(&readMessage{Outpoint: testOutpoint(3), Body: "new message",
+		PubKey: sender, ReceivedAt: testReceived(10)})
+	api.add(&readMessage{Outpoint: testOutpoint(4), Body: "filtered",
+		PubKey: strings.Repeat("ef", 32), ReceivedAt: testReceived(11)})
+	api.add(&readMessage{Outpoint: testOutpoint(5), Body: "a reply",
+		PubKey: sender, ReplyTo: testOutpoint(3),
+		ReceivedAt: testReceived(12)})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "a reply") {
+		if time.Now().After(deadline) {
+			t.Fatalf("new messages not printed, got %q", out.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Let a few more polls run before stopping
+	time.Sleep(50 * time.Millisecond)
+	close(quit)
+	if err := <-done; err != nil {
+		t.Fatalf("followMessages: %v", err)
+	}
+
+	got := out.String()
+	if strings.Count(got, "new message") != 1 ||
+		strings.Count(got, "a reply") != 1 {
+
+		t.Fatalf("messages not printed exactly once:\n%s", got)
+	}
+	if strings.Contains(got, "old") || strings.Contains(got, "filtered") {
+		t.Fatalf("printed messages listed before or filtered out:\n%s", got)
+	}
+	if !strings.Contains(got, "\n  2025-03-01 12:12:00  cdcdcdcd..cdcd") ||
+		!strings.Contains(got, "re 33333333:3") {
+
+		t.Fatalf("reply not indented and marked:\n%s", got)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for _, channel := range api.channels {
+		if channel != "dev" {
+			t.Fatalf("polled channel %q, want dev", channel)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// ErrNotEnoughOutpoints is returned by SignChunks when a payload needs more
+// chunks than outpoints were given.
+var ErrNotEnoughOutpoints = errors.New("not enough outpoints for chunks")
+
+// SignChunks splits payload into chunks under a new random group ID, see
+// message.SplitChunks, and signs each as a structured payload of at most
+// limits.PayloadCap() bytes for the next of outpoints, all outputs of type
+// addrType controlled by privKey. Outpoints left over are not used. Readers
+// join the chunks with message.JoinChunks.
+func SignChunks(privKey *btcec.PrivateKey, addrType AddressType,
+	outpoints []message.Outpoint, contentType message.ContentType,
+	payload []byte, limits message.Limits) ([]*message.Message, error) {
+
+	whole := &message.Message{ContentType: contentType, Payload: payload}
+	if err := whole.ValidateContent(); err != nil {
+		return nil, err
+	}
+
+	var group message.ChunkGroup
+	if _, err := rand.Read(group[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate chunk group: %v", err)
+	}
+	chunks, err := message.SplitChunks(group, contentType, payload,
+		limits.PayloadCap())
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) > len(outpoints) {
+		return nil, fmt.Errorf("%w: %d byte payload needs %d chunks, %d "+
+			"outpoints given", ErrNotEnoughOutpoints, len(payload),
+			len(chunks), len(outpoints))
+	}
+
+	seen := make(map[message.Outpoint]struct{}, len(chunks))
+	for _, outpoint := range outpoints[:len(chunks)] {
+		if _, ok := seen[outpoint]; ok {
+			return nil, fmt.Errorf("outpoint %s given twice",
+				outpoint.ToString())
+		}
+		seen[outpoint] = struct{}{}
+	}
+
+	msgs := make([]*message.Message, 0, len(chunks))
+	for i, chunk := range chunks {
+		data, err := message.BuildPayload(&message.Payload{Chunk: chunk})
+		if err != nil {
+			return nil, err
+		}
+		msg, err := SignReplacementFor(privKey, addrType, outpoints[i], 0,
+			message.ContentTypeBinary, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign chunk %d: %w", i, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestSignChunks checks that a payload too large for one message is signed
+// as 3 valid chunk messages within the payload cap, which join back into it
+// whatever order they arrive in, and that too few outpoints are refused.
+func TestSignChunks(t *testing.T) {
+	limits := message.Limits{MaxPayloadSize: 200}
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := Script(key, AddressTaproot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := mock.NewClient()
+	var outpoints []message.Outpoint
+	for i := 0; i < 4; i++ {
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+		outpoints = append(outpoints, outpoint)
+	}
+	payload := bytes.Repeat([]byte("chunked "),
+		(2*message.ChunkCapacity(limits.PayloadCap())+10)/8)
+
+	_, err = SignChunks(key, AddressTaproot, outpoints[:2],
+		message.ContentTypeText, payload, limits)
+	if !errors.Is(err, ErrNotEnoughOutpoints) {
+		t.Fatalf("2 outpoints for 3 chunks gave %v", err)
+	}
+
+	msgs, err := SignChunks(key, AddressTaproot, outpoints,
+		message.ContentTypeText, payload, limits)
+	if err != nil {
+		t.Fatalf("SignChunks: %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("%d chunks, want 3", len(msgs))
+	}
+	chunks := make([]*message.Chunk, len(msgs))
+	for i, msg := range msgs {
+		if msg.Outpoint != outpoints[i] {
+			t.Fatalf("chunk %d anchored to %s", i, msg.Outpoint.ToString())
+		}
+		if err := limits.CheckPayload(len(msg.Payload)); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if err := validate(client, msg); err != nil {
+			t.Fatalf("chunk %d rejected: %v", i, err)
+		}
+		parsed, err := message.ParsePayload(msg.Payload)
+		if err != nil || parsed.Chunk == nil {
+			t.Fatalf("chunk %d payload: %+v, %v", i, parsed, err)
+		}
+		chunks[i] = parsed.Chunk
+	}
+
+	// Chunks arrive in any order, and are only joined once all did
+	received := []*message.Chunk{chunks[2], chunks[0]}
+	_, _, err = message.JoinChunks(received)
+	if !errors.Is(err, message.ErrIncompleteChunks) {
+		t.Fatalf("2 of 3 chunks gave %v", err)
+	}
+	if missing := message.MissingChunks(received); !slices.Equal(missing,
+		[]uint16{1}) {
+
+		t.Fatalf("missing chunks %v, want [1]", missing)
+	}
+	received = append(received, chunks[1])
+	contentType, joined, err := message.JoinChunks(received)
+	if err != nil {
+		t.Fatalf("JoinChunks: %v", err)
+	}
+	if contentType != message.ContentTypeText ||
+		!bytes.Equal(joined, payload) {
+
+		t.Fatalf("joined %d bytes of %s, want the %d bytes of text",
+			len(joined), contentType, len(payload))
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/shaibearary/utxo_chat/descriptor"
+	"golang.org/x/term"
+)
+
+// KeyEnv is the environment variable a private key is read from when it is
+// neither given directly nor in a file.
+const KeyEnv = "UTXOCHAT_DESCRIPTOR"
+
+var (
+	// ErrNoKey is returned when no source provides a private key.
+	ErrNoKey = errors.New("no private key given")
+
+	// ErrConflictingKeys is returned when more than one source provides a
+	// private key.
+	ErrConflictingKeys = errors.New("private key given more than once")
+
+	// ErrInsecureKeyFile is returned for a key file readable by every user.
+	ErrInsecureKeyFile = errors.New("key file is world-readable")
+)
+
+// Prompter asks the user for a secret.
+type Prompter interface {
+	// ReadSecret shows prompt and returns the line typed, which must not
+	// be echoed.
+	ReadSecret(prompt string) (string, error)
+}
+
+// TerminalPrompter prompts on the terminal attached to standard input, with
+// echo disabled.
+type TerminalPrompter struct{}
+
+// ReadSecret implements Prompter. It fails with ErrNoKey if standard input is
+// not a terminal.
+func (TerminalPrompter) ReadSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%w and standard input is not a terminal",
+			ErrNoKey)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read private key: %v", err)
+	}
+	return string(secret), nil
+}
+
+// KeySource lists where a private key, as a taproot descriptor or WIF, may be
+// read from. At most one of Key, File and the KeyEnv environment variable may
+// provide it; if none does, the user is prompted.
+type KeySource struct {
+	// Key is the private key itself. Keys given as command-line arguments
+	// show up in process listings and shell history, so the other sources
+	// should be preferred.
+	Key string
+
+	// File is the path of a file holding the private key. It must not be
+	// world-readable.
+	File string
+
+	// Getenv looks up environment variables, os.Getenv if nil.
+	Getenv func(string) string
+
+	// Prompter asks for the key when no other source provides it. With a
+	// nil Prompter ReadKey fails with ErrNoKey instead.
+	Prompter Prompter
+}
+
+// ReadKey returns the private key of the single source providing one, with
+// surrounding whitespace removed.
+func (s *KeySource) ReadKey() (string, error) {
+	getenv := s.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+
+	var given []string
+	if s.Key != "" {
+		given = append(given, "the command line")
+	}
+	if s.File != "" {
+		given = append(given, s.File)
+	}
+	env := getenv(KeyEnv)
+	if env != "" {
+		given = append(given, "$"+KeyEnv)
+	}
+	if len(given) > 1 {
+		return "", fmt.Errorf("%w: by %s", ErrConflictingKeys,
+			strings.Join(given, ", "))
+	}
+
+	var key string
+	switch {
+	case s.Key != "":
+		key = s.Key
+
+	case s.File != "":
+		var err error
+		key, err = readKeyFile(s.File)
+		if err != nil {
+			return "", err
+		}
+
+	case env != "":
+		key = env
+
+	case s.Prompter != nil:
+		var err error
+		key, err = s.Prompter.ReadSecret("Private key (descriptor or WIF): ")
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", ErrNoKey
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", ErrNoKey
+	}
+	return key, nil
+}
+
+// readKeyFile reads the private key stored at path, refusing files readable
+// by every user. Permissions are not checked on Windows, which doesn't report
+// them.
+func readKeyFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("%w: %s has mode %v, run chmod o-r on it",
+			ErrInsecureKeyFile, path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %v", err)
+	}
+	return string(data), nil
+}
+
+// IsDescriptor reports whether key is given as a descriptor rather than WIF.
+func IsDescriptor(key string) bool {
+	return strings.Contains(key, "(")
+}
+
+// ParsePrivateKey parses a private key given either as a taproot descriptor,
+// see ParseDescriptor, or as WIF. The format is detected from the key. index
+// is the child derived from a range descriptor and must be zero otherwise.
+func ParsePrivateKey(key string, index uint32) (*btcec.PrivateKey, error) {
+	key = strings.TrimSpace(key)
+	if IsDescriptor(key) {
+		return ParseDescriptor(key, index)
+	}
+	if index != 0 {
+		return nil, fmt.Errorf("%w: index %d given for a WIF key",
+			descriptor.ErrRangeIndex, index)
+	}
+
+	decoded, err := btcutil.DecodeWIF(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WIF: %v", err)
+	}
+	return decoded.PrivKey, nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/shaibearary/utxo_chat/descriptor"
+)
+
+// testPrompter is a Prompter answering with a fixed secret and counting the
+// prompts.
+type testPrompter struct {
+	secret  string
+	err     error
+	prompts int
+}
+
+// ReadSecret implements Prompter.
+func (p *testPrompter) ReadSecret(prompt string) (string, error) {
+	p.prompts++
+	return p.secret, p.err
+}
+
+// testEnv returns a Getenv function holding only KeyEnv, set to key unless
+// it is empty.
+func testEnv(key string) func(string) string {
+	return func(name string) string {
+		if name == KeyEnv {
+			return key
+		}
+		return ""
+	}
+}
+
+// writeKeyFile writes key to a file with the given permissions.
+func writeKeyFile(t *testing.T, key string, perm os.FileMode) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(key), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestKeySourcePrecedence checks that the key is read from the single
+// source providing it, that the prompt is only shown when no other source
+// does, and that several sources are refused.
+func TestKeySourcePrecedence(t *testing.T) {
+	file := writeKeyFile(t, " file-key\n", 0600)
+
+	tests := []struct {
+		name    string
+		source  KeySource
+		env     string
+		secret  string
+		want    string
+		wantErr error
+		prompts int
+	}{
+		{name: "flag", source: KeySource{Key: "flag-key"},
+			want: "flag-key"},
+		{name: "file", source: KeySource{File: file}, want: "file-key"},
+		{name: "env", env: "env-key\n", want: "env-key"},
+		{name: "prompt", secret: "prompt-key", want: "prompt-key",
+			prompts: 1},
+		{name: "empty prompt", secret: " \n", wantErr: ErrNoKey,
+			prompts: 1},
+		{name: "flag and file", source: KeySource{Key: "flag-key",
+			File: file}, wantErr: ErrConflictingKeys},
+		{name: "flag and env", source: KeySource{Key: "flag-key"},
+			env: "env-key", wantErr: ErrConflictingKeys},
+		{name: "file and env", source: KeySource{File: file},
+			env: "env-key", wantErr: ErrConflictingKeys},
+		{name: "all", source: KeySource{Key: "flag-key", File: file},
+			env: "env-key", wantErr: ErrConflictingKeys},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prompter := &testPrompter{secret: test.secret}
+			source := test.source
+			source.Getenv = testEnv(test.env)
+			source.Prompter = prompter
+
+			key, err := source.ReadKey()
+			if !errors.Is(err, test.wantErr) || key != test.want {
+				t.Fatalf("got %q, %v, want %q, %v", key, err, test.want,
+					test.wantErr)
+			}
+			if prompter.prompts != test.prompts {
+				t.Fatalf("prompted %d times, want %d", prompter.prompts,
+					test.prompts)
+			}
+		})
+	}
+
+	t.Run("no prompter", func(t *testing.T) {
+		source := KeySource{Getenv: testEnv("")}
+		if _, err := source.ReadKey(); !errors.Is(err, ErrNoKey) {
+			t.Fatalf("got %v, want ErrNoKey", err)
+		}
+	})
+
+	t.Run("prompt error", func(t *testing.T) {
+		failure := errors.New("no terminal")
+		source := KeySource{
+			Getenv:   testEnv(""),
+			Prompter: &testPrompter{err: failure},
+		}
+		if _, err := source.ReadKey(); !errors.Is(err, failure) {
+			t.Fatalf("got %v, want the prompter's error", err)
+		}
+	})
+}
+
+// TestKeySourceInsecureFile checks that a world-readable key file is
+// refused.
+func TestKeySourceInsecureFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not checked on Windows")
+	}
+
+	source := KeySource{
+		File:   writeKeyFile(t, "file-key", 0644),
+		Getenv: testEnv(""),
+	}
+	if _, err := source.ReadKey(); !errors.Is(err, ErrInsecureKeyFile) {
+		t.Fatalf("got %v, want ErrInsecureKeyFile", err)
+	}
+}
+
+// TestParsePrivateKeyFormats checks that WIF keys and descriptors are told
+// apart and both parse to the key they hold.
+func TestParsePrivateKeyFormats(t *testing.T) {
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{1}, 32),
+		&chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := master
+	for _, step := range []uint32{86 + hdkeychain.HardenedKeyStart,
+		hdkeychain.HardenedKeyStart, hdkeychain.HardenedKeyStart, 0, 7} {
+
+		if child, err = child.Derive(step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	descKey, err := child.ECPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wifKey, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{2}, 32))
+	wif, err := btcutil.NewWIF(wifKey, &chaincfg.MainNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desc := "tr(" + master.String() + "/86h/0h/0h/0/7)"
+	checksum, err := descriptor.Checksum(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeDesc := "tr(" + master.String() + "/86h/0h/0h/0/*)"
+
+	tests := []struct {
+		name       string
+		key        string
+		index      uint32
+		descriptor bool
+		want       *btcec.PrivateKey
+		wantErr    error
+	}{
+		{name: "wif", key: wif.String(), want: wifKey},
+		{name: "wif with whitespace", key: " " + wif.String() + "\n",
+			want: wifKey},
+		{name: "wif with index", key: wif.String(), index: 1,
+			wantErr: descriptor.ErrRangeIndex},
+		{name: "descriptor", key: desc, descriptor: true, want: descKey},
+		{name: "descriptor with checksum", key: desc + "#" + checksum,
+			descriptor: true, want: descKey},
+		{name: "range descriptor", key: rangeDesc, index: 7,
+			descriptor: true, want: descKey},
+		{name: "bad checksum", key: desc + "#qqqqqqqq", descriptor: true,
+			wantErr: descriptor.ErrBadChecksum},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if IsDescriptor(test.key) != test.descriptor {
+				t.Fatalf("IsDescriptor(%q) = %v", test.key,
+					!test.descriptor)
+			}
+
+			key, err := ParsePrivateKey(test.key, test.index)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePrivateKey: %v", err)
+			}
+			if !key.Key.Equals(&test.want.Key) {
+				t.Fatal("parsed another key")
+			}
+		})
+	}
+
+	if _, err := ParsePrivateKey("not a key", 0); err == nil {
+		t.Fatal("invalid WIF accepted")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// psbtOutpointKey is the key of the proprietary global PSBT field recording
+// the outpoint of the message a PSBT signs: the proprietary type 0xfc, the
+// length prefixed identifier "utxochat" and subtype 0.
+var psbtOutpointKey = []byte{0xfc, 8, 'u', 't', 'x', 'o', 'c', 'h', 'a', 't', 0}
+
+var (
+	// ErrPSBTMismatch is returned for a PSBT that doesn't sign the given
+	// message.
+	ErrPSBTMismatch = errors.New("PSBT does not sign this message")
+
+	// ErrPSBTNotSigned is returned for a PSBT whose input is neither
+	// finalized nor signed in a way that can be finalized.
+	ErrPSBTNotSigned = errors.New("PSBT is not signed")
+)
+
+// BuildBIP322PSBT returns the BIP322 to_sign transaction of msg, whose
+// signature is ignored, as a PSBT for a wallet holding the key of the output
+// pkScript to sign, such as a hardware wallet or bitcoin-cli
+// walletprocesspsbt. Its input spends the to_spend transaction committing to
+// msg.SignedData, and the outpoint of msg is recorded in a proprietary field.
+func BuildBIP322PSBT(msg *message.Message, pkScript []byte) (*psbt.Packet,
+	error) {
+
+	if len(pkScript) == 0 {
+		return nil, fmt.Errorf("empty output script")
+	}
+
+	toSpend, err := bip322ToSpend(pkScript, msg.SignedData())
+	if err != nil {
+		return nil, err
+	}
+	toSign, err := bip322ToSign(pkScript, msg.SignedData())
+	if err != nil {
+		return nil, err
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(toSign)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PSBT: %v", err)
+	}
+	packet.Inputs[0].WitnessUtxo = toSpend.TxOut[0]
+	if !txscript.IsPayToTaproot(pkScript) {
+		// Signers of segwit v0 inputs want the whole previous
+		// transaction
+		packet.Inputs[0].NonWitnessUtxo = toSpend
+	}
+	packet.Unknowns = append(packet.Unknowns, &psbt.Unknown{
+		Key:   psbtOutpointKey,
+		Value: append([]byte(nil), msg.Outpoint[:]...),
+	})
+	return packet, nil
+}
+
+// ExtractMessageFromPSBT returns msg signed with the witness of packet, a
+// PSBT built by BuildBIP322PSBT for msg and signed by a wallet. An input that
+// is signed but not finalized is finalized first. The witness is verified
+// against the output script of the PSBT. A taproot key-path signature fills
+// the signature field of the message, any other witness makes it a witness
+// message.
+func ExtractMessageFromPSBT(packet *psbt.Packet,
+	msg *message.Message) (*message.Message, error) {
+
+	if len(packet.UnsignedTx.TxIn) != 1 || len(packet.Inputs) != 1 {
+		return nil, fmt.Errorf("%w: expected a single input", ErrPSBTMismatch)
+	}
+	input := &packet.Inputs[0]
+	if input.WitnessUtxo == nil {
+		return nil, fmt.Errorf("%w: missing witness UTXO", ErrPSBTMismatch)
+	}
+	pkScript := input.WitnessUtxo.PkScript
+
+	toSign, err := bip322ToSign(pkScript, msg.SignedData())
+	if err != nil {
+		return nil, err
+	}
+	if packet.UnsignedTx.TxHash() != toSign.TxHash() {
+		return nil, fmt.Errorf("%w: it commits to a different payload "+
+			"or sequence", ErrPSBTMismatch)
+	}
+	for _, unknown := range packet.Unknowns {
+		if bytes.Equal(unknown.Key, psbtOutpointKey) &&
+			!bytes.Equal(unknown.Value, msg.Outpoint[:]) {
+
+			return nil, fmt.Errorf("%w: it was built for another outpoint",
+				ErrPSBTMismatch)
+		}
+	}
+
+	if input.FinalScriptWitness == nil {
+		if _, err := psbt.MaybeFinalize(packet, 0); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPSBTNotSigned, err)
+		}
+	}
+	if input.FinalScriptWitness == nil {
+		return nil, ErrPSBTNotSigned
+	}
+	witness, err := parseWitness(input.FinalScriptWitness)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyWitness(toSign, pkScript, witness); err != nil {
+		return nil, err
+	}
+
+	signed := *msg
+	signed.Signature = [message.SignatureSize]byte{}
+	signed.Witness = nil
+	if txscript.IsPayToTaproot(pkScript) && len(witness) == 1 &&
+		len(witness[0]) == message.SignatureSize {
+
+		copy(signed.Signature[:], witness[0])
+	} else {
+		signed.Witness = witness
+	}
+	return &signed, nil
+}
+
+// parseWitness decodes a witness serialized as in a PSBT final script
+// witness field.
+func parseWitness(data []byte) (wire.TxWitness, error) {
+	r := bytes.NewReader(data)
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil || count > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid final script witness")
+	}
+
+	witness := make(wire.TxWitness, count)
+	for i := range witness {
+		witness[i], err = wire.ReadVarBytes(r, 0, uint32(len(data)),
+			"witness item")
+		if err != nil {
+			return nil, fmt.Errorf("invalid final script witness: %v", err)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("invalid final script witness: %d trailing "+
+			"bytes", r.Len())
+	}
+	return witness, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// signPSBT signs the input of packet with key as an external wallet would,
+// leaving it to be finalized.
+func signPSBT(t *testing.T, packet *psbt.Packet, key *btcec.PrivateKey) {
+	t.Helper()
+
+	input := &packet.Inputs[0]
+	pkScript := input.WitnessUtxo.PkScript
+	prevFetcher := txscript.NewCannedPrevOutputFetcher(pkScript,
+		input.WitnessUtxo.Value)
+	sigHashes := txscript.NewTxSigHashes(packet.UnsignedTx, prevFetcher)
+
+	if txscript.IsPayToTaproot(pkScript) {
+		sig, err := txscript.RawTxInTaprootSignature(packet.UnsignedTx,
+			sigHashes, 0, input.WitnessUtxo.Value, pkScript, nil,
+			txscript.SigHashDefault, key)
+		if err != nil {
+			t.Fatalf("RawTxInTaprootSignature: %v", err)
+		}
+		input.TaprootKeySpendSig = sig
+		return
+	}
+
+	sig, err := txscript.RawTxInWitnessSignature(packet.UnsignedTx,
+		sigHashes, 0, input.WitnessUtxo.Value, pkScript,
+		txscript.SigHashAll, key)
+	if err != nil {
+		t.Fatalf("RawTxInWitnessSignature: %v", err)
+	}
+	input.PartialSigs = append(input.PartialSigs, &psbt.PartialSig{
+		PubKey:    key.PubKey().SerializeCompressed(),
+		Signature: sig,
+	})
+}
+
+// unsignedMessage returns the message for outpoint to be signed through a
+// PSBT.
+func unsignedMessage(t *testing.T, outpoint message.Outpoint,
+	text string) *message.Message {
+
+	t.Helper()
+
+	msg, err := message.NewMessage(outpoint, [message.SignatureSize]byte{},
+		message.ContentTypeText, []byte(text))
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+	msg.Sequence = 1
+	return msg
+}
+
+// TestPSBTRoundTrip checks that a message signed through a PSBT by a taproot
+// or P2WPKH key, encoded and decoded as it is handed to a wallet, passes the
+// validator against its UTXO.
+func TestPSBTRoundTrip(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, addrType := range []AddressType{AddressTaproot, AddressP2WPKH} {
+		pkScript, err := Script(key, addrType)
+		if err != nil {
+			t.Fatalf("%s: Script: %v", addrType, err)
+		}
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		client := mock.NewClient()
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+
+		msg := unsignedMessage(t, outpoint, "from my wallet")
+		packet, err := BuildBIP322PSBT(msg, pkScript)
+		if err != nil {
+			t.Fatalf("%s: BuildBIP322PSBT: %v", addrType, err)
+		}
+		encoded, err := packet.B64Encode()
+		if err != nil {
+			t.Fatalf("%s: B64Encode: %v", addrType, err)
+		}
+		packet, err = psbt.NewFromRawBytes(strings.NewReader(encoded), true)
+		if err != nil {
+			t.Fatalf("%s: NewFromRawBytes: %v", addrType, err)
+		}
+		signPSBT(t, packet, key)
+
+		signed, err := ExtractMessageFromPSBT(packet, msg)
+		if err != nil {
+			t.Fatalf("%s: ExtractMessageFromPSBT: %v", addrType, err)
+		}
+		if (addrType == AddressTaproot) != (signed.Witness == nil) {
+			t.Fatalf("%s: witness %x", addrType, signed.Witness)
+		}
+		if err := validate(client, signed); err != nil {
+			t.Fatalf("%s: message signed through a PSBT rejected: %v",
+				addrType, err)
+		}
+	}
+}
+
+// TestPSBTMismatch checks that a PSBT is refused for another message than
+// the one it was built for, and before it is signed or when signed by
+// another key.
+func TestPSBTMismatch(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+	msg := unsignedMessage(t, outpoint, "hello")
+	packet, err := BuildBIP322PSBT(msg, pkScript)
+	if err != nil {
+		t.Fatalf("BuildBIP322PSBT: %v", err)
+	}
+	if _, err := ExtractMessageFromPSBT(packet, msg); !errors.Is(err,
+		ErrPSBTNotSigned) {
+
+		t.Fatalf("unsigned PSBT gave %v, want ErrPSBTNotSigned", err)
+	}
+
+	signPSBT(t, packet, key)
+	tests := []struct {
+		name string
+		msg  *message.Message
+	}{
+		{"payload", unsignedMessage(t, outpoint, "goodbye")},
+		{"outpoint", unsignedMessage(t, message.NewOutpoint(
+			chainhash.Hash{2}, 0), "hello")},
+	}
+	for _, test := range tests {
+		_, err := ExtractMessageFromPSBT(packet, test.msg)
+		if !errors.Is(err, ErrPSBTMismatch) {
+			t.Fatalf("other %s gave %v, want ErrPSBTMismatch", test.name,
+				err)
+		}
+	}
+
+	forged, err := BuildBIP322PSBT(msg, pkScript)
+	if err != nil {
+		t.Fatalf("BuildBIP322PSBT: %v", err)
+	}
+	signPSBT(t, forged, other)
+	if _, err := ExtractMessageFromPSBT(forged, msg); err == nil {
+		t.Fatal("PSBT signed by another key accepted")
+	}
+}
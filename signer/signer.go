@@ -0,0 +1,294 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package signer creates signed UTXOchat messages. Messages are signed with
+// the BIP322 simple signature of a taproot key-path or P2WPKH spend, which is
+// what the node's validator checks against the UTXO a message claims.
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shaibearary/utxo_chat/descriptor"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// bip322Tag is the tag of the BIP322 message hash.
+const bip322Tag = "BIP0322-signed-message"
+
+var (
+	// ErrInvalidDescriptor is returned when a descriptor is not a single
+	// key taproot descriptor holding an extended private key.
+	ErrInvalidDescriptor = descriptor.ErrInvalidDescriptor
+
+	// ErrUnknownAddressType is returned for an address type other than
+	// p2tr and p2wpkh.
+	ErrUnknownAddressType = errors.New("unknown address type")
+)
+
+// AddressType is the type of output a key signs messages for.
+type AddressType string
+
+const (
+	// AddressTaproot is the BIP86 key-path only taproot output of a key.
+	AddressTaproot AddressType = "p2tr"
+
+	// AddressP2WPKH is the segwit v0 pay-to-witness-pubkey-hash output of
+	// the compressed public key.
+	AddressP2WPKH AddressType = "p2wpkh"
+)
+
+// ParseAddressType parses an address type name, case insensitively.
+func ParseAddressType(name string) (AddressType, error) {
+	addrType := AddressType(strings.ToLower(name))
+	switch addrType {
+	case AddressTaproot, AddressP2WPKH:
+		return addrType, nil
+	}
+	return "", fmt.Errorf("%w %q, expected p2tr or p2wpkh",
+		ErrUnknownAddressType, name)
+}
+
+// ParseDescriptor derives the private key of a single key taproot
+// descriptor such as tr(tprv.../86h/1h/0h/0/0)#checksum, as printed by
+// bitcoin-cli listdescriptors true, see descriptor.Parse. index is the child
+// derived from a range descriptor ending in /*, and must be zero otherwise.
+func ParseDescriptor(desc string, index uint32) (*btcec.PrivateKey, error) {
+	parsed, err := descriptor.Parse(desc)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.PrivateKey(index)
+}
+
+// TaprootScript returns the P2TR script of the BIP86 key-path only output
+// controlled by privKey.
+func TaprootScript(privKey *btcec.PrivateKey) ([]byte, error) {
+	outputKey := txscript.ComputeTaprootKeyNoScript(privKey.PubKey())
+	return txscript.PayToTaprootScript(outputKey)
+}
+
+// WitnessPubKeyHashScript returns the P2WPKH script of the compressed public
+// key of privKey.
+func WitnessPubKeyHashScript(privKey *btcec.PrivateKey) ([]byte, error) {
+	keyHash := btcutil.Hash160(privKey.PubKey().SerializeCompressed())
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(keyHash).
+		Script()
+}
+
+// Script returns the script of the output of type addrType controlled by
+// privKey.
+func Script(privKey *btcec.PrivateKey, addrType AddressType) ([]byte, error) {
+	switch addrType {
+	case AddressTaproot:
+		return TaprootScript(privKey)
+	case AddressP2WPKH:
+		return WitnessPubKeyHashScript(privKey)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownAddressType, addrType)
+	}
+}
+
+// Sign returns the BIP322 simple signature of payload by the taproot output
+// controlled by privKey. The signature is verified before it is returned.
+// Messages are signed over message.Message.SignedData.
+func Sign(privKey *btcec.PrivateKey, payload []byte) ([message.SignatureSize]byte, error) {
+	var sig [message.SignatureSize]byte
+
+	witness, err := SignWitness(privKey, AddressTaproot, payload)
+	if err != nil {
+		return sig, err
+	}
+
+	if len(witness) != 1 || len(witness[0]) != message.SignatureSize {
+		return sig, fmt.Errorf("unexpected witness for key path spend")
+	}
+	copy(sig[:], witness[0])
+	return sig, nil
+}
+
+// SignWitness returns the witness of the BIP322 simple signature of payload
+// by the output of type addrType controlled by privKey: a schnorr signature
+// for a taproot output, an ECDSA signature and the compressed public key for
+// a P2WPKH output. The witness is verified before it is returned.
+func SignWitness(privKey *btcec.PrivateKey, addrType AddressType,
+	payload []byte) (wire.TxWitness, error) {
+
+	pkScript, err := Script(privKey, addrType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s script: %w", addrType,
+			err)
+	}
+
+	toSign, err := bip322ToSign(pkScript, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	prevFetcher := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	sigHashes := txscript.NewTxSigHashes(toSign, prevFetcher)
+	var witness wire.TxWitness
+	if addrType == AddressTaproot {
+		witness, err = txscript.TaprootWitnessSignature(toSign, sigHashes,
+			0, 0, pkScript, txscript.SigHashDefault, privKey)
+	} else {
+		witness, err = txscript.WitnessSignature(toSign, sigHashes, 0, 0,
+			pkScript, txscript.SigHashAll, privKey, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create witness signature: %v", err)
+	}
+
+	// Run the script engine so a bad signature never leaves this package
+	if err := verifyWitness(toSign, pkScript, witness); err != nil {
+		return nil, err
+	}
+	return witness, nil
+}
+
+// verifyWitness checks that witness spends pkScript in the to_sign
+// transaction toSign, which it is set on.
+func verifyWitness(toSign *wire.MsgTx, pkScript []byte,
+	witness wire.TxWitness) error {
+
+	prevFetcher := txscript.NewCannedPrevOutputFetcher(pkScript, 0)
+	sigHashes := txscript.NewTxSigHashes(toSign, prevFetcher)
+	toSign.TxIn[0].Witness = witness
+	vm, err := txscript.NewEngine(pkScript, toSign, 0,
+		txscript.StandardVerifyFlags, nil, sigHashes, 0, prevFetcher)
+	if err != nil {
+		return fmt.Errorf("failed to create script engine: %v", err)
+	}
+	if err := vm.Execute(); err != nil {
+		return fmt.Errorf("signature verification failed: %v", err)
+	}
+	return nil
+}
+
+// SignMessage creates a message for outpoint signed by privKey, which must
+// control the taproot output at outpoint for the message to be accepted.
+func SignMessage(privKey *btcec.PrivateKey, outpoint message.Outpoint,
+	contentType message.ContentType, payload []byte) (*message.Message, error) {
+
+	return SignReplacement(privKey, outpoint, 0, contentType, payload)
+}
+
+// SignReplacement creates a message like SignMessage with the given sequence
+// number. It replaces a message for the same outpoint with a lower sequence.
+func SignReplacement(privKey *btcec.PrivateKey, outpoint message.Outpoint,
+	sequence uint32, contentType message.ContentType,
+	payload []byte) (*message.Message, error) {
+
+	return SignReplacementFor(privKey, AddressTaproot, outpoint, sequence,
+		contentType, payload)
+}
+
+// SignReplacementFor creates a message like SignReplacement for the output
+// of type addrType controlled by privKey. Taproot signatures fill the
+// signature field, other outputs sign with a witness message.
+func SignReplacementFor(privKey *btcec.PrivateKey, addrType AddressType,
+	outpoint message.Outpoint, sequence uint32,
+	contentType message.ContentType, payload []byte) (*message.Message, error) {
+
+	if err := CheckPayloadSize(len(payload),
+		message.DefaultLimits()); err != nil {
+
+		return nil, err
+	}
+
+	var sig [message.SignatureSize]byte
+	msg, err := message.NewMessage(outpoint, sig, contentType, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Sequence = sequence
+	if err := msg.ValidateContent(); err != nil {
+		return nil, err
+	}
+
+	if addrType == AddressTaproot {
+		msg.Signature, err = Sign(privKey, msg.SignedData())
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	msg.Witness, err = SignWitness(privKey, addrType, msg.SignedData())
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// BIP322Transactions returns the virtual to_spend and to_sign transactions
+// of the BIP322 simple signature of data by the output pkScript. The witness
+// of to_sign is left empty.
+func BIP322Transactions(pkScript, data []byte) (toSpend, toSign *wire.MsgTx,
+	err error) {
+
+	toSpend, err = bip322ToSpend(pkScript, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	toSign, err = bip322ToSign(pkScript, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return toSpend, toSign, nil
+}
+
+// bip322ToSign builds the virtual to_sign transaction of BIP322 spending the
+// to_spend transaction that commits to payload and pkScript.
+func bip322ToSign(pkScript, payload []byte) (*wire.MsgTx, error) {
+	toSpend, err := bip322ToSpend(pkScript, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	opReturn, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_RETURN).
+		Script()
+	if err != nil {
+		return nil, err
+	}
+
+	toSign := wire.NewMsgTx(0)
+	toSpendHash := toSpend.TxHash()
+	signIn := wire.NewTxIn(wire.NewOutPoint(&toSpendHash, 0), nil, nil)
+	signIn.Sequence = 0
+	toSign.AddTxIn(signIn)
+	toSign.AddTxOut(wire.NewTxOut(0, opReturn))
+	return toSign, nil
+}
+
+// bip322ToSpend builds the virtual to_spend transaction of BIP322, whose
+// only output pays to pkScript and whose input commits to payload.
+func bip322ToSpend(pkScript, payload []byte) (*wire.MsgTx, error) {
+	messageHash := chainhash.TaggedHash([]byte(bip322Tag), payload)
+	scriptSig, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(messageHash[:]).
+		Script()
+	if err != nil {
+		return nil, err
+	}
+
+	toSpend := wire.NewMsgTx(0)
+	prevOut := wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex)
+	spendIn := wire.NewTxIn(prevOut, scriptSig, nil)
+	spendIn.Sequence = 0
+	toSpend.AddTxIn(spendIn)
+	toSpend.AddTxOut(wire.NewTxOut(0, pkScript))
+	return toSpend, nil
+}
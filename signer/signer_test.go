@@ -0,0 +1,194 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/bitcoin/mock"
+	"github.com/shaibearary/utxo_chat/database"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// validate checks msg the way the node does, against the UTXO client holds
+// for its outpoint.
+func validate(client *mock.Client, msg *message.Message) error {
+	ctx := context.Background()
+	validator := database.NewValidator(client, database.NewMemoryDB())
+	txOut, err := validator.LookupUTXO(ctx, msg.Outpoint)
+	if err != nil {
+		return err
+	}
+	pkScript, err := validator.GetPKScript(txOut)
+	if err != nil {
+		return err
+	}
+	return validator.ValidateMessage(ctx, msg, pkScript)
+}
+
+// TestSignValidate checks that a message signed with a generated key for a
+// taproot or P2WPKH output is accepted by the validator given a fake txout
+// for it, and that it survives serialization.
+func TestSignValidate(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, addrType := range []AddressType{AddressTaproot, AddressP2WPKH} {
+		pkScript, err := Script(key, addrType)
+		if err != nil {
+			t.Fatalf("%s: Script: %v", addrType, err)
+		}
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 1)
+		client := mock.NewClient()
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+
+		msg, err := SignReplacementFor(key, addrType, outpoint, 2,
+			message.ContentTypeText, []byte("hello"))
+		if err != nil {
+			t.Fatalf("%s: SignReplacementFor: %v", addrType, err)
+		}
+		if err := validate(client, msg); err != nil {
+			t.Fatalf("%s: signed message rejected: %v", addrType, err)
+		}
+
+		decoded, err := message.Deserialize(msg.Serialize())
+		if err != nil {
+			t.Fatalf("%s: Deserialize: %v", addrType, err)
+		}
+		if !bytes.Equal(decoded.Serialize(), msg.Serialize()) ||
+			decoded.Outpoint != outpoint || decoded.Sequence != 2 ||
+			string(decoded.Payload) != "hello" {
+
+			t.Fatalf("%s: round trip gave %+v", addrType, decoded)
+		}
+		if err := validate(client, decoded); err != nil {
+			t.Fatalf("%s: decoded message rejected: %v", addrType, err)
+		}
+	}
+}
+
+// TestSignTampered checks that a signed message whose payload or sequence
+// changed, or that is signed by another key, is rejected.
+func TestSignTampered(t *testing.T) {
+	key, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{3}, 32))
+	other, _ := btcec.PrivKeyFromBytes(bytes.Repeat([]byte{4}, 32))
+	pkScript, err := TaprootScript(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+	client := mock.NewClient()
+	client.AddUTXO(outpoint.WireOutPoint(), 50000, pkScript)
+
+	sign := func(key *btcec.PrivateKey) *message.Message {
+		msg, err := SignMessage(key, outpoint, message.ContentTypeText,
+			[]byte("hello"))
+		if err != nil {
+			t.Fatalf("SignMessage: %v", err)
+		}
+		return msg
+	}
+
+	payload := sign(key)
+	payload.Payload[0] ^= 0x20
+	sequence := sign(key)
+	sequence.Sequence = 1
+	for name, msg := range map[string]*message.Message{
+		"payload":  payload,
+		"sequence": sequence,
+		"key":      sign(other),
+	} {
+		err := validate(client, msg)
+		if !errors.Is(err, message.ErrBadSignature) {
+			t.Fatalf("%s changed: got %v, want ErrBadSignature", name,
+				err)
+		}
+	}
+}
+
+// TestSignAddressType checks that a message signed for one type of output
+// is rejected for a UTXO of the other type of the same key, and that a
+// P2WPKH message whose payload changed is rejected.
+func TestSignAddressType(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []AddressType{AddressTaproot, AddressP2WPKH}
+	for i, addrType := range types {
+		other := types[1-i]
+		outpoint := message.NewOutpoint(chainhash.Hash{byte(i + 1)}, 0)
+		client := mock.NewClient()
+		client.AddUTXO(outpoint.WireOutPoint(), 50000,
+			mustScript(t, key, other))
+
+		msg, err := SignReplacementFor(key, addrType, outpoint, 0,
+			message.ContentTypeText, []byte("hello"))
+		if err != nil {
+			t.Fatalf("%s: SignReplacementFor: %v", addrType, err)
+		}
+		if err := validate(client, msg); err == nil {
+			t.Fatalf("message signed for %s accepted for a %s UTXO",
+				addrType, other)
+		}
+
+		if addrType != AddressP2WPKH {
+			continue
+		}
+		client.AddUTXO(outpoint.WireOutPoint(), 50000, mustScript(t, key,
+			addrType))
+		if err := validate(client, msg); err != nil {
+			t.Fatalf("%s: signed message rejected: %v", addrType, err)
+		}
+		msg.Payload[0] ^= 0x20
+		if err := validate(client, msg); !errors.Is(err,
+			message.ErrBadSignature) {
+
+			t.Fatalf("%s: changed payload gave %v, want "+
+				"ErrBadSignature", addrType, err)
+		}
+	}
+}
+
+// mustScript returns the script of the output of type addrType of key.
+func mustScript(t *testing.T, key *btcec.PrivateKey,
+	addrType AddressType) []byte {
+
+	t.Helper()
+
+	pkScript, err := Script(key, addrType)
+	if err != nil {
+		t.Fatalf("%s: Script: %v", addrType, err)
+	}
+	return pkScript
+}
+
+// TestParseAddressType checks that the address types are parsed case
+// insensitively and that others are refused.
+func TestParseAddressType(t *testing.T) {
+	for name, want := range map[string]AddressType{
+		"p2tr": AddressTaproot, "P2TR": AddressTaproot,
+		"p2wpkh": AddressP2WPKH, "P2WPKH": AddressP2WPKH,
+	} {
+		if got, err := ParseAddressType(name); err != nil || got != want {
+			t.Fatalf("%q parsed as %q, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"", "p2pkh", "p2sh-p2wpkh"} {
+		if _, err := ParseAddressType(name); !errors.Is(err,
+			ErrUnknownAddressType) {
+
+			t.Fatalf("%q gave %v, want ErrUnknownAddressType", name, err)
+		}
+	}
+}
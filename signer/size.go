@@ -0,0 +1,51 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// maxP2WPKHWitnessSize is the size of the serialized witness spending a
+// P2WPKH output with the longest DER signature: the item count, then the
+// signature with its sighash byte and the compressed public key, each length
+// prefixed.
+const maxP2WPKHWitnessSize = 1 + 1 + 72 + 1 + 1 + btcec.PubKeyBytesLenCompressed
+
+// MessageSize returns the size of the serialized message signed for an
+// output of type addrType with sequence and a payload of payloadSize bytes.
+// It is exact for taproot outputs. For P2WPKH outputs it counts the longest
+// DER signature, which the actual one may be a byte or two shorter than.
+func MessageSize(addrType AddressType, sequence uint32, payloadSize int) int {
+	switch {
+	case addrType != AddressTaproot:
+		return message.WitnessHeaderSize + maxP2WPKHWitnessSize + payloadSize
+	case sequence == 0:
+		return message.HeaderSize + payloadSize
+	default:
+		return message.ExtendedHeaderSize + payloadSize
+	}
+}
+
+// CheckPayloadSize checks a payload of size bytes against limits before it
+// is signed. The error tells by how many bytes the payload is over the
+// payload cap, and wraps message.ErrPayloadTooLarge if it is over the
+// protocol limit or message.ErrExceedsPolicy if only over the cap.
+func CheckPayloadSize(size int, limits message.Limits) error {
+	err := limits.CheckPayload(size)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, message.ErrPayloadTooLarge) {
+		err = message.ErrExceedsPolicy
+	}
+	limit := limits.PayloadCap()
+	return fmt.Errorf("%w: %d byte payload is %d bytes over the limit of %d",
+		err, size, size-limit, limit)
+}
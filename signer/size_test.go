@@ -0,0 +1,96 @@
+// Copyright (c) 2023 UTXOchat developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package signer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/shaibearary/utxo_chat/message"
+)
+
+// TestCheckPayloadSize checks that a payload at the limit passes, and that
+// one a byte over is refused with the exact overage and the error of the
+// limit it is over.
+func TestCheckPayloadSize(t *testing.T) {
+	capped := message.Limits{MaxPayloadSize: 1000}
+	tests := []struct {
+		limits message.Limits
+		size   int
+		want   error
+	}{
+		{capped, 1000, nil},
+		{capped, 1001, message.ErrExceedsPolicy},
+		{message.DefaultLimits(), message.MaxPayloadSize, nil},
+		{message.DefaultLimits(), message.MaxPayloadSize + 1,
+			message.ErrPayloadTooLarge},
+	}
+	for _, test := range tests {
+		err := CheckPayloadSize(test.size, test.limits)
+		if test.want == nil {
+			if err != nil {
+				t.Fatalf("%d bytes under %+v refused: %v", test.size,
+					test.limits, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.want) ||
+			!strings.Contains(err.Error(), "1 bytes over") {
+
+			t.Fatalf("%d bytes under %+v gave %v, want %v 1 byte over",
+				test.size, test.limits, err, test.want)
+		}
+	}
+}
+
+// TestMessageSize checks that MessageSize gives the exact size of signed
+// taproot messages, at most 2 bytes over that of P2WPKH ones, and that a
+// payload one byte over the protocol limit is refused before signing.
+func TestMessageSize(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outpoint := message.NewOutpoint(chainhash.Hash{1}, 0)
+
+	tests := []struct {
+		addrType AddressType
+		sequence uint32
+		size     int
+	}{
+		{AddressTaproot, 0, message.MaxPayloadSize},
+		{AddressTaproot, 1, 100},
+		{AddressP2WPKH, 0, message.MaxPayloadSize},
+		{AddressP2WPKH, 1, 100},
+	}
+	for _, test := range tests {
+		payload := bytes.Repeat([]byte{0xab}, test.size)
+		msg, err := SignReplacementFor(key, test.addrType, outpoint,
+			test.sequence, message.ContentTypeBinary, payload)
+		if err != nil {
+			t.Fatalf("%s: %d bytes at sequence %d: %v", test.addrType,
+				test.size, test.sequence, err)
+		}
+		got := len(msg.Serialize())
+		want := MessageSize(test.addrType, test.sequence, test.size)
+		if got > want || (test.addrType == AddressTaproot && got != want) ||
+			got < want-2 {
+
+			t.Fatalf("%s: signed %d bytes, MessageSize gave %d",
+				test.addrType, got, want)
+		}
+	}
+
+	payload := make([]byte, message.MaxPayloadSize+1)
+	_, err = SignReplacementFor(key, AddressTaproot, outpoint, 0,
+		message.ContentTypeBinary, payload)
+	if !errors.Is(err, message.ErrPayloadTooLarge) {
+		t.Fatalf("payload a byte over the limit gave %v", err)
+	}
+}